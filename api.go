@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/audit"
+	"github.com/Mxmilu666/nia-forwarding/config"
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/i18n"
+)
+
+// 规则API请求体的长度上限
+const maxRuleBody = 1 << 20
+
+// ruleAPI 通过指标HTTP服务在运行中创建和删除规则，请求须带有api_tokens中的令牌；
+// 监听端口为0的规则由系统分配空闲端口，响应中返回实际的监听地址
+type ruleAPI struct {
+	rules  *ruleManager
+	tokens map[string]string
+	audit  *audit.Log
+}
+
+// ruleResponse 创建规则的响应
+type ruleResponse struct {
+	Name      string          `json:"name"`
+	Listeners []health.Status `json:"listeners"` // Listen为实际的监听地址
+	Error     string          `json:"error,omitempty"`
+}
+
+// 没有配置令牌时返回nil，不提供规则API
+func newRuleAPI(rules *ruleManager, tokens map[string]string, auditLog *audit.Log) *ruleAPI {
+	if len(tokens) == 0 {
+		return nil
+	}
+	return &ruleAPI{rules: rules, tokens: tokens, audit: auditLog}
+}
+
+func (a *ruleAPI) register(mux *http.ServeMux) {
+	if a == nil {
+		return
+	}
+	mux.HandleFunc("POST /rules", a.create)
+	mux.HandleFunc("DELETE /rules/{name}", a.delete)
+}
+
+// 返回请求所带令牌的名称，用作审计日志中的操作者
+func (a *ruleAPI) actor(req *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	for _, name := range slices.Sorted(maps.Keys(a.tokens)) {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.tokens[name])) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// POST /rules 请求体为一条规则(YAML或JSON)，规则的所有监听器绑定成功后返回201和实际的监听地址；
+// 绑定失败时删除规则并返回422
+func (a *ruleAPI) create(w http.ResponseWriter, req *http.Request) {
+	actor, ok := a.actor(req)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("令牌无效"))
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxRuleBody))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	fc, err := a.rules.add(data)
+	switch {
+	case errors.Is(err, errRuleExists):
+		writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	resp := ruleResponse{Name: fc.Name, Listeners: a.rules.waitRule(req.Context(), fc.Name, fc.BindRetry+time.Second)}
+	status := http.StatusCreated
+	for _, s := range resp.Listeners {
+		if s.State != health.StateReady {
+			resp.Error = s.Error
+			if resp.Error == "" {
+				resp.Error = i18n.Translate("监听器未能在等待时间内就绪")
+			}
+			status = http.StatusUnprocessableEntity
+			break
+		}
+	}
+	if len(resp.Listeners) == 0 {
+		resp.Error = i18n.Translate("规则没有监听器")
+		status = http.StatusUnprocessableEntity
+	}
+	if status != http.StatusCreated {
+		a.rules.remove(fc.Name)
+	} else {
+		a.record(actor, fc.Name, &fc)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// DELETE /rules/{name} 停止并删除通过API创建的规则
+func (a *ruleAPI) delete(w http.ResponseWriter, req *http.Request) {
+	actor, ok := a.actor(req)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("令牌无效"))
+		return
+	}
+	name := req.PathValue("name")
+	switch err := a.rules.remove(name); {
+	case errors.Is(err, errRuleNotFound):
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	a.record(actor, name, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 记录规则的变更，fc为nil表示删除
+func (a *ruleAPI) record(actor, name string, fc *config.ForwardConfig) {
+	var after string
+	var err error
+	if fc != nil {
+		after, err = (&config.Config{Forwards: []config.ForwardConfig{*fc}}).Snapshot()
+	}
+	if err == nil {
+		err = a.audit.Record(actor, audit.ActionRuleChange, name, after)
+	}
+	if err != nil {
+		log.Printf("记录审计日志失败: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": i18n.Translate(err.Error())})
+}
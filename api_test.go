@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Mxmilu666/nia-forwarding/config"
+)
+
+// 启动带规则API的HTTP服务，令牌为"secret"
+func newTestAPI(t *testing.T, cfg *config.Config) (*ruleManager, *httptest.Server) {
+	t.Helper()
+	m := newTestManager(t, cfg)
+	m.startAll(cfg.Forwards)
+	mux := http.NewServeMux()
+	newRuleAPI(m, map[string]string{"ops": "secret"}, nil).register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return m, server
+}
+
+func apiRequest(t *testing.T, server *httptest.Server, method, path, token, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// 监听端口为0的规则由系统分配端口，响应返回实际的监听地址，删除后停止监听
+func TestRuleAPICreateEphemeral(t *testing.T) {
+	target := echoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	_, server := newTestAPI(t, &config.Config{})
+
+	body := fmt.Sprintf(`{"name": "dyn", "protocol": ["tcp"], "listen_ip": "127.0.0.1", "listen_ports": ["0"],
+		"target_ip": %q, "target_ports": [%q], "target_network": "ipv4", "log_level": "error"}`, host, port)
+	resp := apiRequest(t, server, http.MethodPost, "/rules", "secret", body)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("创建规则返回%d", resp.StatusCode)
+	}
+	var created ruleResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if len(created.Listeners) != 1 {
+		t.Fatalf("响应中有%d个监听器", len(created.Listeners))
+	}
+	listen := created.Listeners[0].Listen
+	if _, p, _ := net.SplitHostPort(listen); p == "0" || p == "" {
+		t.Fatalf("响应中的监听地址为%q，不是系统分配的端口", listen)
+	}
+	conn := dialRule(t, listen)
+	if err := roundTrip(conn, "hello"); err != nil {
+		t.Error(err)
+	}
+	conn.Close()
+
+	if resp := apiRequest(t, server, http.MethodPost, "/rules", "secret", body); resp.StatusCode != http.StatusConflict {
+		t.Errorf("重复创建规则返回%d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, server, http.MethodDelete, "/rules/dyn", "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("删除规则返回%d", resp.StatusCode)
+	}
+	if conn, err := net.Dial("tcp", listen); err == nil {
+		conn.Close()
+		t.Error("删除的规则仍在监听")
+	}
+	if resp := apiRequest(t, server, http.MethodDelete, "/rules/dyn", "secret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("删除不存在的规则返回%d", resp.StatusCode)
+	}
+}
+
+// 令牌错误时拒绝请求，配置文件中的规则不能通过API删除
+func TestRuleAPIRejects(t *testing.T) {
+	cfg := &config.Config{Forwards: []config.ForwardConfig{tcpRule("file", freePort(t), echoServer(t))}}
+	m, server := newTestAPI(t, cfg)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		want   int
+	}{
+		{"没有令牌", http.MethodPost, "/rules", "", `{"name": "x"}`, http.StatusUnauthorized},
+		{"令牌错误", http.MethodDelete, "/rules/file", "wrong", "", http.StatusUnauthorized},
+		{"未知的配置项", http.MethodPost, "/rules", "secret", `{"name": "x", "listen_portz": ["0"]}`, http.StatusBadRequest},
+		{"缺少名称", http.MethodPost, "/rules", "secret", `{"listen_ports": ["0"]}`, http.StatusBadRequest},
+		{"删除配置文件中的规则", http.MethodDelete, "/rules/file", "secret", "", http.StatusForbidden},
+		{"执行命令", http.MethodPost, "/rules", "secret", `{"name": "x", "listen_ports": ["0"], "on_disconnect": "touch /tmp/x"}`, http.StatusBadRequest},
+		{"加载中间件", http.MethodPost, "/rules", "secret", `{"name": "x", "listen_ports": ["0"], "middlewares": [{"name": "lua"}]}`, http.StatusBadRequest},
+		{"录制到本机目录", http.MethodPost, "/rules", "secret", `{"name": "x", "listen_ports": ["0"], "record_dir": "/tmp"}`, http.StatusBadRequest},
+		{"读取本机私钥", http.MethodPost, "/rules", "secret", `{"name": "x", "listen_ports": ["0"], "ssh_jump": {"host": "h:22", "key": "/root/.ssh/id_rsa"}}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := apiRequest(t, server, tt.method, tt.path, tt.token, tt.body); resp.StatusCode != tt.want {
+				t.Errorf("返回%d，应为%d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+	if _, ok := m.rules["file"]; !ok {
+		t.Error("配置文件中的规则被删除")
+	}
+}
@@ -0,0 +1,186 @@
+// Package audit 以只追加的JSON Lines文件记录配置变更和管理操作，便于多人运维时追溯
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 常用的操作类型
+const (
+	ActionConfigLoad   = "config_load"   // 启动时加载配置
+	ActionConfigReload = "config_reload" // 运行中重新加载配置
+	ActionRuleChange   = "rule_change"   // 通过API修改规则
+	ActionSessionKill  = "session_kill"  // 手动断开连接或会话
+)
+
+// 非API操作的操作者
+const (
+	ActorStartup = "startup" // 启动时加载配置
+	ActorSignal  = "signal"  // 收到SIGHUP后重新加载配置
+)
+
+// Record 一条审计记录
+type Record struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`            // 操作者，API操作为令牌名称
+	Action string    `json:"action"`           // 操作类型
+	Target string    `json:"target,omitempty"` // 操作对象，例如规则名称或会话ID
+	Diff   []string  `json:"diff,omitempty"`   // 变更前后的逐行差异，"-"为删除，"+"为新增
+	After  string    `json:"after,omitempty"`  // 变更后的内容，作为下一次变更的比较基准
+}
+
+// Log 审计日志，nil表示不记录
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+	last map[string]string // 每个操作对象最近一次记录的After
+}
+
+// Open 打开审计日志文件，path为空时返回nil；已有记录中各对象最近的内容作为后续比较的基准
+func Open(path string) (*Log, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	l := &Log{last: make(map[string]string)}
+	if err := l.load(path); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("无法打开审计日志: %w", err)
+	}
+	l.file = f
+	return l, nil
+}
+
+// 读取已有记录，文件不存在时忽略
+func (l *Log) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("无法读取审计日志: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var r Record
+		if json.Unmarshal(scanner.Bytes(), &r) != nil {
+			continue
+		}
+		if r.After != "" {
+			l.last[key(r.Action, r.Target)] = r.After
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("无法读取审计日志: %w", err)
+	}
+	return nil
+}
+
+// 配置的加载和重载共用比较基准
+func key(action, target string) string {
+	if action == ActionConfigReload {
+		action = ActionConfigLoad
+	}
+	return action + "\x00" + target
+}
+
+// Record 记录一条操作，after为变更后的内容，与该对象上一次记录的内容比较生成差异
+func (l *Log) Record(actor, action, target, after string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := key(action, target)
+	r := Record{
+		Time:   time.Now(),
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		After:  after,
+	}
+	if before, ok := l.last[k]; ok {
+		r.Diff = Diff(before, after)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("写入审计日志失败: %w", err)
+	}
+	if after != "" {
+		l.last[k] = after
+	}
+	return nil
+}
+
+// Close 关闭审计日志文件
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Diff 逐行比较两段文本，只返回变化的行
+func Diff(before, after string) []string {
+	a := splitLines(before)
+	b := splitLines(after)
+
+	// lcs[i][j]为a[i:]和b[j:]的最长公共子序列长度
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+a[i])
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	return diff
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
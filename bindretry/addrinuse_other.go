@@ -0,0 +1,16 @@
+//go:build !windows
+
+package bindretry
+
+import (
+	"errors"
+	"syscall"
+)
+
+func addrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+func addrNotAvail(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL)
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package bindretry
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+func addrInUse(err error) bool {
+	return errors.Is(err, windows.WSAEADDRINUSE)
+}
+
+func addrNotAvail(err error) bool {
+	return errors.Is(err, windows.WSAEADDRNOTAVAIL)
+}
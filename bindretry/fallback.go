@@ -0,0 +1,17 @@
+package bindretry
+
+// Fallback 调用preferred绑定首选端口，地址被占用时依次调用bind尝试ports中的端口，返回绑定结果和实际使用的备用端口；
+// 使用首选端口时返回的端口为0，备用端口全部无法绑定时返回首选端口的错误。同一规则的多个监听器可以共享ports，
+// 已被占用的端口由系统拒绝绑定
+func Fallback[T any](ports []int, preferred func() (T, error), bind func(port int) (T, error)) (T, int, error) {
+	l, err := preferred()
+	if err == nil || len(ports) == 0 || !addrInUse(err) {
+		return l, 0, err
+	}
+	for _, port := range ports {
+		if fl, ferr := bind(port); ferr == nil {
+			return fl, port, nil
+		}
+	}
+	return l, 0, err
+}
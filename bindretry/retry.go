@@ -0,0 +1,70 @@
+// Package bindretry 在监听地址暂时被占用时按退避间隔重试绑定，
+// 例如重启后旧连接处于TIME_WAIT，或上一个进程尚未完全退出
+package bindretry
+
+import (
+	"context"
+	"time"
+)
+
+// 重试间隔从initialWait开始逐次加倍，不超过maxWait
+const (
+	initialWait = 100 * time.Millisecond
+	maxWait     = 5 * time.Second
+)
+
+// Listen 调用bind绑定监听地址，地址被占用时按退避间隔重试，直到成功、累计等待超过period或ctx取消；
+// period不大于0时不重试，其他错误也不重试。每次等待前调用onRetry，ctx取消时返回ctx.Err()
+func Listen[T any](ctx context.Context, period time.Duration, onRetry func(err error, wait time.Duration), bind func() (T, error)) (T, error) {
+	deadline := time.Now().Add(period)
+	wait := initialWait
+	for {
+		l, err := bind()
+		if err == nil || period <= 0 || !addrInUse(err) {
+			return l, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return l, err
+		}
+		wait = min(wait, remaining.Round(time.Millisecond))
+		if onRetry != nil {
+			onRetry(err, wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			var zero T
+			return zero, ctx.Err()
+		case <-timer.C:
+		}
+		wait = min(wait*2, maxWait)
+	}
+}
+
+// WaitAddress 调用listen绑定监听地址，地址在本机不存在(例如网卡尚未启动或尚未获得该地址)时
+// 等待changed返回的通道关闭后重试，直到成功或ctx取消；changed返回nil时不等待直接返回错误。
+// 每次等待前调用onWait，ctx取消时返回ctx.Err()
+func WaitAddress[T any](ctx context.Context, changed func() <-chan struct{}, onWait func(err error), listen func() (T, error)) (T, error) {
+	for {
+		// 在绑定前取得通知通道，以免错过绑定失败和开始等待之间发生的变化
+		ch := changed()
+		l, err := listen()
+		if err == nil || ch == nil || !addrNotAvail(err) {
+			return l, err
+		}
+		if onWait != nil {
+			onWait(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		case <-ch:
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package chaos
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrInjectedReset 故障注入主动重置了连接
+var ErrInjectedReset = errors.New("故障注入: 连接已重置")
+
+// Config 故障注入参数，零值表示不注入对应的故障
+type Config struct {
+	Latency          time.Duration // 每块数据或每个数据包的额外延迟
+	Jitter           time.Duration // 延迟在 ±Jitter 范围内随机波动
+	Bandwidth        int64         // 每个连接每个方向的带宽上限(字节/秒)
+	ResetProbability float64       // TCP每次写入前重置连接的概率
+
+	// 以下仅作用于UDP，每个方向独立计算
+	LossPercent    float64       // 丢弃数据包的百分比
+	ReorderPercent float64       // 被额外推迟以打乱顺序的数据包百分比
+	ReorderDelay   time.Duration // 乱序数据包的额外延迟，默认为DefaultReorderDelay
+}
+
+// 乱序数据包的默认额外延迟
+const DefaultReorderDelay = 20 * time.Millisecond
+
+// Injector 按配置向转发流量注入故障
+type Injector struct {
+	cfg Config
+}
+
+// New 创建故障注入器，配置为零值时返回nil表示不注入
+func New(cfg Config) *Injector {
+	if cfg == (Config{}) {
+		return nil
+	}
+	return &Injector{cfg: cfg}
+}
+
+// Delay 返回一次发送应附加的延迟，包含抖动，不小于0
+func (in *Injector) Delay() time.Duration {
+	if in == nil {
+		return 0
+	}
+	d := in.cfg.Latency
+	if in.cfg.Jitter > 0 {
+		d += time.Duration(rand.Int64N(int64(2*in.cfg.Jitter)+1)) - in.cfg.Jitter
+	}
+	return max(d, 0)
+}
+
+// Writer 包装写往conn的数据流，注入延迟、带宽限制和连接重置；in为nil时直接返回conn
+func (in *Injector) Writer(conn net.Conn) io.Writer {
+	if in == nil {
+		return conn
+	}
+	return &writer{in: in, conn: conn}
+}
+
+type writer struct {
+	in   *Injector
+	conn net.Conn
+	next time.Time // 带宽限制下允许下一次写入的时间
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	cfg := w.in.cfg
+
+	if cfg.ResetProbability > 0 && rand.Float64() < cfg.ResetProbability {
+		reset(w.conn)
+		return 0, ErrInjectedReset
+	}
+
+	if d := w.in.Delay(); d > 0 {
+		time.Sleep(d)
+	}
+
+	if cfg.Bandwidth <= 0 {
+		return w.conn.Write(b)
+	}
+
+	// 按带宽分片写入，每片约为十分之一秒的流量
+	chunk := max(int(cfg.Bandwidth/10), 1)
+	written := 0
+	for written < len(b) {
+		if wait := time.Until(w.next); wait > 0 {
+			time.Sleep(wait)
+		}
+		end := min(written+chunk, len(b))
+		n, err := w.conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		now := time.Now()
+		if w.next.Before(now) {
+			w.next = now
+		}
+		w.next = w.next.Add(time.Duration(int64(n) * int64(time.Second) / cfg.Bandwidth))
+	}
+	return written, nil
+}
+
+// 以RST方式关闭TCP连接
+func reset(conn net.Conn) {
+	if tc, ok := underlyingTCP(conn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func underlyingTCP(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Shaper 为数据包计算发送延迟，包含固定延迟、抖动和带宽排队时间
+type Shaper struct {
+	in   *Injector
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewShaper 为一个方向的数据包流创建整形器，in为nil时返回nil
+func (in *Injector) NewShaper() *Shaper {
+	if in == nil {
+		return nil
+	}
+	return &Shaper{in: in}
+}
+
+// Schedule 返回大小为n的数据包应推迟发送的时间，drop为true时应丢弃该数据包
+func (s *Shaper) Schedule(n int) (d time.Duration, drop bool) {
+	if s == nil {
+		return 0, false
+	}
+	cfg := s.in.cfg
+
+	if cfg.LossPercent > 0 && rand.Float64()*100 < cfg.LossPercent {
+		return 0, true
+	}
+
+	d = s.in.Delay()
+	if cfg.ReorderPercent > 0 && rand.Float64()*100 < cfg.ReorderPercent {
+		// 推迟这个数据包，使其后发送的数据包先到达
+		if cfg.ReorderDelay > 0 {
+			d += cfg.ReorderDelay
+		} else {
+			d += DefaultReorderDelay
+		}
+	}
+
+	if bw := s.in.cfg.Bandwidth; bw > 0 {
+		s.mu.Lock()
+		now := time.Now()
+		if s.next.Before(now) {
+			s.next = now
+		}
+		d += s.next.Sub(now)
+		s.next = s.next.Add(time.Duration(int64(n) * int64(time.Second) / bw))
+		s.mu.Unlock()
+	}
+	return d, false
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DelayRange 固定或随机的延迟，配置中写为 "50ms" 或 "20ms-80ms"
+type DelayRange struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// ParseDelayRange 解析延迟字符串
+func ParseDelayRange(s string) (DelayRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return DelayRange{}, nil
+	}
+
+	first, second, isRange := strings.Cut(s, "-")
+	lo, err := time.ParseDuration(strings.TrimSpace(first))
+	if err != nil || lo < 0 {
+		return DelayRange{}, fmt.Errorf("无效的延迟: %s", s)
+	}
+	if !isRange {
+		return DelayRange{Min: lo, Max: lo}, nil
+	}
+
+	hi, err := time.ParseDuration(strings.TrimSpace(second))
+	if err != nil || hi < lo {
+		return DelayRange{}, fmt.Errorf("无效的延迟范围: %s", s)
+	}
+	return DelayRange{Min: lo, Max: hi}, nil
+}
+
+// IsZero 是否未配置延迟
+func (d DelayRange) IsZero() bool {
+	return d.Max == 0
+}
+
+// String 格式化为配置中的写法
+func (d DelayRange) String() string {
+	if d.Min == d.Max {
+		return d.Min.String()
+	}
+	return d.Min.String() + "-" + d.Max.String()
+}
+
+// UnmarshalYAML 实现yaml.Unmarshaler
+func (d *DelayRange) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	parsed, err := ParseDelayRange(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// MarshalYAML 实现yaml.Marshaler
+func (d DelayRange) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
@@ -0,0 +1,34 @@
+package config
+
+import "reflect"
+
+// merge 把后加载的配置文件src合并到dst，合并规则与文件顺序有关且确定：
+//   - 列表(forwards)按文件顺序追加
+//   - 映射(groups)按键合并，同名的键以后面的文件为准
+//   - 其余配置项在后面的文件中配置了(非零值)时整项替换，例如defaults和reverse_server不逐字段合并
+func merge(dst, src *Config) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src).Elem()
+	for i := 0; i < d.NumField(); i++ {
+		df, sf := d.Field(i), s.Field(i)
+		switch sf.Kind() {
+		case reflect.Slice:
+			df.Set(reflect.AppendSlice(df, sf))
+		case reflect.Map:
+			if sf.Len() == 0 {
+				continue
+			}
+			if df.IsNil() {
+				df.Set(reflect.MakeMapWithSize(sf.Type(), sf.Len()))
+			}
+			iter := sf.MapRange()
+			for iter.Next() {
+				df.SetMapIndex(iter.Key(), iter.Value())
+			}
+		default:
+			if !sf.IsZero() {
+				df.Set(sf)
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion 当前的配置文件格式版本，没有version字段的配置文件为第1版
+const CurrentVersion = 1
+
+// migration 把配置文件从from版本升级到下一个版本
+type migration struct {
+	from  int
+	apply func(root *yaml.Node) ([]edit, error)
+}
+
+// 按版本顺序排列的升级步骤，重命名或调整配置项时在末尾追加一步并增加CurrentVersion
+var migrations = []migration{}
+
+// edit 对原文中一个键或值的替换，只改动所在行，不影响其余内容的行号和注释
+type edit struct {
+	line, col int // 从1开始，col按字符计
+	old, new  string
+	desc      string
+}
+
+func mappingKey(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i]
+		}
+	}
+	return nil
+}
+
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Migrate 把配置文件内容升级到当前版本，返回升级后的内容和变更说明，已是当前版本时changes为空；
+// addVersion为false时不为缺少version字段的配置插入该字段，使内容的行号与原文一致
+func Migrate(data []byte, addVersion bool) (out []byte, changes []string, err error) {
+	root, err := parseNode(data)
+	if err != nil || root == nil {
+		return data, nil, err
+	}
+
+	version := 1
+	versionNode := mappingValue(root, "version")
+	if versionNode != nil {
+		version, err = strconv.Atoi(versionNode.Value)
+		if err != nil || version < 1 {
+			return nil, nil, fmt.Errorf("第%d行: 无效的配置文件版本: %q", versionNode.Line, versionNode.Value)
+		}
+	}
+	if version > CurrentVersion {
+		return nil, nil, fmt.Errorf("配置文件版本%d高于本程序支持的版本%d，请升级程序", version, CurrentVersion)
+	}
+	if version == CurrentVersion {
+		return data, nil, nil
+	}
+
+	for _, m := range migrations {
+		if m.from < version {
+			continue
+		}
+		edits, err := m.apply(root)
+		if err != nil {
+			return nil, nil, err
+		}
+		if data, err = applyEdits(data, edits); err != nil {
+			return nil, nil, err
+		}
+		for _, e := range edits {
+			changes = append(changes, e.desc)
+		}
+		if root, err = parseNode(data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// 更新或插入版本号
+	target := strconv.Itoa(CurrentVersion)
+	if versionNode != nil {
+		data, err = applyEdits(data, []edit{{line: versionNode.Line, col: versionNode.Column, old: versionNode.Value, new: target}})
+		if err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, fmt.Sprintf("第%d行: version 由%d更新为%d", versionNode.Line, version, CurrentVersion))
+	} else if addVersion {
+		data = append([]byte("version: "+target+"\n"), data...)
+		changes = append(changes, fmt.Sprintf("添加 version: %d", CurrentVersion))
+	}
+	return data, changes, nil
+}
+
+// MigrateFile 原地升级配置文件，原文件保存为.bak备份，返回变更说明
+func MigrateFile(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取配置文件: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取配置文件: %w", err)
+	}
+
+	out, changes, err := Migrate(data, true)
+	if err != nil || len(changes) == 0 {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path+".bak", data, info.Mode().Perm()); err != nil {
+		return nil, fmt.Errorf("无法备份配置文件: %w", err)
+	}
+	if err := os.WriteFile(path, out, info.Mode().Perm()); err != nil {
+		return nil, fmt.Errorf("无法写入配置文件: %w", err)
+	}
+	return changes, nil
+}
+
+func parseNode(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("无法解析配置文件: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	return doc.Content[0], nil
+}
+
+// 在原文上执行替换，同一行内从后往前替换以免影响前面的列号
+func applyEdits(data []byte, edits []edit) ([]byte, error) {
+	lines := strings.SplitAfter(string(data), "\n")
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].line != edits[j].line {
+			return edits[i].line < edits[j].line
+		}
+		return edits[i].col > edits[j].col
+	})
+	for _, e := range edits {
+		if e.line < 1 || e.line > len(lines) {
+			return nil, fmt.Errorf("第%d行: 无法自动迁移", e.line)
+		}
+		line := []rune(lines[e.line-1])
+		start := e.col - 1
+		if start < 0 || start+len([]rune(e.old)) > len(line) || string(line[start:start+len([]rune(e.old))]) != e.old {
+			return nil, fmt.Errorf("第%d行: 无法自动迁移%s，请手动修改", e.line, e.old)
+		}
+		lines[e.line-1] = string(line[:start]) + e.new + string(line[start+len([]rune(e.old)):])
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParsePorts 解析端口列表，返回所有端口的切片
+func ParsePorts(portsArray []string) ([]int, error) {
+	var allPorts []int
+
+	for _, portsStr := range portsArray {
+		ports, err := parsePorts(portsStr)
+		if err != nil {
+			return nil, err
+		}
+		allPorts = append(allPorts, ports...)
+	}
+
+	return allPorts, nil
+}
+
+// ParseListenPorts 与ParsePorts相同，另外接受单独的"0"，表示由系统分配空闲端口；
+// 配置文件中的规则在加载时已检查，只有通过API创建的规则会出现0
+func ParseListenPorts(portsArray []string) ([]int, error) {
+	if len(portsArray) == 1 && strings.TrimSpace(portsArray[0]) == "0" {
+		return []int{0}, nil
+	}
+	return ParsePorts(portsArray)
+}
+
+// 解析单个端口范围/列表字符串，返回所有端口的切片
+func parsePorts(portsStr string) ([]int, error) {
+	var ports []int
+
+	// 先按逗号分割，处理可能的多个区间或单端口
+	parts := strings.Split(portsStr, ",")
+
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		// 检查是否为端口范围 (例如 "8080-8085")
+		if strings.Contains(part, "-") {
+			rangeParts := strings.Split(part, "-")
+			if len(rangeParts) != 2 {
+				return nil, fmt.Errorf("端口范围格式无效: %s", part)
+			}
+
+			start, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
+			if err != nil {
+				return nil, fmt.Errorf("无效的起始端口: %s", rangeParts[0])
+			}
+
+			end, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+			if err != nil {
+				return nil, fmt.Errorf("无效的结束端口: %s", rangeParts[1])
+			}
+
+			if start > end {
+				return nil, fmt.Errorf("端口范围无效，起始端口大于结束端口: %d > %d", start, end)
+			}
+			if err := checkPort(start); err != nil {
+				return nil, err
+			}
+			if err := checkPort(end); err != nil {
+				return nil, err
+			}
+
+			// 添加范围内的所有端口
+			for port := start; port <= end; port++ {
+				ports = append(ports, port)
+			}
+		} else {
+			// 单个端口
+			port, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("无效的端口号: %s", part)
+			}
+			if err := checkPort(port); err != nil {
+				return nil, err
+			}
+			ports = append(ports, port)
+		}
+	}
+
+	return ports, nil
+}
+
+func checkPort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("端口号超出范围(1-65535): %d", port)
+	}
+	return nil
+}
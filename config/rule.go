@@ -0,0 +1,39 @@
+package config
+
+import (
+	"errors"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ParseRule 解析通过API提交的一条规则(YAML或JSON)，按loaded中的目标组和WireGuard隧道检查并补全默认值；
+// 与配置文件中的规则不同，listen_ports可以为["0"]，由系统分配空闲端口
+func ParseRule(data []byte, loaded *Config) (ForwardConfig, error) {
+	var fc ForwardConfig
+	if err := decodeStrict("rule", data, &fc); err != nil {
+		return fc, err
+	}
+	if fc.Name == "" {
+		return fc, errors.New("规则需要名称")
+	}
+
+	v := &validator{file: "rule", ephemeral: true}
+	var doc yaml.Node
+	if yaml.Unmarshal(data, &doc) == nil && len(doc.Content) > 0 {
+		v.root = doc.Content[0]
+	}
+	v.forward(nil, &fc, loaded.Groups, loaded.WireGuard)
+	if len(v.problems) > 0 {
+		sort.SliceStable(v.problems, func(i, j int) bool {
+			return v.problems[i].Line < v.problems[j].Line
+		})
+		return fc, v.problems
+	}
+
+	c := &Config{Defaults: loaded.Defaults, Forwards: []ForwardConfig{fc}}
+	c.applyDefaults()
+	fc = c.Forwards[0]
+	fc.Enabled = true
+	return fc, nil
+}
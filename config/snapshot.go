@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 快照中隐去取值的字段
+var secretKeys = map[string]bool{
+	"key":      true,
+	"token":    true,
+	"password": true,
+
+	"private_key":   true, // WireGuard隧道
+	"preshared_key": true,
+}
+
+// 快照中隐去所有取值的映射，例如以令牌名称为键的api_tokens
+var secretMaps = map[string]bool{
+	"api_tokens": true,
+}
+
+// Snapshot 返回隐去密钥、令牌和密码的YAML配置，用于审计日志
+func (c *Config) Snapshot() (string, error) {
+	var doc yaml.Node
+	if err := doc.Encode(c); err != nil {
+		return "", fmt.Errorf("无法序列化配置: %w", err)
+	}
+	redact(&doc)
+
+	data, err := marshalYAML(&doc)
+	if err != nil {
+		return "", fmt.Errorf("无法序列化配置: %w", err)
+	}
+	return string(data), nil
+}
+
+func redact(n *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		for _, child := range n.Content {
+			redact(child)
+		}
+		return
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if secretKeys[key.Value] && value.Kind == yaml.ScalarNode && value.Value != "" {
+			value.SetString("******")
+			continue
+		}
+		if secretMaps[key.Value] && value.Kind == yaml.MappingNode {
+			for j := 1; j < len(value.Content); j += 2 {
+				value.Content[j].SetString("******")
+			}
+			continue
+		}
+		redact(value)
+	}
+}
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 变量引用，例如 "{{host}}" 或 "{{ port }}"
+var varRef = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// expandTemplate 替换vars中定义的变量并展开规则的foreach循环，未使用模板时原样返回；
+// lines把展开后内容的行号映射回原文的行号，用于错误信息。
+// vars传入之前的配置文件中定义的变量，本文件定义的变量会加入其中，同名时覆盖
+//
+//	vars:
+//	  backend: "[::1]"
+//	forwards:
+//	  - name: "web-{{port}}"
+//	    foreach:
+//	      port: "8080-8082"   # 端口表达式，或取值列表；多个变量时按位置一一对应
+//	    target_ip: "{{backend}}"
+//	    listen_ports: ["{{port}}"]
+func expandTemplate(file string, data []byte, vars map[string]string) (out []byte, lines map[int]int, err error) {
+	root, err := parseNode(data)
+	if err != nil || root == nil || root.Kind != yaml.MappingNode {
+		return data, nil, nil
+	}
+
+	forwards := mappingValue(root, "forwards")
+	hasLoop := false
+	if forwards != nil && forwards.Kind == yaml.SequenceNode {
+		for _, rule := range forwards.Content {
+			if mappingKey(rule, "foreach") != nil {
+				hasLoop = true
+			}
+		}
+	}
+	varsNode := mappingValue(root, "vars")
+	if varsNode == nil && !hasLoop && len(vars) == 0 {
+		return data, nil, nil
+	}
+
+	if err := readVars(file, varsNode, vars); err != nil {
+		return nil, nil, err
+	}
+	removeKey(root, "vars")
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		value := root.Content[i+1]
+		if value == forwards {
+			continue
+		}
+		if err := substitute(file, value, vars); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if forwards != nil && forwards.Kind == yaml.SequenceNode {
+		var rules []*yaml.Node
+		for _, rule := range forwards.Content {
+			expanded, err := expandRule(file, rule, vars)
+			if err != nil {
+				return nil, nil, err
+			}
+			rules = append(rules, expanded...)
+		}
+		forwards.Content = rules
+	} else if forwards != nil {
+		if err := substitute(file, forwards, vars); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	out, err = yaml.Marshal(root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("无法展开配置模板: %w", err)
+	}
+	reparsed, err := parseNode(out)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines = make(map[int]int)
+	mapLines(root, reparsed, lines)
+	return out, lines, nil
+}
+
+// 把vars中的变量读入vars，取值须为标量
+func readVars(file string, node *yaml.Node, vars map[string]string) error {
+	if node == nil {
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return &Problem{File: file, Line: node.Line, Path: "vars", Msg: "vars须为变量名到取值的映射"}
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, value := node.Content[i], node.Content[i+1]
+		if value.Kind != yaml.ScalarNode {
+			return &Problem{File: file, Line: value.Line, Path: "vars." + name.Value, Msg: "变量的取值须为字符串或数字"}
+		}
+		vars[name.Value] = value.Value
+	}
+	return nil
+}
+
+// 展开一条规则，没有foreach时只替换变量
+func expandRule(file string, rule *yaml.Node, vars map[string]string) ([]*yaml.Node, error) {
+	loop := mappingValue(rule, "foreach")
+	if loop == nil {
+		return []*yaml.Node{rule}, substitute(file, rule, vars)
+	}
+	if err := substitute(file, loop, vars); err != nil {
+		return nil, err
+	}
+	if loop.Kind != yaml.MappingNode || len(loop.Content) == 0 {
+		return nil, &Problem{File: file, Line: loop.Line, Path: "foreach", Msg: "foreach须为变量名到取值列表的映射"}
+	}
+
+	// 每个循环变量的取值，多个变量按位置一一对应
+	var names []string
+	var values [][]string
+	for i := 0; i+1 < len(loop.Content); i += 2 {
+		name, node := loop.Content[i].Value, loop.Content[i+1]
+		var list []string
+		switch node.Kind {
+		case yaml.ScalarNode:
+			ports, err := parsePorts(node.Value)
+			if err != nil {
+				return nil, &Problem{File: file, Line: node.Line, Path: "foreach." + name, Msg: err.Error()}
+			}
+			for _, port := range ports {
+				list = append(list, strconv.Itoa(port))
+			}
+		case yaml.SequenceNode:
+			for _, item := range node.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, &Problem{File: file, Line: item.Line, Path: "foreach." + name, Msg: "变量的取值须为字符串或数字"}
+				}
+				list = append(list, item.Value)
+			}
+		default:
+			return nil, &Problem{File: file, Line: node.Line, Path: "foreach." + name, Msg: "取值须为端口表达式或列表"}
+		}
+		if len(values) > 0 && len(list) != len(values[0]) {
+			return nil, &Problem{File: file, Line: node.Line, Path: "foreach." + name,
+				Msg: fmt.Sprintf("取值数量(%d)与%s的取值数量(%d)不同", len(list), names[0], len(values[0]))}
+		}
+		names = append(names, name)
+		values = append(values, list)
+	}
+
+	removeKey(rule, "foreach")
+	var rules []*yaml.Node
+	for i := range values[0] {
+		scope := make(map[string]string, len(vars)+len(names))
+		for k, v := range vars {
+			scope[k] = v
+		}
+		for j, name := range names {
+			scope[name] = values[j][i]
+		}
+		copied := copyNode(rule)
+		if err := substitute(file, copied, scope); err != nil {
+			return nil, err
+		}
+		rules = append(rules, copied)
+	}
+	return rules, nil
+}
+
+// 替换节点中所有标量取值里的变量引用，映射的键不替换；
+// 整个取值只有一个引用时按替换后的内容重新判断类型，使 "{{size}}" 可以用于数字字段
+func substitute(file string, node *yaml.Node, vars map[string]string) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !varRef.MatchString(node.Value) {
+			return nil
+		}
+		var undefined string
+		whole := varRef.FindStringIndex(node.Value)
+		single := whole[0] == 0 && whole[1] == len(node.Value)
+		node.Value = varRef.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			name := varRef.FindStringSubmatch(ref)[1]
+			value, ok := vars[name]
+			if !ok && undefined == "" {
+				undefined = name
+			}
+			return value
+		})
+		if undefined != "" {
+			return &Problem{File: file, Line: node.Line, Msg: fmt.Sprintf("未定义的变量 %q", undefined)}
+		}
+		if single {
+			node.Tag = ""
+			node.Style = 0
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := substitute(file, node.Content[i], vars); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, child := range node.Content {
+			if err := substitute(file, child, vars); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func copyNode(node *yaml.Node) *yaml.Node {
+	copied := *node
+	copied.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		copied.Content[i] = copyNode(child)
+	}
+	return &copied
+}
+
+func removeKey(m *yaml.Node, key string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content = slices.Delete(m.Content, i, i+2)
+			return
+		}
+	}
+}
+
+// 同时遍历展开后的语法树和重新解析的语法树，记录新行号对应的原文行号
+func mapLines(orig, reparsed *yaml.Node, lines map[int]int) {
+	if _, ok := lines[reparsed.Line]; !ok {
+		lines[reparsed.Line] = orig.Line
+	}
+	for i := 0; i < len(orig.Content) && i < len(reparsed.Content); i++ {
+		mapLines(orig.Content[i], reparsed.Content[i], lines)
+	}
+}
+
+// remapLines 把错误中展开后内容的行号换算为原文的行号
+func remapLines(err error, lines map[int]int) error {
+	if lines == nil {
+		return err
+	}
+	var problems Problems
+	var problem *Problem
+	switch {
+	case errors.As(err, &problems):
+		for _, p := range problems {
+			p.Line = lines[p.Line]
+		}
+	case errors.As(err, &problem):
+		problem.Line = lines[problem.Line]
+	}
+	return err
+}
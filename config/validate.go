@@ -0,0 +1,528 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Mxmilu666/nia-forwarding/dnscache"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+)
+
+// Problem 配置中的一处错误
+type Problem struct {
+	File string
+	Line int    // 0表示无法定位
+	Path string // 例如 "forwards[0].listen_ip"
+	Msg  string
+}
+
+func (p *Problem) Error() string {
+	switch {
+	case p.Line > 0 && p.Path != "":
+		return fmt.Sprintf("%s:%d: %s: %s", p.File, p.Line, p.Path, p.Msg)
+	case p.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Msg)
+	case p.Path != "":
+		return fmt.Sprintf("%s: %s: %s", p.File, p.Path, p.Msg)
+	}
+	return fmt.Sprintf("%s: %s", p.File, p.Msg)
+}
+
+// Problems 配置中的所有错误，按行号排序
+type Problems []*Problem
+
+func (ps Problems) Error() string {
+	lines := make([]string, len(ps))
+	for i, p := range ps {
+		lines[i] = p.Error()
+	}
+	return fmt.Sprintf("配置文件有误:\n  %s", strings.Join(lines, "\n  "))
+}
+
+// yaml.v3类型错误的格式，例如 "line 5: field listen_port not found in type config.ForwardConfig"
+var (
+	yamlLinePattern  = regexp.MustCompile(`^line (\d+): (.*)$`)
+	unknownKeyFormat = regexp.MustCompile(`^field (\S+) not found in type (\S+)$`)
+)
+
+// decodeStrict 严格解析配置或单条规则，未知的键和类型不符的值都作为错误报告
+func decodeStrict(file string, data []byte, out interface{}) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(out)
+	// 空文件没有任何文档
+	if err == nil || errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return &Problem{File: file, Msg: strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+
+	var problems Problems
+	for _, msg := range typeErr.Errors {
+		p := &Problem{File: file, Msg: msg}
+		if m := yamlLinePattern.FindStringSubmatch(msg); m != nil {
+			p.Line, _ = strconv.Atoi(m[1])
+			p.Msg = m[2]
+		}
+		if m := unknownKeyFormat.FindStringSubmatch(p.Msg); m != nil {
+			p.Msg = fmt.Sprintf("未知的配置项 %q", m[1])
+			if hint := suggestKey(m[1], m[2]); hint != "" {
+				p.Msg += fmt.Sprintf("，是否为 %q?", hint)
+			}
+		}
+		problems = append(problems, p)
+	}
+	return problems
+}
+
+// 配置中所有结构体类型的yaml键，用于为拼错的键给出建议
+var knownKeys = func() map[string][]string {
+	keys := make(map[string][]string)
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || t.PkgPath() != reflect.TypeOf(Config{}).PkgPath() {
+			return
+		}
+		if _, ok := keys[t.String()]; ok {
+			return
+		}
+		keys[t.String()] = nil
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			keys[t.String()] = append(keys[t.String()], name)
+			walk(f.Type)
+		}
+	}
+	walk(reflect.TypeOf(Config{}))
+	return keys
+}()
+
+// 返回与key最接近的合法键，差别过大时返回空字符串
+func suggestKey(key, typeName string) string {
+	best, bestDist := "", 3
+	for _, name := range knownKeys[typeName] {
+		d := editDistance(key, name)
+		if d < bestDist || (d == bestDist && best == "") {
+			best, bestDist = name, d
+		}
+	}
+	if bestDist > 2 || bestDist > len(key)/2 {
+		return ""
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// validator 检查解析后的配置，并借助YAML语法树定位出错的行
+type validator struct {
+	file     string
+	root     *yaml.Node
+	problems Problems
+
+	ephemeral bool // 允许监听端口为0，由系统分配空闲端口，只用于通过API创建的规则
+}
+
+// validate 检查IP地址、端口表达式等取值，返回所有发现的错误；
+// loaded为之前的配置文件合并后的配置，本文件的规则可以引用其中的目标组，但规则名称不能与其重复
+func validate(file string, data []byte, cfg, loaded *Config) error {
+	v := &validator{file: file}
+	var doc yaml.Node
+	if yaml.Unmarshal(data, &doc) == nil && len(doc.Content) > 0 {
+		v.root = doc.Content[0]
+	}
+
+	if d := cfg.Defaults; d != nil {
+		if _, err := logging.ParseLevel(d.LogLevel); err != nil {
+			v.report([]interface{}{"defaults", "log_level"}, "%v", err)
+		}
+		if d.LogSample < 0 {
+			v.report([]interface{}{"defaults", "log_sample"}, "抽样率不能为负数")
+		}
+		v.network([]interface{}{"defaults", "listen_network"}, d.ListenNetwork)
+		v.network([]interface{}{"defaults", "target_network"}, d.TargetNetwork)
+	}
+	if c := cfg.DNSCache; c != nil {
+		if c.MinTTL < 0 {
+			v.report([]interface{}{"dns_cache", "min_ttl"}, "缓存时间不能为负数")
+		}
+		if c.MaxTTL < 0 {
+			v.report([]interface{}{"dns_cache", "max_ttl"}, "缓存时间不能为负数")
+		} else if c.MaxTTL > 0 && c.MinTTL > c.MaxTTL {
+			v.report([]interface{}{"dns_cache", "max_ttl"}, "max_ttl不能小于min_ttl")
+		}
+	}
+	for i, server := range cfg.DNSServers {
+		if err := dnscache.ParseServer(server); err != nil {
+			v.report([]interface{}{"dns_servers", i}, "%v", err)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.APITokens)) {
+		if cfg.APITokens[name] == "" {
+			v.report([]interface{}{"api_tokens", name}, "令牌不能为空")
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Groups)) {
+		addrs := cfg.Groups[name]
+		if len(addrs) == 0 {
+			v.report([]interface{}{"groups", name}, "目标组 %q 没有目标", name)
+		}
+		for j, addr := range addrs {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				v.report([]interface{}{"groups", name, j}, "无效的地址 %q", addr)
+			}
+		}
+	}
+	if c := cfg.ICMPTunnel; c != nil {
+		if c.Role != "client" && c.Role != "server" {
+			v.report([]interface{}{"icmp_tunnel", "role"}, "无效的role %q，应为client或server", c.Role)
+		}
+		for i, svc := range c.Services {
+			if svc.Protocol != "" && svc.Protocol != "udp" {
+				v.report([]interface{}{"icmp_tunnel", "services", i, "protocol"}, "ICMP隧道只能转发UDP，不支持 %q", svc.Protocol)
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.WireGuard)) {
+		v.wireGuard(name, cfg.WireGuard[name])
+	}
+	groups := make(map[string][]string, len(loaded.Groups)+len(cfg.Groups))
+	maps.Copy(groups, loaded.Groups)
+	maps.Copy(groups, cfg.Groups)
+	tunnels := make(map[string]WireGuardConfig, len(loaded.WireGuard)+len(cfg.WireGuard))
+	maps.Copy(tunnels, loaded.WireGuard)
+	maps.Copy(tunnels, cfg.WireGuard)
+	names := make(map[string]bool, len(loaded.Forwards))
+	for _, fc := range loaded.Forwards {
+		names[fc.Name] = true
+	}
+	for i := range cfg.Forwards {
+		fc := &cfg.Forwards[i]
+		if fc.Name != "" && names[fc.Name] {
+			v.report([]interface{}{"forwards", i, "name"}, "规则名称 %q 已在之前的配置文件中定义", fc.Name)
+		}
+		v.forward([]interface{}{"forwards", i}, fc, groups, tunnels)
+	}
+
+	if len(v.problems) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		return v.problems[i].Line < v.problems[j].Line
+	})
+	return v.problems
+}
+
+// forward 检查一条规则，rule为规则在语法树中的路径
+func (v *validator) forward(rule []interface{}, fc *ForwardConfig, groups map[string][]string, tunnels map[string]WireGuardConfig) {
+	at := func(path ...interface{}) []interface{} {
+		return append(append([]interface{}(nil), rule...), path...)
+	}
+
+	for j, protocol := range fc.Protocol {
+		switch protocol {
+		case "tcp", "udp", "ip", "dns", "sip":
+		default:
+			v.report(at("protocol", j), "不支持的协议 %q，应为tcp、udp、ip、dns或sip", protocol)
+		}
+	}
+
+	if err := checkHost(fc.ListenIP); err != nil {
+		v.report(at("listen_ip"), "%v", err)
+	}
+	if err := checkHost(fc.TargetIP); err != nil {
+		v.report(at("target_ip"), "%v", err)
+	}
+	if fc.SIPAdvertiseIP != "" && net.ParseIP(fc.SIPAdvertiseIP) == nil {
+		v.report(at("sip_advertise_ip"), "无效的IP地址: %q", fc.SIPAdvertiseIP)
+	}
+	if fc.FTPAdvertiseIP != "" && net.ParseIP(fc.FTPAdvertiseIP).To4() == nil {
+		v.report(at("ftp_advertise_ip"), "无效的IPv4地址: %q", fc.FTPAdvertiseIP)
+	}
+	if fc.WakeMAC != "" {
+		if mac, err := net.ParseMAC(fc.WakeMAC); err != nil || len(mac) != 6 {
+			v.report(at("wake_mac"), "无效的MAC地址: %q", fc.WakeMAC)
+		}
+		if fc.TargetGroup != "" {
+			v.report(at("wake_mac"), "网络唤醒不能与目标组同时使用")
+		}
+	}
+	if fc.WakeBroadcast != "" {
+		if _, _, err := net.SplitHostPort(fc.WakeBroadcast); err != nil {
+			v.report(at("wake_broadcast"), "无效的地址 %q", fc.WakeBroadcast)
+		}
+	}
+	if fc.TargetGroup != "" {
+		if _, ok := groups[fc.TargetGroup]; !ok {
+			v.report(at("target_group"), "未定义的目标组 %q", fc.TargetGroup)
+		}
+		if fc.TargetIP != "" || len(fc.TargetPorts) > 0 || fc.TargetUnix != "" || fc.TargetPipe != "" || fc.TargetSerial != nil {
+			v.report(at("target_group"), "target_group不能与其他目标配置同时使用")
+		}
+		if slices.Contains(fc.Protocol, "ip") {
+			v.report(at("target_group"), "目标组仅用于TCP和UDP")
+		}
+	}
+	if fc.WireGuard != "" {
+		if _, ok := tunnels[fc.WireGuard]; !ok {
+			v.report(at("wireguard"), "未定义的WireGuard隧道 %q", fc.WireGuard)
+		}
+		if fc.UpstreamProxy != "" || fc.SSHJump != nil {
+			v.report(at("wireguard"), "wireguard不能与upstream_proxy和ssh_jump同时使用")
+		}
+	}
+	// 通过API创建的规则不能执行命令、加载中间件或读写本机文件，持有令牌不等于可以在本机执行代码
+	if v.ephemeral {
+		for _, f := range []struct {
+			path []interface{}
+			set  bool
+		}{
+			{at("on_connect"), fc.OnConnect != ""},
+			{at("on_disconnect"), fc.OnDisconnect != ""},
+			{at("middlewares"), len(fc.Middlewares) > 0},
+			{at("record_dir"), fc.RecordDir != ""},
+			{at("ssh_jump", "key"), fc.SSHJump != nil && fc.SSHJump.Key != ""},
+			{at("ssh_jump", "known_hosts"), fc.SSHJump != nil && fc.SSHJump.KnownHosts != ""},
+		} {
+			if f.set {
+				v.report(f.path, "通过API创建的规则不能配置此项")
+			}
+		}
+	}
+	for j, expr := range fc.ListenPorts {
+		if v.ephemeral && strings.TrimSpace(expr) == "0" {
+			continue
+		}
+		if _, err := parsePorts(expr); err != nil {
+			v.report(at("listen_ports", j), "%v", err)
+		}
+	}
+	for j, expr := range fc.FallbackPorts {
+		if _, err := parsePorts(expr); err != nil {
+			v.report(at("fallback_ports", j), "%v", err)
+		}
+	}
+	for j, expr := range fc.TargetPorts {
+		if _, err := parsePorts(expr); err != nil {
+			v.report(at("target_ports", j), "%v", err)
+		}
+	}
+	for _, host := range slices.Sorted(maps.Keys(fc.HostRoutes)) {
+		if _, _, err := net.SplitHostPort(fc.HostRoutes[host]); err != nil {
+			v.report(at("host_routes", host), "无效的地址 %q", fc.HostRoutes[host])
+		}
+	}
+	for j, expr := range fc.FTPPassivePorts {
+		if _, err := parsePorts(expr); err != nil {
+			v.report(at("ftp_passive_ports", j), "%v", err)
+		}
+	}
+	for j, expr := range fc.RTSPMediaPorts {
+		if _, err := parsePorts(expr); err != nil {
+			v.report(at("rtsp_media_ports", j), "%v", err)
+		}
+	}
+	for j, expr := range fc.SIPMediaPorts {
+		if _, err := parsePorts(expr); err != nil {
+			v.report(at("sip_media_ports", j), "%v", err)
+		}
+	}
+	for _, domain := range slices.Sorted(maps.Keys(fc.DNSRoutes)) {
+		if _, _, err := net.SplitHostPort(fc.DNSRoutes[domain]); err != nil {
+			v.report(at("dns_routes", domain), "无效的地址 %q", fc.DNSRoutes[domain])
+		}
+	}
+	for j, addr := range fc.FanOutTargets {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			v.report(at("fanout_targets", j), "无效的地址 %q", addr)
+		}
+	}
+
+	if _, err := logging.ParseLevel(fc.LogLevel); err != nil {
+		v.report(at("log_level"), "%v", err)
+	}
+	if fc.LogSample < 0 {
+		v.report(at("log_sample"), "抽样率不能为负数")
+	}
+	if fc.TargetPool < 0 {
+		v.report(at("target_pool"), "连接数不能为负数")
+	}
+	if fc.Weight < 0 {
+		v.report(at("weight"), "权重不能为负数")
+	}
+	v.network(at("listen_network"), fc.ListenNetwork)
+	v.network(at("target_network"), fc.TargetNetwork)
+}
+
+// wireGuard 检查WireGuard隧道的密钥、地址和对端
+func (v *validator) wireGuard(name string, c WireGuardConfig) {
+	at := func(path ...interface{}) []interface{} {
+		return append([]interface{}{"wireguard", name}, path...)
+	}
+
+	v.key(at("private_key"), c.PrivateKey)
+	if len(c.Address) == 0 {
+		v.report(at("address"), "未配置隧道内地址")
+	} else if _, err := c.Addresses(); err != nil {
+		v.report(at("address"), "%v", err)
+	}
+	if c.MTU != 0 && (c.MTU < 1280 || c.MTU > 65535) {
+		v.report(at("mtu"), "MTU应在1280到65535之间")
+	}
+	if len(c.Peers) == 0 {
+		v.report(at("peers"), "未配置对端")
+	}
+	for j, p := range c.Peers {
+		v.key(at("peers", j, "public_key"), p.PublicKey)
+		if p.PresharedKey != "" {
+			v.key(at("peers", j, "preshared_key"), p.PresharedKey)
+		}
+		if p.Endpoint != "" {
+			if _, _, err := net.SplitHostPort(p.Endpoint); err != nil {
+				v.report(at("peers", j, "endpoint"), "无效的地址 %q", p.Endpoint)
+			}
+		}
+		if _, err := p.Prefixes(); err != nil {
+			v.report(at("peers", j, "allowed_ips"), "%v", err)
+		}
+	}
+}
+
+// key 检查base64编码的WireGuard密钥
+func (v *validator) key(path []interface{}, key string) {
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 32 {
+		v.report(path, "无效的密钥，应为base64编码的32字节")
+	}
+}
+
+func (v *validator) network(path []interface{}, network string) {
+	switch network {
+	case "", "ipv4", "ipv6", "dual":
+	default:
+		v.report(path, "无效的IP协议族 %q，应为ipv4、ipv6或dual", network)
+	}
+}
+
+// 主机名的每一段由字母、数字和连字符组成
+var hostnameLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+
+// checkHost 检查IP地址或主机名，IPv6地址可以带方括号，空字符串表示未配置
+func checkHost(host string) error {
+	if host == "" {
+		return nil
+	}
+	ip := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	ip, _, _ = strings.Cut(ip, "%") // IPv6链路本地地址的网卡名
+	if net.ParseIP(ip) != nil {
+		return nil
+	}
+
+	// 看起来像IP地址却无法解析的，例如 "10.0.0.256" 或 "::g"
+	if strings.Contains(ip, ":") || strings.Trim(ip, "0123456789.") == "" {
+		return fmt.Errorf("无效的IP地址: %q", host)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("无效的IP地址或主机名: %q", host)
+		}
+	}
+	return nil
+}
+
+func (v *validator) report(path []interface{}, format string, args ...interface{}) {
+	v.problems = append(v.problems, &Problem{
+		File: v.file,
+		Line: v.line(path),
+		Path: pathString(path),
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// 返回路径对应节点所在的行，找不到时返回最近的上级节点的行
+func (v *validator) line(path []interface{}) int {
+	node := v.root
+	if node == nil {
+		return 0
+	}
+	line := node.Line
+	for _, elem := range path {
+		var next *yaml.Node
+		switch elem := elem.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == elem {
+						next = node.Content[i+1]
+						break
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && elem < len(node.Content) {
+				next = node.Content[elem]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node, line = next, next.Line
+	}
+	return line
+}
+
+func pathString(path []interface{}) string {
+	var b strings.Builder
+	for _, elem := range path {
+		switch elem := elem.(type) {
+		case string:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(elem)
+		case int:
+			fmt.Fprintf(&b, "[%d]", elem)
+		}
+	}
+	return b.String()
+}
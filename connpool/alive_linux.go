@@ -0,0 +1,30 @@
+package connpool
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCP连接按内核中的连接状态判断，目标发送欢迎信息后关闭的连接也能发现；其他连接窥探接收缓冲区
+func alive(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return peek(sc)
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	established := false
+	raw.Control(func(fd uintptr) {
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		established = err == nil && info.State == unix.BPF_TCP_ESTABLISHED
+	})
+	return established
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package connpool
+
+import "net"
+
+// 该平台上不检查连接，目标关闭的连接在转发时才发现
+func alive(conn net.Conn) bool {
+	return true
+}
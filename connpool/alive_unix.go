@@ -0,0 +1,16 @@
+//go:build unix && !linux
+
+package connpool
+
+import (
+	"net"
+	"syscall"
+)
+
+func alive(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	return peek(sc)
+}
@@ -0,0 +1,200 @@
+// Package connpool 保存到目标的空闲TCP连接供新的客户端连接直接取用：可以预先建立连接，
+// 不必等待连接目标(例如远距离或需要TLS握手的后端)，也可以放回客户端断开后仍然可用的连接，减少目标的连接数变化
+package connpool
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxIdle 连接在池中保留的默认最长时间，许多服务会关闭长时间没有数据的连接
+const DefaultMaxIdle = time.Minute
+
+// DefaultSize 只复用连接、不预先建立时默认保存的空闲连接数
+const DefaultSize = 8
+
+// 连接目标失败后重试的最短和最长间隔
+const (
+	minRetry = time.Second
+	maxRetry = 30 * time.Second
+)
+
+// Options 连接池的配置
+type Options struct {
+	Size    int                      // 保存的空闲连接数上限
+	MaxIdle time.Duration            // 连接在池中的最长时间，超过后关闭，0为DefaultMaxIdle
+	Dial    func() (net.Conn, error) // 不为nil时预先建立连接，使池中始终有Size个空闲连接
+	OnError func(err error)          // 建立连接失败时调用，可以为nil
+}
+
+// Pool 到一个目标的空闲连接池，nil表示不使用连接池
+type Pool struct {
+	opts   Options
+	idle   chan idleConn
+	wake   chan struct{}
+	closed atomic.Bool // Run已退出，放回的连接直接关闭
+}
+
+type idleConn struct {
+	conn    net.Conn
+	created time.Time
+}
+
+// New 创建连接池，Size<=0时返回nil；须调用Run建立和维护连接
+func New(opts Options) *Pool {
+	if opts.Size <= 0 {
+		return nil
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = DefaultMaxIdle
+	}
+	return &Pool{
+		opts: opts,
+		idle: make(chan idleConn, opts.Size),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Run 关闭过期的连接并预先建立被取走和过期的连接，连接失败时按退避间隔重试，直到上下文取消后关闭所有空闲连接
+func (p *Pool) Run(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	defer func() {
+		p.closed.Store(true)
+		p.closeIdle()
+	}()
+
+	ticker := time.NewTicker(max(p.opts.MaxIdle/4, time.Second))
+	defer ticker.Stop()
+	retry := minRetry
+	var retryTimer <-chan time.Time
+	for {
+		if retryTimer == nil {
+			if err := p.fill(ctx); err != nil {
+				if p.opts.OnError != nil {
+					p.opts.OnError(err)
+				}
+				retryTimer = time.After(retry)
+				retry = min(retry*2, maxRetry)
+			} else {
+				retry = minRetry
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-retryTimer:
+			retryTimer = nil
+		case <-ticker.C:
+			p.expire()
+		}
+	}
+}
+
+// 建立连接直到池满，没有Dial时只保存放回的连接
+func (p *Pool) fill(ctx context.Context) error {
+	for p.opts.Dial != nil && len(p.idle) < cap(p.idle) && ctx.Err() == nil {
+		conn, err := p.opts.Dial()
+		if err != nil {
+			return err
+		}
+		select {
+		case p.idle <- idleConn{conn: conn, created: time.Now()}:
+		default:
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+// 关闭过期或已被目标关闭的空闲连接，留给fill补充
+func (p *Pool) expire() {
+	for n := len(p.idle); n > 0; n-- {
+		select {
+		case c := <-p.idle:
+			if !p.usable(c) {
+				c.conn.Close()
+				continue
+			}
+			select {
+			case p.idle <- c:
+			default:
+				c.conn.Close()
+			}
+		default:
+			return
+		}
+	}
+	p.notify()
+}
+
+func (p *Pool) usable(c idleConn) bool {
+	return time.Since(c.created) < p.opts.MaxIdle && alive(c.conn)
+}
+
+func (p *Pool) closeIdle() {
+	for {
+		select {
+		case c := <-p.idle:
+			c.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// 唤醒Run补充连接
+func (p *Pool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Get 取出一个可用的空闲连接，池中没有可用连接时立即返回nil，由调用者自行连接目标
+func (p *Pool) Get() net.Conn {
+	if p == nil {
+		return nil
+	}
+	defer p.notify()
+	for {
+		select {
+		case c := <-p.idle:
+			if p.usable(c) {
+				return c.conn
+			}
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Put 放回仍然可用的连接，池已满时关闭该连接；连接在池中的保留时间从放回时算起
+func (p *Pool) Put(conn net.Conn) {
+	if p == nil {
+		conn.Close()
+		return
+	}
+	select {
+	case p.idle <- idleConn{conn: conn, created: time.Now()}:
+	default:
+		conn.Close()
+	}
+	if p.closed.Load() {
+		p.closeIdle()
+	}
+}
+
+// Idle 返回池中的空闲连接数
+func (p *Pool) Idle() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.idle)
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package connpool
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// 不阻塞地窥探连接：目标已关闭连接或连接出错时返回false；目标先发送的数据(例如SSH或SMTP的欢迎信息)留在接收缓冲区中，
+// 此时无法得知其后是否还有关闭
+func peek(sc syscall.Conn) bool {
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	ok := true
+	raw.Read(func(fd uintptr) bool {
+		var b [1]byte
+		n, _, err := unix.Recvfrom(int(fd), b[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		ok = n > 0 || errors.Is(err, unix.EAGAIN)
+		return true
+	})
+	return ok
+}
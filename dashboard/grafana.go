@@ -0,0 +1,193 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// 面板使用的数据源变量
+const datasource = "${datasource}"
+
+// 规则过滤条件，对应仪表盘中的rule变量
+const ruleFilter = `rule=~"$rule"`
+
+type panel struct {
+	title   string
+	unit    string
+	kind    string // "timeseries" 或 "stat"
+	targets []target
+}
+
+type target struct {
+	expr   string
+	legend string
+}
+
+var panels = []panel{
+	{
+		title: "吞吐量 (客户端 → 目标)",
+		unit:  "bps",
+		kind:  "timeseries",
+		targets: []target{
+			{`sum by (rule, protocol) (rate(nia_forwarding_bytes_up_total{` + ruleFilter + `}[$__rate_interval])) * 8`, "{{rule}} {{protocol}}"},
+		},
+	},
+	{
+		title: "吞吐量 (目标 → 客户端)",
+		unit:  "bps",
+		kind:  "timeseries",
+		targets: []target{
+			{`sum by (rule, protocol) (rate(nia_forwarding_bytes_down_total{` + ruleFilter + `}[$__rate_interval])) * 8`, "{{rule}} {{protocol}}"},
+		},
+	},
+	{
+		title: "当前连接/会话数",
+		unit:  "short",
+		kind:  "timeseries",
+		targets: []target{
+			{`sum by (rule, protocol) (nia_forwarding_active_connections{` + ruleFilter + `})`, "{{rule}} {{protocol}}"},
+		},
+	},
+	{
+		title: "新建连接/会话速率",
+		unit:  "cps",
+		kind:  "timeseries",
+		targets: []target{
+			{`sum by (rule, protocol) (rate(nia_forwarding_connections_total{` + ruleFilter + `}[$__rate_interval]))`, "{{rule}} {{protocol}}"},
+		},
+	},
+	{
+		title: "错误速率",
+		unit:  "short",
+		kind:  "timeseries",
+		targets: []target{
+			{`sum by (rule, protocol) (rate(nia_forwarding_errors_total{` + ruleFilter + `}[$__rate_interval]))`, "{{rule}} {{protocol}}"},
+		},
+	},
+	{
+		title: "按目标和类别的错误速率",
+		unit:  "short",
+		kind:  "timeseries",
+		targets: []target{
+			{`sum by (rule, target, class) (rate(nia_forwarding_classified_errors_total{` + ruleFilter + `}[$__rate_interval]))`, "{{rule}} {{target}} {{class}}"},
+		},
+	},
+	{
+		title: "内存用量",
+		unit:  "bytes",
+		kind:  "timeseries",
+		targets: []target{
+			{`nia_forwarding_memory_bytes`, "{{instance}}"},
+		},
+	},
+	{
+		title: "文件描述符余量",
+		unit:  "short",
+		kind:  "stat",
+		targets: []target{
+			{`nia_forwarding_fd_limit - nia_forwarding_open_fds`, "{{instance}}"},
+		},
+	},
+	{
+		title: "连接持续时间",
+		unit:  "s",
+		kind:  "timeseries",
+		targets: []target{
+			{`histogram_quantile(0.5, sum by (le, rule) (rate(nia_forwarding_connection_duration_seconds_bucket{` + ruleFilter + `}[$__rate_interval])))`, "p50 {{rule}}"},
+			{`histogram_quantile(0.95, sum by (le, rule) (rate(nia_forwarding_connection_duration_seconds_bucket{` + ruleFilter + `}[$__rate_interval])))`, "p95 {{rule}}"},
+		},
+	},
+	{
+		title: "单连接传输量",
+		unit:  "bytes",
+		kind:  "timeseries",
+		targets: []target{
+			{`histogram_quantile(0.5, sum by (le, rule) (rate(nia_forwarding_connection_bytes_bucket{` + ruleFilter + `}[$__rate_interval])))`, "p50 {{rule}}"},
+			{`histogram_quantile(0.95, sum by (le, rule) (rate(nia_forwarding_connection_bytes_bucket{` + ruleFilter + `}[$__rate_interval])))`, "p95 {{rule}}"},
+		},
+	},
+	{
+		title: "累计流量",
+		unit:  "bytes",
+		kind:  "stat",
+		targets: []target{
+			{`sum(nia_forwarding_bytes_up_total{` + ruleFilter + `}) + sum(nia_forwarding_bytes_down_total{` + ruleFilter + `})`, "total"},
+		},
+	},
+}
+
+// Generate 生成可直接导入Grafana的仪表盘JSON，指标名和标签与/metrics输出一致
+func Generate() ([]byte, error) {
+	ds := map[string]string{"type": "prometheus", "uid": datasource}
+
+	var list []map[string]interface{}
+	for i, p := range panels {
+		var targets []map[string]interface{}
+		for j, t := range p.targets {
+			targets = append(targets, map[string]interface{}{
+				"datasource":   ds,
+				"expr":         t.expr,
+				"legendFormat": t.legend,
+				"refId":        string(rune('A' + j)),
+			})
+		}
+
+		// 两列布局，每个面板宽12高8
+		list = append(list, map[string]interface{}{
+			"id":         i + 1,
+			"type":       p.kind,
+			"title":      p.title,
+			"datasource": ds,
+			"gridPos":    map[string]int{"x": (i % 2) * 12, "y": (i / 2) * 8, "w": 12, "h": 8},
+			"fieldConfig": map[string]interface{}{
+				"defaults":  map[string]interface{}{"unit": p.unit},
+				"overrides": []interface{}{},
+			},
+			"targets": targets,
+		})
+	}
+
+	dashboard := map[string]interface{}{
+		"title":         "nia-forwarding",
+		"uid":           "nia-forwarding",
+		"tags":          []string{"nia-forwarding"},
+		"timezone":      "browser",
+		"schemaVersion": 39,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"panels":        list,
+		"templating": map[string]interface{}{
+			"list": []interface{}{
+				map[string]interface{}{
+					"name":  "datasource",
+					"label": "数据源",
+					"type":  "datasource",
+					"query": "prometheus",
+				},
+				map[string]interface{}{
+					"name":       "rule",
+					"label":      "规则",
+					"type":       "query",
+					"datasource": ds,
+					"query":      "label_values(nia_forwarding_connections_total, rule)",
+					"refresh":    2,
+					"multi":      true,
+					"includeAll": true,
+					"allValue":   ".*",
+					"current":    map[string]interface{}{"text": "All", "value": "$__all"},
+				},
+			},
+		},
+	}
+
+	return json.MarshalIndent(dashboard, "", "  ")
+}
+
+// Save 将生成的仪表盘写入文件
+func Save(filePath string) error {
+	data, err := Generate()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0644)
+}
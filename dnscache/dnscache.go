@@ -0,0 +1,275 @@
+// Package dnscache 在进程内缓存目标主机名的解析结果，缓存时间限制在最小和最大TTL之间，
+// 域名不存在的结果也缓存一段时间，避免每次连接目标都查询系统解析器
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTTL 系统解析器不返回记录的TTL，其结果按该值计算后再限制在最小和最大TTL之间
+	DefaultTTL = time.Minute
+	// DefaultNegativeTTL 域名不存在的结果的默认缓存时间
+	DefaultNegativeTTL = 5 * time.Second
+	// DefaultPurgeInterval 清理过期缓存的间隔
+	DefaultPurgeInterval = time.Minute
+)
+
+// Options 缓存参数
+type Options struct {
+	MinTTL      time.Duration // 缓存时间下限，0为不限制
+	MaxTTL      time.Duration // 缓存时间上限，0为不限制
+	NegativeTTL time.Duration // 域名不存在的结果的缓存时间，0为DefaultNegativeTTL，负数为不缓存
+
+	// 查询主机名，返回地址和记录的TTL，TTL<=0时按DefaultTTL计算；为nil时使用系统解析器
+	Lookup func(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+// Cache 主机名解析缓存，nil表示不缓存，每次都查询系统解析器
+type Cache struct {
+	opts Options
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	done    chan struct{} // 查询完成后关闭，之后ips、err和expires不再改变
+	ips     []net.IP
+	err     error
+	expires time.Time
+	hits    uint64
+}
+
+// Entry 一条缓存记录，用于状态报告
+type Entry struct {
+	Host    string    `json:"host"`
+	Addrs   []string  `json:"addrs,omitempty"`
+	Error   string    `json:"error,omitempty"` // 缓存的解析失败原因
+	Expires time.Time `json:"expires"`
+	Hits    uint64    `json:"hits"`
+}
+
+// New 创建解析缓存
+func New(opts Options) *Cache {
+	if opts.NegativeTTL == 0 {
+		opts.NegativeTTL = DefaultNegativeTTL
+	}
+	return &Cache{opts: opts, entries: make(map[string]*entry)}
+}
+
+// Run 定期清理过期的缓存，直到上下文取消
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	if c == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultPurgeInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for host, e := range c.entries {
+				if e.expired(now) {
+					delete(c.entries, host)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// 查询已完成且已过期，调用者须持有锁
+func (e *entry) expired(now time.Time) bool {
+	select {
+	case <-e.done:
+		return !now.Before(e.expires)
+	default:
+		return false
+	}
+}
+
+// LookupIP 返回主机名的地址，优先使用未过期的缓存；同一主机名同时只查询一次
+func (c *Cache) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if c == nil {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	if !ok || e.expired(time.Now()) {
+		e = &entry{done: make(chan struct{})}
+		c.entries[host] = e
+		c.mu.Unlock()
+		go c.resolve(host, e)
+	} else {
+		e.hits++
+		c.mu.Unlock()
+	}
+
+	select {
+	case <-e.done:
+		return e.ips, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 查询主机名并按结果设置缓存时间，不缓存的失败结果从缓存中移除
+func (c *Cache) resolve(host string, e *entry) {
+	ips, ttl, err := c.lookup(host)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(e.done)
+	e.ips, e.err = ips, err
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound || c.opts.NegativeTTL < 0 {
+			if c.entries[host] == e {
+				delete(c.entries, host)
+			}
+			return
+		}
+		ttl = c.opts.NegativeTTL
+	} else {
+		if ttl <= 0 {
+			ttl = DefaultTTL
+		}
+		if c.opts.MaxTTL > 0 {
+			ttl = min(ttl, c.opts.MaxTTL)
+		}
+		ttl = max(ttl, c.opts.MinTTL)
+	}
+	e.expires = time.Now().Add(ttl)
+}
+
+func (c *Cache) lookup(host string) ([]net.IP, time.Duration, error) {
+	// 查询不随某次连接取消，结果由所有等待者共享
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if c.opts.Lookup != nil {
+		return c.opts.Lookup(ctx, host)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	return ips, 0, err
+}
+
+// 按network("tcp4"、"udp6"等)筛选地址，与标准库相同，network以6结尾时不使用IPv4地址
+func filter(network, host string, ips []net.IP) ([]net.IP, error) {
+	var filtered []net.IP
+	for _, ip := range ips {
+		switch {
+		case strings.HasSuffix(network, "4") && ip.To4() == nil:
+		case strings.HasSuffix(network, "6") && ip.To4() != nil:
+		default:
+			filtered = append(filtered, ip)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return filtered, nil
+}
+
+// Dial 解析addr中的主机名后用d依次连接其地址直到成功，d的超时时间用于整个过程；c为nil或addr中为IP地址时直接使用d连接
+func (c *Cache) Dial(d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if c == nil || err != nil || net.ParseIP(host) != nil {
+		return d.Dial(network, addr)
+	}
+
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	ips, err := c.LookupIP(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if ips, err = filter(network, host, ips); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// ResolveUDPAddr 同net.ResolveUDPAddr，主机名经缓存解析
+func (c *Cache) ResolveUDPAddr(network, addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if c == nil || err != nil || host == "" || net.ParseIP(host) != nil {
+		return net.ResolveUDPAddr(network, addr)
+	}
+
+	ips, err := c.LookupIP(context.Background(), host)
+	if err == nil {
+		ips, err = filter(network, host, ips)
+	}
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := net.LookupPort(network, port)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0], Port: portNum}, nil
+}
+
+// Entries 返回按主机名排序的未过期缓存记录
+func (c *Cache) Entries() []Entry {
+	if c == nil {
+		return nil
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]Entry, 0, len(c.entries))
+	for host, e := range c.entries {
+		select {
+		case <-e.done:
+		default:
+			continue
+		}
+		if !now.Before(e.expires) {
+			continue
+		}
+		item := Entry{Host: host, Expires: e.expires, Hits: e.hits}
+		for _, ip := range e.ips {
+			item.Addrs = append(item.Addrs, ip.String())
+		}
+		if e.err != nil {
+			item.Error = e.err.Error()
+		}
+		entries = append(entries, item)
+	}
+	slices.SortFunc(entries, func(a, b Entry) int { return strings.Compare(a.Host, b.Host) })
+	return entries
+}
@@ -0,0 +1,359 @@
+package dnscache
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 每个DNS服务器单次查询的超时时间
+const queryTimeout = 5 * time.Second
+
+// UDP查询在EDNS0中声明的最大响应大小
+const udpPayloadSize = 1232
+
+// Resolver 向指定的DNS服务器查询主机名，不读取/etc/resolv.conf和hosts文件，
+// 按顺序尝试各服务器，网络错误或服务器失败(SERVFAIL、REFUSED)时尝试下一个
+type Resolver struct {
+	servers []server
+	http    *http.Client
+}
+
+// 一个DNS服务器
+type server struct {
+	scheme string // "udp"、"tcp"、"tls"或"https"
+	addr   string // "host:port"，https为完整的URL
+}
+
+func (s server) String() string {
+	if s.scheme == "https" {
+		return s.addr
+	}
+	return s.scheme + "://" + s.addr
+}
+
+// ParseServer 检查DNS服务器地址，支持 "1.1.1.1"、"udp://1.1.1.1:53"、"tcp://1.1.1.1"、
+// DNS over TLS的 "tls://1.1.1.1:853" 和DNS over HTTPS的 "https://1.1.1.1/dns-query"，
+// 省略端口时分别为53和853；tls和https的主机名由系统解析器解析，系统DNS不可用时应使用IP地址
+func ParseServer(s string) error {
+	_, err := parseServer(s)
+	return err
+}
+
+func parseServer(s string) (server, error) {
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		scheme, rest = "udp", s
+	}
+
+	port := "53"
+	switch scheme {
+	case "udp", "tcp":
+	case "tls":
+		port = "853"
+	case "https":
+		u, err := url.Parse(s)
+		if err != nil {
+			return server{}, fmt.Errorf("无效的DNS服务器地址: %w", err)
+		}
+		if u.Hostname() == "" {
+			return server{}, fmt.Errorf("DNS服务器地址缺少主机名: %q", s)
+		}
+		return server{scheme: scheme, addr: s}, nil
+	default:
+		return server{}, fmt.Errorf("不支持的DNS服务器协议: %q", scheme)
+	}
+
+	if rest == "" {
+		return server{}, fmt.Errorf("DNS服务器地址缺少主机名: %q", s)
+	}
+	if ip := net.ParseIP(strings.Trim(rest, "[]")); ip != nil {
+		return server{scheme: scheme, addr: net.JoinHostPort(ip.String(), port)}, nil
+	}
+	host, p, err := net.SplitHostPort(rest)
+	if err != nil {
+		host, p = rest, port
+	}
+	if host == "" {
+		return server{}, fmt.Errorf("DNS服务器地址缺少主机名: %q", s)
+	}
+	return server{scheme: scheme, addr: net.JoinHostPort(host, p)}, nil
+}
+
+// NewResolver 创建向servers查询的解析器，地址格式见ParseServer
+func NewResolver(servers []string) (*Resolver, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("没有配置DNS服务器")
+	}
+	r := &Resolver{http: &http.Client{Timeout: queryTimeout}}
+	for _, s := range servers {
+		srv, err := parseServer(s)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, srv)
+	}
+	return r, nil
+}
+
+// Lookup 同时查询主机名的AAAA和A记录，返回IPv6地址在前的地址列表和记录中最小的TTL，可用作Options.Lookup
+func (r *Resolver) Lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	fqdn := host
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+
+	types := [...]dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	var results [len(types)]answer
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = r.query(ctx, name, t)
+		}()
+	}
+	wg.Wait()
+
+	// 只要有一种记录查询成功就使用其结果，例如只有IPv4的目标所在区域的AAAA查询失败时
+	var ips []net.IP
+	ttl := time.Duration(math.MaxInt64)
+	for _, res := range results {
+		if len(res.ips) > 0 {
+			ips = append(ips, res.ips...)
+			ttl = min(ttl, res.ttl)
+		}
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	for _, res := range results {
+		if res.err != nil {
+			return nil, 0, &net.DNSError{Err: res.err.Error(), Name: host, Server: res.server, IsTemporary: true, IsTimeout: isTimeout(res.err)}
+		}
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: results[0].server, IsNotFound: true}
+}
+
+// 一种记录类型的查询结果
+type answer struct {
+	ips    []net.IP
+	ttl    time.Duration
+	server string
+	err    error
+}
+
+// 依次向各服务器查询直到得到确定的结果(成功或域名不存在)
+func (r *Resolver) query(ctx context.Context, name dnsmessage.Name, t dnsmessage.Type) answer {
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET})
+	b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(udpPayloadSize, dnsmessage.RCodeSuccess, false)
+	b.OPTResource(opt, dnsmessage.OPTResource{})
+	msg, err := b.Finish()
+	if err != nil {
+		return answer{err: err}
+	}
+
+	var res answer
+	for _, srv := range r.servers {
+		res = answer{server: srv.String()}
+		var resp []byte
+		if resp, res.err = r.exchange(ctx, srv, msg); res.err == nil {
+			res.err = parseAnswer(resp, id, srv.scheme != "https", name, t, &res)
+		}
+		if res.err == nil || ctx.Err() != nil {
+			return res
+		}
+	}
+	return res
+}
+
+// 向一个服务器发送查询并返回响应，UDP响应被截断时改用TCP重新查询
+func (r *Resolver) exchange(ctx context.Context, srv server, msg []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	switch srv.scheme {
+	case "https":
+		// RFC 8484建议查询ID为0，以便HTTP缓存
+		q := bytes.Clone(msg)
+		q[0], q[1] = 0, 0
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.addr, bytes.NewReader(q))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+		resp, err := r.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("DNS服务器返回 %s", resp.Status)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, math.MaxUint16))
+	case "udp":
+		resp, err := exchangeUDP(ctx, srv.addr, msg)
+		if err != nil {
+			return nil, err
+		}
+		var h dnsmessage.Header
+		var p dnsmessage.Parser
+		if h, err = p.Start(resp); err != nil || !h.Truncated {
+			return resp, nil
+		}
+		return exchangeStream(ctx, "tcp", srv.addr, msg)
+	default:
+		return exchangeStream(ctx, srv.scheme, srv.addr, msg)
+	}
+}
+
+func exchangeUDP(ctx context.Context, addr string, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, udpPayloadSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略ID不匹配的响应，例如之前超时的查询迟到的响应
+		if n >= 2 && buf[0] == msg[0] && buf[1] == msg[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// 经TCP或TLS发送带2字节长度前缀的查询
+func exchangeStream(ctx context.Context, scheme, addr string, msg []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if scheme == "tls" {
+		host, _, _ := net.SplitHostPort(addr)
+		d := tls.Dialer{Config: &tls.Config{ServerName: host}}
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	q := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(q, uint16(len(msg)))
+	copy(q[2:], msg)
+	if _, err := conn.Write(q); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// 解析响应中的地址记录，CNAME记录的TTL也计入最小TTL；服务器失败时返回错误以便尝试下一个服务器
+func parseAnswer(resp []byte, id uint16, checkID bool, name dnsmessage.Name, t dnsmessage.Type, res *answer) error {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return fmt.Errorf("无效的DNS响应: %w", err)
+	}
+	if checkID && h.ID != id || !h.Response {
+		return errors.New("无效的DNS响应")
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil
+	default:
+		return fmt.Errorf("DNS服务器返回 %s", h.RCode)
+	}
+
+	q, err := p.Question()
+	if err != nil || q.Type != t || !strings.EqualFold(q.Name.String(), name.String()) {
+		return errors.New("DNS响应与查询不匹配")
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return fmt.Errorf("无效的DNS响应: %w", err)
+	}
+
+	ttl := uint32(math.MaxUint32)
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("无效的DNS响应: %w", err)
+		}
+		ttl = min(ttl, rh.TTL)
+		switch {
+		case rh.Type == dnsmessage.TypeA && t == dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return fmt.Errorf("无效的DNS响应: %w", err)
+			}
+			res.ips = append(res.ips, net.IP(a.A[:]))
+		case rh.Type == dnsmessage.TypeAAAA && t == dnsmessage.TypeAAAA:
+			a, err := p.AAAAResource()
+			if err != nil {
+				return fmt.Errorf("无效的DNS响应: %w", err)
+			}
+			res.ips = append(res.ips, net.IP(a.AAAA[:]))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return fmt.Errorf("无效的DNS响应: %w", err)
+			}
+		}
+	}
+	res.ttl = time.Duration(ttl) * time.Second
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,87 @@
+package dnsfwd
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+// DoHPath DNS over HTTPS查询的路径
+const DoHPath = "/dns-query"
+
+// DNS over HTTPS消息的媒体类型
+const dohContentType = "application/dns-message"
+
+// 在已接受TLS连接的监听器上提供DNS over HTTPS，支持GET(?dns=base64url)和POST两种请求
+func (p *Proxy) serveHTTPS(ctx context.Context, ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(DoHPath, p.handleDoH)
+	srv := &http.Server{
+		Handler:           mux,
+		TLSConfig:         p.opts.TLSConfig.Clone(),
+		ReadHeaderTimeout: tcpIdleTimeout,
+		IdleTimeout:       tcpIdleTimeout,
+		ErrorLog:          log.New(io.Discard, "", 0), // 握手失败等错误过于频繁，不记录
+	}
+	context.AfterFunc(ctx, func() { srv.Close() })
+
+	if err := srv.ServeTLS(ln, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// 处理一个DNS over HTTPS请求，每个请求使用独立的上游TCP连接
+func (p *Proxy) handleDoH(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns")); err != nil || len(query) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxUDPSize+1))
+		if err != nil {
+			return
+		}
+		if len(body) > maxUDPSize {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		query = body
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if exceeded, _ := p.opts.Quota.Exceeded(); exceeded {
+		p.opts.Stats.AddDropped()
+		http.Error(w, "quota exceeded", http.StatusServiceUnavailable)
+		return
+	}
+
+	upstreams := make(map[string]net.Conn)
+	defer func() {
+		for _, c := range upstreams {
+			c.Close()
+		}
+	}()
+	resp := p.forward(r.Context(), ListenHTTPS, r.RemoteAddr, query, upstreams)
+	if resp == nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Write(resp)
+}
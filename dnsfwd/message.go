@@ -0,0 +1,127 @@
+package dnsfwd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 查询的问题部分，用于选择上游和记录日志
+type question struct {
+	id    uint16
+	name  string // 小写、带末尾的点，例如 "www.example.com."
+	qtype dnsmessage.Type
+}
+
+// 解析查询的首个问题，不是查询或没有问题时返回错误
+func parseQuery(msg []byte) (question, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return question{}, err
+	}
+	if h.Response {
+		return question{}, errors.New("不是DNS查询")
+	}
+	q, err := p.Question()
+	if err != nil {
+		return question{}, err
+	}
+	return question{id: h.ID, name: strings.ToLower(q.Name.String()), qtype: q.Type}, nil
+}
+
+// 响应头中记录日志需要的部分
+type responseInfo struct {
+	rcode     dnsmessage.RCode
+	truncated bool
+}
+
+// 解析响应头，ID与查询不一致或不是响应时返回错误
+func parseResponse(msg []byte, id uint16) (responseInfo, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return responseInfo{}, err
+	}
+	if !h.Response || h.ID != id {
+		return responseInfo{}, errors.New("DNS响应与查询不匹配")
+	}
+	return responseInfo{rcode: h.RCode, truncated: h.Truncated}, nil
+}
+
+// 判断响应头中是否设置了TC(截断)标志
+func truncated(msg []byte) bool {
+	return len(msg) > 2 && msg[2]&0x02 != 0
+}
+
+// 构造SERVFAIL响应，上游失败时返回给客户端，使其不必等待超时
+func serverFailure(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               h.ID,
+		Response:         true,
+		OpCode:           h.OpCode,
+		RecursionDesired: h.RecursionDesired,
+		RCode:            dnsmessage.RCodeServerFailure,
+	})
+	b.StartQuestions()
+	b.Question(q)
+	return b.Finish()
+}
+
+// 返回应答码的常用名称，例如NOERROR、NXDOMAIN
+func rcodeName(rcode dnsmessage.RCode) string {
+	switch rcode {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return strings.TrimPrefix(rcode.String(), "RCode")
+}
+
+// 返回记录类型的名称，例如A、AAAA
+func typeName(t dnsmessage.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+// 读取带2字节长度前缀的DNS消息(TCP和DNS over TLS)
+func readStream(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// 写入带2字节长度前缀的DNS消息
+func writeStream(w io.Writer, msg []byte) error {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,391 @@
+// Package dnsfwd 解析并转发DNS查询：同一端口同时监听UDP和TCP，按查询的域名选择上游，
+// 逐条记录客户端、域名、记录类型和应答码。上游的UDP应答被截断(TC)时原样返回，由客户端
+// 按标准改用TCP重新查询，TCP查询同样经TCP转发到上游。
+//
+// 也可以在监听端终止DNS over TLS或DNS over HTTPS，向上游以明文DNS查询，为只支持明文的
+// 解析器提供加密入口；这时客户端无法自行改用TCP，UDP应答被截断时由转发端改用TCP重新查询
+package dnsfwd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/bindretry"
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+)
+
+const (
+	// QueryTimeout 等待上游应答的时长，超时后向客户端返回SERVFAIL
+	QueryTimeout = 5 * time.Second
+	// TCP客户端连接两次查询之间的最长空闲时间
+	tcpIdleTimeout = 10 * time.Second
+	// 同时处理的UDP查询数上限，超过时丢弃新查询
+	maxInflight = 1024
+	// UDP消息的最大长度
+	maxUDPSize = 65535
+)
+
+// 监听方式
+const (
+	ListenPlain = "plain" // 明文DNS，同时监听UDP和TCP(默认)
+	ListenTLS   = "tls"   // DNS over TLS(RFC 7858)，只监听TCP
+	ListenHTTPS = "https" // DNS over HTTPS(RFC 8484)，只监听TCP，路径为DoHPath
+)
+
+// ValidListenMode 检查ListenMode的取值
+func ValidListenMode(s string) bool {
+	return s == "" || s == ListenPlain || s == ListenTLS || s == ListenHTTPS
+}
+
+// Options DNS转发的可选配置
+type Options struct {
+	Log *logging.Logger // 规则的日志级别，nil为info；每条查询的日志按连接日志采样
+
+	Routes *Routes // 按域名选择上游，未匹配时使用targetAddr
+
+	ListenMode string      // 监听方式，见ListenPlain等，为空时为ListenPlain
+	TLSConfig  *tls.Config // ListenTLS和ListenHTTPS使用的服务端证书，这两种方式下必须设置
+
+	// 监听的地址族: "ipv4"、"ipv6"或双栈的"dual"，为空时为ipv4
+	ListenNetwork string
+	BindRetry     time.Duration // 监听地址被占用时重试绑定的时长，0为不重试
+
+	Stats *stats.Rule  // 流量统计，每条查询计为一个连接
+	Quota *quota.Quota // 流量配额，用尽后丢弃查询
+
+	Health *health.Tracker // 所有套接字都监听成功后标记为就绪，退出时标记为未就绪
+}
+
+// Proxy 在一个地址上转发DNS查询
+type Proxy struct {
+	proxyID    string
+	listenAddr string
+	targetAddr string
+	opts       Options
+
+	inflight chan struct{}
+}
+
+// NewProxy 创建DNS转发，targetAddr为默认上游 "host:port"
+func NewProxy(proxyID, listenAddr, targetAddr string, opts Options) *Proxy {
+	return &Proxy{
+		proxyID:    proxyID,
+		listenAddr: listenAddr,
+		targetAddr: targetAddr,
+		opts:       opts,
+		inflight:   make(chan struct{}, maxInflight),
+	}
+}
+
+// Start 监听UDP和TCP并转发查询，直到上下文取消
+func (p *Proxy) Start(ctx context.Context) error {
+	var family string
+	switch p.opts.ListenNetwork {
+	case "", "ipv4":
+		family = "4"
+	case "ipv6":
+		family = "6"
+	}
+
+	mode := p.opts.ListenMode
+	if mode == "" {
+		mode = ListenPlain
+	}
+	if mode != ListenPlain && p.opts.TLSConfig == nil {
+		return fmt.Errorf("监听方式%s需要TLS证书", mode)
+	}
+
+	var lc net.ListenConfig
+	onRetry := func(err error, wait time.Duration) {
+		p.opts.Log.Warnf("[%s] 监听地址被占用，%v后重试: %v", p.proxyID, wait, err)
+	}
+	if mode != ListenPlain {
+		ln, err := bindretry.Listen(ctx, p.opts.BindRetry, onRetry, func() (net.Listener, error) {
+			return lc.Listen(ctx, "tcp"+family, p.listenAddr)
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("无法监听TCP: %w", err)
+		}
+		defer ln.Close()
+		return p.serveEncrypted(ctx, mode, ln)
+	}
+
+	pc, err := bindretry.Listen(ctx, p.opts.BindRetry, onRetry, func() (net.PacketConn, error) {
+		return lc.ListenPacket(ctx, "udp"+family, p.listenAddr)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("无法监听UDP: %w", err)
+	}
+	defer pc.Close()
+	ln, err := bindretry.Listen(ctx, p.opts.BindRetry, onRetry, func() (net.Listener, error) {
+		return lc.Listen(ctx, "tcp"+family, p.listenAddr)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("无法监听TCP: %w", err)
+	}
+	defer ln.Close()
+
+	p.opts.Log.Infof("[%s] DNS转发已启动: %s -> %s", p.proxyID, p.listenAddr, p.targetAddr)
+	p.opts.Health.SetReady(p.proxyID, true)
+	defer p.opts.Health.SetReady(p.proxyID, false)
+
+	context.AfterFunc(ctx, func() {
+		pc.Close()
+		ln.Close()
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	p.opts.Stats.Go(func() {
+		defer wg.Done()
+		p.serveUDP(ctx, pc)
+	})
+	p.opts.Stats.Go(func() {
+		defer wg.Done()
+		p.serveTCP(ctx, ln, "tcp")
+	})
+	wg.Wait()
+	return nil
+}
+
+// 在TCP监听器上终止DNS over TLS或DNS over HTTPS，直到上下文取消
+func (p *Proxy) serveEncrypted(ctx context.Context, mode string, ln net.Listener) error {
+	p.opts.Log.Infof("[%s] DNS转发已启动(%s): %s -> %s", p.proxyID, mode, p.listenAddr, p.targetAddr)
+	p.opts.Health.SetReady(p.proxyID, true)
+	defer p.opts.Health.SetReady(p.proxyID, false)
+
+	if mode == ListenHTTPS {
+		return p.serveHTTPS(ctx, ln)
+	}
+	context.AfterFunc(ctx, func() { ln.Close() })
+	p.serveTCP(ctx, tls.NewListener(ln, p.opts.TLSConfig), ListenTLS)
+	return nil
+}
+
+// 读取UDP查询，每条查询在单独的goroutine中转发
+func (p *Proxy) serveUDP(ctx context.Context, pc net.PacketConn) {
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.opts.Log.Warnf("[%s] UDP读取错误: %v", p.proxyID, err)
+			p.opts.Stats.AddError()
+			continue
+		}
+		if exceeded, first := p.opts.Quota.Exceeded(); exceeded {
+			if first {
+				p.opts.Log.Warnf("[%s] 流量配额已用尽，本周期内丢弃所有查询", p.proxyID)
+			}
+			p.opts.Stats.AddDropped()
+			continue
+		}
+		select {
+		case p.inflight <- struct{}{}:
+		default:
+			p.opts.Stats.AddDropped()
+			continue
+		}
+
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		p.opts.Stats.Go(func() {
+			defer func() { <-p.inflight }()
+			resp := p.forward(ctx, "udp", client.String(), query, nil)
+			if resp == nil {
+				return
+			}
+			if _, err := pc.WriteTo(resp, client); err != nil {
+				p.opts.Log.Warnf("[%s] 发送应答到 %s 失败: %v", p.proxyID, client, err)
+				p.opts.Stats.AddError()
+			}
+		})
+	}
+}
+
+// 接受TCP或TLS连接，每个连接在单独的goroutine中按顺序处理查询
+func (p *Proxy) serveTCP(ctx context.Context, ln net.Listener, transport string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.opts.Log.Warnf("[%s] 接受TCP连接失败: %v", p.proxyID, err)
+			p.opts.Stats.AddError()
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		p.opts.Stats.Go(func() {
+			p.handleTCP(ctx, conn, transport)
+		})
+	}
+}
+
+// 处理一个TCP或TLS客户端连接，同一连接的查询复用到同一上游的TCP连接
+func (p *Proxy) handleTCP(ctx context.Context, conn net.Conn, transport string) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	upstreams := make(map[string]net.Conn)
+	defer func() {
+		for _, c := range upstreams {
+			c.Close()
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readStream(conn)
+		if err != nil {
+			return
+		}
+		if exceeded, _ := p.opts.Quota.Exceeded(); exceeded {
+			p.opts.Stats.AddDropped()
+			return
+		}
+		resp := p.forward(ctx, transport, conn.RemoteAddr().String(), query, upstreams)
+		if resp == nil {
+			return
+		}
+		if err := writeStream(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// 把一条查询转发到上游并返回给客户端的应答，无法解析的查询返回nil。transport为客户端使用的传输方式：
+// udp经UDP转发，tcp经TCP转发并复用upstreams中的上游连接；tls和https先经UDP转发，应答被截断时经TCP重新查询
+func (p *Proxy) forward(ctx context.Context, transport, client string, query []byte, upstreams map[string]net.Conn) []byte {
+	q, err := parseQuery(query)
+	if err != nil {
+		p.opts.Log.Debugf("[%s] 丢弃无法解析的DNS查询(%s): %s: %v", p.proxyID, transport, client, err)
+		p.opts.Stats.AddDropped()
+		return nil
+	}
+	upstream, ok := p.opts.Routes.Upstream(q.name)
+	if !ok {
+		upstream = p.targetAddr
+	}
+
+	p.opts.Stats.ConnOpened()
+	defer p.opts.Stats.ConnClosed()
+	p.opts.Stats.AddUp(int64(len(query)))
+	start := time.Now()
+
+	var resp []byte
+	switch transport {
+	case "udp":
+		resp, err = exchangeUDP(ctx, upstream, query)
+	case "tcp":
+		resp, err = exchangeTCP(ctx, upstreams, upstream, query)
+	default:
+		resp, err = exchangeUDP(ctx, upstream, query)
+		if err == nil && truncated(resp) {
+			resp, err = exchangeTCP(ctx, upstreams, upstream, query)
+		}
+	}
+	var info responseInfo
+	if err == nil {
+		info, err = parseResponse(resp, q.id)
+	}
+	rtt := time.Since(start)
+	if err != nil {
+		p.opts.Log.Warnf("[%s] DNS查询失败(%s): %s %s %s -> %s: %v", p.proxyID, transport, client, q.name, typeName(q.qtype), upstream, err)
+		p.opts.Stats.AddTargetError(upstream, err, false)
+		if resp, err = serverFailure(query); err != nil {
+			return nil
+		}
+	} else if info.truncated {
+		p.opts.Log.Conn().Infof("[%s] DNS查询(%s): %s %s %s -> %s %s, 耗时%s, 应答被截断", p.proxyID, transport, client, q.name, typeName(q.qtype), upstream, rcodeName(info.rcode), rtt.Round(time.Microsecond))
+	} else {
+		p.opts.Log.Conn().Infof("[%s] DNS查询(%s): %s %s %s -> %s %s, 耗时%s", p.proxyID, transport, client, q.name, typeName(q.qtype), upstream, rcodeName(info.rcode), rtt.Round(time.Microsecond))
+	}
+
+	p.opts.Stats.AddDown(int64(len(resp)))
+	p.opts.Stats.ConnFinished(rtt, uint64(len(query)+len(resp)))
+	p.opts.Quota.Add(int64(len(query) + len(resp)))
+	return resp
+}
+
+// 经新的UDP套接字发送查询并等待ID相同的应答
+func exchangeUDP(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 跳过ID不同的迟到应答
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n:n], nil
+		}
+	}
+}
+
+// 经TCP发送查询，复用upstreams中到该上游的连接；复用的连接已被上游关闭时重新连接一次
+func exchangeTCP(ctx context.Context, upstreams map[string]net.Conn, upstream string, query []byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		conn, reused := upstreams[upstream]
+		if !reused {
+			ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+			var d net.Dialer
+			c, err := d.DialContext(ctx, "tcp", upstream)
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+			conn = c
+			upstreams[upstream] = conn
+		}
+
+		conn.SetDeadline(time.Now().Add(QueryTimeout))
+		err := writeStream(conn, query)
+		var resp []byte
+		if err == nil {
+			resp, err = readStream(conn)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		conn.Close()
+		delete(upstreams, upstream)
+		if !reused || attempt > 0 {
+			return nil, err
+		}
+	}
+}
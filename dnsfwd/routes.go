@@ -0,0 +1,54 @@
+package dnsfwd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Routes 按查询的域名选择上游DNS服务器
+type Routes struct {
+	upstreams map[string]string // 小写、带末尾点的域名 -> "host:port"
+}
+
+// NewRoutes 创建域名路由，键为域名，匹配该域名及其所有子域名，值为 "host:port"；routes为空时返回nil
+func NewRoutes(routes map[string]string) (*Routes, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	r := &Routes{upstreams: make(map[string]string, len(routes))}
+	for domain, upstream := range routes {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			return nil, fmt.Errorf("域名%s的上游地址无效: %w", domain, err)
+		}
+		r.upstreams[fqdn(domain)] = upstream
+	}
+	return r, nil
+}
+
+// Upstream 返回最长匹配name的域名对应的上游，没有匹配时返回false
+func (r *Routes) Upstream(name string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	name = fqdn(name)
+	for {
+		if upstream, ok := r.upstreams[name]; ok {
+			return upstream, true
+		}
+		if name == "." {
+			return "", false
+		}
+		// 去掉最左边的标签，例如 "www.example.com." -> "example.com."
+		_, parent, _ := strings.Cut(name, ".")
+		if parent == "" {
+			parent = "."
+		}
+		name = parent
+	}
+}
+
+// 转为小写并补上末尾的点，"."和空字符串表示根域，匹配所有查询
+func fqdn(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
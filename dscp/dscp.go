@@ -0,0 +1,34 @@
+// Package dscp 为转发的数据包设置DSCP标记(IP头的TOS/Traffic Class字段)，使下游设备可以按标记区分服务质量
+package dscp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 常用的DSCP名称，AFxy = 8x+2y，CSx = 8x
+var names = map[string]int{
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14,
+	"AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30,
+	"AF41": 34, "AF42": 36, "AF43": 38,
+	"EF": 46, "VA": 44, "LE": 1,
+}
+
+// Parse 解析DSCP取值，可以是名称(例如 "EF"、"AF41"、"CS1"，不区分大小写)或0-63的数字，空字符串返回0表示不设置
+func Parse(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if v, ok := names[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || v > 63 {
+		return 0, fmt.Errorf("无效的DSCP取值 %q，应为0-63或EF、AF41、CS1等名称", s)
+	}
+	return int(v), nil
+}
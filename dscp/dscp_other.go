@@ -0,0 +1,13 @@
+//go:build !unix
+
+package dscp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Set 在该平台上不受支持，Windows需要通过组策略的QoS策略设置DSCP
+func Set(conn syscall.Conn, dscp int) error {
+	return errors.New("该平台不支持为套接字设置DSCP，Windows请使用组策略中的QoS策略")
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package dscp
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set 为套接字设置DSCP标记，作用于之后发出的所有数据包；
+// IPv6套接字设置Traffic Class，并尽量同时设置TOS以覆盖双栈套接字上的IPv4流量
+func Set(conn syscall.Conn, dscp int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	tos := dscp << 2
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		if unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos) == nil {
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+			return
+		}
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
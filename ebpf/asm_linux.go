@@ -0,0 +1,161 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// 用到的BPF辅助函数编号，见 include/uapi/linux/bpf.h
+const (
+	FuncMapLookupElem   = 1
+	FuncKtimeGetNs      = 5
+	FuncRedirect        = 23
+	FuncCsumDiff        = 28
+	FuncGetSocketCookie = 46
+	FuncFibLookup       = 69
+	FuncSkRedirectHash  = 72
+)
+
+// 寄存器，R0为返回值，R1-R5为参数并在调用后失效，R6-R9在调用间保留，R10为只读的栈帧指针
+const (
+	R0 uint8 = iota
+	R1
+	R2
+	R3
+	R4
+	R5
+	R6
+	R7
+	R8
+	R9
+	R10
+)
+
+// Insn 一条BPF指令
+type Insn struct {
+	Code uint8
+	Regs uint8 // 低4位为目标寄存器，高4位为源寄存器
+	Off  int16
+	Imm  int32
+}
+
+func insn(code, dst, src uint8, off int16, imm int32) Insn {
+	return Insn{Code: code, Regs: src<<4 | dst, Off: off, Imm: imm}
+}
+
+// Mov 64位 dst = imm
+func Mov(dst uint8, imm int32) Insn {
+	return insn(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_K, dst, 0, 0, imm)
+}
+
+// MovReg 64位 dst = src
+func MovReg(dst, src uint8) Insn {
+	return insn(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_X, dst, src, 0, 0)
+}
+
+// ALU 64位 dst op= imm，op为unix.BPF_ADD等
+func ALU(op, dst uint8, imm int32) Insn {
+	return insn(unix.BPF_ALU64|op|unix.BPF_K, dst, 0, 0, imm)
+}
+
+// ALUReg 64位 dst op= src
+func ALUReg(op, dst, src uint8) Insn {
+	return insn(unix.BPF_ALU64|op|unix.BPF_X, dst, src, 0, 0)
+}
+
+// ToBE 把dst的低bits位在网络字节序和主机字节序之间转换
+func ToBE(dst uint8, bits int32) Insn {
+	return insn(unix.BPF_ALU|unix.BPF_END|unix.BPF_TO_BE, dst, 0, 0, bits)
+}
+
+// Load dst = *(size *)(src + off)，size为unix.BPF_B、BPF_H、BPF_W或BPF_DW
+func Load(size, dst, src uint8, off int16) Insn {
+	return insn(unix.BPF_LDX|unix.BPF_MEM|size, dst, src, off, 0)
+}
+
+// Store *(size *)(dst + off) = src
+func Store(size, dst uint8, off int16, src uint8) Insn {
+	return insn(unix.BPF_STX|unix.BPF_MEM|size, dst, src, off, 0)
+}
+
+// StoreImm *(size *)(dst + off) = imm
+func StoreImm(size, dst uint8, off int16, imm int32) Insn {
+	return insn(unix.BPF_ST|unix.BPF_MEM|size, dst, 0, off, imm)
+}
+
+// AtomicAdd 原子地 *(size *)(dst + off) += src，size为BPF_W或BPF_DW
+func AtomicAdd(size, dst uint8, off int16, src uint8) Insn {
+	return insn(unix.BPF_STX|unix.BPF_ATOMIC|size, dst, src, off, unix.BPF_ADD)
+}
+
+// LoadMap dst = 表fd对应的表指针，占两条指令
+func LoadMap(dst uint8, fd int) []Insn {
+	return []Insn{
+		insn(unix.BPF_LD|unix.BPF_IMM|unix.BPF_DW, dst, unix.BPF_PSEUDO_MAP_FD, 0, int32(fd)),
+		{},
+	}
+}
+
+// Call 调用辅助函数
+func Call(fn int32) Insn {
+	return insn(unix.BPF_JMP|unix.BPF_CALL, 0, 0, 0, fn)
+}
+
+// Exit 返回R0
+func Exit() Insn {
+	return insn(unix.BPF_JMP|unix.BPF_EXIT, 0, 0, 0, 0)
+}
+
+// Asm 按顺序拼接指令，跳转以标签表示，在Program中换算为相对偏移
+type Asm struct {
+	insns  []Insn
+	labels map[string]int
+	jumps  map[int]string // 跳转指令的位置到目标标签
+}
+
+// Emit 追加指令
+func (a *Asm) Emit(insns ...Insn) {
+	a.insns = append(a.insns, insns...)
+}
+
+// Label 在下一条指令处定义标签
+func (a *Asm) Label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.insns)
+}
+
+// Jump 满足 dst op imm 时跳转到标签，op为unix.BPF_JEQ等，BPF_JA为无条件跳转
+func (a *Asm) Jump(op, dst uint8, imm int32, label string) {
+	a.jump(insn(unix.BPF_JMP|op|unix.BPF_K, dst, 0, 0, imm), label)
+}
+
+// JumpReg 满足 dst op src 时跳转到标签
+func (a *Asm) JumpReg(op, dst, src uint8, label string) {
+	a.jump(insn(unix.BPF_JMP|op|unix.BPF_X, dst, src, 0, 0), label)
+}
+
+func (a *Asm) jump(ins Insn, label string) {
+	if a.jumps == nil {
+		a.jumps = make(map[int]string)
+	}
+	a.jumps[len(a.insns)] = label
+	a.insns = append(a.insns, ins)
+}
+
+// Program 返回填好跳转偏移的指令
+func (a *Asm) Program() ([]Insn, error) {
+	insns := append([]Insn(nil), a.insns...)
+	for pos, label := range a.jumps {
+		target, ok := a.labels[label]
+		if !ok {
+			return nil, fmt.Errorf("未定义的标签 %q", label)
+		}
+		insns[pos].Off = int16(target - pos - 1)
+	}
+	return insns, nil
+}
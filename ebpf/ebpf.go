@@ -0,0 +1,3 @@
+// Package ebpf 直接通过bpf(2)系统调用创建表、加载和挂载eBPF程序，程序在Go中以指令形式编写，
+// 不依赖clang和外部库，仅Linux支持
+package ebpf
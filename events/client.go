@@ -0,0 +1,90 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/logging"
+)
+
+// Watch 以SSE订阅运行中实例的事件流，对每个事件调用fn，直到上下文取消或连接断开；
+// base为指标HTTP服务的URL前缀
+func Watch(ctx context.Context, client *http.Client, base string, filter Filter, fn func(Event)) error {
+	query := url.Values{}
+	if filter.ProxyID != "" {
+		query.Set("proxy", filter.ProxyID)
+	}
+	if len(filter.Types) > 0 {
+		types := make([]string, len(filter.Types))
+		for i, t := range filter.Types {
+			types[i] = string(t)
+		}
+		query.Set("type", strings.Join(types, ","))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/events?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("无法连接运行中的实例: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("订阅事件失败: %s", resp.Status)
+	}
+
+	// 事件类型已包含在JSON中，只需读取data行，空行表示一个事件结束
+	var data strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if rest, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(strings.TrimPrefix(rest, " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(data.String()), &e); err != nil {
+			return fmt.Errorf("无法解析事件: %w", err)
+		}
+		data.Reset()
+		fn(e)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("读取事件失败: %w", err)
+	}
+	return nil
+}
+
+// Format 把事件格式化为一行文本，供events子命令输出
+func Format(e Event) string {
+	prefix := fmt.Sprintf("%s [%s]", e.Time.Local().Format("15:04:05.000"), logging.Tag(e.ProxyID, e.ConnID))
+	protocol := strings.ToUpper(e.Protocol)
+	switch e.Type {
+	case TypeOpen:
+		return fmt.Sprintf("%s %s连接建立: %s -> %s -> %s", prefix, protocol, e.Client, e.Listen, e.Target)
+	case TypeClose:
+		duration := (time.Duration(e.DurationMS) * time.Millisecond).String()
+		return fmt.Sprintf("%s %s连接关闭: %s -> %s, 上行%d字节, 下行%d字节, 持续%s",
+			prefix, protocol, e.Client, e.Target, e.BytesUp, e.BytesDown, duration)
+	case TypeError:
+		return fmt.Sprintf("%s %s连接错误: %s -> %s: %s", prefix, protocol, e.Client, e.Target, e.Error)
+	case TypeDropped:
+		return fmt.Sprintf("%s 处理不及，丢弃了%d个事件", e.Time.Local().Format("15:04:05.000"), e.Dropped)
+	}
+	return fmt.Sprintf("%s %s", prefix, e.Type)
+}
@@ -0,0 +1,171 @@
+// Package events 把连接的建立、关闭和错误事件实时推送给订阅者，由指标HTTP服务的/events以SSE或WebSocket输出，
+// events子命令读取后逐行显示。订阅者来不及接收时丢弃事件并发送dropped事件说明丢弃的数量，不会阻塞转发
+package events
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+)
+
+// Type 事件类型
+type Type string
+
+const (
+	TypeOpen    Type = "open"    // TCP连接开始转发或UDP会话创建
+	TypeClose   Type = "close"   // 连接或会话结束
+	TypeError   Type = "error"   // 连接目标失败或转发出错
+	TypeDropped Type = "dropped" // 订阅者来不及接收，丢弃了Dropped个事件
+)
+
+// 每个订阅者缓存的事件数量
+const subscriberBuffer = 256
+
+// Event 一个连接事件
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       Type      `json:"type"`
+	ProxyID    string    `json:"proxy,omitempty"`
+	ConnID     string    `json:"conn,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"`
+	Client     string    `json:"client,omitempty"`
+	Listen     string    `json:"listen,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	BytesUp    int64     `json:"bytes_up,omitempty"`
+	BytesDown  int64     `json:"bytes_down,omitempty"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Dropped    uint64    `json:"dropped,omitempty"`
+}
+
+// Filter 订阅条件，空值表示不限制
+type Filter struct {
+	ProxyID string // 代理ID前缀，例如规则名 "ssh" 匹配 "ssh-tcp-p1"
+	Types   []Type
+}
+
+func (f Filter) match(e *Event) bool {
+	if !strings.HasPrefix(e.ProxyID, f.ProxyID) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Bus 事件总线，nil表示不发布事件
+type Bus struct {
+	mu   sync.Mutex
+	subs map[*Subscriber]struct{}
+}
+
+// Subscriber 一个订阅者，从C接收事件
+type Subscriber struct {
+	C       <-chan Event
+	c       chan Event
+	filter  Filter
+	dropped uint64 // 尚未通知订阅者的丢弃数量，由Bus.mu保护
+}
+
+// NewBus 创建事件总线
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscriber]struct{})}
+}
+
+// Publish 发送事件给所有条件匹配的订阅者，Time为零时填入当前时间
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for s := range b.subs {
+		if !s.filter.match(&e) {
+			continue
+		}
+		// 先补发之前的丢弃通知，保证订阅者能知道事件不连续
+		if s.dropped > 0 {
+			select {
+			case s.c <- Event{Time: e.Time, Type: TypeDropped, Dropped: s.dropped}:
+				s.dropped = 0
+			default:
+				s.dropped++
+				continue
+			}
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// PublishConn 以连接信息发布事件，关闭事件带有info中的流量和持续时间，err不为nil时记录错误；没有订阅者时不构造事件
+func (b *Bus) PublishConn(typ Type, info *middleware.Info, err error) {
+	if !b.Active() {
+		return
+	}
+	e := Event{
+		Type:     typ,
+		ProxyID:  info.ProxyID,
+		ConnID:   info.ConnID,
+		Protocol: info.Protocol,
+		Target:   info.TargetAddr,
+	}
+	if info.ClientAddr != nil {
+		e.Client = info.ClientAddr.String()
+	}
+	if info.ListenAddr != nil {
+		e.Listen = info.ListenAddr.String()
+	}
+	// 流量和持续时间只在关闭时写入info，其他事件读取会与关闭竞争
+	if typ == TypeClose {
+		e.BytesUp, e.BytesDown, e.DurationMS = info.BytesUp, info.BytesDown, info.Duration.Milliseconds()
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	b.Publish(e)
+}
+
+// Active 判断是否有订阅者，没有时调用者可以跳过构造事件
+func (b *Bus) Active() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs) > 0
+}
+
+// Subscribe 订阅条件匹配的事件，不再需要时须调用Unsubscribe
+func (b *Bus) Subscribe(filter Filter) *Subscriber {
+	c := make(chan Event, subscriberBuffer)
+	s := &Subscriber{C: c, c: c, filter: filter}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Unsubscribe 取消订阅
+func (b *Bus) Unsubscribe(s *Subscriber) {
+	b.mu.Lock()
+	delete(b.subs, s)
+	b.mu.Unlock()
+}
@@ -0,0 +1,121 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// SSE连接上发送注释保持连接的间隔，避免被中间的代理当作空闲连接关闭
+const keepaliveInterval = 15 * time.Second
+
+// Handler 推送事件：带Upgrade: websocket的请求以WebSocket文本消息发送JSON，其余以SSE (text/event-stream) 发送；
+// 查询参数proxy按代理ID前缀过滤，type为逗号分隔的事件类型
+func (b *Bus) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		filter := ParseFilter(req.URL.Query())
+		if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			ws := websocket.Server{
+				Handshake: sameOrigin,
+				Handler:   func(conn *websocket.Conn) { b.serveWebSocket(conn, filter) },
+			}
+			ws.ServeHTTP(w, req)
+			return
+		}
+		b.serveSSE(w, req, filter)
+	})
+}
+
+// ParseFilter 从查询参数解析订阅条件
+func ParseFilter(query url.Values) Filter {
+	return Filter{ProxyID: query.Get("proxy"), Types: ParseTypes(query.Get("type"))}
+}
+
+// ParseTypes 解析逗号分隔的事件类型
+func ParseTypes(s string) []Type {
+	var types []Type
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, Type(t))
+		}
+	}
+	return types
+}
+
+// 浏览器发起的WebSocket请求只接受同源页面，防止其他网站读取连接事件
+func sameOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != req.Host {
+		return errors.New("跨域的WebSocket请求")
+	}
+	config.Origin = u
+	return nil
+}
+
+func (b *Bus) serveSSE(w http.ResponseWriter, req *http.Request, filter Filter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "不支持流式响应", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := b.Subscribe(filter)
+	defer b.Unsubscribe(sub)
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e := <-sub.C:
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (b *Bus) serveWebSocket(conn *websocket.Conn, filter Filter) {
+	defer conn.Close()
+	sub := b.Subscribe(filter)
+	defer b.Unsubscribe(sub)
+
+	// 丢弃客户端发来的消息，读取出错说明客户端已断开
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var msg string
+		for websocket.Message.Receive(conn, &msg) == nil {
+		}
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case e := <-sub.C:
+			if err := websocket.JSON.Send(conn, e); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Package fdlimit 检查进程的文件描述符上限能否容纳配置中的监听器和连接，
+// 避免连接数上升后大量出现 "too many open files" 错误
+package fdlimit
+
+import "log"
+
+// Reserve 日志、配额文件、指标服务和节点间链路等监听器和连接之外占用的文件描述符
+const Reserve = 64
+
+// Estimate 按配置估算的文件描述符用量
+type Estimate struct {
+	Listeners int  // 监听的端口、套接字和串口
+	Conns     int  // 最多同时处理的TCP连接数，每个连接占用客户端和目标两个文件描述符
+	Bounded   bool // 所有TCP规则都限制了连接数且没有UDP规则；否则Conns只是已知的部分，实际用量取决于连接和会话数
+}
+
+// Need 返回配置最多需要的文件描述符数量，Bounded为false时为下限
+func (e Estimate) Need() uint64 {
+	return uint64(Reserve + e.Listeners + 2*e.Conns)
+}
+
+// Check 在启动时检查文件描述符上限，低于配置所需时尝试把软上限提高到硬上限，仍不足时给出警告；
+// 连接数不受限制时同样尝试提高，并记录上限可以容纳的连接数
+func Check(e Estimate) {
+	soft, hard := Limit()
+	if soft == 0 {
+		return // 当前系统没有文件描述符上限
+	}
+
+	need := e.Need()
+	if (soft < need || !e.Bounded) && soft < hard {
+		raised, err := Raise()
+		if err != nil {
+			log.Printf("无法把文件描述符上限由%d提高到%d: %v", soft, hard, err)
+		} else {
+			log.Printf("文件描述符上限已由%d提高到%d", soft, raised)
+			soft = raised
+		}
+	}
+
+	if soft < need {
+		if e.Bounded {
+			log.Printf("文件描述符上限%d低于配置所需的%d(%d个监听器，最多%d个TCP连接)，请用 ulimit -n 或服务的LimitNOFILE提高上限",
+				soft, need, e.Listeners, e.Conns)
+		} else {
+			log.Printf("文件描述符上限%d不足以容纳%d个监听器，请用 ulimit -n 或服务的LimitNOFILE提高上限", soft, e.Listeners)
+		}
+		return
+	}
+	if !e.Bounded {
+		spare := soft - uint64(Reserve+e.Listeners)
+		log.Printf("文件描述符上限为%d，除%d个监听器外约可同时处理%d个TCP连接或%d个UDP会话", soft, e.Listeners, spare/2, spare)
+	}
+}
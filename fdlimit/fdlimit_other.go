@@ -0,0 +1,20 @@
+//go:build !unix
+
+package fdlimit
+
+import "errors"
+
+// Limit 当前系统没有文件描述符上限，返回0
+func Limit() (soft, hard uint64) {
+	return 0, 0
+}
+
+// Raise 当前系统不支持
+func Raise() (uint64, error) {
+	return 0, errors.New("当前系统不支持设置文件描述符上限")
+}
+
+// Open 当前系统无法统计，返回-1
+func Open() int {
+	return -1
+}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package fdlimit
+
+import (
+	"os"
+	"syscall"
+)
+
+// Limit 返回文件描述符的软上限和硬上限
+func Limit() (soft, hard uint64) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, 0
+	}
+	return uint64(rl.Cur), uint64(rl.Max)
+}
+
+// Raise 把软上限提高到硬上限，返回提高后的软上限
+func Raise() (uint64, error) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, err
+	}
+	rl.Cur = rl.Max
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, err
+	}
+	soft, _ := Limit()
+	return soft, nil
+}
+
+// Open 返回当前打开的文件描述符数量，无法统计时返回-1
+func Open() int {
+	entries, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries) - 1 // 不计读取目录本身使用的文件描述符
+}
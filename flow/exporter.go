@@ -0,0 +1,166 @@
+package flow
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// 导出参数
+const (
+	maxRecordsPerMessage = 16               // 保证IPv6记录的消息也小于常见MTU
+	flushInterval        = time.Second      // 未满一条消息的记录最长等待时间
+	templateInterval     = 30 * time.Second // UDP传输时模板的重发间隔
+	queueSize            = 4096
+)
+
+// 协议号
+const (
+	ProtoTCP uint8 = 6
+	ProtoUDP uint8 = 17
+)
+
+// Record 单方向的流记录
+type Record struct {
+	Src      netip.AddrPort
+	Dst      netip.AddrPort
+	Protocol uint8
+	Bytes    uint64
+	Packets  uint64 // UDP为数据报数量，TCP为写入次数(近似值)
+	Start    time.Time
+	End      time.Time
+}
+
+// Exporter 通过UDP将流记录以IPFIX格式发送到收集器
+type Exporter struct {
+	conn     net.Conn
+	domainID uint32
+	queue    chan Record
+	seq      uint32
+	dropped  atomic.Uint64
+}
+
+// NewExporter 创建发送到collector的导出器，collector为空时返回nil表示不导出
+func NewExporter(collector string, domainID uint32) (*Exporter, error) {
+	if collector == "" {
+		return nil, nil
+	}
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		conn:     conn,
+		domainID: domainID,
+		queue:    make(chan Record, queueSize),
+	}, nil
+}
+
+// Export 提交一条流记录，队列已满时丢弃，不会阻塞数据转发
+func (e *Exporter) Export(r Record) {
+	if e == nil || r.Bytes == 0 {
+		return
+	}
+	select {
+	case e.queue <- r:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// ExportConn 为一条转发连接导出两个方向的流记录
+// up为客户端->目标，down为目标->客户端
+func (e *Exporter) ExportConn(protocol uint8, client, target net.Addr, start, end time.Time,
+	bytesUp, packetsUp, bytesDown, packetsDown uint64) {
+	if e == nil {
+		return
+	}
+	clientAP, targetAP := addrPortOf(client), addrPortOf(target)
+	e.Export(Record{Src: clientAP, Dst: targetAP, Protocol: protocol,
+		Bytes: bytesUp, Packets: packetsUp, Start: start, End: end})
+	e.Export(Record{Src: targetAP, Dst: clientAP, Protocol: protocol,
+		Bytes: bytesDown, Packets: packetsDown, Start: start, End: end})
+}
+
+// QueueLen 返回等待发送的记录数量
+func (e *Exporter) QueueLen() int {
+	if e == nil {
+		return 0
+	}
+	return len(e.queue)
+}
+
+// Dropped 返回因队列已满而丢弃的记录数量
+func (e *Exporter) Dropped() uint64 {
+	if e == nil {
+		return 0
+	}
+	return e.dropped.Load()
+}
+
+// Run 批量发送队列中的记录，直到上下文取消
+func (e *Exporter) Run(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	defer e.conn.Close()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var (
+		pending      []Record
+		lastTemplate time.Time
+		lastDropped  uint64
+	)
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		now := time.Now()
+		withTemplate := now.Sub(lastTemplate) >= templateInterval
+		msg := encodeMessage(pending, e.seq, e.domainID, now, withTemplate)
+		if _, err := e.conn.Write(msg); err != nil {
+			log.Printf("发送流记录失败: %v", err)
+		} else if withTemplate {
+			lastTemplate = now
+		}
+		// 序列号按已发送的数据记录数递增
+		e.seq += uint32(len(pending))
+		pending = pending[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// 尽量发送剩余记录
+			for {
+				select {
+				case r := <-e.queue:
+					pending = append(pending, r)
+					if len(pending) >= maxRecordsPerMessage {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		case r := <-e.queue:
+			pending = append(pending, r)
+			if len(pending) >= maxRecordsPerMessage {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			if dropped := e.dropped.Load(); dropped != lastDropped {
+				log.Printf("流记录队列已满，累计丢弃%d条记录", dropped)
+				lastDropped = dropped
+			}
+		}
+	}
+}
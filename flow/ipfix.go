@@ -0,0 +1,144 @@
+package flow
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// IPFIX (RFC 7011) 协议常量
+const (
+	ipfixVersion     = 10
+	templateSetID    = 2
+	templateIPv4     = 256
+	templateIPv6     = 257
+	messageHeaderLen = 16
+	setHeaderLen     = 4
+)
+
+// IANA信息元素编号和长度
+type fieldSpec struct {
+	id     uint16
+	length uint16
+}
+
+var ipv4Fields = []fieldSpec{
+	{8, 4},   // sourceIPv4Address
+	{12, 4},  // destinationIPv4Address
+	{7, 2},   // sourceTransportPort
+	{11, 2},  // destinationTransportPort
+	{4, 1},   // protocolIdentifier
+	{1, 8},   // octetDeltaCount
+	{2, 8},   // packetDeltaCount
+	{152, 8}, // flowStartMilliseconds
+	{153, 8}, // flowEndMilliseconds
+}
+
+var ipv6Fields = []fieldSpec{
+	{27, 16}, // sourceIPv6Address
+	{28, 16}, // destinationIPv6Address
+	{7, 2},   // sourceTransportPort
+	{11, 2},  // destinationTransportPort
+	{4, 1},   // protocolIdentifier
+	{1, 8},   // octetDeltaCount
+	{2, 8},   // packetDeltaCount
+	{152, 8}, // flowStartMilliseconds
+	{153, 8}, // flowEndMilliseconds
+}
+
+// 追加包含IPv4和IPv6两个模板的模板集
+func appendTemplateSet(b []byte) []byte {
+	start := len(b)
+	b = binary.BigEndian.AppendUint16(b, templateSetID)
+	b = binary.BigEndian.AppendUint16(b, 0) // 长度稍后回填
+
+	for _, t := range []struct {
+		id     uint16
+		fields []fieldSpec
+	}{{templateIPv4, ipv4Fields}, {templateIPv6, ipv6Fields}} {
+		b = binary.BigEndian.AppendUint16(b, t.id)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(t.fields)))
+		for _, f := range t.fields {
+			b = binary.BigEndian.AppendUint16(b, f.id)
+			b = binary.BigEndian.AppendUint16(b, f.length)
+		}
+	}
+
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+// 追加一个数据集，records必须使用同一模板
+func appendDataSet(b []byte, templateID uint16, records []Record) []byte {
+	start := len(b)
+	b = binary.BigEndian.AppendUint16(b, templateID)
+	b = binary.BigEndian.AppendUint16(b, 0)
+
+	for _, r := range records {
+		src, dst := r.Src.Addr(), r.Dst.Addr()
+		if templateID == templateIPv4 {
+			s4, d4 := src.As4(), dst.As4()
+			b = append(b, s4[:]...)
+			b = append(b, d4[:]...)
+		} else {
+			s16, d16 := src.As16(), dst.As16()
+			b = append(b, s16[:]...)
+			b = append(b, d16[:]...)
+		}
+		b = binary.BigEndian.AppendUint16(b, r.Src.Port())
+		b = binary.BigEndian.AppendUint16(b, r.Dst.Port())
+		b = append(b, r.Protocol)
+		b = binary.BigEndian.AppendUint64(b, r.Bytes)
+		b = binary.BigEndian.AppendUint64(b, r.Packets)
+		b = binary.BigEndian.AppendUint64(b, uint64(r.Start.UnixMilli()))
+		b = binary.BigEndian.AppendUint64(b, uint64(r.End.UnixMilli()))
+	}
+
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+// 编码一条IPFIX消息，withTemplate为true时在数据集前附带模板集
+func encodeMessage(records []Record, seq, domainID uint32, now time.Time, withTemplate bool) []byte {
+	b := make([]byte, messageHeaderLen, 1500)
+	binary.BigEndian.PutUint16(b[0:], ipfixVersion)
+	binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(b[8:], seq)
+	binary.BigEndian.PutUint32(b[12:], domainID)
+
+	if withTemplate {
+		b = appendTemplateSet(b)
+	}
+
+	var v4, v6 []Record
+	for _, r := range records {
+		if r.isIPv4() {
+			v4 = append(v4, r)
+		} else {
+			v6 = append(v6, r)
+		}
+	}
+	if len(v4) > 0 {
+		b = appendDataSet(b, templateIPv4, v4)
+	}
+	if len(v6) > 0 {
+		b = appendDataSet(b, templateIPv6, v6)
+	}
+
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b
+}
+
+// 两端均为IPv4时使用IPv4模板，否则IPv4地址以映射形式写入IPv6模板
+func (r Record) isIPv4() bool {
+	return r.Src.Addr().Unmap().Is4() && r.Dst.Addr().Unmap().Is4()
+}
+
+// 从net.Addr提取地址和端口
+func addrPortOf(addr interface{ String() string }) netip.AddrPort {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
@@ -0,0 +1,398 @@
+// Package ftp 解析经TCP转发的FTP控制连接，把被动模式的PASV/EPSV响应中的地址改写为转发端的地址，
+// 并为其中的数据端口临时打开对应的转发，使被动模式FTP可以穿过转发。
+//
+// 服务器在响应中给出的地址不被使用，数据连接总是发往控制连接的目标，以适应NAT后的服务器
+// 给出内网地址的情况。数据连接同样受规则的禁止模式、带宽上限和故障注入约束，控制连接关闭后
+// 已建立的数据连接继续传输直到结束。主动模式(PORT/EPRT)和加密的控制连接(AUTH TLS)不做处理
+package ftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/chaos"
+	"github.com/Mxmilu666/nia-forwarding/inspect"
+	"github.com/Mxmilu666/nia-forwarding/limit"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+)
+
+// AcceptTimeout 数据端口等待客户端连接的时长，超时后关闭
+const AcceptTimeout = 30 * time.Second
+
+// 控制连接中一行响应的最大长度，超过时不再等待换行而原样转发
+const maxLineLength = 4096
+
+// Options FTP被动模式转发的可选配置
+type Options struct {
+	// 在PASV响应中公布给客户端的本机IPv4地址，nil时使用客户端连接的本机地址
+	AdvertiseIP net.IP
+	// 数据端口使用的端口，为空时由系统分配
+	PassivePorts []int
+
+	Stats *stats.Rule  // 数据连接的流量计入规则的统计
+	Quota *quota.Quota // 数据连接的流量计入配额，用尽后拒绝新的数据连接
+
+	Blocker       *inspect.Matcher // 客户端数据开头命中禁止模式时断开数据连接
+	Bandwidth     *limit.Bandwidth // 所有规则共享的总带宽上限，nil为不限制
+	RuleBandwidth *limit.Bandwidth // 本规则共享的带宽上限，nil为不限制
+	Priority      int              // 总带宽不足时本规则的优先级
+	Chaos         *chaos.Injector  // 故障注入，为数据连接附加延迟、带宽限制和随机重置
+}
+
+// Helper 为一个规则的FTP控制连接打开被动模式数据端口，可在同一规则的多个代理间共享
+type Helper struct {
+	opts Options
+	next atomic.Uint32 // 下次尝试的PassivePorts序号
+}
+
+// NewHelper 创建FTP被动模式转发
+func NewHelper(opts Options) *Helper {
+	return &Helper{opts: opts}
+}
+
+// Control 一个FTP控制连接的状态
+type Control struct {
+	h      *Helper
+	ctx    context.Context
+	tag    string
+	log    *logging.Logger
+	client net.Addr // 控制连接的客户端地址，只接受来自同一IP的数据连接
+	local  net.Addr // 客户端连接的本机地址，数据端口监听在同一地址上
+	target net.IP   // 控制连接的目标地址，数据连接发往该地址
+	touch  func()   // 数据连接有流量时调用，避免控制连接被当作空闲连接回收
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	closed    bool
+}
+
+// Control 为一个控制连接创建状态，h为nil时返回nil。调用Close时关闭尚未被连接的数据端口，
+// ctx应在代理停止时取消，取消时同时断开已建立的数据连接
+func (h *Helper) Control(ctx context.Context, tag string, log *logging.Logger, clientConn, targetConn net.Conn, touch func()) *Control {
+	if h == nil {
+		return nil
+	}
+	c := &Control{
+		h:      h,
+		ctx:    ctx,
+		tag:    tag,
+		log:    log,
+		client: clientConn.RemoteAddr(),
+		local:  clientConn.LocalAddr(),
+		touch:  touch,
+	}
+	if addr, ok := targetConn.RemoteAddr().(*net.TCPAddr); ok {
+		c.target = addr.IP
+	}
+	return c
+}
+
+// Reader 返回改写目标发来的被动模式响应的Reader，c为nil时直接返回r
+func (c *Control) Reader(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return &responseReader{c: c, r: r}
+}
+
+// Close 关闭尚未被连接的数据端口，已建立的数据连接继续传输直到结束
+func (c *Control) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, l := range c.listeners {
+		l.Close()
+	}
+	c.listeners = nil
+}
+
+// 按行读取目标的响应，改写其中的PASV和EPSV响应
+type responseReader struct {
+	c     *Control
+	r     io.Reader
+	chunk [4096]byte
+	buf   []byte // 尚未读到换行的部分
+	out   []byte
+	err   error
+}
+
+func (rr *responseReader) Read(p []byte) (int, error) {
+	for len(rr.out) == 0 {
+		if rr.err != nil {
+			if len(rr.buf) > 0 {
+				rr.out, rr.buf = rr.buf, nil
+				break
+			}
+			return 0, rr.err
+		}
+		n, err := rr.r.Read(rr.chunk[:])
+		rr.buf = append(rr.buf, rr.chunk[:n]...)
+		rr.err = err
+		for {
+			i := bytes.IndexByte(rr.buf, '\n')
+			if i < 0 {
+				break
+			}
+			rr.out = append(rr.out, rr.c.rewrite(string(rr.buf[:i+1]))...)
+			rr.buf = rr.buf[i+1:]
+		}
+		if len(rr.buf) > maxLineLength {
+			rr.out, rr.buf = append(rr.out, rr.buf...), nil
+		}
+	}
+	n := copy(p, rr.out)
+	rr.out = rr.out[n:]
+	return n, nil
+}
+
+// 改写一行响应，不是被动模式响应或无法打开数据端口时原样返回
+func (c *Control) rewrite(line string) string {
+	switch {
+	case strings.HasPrefix(line, "227 "):
+		port, ok := parsePASV(line)
+		if !ok {
+			return line
+		}
+		ip := c.h.opts.AdvertiseIP
+		if ip == nil {
+			if addr, ok := c.local.(*net.TCPAddr); ok {
+				ip = addr.IP
+			}
+		}
+		if ip = ip.To4(); ip == nil {
+			// PASV只能表示IPv4地址，IPv6客户端应使用EPSV
+			return line
+		}
+		local, err := c.open(port)
+		if err != nil {
+			c.log.Warnf("[%s] 无法打开FTP数据端口: %v", c.tag, err)
+			return line
+		}
+		return fmt.Sprintf("227 Entering Passive Mode (%d,%d,%d,%d,%d,%d).\r\n", ip[0], ip[1], ip[2], ip[3], local>>8, local&0xff)
+	case strings.HasPrefix(line, "229 "):
+		port, ok := parseEPSV(line)
+		if !ok {
+			return line
+		}
+		local, err := c.open(port)
+		if err != nil {
+			c.log.Warnf("[%s] 无法打开FTP数据端口: %v", c.tag, err)
+			return line
+		}
+		return fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)\r\n", local)
+	}
+	return line
+}
+
+// 解析 "227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)" 中的端口
+func parsePASV(line string) (int, bool) {
+	start := strings.IndexByte(line, '(')
+	end := strings.LastIndexByte(line, ')')
+	if start < 0 || end < start {
+		return 0, false
+	}
+	fields := strings.Split(line[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, false
+	}
+	var n [6]int
+	for i, f := range fields {
+		v, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || v < 0 || v > 255 {
+			return 0, false
+		}
+		n[i] = v
+	}
+	port := n[4]<<8 | n[5]
+	return port, port > 0
+}
+
+// 解析 "229 Entering Extended Passive Mode (|||port|)" 中的端口
+func parseEPSV(line string) (int, bool) {
+	start := strings.IndexByte(line, '(')
+	end := strings.LastIndexByte(line, ')')
+	if start < 0 || end < start+5 {
+		return 0, false
+	}
+	inner := line[start+1 : end]
+	d := inner[:1]
+	fields := strings.Split(inner, d)
+	if len(fields) != 5 {
+		return 0, false
+	}
+	port, err := strconv.Atoi(fields[3])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, false
+	}
+	return port, true
+}
+
+// 在客户端连接的本机地址上打开数据端口，接受一个连接后转发到目标的port端口，返回本机端口
+func (c *Control) open(port int) (int, error) {
+	if c.target == nil {
+		return 0, errors.New("目标不是TCP地址")
+	}
+	host := ""
+	if addr, ok := c.local.(*net.TCPAddr); ok {
+		host = addr.IP.String()
+	}
+	l, err := c.h.listen(host)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		l.Close()
+		return 0, net.ErrClosed
+	}
+	c.listeners = append(c.listeners, l)
+	c.mu.Unlock()
+
+	target := net.JoinHostPort(c.target.String(), strconv.Itoa(port))
+	local := l.Addr().(*net.TCPAddr).Port
+	c.log.Debugf("[%s] FTP数据端口%d -> %s", c.tag, local, target)
+	c.h.opts.Stats.Go(func() { c.serveData(l, target) })
+	return local, nil
+}
+
+// 依次尝试PassivePorts中的端口，未配置时由系统分配
+func (h *Helper) listen(host string) (net.Listener, error) {
+	ports := h.opts.PassivePorts
+	if len(ports) == 0 {
+		return net.Listen("tcp", net.JoinHostPort(host, "0"))
+	}
+	var err error
+	for range ports {
+		port := ports[int(h.next.Add(1)-1)%len(ports)]
+		var l net.Listener
+		if l, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("被动模式端口已全部占用: %w", err)
+}
+
+// 接受一个来自控制连接客户端IP的数据连接并转发到target，之后关闭数据端口
+func (c *Control) serveData(l net.Listener, target string) {
+	defer c.remove(l)
+	timer := time.AfterFunc(AcceptTimeout, func() { l.Close() })
+	defer timer.Stop()
+
+	var conn net.Conn
+	for {
+		var err error
+		if conn, err = l.Accept(); err != nil {
+			return
+		}
+		if sameIP(conn.RemoteAddr(), c.client) {
+			break
+		}
+		c.log.Warnf("[%s] 拒绝来自 %s 的FTP数据连接，与控制连接的客户端不同", c.tag, conn.RemoteAddr())
+		c.h.opts.Stats.AddDropped()
+		conn.Close()
+	}
+	l.Close()
+	timer.Stop()
+	defer conn.Close()
+
+	if exceeded, _ := c.h.opts.Quota.Exceeded(); exceeded {
+		c.h.opts.Stats.AddDropped()
+		return
+	}
+	var d net.Dialer
+	dialCtx, cancel := context.WithTimeout(c.ctx, AcceptTimeout)
+	targetConn, err := d.DialContext(dialCtx, "tcp", target)
+	cancel()
+	if err != nil {
+		c.log.Warnf("[%s] 无法连接FTP数据端口 %s: %v", c.tag, target, err)
+		c.h.opts.Stats.AddTargetError(target, err, true)
+		return
+	}
+	defer targetConn.Close()
+
+	done := make(chan error, 2)
+	copyData := func(dst, src net.Conn, r io.Reader, add func(int64)) {
+		_, err := io.Copy(&dataWriter{w: c.h.limitWriter(c.ctx, dst), c: c, add: add}, r)
+		// 一个方向结束后半关闭，另一方向的数据继续传输
+		if tc, ok := dst.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+		done <- err
+	}
+	c.h.opts.Stats.Go(func() {
+		copyData(targetConn, conn, inspect.NewReader(conn, c.h.opts.Blocker), c.h.opts.Stats.AddUp)
+	})
+	c.h.opts.Stats.Go(func() { copyData(conn, targetConn, targetConn, c.h.opts.Stats.AddDown) })
+	for range 2 {
+		select {
+		case err := <-done:
+			if errors.Is(err, inspect.ErrBlocked) {
+				c.log.Warnf("[%s] FTP数据连接被断开: %s 数据命中禁止模式", c.tag, conn.RemoteAddr())
+				c.h.opts.Stats.AddDropped()
+			}
+			// 被拦截或重置时不再等待另一方向
+			if errors.Is(err, inspect.ErrBlocked) || errors.Is(err, chaos.ErrInjectedReset) {
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// 返回依次经过规则带宽、全局带宽和故障注入后写入conn的Writer
+func (h *Helper) limitWriter(ctx context.Context, conn net.Conn) io.Writer {
+	return h.opts.RuleBandwidth.Writer(ctx, h.opts.Priority, h.opts.Bandwidth.Writer(ctx, h.opts.Priority, h.opts.Chaos.Writer(conn)))
+}
+
+// 从打开的数据端口中移除l
+func (c *Control) remove(l net.Listener) {
+	l.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, x := range c.listeners {
+		if x == l {
+			c.listeners = append(c.listeners[:i], c.listeners[i+1:]...)
+			break
+		}
+	}
+}
+
+// 写入时计入统计和配额，并刷新控制连接的活动时间
+type dataWriter struct {
+	w   io.Writer
+	c   *Control
+	add func(int64)
+}
+
+func (w *dataWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.add(int64(n))
+	w.c.h.opts.Quota.Add(int64(n))
+	if w.c.touch != nil {
+		w.c.touch()
+	}
+	return n, err
+}
+
+func sameIP(a, b net.Addr) bool {
+	x, ok1 := a.(*net.TCPAddr)
+	y, ok2 := b.(*net.TCPAddr)
+	return ok1 && ok2 && x.IP.Equal(y.IP)
+}
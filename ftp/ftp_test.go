@@ -0,0 +1,256 @@
+package ftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/inspect"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+)
+
+func TestParsePASV(t *testing.T) {
+	for line, want := range map[string]int{
+		"227 Entering Passive Mode (192,168,1,2,19,137).\r\n":  19<<8 | 137,
+		"227 Entering Passive Mode ( 10, 0, 0, 5, 0, 21 )\r\n": 21,
+		"227 =10,0,0,5,255,255 (10,0,0,5,255,255)\r\n":         65535,
+	} {
+		if port, ok := parsePASV(line); !ok || port != want {
+			t.Errorf("%q解析出端口%d (%v)，应为%d", line, port, ok, want)
+		}
+	}
+
+	// 格式错误或端口越界的响应原样转发，不能打开数据端口
+	for _, line := range []string{
+		"227 Entering Passive Mode\r\n",
+		"227 Entering Passive Mode (192,168,1,2,19,137\r\n",
+		"227 Entering Passive Mode )192,168,1,2,19,137(\r\n",
+		"227 Entering Passive Mode (192,168,1,2,19).\r\n",
+		"227 Entering Passive Mode (192,168,1,2,19,137,1).\r\n",
+		"227 Entering Passive Mode (192,168,1,2,256,1).\r\n",
+		"227 Entering Passive Mode (192,168,1,2,-1,1).\r\n",
+		"227 Entering Passive Mode (192,168,1,2,a,b).\r\n",
+		"227 Entering Passive Mode (192,168,1,2,,1).\r\n",
+		"227 Entering Passive Mode (192,168,1,2,0,0).\r\n",
+		"227 Entering Passive Mode (192,168,1,2,99999999999999999999,1).\r\n",
+		"227 ()\r\n",
+	} {
+		if port, ok := parsePASV(line); ok {
+			t.Errorf("无效的PASV响应%q解析出端口%d", line, port)
+		}
+	}
+}
+
+func TestParseEPSV(t *testing.T) {
+	if port, ok := parseEPSV("229 Entering Extended Passive Mode (|||6446|)\r\n"); !ok || port != 6446 {
+		t.Errorf("以|分隔的EPSV响应解析出端口%d (%v)", port, ok)
+	}
+	// RFC 2428允许任意可打印字符作为分隔符
+	if port, ok := parseEPSV("229 Entering Extended Passive Mode (!!!65535!)\r\n"); !ok || port != 65535 {
+		t.Errorf("以!分隔的EPSV响应解析出端口%d (%v)", port, ok)
+	}
+
+	for _, line := range []string{
+		"229 Entering Extended Passive Mode\r\n",
+		"229 Entering Extended Passive Mode (|||6446|\r\n",
+		"229 Entering Extended Passive Mode (||6446|)\r\n",
+		"229 Entering Extended Passive Mode (||||6446|)\r\n",
+		"229 Entering Extended Passive Mode (|||6446!)\r\n",
+		"229 Entering Extended Passive Mode (|||0|)\r\n",
+		"229 Entering Extended Passive Mode (|||65536|)\r\n",
+		"229 Entering Extended Passive Mode (|||-1|)\r\n",
+		"229 Entering Extended Passive Mode (|||abc|)\r\n",
+		"229 Entering Extended Passive Mode (||||)\r\n",
+		"229 (|)\r\n",
+		"229 )|||6446|(\r\n",
+	} {
+		if port, ok := parseEPSV(line); ok {
+			t.Errorf("无效的EPSV响应%q解析出端口%d", line, port)
+		}
+	}
+}
+
+// 依次返回各数据块，之后返回err
+type chunkReader struct {
+	chunks []string
+	err    error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.chunks[0])
+	if r.chunks[0] = r.chunks[0][n:]; r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+// 把改写后的被动模式响应替换为固定的文本，改写时打开的数据端口每次不同
+// 测试输入中的被动模式响应都不使用这两种文本
+func normalize(out string) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(out, "\n") {
+		if _, ok := parsePASV(line); ok && strings.HasPrefix(line, "227 Entering Passive Mode (192,0,2,1,") {
+			line = "227 <relay>\r\n"
+		} else if _, ok := parseEPSV(line); ok && strings.HasPrefix(line, "229 Entering Extended Passive Mode (") {
+			line = "229 <relay>\r\n"
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+func TestResponseReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 21}
+	c := &Control{
+		h:      NewHelper(Options{AdvertiseIP: net.IPv4(192, 0, 2, 1)}),
+		ctx:    ctx,
+		client: local,
+		local:  local,
+		target: local.IP,
+	}
+	defer c.Close()
+
+	pasv := "227 Entering Passive Mode (10,0,0,5,19,137).\r\n" // 端口5001
+	banner := "220-" + strings.Repeat("x", maxLineLength) + "\r\n"
+	reset := errors.New("连接被重置")
+
+	tests := []struct {
+		name   string
+		chunks []string
+		err    error // 数据读完后返回的错误，nil为io.EOF
+		want   string
+	}{
+		{"普通响应原样转发", []string{"220 ready\r\n331 need password\r\n"}, nil, "220 ready\r\n331 need password\r\n"},
+		{"PASV响应", []string{pasv}, nil, "227 <relay>\r\n"},
+		{"EPSV响应", []string{"229 EPSV ok (|||5001|)\r\n"}, nil, "229 <relay>\r\n"},
+		{"只有LF换行", []string{"150 ok\n229 (|||5001|)\n"}, nil, "150 ok\n229 <relay>\r\n"},
+		{"跨块的PASV响应", []string{"150 ok\r\n227 Entering Pas", "sive Mode (10,0,0,5,19", ",137).\r", "\n226 done\r\n"}, nil,
+			"150 ok\r\n227 <relay>\r\n226 done\r\n"},
+		{"同一块中的多个被动模式响应", []string{pasv + "229 (|||5001|)\r\n" + pasv}, nil,
+			"227 <relay>\r\n229 <relay>\r\n227 <relay>\r\n"},
+		{"字段不足的PASV原样转发", []string{"227 Entering Passive Mode (10,0,0,5,19).\r\n"}, nil,
+			"227 Entering Passive Mode (10,0,0,5,19).\r\n"},
+		{"字段越界的PASV原样转发", []string{"227 (10,0,0,5,300,1)\r\n227 (10,0,0,5,0,0)\r\n"}, nil,
+			"227 (10,0,0,5,300,1)\r\n227 (10,0,0,5,0,0)\r\n"},
+		{"格式错误的EPSV原样转发", []string{"229 (|||0|)\r\n229 (|||70000|)\r\n229 (||)\r\n229 (|||abc|)\r\n"}, nil,
+			"229 (|||0|)\r\n229 (|||70000|)\r\n229 (||)\r\n229 (|||abc|)\r\n"},
+		{"代码后没有空格不改写", []string{"227-Entering Passive Mode (10,0,0,5,19,137).\r\n"}, nil,
+			"227-Entering Passive Mode (10,0,0,5,19,137).\r\n"},
+		{"结束前没有换行", []string{"220 ready\r\n" + strings.TrimSuffix(pasv, "\r\n")}, nil,
+			"220 ready\r\n" + strings.TrimSuffix(pasv, "\r\n")},
+		{"超长行原样转发", []string{banner[:100], banner[100:], pasv}, nil, banner + "227 <relay>\r\n"},
+		{"超长行后的多块数据", []string{banner + banner, pasv}, nil, banner + banner + "227 <relay>\r\n"},
+		{"读取错误前的数据先交付", []string{"220 ready\r\n", "227 (10,0,0,5"}, reset, "220 ready\r\n227 (10,0,0,5"},
+	}
+	for _, tt := range tests {
+		wantErr := tt.err
+		if wantErr == nil {
+			wantErr = io.EOF
+		}
+		whole := strings.Join(tt.chunks, "")
+		readers := []struct {
+			mode string
+			r    io.Reader
+		}{
+			{"按块", &chunkReader{chunks: slices.Clone(tt.chunks), err: wantErr}},
+			{"整体", &chunkReader{chunks: []string{whole}, err: wantErr}},
+			{"逐字节", iotest.OneByteReader(&chunkReader{chunks: []string{whole}, err: wantErr})},
+			{"错误与数据同时返回", iotest.DataErrReader(&chunkReader{chunks: []string{whole}, err: wantErr})},
+		}
+		for _, rd := range readers {
+			t.Run(tt.name+"/"+rd.mode, func(t *testing.T) {
+				r := c.Reader(rd.r)
+				var out []byte
+				p := make([]byte, 7) // 小于一行，覆盖分多次取出改写结果
+				var err error
+				for err == nil {
+					var n int
+					n, err = r.Read(p)
+					out = append(out, p[:n]...)
+				}
+				if err != wantErr {
+					t.Errorf("读完后返回%v，应返回目标连接的%v", err, wantErr)
+				}
+				if got := normalize(string(out)); got != tt.want {
+					t.Errorf("转发给客户端%q，应为%q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// 为回显目标打开数据端口并连接，返回数据连接
+func dialData(t *testing.T, opts Options) net.Conn {
+	t.Helper()
+	echo, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	c := &Control{
+		h:      NewHelper(opts),
+		ctx:    ctx,
+		log:    logging.New(logging.LevelError),
+		client: local,
+		local:  local,
+		target: local.IP,
+	}
+	port, err := c.open(echo.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// 数据连接中命中禁止模式的客户端数据不发往目标，连接被断开
+func TestDataBlocked(t *testing.T) {
+	blocker, err := inspect.NewMatcher([]inspect.Pattern{{Regex: "SECRET"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dialData(t, Options{Blocker: blocker})
+	if _, err := conn.Write([]byte("SECRET")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("数据连接没有被断开: %v", err)
+	}
+	if len(data) > 0 {
+		t.Errorf("命中禁止模式的数据被转发并回显: %q", data)
+	}
+}
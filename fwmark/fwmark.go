@@ -0,0 +1,60 @@
+// Package fwmark 为连接目标的套接字设置防火墙标记(SO_MARK)，
+// 配合 ip rule fwmark 策略路由把不同规则的目标流量送往不同的路由表，例如经VPN或直连
+package fwmark
+
+import (
+	"net"
+	"syscall"
+)
+
+// Dialer 返回在连接前为套接字设置mark的Dialer，保留d原有的Control；mark为0时原样返回d
+func Dialer(d *net.Dialer, mark uint32) *net.Dialer {
+	if mark == 0 {
+		return d
+	}
+	control := d.Control
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return setRaw(c, mark)
+	}
+	return d
+}
+
+// Set 为已创建的套接字设置mark，用于未连接的UDP套接字，mark为0时不做任何操作
+func Set(conn syscall.Conn, mark uint32) error {
+	if mark == 0 {
+		return nil
+	}
+	c, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setRaw(c, mark)
+}
+
+// Check 在临时套接字上设置mark，检查当前平台和权限是否支持
+func Check(mark uint32) error {
+	if mark == 0 {
+		return nil
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return Set(conn, mark)
+}
+
+func setRaw(c syscall.RawConn, mark uint32) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = setMark(fd, mark)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
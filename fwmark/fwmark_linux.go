@@ -0,0 +1,19 @@
+//go:build linux
+
+package fwmark
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+func setMark(fd uintptr, mark uint32) error {
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark)); err != nil {
+		if err == unix.EPERM {
+			return fmt.Errorf("无法设置fwmark，需要root或CAP_NET_ADMIN权限: %w", err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package fwmark
+
+import "errors"
+
+func setMark(fd uintptr, mark uint32) error {
+	return errors.New("仅Linux支持fwmark")
+}
@@ -2,4 +2,22 @@ module github.com/Mxmilu666/nia-forwarding
 
 go 1.23.2
 
-require gopkg.in/yaml.v2 v2.4.0 // indirect
+require (
+	github.com/Microsoft/go-winio v0.6.2
+	github.com/tetratelabs/wazero v1.8.2
+	github.com/yuin/gopher-lua v1.1.1
+	go.bug.st/serial v1.6.4
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+	golang.org/x/sys v0.28.0
+	golang.zx2c4.com/wireguard v0.0.0-20231211153847-12269c276173
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/creack/goselect v0.1.2 // indirect
+	github.com/google/btree v1.0.1 // indirect
+	golang.org/x/time v0.0.0-20220210224613-90d013bbcef8 // indirect
+	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
+	gvisor.dev/gvisor v0.0.0-20230927004350-cbd86285d259 // indirect
+)
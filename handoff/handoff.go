@@ -0,0 +1,166 @@
+// Package handoff 在升级时把已建立的TCP连接交给替换的新进程：新进程启动时连接旧进程的交接套接字，
+// 旧进程以读取超时暂停可交接连接的转发，经SCM_RIGHTS发送客户端和目标连接的文件描述符及转发状态后正常退出，
+// 新进程接管这些连接继续转发，SSH等长连接在更换程序文件时不会断开。仅Linux支持
+package handoff
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTimeout 等待各连接暂停转发的最长时间，超时的连接不交接
+const DefaultTimeout = 5 * time.Second
+
+// ErrUnsupported 当前系统不支持连接交接
+var ErrUnsupported = errors.New("连接交接仅支持Linux")
+
+// State 连接的转发状态，随文件描述符一起交给新进程
+type State struct {
+	ProxyID   string    `json:"proxy_id"`
+	ConnID    string    `json:"conn_id"`
+	Target    string    `json:"target"` // 连接的目标地址，可能不同于代理的默认目标
+	Started   time.Time `json:"started"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+// Conn 从旧进程接管的连接
+type Conn struct {
+	State
+	ClientConn *net.TCPConn
+	TargetConn *net.TCPConn
+}
+
+// Close 关闭接管的连接，用于没有对应代理的情况
+func (c *Conn) Close() {
+	c.ClientConn.Close()
+	c.TargetConn.Close()
+}
+
+// Registry 登记正在转发、可以交接的连接，nil表示不交接
+type Registry struct {
+	mu     sync.Mutex
+	relays map[*Relay]struct{}
+	closed bool // 已开始交接，不再登记新连接
+}
+
+// NewRegistry 创建连接登记表
+func NewRegistry() *Registry {
+	return &Registry{relays: make(map[*Relay]struct{})}
+}
+
+// Relay 一个登记的连接，nil表示该连接不交接
+type Relay struct {
+	registry *Registry
+	state    State
+	client   *net.TCPConn
+	target   *net.TCPConn
+
+	paused atomic.Bool
+	files  [2]*os.File   // 暂停时复制的客户端和目标文件描述符
+	done   chan struct{} // 暂停后转发循环都已退出
+}
+
+// Register 登记正在转发的连接，r为nil或已开始交接时返回nil
+func (r *Registry) Register(state State, client, target *net.TCPConn) *Relay {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	rl := &Relay{registry: r, state: state, client: client, target: target, done: make(chan struct{})}
+	r.relays[rl] = struct{}{}
+	return rl
+}
+
+// Paused 判断连接是否已暂停等待交接
+func (rl *Relay) Paused() bool {
+	return rl != nil && rl.paused.Load()
+}
+
+// Interrupted 判断转发循环的错误是否由交接暂停引起
+func (rl *Relay) Interrupted(err error) bool {
+	return rl != nil && rl.paused.Load() && errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// Finish 在两个方向的转发循环都退出后调用，up和down为累计转发的字节数；
+// 返回true表示连接已暂停等待交接，调用者关闭连接时不影响交给新进程的副本
+func (rl *Relay) Finish(up, down int64) bool {
+	if rl == nil {
+		return false
+	}
+	r := rl.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.relays, rl)
+	if !rl.paused.Load() {
+		return false
+	}
+	rl.state.BytesUp, rl.state.BytesDown = up, down
+	close(rl.done)
+	return true
+}
+
+// 复制文件描述符后以读取超时让转发循环退出，此前读到的数据仍会写完
+func (rl *Relay) pause() bool {
+	client, err := rl.client.File()
+	if err != nil {
+		return false
+	}
+	target, err := rl.target.File()
+	if err != nil {
+		client.Close()
+		return false
+	}
+	rl.files = [2]*os.File{client, target}
+	rl.paused.Store(true)
+	rl.client.SetReadDeadline(time.Now())
+	rl.target.SetReadDeadline(time.Now())
+	return true
+}
+
+func (rl *Relay) closeFiles() {
+	for _, f := range rl.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// 停止登记新连接并暂停所有已登记的连接，返回timeout内暂停完成的连接
+func (r *Registry) pause(timeout time.Duration) []*Relay {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	r.closed = true
+	var paused []*Relay
+	for rl := range r.relays {
+		if rl.pause() {
+			paused = append(paused, rl)
+		}
+	}
+	r.mu.Unlock()
+
+	deadline := time.After(timeout)
+	var ready []*Relay
+	for i, rl := range paused {
+		select {
+		case <-rl.done:
+			ready = append(ready, rl)
+		case <-deadline:
+			for _, rl := range paused[i:] {
+				rl.closeFiles()
+			}
+			return ready
+		}
+	}
+	return ready
+}
@@ -0,0 +1,190 @@
+package handoff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Mxmilu666/nia-forwarding/unixsock"
+)
+
+// 新进程等待旧进程交接并退出的最长时间
+const receiveTimeout = time.Minute
+
+// 单条消息中连接状态的最大长度
+const maxStateSize = 4096
+
+// Server 旧进程的交接套接字，使用SOCK_SEQPACKET保持每个连接的消息边界
+type Server struct {
+	listener *net.UnixListener
+	requests chan *net.UnixConn
+}
+
+// Listen 在path上监听交接请求，只接受与本进程相同用户或root的连接
+func Listen(path string) (*Server, error) {
+	unixsock.RemoveStale(path)
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		return nil, err
+	}
+	if !unixsock.IsAbstract(path) {
+		os.Chmod(path, 0600)
+	}
+
+	s := &Server{listener: listener, requests: make(chan *net.UnixConn, 1)}
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		if !trustedPeer(conn) {
+			conn.Close()
+			continue
+		}
+		select {
+		case s.requests <- conn:
+		default:
+			// 已有交接在进行
+			conn.Close()
+		}
+	}
+}
+
+// 检查对端进程的用户与本进程相同或为root
+func trustedPeer(conn *net.UnixConn) bool {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var cred *unix.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	return err == nil && (cred.Uid == 0 || int(cred.Uid) == os.Getuid())
+}
+
+// Requests 返回新进程发起的交接请求，s为nil时返回的通道永远不会就绪
+func (s *Server) Requests() <-chan *net.UnixConn {
+	if s == nil {
+		return nil
+	}
+	return s.requests
+}
+
+// Close 停止监听，之后新进程无法再发起交接
+func (s *Server) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Transfer 暂停所有已登记的连接并经conn交给新进程，返回交出的连接数；
+// 调用者随后应正常退出并关闭conn，新进程在conn关闭后开始监听
+func (r *Registry) Transfer(conn *net.UnixConn, timeout time.Duration) (int, error) {
+	relays := r.pause(timeout)
+	for i, rl := range relays {
+		data, err := json.Marshal(rl.state)
+		if err == nil {
+			rights := unix.UnixRights(int(rl.files[0].Fd()), int(rl.files[1].Fd()))
+			_, _, err = conn.WriteMsgUnix(data, rights, nil)
+		}
+		if err != nil {
+			for _, rl := range relays[i:] {
+				rl.closeFiles()
+			}
+			return i, err
+		}
+		rl.closeFiles()
+	}
+	return len(relays), nil
+}
+
+// Receive 连接旧进程的交接套接字并接收其交出的连接，直到旧进程退出时关闭套接字；
+// 没有旧进程在path上监听时返回nil。出错时也返回已接收的连接
+func Receive(path string) ([]Conn, error) {
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(receiveTimeout))
+
+	var conns []Conn
+	buf := make([]byte, maxStateSize)
+	oob := make([]byte, unix.CmsgSpace(2*4))
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err == io.EOF || err == nil && n == 0 && oobn == 0 {
+			return conns, nil
+		}
+		if err != nil {
+			return conns, fmt.Errorf("接收连接失败: %w", err)
+		}
+		c, err := parseMessage(buf[:n], oob[:oobn])
+		if err != nil {
+			return conns, err
+		}
+		conns = append(conns, c)
+	}
+}
+
+// 解析一条交接消息，文件描述符转换为TCP连接
+func parseMessage(data, oob []byte) (Conn, error) {
+	var fds []int
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err == nil {
+		for _, msg := range msgs {
+			var rights []int
+			if rights, err = unix.ParseUnixRights(&msg); err != nil {
+				break
+			}
+			fds = append(fds, rights...)
+		}
+	}
+	if err != nil || len(fds) != 2 {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return Conn{}, errors.New("无效的交接消息")
+	}
+
+	c := Conn{}
+	var conns [2]*net.TCPConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "handoff")
+		nc, ferr := net.FileConn(f)
+		f.Close()
+		if ferr == nil {
+			conns[i], _ = nc.(*net.TCPConn)
+			if conns[i] == nil {
+				nc.Close()
+			}
+		}
+	}
+	if conns[0] == nil || conns[1] == nil || json.Unmarshal(data, &c.State) != nil {
+		for _, nc := range conns {
+			if nc != nil {
+				nc.Close()
+			}
+		}
+		return Conn{}, errors.New("无效的交接消息")
+	}
+	c.ClientConn, c.TargetConn = conns[0], conns[1]
+	return c, nil
+}
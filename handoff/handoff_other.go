@@ -0,0 +1,36 @@
+//go:build !linux
+
+package handoff
+
+import (
+	"net"
+	"time"
+)
+
+// Server 旧进程的交接套接字，仅Linux支持
+type Server struct{}
+
+// Listen 仅Linux支持
+func Listen(path string) (*Server, error) {
+	return nil, ErrUnsupported
+}
+
+// Requests 返回的通道永远不会就绪
+func (s *Server) Requests() <-chan *net.UnixConn {
+	return nil
+}
+
+// Close 没有需要关闭的资源
+func (s *Server) Close() error {
+	return nil
+}
+
+// Transfer 仅Linux支持
+func (r *Registry) Transfer(conn *net.UnixConn, timeout time.Duration) (int, error) {
+	return 0, ErrUnsupported
+}
+
+// Receive 仅Linux支持，总是返回nil表示没有可接管的连接
+func Receive(path string) ([]Conn, error) {
+	return nil, nil
+}
@@ -0,0 +1,259 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/i18n"
+	"github.com/Mxmilu666/nia-forwarding/table"
+)
+
+// 监听器的状态
+const (
+	StatePending = "pending" // 尚未绑定，或绑定重试中
+	StateReady   = "ready"   // 已绑定
+	StateFailed  = "failed"  // 绑定失败或规则配置有误而未能启动
+)
+
+// Listener 监听器的描述，用于启动汇总和状态查询
+type Listener struct {
+	ID       string `json:"id"`
+	Rule     string `json:"rule,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Listen   string `json:"listen,omitempty"`
+	Target   string `json:"target,omitempty"`
+
+	Preferred string `json:"preferred,omitempty"` // 首选端口被占用而改用备用端口时为配置的监听地址，Listen为实际地址
+}
+
+// Status 监听器的当前状态
+type Status struct {
+	Listener
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+type entry struct {
+	Status
+	rule bool // 规则级的启动失败，不参与就绪检查
+}
+
+// Tracker 记录所有已启用监听器的绑定状态，用于就绪检查和启动汇总
+type Tracker struct {
+	mu        sync.Mutex
+	listeners map[string]*entry
+	order     []*entry // 登记顺序
+}
+
+// NewTracker 创建状态跟踪器
+func NewTracker() *Tracker {
+	return &Tracker{listeners: make(map[string]*entry)}
+}
+
+// Expect 登记一个需要就绪的监听器，应在启动代理之前调用，绑定失败的监听器会一直保持未就绪
+func (t *Tracker) Expect(id string) {
+	t.Register(Listener{ID: id})
+}
+
+// Register 与Expect相同，同时记录监听器所属的规则和地址
+func (t *Tracker) Register(l Listener) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.listeners[l.ID]; ok {
+		e.Listener = l
+		return
+	}
+	e := &entry{Status: Status{Listener: l, State: StatePending}}
+	t.listeners[l.ID] = e
+	t.order = append(t.order, e)
+}
+
+// SetReady 更新监听器的就绪状态
+func (t *Tracker) SetReady(id string, ready bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.listeners[id]
+	if !ok {
+		e = &entry{Status: Status{Listener: Listener{ID: id}}}
+		t.listeners[id] = e
+		t.order = append(t.order, e)
+	}
+	e.State = StatePending
+	if ready {
+		e.State, e.Error = StateReady, ""
+	}
+}
+
+// SetListen 记录监听器改用的实际监听地址，原地址保存在Preferred中
+func (t *Tracker) SetListen(id, listen string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.listeners[id]; ok && e.Listen != listen {
+		if e.Preferred == "" {
+			e.Preferred = e.Listen
+		}
+		e.Listen = listen
+	}
+}
+
+// Fail 记录监听器启动失败，失败的监听器保持未就绪
+func (t *Tracker) Fail(id string, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.listeners[id]; ok {
+		e.State, e.Error = StateFailed, err.Error()
+	}
+}
+
+// RuleFailed 记录因配置有误而未能启动的规则，只用于启动汇总和状态查询，不影响就绪检查
+func (t *Tracker) RuleFailed(rule, protocol string, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.order = append(t.order, &entry{
+		Status: Status{Listener: Listener{ID: rule, Rule: rule, Protocol: protocol}, State: StateFailed, Error: err.Error()},
+		rule:   true,
+	})
+}
+
+// RemoveRule 移除规则的所有监听器和启动失败记录，用于重新加载配置时停止或重启规则
+func (t *Tracker) RemoveRule(rule string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.order = slices.DeleteFunc(t.order, func(e *entry) bool {
+		if e.Rule != rule {
+			return false
+		}
+		if !e.rule {
+			delete(t.listeners, e.ID)
+		}
+		return true
+	})
+}
+
+// NotReady 返回尚未就绪的监听器，按名称排序
+func (t *Tracker) NotReady() []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ids []string
+	for id, e := range t.listeners {
+		if e.State != StateReady {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Statuses 按登记顺序返回所有监听器和启动失败的规则的状态
+func (t *Tracker) Statuses() []Status {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	statuses := make([]Status, len(t.order))
+	for i, e := range t.order {
+		statuses[i] = e.Status
+	}
+	return statuses
+}
+
+// WaitSettled 等待所有监听器绑定成功或失败，最多等待timeout，返回是否全部已有结果
+func (t *Tracker) WaitSettled(ctx context.Context, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if t.settled() {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline.C:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *Tracker) settled() bool {
+	for _, s := range t.Statuses() {
+		if s.State == StatePending {
+			return false
+		}
+	}
+	return true
+}
+
+// Summary 以表格列出所有监听器的地址和状态，以及启动失败的规则
+func (t *Tracker) Summary() string {
+	var rows [][]string
+	for _, s := range t.Statuses() {
+		state := i18n.Translate("等待中")
+		switch s.State {
+		case StateReady:
+			state = i18n.Translate("已监听")
+		case StateFailed:
+			state = i18n.Translate(fmt.Sprintf("失败: %s", s.Error))
+		}
+		rows = append(rows, []string{s.ID, s.Protocol, s.Listen, s.Target, state})
+	}
+
+	header := []string{"监听器", "协议", "监听地址", "目标", "状态"}
+	for i := range header {
+		header[i] = i18n.Translate(header[i])
+	}
+	var b strings.Builder
+	table.Write(&b, header, rows)
+	return b.String()
+}
+
+// LivenessHandler 进程存活即返回200
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// ReadinessHandler 所有已登记的监听器均已绑定时返回200，否则返回503并列出未就绪的监听器
+func (t *Tracker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if pending := t.NotReady(); len(pending) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready: %s\n", strings.Join(pending, ", "))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,684 @@
+package i18n
+
+// 英文消息目录，键为各模块中原样的中文格式字符串，译文中的动词顺序须与原文一致
+var catalogEN = map[string]string{
+	"故障注入: 连接已重置":                     "fault injection: connection reset",
+	"未找到配置文件 %s，正在生成默认配置...\n":        "config file %s not found, generating default config...\n",
+	"无法创建默认配置文件: %w":                  "cannot create default config file: %w",
+	"已生成默认配置文件: %s，请编辑后重新运行程序\n":      "default config file generated: %s, edit it and run the program again\n",
+	"请编辑配置文件后重新运行":                    "edit the config file and run again",
+	"无法读取配置文件: %w":                    "cannot read config file: %w",
+	"无法解析配置文件: %w":                    "cannot parse config file: %w",
+	"已加载配置文件: %s\n":                   "config file loaded: %s\n",
+	"检查配置文件时出错: %w":                   "error checking config file: %w",
+	"使用默认配置":                          "using default config",
+	"无法序列化配置: %w":                     "cannot serialize config: %w",
+	"无法写入配置文件: %w":                    "cannot write config file: %w",
+	"无效的延迟: %s":                       "invalid delay: %s",
+	"无效的延迟范围: %s":                     "invalid delay range: %s",
+	"无效的字节数: %s":                      "invalid byte size: %s",
+	"发送流记录失败: %v":                     "failed to send flow records: %v",
+	"流记录队列已满，累计丢弃%d条记录":               "flow record queue full, %d records dropped in total",
+	"无效的ICMP隧道对端地址 %q: %w":            "invalid ICMP tunnel peer address %q: %w",
+	"ICMP隧道服务[%s]无法监听 %s: %w":         "ICMP tunnel service [%s] cannot listen on %s: %w",
+	"ICMP隧道服务[%s]已启动: %s -> %s -> %s": "ICMP tunnel service [%s] started: %s -> %s -> %s",
+	"ICMP隧道读取错误: %v":                  "ICMP tunnel read error: %v",
+	"ICMP隧道服务[%s]会话创建: %s -> %s":      "ICMP tunnel service [%s] session created: %s -> %s",
+	"ICMP隧道发送请求错误: %v":                "ICMP tunnel request send error: %v",
+	"ICMP隧道需要root权限或CAP_NET_RAW":      "ICMP tunnel requires root or CAP_NET_RAW",
+	"无法打开ICMP套接字: %w":                 "cannot open ICMP socket: %w",
+	"ICMP隧道服务端已启动，允许的目标: %v":          "ICMP tunnel server started, allowed targets: %v",
+	"ICMP隧道拒绝会话: %s 请求的目标 %s 不在允许列表中": "ICMP tunnel session rejected: %s requested target %s, which is not in the allow list",
+	"ICMP隧道无法连接目标 %s: %v":             "ICMP tunnel cannot connect to target %s: %v",
+	"ICMP隧道会话创建: %s#%d -> %s":         "ICMP tunnel session created: %s#%d -> %s",
+	"ICMP隧道发送应答错误: %v":                "ICMP tunnel reply send error: %v",
+	"数据命中禁止模式":                        "data matched a block pattern",
+	"禁止模式不能同时指定regex和hex: %s":         "block pattern cannot specify both regex and hex: %s",
+	"无效的正则表达式 %s: %w":                 "invalid regular expression %s: %w",
+	"无效的十六进制签名: %s":                   "invalid hex signature: %s",
+	"禁止模式须指定regex或hex":                "block pattern must specify regex or hex",
+	"IP协议转发需要root权限或CAP_NET_RAW":      "IP protocol relay requires root or CAP_NET_RAW",
+	"无法解析目标地址: %w":                    "cannot resolve target address: %w",
+	"无法解析监听地址: %w":                    "cannot resolve listen address: %w",
+	"无法打开原始套接字: %w":                   "cannot open raw socket: %w",
+	"[%s] IP协议%d转发已启动: %s -> %s":      "[%s] IP protocol %d relay started: %s -> %s",
+	"[%s] 原始套接字读取错误: %v":              "[%s] raw socket read error: %v",
+	"[%s] 流量配额已用尽，本周期内丢弃所有数据包":        "[%s] traffic quota exhausted, dropping all packets for this period",
+	"[%s] 发送到 %s 失败: %v":              "[%s] failed to send to %s: %v",
+	"[%s] 对端变更为: %s":                  "[%s] peer changed to: %s",
+	"链路认证失败":                          "link authentication failed",
+	"链路消息超过长度上限":                      "link message exceeds the size limit",
+	"期望auth消息，收到%q":                   "expected auth message, got %q",
+	"不支持的协议版本%d，服务端版本为%d":             "unsupported protocol version %d, server version is %d",
+	"不支持的协议版本%d":                      "unsupported protocol version %d",
+	"期望hello消息，收到%q":                  "expected hello message, got %q",
+	"握手被拒绝: %s":                       "handshake rejected: %s",
+	"%s 不是IPv4组播地址":                   "%s is not an IPv4 multicast address",
+	"找不到网卡 %s: %w":                    "interface %s not found: %w",
+	"反向转发服务端允许端口解析错误: %v":             "reverse server allow_ports parse error: %v",
+	"反向转发服务端未配置token，不启动":             "reverse server has no token configured, not starting",
+	"反向转发服务端错误: %v":                   "reverse server error: %v",
+	"ICMP隧道未配置key，不启动":                "ICMP tunnel has no key configured, not starting",
+	"ICMP隧道服务端未配置allow_targets，不启动":   "ICMP tunnel server has no allow_targets configured, not starting",
+	"ICMP隧道配置错误: %v":                  "ICMP tunnel config error: %v",
+	"ICMP隧道配置错误: 无效的role %q":          "ICMP tunnel config error: invalid role %q",
+	"ICMP隧道未启动: %v":                   "ICMP tunnel not started: %v",
+	"监听端口数量(%d)与目标端口数量(%d)不匹配":        "number of listen ports (%d) does not match number of target ports (%d)",
+	"unix套接字、命名管道和串口只能配置一个":           "only one of unix socket, named pipe and serial port can be configured",
+	"命名管道仅用于TCP":                      "named pipes are only supported for TCP",
+	"命名管道仅支持Windows":                  "named pipes are only supported on Windows",
+	"串口仅用于TCP":                        "serial ports are only supported for TCP",
+	"端口范围格式无效: %s":                    "invalid port range format: %s",
+	"无效的起始端口: %s":                     "invalid start port: %s",
+	"无效的结束端口: %s":                     "invalid end port: %s",
+	"端口范围无效，起始端口大于结束端口: %d > %d":      "invalid port range, start port is greater than end port: %d > %d",
+	"无效的端口号: %s":                      "invalid port number: %s",
+	"TLS最低版本%s高于最高版本%s":               "TLS minimum version %s is higher than maximum version %s",
+	"替换规则的查找串不能为空":                    "rewrite search string cannot be empty",
+	"无效的替换方向: %s":                     "invalid rewrite direction: %s",
+	"配置[%s]已启用故障注入: 延迟%s±%s, 带宽%s/s, 重置概率%g, UDP丢包%g%%, 乱序%g%%": "rule [%s] fault injection enabled: delay %s±%s, bandwidth %s/s, reset probability %g, UDP loss %g%%, reorder %g%%",
+	"配置[%s]转发延迟: %s":               "rule [%s] forwarding delay: %s",
+	"指标服务已启动: http://%s/metrics":   "metrics server started: http://%s/metrics",
+	"指标服务错误: %v":                   "metrics server error: %v",
+	"生成配置文件失败: %v":                 "failed to generate config file: %v",
+	"默认配置已保存到: %s":                 "default config saved to: %s",
+	"生成仪表盘失败: %v":                  "failed to generate dashboard: %v",
+	"Grafana仪表盘已保存到: %s":           "Grafana dashboard saved to: %s",
+	"回放需要通过 -replay-target 指定目标地址": "replay requires a target address via -replay-target",
+	"读取录制文件失败: %v":                 "failed to read recording: %v",
+	"回放%s录制: %d块数据, 录制于%s":         "replaying %s recording: %d chunks, recorded at %s",
+	"回放失败: %v":                     "replay failed: %v",
+	"加载配置失败: %v":                   "failed to load config: %v",
+	"加载流量配额失败: %v":                 "failed to load traffic quotas: %v",
+	"创建流记录导出器失败: %v":               "failed to create flow exporter: %v",
+	"流记录将以IPFIX格式导出到: %s":          "flow records will be exported as IPFIX to: %s",
+	"创建StatsD推送失败: %v":             "failed to create StatsD pusher: %v",
+	"指标将推送到StatsD: %s":             "metrics will be pushed to StatsD: %s",
+	"指标将推送到InfluxDB: %s":           "metrics will be pushed to InfluxDB: %s",
+	"配置[%s]监听端口解析错误: %v":           "rule [%s] listen port parse error: %v",
+	"配置[%s]目标端口解析错误: %v":           "rule [%s] target port parse error: %v",
+	"配置[%s]流量配额: 本周期已使用%d/%d字节":    "rule [%s] traffic quota: %d/%d bytes used this period",
+	"配置[%s]中间件错误: %v":              "rule [%s] middleware error: %v",
+	"配置[%s]禁止模式错误: %v":             "rule [%s] block pattern error: %v",
+	"配置[%s]错误: %v":                 "rule [%s] error: %v",
+	"配置[%s]录制错误: %v":               "rule [%s] recording error: %v",
+	"配置[%s]上游代理错误: %v":             "rule [%s] upstream proxy error: %v",
+	"配置[%s]SSH跳板机错误: %v":           "rule [%s] SSH jump host error: %v",
+	"配置[%s]WireGuard隧道[%s]不可用: %v": "rule [%s] WireGuard tunnel [%s] is unavailable: %v",
+	"配置[%s]Shadowsocks错误: %v":      "rule [%s] Shadowsocks error: %v",
+	"配置[%s]UDP混淆错误: %v":            "rule [%s] UDP obfuscation error: %v",
+	"配置[%s]的上游代理、SSH跳板机和WireGuard隧道仅对TCP生效，UDP仍直接连接目标": "rule [%s] upstream proxy, SSH jump host and WireGuard tunnel only apply to TCP, UDP still connects to the target directly",
+	"配置[%s]的Shadowsocks加密仅对TCP生效，UDP仍明文转发":             "rule [%s] Shadowsocks encryption only applies to TCP, UDP is still forwarded in plaintext",
+	"配置[%s]错误: listen_serial只能转发到TCP地址":                "rule [%s] error: listen_serial can only forward to a TCP address",
+	"串口转发[%s]错误: %v":                           "serial bridge [%s] error: %v",
+	"配置[%s]TLS错误: %v":                          "rule [%s] TLS error: %v",
+	"配置[%s]替换规则错误: %v":                         "rule [%s] rewrite error: %v",
+	"TCP代理[%s]错误: %v":                          "TCP proxy [%s] error: %v",
+	"已启动TCP端口组[%s]: %s -> %s, 共%d个端口对":         "TCP port group [%s] started: %s -> %s, %d port pairs",
+	"配置[%s]错误: 无效的fanout_replies '%s'":         "rule [%s] error: invalid fanout_replies '%s'",
+	"配置[%s]错误: 无效的session_mode '%s'":           "rule [%s] error: invalid session_mode '%s'",
+	"配置[%s]组播错误: %v":                           "rule [%s] multicast error: %v",
+	"UDP代理[%s]错误: %v":                          "UDP proxy [%s] error: %v",
+	"已启动UDP端口组[%s]: %s -> %s, 共%d个端口对":         "UDP port group [%s] started: %s -> %s, %d port pairs",
+	"配置[%s]错误: 无效的ip_protocol %d":              "rule [%s] error: invalid ip_protocol %d",
+	"配置[%s]错误: 无效的ip_peer '%s'":                "rule [%s] error: invalid ip_peer '%s'",
+	"IP协议转发[%s]错误: %v":                         "IP protocol relay [%s] error: %v",
+	"配置[%s]错误: 不支持的协议类型 '%s'":                  "rule [%s] error: unsupported protocol '%s'",
+	"正在关闭服务...":                                "shutting down...",
+	"保存流量配额失败: %v":                             "failed to save traffic quotas: %v",
+	"规则[%s] %s统计: 累计连接%d, 上行%d字节, 下行%d字节":      "rule [%s] %s stats: %d connections total, %d bytes up, %d bytes down",
+	"服务已关闭":                                    "shutdown complete",
+	"规则[%s] %s事件命令执行失败: %v: %s":                "rule [%s] %s event command failed: %v: %s",
+	"未指定Lua脚本路径(path)":                         "Lua script path (path) not specified",
+	"无法读取Lua脚本: %w":                            "cannot read Lua script: %w",
+	"无法解析Lua脚本: %w":                            "cannot parse Lua script: %w",
+	"无法编译Lua脚本: %w":                            "cannot compile Lua script: %w",
+	"执行Lua脚本失败: %w":                            "failed to run Lua script: %w",
+	"Lua函数%s执行失败: %w":                          "Lua function %s failed: %w",
+	"Lua脚本拒绝: %s":                              "rejected by Lua script: %s",
+	"Lua脚本拒绝":                                  "rejected by Lua script",
+	"中间件重复注册: %s":                              "middleware registered twice: %s",
+	"未知的中间件: %s":                               "unknown middleware: %s",
+	"创建中间件%s失败: %w":                            "failed to create middleware %s: %w",
+	"WASM过滤器拒绝":                                "rejected by WASM filter",
+	"未指定WASM模块路径(path)":                        "WASM module path (path) not specified",
+	"无法读取WASM模块: %w":                           "cannot read WASM module: %w",
+	"无法编译WASM模块: %w":                           "cannot compile WASM module: %w",
+	"WASM模块未导出alloc函数":                         "WASM module does not export an alloc function",
+	"无法实例化WASM模块: %w":                          "cannot instantiate WASM module: %w",
+	"WASM模块内存越界":                               "WASM module memory access out of bounds",
+	"WASM过滤器执行失败: %w":                          "WASM filter failed: %w",
+	"obfs: 数据包过短":                              "obfs: packet too short",
+	"无效的混淆方式: %q，应为xor或chacha20":               "invalid obfuscation mode: %q, must be xor or chacha20",
+	"无效的角色: %q，应为client或server":                "invalid role: %q, must be client or server",
+	"未配置预共享密钥":                                 "no pre-shared key configured",
+	"无效的PROXY协议版本: %q，应为v1或v2":                 "invalid PROXY protocol version: %q, must be v1 or v2",
+	"PROXY协议仅支持TCP地址":                          "PROXY protocol only supports TCP addresses",
+	"无效的PROXY协议版本: %d":                         "invalid PROXY protocol version: %d",
+	"无法读取流量配额文件: %w":                           "cannot read traffic quota file: %w",
+	"无法解析流量配额文件: %w":                           "cannot parse traffic quota file: %w",
+	"无法创建录制目录: %w":                             "cannot create recording directory: %w",
+	"[%s] 创建录制文件失败: %v":                        "[%s] failed to create recording file: %v",
+	"写入录制文件失败: %v":                             "failed to write recording file: %v",
+	"不是有效的录制文件":                                "not a valid recording file",
+	"不支持的录制文件版本: %d":                           "unsupported recording file version: %d",
+	"录制文件头部不完整: %w":                            "incomplete recording file header: %w",
+	"录制文件末尾不完整，已忽略: %v":                        "incomplete recording file tail, ignored: %v",
+	"无法连接到目标: %w":                              "cannot connect to target: %w",
+	"发送失败: %w":                                 "send failed: %w",
+	"已回放%d块数据共%d字节，用时%s":                       "replayed %d chunks, %d bytes in total, took %s",
+	"目标已关闭连接，共收到%d字节":                          "target closed the connection, %d bytes received in total",
+	"共收到%d字节":                                  "%d bytes received in total",
+	"反向转发代理端与服务端 %s 的连接断开: %v, %s后重连":          "reverse agent lost connection to server %s: %v, reconnecting in %s",
+	"注册失败: %s":                                 "registration failed: %s",
+	"反向转发服务[%s]被服务端拒绝: %s":                     "reverse service [%s] rejected by server: %s",
+	"反向转发代理端已连接到服务端 %s(%s), 接受%d/%d个服务":        "reverse agent connected to server %s(%s), %d/%d services accepted",
+	"反向转发代理端收到未知服务的连接请求: %s":                   "reverse agent received a connection request for unknown service: %s",
+	"反向转发服务[%s]无法连接本地地址 %s: %v":                "reverse service [%s] cannot connect to local address %s: %v",
+	"反向转发服务[%s]无法建立工作连接: %v":                   "reverse service [%s] cannot establish work connection: %v",
+	"无法监听: %w":                                 "cannot listen: %w",
+	"反向转发服务端已启动: %s":                           "reverse server started: %s",
+	"反向转发服务端接受连接错误: %v":                        "reverse server accept error: %v",
+	"反向转发代理端认证失败: %s":                          "reverse agent authentication failed: %s",
+	"反向转发代理端 %s 未注册服务":                         "reverse agent %s registered no services",
+	"反向转发代理端 %s 的服务[%s]被拒绝: %v":                "reverse agent %s service [%s] rejected: %v",
+	"反向转发代理端已连接: %s, 接受%d/%d个服务":               "reverse agent connected: %s, %d/%d services accepted",
+	"反向转发代理端 %s 已断开: %v":                       "reverse agent %s disconnected: %v",
+	"公网端口%d不在允许范围内":                            "public port %d is not in the allowed range",
+	"公网端口%d已被服务[%s]占用":                         "public port %d is already used by service [%s]",
+	"无法监听公网端口%d: %w":                           "cannot listen on public port %d: %w",
+	"反向转发服务[%s]已在公网端口%d上监听":                    "reverse service [%s] listening on public port %d",
+	"反向转发服务[%s]接受连接错误: %v":                     "reverse service [%s] accept error: %v",
+	"反向转发服务[%s]等待代理端工作连接超时: %s":                "reverse service [%s] timed out waiting for agent work connection: %s",
+	"反向转发服务[%s]: %s -> %s":                     "reverse service [%s]: %s -> %s",
+	"反向转发服务[%s]连接关闭: %s, 上行%d字节, 下行%d字节, 持续%s": "reverse service [%s] connection closed: %s, %d bytes up, %d bytes down, duration %s",
+	"[%s] 串口转发已启动: %s -> %s":                   "[%s] serial bridge started: %s -> %s",
+	"[%s] 串口读取错误: %v":                          "[%s] serial read error: %v",
+	"[%s] 流量配额已用尽，本周期内不再连接目标":                  "[%s] traffic quota exhausted, no more target connections this period",
+	"[%s] 无法连接到TCP目标 %s: %v":                   "[%s] cannot connect to TCP target %s: %v",
+	"串口已关闭":                                    "serial port closed",
+	"[%s] 串口转发: %s -> %s":                      "[%s] serial bridge: %s -> %s",
+	"[%s] 串口转发连接关闭: %s, 上行%d字节, 下行%d字节, 持续%s":  "[%s] serial bridge connection closed: %s, %d bytes up, %d bytes down, duration %s",
+	"未配置串口设备":                                  "no serial device configured",
+	"无效的串口格式: %q":                              "invalid serial format: %q",
+	"无效的串口校验位: %q":                             "invalid serial parity: %q",
+	"无效的串口停止位: %q":                             "invalid serial stop bits: %q",
+	"串口 %s 正在被使用":                              "serial port %s is in use",
+	"无法打开串口 %s: %w":                            "cannot open serial port %s: %w",
+	"无效的端口: %q":                                "invalid port: %q",
+	"域名过长: %q":                                 "domain name too long: %q",
+	"无效的地址类型 %d":                               "invalid address type %d",
+	"不支持的加密方式: %q":                             "unsupported cipher: %q",
+	"未配置密码":                                    "no password configured",
+	"client模式须配置destination":                   "client mode requires destination",
+	"无效的destination: %w":                       "invalid destination: %w",
+	"无效的模式: %q，应为client或server":                "invalid mode: %q, must be client or server",
+	"shadowsocks: 解密失败，请检查密码和加密方式":             "shadowsocks: decryption failed, check password and cipher",
+	"推送%s指标失败: %v":                             "failed to push %s metrics: %v",
+	"当前系统不支持设置监听队列长度":                          "setting the listen backlog is not supported on this system",
+	"无法监听TCP: %w":                              "cannot listen on TCP: %w",
+	"[%s] 设置监听队列长度失败: %v":                      "[%s] failed to set listen backlog: %v",
+	"[%s] TCP转发已启动: %s -> %s\n":                "[%s] TCP forwarding started: %s -> %s\n",
+	"[%s] TCP接受连接错误: %v":                       "[%s] TCP accept error: %v",
+	"[%s] 流量配额已用尽，本周期内拒绝新的TCP连接":               "[%s] traffic quota exhausted, rejecting new TCP connections this period",
+	"[%s] TCP连接被拒绝: %s 并发连接数已达上限":              "[%s] TCP connection rejected: %s concurrent connection limit reached",
+	"[%s] TLS握手失败: %s: %v":                     "[%s] TLS handshake failed: %s: %v",
+	"[%s] TCP连接被中间件拒绝: %s: %v":                 "[%s] TCP connection rejected by middleware: %s: %v",
+	"[%s] TCP连接目标前被中间件中止: %s: %v":              "[%s] TCP connection aborted by middleware before connecting to target: %s: %v",
+	"[%s]无法连接到TCP目标 %s: %v":                    "[%s] cannot connect to TCP target %s: %v",
+	"[%s] 已连接TCP目标 %s, 耗时%s":                   "[%s] connected to TCP target %s, took %s",
+	"[%s] 发送Shadowsocks地址头失败: %v":              "[%s] failed to send Shadowsocks address header: %v",
+	"[%s] 发送PROXY协议头失败: %v":                    "[%s] failed to send PROXY protocol header: %v",
+	"[%s] TCP转发: %s -> %s -> %s":               "[%s] TCP forwarding: %s -> %s -> %s",
+	"[%s] TCP连接被断开: %s 数据命中禁止模式":               "[%s] TCP connection dropped: %s data matched a block pattern",
+	"[%s] TCP连接被故障注入重置: %s":                    "[%s] TCP connection reset by fault injection: %s",
+	"[%s] TCP客户端->目标错误: %v":                    "[%s] TCP client->target error: %v",
+	"[%s] TCP目标->客户端错误: %v":                    "[%s] TCP target->client error: %v",
+	"[%s] TCP连接关闭: %s, 上行%d字节, 下行%d字节, 持续%s":   "[%s] TCP connection closed: %s, %d bytes up, %d bytes down, duration %s",
+	"[%s] 设置TCP接收缓冲区失败: %v":                    "[%s] failed to set TCP receive buffer: %v",
+	"[%s] 设置TCP发送缓冲区失败: %v":                    "[%s] failed to set TCP send buffer: %v",
+	"获取OCSP响应失败 %s: %v":                        "failed to fetch OCSP response %s: %v",
+	"证书未包含OCSP服务器地址":                           "certificate has no OCSP server address",
+	"证书链中缺少签发者证书":                              "issuer certificate missing from certificate chain",
+	"无法解析签发者证书: %w":                            "cannot parse issuer certificate: %w",
+	"无法创建OCSP请求: %w":                           "cannot create OCSP request: %w",
+	"OCSP服务器返回状态码 %d":                          "OCSP server returned status code %d",
+	"无法解析OCSP响应: %w":                           "cannot parse OCSP response: %w",
+	"OCSP证书状态异常: %d":                           "unexpected OCSP certificate status: %d",
+	"无效的TLS版本: %s":                             "invalid TLS version: %s",
+	"不支持的密码套件: %s":                             "unsupported cipher suite: %s",
+	"未配置证书":                                    "no certificate configured",
+	"检查证书文件失败: %v":                             "failed to check certificate files: %v",
+	"重新加载证书失败，继续使用旧证书: %v":                     "failed to reload certificate, keeping the old one: %v",
+	"已重新加载证书: %s":                              "certificate reloaded: %s",
+	"无法加载证书 %s: %w":                            "cannot load certificate %s: %w",
+	"无法解析证书 %s: %w":                            "cannot parse certificate %s: %w",
+	"网卡 %s 没有IPv4地址":                           "interface %s has no IPv4 address",
+	"无法解析UDP监听地址: %w":                          "cannot resolve UDP listen address: %w",
+	"[%s] 组播监听只使用一个套接字，%d个读取循环将共享该套接字":       "[%s] multicast listening uses a single socket, %d read loops will share it",
+	"[%s] unixgram监听只使用一个套接字，%d个读取循环将共享该套接字": "[%s] unixgram listening uses a single socket, %d read loops will share it",
+	"无法监听UDP: %w":                             "cannot listen on UDP: %w",
+	"[%s] 设置UDP套接字缓冲区失败: %v":                  "[%s] failed to set UDP socket buffers: %v",
+	"[%s] UDP转发已启动: 组播%s:%d -> %s\n":          "[%s] UDP forwarding started: multicast %s:%d -> %s\n",
+	"[%s] UDP转发已启动: %s -> %s\n":               "[%s] UDP forwarding started: %s -> %s\n",
+	"[%s] UDP读取错误: %v":                        "[%s] UDP read error: %v",
+	"[%s] UDP数据包命中禁止模式被丢弃: %s":                "[%s] UDP packet dropped, matched a block pattern: %s",
+	"[%s] 流量配额已用尽，本周期内不再创建新的UDP会话":            "[%s] traffic quota exhausted, no new UDP sessions this period",
+	"[%s] UDP数据包被中间件丢弃: %s: %v":               "[%s] UDP packet dropped by middleware: %s: %v",
+	"[%s] UDP数据包被丢弃: %s 并发会话数已达上限":            "[%s] UDP packet dropped: %s concurrent session limit reached",
+	"[%s] UDP会话创建前被中间件中止: %s: %v":             "[%s] UDP session aborted by middleware before creation: %s: %v",
+	"[%s] 创建UDP会话失败: %v":                      "[%s] failed to create UDP session: %v",
+	"无法解析目标UDP地址: %w":                         "cannot resolve target UDP address: %w",
+	"无法解析扇出目标地址: %w":                          "cannot resolve fanout target address: %w",
+	"扇出目标 %s 与目标 %s 的地址类型不同":                  "fanout target %s has a different address type from target %s",
+	"无法创建UDP会话: %w":                           "cannot create UDP session: %w",
+	"[%s] 设置UDP会话套接字缓冲区失败: %v":                "[%s] failed to set UDP session socket buffers: %v",
+	"[%s] 设置UDP组播发送网卡失败: %v":                  "[%s] failed to set UDP multicast outgoing interface: %v",
+	"[%s] UDP会话创建: %s -> %s -> %s":            "[%s] UDP session created: %s -> %s -> %s",
+	"[%s] UDP发送到目标 %s 错误: %v":                 "[%s] UDP send to target %s error: %v",
+	"[%s] UDP数据包: %s -> %s, %d字节":             "[%s] UDP packet: %s -> %s, %d bytes",
+	"[%s] UDP返回到客户端错误: %v":                    "[%s] UDP reply to client error: %v",
+	"[%s] UDP会话超时: %s":                        "[%s] UDP session timed out: %s",
+	"[%s] UDP会话关闭: %s, 上行%d字节, 下行%d字节, 持续%s":  "[%s] UDP session closed: %s, %d bytes up, %d bytes down, duration %s",
+	"unix套接字路径为空":                             "unix socket path is empty",
+	"抽象命名空间套接字 %q 仅支持Linux":                   "abstract namespace socket %q is only supported on Linux",
+	"读取CONNECT响应失败: %w":                       "failed to read CONNECT response: %w",
+	"连接 %s 失败: %s":                            "connect to %s failed: %s",
+	"服务器故障":                                   "general server failure",
+	"规则不允许连接":                                 "connection not allowed by ruleset",
+	"网络不可达":                                   "network unreachable",
+	"主机不可达":                                   "host unreachable",
+	"连接被拒绝":                                   "connection refused",
+	"TTL过期":                                   "TTL expired",
+	"不支持的命令":                                  "command not supported",
+	"不支持的地址类型":                                "address type not supported",
+	"不是SOCKS5服务器 (版本 %d)":                     "not a SOCKS5 server (version %d)",
+	"没有可接受的认证方式":                              "no acceptable authentication method",
+	"不支持的认证方式 %d":                             "unsupported authentication method %d",
+	"连接 %s 失败: 错误码 %d":                        "connect to %s failed: error code %d",
+	"用户名或密码过长":                                "username or password too long",
+	"用户名或密码错误":                                "wrong username or password",
+	"SSH跳板机须配置host和user":                      "SSH jump host requires host and user",
+	"无法读取私钥: %w":                              "cannot read private key: %w",
+	"无法解析私钥: %w":                              "cannot parse private key: %w",
+	"SSH跳板机须配置key或password":                   "SSH jump host requires key or password",
+	"无法读取known_hosts: %w":                     "cannot read known_hosts: %w",
+	"与SSH跳板机 %s 的连接已断开: %v":                   "connection to SSH jump host %s lost: %v",
+	"无法连接SSH跳板机 %s: %w":                       "cannot connect to SSH jump host %s: %w",
+	"SSH跳板机 %s: %w":                           "SSH jump host %s: %w",
+	"无效的上游代理地址: %w":                           "invalid upstream proxy address: %w",
+	"不支持的上游代理协议: %q":                          "unsupported upstream proxy scheme: %q",
+	"上游代理地址缺少主机名: %q":                         "upstream proxy address has no host name: %q",
+	"无法连接上游代理 %s: %w":                         "cannot connect to upstream proxy %s: %w",
+	"上游代理 %s: %w":                             "upstream proxy %s: %w",
+	"WireGuard隧道[%s]启动失败: %v":                 "WireGuard tunnel [%s] failed to start: %v",
+	"WireGuard隧道[%s]已启动，隧道内地址: %v":            "WireGuard tunnel [%s] started, tunnel addresses: %v",
+	"WireGuard隧道[%s]: %s":                     "WireGuard tunnel [%s]: %s",
+	"经WireGuard隧道[%s]连接 %s 失败: %w":            "WireGuard tunnel [%s]: connect to %s failed: %w",
+	"未配置隧道内地址":                                "no tunnel address configured",
+	"未配置对端":                                   "no peers configured",
+	"无效的MTU %d":                               "invalid MTU %d",
+	"创建隧道失败: %w":                              "failed to create tunnel: %w",
+	"配置隧道失败: %w":                              "failed to configure tunnel: %w",
+	"启动隧道失败: %w":                              "failed to bring up tunnel: %w",
+	"无效的private_key: %w":                      "invalid private_key: %w",
+	"第%d个对端的public_key无效: %w":                 "invalid public_key of peer %d: %w",
+	"第%d个对端的preshared_key无效: %w":              "invalid preshared_key of peer %d: %w",
+	"第%d个对端的endpoint无效: %w":                   "invalid endpoint of peer %d: %w",
+	"密钥应为32字节，实际为%d字节":                        "key should be 32 bytes, got %d bytes",
+	"无效的端口 %q":                                "invalid port %q",
+	"无效的隧道内地址 %q":                             "invalid tunnel address %q",
+	"无效的网段 %q":                                "invalid prefix %q",
+	"无效的日志级别: %q":                             "invalid log level: %q",
+	"无效的日志语言: %q":                             "invalid log language: %q",
+	"无法打开审计日志: %w":                            "cannot open audit log: %w",
+	"无法读取审计日志: %w":                            "cannot read audit log: %w",
+	"写入审计日志失败: %w":                            "failed to write audit log: %w",
+	"打开审计日志失败: %v":                            "failed to open audit log: %v",
+	"记录审计日志失败: %v":                            "failed to record audit log: %v",
+	"端口号超出范围(1-65535): %d":                    "port number out of range (1-65535): %d",
+	"配置文件有误:":                                 "invalid config file:",
+	"%s:%d: %s: %s":                           "%s:%d: %s: %s",
+	"%s:%d: %s":                               "%s:%d: %s",
+	"未知的配置项 %q":                               "unknown config key %q",
+	"未知的配置项 %q，是否为 %q?":                       "unknown config key %q, did you mean %q?",
+	"无效的地址 %q":                                "invalid address %q",
+	"无效的IP地址: %q":                             "invalid IP address: %q",
+	"无效的IP地址或主机名: %q":                         "invalid IP address or host name: %q",
+	"未定义的WireGuard隧道 %q":                      "undefined WireGuard tunnel %q",
+	"wireguard不能与upstream_proxy和ssh_jump同时使用": "wireguard cannot be combined with upstream_proxy or ssh_jump",
+	"MTU应在1280到65535之间":                       "MTU must be between 1280 and 65535",
+	"无效的密钥，应为base64编码的32字节":                   "invalid key, expected 32 bytes encoded in base64",
+	"第%d行: 无效的配置文件版本: %q":                     "line %d: invalid config version: %q",
+	"配置文件版本%d高于本程序支持的版本%d，请升级程序":              "config version %d is newer than the supported version %d, upgrade the program",
+	"第%d行: version 由%d更新为%d":                  "line %d: version updated from %d to %d",
+	"添加 version: %d":                          "added version: %d",
+	"无法备份配置文件: %w":                            "cannot back up config file: %w",
+	"第%d行: 无法自动迁移":                            "line %d: cannot migrate automatically",
+	"第%d行: 无法自动迁移%s，请手动修改":                    "line %d: cannot migrate %s automatically, edit it by hand",
+	"无法升级配置文件: %w":                            "cannot upgrade config file: %w",
+	"配置文件为旧版本格式，已按第%d版读取，可运行 -migrate %s 升级文件:\n": "config file uses an old format and was read as version %d, run -migrate %s to upgrade it:\n",
+	"  %s\n":       "  %s\n",
+	"升级配置文件失败: %v": "failed to upgrade config file: %v",
+	"配置文件已是第%d版，无需升级":              "config file is already version %d, nothing to upgrade",
+	"配置文件已升级到第%d版，原文件保存为%s.bak:":   "config file upgraded to version %d, original saved as %s.bak:",
+	"无效的IP协议族 %q，应为ipv4、ipv6或dual": "invalid IP family %q, must be ipv4, ipv6 or dual",
+	"无法展开配置模板: %w":                 "cannot expand config template: %w",
+	"vars须为变量名到取值的映射":              "vars must map variable names to values",
+	"变量的取值须为字符串或数字":                "variable values must be strings or numbers",
+	"foreach须为变量名到取值列表的映射":         "foreach must map variable names to value lists",
+	"取值须为端口表达式或列表":                 "values must be a port expression or a list",
+	"取值数量(%d)与%s的取值数量(%d)不同":       "number of values (%d) differs from the number of values of %s (%d)",
+	"未定义的变量 %q":                    "undefined variable %q",
+	"%s: %s: %s":                   "%s: %s: %s",
+	"[%s] 无法连接目标组[%s]中的 %s: %v":    "[%s] target group [%s]: cannot connect to %s: %v",
+	"目标组[%s]中的目标均无法连接: %w":         "no target in target group [%s] is reachable: %w",
+	"目标组 %q 没有目标":                  "target group %q has no targets",
+	"未定义的目标组 %q":                   "undefined target group %q",
+	"target_group不能与其他目标配置同时使用":    "target_group cannot be combined with other target options",
+	"目标组仅用于TCP和UDP":                "target groups only apply to TCP and UDP",
+
+	"配置文件不存在: %s":          "config file does not exist: %s",
+	"规则名称 %q 已在之前的配置文件中定义": "rule name %q is already defined in an earlier config file",
+
+	"[%s] 监听地址被占用，%v后重试: %v": "[%s] listen address in use, retrying in %v: %v",
+
+	"启动汇总:":  "startup summary:",
+	"监听器":    "listener",
+	"协议":     "protocol",
+	"监听地址":   "listen",
+	"目标":     "target",
+	"状态":     "state",
+	"等待中":    "pending",
+	"已监听":    "listening",
+	"失败: %s": "failed: %s",
+
+	"运行时间: %s，启动于%s，监听器: %d/%d已就绪": "uptime: %s, started at %s, listeners: %d/%d ready",
+	"规则":             "rule",
+	"活动连接":           "active",
+	"累计连接":           "total",
+	"上行":             "up",
+	"下行":             "down",
+	"错误":             "errors",
+	"未就绪的监听器:":       "listeners not ready:",
+	"无法连接运行中的实例: %v": "cannot connect to the running instance: %v",
+	"读取状态失败: %s":     "failed to read status: %s",
+	"无法解析状态: %v":     "cannot parse status: %v",
+	"未找到配置文件，请通过 -config 或 -addr 指定运行中的实例":    "config file not found, use -config or -addr to specify the running instance",
+	"配置中未设置metrics_listen，请通过 -addr 指定运行中的实例": "metrics_listen is not set in the config, use -addr to specify the running instance",
+	"查询状态失败: %v": "failed to query status: %v",
+	"输出状态失败: %v": "failed to print status: %v",
+	"未知的子命令: %s": "unknown subcommand: %s",
+
+	"抽样率不能为负数": "sample rate must not be negative",
+
+	"重复%d次(最近%s内): %s": "repeated %d times (in the last %s): %s",
+
+	"无法把文件描述符上限由%d提高到%d: %v": "cannot raise the file descriptor limit from %d to %d: %v",
+	"文件描述符上限已由%d提高到%d":       "raised the file descriptor limit from %d to %d",
+	"文件描述符上限%d低于配置所需的%d(%d个监听器，最多%d个TCP连接)，请用 ulimit -n 或服务的LimitNOFILE提高上限": "file descriptor limit %d is below the %d the config needs (%d listeners, at most %d TCP connections); raise it with ulimit -n or the service's LimitNOFILE",
+	"文件描述符上限%d不足以容纳%d个监听器，请用 ulimit -n 或服务的LimitNOFILE提高上限":                  "file descriptor limit %d is too low for %d listeners; raise it with ulimit -n or the service's LimitNOFILE",
+	"文件描述符上限为%d，除%d个监听器外约可同时处理%d个TCP连接或%d个UDP会话":                             "file descriptor limit is %d; besides %d listeners it allows about %d concurrent TCP connections or %d UDP sessions",
+	"当前系统不支持设置文件描述符上限":                                                       "setting the file descriptor limit is not supported on this system",
+
+	"内存用量%dMB超过预算%dMB，暂停接受新的TCP连接和UDP会话": "memory usage %dMB exceeds the %dMB budget, pausing new TCP connections and UDP sessions",
+	"内存用量已降至%dMB，恢复接受新的TCP连接和UDP会话":      "memory usage dropped to %dMB, accepting new TCP connections and UDP sessions again",
+
+	"[%s] UDP目标 %s 不可达，关闭会话: %v": "[%s] UDP target %s is unreachable, closing session: %v",
+
+	"[%s] 无法使用拥塞控制算法%s，使用系统默认算法: %v":       "[%s] cannot use congestion control algorithm %s, using the system default: %v",
+	"[%s] 设置TCP拥塞控制算法失败: %v":               "[%s] failed to set TCP congestion control algorithm: %v",
+	"内核未提供该算法(可用: %s)，可能需要先加载tcp_%s模块":     "the kernel does not provide this algorithm (available: %s); the tcp_%s module may need to be loaded",
+	"仅Linux支持设置拥塞控制算法":                     "setting the congestion control algorithm is only supported on Linux",
+	"只有转发规则和目标组的变更在重新加载后生效，其他配置项的变更需要重启程序": "only changes to forwarding rules and target groups take effect on reload, other settings require a restart",
+	"关闭了%d个没有被新规则接手的监听套接字":                 "closed %d listening sockets not taken over by new rules",
+	"配置已重新加载: 新增%d条规则, 重启%d条规则, 停止%d条规则":   "config reloaded: %d rules added, %d rules restarted, %d rules stopped",
+	"  新增规则[%s]":          "  added rule [%s]",
+	"  重启规则[%s]":          "  restarted rule [%s]",
+	"  停止规则[%s]":          "  stopped rule [%s]",
+	"收到SIGHUP，重新加载配置":     "received SIGHUP, reloading config",
+	"重新加载配置失败，保持当前配置: %v": "failed to reload config, keeping the current config: %v",
+	"无法确定配置文件路径: %w":      "cannot determine config file path: %w",
+
+	"[%s] 监听地址在本机不存在，等待网卡地址变化后重试: %v": "[%s] listen address does not exist on this host, retrying after network addresses change: %v",
+	"无法订阅网卡变化事件，改为每%v检查一次: %v":        "cannot subscribe to network interface events, checking every %v instead: %v",
+
+	"无效的源地址策略 %q，应为stable、temporary或IPv6前缀": "invalid source address policy %q, expected stable, temporary or an IPv6 prefix",
+	"本机没有位于%s内的IPv6地址":                      "no local IPv6 address within %s",
+	"仅Linux支持按稳定地址或临时地址选择源地址":               "preferring stable or temporary source addresses is only supported on Linux",
+	"无效的DSCP取值 %q，应为0-63或EF、AF41、CS1等名称":    "invalid DSCP value %q, expected 0-63 or a name such as EF, AF41, CS1",
+	"该平台不支持为套接字设置DSCP，Windows请使用组策略中的QoS策略": "setting DSCP on sockets is not supported on this platform; on Windows use a Group Policy QoS policy",
+	"[%s] 设置TCP连接的DSCP失败: %v":               "[%s] failed to set DSCP on TCP connection: %v",
+	"[%s] 设置UDP套接字的DSCP失败: %v":              "[%s] failed to set DSCP on UDP socket: %v",
+	"[%s] 设置UDP会话套接字的DSCP失败: %v":            "[%s] failed to set DSCP on UDP session socket: %v",
+	"无法设置fwmark，需要root或CAP_NET_ADMIN权限: %w": "cannot set fwmark, root or CAP_NET_ADMIN is required: %w",
+	"仅Linux支持fwmark":                        "fwmark is only supported on Linux",
+	"无效的优先级 %q，应为high、normal或low":           "invalid priority %q, expected high, normal or low",
+	"无法启用sockmap加速，相关规则使用普通转发: %v":          "cannot enable sockmap acceleration, affected rules use regular forwarding: %v",
+	"[%s] 规则使用了%s，不使用sockmap加速":             "[%s] rule uses %s, sockmap acceleration disabled",
+	"[%s] sockmap对接失败，使用普通转发: %v":           "[%s] sockmap splice failed, using regular forwarding: %v",
+	"无法创建sockhash: %w":                      "cannot create sockhash: %w",
+	"无法加载判决程序: %w":                          "cannot load verdict program: %w",
+	"无法挂载判决程序: %w":                          "cannot attach verdict program: %w",
+	"无法加入sockmap: %w":                       "cannot add to sockmap: %w",
+	"sockmap加速不可用":                          "sockmap acceleration unavailable",
+	"仅Linux支持sockmap加速":                     "sockmap acceleration is only supported on Linux",
+	"数据替换":                                  "stream rewrite",
+	"禁止模式":                                  "block patterns",
+	"录制":                                    "recording",
+	"故障注入":                                  "fault injection",
+	"全局带宽限制":                                "global bandwidth limit",
+	"未定义的标签 %q":                             "undefined label %q",
+	"没有配置挂载XDP程序的网卡":                        "no interfaces configured for the XDP program",
+	"无法创建XDP会话表: %w":                        "cannot create XDP session table: %w",
+	"无法加载XDP程序: %w":                         "cannot load XDP program: %w",
+	"无法把XDP程序挂到网卡%s: %w":                    "cannot attach XDP program to interface %s: %w",
+	"XDP转发不可用":                              "XDP forwarding unavailable",
+	"无法写入XDP会话表: %w":                        "cannot write XDP session table: %w",
+	"XDP转发只支持IPv4地址: %s -> %s":              "XDP forwarding only supports IPv4 addresses: %s -> %s",
+	"仅Linux支持XDP转发":                         "XDP forwarding is only supported on Linux",
+	"无法启用XDP转发，相关规则使用普通转发: %v":              "cannot enable XDP forwarding, affected rules use regular forwarding: %v",
+	"[%s] 规则使用了%s，不使用XDP转发":                 "[%s] rule uses %s, XDP forwarding disabled",
+	"[%s] UDP会话未使用XDP转发: %v":                "[%s] UDP session not using XDP forwarding: %v",
+	"[%s] UDP会话使用XDP转发":                     "[%s] UDP session using XDP forwarding",
+	"数据包混淆":                                 "packet obfuscation",
+	"扇出":                                    "fan-out",
+	"dns会话模式":                               "dns session mode",
+	"组播":                                    "multicast",
+	"DSCP标记":                                "DSCP marking",
+	"unixgram监听":                            "unixgram listening",
+	"仅Linux支持数据包级转发":                        "packet-level forwarding is only supported on Linux",
+	"无法把tc程序挂到网卡%s: %w":                     "cannot attach tc program to interface %s: %w",
+	"无法在网卡%s上打开数据包套接字: %w":                  "cannot open packet socket on interface %s: %w",
+	"[%s] 数据包级转发已启动: %s -> %s, 网卡%v":        "[%s] packet-level forwarding started: %s -> %s, interfaces %v",
+	"[%s] 数据包套接字读取错误: %v":                   "[%s] packet socket read error: %v",
+	"无法创建BPF表: %w":                          "cannot create BPF map: %w",
+	"无法写入BPF表: %w":                          "cannot write BPF map: %w",
+	"无法加载tc程序: %w":                          "cannot load tc program: %w",
+	"数据包级转发需要root权限或CAP_NET_RAW、CAP_NET_ADMIN和CAP_BPF":  "packet-level forwarding requires root or CAP_NET_RAW, CAP_NET_ADMIN and CAP_BPF",
+	"数据包级转发只支持IPv4目标: %s":                               "packet-level forwarding only supports IPv4 targets: %s",
+	"数据包级转发只支持IPv4监听地址: %s":                             "packet-level forwarding only supports IPv4 listen addresses: %s",
+	"配置[%s]错误: packet_mode需要配置packet_interfaces":        "rule [%s] error: packet_mode requires packet_interfaces",
+	"配置[%s]错误: 监听端口数量(%d)与目标端口数量(%d)不匹配":                "rule [%s] error: number of listen ports (%d) does not match number of target ports (%d)",
+	"配置[%s]错误: packet_mode只支持tcp和udp协议":                 "rule [%s] error: packet_mode only supports tcp and udp",
+	"数据包级转发[%s]错误: %v":                                  "packet-level forwarding [%s] error: %v",
+	"[%s] 目标组和串口目标不使用连接池":                               "[%s] target groups and serial targets do not use the connection pool",
+	"[%s] 预建立目标连接失败: %v":                                "[%s] failed to pre-establish target connection: %v",
+	"[%s] 使用连接池中的TCP目标连接 %s":                            "[%s] using pooled TCP target connection %s",
+	"连接数不能为负数":                                          "connection count cannot be negative",
+	"[%s] 规则使用了%s，不复用目标连接":                              "[%s] rule uses %s, target connections are not reused",
+	"[%s] TCP目标连接已放回连接池":                                "[%s] TCP target connection returned to pool",
+	"PROXY协议":                                           "PROXY protocol",
+	"sockmap加速":                                         "sockmap acceleration",
+	"解析缓存:":                                             "DNS cache:",
+	"主机名":                                               "Host",
+	"地址":                                                "Addresses",
+	"剩余时间":                                              "Remaining",
+	"命中":                                                "Hits",
+	"缓存时间不能为负数":                                         "cache time cannot be negative",
+	"max_ttl不能小于min_ttl":                                "max_ttl cannot be less than min_ttl",
+	"已启用DNS缓存: min_ttl=%s, max_ttl=%s, negative_ttl=%s": "DNS cache enabled: min_ttl=%s, max_ttl=%s, negative_ttl=%s",
+	"无效的DNS服务器地址: %w":                                   "invalid DNS server address: %w",
+	"DNS服务器地址缺少主机名: %q":                                 "DNS server address is missing a host: %q",
+	"不支持的DNS服务器协议: %q":                                  "unsupported DNS server protocol: %q",
+	"没有配置DNS服务器":                                        "no DNS servers configured",
+	"DNS服务器返回 %s":                                       "DNS server returned %s",
+	"无效的DNS响应: %w":                                      "invalid DNS response: %w",
+	"无效的DNS响应":                                          "invalid DNS response",
+	"DNS响应与查询不匹配":                                       "DNS response does not match the query",
+	"DNS服务器配置错误: %v":                                    "DNS server configuration error: %v",
+	"目标主机名将通过DNS服务器解析: %s":                              "target hostnames will be resolved via DNS servers: %s",
+	"接收连接失败: %w":                                        "failed to receive connections: %w",
+	"无效的交接消息":                                           "invalid handoff message",
+	"连接交接仅支持Linux":                                      "connection handoff is only supported on Linux",
+	"[%s] 规则使用了%s，升级时连接不交给新进程":                          "[%s] rule uses %s, connections will not be handed off on upgrade",
+	"[%s] TCP连接已交给新进程: %s, 已转发上行%d字节, 下行%d字节":              "[%s] TCP connection handed off to new process: %s, forwarded %d bytes up, %d bytes down",
+	"[%s] 已接管旧进程的TCP连接: %s -> %s -> %s, 已转发上行%d字节, 下行%d字节": "[%s] adopted TCP connection from old process: %s -> %s -> %s, forwarded %d bytes up, %d bytes down",
+	"接管旧进程的连接失败: %v":                                       "failed to adopt connections from old process: %v",
+	"已从旧进程接管%d个TCP连接":                                      "adopted %d TCP connections from old process",
+	"无法启用连接交接: %v":                                         "cannot enable connection handoff: %v",
+	"接管的连接没有对应的TCP代理[%s]，关闭%d个连接":                          "no TCP proxy [%s] for adopted connections, closing %d connections",
+	"交接连接失败: %v":                                           "connection handoff failed: %v",
+	"新进程已启动，已交出%d个TCP连接":                                   "new process started, handed off %d TCP connections",
+	"订阅事件失败: %s":                                           "failed to subscribe to events: %s",
+	"订阅事件失败: %v":                                           "failed to subscribe to events: %v",
+	"无法解析事件: %w":                                           "cannot parse event: %w",
+	"读取事件失败: %w":                                           "failed to read events: %w",
+	"%s %s连接建立: %s -> %s -> %s":                            "%s %s connection opened: %s -> %s -> %s",
+	"%s %s连接关闭: %s -> %s, 上行%d字节, 下行%d字节, 持续%s":            "%s %s connection closed: %s -> %s, up %d bytes, down %d bytes, lasted %s",
+	"%s %s连接错误: %s -> %s: %s":                              "%s %s connection error: %s -> %s: %s",
+	"%s 处理不及，丢弃了%d个事件":                                     "%s falling behind, dropped %d events",
+	"跨域的WebSocket请求":                                       "cross-origin WebSocket request",
+	"不支持流式响应":                                              "streaming responses are not supported",
+	"配置[%s]带宽上限: %s/s":                                     "config [%s] bandwidth limit: %s/s",
+	"规则带宽限制":                                               "rule bandwidth limit",
+	"权重不能为负数":                                              "weight cannot be negative",
+	"[%s] TCP连接被拒绝: %s 内存用量超过预算":                           "[%s] TCP connection rejected: %s memory usage exceeds budget",
+	"[%s] TCP连接被拒绝: %s 全局连接数已达上限":                          "[%s] TCP connection rejected: %s global connection limit reached",
+	"内存用量%dMB接近预算%dMB，暂停接受低优先级规则的新TCP连接和UDP会话": "memory usage %dMB is close to budget %dMB, pausing new TCP connections and UDP sessions for low-priority rules",
+	"内存用量已降至%dMB，恢复接受低优先级规则的新TCP连接和UDP会话":      "memory usage dropped to %dMB, resuming new TCP connections and UDP sessions for low-priority rules",
+	"无效的过载处理方式 %q，应为queue或drop":                "invalid overload action %q, must be queue or drop",
+	"单连接传输上限":                      "per-connection transfer cap",
+	"达到单连接传输上限":                    "per-connection transfer cap reached",
+	"[%s] TCP连接达到传输上限%d字节，已关闭: %s": "[%s] TCP connection reached transfer cap of %d bytes, closed: %s",
+	"[%s] UDP会话达到传输上限%d字节，已关闭: %s": "[%s] UDP session reached transfer cap of %d bytes, closed: %s",
+	"[%s] TCP连接达到最长持续时间%s，已关闭: %s": "[%s] TCP connection reached maximum lifetime %s, closed: %s",
+	"[%s] UDP会话达到最长持续时间%s，已关闭: %s": "[%s] UDP session reached maximum lifetime %s, closed: %s",
+	"[%s] TCP连接空闲超过%s，已关闭: %s":     "[%s] TCP connection idle for more than %s, closed: %s",
+	"TCP空闲超时":  "TCP idle timeout",
+	"空闲回收":     "idle reaped",
+	"最早的活动连接:": "Oldest active connections:",
+	"连接":       "connection",
+	"客户端":      "client",
+	"持续时间":     "age",
+	"空闲":       "idle",
+	"[%s] 监听地址%s被占用，改用备用端口: %s": "[%s] listen address %s is in use, using fallback port: %s",
+	"改用备用端口的监听器:":               "Listeners on fallback ports:",
+	"配置的地址":                     "configured",
+	"实际地址":                      "actual",
+	"配置[%s]备用端口解析错误: %v":        "rule [%s] fallback port parse error: %v",
+	"规则已存在":                     "rule already exists",
+	"规则不存在":                     "rule does not exist",
+	"只能删除通过API创建的规则，配置文件中的规则须修改配置后重新加载": "only rules created through the API can be deleted, change the config file and reload to remove other rules",
+	"已通过API创建规则[%s]": "rule [%s] created through the API",
+	"已通过API删除规则[%s]": "rule [%s] deleted through the API",
+	"令牌无效":           "invalid token",
+	"监听器未能在等待时间内就绪":  "listener did not become ready in time",
+	"规则没有监听器":        "rule has no listeners",
+	"配置了api_tokens但没有配置metrics_listen，规则API不可用": "api_tokens is set but metrics_listen is not, the rule API is unavailable",
+	"令牌不能为空":                                         "token must not be empty",
+	"规则需要名称":                                         "rule needs a name",
+	"[%s] 无法读取HTTP请求头: %s: %v":                       "[%s] failed to read HTTP request header: %s: %v",
+	"[%s] 按Host %s 选择目标 %s":                          "[%s] routed by Host %s to target %s",
+	"HTTP主机路由":                                       "HTTP host routing",
+	"请求头超过%d字节":                                      "request header exceeds %d bytes",
+	"主机%s的目标地址无效: %w":                                "invalid target address for host %s: %w",
+	"无效的通配符主机名: %s":                                  "invalid wildcard host name: %s",
+	"主机名不能为空":                                        "host name must not be empty",
+	"配置[%s]主机路由错误: %v":                               "rule [%s] host routing error: %v",
+	"[%s] QUIC连接迁移: %s -> %s":                        "[%s] QUIC connection migrated: %s -> %s",
+	"QUIC会话亲和":                                       "QUIC session affinity",
+	"域名%s的上游地址无效: %w":                                "invalid upstream address for domain %s: %w",
+	"不是DNS查询":                                        "not a DNS query",
+	"[%s] DNS转发已启动: %s -> %s":                        "[%s] DNS forwarding started: %s -> %s",
+	"[%s] 流量配额已用尽，本周期内丢弃所有查询":                        "[%s] traffic quota exhausted, dropping all queries for the rest of this period",
+	"[%s] 发送应答到 %s 失败: %v":                           "[%s] failed to send response to %s: %v",
+	"[%s] 接受TCP连接失败: %v":                             "[%s] failed to accept TCP connection: %v",
+	"[%s] 丢弃无法解析的DNS查询(%s): %s: %v":                  "[%s] dropped unparseable DNS query (%s): %s: %v",
+	"[%s] DNS查询失败(%s): %s %s %s -> %s: %v":           "[%s] DNS query failed (%s): %s %s %s -> %s: %v",
+	"[%s] DNS查询(%s): %s %s %s -> %s %s, 耗时%s, 应答被截断": "[%s] DNS query (%s): %s %s %s -> %s %s, took %s, response truncated",
+	"[%s] DNS查询(%s): %s %s %s -> %s %s, 耗时%s":        "[%s] DNS query (%s): %s %s %s -> %s %s, took %s",
+	"配置[%s]错误: DNS转发只支持IP地址和端口，不支持unix套接字、命名管道、串口和目标组": "rule [%s] error: DNS forwarding only supports IP addresses and ports, not unix sockets, named pipes, serial ports or target groups",
+	"配置[%s]DNS路由错误: %v":                "rule [%s] DNS routes error: %v",
+	"DNS转发[%s]错误: %v":                  "DNS forwarding [%s] error: %v",
+	"已启动DNS端口组[%s]: %s -> %s, 共%d个端口对": "DNS port group [%s] started: %s -> %s, %d port pairs",
+	"监听方式%s需要TLS证书":                    "listen mode %s requires a TLS certificate",
+	"[%s] DNS转发已启动(%s): %s -> %s":      "[%s] DNS forwarding started (%s): %s -> %s",
+	"配置[%s]错误: 无效的dns_listen '%s'":     "rule [%s] error: invalid dns_listen '%s'",
+	"配置[%s]错误: dns_listen为%s时需要配置tls":  "rule [%s] error: dns_listen %s requires tls to be configured",
+	"媒体端口已全部占用":                        "all media ports are in use",
+	"通话已结束":                            "call has ended",
+	"监听地址为通配地址时需要指定在SDP中公布的地址":         "an address to advertise in SDP is required when listening on a wildcard address",
+	"媒体端口范围中没有连续的4个可用端口":               "media port range has no 4 consecutive usable ports",
+	"[%s] SIP转发已启动: %s -> %s":          "[%s] SIP forwarding started: %s -> %s",
+	"[%s] 无法连接目标 %s: %v":               "[%s] failed to connect to target %s: %v",
+	"[%s] 发送到目标失败: %v":                 "[%s] failed to send to target: %v",
+	"[%s] SIP会话创建: %s -> %s":           "[%s] SIP session created: %s -> %s",
+	"[%s] SIP会话关闭: %s, 持续%s":           "[%s] SIP session closed: %s, lasted %s",
+	"[%s] 发送到客户端失败: %v":                "[%s] failed to send to client: %v",
+	"[%s] 无法为通话%s分配媒体中转端口，原样转发SDP: %v": "[%s] failed to allocate media relay ports for call %s, forwarding SDP unchanged: %v",
+	"[%s] 通话%s的媒体流%d使用中转端口%d-%d":       "[%s] call %s media stream %d uses relay ports %d-%d",
+	"[%s] 通话%s结束，已关闭%d个媒体转发":           "[%s] call %s ended, closed %d media relays",
+	"[%s] 通话%s的媒体流空闲超过%s，已关闭%d个媒体转发":   "[%s] call %s media idle for over %s, closed %d media relays",
+	"配置[%s]错误: SIP转发只支持IP地址和端口，不支持unix套接字、命名管道、串口和目标组": "rule [%s] error: SIP forwarding only supports IP addresses and ports, not unix sockets, named pipes, serial ports or target groups",
+	"配置[%s]错误: 无效的sip_advertise_ip '%s'":               "rule [%s] error: invalid sip_advertise_ip '%s'",
+	"配置[%s]媒体端口解析错误: %v":                               "rule [%s] media ports parse error: %v",
+	"SIP转发[%s]错误: %v":                                  "SIP forwarding [%s] error: %v",
+	"已启动SIP端口组[%s]: %s -> %s, 共%d个端口对":                 "SIP port group [%s] started: %s -> %s, %d port pairs",
+	"不支持的协议 %q，应为tcp、udp、ip、dns或sip":                   "unsupported protocol %q, must be tcp, udp, ip, dns or sip",
+	"[%s] 无法打开FTP数据端口: %v":                             "[%s] failed to open FTP data port: %v",
+	"目标不是TCP地址":                                        "target is not a TCP address",
+	"[%s] FTP数据端口%d -> %s":                             "[%s] FTP data port %d -> %s",
+	"被动模式端口已全部占用: %w":                                  "all passive mode ports are in use: %w",
+	"[%s] 拒绝来自 %s 的FTP数据连接，与控制连接的客户端不同":                "[%s] rejected FTP data connection from %s, which differs from the control connection's client",
+	"[%s] 无法连接FTP数据端口 %s: %v":                          "[%s] failed to connect to FTP data port %s: %v",
+	"FTP被动模式": "FTP passive mode",
+	"配置[%s]错误: 无效的ftp_advertise_ip '%s'":    "rule [%s] error: invalid ftp_advertise_ip '%s'",
+	"配置[%s]被动模式端口解析错误: %v":                  "rule [%s] passive ports parse error: %v",
+	"无效的IPv4地址: %q":                         "invalid IPv4 address: %q",
+	"[%s] TFTP服务器改用端口%d回复，后续数据包发往该端口":       "[%s] TFTP server replied from port %d, sending subsequent packets there",
+	"控制连接的媒体流过多":                            "too many media streams on the control connection",
+	"[%s] 已关闭%d个RTSP媒体转发":                   "[%s] closed %d RTSP media relays",
+	"[%s] 无法为RTSP媒体流分配中转端口，原样转发SETUP请求: %v": "[%s] cannot allocate relay ports for RTSP media stream, forwarding SETUP request unchanged: %v",
+	"[%s] RTSP媒体流使用中转端口%d-%d，客户端端口%s":       "[%s] RTSP media stream uses relay ports %d-%d, client ports %s",
+	"RTSP媒体转发":                                       "RTSP media relay",
+	"无效的MAC地址: %q":                                   "invalid MAC address: %q",
+	"[%s] 无法发送网络唤醒数据包到 %s: %v":                       "[%s] cannot send Wake-on-LAN packet to %s: %v",
+	"[%s] 目标 %s 无响应，已向 %s 发送网络唤醒数据包":                 "[%s] target %s not responding, sent Wake-on-LAN packet to %s",
+	"[%s] 目标 %s 已唤醒，等待%s":                            "[%s] target %s is awake after %s",
+	"网络唤醒后%s内仍无法连接: %w":                              "still unreachable %s after Wake-on-LAN: %w",
+	"网络唤醒不能与目标组同时使用":                                 "Wake-on-LAN cannot be used with a target group",
+	"配置[%s]错误: 网络唤醒不能与目标组同时使用":                       "rule [%s] error: Wake-on-LAN cannot be used with a target group",
+	"[%s] 等待目标唤醒时客户端断开或转发已停止: %s":                    "[%s] client disconnected or forwarding stopped while waiting for the target to wake: %s",
+	"等待目标唤醒时客户端断开或转发已停止":                             "client disconnected or forwarding stopped while waiting for the target to wake",
+	"无效的role %q，应为client或server":                     "invalid role %q, expected client or server",
+	"ICMP隧道只能转发UDP，不支持 %q":                           "the ICMP tunnel only forwards UDP, %q is not supported",
+	"ICMP隧道服务[%s]配置错误: 只能转发UDP，不支持 %q":               "ICMP tunnel service [%s] configuration error: only UDP can be forwarded, %q is not supported",
+	"obfs: 生成随机盐失败: %w":                              "obfs: failed to generate random salt: %w",
+	"obfs: 生成随机nonce失败: %w":                          "obfs: failed to generate random nonce: %w",
+	"[%s] UDP数据包混淆错误: %v":                            "[%s] UDP packet obfuscation error: %v",
+	"[%s] 只有Linux支持按SO_REUSEPORT分流，%d个读取循环将共享同一套接字":  "[%s] only Linux distributes packets across SO_REUSEPORT sockets, %d read loops will share one socket",
+	"无效的Lua脚本超时时间(timeout): %v":                      "invalid Lua script timeout (timeout): %v",
+	"Lua函数%s执行超过%s":                                  "Lua function %s ran longer than %s",
+	"规则[%s] 同时执行的事件命令已达上限%d个，丢弃%s事件，累计丢弃%d个":         "rule [%s] reached the limit of %d concurrent event commands, dropped %s event, %d dropped in total",
+	"SSH跳板机 %s 配置了insecure_ignore_host_key，将不校验主机密钥": "SSH jump host %s has insecure_ignore_host_key set, host key will not be verified",
+	"未配置known_hosts且无法确定用户主目录: %w":                   "no known_hosts configured and the user home directory cannot be determined: %w",
+	"shadowsocks: 盐重复，拒绝可能被重放的连接":                    "shadowsocks: duplicate salt, rejecting a possibly replayed connection",
+	"通过API创建的规则不能配置此项":                               "not allowed in rules created through the API",
+	"无效的WASM调用超时时间(timeout): %v":                     "invalid WASM call timeout (timeout): %v",
+	"执行超过%s": "ran longer than %s",
+	"反向转发服务端未配置allow_ports，将拒绝代理端注册的所有服务": "reverse server has no allow_ports configured, all services registered by agents will be rejected",
+	"反向转发服务端拒绝不属于代理端 %s 的工作连接: %s(%s)":    "reverse server rejected a work connection not belonging to agent %s: %s(%s)",
+	"录制文件末尾不完整，已忽略: 数据块长度%d超过文件大小":        "incomplete recording file tail, ignored: chunk length %d exceeds the file size",
+	"[%s] FTP数据连接被断开: %s 数据命中禁止模式":        "[%s] FTP data connection dropped: %s data matched a block pattern",
+}
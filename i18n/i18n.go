@@ -0,0 +1,203 @@
+// Package i18n 将中文日志翻译为其他语言输出
+//
+// 各模块仍以中文格式字符串记录日志，Writer在输出时按消息目录匹配格式字符串并替换为译文，
+// 参数中嵌套的错误信息同样逐层翻译。目录中没有的消息原样输出。
+package i18n
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 通过环境变量指定日志语言，便于在加载配置之前生效
+const envLanguage = "NF_LOG_LANGUAGE"
+
+var (
+	// 当前语言的消息目录，nil表示不翻译
+	current atomic.Pointer[catalog]
+
+	compileOnce sync.Once
+	english     *catalog
+)
+
+// 格式字符串中的动词，例如 %s、%v、%d、%5.2f
+var verbPattern = regexp.MustCompile(`%[-+# 0-9.]*[a-zA-Z%]`)
+
+// log包默认的日期时间前缀
+var timePrefix = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? `)
+
+func init() {
+	if lang := os.Getenv(envLanguage); lang != "" {
+		SetLanguage(lang)
+	}
+}
+
+// SetLanguage 设置日志语言，""和"zh"为中文(不翻译)，"en"为英文
+func SetLanguage(lang string) error {
+	switch strings.ToLower(lang) {
+	case "", "zh", "zh-cn":
+		current.Store(nil)
+	case "en", "en-us":
+		compileOnce.Do(func() { english = compile(catalogEN) })
+		current.Store(english)
+	default:
+		return fmt.Errorf("无效的日志语言: %q", lang)
+	}
+	return nil
+}
+
+// Translate 按当前语言翻译一条已格式化的消息，多行消息逐行翻译并保留缩进
+func Translate(msg string) string {
+	c := current.Load()
+	if c == nil {
+		return msg
+	}
+
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		text := strings.TrimLeft(line, " \t")
+		lines[i] = line[:len(line)-len(text)] + c.translate(text, 0)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Printf 以当前语言向标准输出打印消息
+func Printf(format string, args ...interface{}) {
+	fmt.Print(Translate(fmt.Sprintf(format, args...)))
+}
+
+// Println 以当前语言向标准输出打印一行消息
+func Println(msg string) {
+	fmt.Println(Translate(msg))
+}
+
+// Writer 返回翻译后写入w的io.Writer，用于log.SetOutput
+func Writer(w io.Writer) io.Writer {
+	return &writer{w: w}
+}
+
+type writer struct {
+	w io.Writer
+}
+
+// Write log包每条日志调用一次Write
+func (w *writer) Write(p []byte) (int, error) {
+	if current.Load() == nil {
+		return w.w.Write(p)
+	}
+
+	line := string(p)
+	prefix := timePrefix.FindString(line)
+	if _, err := io.WriteString(w.w, prefix+Translate(line[len(prefix):])); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 嵌套错误的最大翻译深度
+const maxDepth = 8
+
+type entry struct {
+	pattern  *regexp.Regexp
+	anchor   string   // 格式字符串中最长的字面部分，用于快速排除
+	literals int      // 字面部分总长度，越长的格式越具体，优先匹配
+	parts    []string // 译文按动词切分后的字面部分
+}
+
+type catalog struct {
+	entries []*entry
+}
+
+func compile(messages map[string]string) *catalog {
+	c := &catalog{}
+	for format, translated := range messages {
+		format = strings.TrimSuffix(format, "\n")
+		translated = strings.TrimSuffix(translated, "\n")
+
+		chunks := verbPattern.Split(format, -1)
+		verbs := verbPattern.FindAllString(format, -1)
+
+		var expr strings.Builder
+		e := &entry{}
+		expr.WriteString(`(?s)^`)
+		for i, chunk := range chunks {
+			expr.WriteString(regexp.QuoteMeta(chunk))
+			e.literals += len(chunk)
+			if len(chunk) > len(e.anchor) {
+				e.anchor = chunk
+			}
+			if i < len(verbs) {
+				if verbs[i] == "%%" {
+					expr.WriteString("%")
+					e.literals++
+				} else {
+					expr.WriteString("(.*?)")
+				}
+			}
+		}
+		expr.WriteString(`$`)
+		e.pattern = regexp.MustCompile(expr.String())
+
+		e.parts = splitVerbs(translated)
+		c.entries = append(c.entries, e)
+	}
+
+	sort.SliceStable(c.entries, func(i, j int) bool {
+		if c.entries[i].literals != c.entries[j].literals {
+			return c.entries[i].literals > c.entries[j].literals
+		}
+		return c.entries[i].pattern.String() < c.entries[j].pattern.String()
+	})
+	return c
+}
+
+// splitVerbs 按参数动词切分译文，%%作为字面的%保留在切分结果中
+func splitVerbs(s string) []string {
+	parts := []string{""}
+	for {
+		loc := verbPattern.FindStringIndex(s)
+		if loc == nil {
+			parts[len(parts)-1] += s
+			return parts
+		}
+		parts[len(parts)-1] += s[:loc[0]]
+		if s[loc[0]:loc[1]] == "%%" {
+			parts[len(parts)-1] += "%"
+		} else {
+			parts = append(parts, "")
+		}
+		s = s[loc[1]:]
+	}
+}
+
+func (c *catalog) translate(msg string, depth int) string {
+	if depth >= maxDepth {
+		return msg
+	}
+
+	for _, e := range c.entries {
+		if !strings.Contains(msg, e.anchor) {
+			continue
+		}
+		m := e.pattern.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+
+		var b strings.Builder
+		for i, part := range e.parts {
+			b.WriteString(part)
+			if i+1 < len(m) && i+1 < len(e.parts) {
+				b.WriteString(c.translate(m[i+1], depth+1))
+			}
+		}
+		return b.String()
+	}
+	return msg
+}
@@ -0,0 +1,236 @@
+package icmptunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// 轮询间隔与重发打开帧的间隔，打开帧同时用作保活
+const (
+	pollInterval = 20 * time.Millisecond
+	openInterval = 5 * time.Second
+)
+
+// Service 客户端本地监听的UDP地址及其在服务端一侧的目标
+type Service struct {
+	Name   string
+	Listen string
+	Target string
+}
+
+// Client 把本地UDP数据包经ICMP回显请求发送到服务端
+type Client struct {
+	codec    codec
+	peer     *net.IPAddr
+	services []Service
+
+	conn    *icmp.PacketConn
+	id      int
+	counter counter
+
+	mu        sync.Mutex
+	seq       int
+	sessions  map[string]*clientSession
+	bySession map[uint32]*clientSession
+}
+
+type clientSession struct {
+	id         uint32
+	target     string
+	listener   *net.UDPConn
+	addr       *net.UDPAddr
+	lastActive time.Time
+	lastOpen   time.Time
+	lastReply  uint64 // 已收到的应答的最大计数器
+}
+
+// NewClient 创建ICMP隧道客户端
+func NewClient(peer, key string, services []Service) (*Client, error) {
+	ip, err := net.ResolveIPAddr("ip4", peer)
+	if err != nil {
+		return nil, fmt.Errorf("无效的ICMP隧道对端地址 %q: %w", peer, err)
+	}
+	return &Client{
+		codec:     codec{key: []byte(key)},
+		peer:      ip,
+		services:  services,
+		id:        rand.IntN(0xffff) + 1,
+		sessions:  make(map[string]*clientSession),
+		bySession: make(map[uint32]*clientSession),
+	}, nil
+}
+
+// Run 处理隧道数据直到上下文取消，没有权限时返回ErrPermission
+func (c *Client) Run(ctx context.Context) error {
+	var listeners []*net.UDPConn
+	for _, svc := range c.services {
+		addr, err := net.ResolveUDPAddr("udp", svc.Listen)
+		if err == nil {
+			var l *net.UDPConn
+			if l, err = net.ListenUDP("udp", addr); err == nil {
+				listeners = append(listeners, l)
+				continue
+			}
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+		return fmt.Errorf("ICMP隧道服务[%s]无法监听 %s: %w", svc.Name, svc.Listen, err)
+	}
+
+	conn, err := listenICMP()
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return err
+	}
+	c.conn = conn
+	context.AfterFunc(ctx, func() {
+		conn.Close()
+		for _, l := range listeners {
+			l.Close()
+		}
+	})
+
+	for i, l := range listeners {
+		go c.readLocal(l, c.services[i])
+		log.Printf("ICMP隧道服务[%s]已启动: %s -> %s -> %s", c.services[i].Name, c.services[i].Listen, c.peer, c.services[i].Target)
+	}
+	go c.poll(ctx)
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("ICMP隧道读取错误: %v", err)
+			continue
+		}
+		if addr.String() != c.peer.String() {
+			continue
+		}
+		msg, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || echo.ID != c.id {
+			continue
+		}
+		f, ok := c.codec.decode(magicReply, echo.Data)
+		if !ok || f.typ != frameData {
+			continue
+		}
+
+		c.mu.Lock()
+		sess := c.bySession[f.session]
+		if sess != nil && f.counter <= sess.lastReply {
+			// 重放或乱序到达的旧应答
+			sess = nil
+		}
+		if sess != nil {
+			sess.lastActive = time.Now()
+			sess.lastReply = f.counter
+		}
+		c.mu.Unlock()
+		if sess != nil {
+			sess.listener.WriteToUDP(f.body, sess.addr)
+		}
+		// 服务端可能还有待返回的数据，立即再轮询一次
+		c.send(frame{typ: framePoll})
+	}
+}
+
+// 读取本地客户端的数据包，新客户端创建会话
+func (c *Client) readLocal(l *net.UDPConn, svc Service) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := l.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		key := l.LocalAddr().String() + "|" + addr.String()
+		c.mu.Lock()
+		sess := c.sessions[key]
+		if sess == nil {
+			sess = &clientSession{id: rand.Uint32(), target: svc.Target, listener: l, addr: addr}
+			c.sessions[key] = sess
+			c.bySession[sess.id] = sess
+			log.Printf("ICMP隧道服务[%s]会话创建: %s -> %s", svc.Name, addr, svc.Target)
+		}
+		sess.lastActive = time.Now()
+		open := time.Since(sess.lastOpen) > openInterval
+		if open {
+			sess.lastOpen = time.Now()
+		}
+		c.mu.Unlock()
+
+		if open {
+			c.send(frame{typ: frameOpen, session: sess.id, body: []byte(sess.target)})
+		}
+		c.send(frame{typ: frameData, session: sess.id, body: buf[:n]})
+	}
+}
+
+// 有会话时定期轮询，并重发打开帧、关闭空闲会话
+func (c *Client) poll(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var frames []frame
+		c.mu.Lock()
+		for key, sess := range c.sessions {
+			switch {
+			case time.Since(sess.lastActive) > sessionTimeout:
+				delete(c.sessions, key)
+				delete(c.bySession, sess.id)
+				frames = append(frames, frame{typ: frameClose, session: sess.id})
+			case time.Since(sess.lastOpen) > openInterval:
+				sess.lastOpen = time.Now()
+				frames = append(frames, frame{typ: frameOpen, session: sess.id, body: []byte(sess.target)})
+			}
+		}
+		if len(c.sessions) > 0 {
+			frames = append(frames, frame{typ: framePoll})
+		}
+		c.mu.Unlock()
+
+		for _, f := range frames {
+			c.send(f)
+		}
+	}
+}
+
+func (c *Client) send(f frame) {
+	f.counter = c.counter.next()
+	c.mu.Lock()
+	c.seq = (c.seq + 1) & 0xffff
+	seq := c.seq
+	c.mu.Unlock()
+
+	b, err := echoMessage(ipv4.ICMPTypeEcho, c.id, seq, c.codec.encode(magicRequest, f))
+	if err == nil {
+		_, err = c.conn.WriteTo(b, c.peer)
+	}
+	if err != nil {
+		log.Printf("ICMP隧道发送请求错误: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+// Package icmptunnel 把UDP数据包封装在ICMP回显请求和回显应答中，在两个转发节点之间传输(实验性)。
+// 隧道不保证送达和顺序，只转发UDP，不承载TCP。
+//
+// 客户端把数据放在回显请求中发往服务端，服务端只能在回显应答中返回数据，
+// 因此客户端会定期发送空的轮询请求，服务端为每个客户端缓存待返回的数据包。
+// 使用原始ICMP套接字，需要root权限或CAP_NET_RAW。服务端系统自身也会应答回显请求，
+// 这些应答会被客户端忽略，可设置 net.ipv4.icmp_echo_ignore_all=1 避免额外流量。
+// 每个帧都带有发送方的计数器并经预共享密钥认证，两端的时钟误差须在5分钟内。
+package icmptunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// 帧格式: 标记(4字节) | 类型(1) | 会话ID(4) | 计数器(8) | 认证标签(8) | 数据
+// 请求和应答使用不同的标记，以便客户端忽略系统自动回复的回显应答；
+// 计数器由发送方单调递增并参与认证，接收方拒绝不比已收到的更新的帧，防止重放
+const (
+	magicRequest = "NFIT"
+	magicReply   = "NFIR"
+
+	headerSize = 4 + 1 + 4 + 8 + tagSize
+	tagSize    = 8
+)
+
+// 服务端接受新会话的第一个帧时，计数器与本机时间的最大差距，两端的时钟误差须在此范围内
+const replayWindow = 5 * time.Minute
+
+// 帧类型
+const (
+	frameOpen  byte = 1 // 打开会话，数据为目标地址
+	frameData  byte = 2
+	framePoll  byte = 3 // 空轮询，给服务端返回数据的机会
+	frameClose byte = 4
+)
+
+type frame struct {
+	typ     byte
+	session uint32
+	counter uint64
+	body    []byte
+}
+
+// 用预共享密钥为帧计算认证标签
+type codec struct {
+	key []byte
+}
+
+func (c codec) tag(magic string, f frame) []byte {
+	h := hmac.New(sha256.New, c.key)
+	h.Write([]byte(magic))
+	h.Write([]byte{f.typ})
+	h.Write(binary.BigEndian.AppendUint32(nil, f.session))
+	h.Write(binary.BigEndian.AppendUint64(nil, f.counter))
+	h.Write(f.body)
+	return h.Sum(nil)[:tagSize]
+}
+
+func (c codec) encode(magic string, f frame) []byte {
+	b := make([]byte, 0, headerSize+len(f.body))
+	b = append(b, magic...)
+	b = append(b, f.typ)
+	b = binary.BigEndian.AppendUint32(b, f.session)
+	b = binary.BigEndian.AppendUint64(b, f.counter)
+	b = append(b, c.tag(magic, f)...)
+	return append(b, f.body...)
+}
+
+func (c codec) decode(magic string, b []byte) (frame, bool) {
+	if len(b) < headerSize || string(b[:4]) != magic {
+		return frame{}, false
+	}
+	f := frame{
+		typ:     b[4],
+		session: binary.BigEndian.Uint32(b[5:9]),
+		counter: binary.BigEndian.Uint64(b[9:17]),
+		body:    b[headerSize:],
+	}
+	if !hmac.Equal(b[17:headerSize], c.tag(magic, f)) {
+		return frame{}, false
+	}
+	return f, true
+}
+
+// counter 发送帧的计数器，以纳秒时间为起点单调递增，重启后也不会回到之前的值
+type counter struct {
+	last atomic.Uint64
+}
+
+func (c *counter) next() uint64 {
+	for {
+		old := c.last.Load()
+		n := max(old+1, uint64(time.Now().UnixNano()))
+		if c.last.CompareAndSwap(old, n) {
+			return n
+		}
+	}
+}
+
+// replayFilter 记录每个会话收到的最大计数器，拒绝重放的帧
+type replayFilter struct {
+	mu   sync.Mutex
+	seen map[uint32]replayState
+}
+
+type replayState struct {
+	last uint64
+	at   time.Time
+}
+
+func newReplayFilter() *replayFilter {
+	return &replayFilter{seen: make(map[uint32]replayState)}
+}
+
+// accept 判断帧是否比该会话已收到的帧更新；没有记录的会话要求计数器在本机时间前后replayWindow内
+func (r *replayFilter) accept(session uint32, counter uint64) bool {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if st, ok := r.seen[session]; ok {
+		if counter <= st.last {
+			return false
+		}
+	} else {
+		ts := time.Unix(0, int64(counter))
+		if ts.Before(now.Add(-replayWindow)) || ts.After(now.Add(replayWindow)) {
+			return false
+		}
+	}
+	r.seen[session] = replayState{last: counter, at: now}
+	return true
+}
+
+// expire 清除超过replayWindow没有收到帧的会话，更早的帧已会因计数器过旧被拒绝
+func (r *replayFilter) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for session, st := range r.seen {
+		if time.Since(st.at) > replayWindow {
+			delete(r.seen, session)
+		}
+	}
+}
+
+// ErrPermission 没有打开原始ICMP套接字的权限
+var ErrPermission = errors.New("ICMP隧道需要root权限或CAP_NET_RAW")
+
+// 打开原始ICMP套接字
+func listenICMP() (*icmp.PacketConn, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if errors.Is(err, os.ErrPermission) {
+		return nil, ErrPermission
+	}
+	if err != nil {
+		return nil, fmt.Errorf("无法打开ICMP套接字: %w", err)
+	}
+	return conn, nil
+}
+
+// 构造回显请求或应答
+func echoMessage(typ icmp.Type, id, seq int, data []byte) ([]byte, error) {
+	m := icmp.Message{Type: typ, Body: &icmp.Echo{ID: id, Seq: seq, Data: data}}
+	return m.Marshal(nil)
+}
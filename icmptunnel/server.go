@@ -0,0 +1,250 @@
+package icmptunnel
+
+import (
+	"context"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// 会话空闲超时，以及每个客户端待返回数据包的队列长度
+const (
+	sessionTimeout = 2 * time.Minute
+	replyQueueSize = 256
+)
+
+// Server 接收封装在回显请求中的数据包并转发到目标，目标的回复在回显应答中返回
+type Server struct {
+	codec        codec
+	allowTargets []string
+
+	conn    *icmp.PacketConn
+	counter counter
+	replay  *replayFilter
+
+	mu      sync.Mutex
+	peers   map[peerKey]*peer
+	targets map[sessionKey]*serverSession
+}
+
+// 客户端由IP和ICMP标识符区分
+type peerKey struct {
+	ip string
+	id int
+}
+
+type sessionKey struct {
+	peer    peerKey
+	session uint32
+}
+
+// peer 一个客户端待返回的数据包
+type peer struct {
+	queue [][]byte
+}
+
+type serverSession struct {
+	conn       *net.UDPConn
+	lastActive time.Time
+}
+
+// NewServer 创建ICMP隧道服务端，只允许转发到allowTargets中的地址
+func NewServer(key string, allowTargets []string) *Server {
+	return &Server{
+		codec:        codec{key: []byte(key)},
+		allowTargets: allowTargets,
+		replay:       newReplayFilter(),
+		peers:        make(map[peerKey]*peer),
+		targets:      make(map[sessionKey]*serverSession),
+	}
+}
+
+// Run 处理隧道数据直到上下文取消，没有权限时返回ErrPermission
+func (s *Server) Run(ctx context.Context) error {
+	conn, err := listenICMP()
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	context.AfterFunc(ctx, func() { conn.Close() })
+	go s.expire(ctx)
+	log.Printf("ICMP隧道服务端已启动，允许的目标: %v", s.allowTargets)
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				s.closeAll()
+				return nil
+			}
+			log.Printf("ICMP隧道读取错误: %v", err)
+			continue
+		}
+		msg, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEcho {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok {
+			continue
+		}
+		f, ok := s.codec.decode(magicRequest, echo.Data)
+		if !ok {
+			continue
+		}
+		// 轮询帧不带会话也不携带数据，重放只会取走该客户端的应答，不检查计数器
+		if f.typ != framePoll && !s.replay.accept(f.session, f.counter) {
+			continue
+		}
+		s.handle(ctx, addr, echo, f)
+	}
+}
+
+func (s *Server) handle(ctx context.Context, addr net.Addr, echo *icmp.Echo, f frame) {
+	pk := peerKey{ip: addr.String(), id: echo.ID}
+	sk := sessionKey{peer: pk, session: f.session}
+
+	s.mu.Lock()
+	if _, ok := s.peers[pk]; !ok {
+		s.peers[pk] = &peer{}
+	}
+	sess := s.targets[sk]
+	if sess != nil {
+		sess.lastActive = time.Now()
+	}
+	s.mu.Unlock()
+
+	switch f.typ {
+	case frameOpen:
+		if sess == nil {
+			s.open(ctx, addr, sk, string(f.body))
+		}
+	case frameData:
+		if sess != nil {
+			sess.conn.Write(f.body)
+		}
+	case frameClose:
+		if sess != nil {
+			s.closeSession(sk)
+		}
+	}
+
+	// 每个请求最多携带一个待返回的数据包
+	s.reply(addr, echo, pk)
+}
+
+// 为会话连接目标，目标不在允许列表中时忽略
+func (s *Server) open(ctx context.Context, addr net.Addr, sk sessionKey, target string) {
+	if !slices.Contains(s.allowTargets, target) {
+		log.Printf("ICMP隧道拒绝会话: %s 请求的目标 %s 不在允许列表中", addr, target)
+		return
+	}
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		log.Printf("ICMP隧道无法连接目标 %s: %v", target, err)
+		return
+	}
+
+	s.mu.Lock()
+	s.targets[sk] = &serverSession{conn: conn.(*net.UDPConn), lastActive: time.Now()}
+	s.mu.Unlock()
+	log.Printf("ICMP隧道会话创建: %s#%d -> %s", addr, sk.session, target)
+
+	go s.readTarget(ctx, sk, conn.(*net.UDPConn))
+}
+
+// 把目标的回复放入客户端的队列，队列满时丢弃最旧的数据包
+func (s *Server) readTarget(ctx context.Context, sk sessionKey, conn *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		b := s.codec.encode(magicReply, frame{typ: frameData, session: sk.session, counter: s.counter.next(), body: buf[:n]})
+
+		s.mu.Lock()
+		if p, ok := s.peers[sk.peer]; ok {
+			if len(p.queue) >= replyQueueSize {
+				p.queue = p.queue[1:]
+			}
+			p.queue = append(p.queue, b)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) reply(addr net.Addr, echo *icmp.Echo, pk peerKey) {
+	s.mu.Lock()
+	var data []byte
+	if p := s.peers[pk]; p != nil && len(p.queue) > 0 {
+		data, p.queue = p.queue[0], p.queue[1:]
+	}
+	s.mu.Unlock()
+	if data == nil {
+		return
+	}
+
+	b, err := echoMessage(ipv4.ICMPTypeEchoReply, echo.ID, echo.Seq, data)
+	if err == nil {
+		_, err = s.conn.WriteTo(b, addr)
+	}
+	if err != nil {
+		log.Printf("ICMP隧道发送应答错误: %v", err)
+	}
+}
+
+func (s *Server) closeSession(sk sessionKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.targets[sk]; ok {
+		sess.conn.Close()
+		delete(s.targets, sk)
+	}
+}
+
+// 定期关闭空闲会话，并清理已没有会话的客户端
+func (s *Server) expire(ctx context.Context) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		active := make(map[peerKey]bool)
+		for sk, sess := range s.targets {
+			if time.Since(sess.lastActive) > sessionTimeout {
+				sess.conn.Close()
+				delete(s.targets, sk)
+				continue
+			}
+			active[sk.peer] = true
+		}
+		for pk := range s.peers {
+			if !active[pk] {
+				delete(s.peers, pk)
+			}
+		}
+		s.mu.Unlock()
+		s.replay.expire()
+	}
+}
+
+func (s *Server) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sk, sess := range s.targets {
+		sess.conn.Close()
+		delete(s.targets, sk)
+	}
+}
@@ -0,0 +1,82 @@
+// Package inherit 在重新加载配置时把停止的代理的监听套接字交给监听同一地址的新代理，
+// 套接字一直保持绑定，监听队列中尚未接受的连接和尚未读取的数据包由新代理继续处理
+package inherit
+
+import (
+	"io"
+	"sync"
+)
+
+// Registry 暂存停止的代理交回的监听套接字，只在Hold和Release之间保留
+type Registry struct {
+	mu      sync.Mutex
+	holding bool
+	parked  map[string][]io.Closer
+}
+
+// New 创建暂存区
+func New() *Registry {
+	return &Registry{parked: make(map[string][]io.Closer)}
+}
+
+// Key 返回监听套接字的标识，协议、网络和配置的监听地址都相同的代理才能接手
+func Key(protocol, network, addr string) string {
+	return protocol + "/" + network + "/" + addr
+}
+
+// Hold 开始保留停止的代理交回的套接字，直到调用Release
+func (r *Registry) Hold() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.holding = true
+}
+
+// Park 在保留期间存放套接字并返回true；r为nil或不在保留期间时返回false，由调用者关闭套接字
+func (r *Registry) Park(key string, sockets ...io.Closer) bool {
+	if r == nil || len(sockets) == 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.holding {
+		return false
+	}
+	r.parked[key] = append(r.parked[key], sockets...)
+	return true
+}
+
+// Take 取出key对应的所有套接字，没有时返回nil
+func (r *Registry) Take(key string) []io.Closer {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sockets := r.parked[key]
+	delete(r.parked, key)
+	return sockets
+}
+
+// Release 结束保留并关闭没有被接手的套接字，返回关闭的数量
+func (r *Registry) Release() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	parked := r.parked
+	r.parked = make(map[string][]io.Closer)
+	r.holding = false
+	r.mu.Unlock()
+
+	n := 0
+	for _, sockets := range parked {
+		for _, s := range sockets {
+			s.Close()
+			n++
+		}
+	}
+	return n
+}
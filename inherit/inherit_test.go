@@ -0,0 +1,44 @@
+package inherit
+
+import "testing"
+
+type closer struct{ closed bool }
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestRegistryHold(t *testing.T) {
+	r := New()
+	early := &closer{}
+	if r.Park("tcp//127.0.0.1:80", early) {
+		t.Fatal("Hold之前存放了套接字")
+	}
+
+	r.Hold()
+	taken, left := &closer{}, &closer{}
+	r.Park(Key("tcp", "", "127.0.0.1:80"), taken)
+	r.Park(Key("udp", "", "127.0.0.1:80"), left)
+	if got := r.Take(Key("tcp", "", "127.0.0.1:80")); len(got) != 1 || got[0] != taken {
+		t.Fatalf("Take = %v", got)
+	}
+	if got := r.Take(Key("tcp", "tcp4", "127.0.0.1:80")); got != nil {
+		t.Errorf("网络不同的代理取得了套接字: %v", got)
+	}
+
+	if n := r.Release(); n != 1 || !left.closed || taken.closed {
+		t.Errorf("Release关闭了%d个套接字: 未接手的已关闭=%v 已接手的已关闭=%v", n, left.closed, taken.closed)
+	}
+	if r.Park(Key("udp", "", "127.0.0.1:80"), &closer{}) {
+		t.Error("Release之后仍存放套接字")
+	}
+}
+
+func TestRegistryNil(t *testing.T) {
+	var r *Registry
+	r.Hold()
+	if r.Park("k", &closer{}) || r.Take("k") != nil || r.Release() != 0 {
+		t.Error("nil暂存区应不保留任何套接字")
+	}
+}
@@ -0,0 +1,126 @@
+package inspect
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// 默认检查的数据长度
+const DefaultInspectBytes = 1024
+
+// ErrBlocked 数据命中了禁止的模式
+var ErrBlocked = errors.New("数据命中禁止模式")
+
+// Pattern 禁止模式的配置，Regex和Hex二选一
+type Pattern struct {
+	Regex string // 正则表达式，按字节匹配
+	Hex   string // 十六进制字节签名，例如 "474554"
+}
+
+// Matcher 检查数据开头的N个字节是否包含禁止的模式
+type Matcher struct {
+	limit      int
+	regexps    []*regexp.Regexp
+	signatures [][]byte
+}
+
+// NewMatcher 编译禁止模式，没有模式时返回nil表示不检查；limit<=0时使用默认值
+func NewMatcher(patterns []Pattern, limit int) (*Matcher, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = DefaultInspectBytes
+	}
+
+	m := &Matcher{limit: limit}
+	for _, p := range patterns {
+		switch {
+		case p.Regex != "" && p.Hex != "":
+			return nil, fmt.Errorf("禁止模式不能同时指定regex和hex: %s", p.Regex)
+		case p.Regex != "":
+			re, err := regexp.Compile(p.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("无效的正则表达式 %s: %w", p.Regex, err)
+			}
+			m.regexps = append(m.regexps, re)
+		case p.Hex != "":
+			sig, err := hex.DecodeString(strings.ReplaceAll(p.Hex, " ", ""))
+			if err != nil || len(sig) == 0 {
+				return nil, fmt.Errorf("无效的十六进制签名: %s", p.Hex)
+			}
+			m.signatures = append(m.signatures, sig)
+		default:
+			return nil, errors.New("禁止模式须指定regex或hex")
+		}
+	}
+	return m, nil
+}
+
+// Limit 返回检查的字节数
+func (m *Matcher) Limit() int {
+	if m == nil {
+		return 0
+	}
+	return m.limit
+}
+
+// Match 检查data的前Limit个字节，命中时返回true
+func (m *Matcher) Match(data []byte) bool {
+	if m == nil {
+		return false
+	}
+	if len(data) > m.limit {
+		data = data[:m.limit]
+	}
+	for _, sig := range m.signatures {
+		if bytes.Contains(data, sig) {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.Match(data) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reader 检查数据流的前Limit个字节，命中禁止模式时返回ErrBlocked，命中的数据块不会被读出
+type Reader struct {
+	r       io.Reader
+	m       *Matcher
+	prefix  []byte
+	checked bool // 已超过检查长度
+}
+
+// NewReader 创建检查读取器，m为nil时直接返回r
+func NewReader(r io.Reader, m *Matcher) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &Reader{r: r, m: m}
+}
+
+func (ir *Reader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if ir.checked || n == 0 {
+		return n, err
+	}
+
+	// 每次都检查累计的前缀，以便发现跨越多个数据块的模式
+	ir.prefix = append(ir.prefix, p[:min(n, ir.m.limit-len(ir.prefix))]...)
+	if ir.m.Match(ir.prefix) {
+		return 0, ErrBlocked
+	}
+	if len(ir.prefix) >= ir.m.limit {
+		ir.checked = true
+		ir.prefix = nil
+	}
+	return n, err
+}
@@ -0,0 +1,136 @@
+// Package iprelay 使用原始套接字在两台主机之间转发任意IP协议(例如GRE、ESP)的数据包
+//
+// 来自目标的数据包发往对端，来自其他地址的数据包发往目标。未配置对端时以最近一个
+// 发来数据包的非目标地址作为对端。两端主机需要把本机作为隧道的对端地址。
+// 需要root权限或CAP_NET_RAW。
+package iprelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+)
+
+// ErrPermission 没有打开原始套接字的权限
+var ErrPermission = errors.New("IP协议转发需要root权限或CAP_NET_RAW")
+
+// Options IP协议转发的可选配置
+type Options struct {
+	Peer net.IP // 只接受该地址发来的数据包，nil时以最近的来源作为对端
+
+	Stats *stats.Rule  // 流量统计，发往目标计为上行
+	Quota *quota.Quota // 流量配额，用尽后丢弃数据包
+
+	Health *health.Tracker // 套接字打开后标记为就绪，退出时标记为未就绪
+}
+
+// Proxy 转发一种IP协议的数据包
+type Proxy struct {
+	proxyID  string
+	listenIP string
+	targetIP string
+	protocol int
+	opts     Options
+
+	peer *net.IPAddr // 只在读取循环中访问
+}
+
+// NewProxy 创建IP协议转发，protocol为IP协议号，例如GRE为47、ESP为50
+func NewProxy(proxyID, listenIP, targetIP string, protocol int, opts Options) *Proxy {
+	p := &Proxy{
+		proxyID:  proxyID,
+		listenIP: listenIP,
+		targetIP: targetIP,
+		protocol: protocol,
+		opts:     opts,
+	}
+	if opts.Peer != nil {
+		p.peer = &net.IPAddr{IP: opts.Peer}
+	}
+	return p
+}
+
+// Start 打开原始套接字并转发数据包，直到上下文取消
+func (p *Proxy) Start(ctx context.Context) error {
+	target, err := net.ResolveIPAddr("ip4", p.targetIP)
+	if err != nil {
+		return fmt.Errorf("无法解析目标地址: %w", err)
+	}
+	laddr, err := net.ResolveIPAddr("ip4", p.listenIP)
+	if err != nil {
+		return fmt.Errorf("无法解析监听地址: %w", err)
+	}
+
+	conn, err := net.ListenIP(fmt.Sprintf("ip4:%d", p.protocol), laddr)
+	if errors.Is(err, os.ErrPermission) {
+		return ErrPermission
+	}
+	if err != nil {
+		return fmt.Errorf("无法打开原始套接字: %w", err)
+	}
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	log.Printf("[%s] IP协议%d转发已启动: %s -> %s", p.proxyID, p.protocol, p.listenIP, target)
+	p.opts.Health.SetReady(p.proxyID, true)
+	defer p.opts.Health.SetReady(p.proxyID, false)
+
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := conn.ReadFromIP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("[%s] 原始套接字读取错误: %v", p.proxyID, err)
+			p.opts.Stats.AddError()
+			continue
+		}
+
+		dst, up := p.route(src, target)
+		if dst == nil {
+			p.opts.Stats.AddDropped()
+			continue
+		}
+		if exceeded, first := p.opts.Quota.Exceeded(); exceeded {
+			if first {
+				log.Printf("[%s] 流量配额已用尽，本周期内丢弃所有数据包", p.proxyID)
+			}
+			p.opts.Stats.AddDropped()
+			continue
+		}
+
+		if _, err := conn.WriteToIP(buf[:n], dst); err != nil {
+			log.Printf("[%s] 发送到 %s 失败: %v", p.proxyID, dst, err)
+			p.opts.Stats.AddError()
+			continue
+		}
+		if up {
+			p.opts.Stats.AddUp(int64(n))
+		} else {
+			p.opts.Stats.AddDown(int64(n))
+		}
+		p.opts.Quota.Add(int64(n))
+	}
+}
+
+// 根据来源决定发往何处，up表示发往目标
+func (p *Proxy) route(src, target *net.IPAddr) (dst *net.IPAddr, up bool) {
+	if src.IP.Equal(target.IP) {
+		return p.peer, false
+	}
+	if p.opts.Peer != nil && !src.IP.Equal(p.opts.Peer) {
+		return nil, false
+	}
+	if p.peer == nil || !p.peer.IP.Equal(src.IP) {
+		log.Printf("[%s] 对端变更为: %s", p.proxyID, src)
+		p.peer = src
+	}
+	return target, true
+}
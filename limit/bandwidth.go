@@ -0,0 +1,289 @@
+package limit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 规则的带宽优先级，数值越小越优先
+const (
+	PriorityHigh = iota
+	PriorityNormal
+	PriorityLow
+	numPriorities
+)
+
+// DefaultBandwidthInterval 向等待者分配带宽的间隔
+const DefaultBandwidthInterval = 10 * time.Millisecond
+
+// ParsePriority 解析优先级："high"、"normal"或"low"，空字符串为normal
+func ParsePriority(s string) (int, error) {
+	switch s {
+	case "high":
+		return PriorityHigh, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	}
+	return 0, fmt.Errorf("无效的优先级 %q，应为high、normal或low", s)
+}
+
+// 全局连接名额用尽时规则对新连接的处理方式
+const (
+	OverloadQueue = iota // 新连接留在内核队列中等待名额，名额按规则优先级分配
+	OverloadDrop         // 立即接受并关闭新连接，客户端可以尽快重试其他服务器
+)
+
+// ParseOverload 解析过载处理方式："queue"或"drop"，空字符串为queue
+func ParseOverload(s string) (int, error) {
+	switch s {
+	case "", "queue":
+		return OverloadQueue, nil
+	case "drop":
+		return OverloadDrop, nil
+	}
+	return 0, fmt.Errorf("无效的过载处理方式 %q，应为queue或drop", s)
+}
+
+// Bandwidth 所有规则共享的总带宽上限或一条规则的所有连接共享的带宽上限；带宽不足时高优先级规则的数据先发送，
+// 低优先级规则只使用剩余的带宽；同一优先级内由ForRule分出的规则按权重加权公平排队，
+// 各规则得到的带宽与权重成正比，用不完的部分分给其他规则，同一规则内先到先得
+type Bandwidth struct {
+	state *bandwidthState
+	flow  *bandwidthFlow
+}
+
+type bandwidthState struct {
+	rate  int64 // 字节/秒
+	burst int64 // 令牌桶容量，也是单次申请的上限
+
+	mu     sync.Mutex
+	tokens int64
+	last   time.Time
+	flows  []*bandwidthFlow
+	queued [numPriorities]int // 各优先级的等待者数量
+	clock  float64            // 最近一次分配时的虚拟时间，新开始等待的规则从这里开始计算
+}
+
+// 一个规则的等待队列
+type bandwidthFlow struct {
+	weight  float64
+	vtime   float64 // 已分配的带宽除以权重，越小越先分配
+	waiters [numPriorities][]*bandwidthWaiter
+}
+
+type bandwidthWaiter struct {
+	n       int64
+	granted chan struct{}
+}
+
+// NewBandwidth 创建每秒rate字节的带宽上限，rate<=0时返回nil表示不限制
+func NewBandwidth(rate int64) *Bandwidth {
+	if rate <= 0 {
+		return nil
+	}
+	// 令牌桶容纳约0.1秒的流量，使各优先级的切换足够及时
+	burst := max(rate/10, 16<<10)
+	st := &bandwidthState{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+	return &Bandwidth{state: st, flow: st.addFlow(1)}
+}
+
+// ForRule 返回共享同一带宽、按weight参与公平排队的规则视图，weight<=0时为1；b为nil时返回nil
+func (b *Bandwidth) ForRule(weight int) *Bandwidth {
+	if b == nil {
+		return nil
+	}
+	b.state.mu.Lock()
+	defer b.state.mu.Unlock()
+	return &Bandwidth{state: b.state, flow: b.state.addFlow(weight)}
+}
+
+// Close 在规则的所有代理退出后从排队中移除ForRule返回的视图，此后不应再通过它申请带宽；b为nil时不做任何事
+func (b *Bandwidth) Close() {
+	if b == nil {
+		return
+	}
+	b.state.mu.Lock()
+	defer b.state.mu.Unlock()
+	b.state.flows = slices.DeleteFunc(b.state.flows, func(f *bandwidthFlow) bool { return f == b.flow })
+}
+
+// 登记新的规则队列，调用者须持有锁或尚未共享state
+func (s *bandwidthState) addFlow(weight int) *bandwidthFlow {
+	f := &bandwidthFlow{weight: float64(max(weight, 1))}
+	s.flows = append(s.flows, f)
+	return f
+}
+
+// Run 定期补充令牌并按优先级和权重唤醒等待者，直到上下文取消；只需对其中一个视图调用
+func (b *Bandwidth) Run(ctx context.Context, interval time.Duration) {
+	if b == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultBandwidthInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s := b.state
+		s.mu.Lock()
+		s.refill()
+		for p := range s.queued {
+			s.grant(p)
+			// 该优先级仍有等待者时不把带宽让给更低的优先级
+			if s.queued[p] > 0 {
+				break
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// 按虚拟时间从小到大唤醒优先级p的等待者直到令牌不足，调用者须持有锁
+func (s *bandwidthState) grant(p int) {
+	for s.queued[p] > 0 {
+		var next *bandwidthFlow
+		for _, f := range s.flows {
+			if len(f.waiters[p]) > 0 && (next == nil || f.vtime < next.vtime) {
+				next = f
+			}
+		}
+		w := next.waiters[p][0]
+		if s.tokens < w.n {
+			return
+		}
+		next.waiters[p] = next.waiters[p][1:]
+		s.queued[p]--
+		s.charge(next, w.n)
+		close(w.granted)
+	}
+}
+
+// 扣除令牌并推进规则的虚拟时间，调用者须持有锁
+func (s *bandwidthState) charge(f *bandwidthFlow, n int64) {
+	s.tokens -= n
+	s.clock = f.vtime
+	f.vtime += float64(n) / f.weight
+}
+
+// 按经过的时间补充令牌，调用者须持有锁
+func (s *bandwidthState) refill() {
+	now := time.Now()
+	s.tokens = min(s.tokens+int64(now.Sub(s.last))*s.rate/int64(time.Second), s.burst)
+	s.last = now
+}
+
+// Wait 为n字节申请带宽，n超过Chunk()时按Chunk()计算；带宽不足时阻塞，上下文取消时返回错误
+func (b *Bandwidth) Wait(ctx context.Context, priority, n int) error {
+	if b == nil {
+		return nil
+	}
+	s, f := b.state, b.flow
+	need := min(int64(n), s.burst)
+	priority = min(max(priority, 0), numPriorities-1)
+
+	s.mu.Lock()
+	s.refill()
+	// 空闲一段时间后的规则从当前虚拟时间开始，不能用积攒的份额挤占其他规则
+	idle := true
+	for p := range f.waiters {
+		idle = idle && len(f.waiters[p]) == 0
+	}
+	if idle {
+		f.vtime = max(f.vtime, s.clock)
+	}
+	queued := false
+	for p := 0; p <= priority; p++ {
+		queued = queued || s.queued[p] > 0
+	}
+	if !queued && s.tokens >= need {
+		s.charge(f, need)
+		s.mu.Unlock()
+		return nil
+	}
+	w := &bandwidthWaiter{n: need, granted: make(chan struct{})}
+	f.waiters[priority] = append(f.waiters[priority], w)
+	s.queued[priority]++
+	s.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, queued := range f.waiters[priority] {
+			if queued == w {
+				f.waiters[priority] = append(f.waiters[priority][:i:i], f.waiters[priority][i+1:]...)
+				s.queued[priority]--
+				return ctx.Err()
+			}
+		}
+		// 已分配的带宽不再归还
+		return ctx.Err()
+	}
+}
+
+// Chunk 返回单次申请的上限，写入更大的数据时应分片申请
+func (b *Bandwidth) Chunk() int {
+	if b == nil {
+		return 0
+	}
+	return int(b.state.burst)
+}
+
+// Waiting 返回各优先级正在等待带宽的数量，包括所有规则视图，按high、normal、low排列
+func (b *Bandwidth) Waiting() [numPriorities]int {
+	var counts [numPriorities]int
+	if b == nil {
+		return counts
+	}
+	b.state.mu.Lock()
+	defer b.state.mu.Unlock()
+	return b.state.queued
+}
+
+// Writer 返回按优先级申请带宽后再写入w的Writer，b为nil时返回w
+func (b *Bandwidth) Writer(ctx context.Context, priority int, w io.Writer) io.Writer {
+	if b == nil {
+		return w
+	}
+	return &bandwidthWriter{b: b, ctx: ctx, priority: priority, w: w}
+}
+
+type bandwidthWriter struct {
+	b        *Bandwidth
+	ctx      context.Context
+	priority int
+	w        io.Writer
+}
+
+func (bw *bandwidthWriter) Write(p []byte) (int, error) {
+	chunk := bw.b.Chunk()
+	written := 0
+	for written < len(p) {
+		end := min(written+chunk, len(p))
+		if err := bw.b.Wait(bw.ctx, bw.priority, end-written); err != nil {
+			return written, err
+		}
+		n, err := bw.w.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
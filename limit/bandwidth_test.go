@@ -0,0 +1,135 @@
+package limit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 创建令牌已耗尽、几乎不补充令牌的带宽上限，令牌只由测试通过release发放
+func exhaustedBandwidth() *Bandwidth {
+	b := NewBandwidth(1)
+	b.state.mu.Lock()
+	b.state.tokens = 0
+	b.state.mu.Unlock()
+	return b
+}
+
+// 在新的goroutine中为n字节等待带宽，获得后把name发送到granted，并等待它进入队列
+func waitAsync(t *testing.T, ctx context.Context, b *Bandwidth, priority, n int, name string, granted chan<- string) {
+	t.Helper()
+	s := b.state
+	s.mu.Lock()
+	queued := s.queued[priority]
+	s.mu.Unlock()
+	go func() {
+		if b.Wait(ctx, priority, n) == nil {
+			granted <- name
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		now := s.queued[priority]
+		s.mu.Unlock()
+		if now == queued+1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s没有进入优先级%d的队列", name, priority)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 发放tokens字节的令牌并唤醒优先级priority的等待者，返回各规则获得带宽的次数
+func release(t *testing.T, b *Bandwidth, priority int, tokens int64, granted <-chan string, grants int) map[string]int {
+	t.Helper()
+	s := b.state
+	s.mu.Lock()
+	s.tokens = tokens
+	s.grant(priority)
+	s.mu.Unlock()
+
+	counts := make(map[string]int)
+	for range grants {
+		select {
+		case name := <-granted:
+			counts[name]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("发放%d字节后只有%v获得了带宽", tokens, counts)
+		}
+	}
+	select {
+	case name := <-granted:
+		t.Fatalf("令牌不足时%s仍获得了带宽", name)
+	case <-time.After(10 * time.Millisecond):
+	}
+	return counts
+}
+
+// 同一优先级内各规则得到的带宽与权重成正比
+func TestBandwidthWeightedFairQueueing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := exhaustedBandwidth()
+	light, heavy := b.ForRule(1), b.ForRule(3)
+
+	granted := make(chan string, 16)
+	for range 8 {
+		waitAsync(t, ctx, light, PriorityNormal, 1024, "light", granted)
+		waitAsync(t, ctx, heavy, PriorityNormal, 1024, "heavy", granted)
+	}
+	counts := release(t, b, PriorityNormal, 8*1024, granted, 8)
+	if counts["light"] != 2 || counts["heavy"] != 6 {
+		t.Errorf("8KB带宽按1:3的权重分为%d:%d", counts["light"], counts["heavy"])
+	}
+}
+
+// 空闲过的规则从当前虚拟时间开始排队，不能用空闲期间积攒的份额挤占一直在发送的规则
+func TestBandwidthIdleRuleDoesNotBank(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := NewBandwidth(1)
+	busy, idle := b.ForRule(1), b.ForRule(1)
+	for range 10 {
+		if err := busy.Wait(ctx, PriorityNormal, 1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.state.mu.Lock()
+	b.state.tokens = 0
+	b.state.mu.Unlock()
+
+	granted := make(chan string, 8)
+	for range 4 {
+		waitAsync(t, ctx, busy, PriorityNormal, 1024, "busy", granted)
+		waitAsync(t, ctx, idle, PriorityNormal, 1024, "idle", granted)
+	}
+	counts := release(t, b, PriorityNormal, 4*1024, granted, 4)
+	if counts["busy"] != 2 || counts["idle"] != 2 {
+		t.Errorf("刚开始发送的规则与一直发送的规则分得%d:%d，应平分", counts["idle"], counts["busy"])
+	}
+}
+
+// Close后规则不再参与排队，其余规则照常获得带宽
+func TestBandwidthClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := exhaustedBandwidth()
+	closed, open := b.ForRule(1), b.ForRule(1)
+	closed.Close()
+
+	b.state.mu.Lock()
+	flows := len(b.state.flows)
+	b.state.mu.Unlock()
+	if flows != 2 {
+		t.Fatalf("关闭一个规则视图后剩余%d个队列，应剩下基础视图和open", flows)
+	}
+
+	granted := make(chan string, 1)
+	waitAsync(t, ctx, open, PriorityNormal, 1024, "open", granted)
+	if counts := release(t, b, PriorityNormal, 1024, granted, 1); counts["open"] != 1 {
+		t.Errorf("关闭其他规则后open获得带宽%d次", counts["open"])
+	}
+}
@@ -0,0 +1,150 @@
+package limit
+
+import (
+	"context"
+	"log"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// DefaultMemoryInterval 检查内存用量的间隔
+const DefaultMemoryInterval = time.Second
+
+// 超过预算后，用量降到预算的该比例以下才恢复，避免在预算附近反复切换
+const memoryResume = 0.9
+
+// 低优先级规则在用量超过预算的该比例时就暂停，为其他规则的新连接保留余量
+const memoryLowPriority = 0.8
+
+// Memory 内存预算，进程内存用量超过预算时暂停接受新的TCP连接和UDP会话，已有的连接不受影响；
+// 低优先级规则先暂停，高优先级和普通规则在用量超过预算时暂停
+type Memory struct {
+	budget uint64
+
+	mu      sync.Mutex
+	usage   uint64
+	resumed [numPriorities]chan struct{} // 各优先级超过限额期间不为nil，恢复时关闭
+}
+
+// NewMemory 创建内存预算，budget<=0时返回nil表示不限制
+func NewMemory(budget int64) *Memory {
+	if budget <= 0 {
+		return nil
+	}
+	return &Memory{budget: uint64(budget)}
+}
+
+// MemoryUsage 返回上次垃圾回收后仍存活的堆内存，包括所有连接和会话的缓冲区；
+// 不含等待回收的垃圾和运行时尚未归还系统的空闲内存，连接关闭后用量随下一次回收下降
+func MemoryUsage() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/live:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// Run 每隔interval检查一次内存用量，直到上下文取消
+func (m *Memory) Run(ctx context.Context, interval time.Duration) {
+	if m == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultMemoryInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.check(MemoryUsage())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Memory) check(usage uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.usage = usage
+	for p := range m.resumed {
+		limit := m.limit(p)
+		switch {
+		case m.resumed[p] == nil && float64(usage) > limit:
+			m.resumed[p] = make(chan struct{})
+			m.logChange(p, true, usage)
+		case m.resumed[p] != nil && float64(usage) < limit*memoryResume:
+			close(m.resumed[p])
+			m.resumed[p] = nil
+			m.logChange(p, false, usage)
+		}
+	}
+}
+
+// 返回优先级为priority的规则暂停接受新连接的用量
+func (m *Memory) limit(priority int) float64 {
+	if priority >= PriorityLow {
+		return float64(m.budget) * memoryLowPriority
+	}
+	return float64(m.budget)
+}
+
+// 高优先级与普通规则的限额相同，只记录一次
+func (m *Memory) logChange(priority int, paused bool, usage uint64) {
+	switch {
+	case priority == PriorityLow && paused:
+		log.Printf("内存用量%dMB接近预算%dMB，暂停接受低优先级规则的新TCP连接和UDP会话", usage>>20, m.budget>>20)
+	case priority == PriorityLow:
+		log.Printf("内存用量已降至%dMB，恢复接受低优先级规则的新TCP连接和UDP会话", usage>>20)
+	case priority != PriorityNormal:
+	case paused:
+		log.Printf("内存用量%dMB超过预算%dMB，暂停接受新的TCP连接和UDP会话", usage>>20, m.budget>>20)
+	default:
+		log.Printf("内存用量已降至%dMB，恢复接受新的TCP连接和UDP会话", usage>>20)
+	}
+}
+
+// Exceeded 判断内存用量是否超过优先级为priority的规则的限额
+func (m *Memory) Exceeded(priority int) bool {
+	if m == nil {
+		return false
+	}
+	priority = min(max(priority, 0), numPriorities-1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resumed[priority] != nil
+}
+
+// Wait 内存用量超过优先级为priority的规则的限额时阻塞直到恢复，上下文取消时返回错误
+func (m *Memory) Wait(ctx context.Context, priority int) error {
+	if m == nil {
+		return nil
+	}
+	priority = min(max(priority, 0), numPriorities-1)
+
+	m.mu.Lock()
+	resumed := m.resumed[priority]
+	m.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
+
+// Usage 返回最近一次检查时的内存用量和预算
+func (m *Memory) Usage() (usage, budget uint64) {
+	if m == nil {
+		return 0, 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage, m.budget
+}
@@ -0,0 +1,52 @@
+package limit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Pacer 将事件速率限制在每秒固定次数以内，多余的事件被均匀地推迟
+type Pacer struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+// NewPacer 创建速率为每秒perSecond次的节拍器，perSecond<=0时返回nil表示不限制
+func NewPacer(perSecond int) *Pacer {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &Pacer{interval: time.Second / time.Duration(perSecond)}
+}
+
+// Wait 阻塞直到下一个时间槽可用，上下文取消时返回错误
+func (p *Pacer) Wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	delay := p.next.Sub(now)
+	p.next = p.next.Add(p.interval)
+	p.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,73 @@
+package limit
+
+import (
+	"net"
+	"sync"
+)
+
+// PerIP 限制单个来源IP的并发连接数
+type PerIP struct {
+	max    int
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewPerIP 创建每IP并发限制器，max<=0时返回nil表示不限制
+func NewPerIP(max int) *PerIP {
+	if max <= 0 {
+		return nil
+	}
+	return &PerIP{
+		max:    max,
+		counts: make(map[string]int),
+	}
+}
+
+// Acquire 为指定地址占用一个连接名额，超出限制时返回false
+func (l *PerIP) Acquire(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	ip := hostOf(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.counts[ip] >= l.max {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+// Release 释放指定地址占用的连接名额
+func (l *PerIP) Release(addr net.Addr) {
+	if l == nil {
+		return
+	}
+
+	ip := hostOf(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.counts[ip] <= 1 {
+		delete(l.counts, ip)
+		return
+	}
+	l.counts[ip]--
+}
+
+// 提取地址中的IP部分
+func hostOf(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
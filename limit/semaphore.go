@@ -0,0 +1,171 @@
+package limit
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Semaphore 限制同时进行的任务数量；由ForRule分给多个规则时，名额用尽后释放的名额先交给高优先级的等待规则，
+// 同一优先级内按权重做加权最大最小公平分配：交给占用数与权重之比最小的规则，占用大量名额的规则不能让其他规则一直等待
+type Semaphore struct {
+	state *semaphoreState
+	share *semaphoreShare
+}
+
+type semaphoreState struct {
+	capacity int
+
+	mu     sync.Mutex
+	inUse  int
+	shares []*semaphoreShare
+}
+
+// 一个规则在信号量中的份额
+type semaphoreShare struct {
+	priority int
+	weight   int
+	inUse    int
+	waiters  []chan struct{}
+}
+
+// NewSemaphore 创建容量为n的信号量，n<=0时返回nil表示不限制
+func NewSemaphore(n int) *Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	s := &semaphoreState{capacity: n}
+	return &Semaphore{state: s, share: s.addShare(1, PriorityNormal)}
+}
+
+// ForRule 返回共享同一容量、按优先级和weight参与分配的规则视图，weight<=0时为1；s为nil时返回nil
+func (s *Semaphore) ForRule(weight, priority int) *Semaphore {
+	if s == nil {
+		return nil
+	}
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	return &Semaphore{state: s.state, share: s.state.addShare(weight, priority)}
+}
+
+// Close 在规则的所有代理退出后从分配中移除ForRule返回的视图，此后不应再通过它等待名额；s为nil时不做任何事
+func (s *Semaphore) Close() {
+	if s == nil {
+		return
+	}
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.shares = slices.DeleteFunc(s.state.shares, func(share *semaphoreShare) bool { return share == s.share })
+}
+
+// 登记新的份额，调用者须持有锁或尚未共享state
+func (s *semaphoreState) addShare(weight, priority int) *semaphoreShare {
+	share := &semaphoreShare{weight: max(weight, 1), priority: min(max(priority, 0), numPriorities-1)}
+	s.shares = append(s.shares, share)
+	return share
+}
+
+// Acquire 阻塞直到获得一个名额，上下文取消时返回错误
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	st := s.state
+	st.mu.Lock()
+	if st.inUse < st.capacity {
+		st.inUse++
+		s.share.inUse++
+		st.mu.Unlock()
+		return nil
+	}
+	granted := make(chan struct{})
+	s.share.waiters = append(s.share.waiters, granted)
+	st.mu.Unlock()
+
+	select {
+	case <-granted:
+		return nil
+	case <-ctx.Done():
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		for i, w := range s.share.waiters {
+			if w == granted {
+				s.share.waiters = append(s.share.waiters[:i:i], s.share.waiters[i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// 取消的同时已获得名额，交给下一个等待者
+		s.share.inUse--
+		st.inUse--
+		st.grant()
+		return ctx.Err()
+	}
+}
+
+// TryAcquire 有空闲名额时占用一个并返回true，否则立即返回false
+func (s *Semaphore) TryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	st := s.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.inUse >= st.capacity {
+		return false
+	}
+	st.inUse++
+	s.share.inUse++
+	return true
+}
+
+// Release 释放一个名额
+func (s *Semaphore) Release() {
+	if s == nil {
+		return
+	}
+	st := s.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s.share.inUse--
+	st.inUse--
+	st.grant()
+}
+
+// 把空闲名额交给优先级最高、其次占用数与权重之比最小的等待规则，调用者须持有锁
+func (s *semaphoreState) grant() {
+	for s.inUse < s.capacity {
+		var next *semaphoreShare
+		for _, share := range s.shares {
+			if len(share.waiters) > 0 && (next == nil || share.before(next)) {
+				next = share
+			}
+		}
+		if next == nil {
+			return
+		}
+		close(next.waiters[0])
+		next.waiters = next.waiters[1:]
+		next.inUse++
+		s.inUse++
+	}
+}
+
+// 判断等待的份额是否应先于other获得名额
+func (s *semaphoreShare) before(other *semaphoreShare) bool {
+	if s.priority != other.priority {
+		return s.priority < other.priority
+	}
+	// 比较 s.inUse/s.weight < other.inUse/other.weight
+	return s.inUse*other.weight < other.inUse*s.weight
+}
+
+// InUse 返回当前已占用的名额数量，包括所有规则视图
+func (s *Semaphore) InUse() int {
+	if s == nil {
+		return 0
+	}
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	return s.state.inUse
+}
@@ -0,0 +1,291 @@
+package limit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 等待直到规则视图有n个等待者
+func waitQueued(t *testing.T, s *Semaphore, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.state.mu.Lock()
+		queued := len(s.share.waiters)
+		s.state.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("规则视图有%d个等待者，一直没有变为%d个", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 在新的goroutine中等待名额，获得后把name发送到granted
+func acquireAsync(t *testing.T, s *Semaphore, name string, granted chan<- string) {
+	t.Helper()
+	s.state.mu.Lock()
+	n := len(s.share.waiters)
+	s.state.mu.Unlock()
+	go func() {
+		if err := s.Acquire(context.Background()); err != nil {
+			t.Errorf("%s等待名额失败: %v", name, err)
+		}
+		granted <- name
+	}()
+	waitQueued(t, s, n+1)
+}
+
+// 在有空闲名额时占用n个名额
+func hold(t *testing.T, s *Semaphore, n int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for range n {
+		if err := s.Acquire(ctx); err != nil {
+			t.Fatalf("有空闲名额时Acquire阻塞: %v", err)
+		}
+	}
+}
+
+// 每次释放一个名额，检查依次获得名额的规则
+func expectGrants(t *testing.T, release *Semaphore, granted <-chan string, want ...string) {
+	t.Helper()
+	for i, name := range want {
+		release.Release()
+		select {
+		case got := <-granted:
+			if got != name {
+				t.Fatalf("第%d次释放的名额给了%s，应给%s", i+1, got, name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("第%d次释放后%s没有获得名额", i+1, name)
+		}
+	}
+}
+
+// 名额交给占用数与权重之比最小的规则，同一规则内按等待顺序
+func TestSemaphoreWeightedFairness(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		weights  map[string]int
+		held     string   // 占满所有名额的规则
+		queue    []string // 依次开始等待的规则
+		want     []string // held每释放一个名额时获得名额的规则
+	}{
+		{
+			name:     "权重相同时占用少的规则先得到名额",
+			capacity: 2,
+			weights:  map[string]int{"a": 1, "b": 1},
+			held:     "a",
+			queue:    []string{"a", "a", "b", "b"},
+			want:     []string{"b", "a"},
+		},
+		{
+			name:     "权重为3的规则得到三倍的名额",
+			capacity: 4,
+			weights:  map[string]int{"a": 1, "b": 3},
+			held:     "a",
+			queue:    []string{"a", "a", "a", "a", "b", "b", "b", "b"},
+			want:     []string{"b", "b", "b", "a"},
+		},
+		{
+			name:     "权重为0或负数按1计算",
+			capacity: 2,
+			weights:  map[string]int{"a": 0, "b": -5},
+			held:     "a",
+			queue:    []string{"a", "b"},
+			want:     []string{"b", "a"},
+		},
+		{
+			name:     "没有等待的高权重规则不占用名额",
+			capacity: 3,
+			weights:  map[string]int{"a": 1, "b": 2, "idle": 100},
+			held:     "a",
+			queue:    []string{"b", "b", "b", "a"},
+			want:     []string{"b", "b", "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := NewSemaphore(tt.capacity)
+			rules := make(map[string]*Semaphore)
+			for name, w := range tt.weights {
+				rules[name] = base.ForRule(w, PriorityNormal)
+			}
+			hold(t, rules[tt.held], tt.capacity)
+
+			granted := make(chan string, len(tt.queue))
+			for _, name := range tt.queue {
+				acquireAsync(t, rules[name], name, granted)
+			}
+			expectGrants(t, rules[tt.held], granted, tt.want...)
+			if n := base.InUse(); n != tt.capacity {
+				t.Errorf("名额交接后占用%d个名额，容量为%d", n, tt.capacity)
+			}
+		})
+	}
+}
+
+// 等待中取消时移除等待者，不占用名额
+func TestSemaphoreCancelWhileWaiting(t *testing.T) {
+	base := NewSemaphore(1)
+	r := base.ForRule(1, PriorityNormal)
+	hold(t, r, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.Acquire(ctx) }()
+	waitQueued(t, r, 1)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("取消等待后Acquire返回%v", err)
+	}
+	waitQueued(t, r, 0)
+
+	r.Release()
+	if n := base.InUse(); n != 0 {
+		t.Fatalf("取消的等待者占用了%d个名额", n)
+	}
+	hold(t, r, 1)
+}
+
+// 取消与释放同时发生：取消的等待者若已获得名额则交给下一个等待者，名额不会丢失或重复分配
+func TestSemaphoreCancelRacesRelease(t *testing.T) {
+	for range 200 {
+		base := NewSemaphore(1)
+		a, b := base.ForRule(1, PriorityNormal), base.ForRule(1, PriorityNormal)
+		hold(t, a, 1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errA := make(chan error)
+		go func() { errA <- a.Acquire(ctx) }()
+		waitQueued(t, a, 1)
+		granted := make(chan string, 1)
+		acquireAsync(t, b, "b", granted)
+
+		// a和b的占用数相同，释放的名额先交给先登记的a
+		go cancel()
+		a.Release()
+
+		if err := <-errA; err == nil {
+			select {
+			case <-granted:
+				t.Fatal("a持有名额时b也获得了名额")
+			case <-time.After(time.Millisecond):
+			}
+			a.Release()
+		}
+		select {
+		case <-granted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("a放弃名额后b没有获得名额")
+		}
+		if n := base.InUse(); n != 1 {
+			t.Fatalf("只有b持有名额时占用数为%d", n)
+		}
+		b.Release()
+		if n := base.InUse(); n != 0 {
+			t.Fatalf("全部释放后占用数为%d", n)
+		}
+	}
+}
+
+// Close移除规则视图后，其余规则的等待者照常获得名额
+func TestSemaphoreClose(t *testing.T) {
+	base := NewSemaphore(1)
+	a, b := base.ForRule(1, PriorityNormal), base.ForRule(1, PriorityNormal)
+	hold(t, a, 1)
+	granted := make(chan string, 1)
+	acquireAsync(t, b, "b", granted)
+
+	a.Close()
+	base.state.mu.Lock()
+	shares := len(base.state.shares)
+	base.state.mu.Unlock()
+	if shares != 2 {
+		t.Errorf("关闭一个规则视图后剩余%d个份额，应剩下基础视图和b", shares)
+	}
+	expectGrants(t, a, granted, "b")
+}
+
+// 名额先交给优先级高的规则，优先级相同时才按权重分配
+func TestSemaphorePriority(t *testing.T) {
+	type rule struct{ weight, priority int }
+	tests := []struct {
+		name  string
+		rules map[string]rule
+		held  string   // 占满所有名额的规则
+		queue []string // 依次开始等待的规则
+		want  []string // 每个获得名额的规则随后释放名额，依次获得名额的规则
+	}{
+		{
+			name:  "高优先级后到也先得到名额",
+			rules: map[string]rule{"low": {1, PriorityLow}, "normal": {1, PriorityNormal}, "high": {1, PriorityHigh}},
+			held:  "low",
+			queue: []string{"low", "normal", "high", "normal"},
+			want:  []string{"high", "normal", "normal", "low"},
+		},
+		{
+			name:  "权重再高也排在高优先级之后",
+			rules: map[string]rule{"high": {1, PriorityHigh}, "heavy": {100, PriorityNormal}},
+			held:  "high",
+			queue: []string{"heavy", "high", "high"},
+			want:  []string{"high", "high", "heavy"},
+		},
+		{
+			name:  "超出范围的优先级按最高或最低处理",
+			rules: map[string]rule{"above": {1, -3}, "below": {1, 9}, "normal": {1, PriorityNormal}},
+			held:  "below",
+			queue: []string{"below", "normal", "above"},
+			want:  []string{"above", "normal", "below"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := NewSemaphore(1)
+			rules := make(map[string]*Semaphore)
+			for name, r := range tt.rules {
+				rules[name] = base.ForRule(r.weight, r.priority)
+			}
+			if !rules[tt.held].TryAcquire() {
+				t.Fatal("空闲的信号量TryAcquire失败")
+			}
+			if rules[tt.held].TryAcquire() {
+				t.Fatal("名额用尽后TryAcquire仍然成功")
+			}
+			granted := make(chan string, len(tt.queue))
+			for _, name := range tt.queue {
+				acquireAsync(t, rules[name], name, granted)
+			}
+			holder := tt.held
+			for _, name := range tt.want {
+				expectGrants(t, rules[holder], granted, name)
+				holder = name
+			}
+		})
+	}
+}
+
+// 高优先级的等待者取消后，名额交给低优先级的等待者
+func TestSemaphorePriorityCancel(t *testing.T) {
+	base := NewSemaphore(1)
+	high, low := base.ForRule(1, PriorityHigh), base.ForRule(1, PriorityLow)
+	hold(t, low, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- high.Acquire(ctx) }()
+	waitQueued(t, high, 1)
+	granted := make(chan string, 1)
+	acquireAsync(t, low, "low", granted)
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("取消等待后high的Acquire返回%v", err)
+	}
+	expectGrants(t, low, granted, "low")
+}
@@ -0,0 +1,134 @@
+package link
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// HandshakeTimeout 握手各步骤的超时时间
+const HandshakeTimeout = 10 * time.Second
+
+// ErrAuthFailed 令牌不一致
+var ErrAuthFailed = errors.New("链路认证失败")
+
+// 对挑战、用途和连接ID计算HMAC，令牌本身不在网络上传输
+func computeMAC(token string, nonce []byte, role string, id []byte) []byte {
+	h := hmac.New(sha256.New, []byte(token))
+	h.Write(nonce)
+	h.Write([]byte(role))
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(id))))
+	h.Write(id)
+	return h.Sum(nil)
+}
+
+// 服务端对双方的挑战计算HMAC，证明自己持有令牌；消息类型参与计算，与客户端的认证响应区分开
+func welcomeMAC(token string, serverNonce, clientNonce []byte, role string, id []byte) []byte {
+	return computeMAC(token, append(append([]byte(MsgWelcome), serverNonce...), clientNonce...), role, id)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// Accept 在服务端完成握手：发送挑战并校验客户端的认证消息，返回客户端的auth消息
+// 认证通过后回复带有认证响应的welcome，工作连接随后开始传输数据
+func Accept(conn net.Conn, token, name string) (*Conn, Message, error) {
+	c := NewConn(conn)
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, Message{}, err
+	}
+	if err := c.Send(Message{Type: MsgHello, Version: Version, Nonce: nonce}); err != nil {
+		return nil, Message{}, err
+	}
+
+	m, err := c.Recv(HandshakeTimeout)
+	if err != nil {
+		return nil, Message{}, err
+	}
+	if m.Type != MsgAuth {
+		return nil, m, fmt.Errorf("期望auth消息，收到%q", m.Type)
+	}
+	if m.Version != Version {
+		c.Send(Message{Type: MsgError, Error: fmt.Sprintf("不支持的协议版本%d，服务端版本为%d", m.Version, Version)})
+		return nil, m, fmt.Errorf("不支持的协议版本%d", m.Version)
+	}
+	if !hmac.Equal(m.MAC, computeMAC(token, nonce, m.Role, m.ID)) {
+		c.Send(Message{Type: MsgError, Error: ErrAuthFailed.Error()})
+		return nil, m, ErrAuthFailed
+	}
+
+	welcome := Message{Type: MsgWelcome, Version: Version, Name: name, MAC: welcomeMAC(token, nonce, m.Nonce, m.Role, m.ID)}
+	if err := c.Send(welcome); err != nil {
+		return nil, m, err
+	}
+	return c, m, nil
+}
+
+// Dial 连接服务端并完成握手，校验welcome中的认证响应后返回服务端节点名；id为工作连接的ID，控制连接为nil
+func Dial(ctx context.Context, addr, token, name, role string, id []byte) (*Conn, string, error) {
+	dialer := net.Dialer{Timeout: HandshakeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, "", err
+	}
+	c := NewConn(conn)
+
+	peer, err := clientHandshake(c, token, name, role, id)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return c, peer, nil
+}
+
+func clientHandshake(c *Conn, token, name, role string, id []byte) (string, error) {
+	hello, err := c.Recv(HandshakeTimeout)
+	if err != nil {
+		return "", err
+	}
+	if hello.Type != MsgHello {
+		return "", fmt.Errorf("期望hello消息，收到%q", hello.Type)
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return "", err
+	}
+
+	err = c.Send(Message{
+		Type:    MsgAuth,
+		Version: Version,
+		Name:    name,
+		Nonce:   nonce,
+		Role:    role,
+		ID:      id,
+		MAC:     computeMAC(token, hello.Nonce, role, id),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	welcome, err := c.Recv(HandshakeTimeout)
+	if err != nil {
+		return "", err
+	}
+	if welcome.Type != MsgWelcome {
+		return "", fmt.Errorf("握手被拒绝: %s", welcome.Error)
+	}
+	// 服务端同样须证明持有令牌，否则冒充的服务端可以让本端为其建立工作连接
+	if !hmac.Equal(welcome.MAC, welcomeMAC(token, hello.Nonce, nonce, role, id)) {
+		return "", ErrAuthFailed
+	}
+	return welcome.Name, nil
+}
@@ -0,0 +1,163 @@
+package link
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+type acceptResult struct {
+	conn *Conn
+	auth Message
+	err  error
+}
+
+// 在本地监听一次握手，返回监听地址和服务端的握手结果
+func serveOnce(t *testing.T, token string) (string, <-chan acceptResult) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	done := make(chan acceptResult, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- acceptResult{err: err}
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		c, m, err := Accept(conn, token, "server")
+		done <- acceptResult{c, m, err}
+	}()
+	return ln.Addr().String(), done
+}
+
+func TestHandshakeControl(t *testing.T) {
+	addr, done := serveOnce(t, "secret")
+	c, peer, err := Dial(context.Background(), addr, "secret", "client", RoleControl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if peer != "server" {
+		t.Errorf("服务端节点名 = %q", peer)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.auth.Name != "client" || res.auth.Role != RoleControl {
+		t.Errorf("服务端收到的auth消息: name=%q role=%q", res.auth.Name, res.auth.Role)
+	}
+}
+
+// 工作连接认证后不回复welcome，之后的数据原样传输
+func TestHandshakeWorkCarriesData(t *testing.T) {
+	addr, done := serveOnce(t, "secret")
+	c, _, err := Dial(context.Background(), addr, "secret", "client", RoleWork, []byte("work-42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if string(res.auth.ID) != "work-42" {
+		t.Errorf("服务端收到的工作连接ID为%q", res.auth.ID)
+	}
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(res.conn, buf); err != nil || string(buf) != "payload" {
+		t.Errorf("认证后读取到 %q, %v", buf, err)
+	}
+}
+
+func TestHandshakeWrongToken(t *testing.T) {
+	addr, done := serveOnce(t, "secret")
+	_, _, err := Dial(context.Background(), addr, "guess", "client", RoleControl, nil)
+	if err == nil {
+		t.Fatal("令牌错误时握手成功")
+	}
+	if res := <-done; !errors.Is(res.err, ErrAuthFailed) {
+		t.Errorf("服务端返回 %v, 期望 ErrAuthFailed", res.err)
+	}
+}
+
+// MAC覆盖连接用途和ID，截获的工作连接认证不能改用其他ID或升级为控制连接
+func TestHandshakeMACBindsRoleAndID(t *testing.T) {
+	tests := []struct {
+		name string
+		role string
+		id   []byte
+	}{
+		{"改用其他ID", RoleWork, []byte("id-8")},
+		{"ID加长", RoleWork, []byte("id-7\x00")},
+		{"改为控制连接", RoleControl, []byte("id-7")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, done := serveOnce(t, "secret")
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			c := NewConn(conn)
+			hello, err := c.Recv(HandshakeTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Send(Message{
+				Type:    MsgAuth,
+				Version: Version,
+				Role:    tt.role,
+				ID:      tt.id,
+				MAC:     computeMAC("secret", hello.Nonce, RoleWork, []byte("id-7")),
+			})
+			if res := <-done; !errors.Is(res.err, ErrAuthFailed) {
+				t.Errorf("服务端返回 %v, 期望 ErrAuthFailed", res.err)
+			}
+		})
+	}
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	addr, done := serveOnce(t, "secret")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewConn(conn)
+	hello, err := c.Recv(HandshakeTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Send(Message{
+		Type:    MsgAuth,
+		Version: Version + 1,
+		Role:    RoleControl,
+		MAC:     computeMAC("secret", hello.Nonce, RoleControl, nil),
+	})
+
+	reply, err := c.Recv(HandshakeTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != MsgError {
+		t.Errorf("版本不一致时回复%q, 期望error", reply.Type)
+	}
+	if res := <-done; res.err == nil {
+		t.Error("版本不一致时服务端握手成功")
+	}
+}
@@ -0,0 +1,112 @@
+package link
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// 心跳和健康信息的发送间隔，超过3倍间隔未收到任何消息视为链路已断开
+const (
+	KeepaliveInterval = 15 * time.Second
+	KeepaliveTimeout  = 3 * KeepaliveInterval
+)
+
+// Control 已认证的控制连接，负责心跳、往返时间测量和健康信息交换
+type Control struct {
+	*Conn
+	peer   string
+	status func() Status // 本端的健康信息
+
+	rtt        atomic.Int64 // 纳秒
+	pingSeq    atomic.Uint64
+	pingSent   atomic.Int64 // 最近一次ping的发送时间
+	peerStatus atomic.Pointer[Status]
+	lastSeen   atomic.Int64
+}
+
+// NewControl 包装已完成握手的控制连接，status为nil时不发送健康信息
+func NewControl(c *Conn, peer string, status func() Status) *Control {
+	ctl := &Control{Conn: c, peer: peer, status: status}
+	ctl.lastSeen.Store(time.Now().UnixNano())
+	return ctl
+}
+
+// Peer 返回对端节点名
+func (c *Control) Peer() string {
+	return c.peer
+}
+
+// RTT 返回最近一次心跳的往返时间
+func (c *Control) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+// PeerStatus 返回对端最近报告的健康信息，尚未收到时返回nil
+func (c *Control) PeerStatus() *Status {
+	return c.peerStatus.Load()
+}
+
+// LastSeen 返回最近一次收到对端消息的时间
+func (c *Control) LastSeen() time.Time {
+	return time.Unix(0, c.lastSeen.Load())
+}
+
+// Run 定期发送心跳和健康信息并读取消息，心跳和健康信息在内部处理，其余消息交给handle
+// 链路断开、超时或上下文取消时关闭连接并返回
+func (c *Control) Run(ctx context.Context, handle func(Message)) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	context.AfterFunc(runCtx, func() { c.Close() })
+
+	go c.heartbeat(runCtx)
+
+	for {
+		m, err := c.Recv(KeepaliveTimeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		c.lastSeen.Store(time.Now().UnixNano())
+
+		switch m.Type {
+		case MsgPing:
+			c.Send(Message{Type: MsgPong, Seq: m.Seq})
+		case MsgPong:
+			if m.Seq == c.pingSeq.Load() {
+				c.rtt.Store(time.Now().UnixNano() - c.pingSent.Load())
+			}
+		case MsgStatus:
+			if m.Status != nil {
+				c.peerStatus.Store(m.Status)
+			}
+		default:
+			handle(m)
+		}
+	}
+}
+
+func (c *Control) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(KeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		if c.status != nil {
+			s := c.status()
+			if err := c.Send(Message{Type: MsgStatus, Status: &s}); err != nil {
+				return
+			}
+		}
+		c.pingSent.Store(time.Now().UnixNano())
+		if err := c.Send(Message{Type: MsgPing, Seq: c.pingSeq.Add(1)}); err != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
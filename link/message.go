@@ -0,0 +1,140 @@
+package link
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Version 当前的链路协议版本；版本2起服务端在welcome中证明持有令牌，工作连接也回复welcome；
+// 版本3起工作连接ID为随机的16字节，不能被猜测
+const Version = 3
+
+// 一条消息的长度上限，握手在认证前读取消息，不限制时对端可以发送不含换行的数据耗尽内存
+const maxMessageSize = 1 << 20
+
+// ErrMessageTooLarge 消息超过长度上限
+var ErrMessageTooLarge = errors.New("链路消息超过长度上限")
+
+// 消息类型
+const (
+	MsgHello   = "hello"   // 服务端 -> 客户端: 协议版本和认证挑战
+	MsgAuth    = "auth"    // 客户端 -> 服务端: 认证响应、连接用途和客户端的挑战
+	MsgWelcome = "welcome" // 服务端 -> 客户端: 认证通过，附带对客户端挑战的认证响应
+	MsgError   = "error"
+	MsgPing    = "ping"
+	MsgPong    = "pong"
+	MsgStatus  = "status" // 双方定期交换的健康信息
+)
+
+// 连接用途
+const (
+	RoleControl = "control" // 控制连接，长期保持
+	RoleWork    = "work"    // 工作连接，认证后为原始数据流
+)
+
+// Message 链路上的消息，每条消息为一行JSON；各用途只使用其中的部分字段
+type Message struct {
+	Type    string `json:"type"`
+	Version int    `json:"version,omitempty"`
+	Name    string `json:"name,omitempty"` // 发送方节点名
+	Error   string `json:"error,omitempty"`
+
+	// 认证
+	Nonce []byte `json:"nonce,omitempty"`
+	MAC   []byte `json:"mac,omitempty"`
+	Role  string `json:"role,omitempty"`
+
+	// 心跳和健康信息
+	Seq    uint64  `json:"seq,omitempty"`
+	Status *Status `json:"status,omitempty"`
+
+	// 上层协议使用的字段
+	ID       []byte       `json:"id,omitempty"`
+	Service  string       `json:"service,omitempty"`
+	Services []Service    `json:"services,omitempty"`
+	Results  []RuleResult `json:"results,omitempty"`
+}
+
+// Service 由一端提出、另一端确认的转发规则
+type Service struct {
+	Name       string `json:"name"`
+	RemotePort int    `json:"remote_port"`
+}
+
+// RuleResult 对一条规则的协商结果
+type RuleResult struct {
+	Name     string `json:"name"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Status 节点的健康信息
+type Status struct {
+	Ready       bool     `json:"ready"`               // 所有监听器和链路是否就绪
+	NotReady    []string `json:"not_ready,omitempty"` // 未就绪的项目
+	ActiveConns int64    `json:"active_conns"`        // 经由本链路的活动连接数
+	Uptime      int64    `json:"uptime_seconds"`      // 进程运行时间
+}
+
+// Conn 按行收发消息的连接，消息之后的原始数据可直接通过Read读取，写入消息可并发
+type Conn struct {
+	net.Conn
+	r  *bufio.Reader
+	mu sync.Mutex
+}
+
+// NewConn 包装conn
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Send 发送一条消息
+func (c *Conn) Send(m Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.Conn.Write(append(b, '\n'))
+	return err
+}
+
+// Recv 读取一条消息，timeout>0时为本次读取设置超时
+func (c *Conn) Recv(timeout time.Duration) (Message, error) {
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		defer c.SetReadDeadline(time.Time{})
+	}
+	line, err := c.readLine()
+	if err != nil {
+		return Message{}, err
+	}
+	var m Message
+	err = json.Unmarshal(line, &m)
+	return m, err
+}
+
+// 读取一行，超过maxMessageSize时返回ErrMessageTooLarge
+func (c *Conn) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := c.r.ReadSlice('\n')
+		if len(line)+len(frag) > maxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// Read 读取消息之后的原始数据，包含已缓冲的部分
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,32 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+var (
+	// 每个进程随机的前缀，使重启前后的ID不会重复
+	connIDPrefix = func() string {
+		var b [4]byte
+		rand.Read(b[:])
+		return fmt.Sprintf("%08x", binary.BigEndian.Uint32(b[:]))
+	}()
+	connIDSeq atomic.Uint64
+)
+
+// NewConnID 为TCP连接或UDP会话分配唯一ID，例如 "5f3a9c1e-1a"，同一连接的所有日志都带有该ID以便关联
+func NewConnID() string {
+	return connIDPrefix + "-" + strconv.FormatUint(connIDSeq.Add(1), 36)
+}
+
+// Tag 返回日志中方括号内的标识，例如 "web-tcp-p1 conn=5f3a9c1e-1a"，connID为空时只有代理ID
+func Tag(proxyID, connID string) string {
+	if connID == "" {
+		return proxyID
+	}
+	return proxyID + " conn=" + connID
+}
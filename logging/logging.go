@@ -0,0 +1,111 @@
+// Package logging 为每条转发规则提供独立的日志级别
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Level 日志级别
+type Level int
+
+const (
+	LevelDebug Level = iota // 逐个数据包等调试信息
+	LevelInfo               // 连接和会话的建立与关闭(默认)
+	LevelWarn               // 被拒绝或丢弃的连接、配置问题
+	LevelError              // 转发过程中的错误
+)
+
+// ParseLevel 解析日志级别，空字符串为LevelInfo
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("无效的日志级别: %q", s)
+}
+
+// Logger 只输出不低于指定级别的日志，nil按LevelInfo输出
+type Logger struct {
+	level Level
+
+	// 连接日志的抽样：每sample个连接或会话中只有1个输出info和debug日志
+	sample int
+	conns  *atomic.Uint64
+
+	throttle *throttle // 合并重复的警告和错误，nil为不合并
+}
+
+// New 创建指定级别的Logger
+func New(level Level) *Logger {
+	return &Logger{level: level}
+}
+
+// Sample 设置连接日志的抽样率，每n个连接或会话只有1个输出建立和关闭等日志，警告和错误不受影响；
+// n不大于1时全部输出
+func (l *Logger) Sample(n int) *Logger {
+	if l == nil || n <= 1 {
+		return l
+	}
+	c := *l
+	c.sample, c.conns = n, new(atomic.Uint64)
+	return &c
+}
+
+// Throttle 合并重复的警告和错误：同一格式的日志在window内最多输出5条，其余在窗口结束时汇总为一条；
+// window为0时使用DefaultThrottle，为负数时不合并
+func (l *Logger) Throttle(window time.Duration) *Logger {
+	if l == nil || window < 0 {
+		return l
+	}
+	if window == 0 {
+		window = DefaultThrottle
+	}
+	c := *l
+	c.throttle = &throttle{window: window, seen: make(map[string]*repeat)}
+	return &c
+}
+
+// Conn 为一个新的连接或会话返回Logger，未被抽中的连接只输出警告和错误
+func (l *Logger) Conn() *Logger {
+	if l == nil || l.sample <= 1 {
+		return l
+	}
+	if (l.conns.Add(1)-1)%uint64(l.sample) == 0 {
+		return l
+	}
+	return &Logger{level: max(l.level, LevelWarn), throttle: l.throttle}
+}
+
+// Enabled 判断是否输出该级别的日志，可用于跳过代价较高的日志参数计算
+func (l *Logger) Enabled(level Level) bool {
+	if l == nil {
+		return level >= LevelInfo
+	}
+	return level >= l.level
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.output(LevelDebug, format, args) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.output(LevelInfo, format, args) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.output(LevelWarn, format, args) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.output(LevelError, format, args) }
+
+func (l *Logger) output(level Level, format string, args []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if level >= LevelWarn && l != nil && l.throttle != nil && !l.throttle.allow(format, msg) {
+		return
+	}
+	log.Output(3, msg)
+}
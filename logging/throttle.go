@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultThrottle 未配置时合并重复日志的时间窗口
+	DefaultThrottle = time.Minute
+	// 每个窗口内同一格式的日志最多直接输出的条数
+	throttleBurst = 5
+)
+
+// throttle 合并短时间内大量重复的警告和错误日志，同一格式字符串视为相同的日志
+type throttle struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]*repeat
+}
+
+type repeat struct {
+	count      int    // 本窗口内的次数
+	suppressed int    // 本窗口内省略的次数
+	last       string // 最后一条被省略的日志
+}
+
+// allow 记录一次日志，返回是否直接输出；窗口内超出条数的日志在窗口结束时汇总输出一条
+func (t *throttle) allow(format, msg string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r := t.seen[format]
+	if r == nil {
+		r = &repeat{}
+		t.seen[format] = r
+		time.AfterFunc(t.window, func() { t.flush(format) })
+	}
+	r.count++
+	if r.count <= throttleBurst {
+		return true
+	}
+	r.suppressed++
+	r.last = msg
+	return false
+}
+
+func (t *throttle) flush(format string) {
+	t.mu.Lock()
+	r := t.seen[format]
+	delete(t.seen, format)
+	t.mu.Unlock()
+
+	if r != nil && r.suppressed > 0 {
+		log.Print(fmt.Sprintf("重复%d次(最近%s内): %s", r.suppressed, t.window, r.last))
+	}
+}
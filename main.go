@@ -2,100 +2,680 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/Mxmilu666/nia-forwarding/audit"
+	"github.com/Mxmilu666/nia-forwarding/chaos"
 	"github.com/Mxmilu666/nia-forwarding/config"
+	"github.com/Mxmilu666/nia-forwarding/dashboard"
+	"github.com/Mxmilu666/nia-forwarding/dnscache"
+	"github.com/Mxmilu666/nia-forwarding/events"
+	"github.com/Mxmilu666/nia-forwarding/fdlimit"
+	"github.com/Mxmilu666/nia-forwarding/flow"
+	"github.com/Mxmilu666/nia-forwarding/handoff"
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/i18n"
+	"github.com/Mxmilu666/nia-forwarding/icmptunnel"
+	"github.com/Mxmilu666/nia-forwarding/limit"
+	"github.com/Mxmilu666/nia-forwarding/link"
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+	_ "github.com/Mxmilu666/nia-forwarding/middleware/lua"
+	_ "github.com/Mxmilu666/nia-forwarding/middleware/wasm"
+	"github.com/Mxmilu666/nia-forwarding/netwatch"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/record"
+	"github.com/Mxmilu666/nia-forwarding/reverse"
+	"github.com/Mxmilu666/nia-forwarding/rewrite"
+	"github.com/Mxmilu666/nia-forwarding/serialport"
+	"github.com/Mxmilu666/nia-forwarding/sockmap"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+	"github.com/Mxmilu666/nia-forwarding/status"
+	"github.com/Mxmilu666/nia-forwarding/targetgroup"
 	"github.com/Mxmilu666/nia-forwarding/tcp"
+	"github.com/Mxmilu666/nia-forwarding/tlsutil"
 	"github.com/Mxmilu666/nia-forwarding/udp"
+	"github.com/Mxmilu666/nia-forwarding/unixsock"
+	"github.com/Mxmilu666/nia-forwarding/wgnet"
+	"github.com/Mxmilu666/nia-forwarding/xdp"
 )
 
 var (
-	configPath   string
+	configPaths  pathList
 	generateConf string
+	generateDash string
+	migrateConf  string
+
+	replayFile   string
+	replayTarget string
+	replaySpeed  float64
+	replayWait   time.Duration
 )
 
 func init() {
-	flag.StringVar(&configPath, "config", "", "配置文件路径 (默认为当前目录下的config.yaml)")
+	flag.Var(&configPaths, "config", "配置文件路径 (默认为当前目录下的config.yaml)，可重复指定或以逗号分隔多个文件，按顺序合并")
 	flag.StringVar(&generateConf, "gen-config", "", "生成默认配置文件到指定路径")
-	flag.Parse()
+	flag.StringVar(&generateDash, "gen-dashboard", "", "生成Grafana仪表盘JSON到指定路径")
+	flag.StringVar(&migrateConf, "migrate", "", "将指定的配置文件升级到当前版本，原文件保存为.bak")
+	flag.StringVar(&replayFile, "replay", "", "回放指定的录制文件")
+	flag.StringVar(&replayTarget, "replay-target", "", "回放的目标地址 (例如 127.0.0.1:8080)")
+	flag.Float64Var(&replaySpeed, "replay-speed", 1, "回放速度倍数，0为不等待直接发送")
+	flag.DurationVar(&replayWait, "replay-wait", 2*time.Second, "回放结束后等待目标响应的时间")
 }
 
-// 解析端口列表，返回所有端口的切片
-func parseAllPorts(portsArray []string) ([]int, error) {
-	var allPorts []int
+// pathList 可重复指定的路径参数，每次的取值也可以是逗号分隔的多个路径
+type pathList []string
 
-	for _, portsStr := range portsArray {
-		ports, err := parsePorts(portsStr)
-		if err != nil {
-			return nil, err
+func (p *pathList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pathList) Set(value string) error {
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			*p = append(*p, path)
 		}
-		allPorts = append(allPorts, ports...)
 	}
+	return nil
+}
 
-	return allPorts, nil
+// 把配置中的IP协议族转换为net包的网络名，例如 ("tcp", "ipv4") 为 "tcp4"，未配置时返回空字符串使用默认值
+func networkName(protocol, family string) string {
+	switch family {
+	case "ipv4":
+		return protocol + "4"
+	case "ipv6":
+		return protocol + "6"
+	case "dual":
+		return protocol
+	}
+	return ""
 }
 
-// 解析单个端口范围/列表字符串，返回所有端口的切片
-func parsePorts(portsStr string) ([]int, error) {
-	var ports []int
+// 解析组播组和网卡配置，未配置的项返回nil
+func parseMulticast(group, ifaceName string) (net.IP, *net.Interface, error) {
+	var ip net.IP
+	if group != "" {
+		ip = net.ParseIP(group)
+		if ip == nil || ip.To4() == nil || !ip.IsMulticast() {
+			return nil, nil, fmt.Errorf("%s 不是IPv4组播地址", group)
+		}
+	}
+	if ifaceName == "" {
+		return ip, nil, nil
+	}
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("找不到网卡 %s: %w", ifaceName, err)
+	}
+	return ip, iface, nil
+}
 
-	// 先按逗号分割，处理可能的多个区间或单端口
-	parts := strings.Split(portsStr, ",")
+// 根据配置启动反向转发服务端和代理端，链路状态通过expvar的links输出
+func startReverse(ctx context.Context, wg *sync.WaitGroup, cfg *config.Config, tracker *health.Tracker) {
+	if cfg.ReverseServer == nil && cfg.ReverseAgent == nil {
+		return
+	}
 
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if part == "" {
-			continue
+	nodeName := cfg.NodeName
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+	started := time.Now()
+	nodeStatus := func() link.Status {
+		notReady := tracker.NotReady()
+		return link.Status{
+			Ready:    len(notReady) == 0,
+			NotReady: notReady,
+			Uptime:   int64(time.Since(started).Seconds()),
 		}
+	}
 
-		// 检查是否为端口范围 (例如 "8080-8085")
-		if strings.Contains(part, "-") {
-			rangeParts := strings.Split(part, "-")
-			if len(rangeParts) != 2 {
-				return nil, fmt.Errorf("端口范围格式无效: %s", part)
+	var server *reverse.Server
+	if rs := cfg.ReverseServer; rs != nil {
+		allowPorts, err := config.ParsePorts(rs.AllowPorts)
+		switch {
+		case err != nil:
+			log.Printf("反向转发服务端允许端口解析错误: %v", err)
+		case rs.Token == "":
+			log.Printf("反向转发服务端未配置token，不启动")
+		default:
+			if len(allowPorts) == 0 {
+				log.Printf("反向转发服务端未配置allow_ports，将拒绝代理端注册的所有服务")
 			}
+			server = reverse.NewServer(rs.Listen, rs.Token, nodeName, allowPorts, nodeStatus)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := server.Run(ctx); err != nil {
+					log.Printf("反向转发服务端错误: %v", err)
+				}
+			}()
+		}
+	}
 
-			start, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
-			if err != nil {
-				return nil, fmt.Errorf("无效的起始端口: %s", rangeParts[0])
+	var agent *reverse.Agent
+	if ra := cfg.ReverseAgent; ra != nil {
+		var services []reverse.Service
+		for _, svc := range ra.Services {
+			services = append(services, reverse.Service{Name: svc.Name, RemotePort: svc.RemotePort, LocalAddr: svc.Local})
+		}
+		agent = reverse.NewAgent(ra.Server, ra.Token, nodeName, services, nodeStatus, tracker)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent.Run(ctx)
+		}()
+	}
+
+	expvar.Publish("links", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"node":   nodeName,
+			"agents": server.Peers(),
+			"server": agent.Peer(),
+		}
+	}))
+}
+
+// 根据配置启动ICMP隧道，没有原始套接字权限时只记录日志
+func startICMPTunnel(ctx context.Context, wg *sync.WaitGroup, c *config.ICMPTunnelConfig) {
+	if c == nil {
+		return
+	}
+
+	var run func(context.Context) error
+	switch {
+	case c.Key == "":
+		log.Printf("ICMP隧道未配置key，不启动")
+		return
+	case c.Role == "server" && len(c.AllowTargets) == 0:
+		log.Printf("ICMP隧道服务端未配置allow_targets，不启动")
+		return
+	case c.Role == "server":
+		run = icmptunnel.NewServer(c.Key, c.AllowTargets).Run
+	case c.Role == "client":
+		var services []icmptunnel.Service
+		for _, svc := range c.Services {
+			if svc.Protocol != "" && svc.Protocol != "udp" {
+				log.Printf("ICMP隧道服务[%s]配置错误: 只能转发UDP，不支持 %q", svc.Name, svc.Protocol)
+				return
 			}
+			services = append(services, icmptunnel.Service{Name: svc.Name, Listen: svc.Listen, Target: svc.Target})
+		}
+		client, err := icmptunnel.NewClient(c.Peer, c.Key, services)
+		if err != nil {
+			log.Printf("ICMP隧道配置错误: %v", err)
+			return
+		}
+		run = client.Run
+	default:
+		log.Printf("ICMP隧道配置错误: 无效的role %q", c.Role)
+		return
+	}
 
-			end, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := run(ctx); err != nil {
+			log.Printf("ICMP隧道未启动: %v", err)
+		}
+	}()
+}
+
+// 生成一一对应的监听地址和目标地址，只有一个目标时所有监听地址汇聚到该目标
+func addrPairs(fc *config.ForwardConfig, protocol string, listenPorts, targetPorts []int) (listen, target []string, err error) {
+	if listen, err = endpoints(protocol, fc.ListenIP, listenPorts, fc.ListenUnix, fc.ListenPipe, serialConfig(fc.ListenSerial)); err != nil {
+		return nil, nil, err
+	}
+	if fc.TargetGroup != "" {
+		target = []string{groupDesc(fc.TargetGroup)}
+	} else if target, err = endpoints(protocol, fc.TargetIP, targetPorts, fc.TargetUnix, fc.TargetPipe, serialConfig(fc.TargetSerial)); err != nil {
+		return nil, nil, err
+	}
+
+	if len(target) == 1 && len(listen) > 1 {
+		target = slices.Repeat(target, len(listen))
+	}
+	if len(listen) != len(target) {
+		return nil, nil, fmt.Errorf("监听端口数量(%d)与目标端口数量(%d)不匹配", len(listen), len(target))
+	}
+	return listen, target, nil
+}
+
+// 一侧的端点地址，配置了unix套接字路径、命名管道或串口时只有一个端点
+func endpoints(protocol, ip string, ports []int, unixPath, pipe string, serial *serialport.Config) ([]string, error) {
+	switch {
+	case countSet(unixPath != "", pipe != "", serial != nil) > 1:
+		return nil, fmt.Errorf("unix套接字、命名管道和串口只能配置一个")
+	case unixPath != "":
+		if err := unixsock.Check(unixPath); err != nil {
+			return nil, err
+		}
+		if protocol == "udp" {
+			return []string{udp.UnixgramPrefix + unixPath}, nil
+		}
+		return []string{tcp.UnixPrefix + unixPath}, nil
+	case pipe != "":
+		if protocol != "tcp" {
+			return nil, fmt.Errorf("命名管道仅用于TCP")
+		}
+		if runtime.GOOS != "windows" {
+			return nil, fmt.Errorf("命名管道仅支持Windows")
+		}
+		return []string{tcp.PipePrefix + pipe}, nil
+	case serial != nil:
+		if protocol != "tcp" {
+			return nil, fmt.Errorf("串口仅用于TCP")
+		}
+		if err := serial.Validate(); err != nil {
+			return nil, err
+		}
+		return []string{tcp.SerialPrefix + serial.Device}, nil
+	}
+
+	addrs := make([]string, 0, len(ports))
+	for _, port := range ports {
+		addrs = append(addrs, fmt.Sprintf("%s:%d", ip, port))
+	}
+	return addrs, nil
+}
+
+// 按已启用的规则估算文件描述符用量，端口表达式有误的规则不计入
+func estimateFDs(cfg *config.Config) fdlimit.Estimate {
+	e := fdlimit.Estimate{Bounded: true}
+	ruleConns := 0
+	for _, fc := range cfg.Forwards {
+		if !fc.Enabled {
+			continue
+		}
+		// 数据包级转发只占用每个网卡一个套接字和一个原始套接字
+		if fc.PacketMode {
+			e.Listeners += len(fc.PacketInterfaces) + 1
+			continue
+		}
+		ports := 1
+		if fc.ListenUnix == "" && fc.ListenPipe == "" && fc.ListenSerial == nil {
+			listenPorts, err := config.ParsePorts(fc.ListenPorts)
 			if err != nil {
-				return nil, fmt.Errorf("无效的结束端口: %s", rangeParts[1])
+				continue
 			}
+			ports = len(listenPorts)
+		}
 
-			if start > end {
-				return nil, fmt.Errorf("端口范围无效，起始端口大于结束端口: %d > %d", start, end)
+		protocols := fc.Protocol
+		if len(protocols) == 0 {
+			protocols = []string{"tcp"}
+		}
+		for _, protocol := range protocols {
+			switch strings.ToLower(strings.TrimSpace(protocol)) {
+			case "tcp":
+				e.Listeners += ports
+				if fc.MaxHandlers > 0 {
+					ruleConns += fc.MaxHandlers
+				} else if cfg.MaxHandlers <= 0 {
+					e.Bounded = false
+				}
+			case "udp":
+				// 每个UDP会话占用一个连接目标的套接字，会话数不受限制
+				e.Listeners += ports * max(fc.ReadLoops, 1)
+				e.Bounded = false
+			case "ip":
+				e.Listeners++
+			case "sip":
+				// 每个通话的媒体流占用4个中转端口，通话数不受限制
+				e.Listeners += ports
+				e.Bounded = false
+			case "dns":
+				// 同时监听UDP和TCP，每条UDP查询占用一个连接上游的套接字，TCP客户端连接数不受限制
+				e.Listeners += ports * 2
+				e.Bounded = false
 			}
+		}
+	}
 
-			// 添加范围内的所有端口
-			for port := start; port <= end; port++ {
-				ports = append(ports, port)
-			}
+	e.Conns = ruleConns
+	if cfg.MaxHandlers > 0 && (ruleConns == 0 || cfg.MaxHandlers < ruleConns) {
+		e.Conns = cfg.MaxHandlers
+	}
+	return e
+}
+
+func countSet(set ...bool) int {
+	n := 0
+	for _, b := range set {
+		if b {
+			n++
+		}
+	}
+	return n
+}
+
+// 转换串口配置，c为nil时返回nil
+func serialConfig(c *config.SerialConfig) *serialport.Config {
+	if c == nil {
+		return nil
+	}
+	return &serialport.Config{Device: c.Device, Baud: c.Baud, Format: c.Format}
+}
+
+// 串口设备名，c为nil时为空
+func serialDevice(c *config.SerialConfig) string {
+	if c == nil {
+		return ""
+	}
+	return c.Device
+}
+
+// 用于日志的目标组描述，未配置时为空
+func groupDesc(name string) string {
+	if name == "" {
+		return ""
+	}
+	return targetgroup.Prefix + name
+}
+
+// 用于日志的端点描述，配置了套接字路径、命名管道或串口时使用该路径
+func endpointDesc(ip string, ports []string, paths ...string) string {
+	for _, path := range paths {
+		if path != "" {
+			return path
+		}
+	}
+	return fmt.Sprintf("%s:%v", ip, ports)
+}
+
+// 根据配置创建TLS配置，并启动证书热重载
+func buildTLSConfig(ctx context.Context, tlsCfg *config.TLSConfig) (*tls.Config, error) {
+	minVersion, err := tlsutil.ParseVersion(tlsCfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	maxVersion, err := tlsutil.ParseVersion(tlsCfg.MaxVersion)
+	if err != nil {
+		return nil, err
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		return nil, fmt.Errorf("TLS最低版本%s高于最高版本%s", tlsCfg.MinVersion, tlsCfg.MaxVersion)
+	}
+
+	cipherSuites, err := tlsutil.ParseCipherSuites(tlsCfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	var pairs []tlsutil.CertPair
+	if tlsCfg.CertFile != "" {
+		pairs = append(pairs, tlsutil.CertPair{CertFile: tlsCfg.CertFile, KeyFile: tlsCfg.KeyFile})
+	}
+	for _, c := range tlsCfg.Certificates {
+		pairs = append(pairs, tlsutil.CertPair{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+
+	reloader, err := tlsutil.NewCertReloader(pairs)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.Watch(ctx, tlsCfg.ReloadInterval)
+	if tlsCfg.OCSPStapling {
+		go reloader.StapleOCSP(ctx, tlsCfg.OCSPRefresh)
+	}
+
+	return &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     minVersion,
+		MaxVersion:     maxVersion,
+		CipherSuites:   cipherSuites,
+	}, nil
+}
+
+// 按配置顺序创建规则的中间件链
+func buildMiddlewares(configs []config.MiddlewareConfig) (middleware.Chain, error) {
+	var chain middleware.Chain
+	for _, mc := range configs {
+		m, err := middleware.New(mc.Name, mc.Options)
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+		chain = append(chain, m)
+	}
+	return chain, nil
+}
+
+// 将查找替换规则按方向拆分
+func buildRewrites(configs []config.RewriteConfig) (up, down []rewrite.Replacement, err error) {
+	for _, rc := range configs {
+		if rc.Find == "" {
+			return nil, nil, fmt.Errorf("替换规则的查找串不能为空")
+		}
+		rep := rewrite.Replacement{Find: []byte(rc.Find), Replace: []byte(rc.Replace)}
+
+		switch strings.ToLower(strings.TrimSpace(rc.Direction)) {
+		case "", "both":
+			up = append(up, rep)
+			down = append(down, rep)
+		case "up":
+			up = append(up, rep)
+		case "down":
+			down = append(down, rep)
+		default:
+			return nil, nil, fmt.Errorf("无效的替换方向: %s", rc.Direction)
+		}
+	}
+	return up, down, nil
+}
+
+// 规则启用了tcp_sockmap时返回共享的加速器
+func sockmapFor(accel *sockmap.Accelerator, enabled bool) *sockmap.Accelerator {
+	if !enabled {
+		return nil
+	}
+	return accel
+}
+
+// 规则启用了udp_xdp时返回共享的XDP转发器
+func xdpFor(forwarder *xdp.Forwarder, enabled bool) *xdp.Forwarder {
+	if !enabled {
+		return nil
+	}
+	return forwarder
+}
+
+// 根据故障注入配置和delay选项创建注入器，delay的随机范围折算为延迟加抖动
+func buildChaos(ruleName string, c *config.ChaosConfig, delay config.DelayRange) *chaos.Injector {
+	var cfg chaos.Config
+	if c != nil {
+		cfg = chaos.Config{
+			Latency:          c.Latency,
+			Jitter:           c.Jitter,
+			Bandwidth:        int64(c.Bandwidth),
+			ResetProbability: c.ResetProbability,
+			LossPercent:      c.PacketLossPercent,
+			ReorderPercent:   c.ReorderPercent,
+			ReorderDelay:     c.ReorderDelay,
+		}
+		if cfg != (chaos.Config{}) {
+			log.Printf("配置[%s]已启用故障注入: 延迟%s±%s, 带宽%s/s, 重置概率%g, UDP丢包%g%%, 乱序%g%%",
+				ruleName, c.Latency, c.Jitter, c.Bandwidth, c.ResetProbability, c.PacketLossPercent, c.ReorderPercent)
+		}
+	}
+
+	if !delay.IsZero() {
+		cfg.Latency += (delay.Min + delay.Max) / 2
+		cfg.Jitter += (delay.Max - delay.Min) / 2
+		log.Printf("配置[%s]转发延迟: %s", ruleName, delay)
+	}
+
+	return chaos.New(cfg)
+}
+
+// 按配置启动进程内的WireGuard隧道
+func startWireGuard(name string, c config.WireGuardConfig) (*wgnet.Net, error) {
+	addrs, err := c.Addresses()
+	if err != nil {
+		return nil, err
+	}
+	cfg := wgnet.Config{
+		PrivateKey: c.PrivateKey,
+		Addresses:  addrs,
+		ListenPort: c.ListenPort,
+		MTU:        c.MTU,
+	}
+	for _, p := range c.Peers {
+		prefixes, err := p.Prefixes()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Peers = append(cfg.Peers, wgnet.Peer{
+			PublicKey:           p.PublicKey,
+			PresharedKey:        p.PresharedKey,
+			Endpoint:            p.Endpoint,
+			AllowedIPs:          prefixes,
+			PersistentKeepalive: p.PersistentKeepalive,
+		})
+	}
+	n, err := wgnet.New(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("WireGuard隧道[%s]已启动，隧道内地址: %v", name, addrs)
+	return n, nil
+}
+
+// 启动指标和健康检查HTTP服务，直到上下文取消；addr可以是 "unix:路径"，供status和events子命令在本机查询；api不为nil时同时提供规则API
+func serveHTTP(ctx context.Context, addr string, tracker *health.Tracker, resolver *dnscache.Cache, eventBus *events.Bus, api *ruleAPI, started time.Time) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", stats.Handler())
+	mux.Handle("/healthz", health.LivenessHandler())
+	mux.Handle("/readyz", tracker.ReadinessHandler())
+	mux.Handle("/status", status.Handler(started, tracker, resolver))
+	mux.Handle("/events", eventBus.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	api.register(mux)
+	server := &http.Server{Handler: mux}
+
+	var listener net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, status.UnixPrefix); ok {
+		unixsock.RemoveStale(path)
+		listener, err = net.Listen("unix", path)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		log.Printf("指标服务错误: %v", err)
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Printf("指标服务已启动: http://%s/metrics", addr)
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("指标服务错误: %v", err)
+	}
+}
+
+// 查询运行中实例的状态并以表格输出，实例地址默认为配置中的metrics_listen
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	addr := fs.String("addr", "", "运行中实例的指标服务地址，例如 127.0.0.1:9100 或 unix:/run/nia-forwarding.sock (默认为配置中的metrics_listen)")
+	timeout := fs.Duration("timeout", 5*time.Second, "等待响应的超时时间")
+	fs.Parse(args)
+
+	report, err := status.Fetch(instanceAddr(*addr), *timeout)
+	if err != nil {
+		log.Fatalf("查询状态失败: %v", err)
+	}
+	if err := status.Print(os.Stdout, report); err != nil {
+		log.Fatalf("输出状态失败: %v", err)
+	}
+}
+
+// 持续输出运行中实例的连接事件，类似tail -f，直到中断或实例退出
+func runEvents(args []string) {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	addr := fs.String("addr", "", "运行中实例的指标服务地址，例如 127.0.0.1:9100 或 unix:/run/nia-forwarding.sock (默认为配置中的metrics_listen)")
+	proxyID := fs.String("proxy", "", "只显示代理ID以此开头的事件，例如规则名")
+	types := fs.String("type", "", "只显示这些类型的事件，逗号分隔: open, close, error")
+	asJSON := fs.Bool("json", false, "每行输出一个JSON格式的事件")
+	fs.Parse(args)
+
+	filter := events.Filter{ProxyID: *proxyID, Types: events.ParseTypes(*types)}
+	client, base := status.Client(instanceAddr(*addr), 0)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	encoder := json.NewEncoder(os.Stdout)
+	err := events.Watch(ctx, client, base, filter, func(e events.Event) {
+		if *asJSON {
+			encoder.Encode(e)
 		} else {
-			// 单个端口
-			port, err := strconv.Atoi(part)
-			if err != nil {
-				return nil, fmt.Errorf("无效的端口号: %s", part)
-			}
-			ports = append(ports, port)
+			i18n.Println(events.Format(e))
 		}
+	})
+	if err != nil {
+		log.Fatalf("订阅事件失败: %v", err)
 	}
+}
 
-	return ports, nil
+// 返回子命令连接的实例地址，addr为空时使用配置中的metrics_listen
+func instanceAddr(addr string) string {
+	if addr != "" {
+		return addr
+	}
+	// 不为子命令生成默认配置文件
+	if len(configPaths) == 0 {
+		if _, err := os.Stat(config.DefaultConfigFile); err != nil {
+			log.Fatalf("未找到配置文件，请通过 -config 或 -addr 指定运行中的实例")
+		}
+	}
+	cfg, err := config.LoadConfig(configPaths...)
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
+	}
+	if cfg.MetricsListen == "" {
+		log.Fatalf("配置中未设置metrics_listen，请通过 -addr 指定运行中的实例")
+	}
+	return cfg.MetricsListen
 }
 
 func main() {
+	flag.Parse()
+	started := time.Now()
+
+	// 日志经翻译后输出，语言由配置文件的log_language或环境变量NF_LOG_LANGUAGE指定
+	log.SetOutput(i18n.Writer(os.Stderr))
+
+	// 子命令
+	switch flag.Arg(0) {
+	case "":
+	case "status":
+		runStatus(flag.Args()[1:])
+		return
+	case "events":
+		runEvents(flag.Args()[1:])
+		return
+	default:
+		log.Fatalf("未知的子命令: %s", flag.Arg(0))
+	}
+
 	// 如果指定了生成配置文件
 	if generateConf != "" {
 		if err := config.SaveDefaultConfig(generateConf); err != nil {
@@ -105,117 +685,311 @@ func main() {
 		return
 	}
 
+	// 如果指定了升级配置文件
+	if migrateConf != "" {
+		changes, err := config.MigrateFile(migrateConf)
+		if err != nil {
+			log.Fatalf("升级配置文件失败: %v", err)
+		}
+		if len(changes) == 0 {
+			log.Printf("配置文件已是第%d版，无需升级", config.CurrentVersion)
+			return
+		}
+		log.Printf("配置文件已升级到第%d版，原文件保存为%s.bak:", config.CurrentVersion, migrateConf)
+		for _, change := range changes {
+			log.Printf("  %s", change)
+		}
+		return
+	}
+
+	// 如果指定了生成仪表盘
+	if generateDash != "" {
+		if err := dashboard.Save(generateDash); err != nil {
+			log.Fatalf("生成仪表盘失败: %v", err)
+		}
+		log.Printf("Grafana仪表盘已保存到: %s", generateDash)
+		return
+	}
+
+	// 如果指定了回放录制文件
+	if replayFile != "" {
+		if replayTarget == "" {
+			log.Fatalf("回放需要通过 -replay-target 指定目标地址")
+		}
+		rec, err := record.Load(replayFile)
+		if err != nil {
+			log.Fatalf("读取录制文件失败: %v", err)
+		}
+		log.Printf("回放%s录制: %d块数据, 录制于%s", strings.ToUpper(rec.Protocol), len(rec.Chunks), rec.Start.Format(time.DateTime))
+		if err := record.Replay(context.Background(), rec, replayTarget, replaySpeed, replayWait); err != nil {
+			log.Fatalf("回放失败: %v", err)
+		}
+		return
+	}
+
 	// 加载配置
-	cfg, err := config.LoadConfig(configPath)
+	cfg, err := config.LoadConfig(configPaths...)
 	if err != nil {
 		log.Fatalf("加载配置失败: %v", err)
 	}
 
+	fdlimit.Check(estimateFDs(cfg))
+
+	// 审计日志记录本次加载的配置及其与上一次记录相比的变更
+	auditLog, err := audit.Open(cfg.AuditLog)
+	if err != nil {
+		log.Fatalf("打开审计日志失败: %v", err)
+	}
+	defer auditLog.Close()
+	if auditLog != nil {
+		snapshot, err := cfg.Snapshot()
+		if err == nil {
+			err = auditLog.Record(audit.ActorStartup, audit.ActionConfigLoad, "", snapshot)
+		}
+		if err != nil {
+			log.Printf("记录审计日志失败: %v", err)
+		}
+	}
+
+	// 升级时从旧进程接管TCP连接，按代理ID分组；旧进程退出后才释放监听地址并保存配额用量，因此须在监听和加载配额之前完成
+	adopted := make(map[string][]handoff.Conn)
+	var handoffs *handoff.Registry
+	var handoffServer *handoff.Server
+	if cfg.HandoffSocket != "" {
+		conns, err := handoff.Receive(cfg.HandoffSocket)
+		if err != nil {
+			log.Printf("接管旧进程的连接失败: %v", err)
+		}
+		if len(conns) > 0 {
+			log.Printf("已从旧进程接管%d个TCP连接", len(conns))
+		}
+		for _, c := range conns {
+			adopted[c.ProxyID] = append(adopted[c.ProxyID], c)
+		}
+
+		if handoffServer, err = handoff.Listen(cfg.HandoffSocket); err != nil {
+			log.Printf("无法启用连接交接: %v", err)
+		} else {
+			handoffs = handoff.NewRegistry()
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	var wg sync.WaitGroup
 
-	// 处理所有转发规则
-	for i, forwardCfg := range cfg.Forwards {
-		if !forwardCfg.Enabled {
-			continue
-		}
+	// 所有规则共享的连接处理上限，按规则权重公平分配
+	globalHandlers := limit.NewSemaphore(cfg.MaxHandlers)
+
+	// 监听地址在本机不存在的代理等待网卡地址变化后重新绑定
+	netWatch := netwatch.New(ctx)
+
+	// 所有规则共享的内存预算
+	memory := limit.NewMemory(int64(cfg.MemoryBudget))
+	go memory.Run(ctx, limit.DefaultMemoryInterval)
 
-		ruleName := forwardCfg.Name
-		if ruleName == "" {
-			ruleName = fmt.Sprintf("forward-%d", i+1)
+	// 所有规则共享的总带宽上限，按规则优先级分配，同一优先级内按规则权重公平分配
+	bandwidth := limit.NewBandwidth(int64(cfg.BandwidthLimit))
+	go bandwidth.Run(ctx, limit.DefaultBandwidthInterval)
+
+	// 所有规则共享的目标主机名解析缓存，配置了dns_servers时向这些服务器查询
+	var resolver *dnscache.Cache
+	if c := cfg.DNSCache; c != nil || len(cfg.DNSServers) > 0 {
+		if c == nil {
+			c = &config.DNSCacheConfig{}
+		}
+		negative := c.NegativeTTL
+		if negative == 0 {
+			negative = dnscache.DefaultNegativeTTL
 		}
+		opts := dnscache.Options{MinTTL: c.MinTTL, MaxTTL: c.MaxTTL, NegativeTTL: negative}
+		if len(cfg.DNSServers) > 0 {
+			servers, err := dnscache.NewResolver(cfg.DNSServers)
+			if err != nil {
+				log.Fatalf("DNS服务器配置错误: %v", err)
+			}
+			opts.Lookup = servers.Lookup
+			log.Printf("目标主机名将通过DNS服务器解析: %s", strings.Join(cfg.DNSServers, ", "))
+		}
+		resolver = dnscache.New(opts)
+		go resolver.Run(ctx, dnscache.DefaultPurgeInterval)
+		log.Printf("已启用DNS缓存: min_ttl=%s, max_ttl=%s, negative_ttl=%s", c.MinTTL, c.MaxTTL, negative)
+	}
 
-		listenPorts, err := parseAllPorts(forwardCfg.ListenPorts)
+	// 启用了tcp_sockmap的规则共享的sockmap加速器，无法创建时这些规则使用普通转发
+	var accel *sockmap.Accelerator
+	if slices.ContainsFunc(cfg.Forwards, func(fc config.ForwardConfig) bool { return fc.Enabled && fc.TCPSockmap }) {
+		a, err := sockmap.New()
 		if err != nil {
-			log.Printf("配置[%s]监听端口解析错误: %v", ruleName, err)
-			continue
+			log.Printf("无法启用sockmap加速，相关规则使用普通转发: %v", err)
+		} else {
+			accel = a
+			defer accel.Close()
 		}
+	}
 
-		targetPorts, err := parseAllPorts(forwardCfg.TargetPorts)
+	// 启用了udp_xdp的规则共享挂在xdp_interfaces网卡上的XDP程序，无法加载时这些规则使用普通转发
+	var xdpForwarder *xdp.Forwarder
+	if slices.ContainsFunc(cfg.Forwards, func(fc config.ForwardConfig) bool { return fc.Enabled && fc.UDPXDP }) {
+		f, err := xdp.New(cfg.XDPInterfaces)
 		if err != nil {
-			log.Printf("配置[%s]目标端口解析错误: %v", ruleName, err)
-			continue
+			log.Printf("无法启用XDP转发，相关规则使用普通转发: %v", err)
+		} else {
+			xdpForwarder = f
+			defer xdpForwarder.Close()
 		}
+	}
 
-		// 检查端口数量是否匹配
-		if len(listenPorts) != len(targetPorts) {
-			log.Printf("配置[%s]错误: 监听端口数量(%d)与目标端口数量(%d)不匹配",
-				ruleName, len(listenPorts), len(targetPorts))
-			continue
-		}
+	// 加载流量配额用量
+	quotaFile := cfg.QuotaFile
+	if quotaFile == "" {
+		quotaFile = config.DefaultQuotaFile
+	}
+	quotas, err := quota.NewStore(quotaFile)
+	if err != nil {
+		log.Fatalf("加载流量配额失败: %v", err)
+	}
+	go quotas.Run(ctx, quota.DefaultSaveInterval)
+
+	// 流记录导出使用独立的上下文，以便在所有代理退出后发送剩余记录
+	flows, err := flow.NewExporter(cfg.FlowCollector, cfg.FlowObservDomain)
+	if err != nil {
+		log.Fatalf("创建流记录导出器失败: %v", err)
+	}
+	flowCtx, stopFlows := context.WithCancel(context.Background())
+	flowsDone := make(chan struct{})
+	go func() {
+		defer close(flowsDone)
+		flows.Run(flowCtx)
+	}()
+	if flows != nil {
+		log.Printf("流记录将以IPFIX格式导出到: %s", cfg.FlowCollector)
+	}
+
+	// 连接事件经指标HTTP服务的/events推送，没有指标服务时不发布
+	var eventBus *events.Bus
+	if cfg.MetricsListen != "" {
+		eventBus = events.NewBus()
+	}
 
-		// 如果协议列表为空，默认使用TCP
-		if len(forwardCfg.Protocol) == 0 {
-			forwardCfg.Protocol = []string{"tcp"}
+	if cfg.StatsD != nil && cfg.StatsD.Address != "" {
+		statsd, err := stats.NewStatsD(cfg.StatsD.Address, cfg.StatsD.Prefix)
+		if err != nil {
+			log.Printf("创建StatsD推送失败: %v", err)
+		} else {
+			go statsd.Run(ctx, cfg.StatsD.Interval)
+			log.Printf("指标将推送到StatsD: %s", cfg.StatsD.Address)
 		}
+	}
+	if cfg.InfluxDB != nil && cfg.InfluxDB.URL != "" {
+		go stats.NewInfluxDB(cfg.InfluxDB.URL, cfg.InfluxDB.Token).Run(ctx, cfg.InfluxDB.Interval)
+		log.Printf("指标将推送到InfluxDB: %s", cfg.InfluxDB.URL)
+	}
 
-		// 循环处理每个协议
-		for _, protocol := range forwardCfg.Protocol {
-			protocol = strings.ToLower(strings.TrimSpace(protocol))
+	tracker := health.NewTracker()
 
-			// 根据协议类型创建对应的转发代理
-			switch protocol {
-			case "tcp":
-				// 为每对端口创建一个TCP代理
-				for j := 0; j < len(listenPorts); j++ {
-					wg.Add(1)
-					listenAddr := fmt.Sprintf("%s:%d", forwardCfg.ListenIP, listenPorts[j])
-					targetAddr := fmt.Sprintf("%s:%d", forwardCfg.TargetIP, targetPorts[j])
-					proxyID := fmt.Sprintf("%s-tcp-p%d", ruleName, j+1)
-
-					go func(listenAddr, targetAddr, proxyID string) {
-						defer wg.Done()
-						tcpProxy := tcp.NewProxy(proxyID, listenAddr, targetAddr)
-						if err := tcpProxy.Start(ctx); err != nil {
-							log.Printf("TCP代理[%s]错误: %v", proxyID, err)
-						}
-					}(listenAddr, targetAddr, proxyID)
-				}
+	// 处理所有转发规则
+	rules := newRuleManager(ctx, &wg, cfg, ruleShared{
+		tracker:        tracker,
+		quotas:         quotas,
+		globalHandlers: globalHandlers,
+		bandwidth:      bandwidth,
+		memory:         memory,
+		netWatch:       netWatch,
+		resolver:       resolver,
+		accel:          accel,
+		xdp:            xdpForwarder,
+		handoffs:       handoffs,
+		flows:          flows,
+		events:         eventBus,
+		adopted:        adopted,
+	})
+	defer rules.Close()
+	rules.startAll(cfg.Forwards)
+
+	stats.PublishExpvar()
+	expvar.Publish("pools", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"global_handlers": globalHandlers.InUse(),
+			"memory_exceeded": memory.Exceeded(limit.PriorityNormal),
+			"bandwidth_wait":  bandwidth.Waiting(),
+			"rule_handlers":   rules.handlerUsage(),
+			"flow_queue":      flows.QueueLen(),
+			"flow_dropped":    flows.Dropped(),
+		}
+	}))
 
-				log.Printf("已启动TCP端口组[%s]: %s:%v -> %s:%v, 共%d个端口对",
-					ruleName, forwardCfg.ListenIP, forwardCfg.ListenPorts, forwardCfg.TargetIP, forwardCfg.TargetPorts, len(listenPorts))
+	startReverse(ctx, &wg, cfg, tracker)
+	startICMPTunnel(ctx, &wg, cfg.ICMPTunnel)
 
-			case "udp":
-				// 为每对端口创建一个UDP代理
-				for j := 0; j < len(listenPorts); j++ {
-					wg.Add(1)
-					listenAddr := fmt.Sprintf("%s:%d", forwardCfg.ListenIP, listenPorts[j])
-					targetAddr := fmt.Sprintf("%s:%d", forwardCfg.TargetIP, targetPorts[j])
-					proxyID := fmt.Sprintf("%s-udp-p%d", ruleName, j+1)
-
-					go func(listenAddr, targetAddr, proxyID string, bufferSize int, timeout time.Duration) {
-						defer wg.Done()
-						udpProxy := udp.NewProxy(
-							proxyID,
-							listenAddr,
-							targetAddr,
-							bufferSize,
-							timeout,
-						)
-						if err := udpProxy.Start(ctx); err != nil {
-							log.Printf("UDP代理[%s]错误: %v", proxyID, err)
-						}
-					}(listenAddr, targetAddr, proxyID, forwardCfg.BufferSize, forwardCfg.Timeout)
-				}
+	// 所有规则处理完毕后再启动HTTP服务，避免与上面的初始化并发访问
+	if cfg.MetricsListen != "" {
+		go serveHTTP(ctx, cfg.MetricsListen, tracker, resolver, eventBus, newRuleAPI(rules, cfg.APITokens, auditLog), started)
+	} else if len(cfg.APITokens) > 0 {
+		log.Printf("配置了api_tokens但没有配置metrics_listen，规则API不可用")
+	}
 
-				log.Printf("已启动UDP端口组[%s]: %s:%v -> %s:%v, 共%d个端口对",
-					ruleName, forwardCfg.ListenIP, forwardCfg.ListenPorts, forwardCfg.TargetIP, forwardCfg.TargetPorts, len(listenPorts))
+	// 所有监听器绑定成功或失败后输出启动汇总，绑定重试期间最多等待最长的重试时长
+	var maxBindRetry time.Duration
+	for _, fc := range cfg.Forwards {
+		maxBindRetry = max(maxBindRetry, fc.BindRetry)
+	}
+	go func() {
+		if !tracker.WaitSettled(ctx, maxBindRetry+time.Second) && ctx.Err() != nil {
+			return
+		}
+		if len(tracker.Statuses()) > 0 {
+			log.Printf("启动汇总:\n%s", strings.TrimSuffix(tracker.Summary(), "\n"))
+		}
+	}()
 
-			default:
-				log.Printf("配置[%s]错误: 不支持的协议类型 '%s'", ruleName, protocol)
-			}
+	// 配置已变更、找不到对应代理的连接无法继续转发
+	for proxyID, conns := range adopted {
+		log.Printf("接管的连接没有对应的TCP代理[%s]，关闭%d个连接", proxyID, len(conns))
+		for _, c := range conns {
+			c.Close()
 		}
 	}
+	clear(adopted)
 
-	// 优雅退出
+	// 收到SIGHUP时重新加载配置；优雅退出，新进程发起交接时先交出连接；交接套接字在退出的最后关闭，新进程此后开始监听
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				reloadConfig(rules, auditLog)
+				continue
+			}
+			break wait
+		case conn := <-handoffServer.Requests():
+			defer conn.Close()
+			n, err := handoffs.Transfer(conn, handoff.DefaultTimeout)
+			if err != nil {
+				log.Printf("交接连接失败: %v", err)
+			}
+			log.Printf("新进程已启动，已交出%d个TCP连接", n)
+			break wait
+		}
+	}
+	handoffServer.Close()
 
 	log.Println("正在关闭服务...")
 	cancel()
 	wg.Wait()
+
+	if err := quotas.Save(); err != nil {
+		log.Printf("保存流量配额失败: %v", err)
+	}
+	stopFlows()
+	<-flowsDone
+
+	for _, r := range stats.All() {
+		log.Printf("规则[%s] %s统计: 累计连接%d, 上行%d字节, 下行%d字节",
+			r.Name, strings.ToUpper(r.Protocol), r.TotalConns.Load(), r.BytesUp.Load(), r.BytesDown.Load())
+	}
 	log.Println("服务已关闭")
 }
@@ -0,0 +1,160 @@
+// Package command 在连接事件发生时执行外部命令
+//
+// 命令通过系统shell执行，事件信息以环境变量传递：
+// NF_EVENT (connect/disconnect)、NF_RULE、NF_PROXY_ID、NF_CONN_ID、NF_PROTOCOL、NF_CLIENT、NF_CLIENT_IP、
+// NF_CLIENT_PORT、NF_LISTEN、NF_LISTEN_PORT、NF_TARGET、NF_SNI，disconnect事件另有NF_BYTES_UP、NF_BYTES_DOWN和NF_DURATION(秒)。
+//
+// connect事件在连接到目标后触发，之后连接结束时一定触发disconnect事件。所有规则合计最多同时执行16个命令，
+// 达到上限时丢弃新的connect事件并计数，避免大量连接造成进程洪泛；已执行connect命令的连接的disconnect事件
+// 等待空闲槽位而不丢弃，connect事件被丢弃的连接也不执行disconnect命令，两个命令总是成对执行。
+package command
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+)
+
+// 单个命令的最长执行时间，以及所有规则合计同时执行的命令数上限
+const (
+	commandTimeout = 30 * time.Second
+	maxRunning     = 16
+)
+
+// 正在执行的命令占用的槽位
+var running = make(chan struct{}, maxRunning)
+
+// Hooks 在连接建立和结束时异步执行命令的中间件
+type Hooks struct {
+	middleware.Base
+
+	rule         string
+	onConnect    string
+	onDisconnect string
+	dropped      atomic.Uint64 // 因达到并发上限而丢弃的事件数
+	unpaired     sync.Map      // connect事件被丢弃的连接(*middleware.Info)，结束时不执行disconnect命令
+}
+
+// New 创建命令钩子，两个命令均为空时返回nil
+func New(rule, onConnect, onDisconnect string) *Hooks {
+	if onConnect == "" && onDisconnect == "" {
+		return nil
+	}
+	return &Hooks{rule: rule, onConnect: onConnect, onDisconnect: onDisconnect}
+}
+
+// OnConnect 连接到目标后执行on_connect命令
+func (h *Hooks) OnConnect(info *middleware.Info) {
+	if h.onConnect == "" {
+		return
+	}
+	if !h.start("connect", h.onConnect, info, false, false) && h.onDisconnect != "" {
+		h.unpaired.Store(info, struct{}{})
+	}
+}
+
+// OnClose 连接结束时执行on_disconnect命令；配置了on_connect时等待空闲槽位，与connect命令成对执行
+func (h *Hooks) OnClose(info *middleware.Info) {
+	if h.onDisconnect == "" {
+		return
+	}
+	if _, skip := h.unpaired.LoadAndDelete(info); skip {
+		h.drop("disconnect")
+		return
+	}
+	h.start("disconnect", h.onDisconnect, info, true, h.onConnect != "")
+}
+
+// 在后台执行命令。wait为true时在后台等待空闲槽位；否则没有空闲槽位时丢弃事件并返回false
+func (h *Hooks) start(event, command string, info *middleware.Info, closing, wait bool) bool {
+	env := h.env(event, info, closing)
+	if wait {
+		go func() {
+			running <- struct{}{}
+			defer func() { <-running }()
+			h.run(event, command, env)
+		}()
+		return true
+	}
+	select {
+	case running <- struct{}{}:
+	default:
+		h.drop(event)
+		return false
+	}
+	go func() {
+		defer func() { <-running }()
+		h.run(event, command, env)
+	}()
+	return true
+}
+
+// 计数丢弃的事件，第一次和之后每100次记录一次日志
+func (h *Hooks) drop(event string) {
+	if n := h.dropped.Add(1); n%100 == 1 {
+		log.Printf("规则[%s] 同时执行的事件命令已达上限%d个，丢弃%s事件，累计丢弃%d个", h.rule, maxRunning, event, n)
+	}
+}
+
+func (h *Hooks) run(event, command string, env []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, command)
+	cmd.Env = append(os.Environ(), env...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("规则[%s] %s事件命令执行失败: %v: %s", h.rule, event, err, output)
+	}
+}
+
+// 事件信息对应的环境变量
+func (h *Hooks) env(event string, info *middleware.Info, closing bool) []string {
+	env := []string{
+		"NF_EVENT=" + event,
+		"NF_RULE=" + h.rule,
+		"NF_PROXY_ID=" + info.ProxyID,
+		"NF_CONN_ID=" + info.ConnID,
+		"NF_PROTOCOL=" + info.Protocol,
+		"NF_TARGET=" + info.TargetAddr,
+		"NF_SNI=" + info.SNI,
+	}
+	if info.ClientAddr != nil {
+		client := info.ClientAddr.String()
+		env = append(env, "NF_CLIENT="+client)
+		if host, port, err := net.SplitHostPort(client); err == nil {
+			env = append(env, "NF_CLIENT_IP="+host, "NF_CLIENT_PORT="+port)
+		}
+	}
+	if info.ListenAddr != nil {
+		listen := info.ListenAddr.String()
+		env = append(env, "NF_LISTEN="+listen)
+		if _, port, err := net.SplitHostPort(listen); err == nil {
+			env = append(env, "NF_LISTEN_PORT="+port)
+		}
+	}
+	if closing {
+		env = append(env,
+			"NF_BYTES_UP="+strconv.FormatInt(info.BytesUp, 10),
+			"NF_BYTES_DOWN="+strconv.FormatInt(info.BytesDown, 10),
+			"NF_DURATION="+strconv.FormatFloat(info.Duration.Seconds(), 'f', 3, 64),
+		)
+	}
+	return env
+}
+
+// 通过系统shell执行命令
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
@@ -0,0 +1,101 @@
+package command
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+)
+
+// 占满所有槽位，返回释放函数
+func fillSlots(t *testing.T) (release func()) {
+	t.Helper()
+	for range maxRunning {
+		select {
+		case running <- struct{}{}:
+		case <-time.After(5 * time.Second):
+			t.Fatal("之前的命令一直没有释放槽位")
+		}
+	}
+	return func() {
+		for range maxRunning {
+			<-running
+		}
+	}
+}
+
+// 等待命令向文件写入n行，返回文件内容
+func waitLines(t *testing.T, path string, n int) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		if strings.Count(string(data), "\n") >= n {
+			return string(data)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("文件中只有%q，应有%d行", data, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newLoggingHooks(t *testing.T) (*Hooks, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("测试使用/bin/sh")
+	}
+	path := filepath.Join(t.TempDir(), "events")
+	cmd := `echo "$NF_EVENT $NF_CONN_ID" >> ` + path
+	return New("test", cmd, cmd), path
+}
+
+// 已执行connect命令的连接在槽位占满时等待执行disconnect命令，不丢弃
+func TestDisconnectWaitsForSlot(t *testing.T) {
+	h, path := newLoggingHooks(t)
+	info := &middleware.Info{ConnID: "c1"}
+	h.OnConnect(info)
+	waitLines(t, path, 1)
+
+	release := fillSlots(t)
+	h.OnClose(info)
+	time.Sleep(50 * time.Millisecond)
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "disconnect") {
+		release()
+		t.Fatal("槽位占满时disconnect命令仍然执行")
+	}
+	release()
+
+	if got := waitLines(t, path, 2); got != "connect c1\ndisconnect c1\n" {
+		t.Errorf("事件命令输出%q", got)
+	}
+	if n := h.dropped.Load(); n != 0 {
+		t.Errorf("丢弃了%d个事件", n)
+	}
+}
+
+// connect事件因槽位占满被丢弃的连接，结束时也不执行disconnect命令
+func TestDroppedConnectSkipsDisconnect(t *testing.T) {
+	h, path := newLoggingHooks(t)
+	info := &middleware.Info{ConnID: "c2"}
+
+	release := fillSlots(t)
+	h.OnConnect(info)
+	release()
+	h.OnClose(info)
+
+	time.Sleep(100 * time.Millisecond)
+	if data, err := os.ReadFile(path); err == nil {
+		t.Errorf("connect事件被丢弃后仍执行了命令: %q", data)
+	}
+	if n := h.dropped.Load(); n != 2 {
+		t.Errorf("丢弃计数为%d，应为connect和disconnect两个", n)
+	}
+	if _, ok := h.unpaired.Load(info); ok {
+		t.Error("连接结束后仍记录着被丢弃的connect事件")
+	}
+}
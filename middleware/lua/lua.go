@@ -0,0 +1,227 @@
+// Package lua 以Lua脚本实现连接中间件，配置名为"lua"
+//
+// 脚本可定义以下全局函数(均为可选)：
+//
+//	on_accept(conn)  接受连接或创建UDP会话前调用，返回false(可附带原因字符串)拒绝，
+//	                 返回字符串则将其作为新的目标地址，其他返回值放行
+//	on_close(conn)   连接或会话结束时调用
+//
+// conn为包含以下字段的表: proxy_id, conn_id, protocol, client, client_ip, client_port, listen, listen_port,
+// target, sni，on_close中另有bytes_up, bytes_down和duration(秒)。
+//
+// 每次调用最长执行options.timeout(默认100ms)，UDP规则的on_accept在读取数据包的循环中执行，
+// 超时的on_accept拒绝连接，避免慢速或死循环的脚本阻塞整个规则。
+package lua
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+)
+
+func init() {
+	middleware.Register("lua", New)
+}
+
+// 未配置options.timeout时每次调用脚本函数的最长执行时间
+const defaultTimeout = 100 * time.Millisecond
+
+// Script 运行Lua脚本的中间件
+type Script struct {
+	middleware.Base
+
+	code    *lua.FunctionProto
+	pool    chan *lua.LState // LState不可并发使用，每次调用独占一个
+	timeout time.Duration
+}
+
+// New 根据配置项创建Lua中间件，options.path为脚本文件路径，options.timeout为每次调用的最长执行时间，例如 "200ms"
+func New(options map[string]interface{}) (middleware.Middleware, error) {
+	path, _ := options["path"].(string)
+	if path == "" {
+		return nil, errors.New("未指定Lua脚本路径(path)")
+	}
+	timeout := defaultTimeout
+	if v, ok := options["timeout"]; ok {
+		str, _ := v.(string)
+		d, err := time.ParseDuration(str)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("无效的Lua脚本超时时间(timeout): %v", v)
+		}
+		timeout = d
+	}
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取Lua脚本: %w", err)
+	}
+
+	chunk, err := parse.Parse(bytes.NewReader(source), path)
+	if err != nil {
+		return nil, fmt.Errorf("无法解析Lua脚本: %w", err)
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, fmt.Errorf("无法编译Lua脚本: %w", err)
+	}
+
+	s := &Script{
+		code:    proto,
+		pool:    make(chan *lua.LState, runtime.GOMAXPROCS(0)),
+		timeout: timeout,
+	}
+
+	// 预先执行一次以便尽早发现脚本错误
+	L, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	s.put(L)
+	return s, nil
+}
+
+func (s *Script) newState() (*lua.LState, error) {
+	L := lua.NewState()
+	L.Push(L.NewFunctionFromProto(s.code))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("执行Lua脚本失败: %w", err)
+	}
+	return L, nil
+}
+
+func (s *Script) get() (*lua.LState, error) {
+	select {
+	case L := <-s.pool:
+		return L, nil
+	default:
+		return s.newState()
+	}
+}
+
+func (s *Script) put(L *lua.LState) {
+	select {
+	case s.pool <- L:
+	default:
+		L.Close()
+	}
+}
+
+// 调用全局函数name，返回其结果；函数未定义时返回nil
+func (s *Script) call(name string, info *middleware.Info, closing bool) ([]lua.LValue, error) {
+	L, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+
+	fn := L.GetGlobal(name)
+	if fn.Type() != lua.LTFunction {
+		s.put(L)
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	top := L.GetTop()
+	L.Push(fn)
+	L.Push(connTable(L, info, closing))
+	if err := L.PCall(1, lua.MultRet, nil); err != nil {
+		// 出错或超时中断的状态可能不完整，不再复用
+		L.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("Lua函数%s执行超过%s", name, s.timeout)
+		}
+		return nil, fmt.Errorf("Lua函数%s执行失败: %w", name, err)
+	}
+	L.RemoveContext()
+	defer s.put(L)
+
+	results := make([]lua.LValue, 0, L.GetTop()-top)
+	for i := top + 1; i <= L.GetTop(); i++ {
+		results = append(results, L.Get(i))
+	}
+	L.SetTop(top)
+	return results, nil
+}
+
+// OnAccept 调用脚本的on_accept决定是否接受连接以及转发目标
+func (s *Script) OnAccept(info *middleware.Info) error {
+	results, err := s.call("on_accept", info, false)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return nil
+	}
+
+	switch v := results[0].(type) {
+	case lua.LBool:
+		if !v {
+			if len(results) > 1 && results[1].Type() == lua.LTString {
+				return fmt.Errorf("Lua脚本拒绝: %s", results[1].String())
+			}
+			return errors.New("Lua脚本拒绝")
+		}
+	case lua.LString:
+		info.TargetAddr = string(v)
+	}
+	return nil
+}
+
+// OnClose 调用脚本的on_close
+func (s *Script) OnClose(info *middleware.Info) {
+	if _, err := s.call("on_close", info, true); err != nil {
+		log.Printf("[%s] %v", logging.Tag(info.ProxyID, info.ConnID), err)
+	}
+}
+
+// 构造传给脚本的连接信息表
+func connTable(L *lua.LState, info *middleware.Info, closing bool) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("proxy_id", lua.LString(info.ProxyID))
+	t.RawSetString("conn_id", lua.LString(info.ConnID))
+	t.RawSetString("protocol", lua.LString(info.Protocol))
+	t.RawSetString("target", lua.LString(info.TargetAddr))
+	t.RawSetString("sni", lua.LString(info.SNI))
+
+	if info.ClientAddr != nil {
+		client := info.ClientAddr.String()
+		t.RawSetString("client", lua.LString(client))
+		if host, port, err := net.SplitHostPort(client); err == nil {
+			t.RawSetString("client_ip", lua.LString(host))
+			if n, err := strconv.Atoi(port); err == nil {
+				t.RawSetString("client_port", lua.LNumber(n))
+			}
+		}
+	}
+	if info.ListenAddr != nil {
+		listen := info.ListenAddr.String()
+		t.RawSetString("listen", lua.LString(listen))
+		if _, port, err := net.SplitHostPort(listen); err == nil {
+			if n, err := strconv.Atoi(port); err == nil {
+				t.RawSetString("listen_port", lua.LNumber(n))
+			}
+		}
+	}
+
+	if closing {
+		t.RawSetString("bytes_up", lua.LNumber(info.BytesUp))
+		t.RawSetString("bytes_down", lua.LNumber(info.BytesDown))
+		t.RawSetString("duration", lua.LNumber(info.Duration.Seconds()))
+	}
+	return t
+}
@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Side 表示被包装连接所在的一侧
+type Side int
+
+const (
+	SideClient Side = iota // 客户端连接
+	SideTarget             // 目标连接
+)
+
+// Info 描述一个TCP连接或UDP会话
+type Info struct {
+	ProxyID    string   // 代理ID，例如 "web-tcp-p1"
+	ConnID     string   // 连接或会话的唯一ID，与日志中的conn=一致
+	Protocol   string   // "tcp" 或 "udp"
+	ClientAddr net.Addr // 客户端地址
+	ListenAddr net.Addr // 客户端连接的监听地址，多个监听端口汇聚到同一目标时用于区分来源端口
+	TargetAddr string   // 目标地址，OnAccept和OnDial中可修改以改变转发目标
+	SNI        string   // 终止TLS时客户端请求的服务器名
+
+	// 以下字段仅在OnClose中有效
+	BytesUp   int64         // 客户端 -> 目标
+	BytesDown int64         // 目标 -> 客户端
+	Duration  time.Duration // 连接或会话的持续时间
+}
+
+// Middleware 连接中间件，代理在固定的位置调用这些方法：
+//   - OnAccept: 接受TCP连接或收到新UDP客户端的第一个数据包后，返回错误则拒绝
+//   - OnDial:   连接目标(或创建UDP会话套接字)之前，返回错误则放弃
+//   - WrapConn: TCP双向连接建立后分别包装客户端和目标连接，可用于记录或改写数据；UDP会话不调用
+//
+// 持有运行时等资源的中间件可另外实现io.Closer，规则停止且所有连接结束后调用
+type Middleware interface {
+	OnAccept(info *Info) error
+	OnDial(info *Info) error
+	WrapConn(info *Info, conn net.Conn, side Side) net.Conn
+}
+
+// ConnectHook 可选接口，中间件实现后会在TCP连接到目标并准备开始转发、或UDP会话创建后收到通知；
+// 此后连接结束时一定会调用CloseHook的OnClose
+type ConnectHook interface {
+	OnConnect(info *Info)
+}
+
+// CloseHook 可选接口，中间件实现后会在连接或会话结束时收到通知，仅对成功连接到目标的连接调用
+type CloseHook interface {
+	OnClose(info *Info)
+}
+
+// Base 提供所有方法的空实现，可嵌入自定义中间件中只重写需要的方法
+type Base struct{}
+
+func (Base) OnAccept(*Info) error                             { return nil }
+func (Base) OnDial(*Info) error                               { return nil }
+func (Base) WrapConn(_ *Info, conn net.Conn, _ Side) net.Conn { return conn }
+
+// Factory 根据配置项创建中间件实例
+type Factory func(options map[string]interface{}) (Middleware, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register 注册中间件，通常在自定义构建的init函数中调用，重复注册同名中间件会panic
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("中间件重复注册: %s", name))
+	}
+	factories[name] = factory
+}
+
+// Names 返回所有已注册的中间件名称
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New 按名称创建已注册的中间件
+func New(name string, options map[string]interface{}) (Middleware, error) {
+	mu.RLock()
+	factory, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("未知的中间件: %s", name)
+	}
+	m, err := factory(options)
+	if err != nil {
+		return nil, fmt.Errorf("创建中间件%s失败: %w", name, err)
+	}
+	return m, nil
+}
+
+// Chain 按顺序执行的中间件列表，空列表不做任何处理
+type Chain []Middleware
+
+// OnAccept 依次调用各中间件，遇到第一个错误即返回
+func (c Chain) OnAccept(info *Info) error {
+	for _, m := range c {
+		if err := m.OnAccept(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnDial 依次调用各中间件，遇到第一个错误即返回
+func (c Chain) OnDial(info *Info) error {
+	for _, m := range c {
+		if err := m.OnDial(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WrapConn 依次包装连接，后面的中间件包装在外层
+func (c Chain) WrapConn(info *Info, conn net.Conn, side Side) net.Conn {
+	for _, m := range c {
+		conn = m.WrapConn(info, conn, side)
+	}
+	return conn
+}
+
+// OnConnect 通知实现了ConnectHook的中间件
+func (c Chain) OnConnect(info *Info) {
+	for _, m := range c {
+		if hook, ok := m.(ConnectHook); ok {
+			hook.OnConnect(info)
+		}
+	}
+}
+
+// OnClose 通知实现了CloseHook的中间件
+func (c Chain) OnClose(info *Info) {
+	for _, m := range c {
+		if hook, ok := m.(CloseHook); ok {
+			hook.OnClose(info)
+		}
+	}
+}
+
+// Close 关闭实现了io.Closer的中间件
+func (c Chain) Close() error {
+	var errs []error
+	for _, m := range c {
+		if closer, ok := m.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,260 @@
+// Package wasm 以WebAssembly模块实现连接中间件，配置名为"wasm"
+//
+// 模块可导出以下函数(均为可选，未导出的阶段直接放行)：
+//
+//	alloc(size i32) -> i32                    分配size字节并返回指针，传递字符串和数据时必须导出
+//	free(ptr i32, size i32)                   释放alloc分配的内存
+//	on_accept(addr_ptr i32, addr_len i32) -> i32   客户端地址，返回非0拒绝连接
+//	on_dial(addr_ptr i32, addr_len i32) -> i32     目标地址，返回非0放弃连接
+//	on_data(side i32, ptr i32, len i32) -> i32     TCP数据，side为0(客户端发出)或1(目标发出)，返回非0关闭连接
+//
+// 模块以WASI reactor方式实例化，导出的_initialize会在实例化时调用。
+//
+// 每次调用最长执行options.timeout(默认100ms)，超时的实例被终止并丢弃，本次调用按拒绝处理。
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+)
+
+func init() {
+	middleware.Register("wasm", New)
+}
+
+// 未配置options.timeout时每次调用模块函数的最长执行时间
+const defaultTimeout = 100 * time.Millisecond
+
+// ErrDenied 模块拒绝了连接
+var ErrDenied = errors.New("WASM过滤器拒绝")
+
+// Filter 加载WebAssembly模块的中间件
+type Filter struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	pool     chan *instance // 模块实例不可并发调用，每个调用独占一个实例
+	timeout  time.Duration
+
+	// 模块导出了哪些过滤函数
+	hasAccept bool
+	hasDial   bool
+	hasData   bool
+}
+
+type instance struct {
+	mod      api.Module
+	alloc    api.Function
+	free     api.Function
+	onAccept api.Function
+	onDial   api.Function
+	onData   api.Function
+}
+
+// New 根据配置项创建WASM中间件，options.path为模块文件路径，options.timeout为每次调用的最长执行时间，例如 "200ms"
+func New(options map[string]interface{}) (middleware.Middleware, error) {
+	path, _ := options["path"].(string)
+	if path == "" {
+		return nil, errors.New("未指定WASM模块路径(path)")
+	}
+	timeout := defaultTimeout
+	if v, ok := options["timeout"]; ok {
+		str, _ := v.(string)
+		d, err := time.ParseDuration(str)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("无效的WASM调用超时时间(timeout): %v", v)
+		}
+		timeout = d
+	}
+
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取WASM模块: %w", err)
+	}
+
+	// 调用的ctx超时后终止正在执行的模块，死循环的函数不会一直占用goroutine
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+
+	compiled, err := rt.CompileModule(ctx, code)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, fmt.Errorf("无法编译WASM模块: %w", err)
+	}
+
+	f := &Filter{
+		runtime:  rt,
+		compiled: compiled,
+		pool:     make(chan *instance, runtime.GOMAXPROCS(0)),
+		timeout:  timeout,
+	}
+
+	// 预先实例化一次以便尽早发现导入缺失等错误
+	initCtx, cancel := context.WithTimeout(ctx, timeout)
+	inst, err := f.instantiate(initCtx)
+	cancel()
+	if err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	if (inst.onAccept != nil || inst.onDial != nil || inst.onData != nil) && inst.alloc == nil {
+		rt.Close(ctx)
+		return nil, errors.New("WASM模块未导出alloc函数")
+	}
+	f.hasAccept = inst.onAccept != nil
+	f.hasDial = inst.onDial != nil
+	f.hasData = inst.onData != nil
+	f.put(inst)
+
+	return f, nil
+}
+
+func (f *Filter) instantiate(ctx context.Context) (*instance, error) {
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize")
+	mod, err := f.runtime.InstantiateModule(ctx, f.compiled, config)
+	if err != nil {
+		return nil, fmt.Errorf("无法实例化WASM模块: %w", err)
+	}
+	return &instance{
+		mod:      mod,
+		alloc:    mod.ExportedFunction("alloc"),
+		free:     mod.ExportedFunction("free"),
+		onAccept: mod.ExportedFunction("on_accept"),
+		onDial:   mod.ExportedFunction("on_dial"),
+		onData:   mod.ExportedFunction("on_data"),
+	}, nil
+}
+
+// 取出一个空闲实例，没有时新建
+func (f *Filter) get(ctx context.Context) (*instance, error) {
+	select {
+	case inst := <-f.pool:
+		return inst, nil
+	default:
+		return f.instantiate(ctx)
+	}
+}
+
+// 归还实例，池已满时关闭
+func (f *Filter) put(inst *instance) {
+	select {
+	case f.pool <- inst:
+	default:
+		inst.mod.Close(context.Background())
+	}
+}
+
+// 将data写入模块内存后调用fn，prefix为附加在指针和长度之前的参数；实例化和调用合计不超过f.timeout
+func (f *Filter) call(fn func(*instance) api.Function, data []byte, prefix ...uint64) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	inst, err := f.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := inst.call(ctx, fn(inst), data, prefix)
+	if err != nil {
+		// 出错或超时被终止的实例状态未知，直接丢弃
+		inst.mod.Close(context.Background())
+		if ctx.Err() != nil {
+			return 0, fmt.Errorf("执行超过%s", f.timeout)
+		}
+		return 0, err
+	}
+	f.put(inst)
+	return result, nil
+}
+
+func (i *instance) call(ctx context.Context, fn api.Function, data []byte, prefix []uint64) (uint64, error) {
+	size := uint64(len(data))
+	res, err := i.alloc.Call(ctx, size)
+	if err != nil {
+		return 0, err
+	}
+	ptr := res[0]
+	if i.free != nil {
+		defer i.free.Call(ctx, ptr, size)
+	}
+
+	if !i.mod.Memory().Write(uint32(ptr), data) {
+		return 0, errors.New("WASM模块内存越界")
+	}
+
+	res, err = fn.Call(ctx, append(prefix, ptr, size)...)
+	if err != nil {
+		return 0, err
+	}
+	if len(res) == 0 {
+		return 0, nil
+	}
+	return res[0], nil
+}
+
+// Close 关闭运行时及其中的所有模块实例
+func (f *Filter) Close() error {
+	return f.runtime.Close(context.Background())
+}
+
+// OnAccept 将客户端地址交给模块的on_accept
+func (f *Filter) OnAccept(info *middleware.Info) error {
+	if !f.hasAccept {
+		return nil
+	}
+	return f.check(func(i *instance) api.Function { return i.onAccept }, []byte(info.ClientAddr.String()))
+}
+
+// OnDial 将目标地址交给模块的on_dial
+func (f *Filter) OnDial(info *middleware.Info) error {
+	if !f.hasDial {
+		return nil
+	}
+	return f.check(func(i *instance) api.Function { return i.onDial }, []byte(info.TargetAddr))
+}
+
+// 调用过滤函数，返回值非0时拒绝
+func (f *Filter) check(fn func(*instance) api.Function, data []byte, prefix ...uint64) error {
+	result, err := f.call(fn, data, prefix...)
+	if err != nil {
+		return fmt.Errorf("WASM过滤器执行失败: %w", err)
+	}
+	if result != 0 {
+		return ErrDenied
+	}
+	return nil
+}
+
+// WrapConn 模块导出on_data时检查从该连接读取的每块数据
+func (f *Filter) WrapConn(_ *middleware.Info, conn net.Conn, side middleware.Side) net.Conn {
+	if !f.hasData {
+		return conn
+	}
+	return &filteredConn{Conn: conn, filter: f, side: side}
+}
+
+type filteredConn struct {
+	net.Conn
+	filter *Filter
+	side   middleware.Side
+}
+
+func (c *filteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if checkErr := c.filter.check(func(i *instance) api.Function { return i.onData }, b[:n], uint64(c.side)); checkErr != nil {
+			return 0, checkErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,74 @@
+package wasm
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+)
+
+// 导出memory、alloc(总是返回0)和死循环的on_accept的最小模块
+var loopModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// 类型: (i32)->i32, (i32,i32)->i32
+	0x01, 0x0c, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f,
+	// 函数: alloc使用类型0，on_accept使用类型1
+	0x03, 0x03, 0x02, 0x00, 0x01,
+	// 1页内存
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// 导出
+	0x07, 0x1e, 0x03,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x05, 'a', 'l', 'l', 'o', 'c', 0x00, 0x00,
+	0x09, 'o', 'n', '_', 'a', 'c', 'c', 'e', 'p', 't', 0x00, 0x01,
+	// 代码: alloc返回0；on_accept为loop br 0 end unreachable
+	0x0a, 0x0f, 0x02,
+	0x04, 0x00, 0x41, 0x00, 0x0b,
+	0x08, 0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x00, 0x0b,
+}
+
+// 死循环的on_accept在超时后被终止并拒绝连接，之后的调用使用新的实例
+func TestFilterTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loop.wasm")
+	if err := os.WriteFile(path, loopModule, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(map[string]interface{}{"path": path, "timeout": "50ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := m.(*Filter)
+	info := &middleware.Info{ClientAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}
+
+	for i := range 2 {
+		done := make(chan error, 1)
+		go func() { done <- f.OnAccept(info) }()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatalf("第%d次调用: 超时的on_accept放行了连接", i+1)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("第%d次调用: 超时后on_accept没有被终止", i+1)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("关闭运行时失败: %v", err)
+	}
+}
+
+func TestNewRejectsInvalidTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loop.wasm")
+	if err := os.WriteFile(path, loopModule, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []interface{}{"0s", "-1s", "soon", 100} {
+		if m, err := New(map[string]interface{}{"path": path, "timeout": v}); err == nil {
+			m.(*Filter).Close()
+			t.Errorf("超时时间%v被接受", v)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+//go:build linux
+
+package netwatch
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 订阅netlink的网卡和地址变化事件，每收到一批事件调用一次notify，直到ctx取消
+func watchEvents(ctx context.Context, notify func()) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		return err
+	}
+	// 设置接收超时以便检查ctx是否已取消
+	timeout := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 16<<10)
+	for ctx.Err() == nil {
+		_, _, err := unix.Recvfrom(fd, buf, 0)
+		switch {
+		case err == nil, errors.Is(err, unix.ENOBUFS): // 事件过多时内核丢弃了部分事件，同样视为发生了变化
+			notify()
+		case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EINTR):
+		default:
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package netwatch
+
+import "context"
+
+func watchEvents(ctx context.Context, notify func()) error {
+	return errNoEvents
+}
@@ -0,0 +1,89 @@
+// Package netwatch 监视本机网卡和地址的变化，用于在配置的监听地址出现后重新绑定
+package netwatch
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 不支持事件通知的系统上轮询网卡地址的间隔
+const pollInterval = 5 * time.Second
+
+// 当前系统没有网卡变化事件，只能轮询
+var errNoEvents = errors.New("当前系统不支持网卡变化事件")
+
+// Watcher 在网卡启停或地址增删时通知等待者，第一次调用Changed时才开始监视
+type Watcher struct {
+	ctx  context.Context
+	once sync.Once
+
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+// New 创建在ctx取消前有效的Watcher
+func New(ctx context.Context) *Watcher {
+	return &Watcher{ctx: ctx, changed: make(chan struct{})}
+}
+
+// Changed 返回在下一次网卡或地址变化时关闭的通道，w为nil时返回nil
+func (w *Watcher) Changed() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	w.once.Do(func() {
+		go func() {
+			if err := watchEvents(w.ctx, w.notify); err != nil {
+				if err != errNoEvents {
+					log.Printf("无法订阅网卡变化事件，改为每%v检查一次: %v", pollInterval, err)
+				}
+				w.poll()
+			}
+		}()
+	})
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.changed
+}
+
+func (w *Watcher) notify() {
+	w.mu.Lock()
+	close(w.changed)
+	w.changed = make(chan struct{})
+	w.mu.Unlock()
+}
+
+// 定期比较网卡地址列表，有变化时通知
+func (w *Watcher) poll() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	last := interfaceAddrs()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if addrs := interfaceAddrs(); !slices.Equal(addrs, last) {
+			last = addrs
+			w.notify()
+		}
+	}
+}
+
+func interfaceAddrs() []string {
+	addrs, _ := net.InterfaceAddrs()
+	list := make([]string, len(addrs))
+	for i, addr := range addrs {
+		list[i] = addr.String()
+	}
+	slices.Sort(list)
+	return list
+}
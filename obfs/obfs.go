@@ -0,0 +1,148 @@
+package obfs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// 混淆方式
+const (
+	ModeXOR      = "xor"      // 与密钥和每包随机盐派生的32字节序列循环异或，增加4字节
+	ModeChaCha20 = "chacha20" // 每个数据包使用随机nonce的ChaCha20流加密，增加12字节
+)
+
+// xor方式每个数据包的随机盐长度
+const saltSize = 4
+
+// 节点角色
+const (
+	RoleClient = "client" // 混淆发往目标的数据包，还原目标返回的数据包
+	RoleServer = "server" // 还原客户端发来的数据包，混淆返回给客户端的数据包
+)
+
+// ErrShortPacket 数据包短于混淆头，无法还原
+var ErrShortPacket = errors.New("obfs: 数据包过短")
+
+// Obfuscator 使用预共享密钥混淆两个转发节点之间的UDP数据包，仅用于对抗简单的特征识别，不提供完整性校验
+type Obfuscator struct {
+	mode   string
+	server bool
+	key    [32]byte
+}
+
+// New 创建混淆器，mode为空时返回nil表示不混淆
+func New(role, mode, psk string) (*Obfuscator, error) {
+	if mode == "" {
+		return nil, nil
+	}
+	if mode != ModeXOR && mode != ModeChaCha20 {
+		return nil, fmt.Errorf("无效的混淆方式: %q，应为xor或chacha20", mode)
+	}
+	if role != RoleClient && role != RoleServer {
+		return nil, fmt.Errorf("无效的角色: %q，应为client或server", role)
+	}
+	if psk == "" {
+		return nil, errors.New("未配置预共享密钥")
+	}
+	return &Obfuscator{mode: mode, server: role == RoleServer, key: sha256.Sum256([]byte(psk))}, nil
+}
+
+// FromClient 还原客户端发来的数据包，仅server角色生效，可能原地修改p
+func (o *Obfuscator) FromClient(p []byte) ([]byte, error) {
+	if o == nil || !o.server {
+		return p, nil
+	}
+	return o.decode(p)
+}
+
+// ToTarget 混淆发往目标的数据包，仅client角色生效；结果写入dst并返回，见encode
+func (o *Obfuscator) ToTarget(dst, p []byte) ([]byte, error) {
+	if o == nil || o.server {
+		return p, nil
+	}
+	return o.encode(dst, p)
+}
+
+// FromTarget 还原目标返回的数据包，仅client角色生效，可能原地修改p
+func (o *Obfuscator) FromTarget(p []byte) ([]byte, error) {
+	if o == nil || o.server {
+		return p, nil
+	}
+	return o.decode(p)
+}
+
+// ToClient 混淆返回给客户端的数据包，仅server角色生效；结果写入dst并返回，见encode
+func (o *Obfuscator) ToClient(dst, p []byte) ([]byte, error) {
+	if o == nil || !o.server {
+		return p, nil
+	}
+	return o.encode(dst, p)
+}
+
+// Overhead 返回混淆给每个数据包增加的字节数，o为nil时为0
+func (o *Obfuscator) Overhead() int {
+	switch {
+	case o == nil:
+		return 0
+	case o.mode == ModeXOR:
+		return saltSize
+	}
+	return chacha20.NonceSize
+}
+
+// 混淆p并写入dst，dst的容量不小于len(p)+Overhead()时不分配内存，否则分配新的切片；dst不能与p重叠
+func (o *Obfuscator) encode(dst, p []byte) ([]byte, error) {
+	n := o.Overhead() + len(p)
+	out := dst[:0]
+	if cap(out) < n {
+		out = make([]byte, n)
+	}
+	out = out[:n]
+	if o.mode == ModeXOR {
+		if _, err := rand.Read(out[:saltSize]); err != nil {
+			return nil, fmt.Errorf("obfs: 生成随机盐失败: %w", err)
+		}
+		o.xor(out[saltSize:], p, out[:saltSize])
+		return out, nil
+	}
+	nonce := out[:chacha20.NonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("obfs: 生成随机nonce失败: %w", err)
+	}
+	c, _ := chacha20.NewUnauthenticatedCipher(o.key[:], nonce)
+	c.XORKeyStream(out[chacha20.NonceSize:], p)
+	return out, nil
+}
+
+func (o *Obfuscator) decode(p []byte) ([]byte, error) {
+	if o.mode == ModeXOR {
+		if len(p) < saltSize {
+			return nil, ErrShortPacket
+		}
+		data := p[saltSize:]
+		o.xor(data, data, p[:saltSize])
+		return data, nil
+	}
+	if len(p) < chacha20.NonceSize {
+		return nil, ErrShortPacket
+	}
+	c, _ := chacha20.NewUnauthenticatedCipher(o.key[:], p[:chacha20.NonceSize])
+	data := p[chacha20.NonceSize:]
+	c.XORKeyStream(data, data)
+	return data, nil
+}
+
+// 把src与密钥和盐派生的字节序列异或后写入dst，每个数据包的盐不同，序列也不同
+func (o *Obfuscator) xor(dst, src, salt []byte) {
+	var seed [len(o.key) + saltSize]byte
+	copy(seed[:], o.key[:])
+	copy(seed[len(o.key):], salt)
+	pad := sha256.Sum256(seed[:])
+	for i := range src {
+		dst[i] = src[i] ^ pad[i%len(pad)]
+	}
+}
@@ -0,0 +1,101 @@
+package obfs
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, mode := range []string{ModeXOR, ModeChaCha20} {
+		client, err := New(RoleClient, mode, "psk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := New(RoleServer, mode, "psk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range []int{0, 1, 31, 32, 33, 1400} {
+			p := bytes.Repeat([]byte{0x5a}, size)
+
+			up, err := client.ToTarget(make([]byte, 0, 2048), p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(up) != size+client.Overhead() {
+				t.Fatalf("%s: 混淆后长度 = %d, 期望 %d", mode, len(up), size+client.Overhead())
+			}
+			got, err := server.FromClient(up)
+			if err != nil || !bytes.Equal(got, p) {
+				t.Fatalf("%s: 还原客户端数据包 = %x, %v", mode, got, err)
+			}
+
+			down, err := server.ToClient(nil, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = client.FromTarget(down)
+			if err != nil || !bytes.Equal(got, p) {
+				t.Fatalf("%s: 还原目标数据包 = %x, %v", mode, got, err)
+			}
+		}
+	}
+}
+
+// 角色不对应的方向和nil混淆器原样返回数据包
+func TestPassThrough(t *testing.T) {
+	client, _ := New(RoleClient, ModeXOR, "psk")
+	server, _ := New(RoleServer, ModeXOR, "psk")
+	var none *Obfuscator
+	p := []byte("data")
+	for name, f := range map[string]func([]byte) ([]byte, error){
+		"client.FromClient": client.FromClient,
+		"client.ToClient":   func(p []byte) ([]byte, error) { return client.ToClient(nil, p) },
+		"server.ToTarget":   func(p []byte) ([]byte, error) { return server.ToTarget(nil, p) },
+		"server.FromTarget": server.FromTarget,
+		"nil.ToTarget":      func(p []byte) ([]byte, error) { return none.ToTarget(nil, p) },
+		"nil.FromClient":    none.FromClient,
+	} {
+		if got, err := f(p); err != nil || &got[0] != &p[0] {
+			t.Errorf("%s没有原样返回数据包: %q, %v", name, got, err)
+		}
+	}
+	if n := none.Overhead(); n != 0 {
+		t.Errorf("nil.Overhead() = %d", n)
+	}
+}
+
+func TestShortPacket(t *testing.T) {
+	for _, mode := range []string{ModeXOR, ModeChaCha20} {
+		server, _ := New(RoleServer, mode, "psk")
+		for n := 0; n < server.Overhead(); n++ {
+			if _, err := server.FromClient(make([]byte, n)); !errors.Is(err, ErrShortPacket) {
+				t.Errorf("%s: %d字节的数据包: %v, 期望 %v", mode, n, err, ErrShortPacket)
+			}
+		}
+	}
+}
+
+// dst容量足够时写入dst，xor方式不分配内存；容量不足时分配新的切片
+func TestEncodeIntoDst(t *testing.T) {
+	client, _ := New(RoleClient, ModeXOR, "psk")
+	p := make([]byte, 1400)
+	dst := make([]byte, 1500)
+
+	out, err := client.ToTarget(dst, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &out[0] != &dst[0] {
+		t.Error("容量足够时没有写入dst")
+	}
+	if allocs := testing.AllocsPerRun(100, func() { client.ToTarget(dst, p) }); allocs != 0 {
+		t.Errorf("每个数据包分配%.0f次内存", allocs)
+	}
+
+	small := make([]byte, 10)
+	if out, _ := client.ToTarget(small, p); &out[0] == &small[0] || len(out) != len(p)+saltSize {
+		t.Error("容量不足时没有分配新的切片")
+	}
+}
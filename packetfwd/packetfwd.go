@@ -0,0 +1,326 @@
+// Package packetfwd 在数据包层面转发TCP和UDP端口：从网卡读取发往监听端口的数据包，改写目的地址和端口后
+// 经原始套接字发往目标，目标看到的是客户端的真实地址；目标的回复改写源地址和端口后发回客户端，与LVS的NAT模式相同。
+// 适合后端依赖客户端地址、TCP选项或数据包边界等套接字转发会改变的语义的场景。
+//
+// 目标必须经本机路由回复客户端，例如把本机设为目标的网关。只支持IPv4，不转发IP分片；
+// 网卡GRO合并后超过MTU的TCP数据包按网卡的最小MTU重新分段。本机不能再以套接字访问目标的同一端口，
+// 这些回复同样会被截获。仅Linux 6.6以上支持，需要root权限或CAP_NET_RAW、CAP_NET_ADMIN和CAP_BPF。
+package packetfwd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+)
+
+// ErrPermission 没有打开数据包套接字或加载BPF程序的权限
+var ErrPermission = errors.New("数据包级转发需要root权限或CAP_NET_RAW、CAP_NET_ADMIN和CAP_BPF")
+
+// DefaultTimeout 未配置Timeout时的流空闲超时
+const DefaultTimeout = 10 * time.Minute
+
+// Options 数据包级转发的可选配置
+type Options struct {
+	Interfaces []string      // 读取数据包的网卡，客户端和目标方向的网卡都需要列出
+	TCP, UDP   bool          // 转发的传输层协议
+	Timeout    time.Duration // 流空闲超时，超时后目标的回复不再发回客户端，0为DefaultTimeout
+
+	Stats *stats.Rule  // 流量统计，发往目标计为上行
+	Quota *quota.Quota // 流量配额，用尽后丢弃客户端发来的数据包
+
+	Health *health.Tracker // 所有网卡开始读取后标记为就绪，退出时标记为未就绪
+}
+
+// Proxy 转发一条规则的所有端口
+type Proxy struct {
+	proxyID  string
+	listenIP string
+	targetIP string
+	ports    map[uint16]uint16 // 监听端口 -> 目标端口
+	opts     Options
+
+	listen  [4]byte // 全零表示所有本机地址
+	target  [4]byte
+	targets map[uint16]bool // 目标端口
+
+	mu    sync.Mutex
+	flows map[flowKey]*flowEntry
+}
+
+// 一个客户端到一个目标端口的流
+type flowKey struct {
+	proto      uint8
+	client     [4]byte
+	clientPort uint16
+	targetPort uint16
+}
+
+// 客户端原来的目的地址，目标的回复改写为从该地址发出
+type flowEntry struct {
+	listen     [4]byte
+	listenPort uint16
+	last       time.Time
+}
+
+// NewProxy 创建数据包级转发，listenPorts与targetPorts一一对应
+func NewProxy(proxyID, listenIP, targetIP string, listenPorts, targetPorts []int, opts Options) *Proxy {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	p := &Proxy{
+		proxyID:  proxyID,
+		listenIP: listenIP,
+		targetIP: targetIP,
+		ports:    make(map[uint16]uint16, len(listenPorts)),
+		opts:     opts,
+		targets:  make(map[uint16]bool, len(targetPorts)),
+		flows:    make(map[flowKey]*flowEntry),
+	}
+	for i, port := range listenPorts {
+		p.ports[uint16(port)] = uint16(targetPorts[i])
+		p.targets[uint16(targetPorts[i])] = true
+	}
+	return p
+}
+
+// 解析监听地址和目标地址，监听地址为空或0.0.0.0时匹配所有本机地址
+func (p *Proxy) resolve() error {
+	target, err := net.ResolveIPAddr("ip4", p.targetIP)
+	if err != nil {
+		return fmt.Errorf("无法解析目标地址: %w", err)
+	}
+	if target.IP.To4() == nil {
+		return fmt.Errorf("数据包级转发只支持IPv4目标: %s", p.targetIP)
+	}
+	p.target = [4]byte(target.IP.To4())
+	if p.listenIP == "" {
+		return nil
+	}
+	listen, err := net.ResolveIPAddr("ip4", p.listenIP)
+	if err != nil {
+		return fmt.Errorf("无法解析监听地址: %w", err)
+	}
+	if listen.IP.To4() == nil {
+		return fmt.Errorf("数据包级转发只支持IPv4监听地址: %s", p.listenIP)
+	}
+	p.listen = [4]byte(listen.IP.To4())
+	return nil
+}
+
+// 传输层协议号
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// 返回是否转发该传输层协议
+func (p *Proxy) enabled(proto uint8) bool {
+	return proto == protoTCP && p.opts.TCP || proto == protoUDP && p.opts.UDP
+}
+
+// forward 改写从网卡读到的IPv4数据包b的地址和端口，返回改写后的数据包和应发往的地址，校验和由调用者计算；
+// up表示客户端发往目标，ok为false时数据包与本规则无关或应丢弃
+func (p *Proxy) forward(b []byte, now time.Time) (pkt packet, dst [4]byte, up, ok bool) {
+	pkt, ok = parse(b)
+	if !ok || !p.enabled(pkt.proto) {
+		return pkt, dst, false, false
+	}
+	src, dstAddr := pkt.addr(12), pkt.addr(16)
+	srcPort, dstPort := pkt.port(0), pkt.port(2)
+
+	if targetPort, found := p.ports[dstPort]; found && (p.listen == [4]byte{} || dstAddr == p.listen) {
+		key := flowKey{proto: pkt.proto, client: src, clientPort: srcPort, targetPort: targetPort}
+		p.mu.Lock()
+		if e := p.flows[key]; e != nil && e.listen == dstAddr && e.listenPort == dstPort {
+			e.last = now
+		} else {
+			p.flows[key] = &flowEntry{listen: dstAddr, listenPort: dstPort, last: now}
+		}
+		p.mu.Unlock()
+		return pkt, p.target, true, pkt.rewrite(src, srcPort, p.target, targetPort)
+	}
+
+	if src == p.target && p.targets[srcPort] {
+		key := flowKey{proto: pkt.proto, client: dstAddr, clientPort: dstPort, targetPort: srcPort}
+		p.mu.Lock()
+		e := p.flows[key]
+		var listen [4]byte
+		var listenPort uint16
+		if e != nil {
+			e.last = now
+			listen, listenPort = e.listen, e.listenPort
+		}
+		p.mu.Unlock()
+		if e == nil {
+			return pkt, dst, false, false
+		}
+		return pkt, dstAddr, false, pkt.rewrite(listen, listenPort, dstAddr, dstPort)
+	}
+	return pkt, dst, false, false
+}
+
+// 删除空闲超过超时时间的流
+func (p *Proxy) expire(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, e := range p.flows {
+		if now.Sub(e.last) > p.opts.Timeout {
+			delete(p.flows, key)
+		}
+	}
+}
+
+// 一个未分片的IPv4 TCP或UDP数据包
+type packet struct {
+	b     []byte // IP头和传输层数据
+	ihl   int    // IP头长度
+	proto uint8
+}
+
+func parse(b []byte) (packet, bool) {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return packet{}, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:]))
+	if ihl < 20 || total < ihl || total > len(b) {
+		return packet{}, false
+	}
+	// MF标志或片偏移不为0
+	if binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+		return packet{}, false
+	}
+	pkt := packet{b: b[:total], ihl: ihl, proto: b[9]}
+	switch {
+	case pkt.proto == protoTCP && total >= ihl+20:
+	case pkt.proto == protoUDP && total >= ihl+8:
+	default:
+		return packet{}, false
+	}
+	return pkt, true
+}
+
+// IP头中off处的地址
+func (pkt packet) addr(off int) [4]byte {
+	return [4]byte(pkt.b[off : off+4])
+}
+
+// 传输层头中off处的端口
+func (pkt packet) port(off int) uint16 {
+	return binary.BigEndian.Uint16(pkt.b[pkt.ihl+off:])
+}
+
+// 改写地址和端口并把TTL减1，TTL耗尽时返回false
+func (pkt packet) rewrite(src [4]byte, srcPort uint16, dst [4]byte, dstPort uint16) bool {
+	b := pkt.b
+	if b[8] <= 1 {
+		return false
+	}
+	b[8]--
+	copy(b[12:16], src[:])
+	copy(b[16:20], dst[:])
+	binary.BigEndian.PutUint16(b[pkt.ihl:], srcPort)
+	binary.BigEndian.PutUint16(b[pkt.ihl+2:], dstPort)
+	return true
+}
+
+// 重新计算IP头和传输层的校验和；传输层校验和完整地重新计算，
+// 发送方使用了校验和卸载的数据包也能得到正确的校验和
+func (pkt packet) checksum() {
+	b := pkt.b
+	binary.BigEndian.PutUint16(b[10:], 0)
+	binary.BigEndian.PutUint16(b[10:], ^fold(sum(b[:pkt.ihl], 0)))
+
+	l4 := b[pkt.ihl:]
+	checkOff := 16
+	if pkt.proto == protoUDP {
+		checkOff = 6
+		if binary.BigEndian.Uint16(l4[checkOff:]) == 0 {
+			return // 未使用校验和
+		}
+	}
+	binary.BigEndian.PutUint16(l4[checkOff:], 0)
+	pseudo := sum(b[12:20], uint32(pkt.proto)+uint32(len(l4)))
+	check := ^fold(sum(l4, pseudo))
+	if check == 0 && pkt.proto == protoUDP {
+		check = 0xffff
+	}
+	binary.BigEndian.PutUint16(l4[checkOff:], check)
+}
+
+// TCP标志
+const (
+	tcpFIN = 0x01
+	tcpPSH = 0x08
+	tcpCWR = 0x80
+)
+
+// segment 把超过mtu的TCP数据包(网卡GRO合并或发送方TSO产生)切分为不超过mtu的分段，
+// 计算校验和后依次交给send；buf为分段使用的缓冲区，长度至少为mtu
+func (pkt packet) segment(mtu int, buf []byte, send func([]byte) error) error {
+	b := pkt.b
+	thl := int(b[pkt.ihl+12]>>4) * 4
+	hdr := pkt.ihl + thl
+	if thl < 20 || hdr > len(b) || hdr >= mtu {
+		return nil
+	}
+	payload := b[hdr:]
+	mss := mtu - hdr
+	seq := binary.BigEndian.Uint32(b[pkt.ihl+4:])
+	id := binary.BigEndian.Uint16(b[4:])
+	flags := b[pkt.ihl+13]
+
+	for off := 0; off < len(payload); off += mss {
+		chunk := payload[off:min(off+mss, len(payload))]
+		seg := buf[:hdr+len(chunk)]
+		copy(seg, b[:hdr])
+		copy(seg[hdr:], chunk)
+
+		binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)))
+		binary.BigEndian.PutUint16(seg[4:], id)
+		id++
+		binary.BigEndian.PutUint32(seg[pkt.ihl+4:], seq+uint32(off))
+		// FIN和PSH只保留在最后一个分段，CWR只保留在第一个分段
+		f := flags
+		if off+len(chunk) < len(payload) {
+			f &^= tcpFIN | tcpPSH
+		}
+		if off > 0 {
+			f &^= tcpCWR
+		}
+		seg[pkt.ihl+13] = f
+
+		segPkt := packet{b: seg, ihl: pkt.ihl, proto: pkt.proto}
+		segPkt.checksum()
+		if err := send(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按16位大端累加b
+func sum(b []byte, acc uint32) uint32 {
+	for len(b) >= 2 {
+		acc += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		acc += uint32(b[0]) << 8
+	}
+	return acc
+}
+
+func fold(acc uint32) uint16 {
+	for acc > 0xffff {
+		acc = acc>>16 + acc&0xffff
+	}
+	return uint16(acc)
+}
@@ -0,0 +1,354 @@
+//go:build linux
+
+package packetfwd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+
+	"github.com/Mxmilu666/nia-forwarding/ebpf"
+)
+
+// Start 在每个网卡上读取数据包并转发，直到上下文取消
+func (p *Proxy) Start(ctx context.Context) error {
+	if err := p.resolve(); err != nil {
+		return err
+	}
+
+	// 以IP_HDRINCL发送改写后的数据包，源地址可以不是本机地址，由内核选择路由和下一跳
+	raw, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_RAW)
+	if errors.Is(err, unix.EPERM) {
+		return ErrPermission
+	}
+	if err != nil {
+		return fmt.Errorf("无法打开原始套接字: %w", err)
+	}
+	defer unix.Close(raw)
+
+	// 内核协议栈仍会收到这些数据包，需要在tc入口丢弃，否则会以RST或ICMP端口不可达回应客户端
+	drop, err := p.loadDropProgram()
+	if err != nil {
+		return err
+	}
+	defer drop.close()
+
+	var files []*os.File
+	mtu := 65535
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range p.opts.Interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return err
+		}
+		link, err := ebpf.CreateLink(drop.prog, iface.Index, unix.BPF_TCX_INGRESS, 0)
+		if err != nil {
+			return fmt.Errorf("无法把tc程序挂到网卡%s: %w", name, err)
+		}
+		drop.links = append(drop.links, link)
+		mtu = min(mtu, iface.MTU)
+
+		f, err := openPacketSocket(iface.Index)
+		if errors.Is(err, unix.EPERM) {
+			return ErrPermission
+		}
+		if err != nil {
+			return fmt.Errorf("无法在网卡%s上打开数据包套接字: %w", name, err)
+		}
+		files = append(files, f)
+	}
+
+	log.Printf("[%s] 数据包级转发已启动: %s -> %s, 网卡%v", p.proxyID, p.listenIP, p.targetIP, p.opts.Interfaces)
+	p.opts.Health.SetReady(p.proxyID, true)
+	defer p.opts.Health.SetReady(p.proxyID, false)
+
+	var wg sync.WaitGroup
+	for _, f := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.serve(ctx, f, raw, mtu)
+		}()
+	}
+
+	ticker := time.NewTicker(min(p.opts.Timeout/2, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			for _, f := range files {
+				f.Close()
+			}
+			files = nil
+			wg.Wait()
+			return nil
+		case now := <-ticker.C:
+			p.expire(now)
+		}
+	}
+}
+
+// 从数据包套接字读取并转发，直到套接字关闭；超过mtu的TCP数据包重新分段
+func (p *Proxy) serve(ctx context.Context, f *os.File, raw, mtu int) {
+	buf := make([]byte, 65535)
+	segBuf := make([]byte, mtu)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, os.ErrClosed) {
+				log.Printf("[%s] 数据包套接字读取错误: %v", p.proxyID, err)
+			}
+			return
+		}
+
+		pkt, dst, up, ok := p.forward(buf[:n], time.Now())
+		if !ok {
+			continue
+		}
+		if up {
+			if exceeded, first := p.opts.Quota.Exceeded(); exceeded {
+				if first {
+					log.Printf("[%s] 流量配额已用尽，本周期内丢弃所有数据包", p.proxyID)
+				}
+				p.opts.Stats.AddDropped()
+				continue
+			}
+		}
+
+		to := &unix.SockaddrInet4{Addr: dst}
+		send := func(b []byte) error { return unix.Sendto(raw, b, 0, to) }
+		if len(pkt.b) > mtu && pkt.proto == protoTCP {
+			err = pkt.segment(mtu, segBuf, send)
+		} else {
+			pkt.checksum()
+			err = send(pkt.b)
+		}
+		if err != nil {
+			if errors.Is(err, unix.EMSGSIZE) {
+				p.opts.Stats.AddDropped()
+				continue
+			}
+			log.Printf("[%s] 发送到 %s 失败: %v", p.proxyID, net.IP(dst[:]), err)
+			p.opts.Stats.AddError()
+			continue
+		}
+		if up {
+			p.opts.Stats.AddUp(int64(len(pkt.b)))
+		} else {
+			p.opts.Stats.AddDown(int64(len(pkt.b)))
+		}
+		p.opts.Quota.Add(int64(len(pkt.b)))
+	}
+}
+
+// 打开绑定到网卡的数据包套接字，只接收进入网卡的IPv4 TCP和UDP数据包，读取到的数据从IP头开始
+func openPacketSocket(ifindex int) (*os.File, error) {
+	filter, err := bpf.Assemble([]bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtType},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.PACKET_OUTGOING, SkipTrue: 5},
+		bpf.LoadExtension{Num: bpf.ExtProto},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.ETH_P_IP, SkipTrue: 3},
+		bpf.LoadAbsolute{Off: 9, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: protoTCP, SkipTrue: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: protoUDP, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 65535},
+	})
+	if err != nil {
+		return nil, err
+	}
+	sockFilter := make([]unix.SockFilter, len(filter))
+	for i, ins := range filter {
+		sockFilter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+
+	// ETH_P_ALL的套接字在tc入口之前收到数据包，tc程序丢弃后仍能读到
+	proto := int(htons(unix.ETH_P_ALL))
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(sockFilter)),
+		Filter: &sockFilter[0],
+	})
+	if err == nil {
+		err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: uint16(proto), Ifindex: ifindex})
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "packet"), nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// 丢弃表的键，地址和端口为网络字节序
+//
+//	addr(4) port(2) proto(1) dir(1)
+//
+// dir为0时匹配目的地址和端口(客户端发往监听端口，地址全零匹配所有本机地址)，
+// 为1时匹配源地址和端口(目标的回复)
+const dropKeySize = 8
+
+func dropKey(addr [4]byte, port uint16, proto, dir uint8) []byte {
+	key := append(addr[:0:0], addr[:]...)
+	key = binary.BigEndian.AppendUint16(key, port)
+	return append(key, proto, dir)
+}
+
+// tc入口程序及其挂载
+type dropProgram struct {
+	table int
+	prog  int
+	links []int
+}
+
+func (d *dropProgram) close() {
+	for _, link := range d.links {
+		unix.Close(link)
+	}
+	unix.Close(d.prog)
+	unix.Close(d.table)
+}
+
+// 加载在tc入口丢弃本规则转发的数据包的程序
+func (p *Proxy) loadDropProgram() (*dropProgram, error) {
+	var keys [][]byte
+	for _, proto := range []uint8{protoTCP, protoUDP} {
+		if !p.enabled(proto) {
+			continue
+		}
+		for listenPort, targetPort := range p.ports {
+			keys = append(keys, dropKey(p.listen, listenPort, proto, 0), dropKey(p.target, targetPort, proto, 1))
+		}
+	}
+
+	table, err := ebpf.CreateMap(unix.BPF_MAP_TYPE_HASH, dropKeySize, 1, uint32(max(len(keys), 1)))
+	if errors.Is(err, unix.EPERM) {
+		return nil, ErrPermission
+	}
+	if err != nil {
+		return nil, fmt.Errorf("无法创建BPF表: %w", err)
+	}
+	d := &dropProgram{table: table, prog: -1}
+	for _, key := range keys {
+		if err := ebpf.UpdateElem(table, key, []byte{1}); err != nil {
+			d.close()
+			return nil, fmt.Errorf("无法写入BPF表: %w", err)
+		}
+	}
+	insns, err := dropProgramInsns(table)
+	if err == nil {
+		d.prog, err = ebpf.LoadProgram(unix.BPF_PROG_TYPE_SCHED_CLS, insns)
+	}
+	if err != nil {
+		d.close()
+		return nil, fmt.Errorf("无法加载tc程序: %w", err)
+	}
+	return d, nil
+}
+
+// tcx程序的返回值
+const (
+	tcxNext = -1
+	tcxDrop = 2
+)
+
+// 返回tc入口程序：IPv4 TCP或UDP数据包的目的地址和端口或源地址和端口在丢弃表中时丢弃
+func dropProgramInsns(table int) ([]ebpf.Insn, error) {
+	var a ebpf.Asm
+	R0, R1, R2, R6, R7, R8, R9, R10 := ebpf.R0, ebpf.R1, ebpf.R2, ebpf.R6, ebpf.R7, ebpf.R8, ebpf.R9, ebpf.R10
+	const key = -8 // 栈上的键
+
+	// r7 = data, r8 = data_end (__sk_buff的data和data_end字段)，数据从以太网头开始
+	a.Emit(
+		ebpf.MovReg(R6, R1),
+		ebpf.Load(unix.BPF_W, R7, R6, 76),
+		ebpf.Load(unix.BPF_W, R8, R6, 80),
+		ebpf.MovReg(R1, R7),
+		ebpf.ALU(unix.BPF_ADD, R1, 14+20),
+	)
+	a.JumpReg(unix.BPF_JGT, R1, R8, "next")
+	a.Emit(ebpf.Load(unix.BPF_H, R1, R7, 12))
+	a.Jump(unix.BPF_JNE, R1, 0x0008, "next")
+	a.Emit(
+		ebpf.Load(unix.BPF_B, R1, R7, 14),
+		ebpf.MovReg(R2, R1),
+		ebpf.ALU(unix.BPF_AND, R2, 0xf0),
+	)
+	a.Jump(unix.BPF_JNE, R2, 0x40, "next")
+	a.Emit(
+		ebpf.Load(unix.BPF_H, R2, R7, 14+6),
+		ebpf.ALU(unix.BPF_AND, R2, 0xff1f), // 片偏移，后续分片没有端口
+	)
+	a.Jump(unix.BPF_JNE, R2, 0, "next")
+	a.Emit(ebpf.Load(unix.BPF_B, R2, R7, 14+9))
+	a.Jump(unix.BPF_JEQ, R2, protoTCP, "l4")
+	a.Jump(unix.BPF_JNE, R2, protoUDP, "next")
+
+	// r9 = 传输层头
+	a.Label("l4")
+	a.Emit(
+		ebpf.Store(unix.BPF_B, R10, key+6, R2),
+		ebpf.ALU(unix.BPF_AND, R1, 0x0f),
+		ebpf.ALU(unix.BPF_LSH, R1, 2),
+	)
+	a.Jump(unix.BPF_JLT, R1, 20, "next")
+	a.Emit(
+		ebpf.MovReg(R9, R7),
+		ebpf.ALUReg(unix.BPF_ADD, R9, R1),
+		ebpf.ALU(unix.BPF_ADD, R9, 14),
+		ebpf.MovReg(R1, R9),
+		ebpf.ALU(unix.BPF_ADD, R1, 4),
+	)
+	a.JumpReg(unix.BPF_JGT, R1, R8, "next")
+
+	lookup := func(addrOff int16, zero bool, portOff int16, dir int32) {
+		if zero {
+			a.Emit(ebpf.StoreImm(unix.BPF_W, R10, key, 0))
+		} else {
+			a.Emit(
+				ebpf.Load(unix.BPF_W, R1, R7, 14+addrOff),
+				ebpf.Store(unix.BPF_W, R10, key, R1),
+			)
+		}
+		a.Emit(
+			ebpf.Load(unix.BPF_H, R1, R9, portOff),
+			ebpf.Store(unix.BPF_H, R10, key+4, R1),
+			ebpf.StoreImm(unix.BPF_B, R10, key+7, dir),
+		)
+		a.Emit(ebpf.LoadMap(R1, table)...)
+		a.Emit(
+			ebpf.MovReg(R2, R10),
+			ebpf.ALU(unix.BPF_ADD, R2, key),
+			ebpf.Call(ebpf.FuncMapLookupElem),
+		)
+		a.Jump(unix.BPF_JNE, R0, 0, "drop")
+	}
+	lookup(16, false, 2, 0) // 发往监听地址
+	lookup(0, true, 2, 0)   // 发往任意本机地址
+	lookup(12, false, 0, 1) // 来自目标
+
+	a.Label("next")
+	a.Emit(ebpf.Mov(R0, tcxNext), ebpf.Exit())
+	a.Label("drop")
+	a.Emit(ebpf.Mov(R0, tcxDrop), ebpf.Exit())
+	return a.Program()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package packetfwd
+
+import (
+	"context"
+	"errors"
+)
+
+// Start 在该平台上返回错误
+func (p *Proxy) Start(ctx context.Context) error {
+	return errors.New("仅Linux支持数据包级转发")
+}
@@ -0,0 +1,79 @@
+// Package proxyproto 生成HAProxy PROXY协议头，向目标传递客户端地址和被连接的监听地址
+package proxyproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// v2协议头的固定签名
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ParseVersion 解析配置中的版本，"v1"/"1"或"v2"/"2"，空字符串返回0表示不发送
+func ParseVersion(s string) (int, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "v1", "1":
+		return 1, nil
+	case "v2", "2":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("无效的PROXY协议版本: %q，应为v1或v2", s)
+}
+
+// Header 生成PROXY协议头，src为客户端地址，dst为客户端连接的监听地址
+func Header(version int, src, dst net.Addr) ([]byte, error) {
+	srcTCP, ok1 := src.(*net.TCPAddr)
+	dstTCP, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("PROXY协议仅支持TCP地址")
+	}
+
+	// 两端地址族不同时统一使用IPv6表示
+	srcIP, dstIP := srcTCP.IP.To4(), dstTCP.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+	}
+	v4 := len(srcIP) == net.IPv4len
+
+	switch version {
+	case 1:
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcTCP.Port, dstTCP.Port)), nil
+	case 2:
+		h := append([]byte(nil), v2Signature...)
+		h = append(h, 0x21) // 版本2, PROXY命令
+		if v4 {
+			h = append(h, 0x11) // AF_INET, STREAM
+			h = binary.BigEndian.AppendUint16(h, 12)
+		} else {
+			h = append(h, 0x21) // AF_INET6, STREAM
+			h = binary.BigEndian.AppendUint16(h, 36)
+		}
+		h = append(h, srcIP...)
+		h = append(h, dstIP...)
+		h = binary.BigEndian.AppendUint16(h, uint16(srcTCP.Port))
+		h = binary.BigEndian.AppendUint16(h, uint16(dstTCP.Port))
+		return h, nil
+	}
+	return nil, fmt.Errorf("无效的PROXY协议版本: %d", version)
+}
+
+// WriteHeader 向w写入PROXY协议头，version为0时不写入
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	if version == 0 {
+		return nil
+	}
+	h, err := Header(version, src, dst)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(h)
+	return err
+}
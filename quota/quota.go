@@ -0,0 +1,101 @@
+package quota
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Quota 单条规则在一个计费周期内的流量配额，所有协议共享
+type Quota struct {
+	limit    uint64
+	resetDay int
+
+	mu          sync.Mutex
+	periodStart time.Time
+	used        atomic.Uint64
+	exhausted   atomic.Bool // 本周期内是否已记录过超额
+}
+
+// New 创建流量配额，limit<=0时返回nil表示不限制；resetDay为每月重置的日期(1-28)
+func New(limit int64, resetDay int) *Quota {
+	if limit <= 0 {
+		return nil
+	}
+	if resetDay < 1 || resetDay > 28 {
+		resetDay = 1
+	}
+	return &Quota{
+		limit:       uint64(limit),
+		resetDay:    resetDay,
+		periodStart: periodStart(time.Now(), resetDay),
+	}
+}
+
+// Add 累加已使用的字节数
+func (q *Quota) Add(n int64) {
+	if q == nil || n <= 0 {
+		return
+	}
+	q.rollover()
+	q.used.Add(uint64(n))
+}
+
+// Exceeded 返回本周期的流量是否已用尽；第一次发现用尽时second返回true，便于只记录一次日志
+func (q *Quota) Exceeded() (exceeded, first bool) {
+	if q == nil {
+		return false, false
+	}
+	q.rollover()
+	if q.used.Load() < q.limit {
+		return false, false
+	}
+	return true, q.exhausted.CompareAndSwap(false, true)
+}
+
+// Used 返回本周期已使用的字节数和配额上限
+func (q *Quota) Used() (used, limit uint64) {
+	if q == nil {
+		return 0, 0
+	}
+	q.rollover()
+	return q.used.Load(), q.limit
+}
+
+// 进入新周期时清零计数
+func (q *Quota) rollover() {
+	start := periodStart(time.Now(), q.resetDay)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if start.After(q.periodStart) {
+		q.periodStart = start
+		q.used.Store(0)
+		q.exhausted.Store(false)
+	}
+}
+
+// 恢复持久化的用量，仅当记录属于当前周期时生效
+func (q *Quota) restore(start time.Time, used uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if start.Equal(q.periodStart) {
+		q.used.Store(used)
+	}
+}
+
+func (q *Quota) snapshot() (time.Time, uint64) {
+	q.rollover()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.periodStart, q.used.Load()
+}
+
+// 返回t所在计费周期的起始时间，即不晚于t的最近一个resetDay零点(本地时间)
+func periodStart(t time.Time, resetDay int) time.Time {
+	start := time.Date(t.Year(), t.Month(), resetDay, 0, 0, 0, 0, t.Location())
+	if start.After(t) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
@@ -0,0 +1,165 @@
+package quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeriodStart(t *testing.T) {
+	day := func(month time.Month, d, hour int) time.Time {
+		return time.Date(2026, month, d, hour, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		now      time.Time
+		resetDay int
+		want     time.Time
+	}{
+		{day(3, 15, 12), 1, day(3, 1, 0)},
+		{day(3, 1, 0), 1, day(3, 1, 0)},
+		{day(3, 9, 23), 10, day(2, 10, 0)},
+		{day(3, 10, 0), 10, day(3, 10, 0)},
+		{day(1, 5, 8), 28, time.Date(2025, 12, 28, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := periodStart(tt.now, tt.resetDay); !got.Equal(tt.want) {
+			t.Errorf("periodStart(%s, %d) = %s, 期望 %s", tt.now.Format(time.DateTime), tt.resetDay, got.Format(time.DateOnly), tt.want.Format(time.DateOnly))
+		}
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	if q := New(0, 1); q != nil {
+		t.Fatal("配额为0时应不限制")
+	}
+	var none *Quota
+	none.Add(100)
+	if exceeded, _ := none.Exceeded(); exceeded {
+		t.Error("不限制的配额报告已用尽")
+	}
+
+	q := New(1000, 1)
+	q.Add(999)
+	if exceeded, _ := q.Exceeded(); exceeded {
+		t.Fatal("用量未达到上限时报告已用尽")
+	}
+	q.Add(1)
+	if exceeded, first := q.Exceeded(); !exceeded || !first {
+		t.Fatalf("用量达到上限: exceeded=%v first=%v", exceeded, first)
+	}
+	// 只有第一次发现用尽时first为true，日志只记录一次
+	if exceeded, first := q.Exceeded(); !exceeded || first {
+		t.Errorf("再次检查: exceeded=%v first=%v", exceeded, first)
+	}
+	if used, limit := q.Used(); used != 1000 || limit != 1000 {
+		t.Errorf("Used() = %d/%d", used, limit)
+	}
+}
+
+// 保存的用量在重启后恢复，上一周期的记录不恢复
+func TestStoreRestoresCurrentPeriod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Get("web", 1<<30, 1).Add(12345)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := s.Get("web", 1<<30, 1).Used(); used != 12345 {
+		t.Errorf("重启后的用量 = %d, 期望 12345", used)
+	}
+	// 重置日期改变后周期起点不同，旧记录不再适用
+	if periodStart(time.Now(), 1).Equal(periodStart(time.Now(), 15)) {
+		t.Skip("今天两个重置日期的周期起点相同")
+	}
+	if used, _ := s.Get("web", 1<<30, 15).Used(); used != 0 {
+		t.Errorf("其他周期的用量被恢复: %d", used)
+	}
+}
+
+// 启动后还没有被规则认领的记录在保存时保留，不会被当前规则的用量覆盖掉
+func TestStoreKeepsUnclaimedRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Get("web", 1<<30, 1).Add(100)
+	s.Get("ssh", 1<<30, 1).Add(200)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后ssh规则暂时没有加载
+	s, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Get("web", 1<<30, 1).Add(1)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := s.Get("ssh", 1<<30, 1).Used(); used != 200 {
+		t.Errorf("未认领规则的用量 = %d, 期望 200", used)
+	}
+	if used, _ := s.Get("web", 1<<30, 1).Used(); used != 101 {
+		t.Errorf("已认领规则的用量 = %d, 期望 101", used)
+	}
+}
+
+func TestStoreCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStore(path); err == nil {
+		t.Error("损坏的配额文件没有报错")
+	}
+
+	// 未配置路径时不读写文件
+	s, err := NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Get("web", 100, 1).Add(10)
+	if err := s.Save(); err != nil {
+		t.Error(err)
+	}
+}
+
+// 重新加载配置时上限不变的规则沿用原配额，上限改变时新配额延续已用量
+func TestStoreGetOnReload(t *testing.T) {
+	s, err := NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := s.Get("web", 1000, 1)
+	q.Add(300)
+	if s.Get("web", 1000, 1) != q {
+		t.Error("上限和重置日期不变时没有沿用原配额")
+	}
+
+	raised := s.Get("web", 2000, 1)
+	if used, limit := raised.Used(); used != 300 || limit != 2000 {
+		t.Errorf("提高上限后 Used() = %d/%d, 期望 300/2000", used, limit)
+	}
+	if s.Get("web", 0, 1) != nil {
+		t.Fatal("取消配额后仍返回配额")
+	}
+	if used, _ := s.Get("web", 2000, 1).Used(); used != 300 {
+		t.Errorf("重新启用配额后的用量 = %d, 期望 300", used)
+	}
+}
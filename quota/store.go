@@ -0,0 +1,129 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// 默认的用量保存间隔
+const DefaultSaveInterval = time.Minute
+
+// Store 管理所有规则的配额，并将用量持久化到文件，使计数在重启后延续
+type Store struct {
+	path   string
+	mu     sync.Mutex
+	quotas map[string]*Quota
+	saved  map[string]record // 从文件加载、尚未被规则认领的记录
+}
+
+// 持久化文件中的单条记录
+type record struct {
+	PeriodStart time.Time `json:"period_start"`
+	Used        uint64    `json:"used"`
+}
+
+// NewStore 从path加载已保存的用量，path为空时不持久化
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:   path,
+		quotas: make(map[string]*Quota),
+		saved:  make(map[string]record),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("无法读取流量配额文件: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.saved); err != nil {
+		return nil, fmt.Errorf("无法解析流量配额文件: %w", err)
+	}
+	return s, nil
+}
+
+// Get 为规则创建配额并恢复已保存的用量，limit<=0时返回nil；
+// 重新加载配置时规则已有相同上限和重置日期的配额则直接返回，否则新配额延续原配额的用量
+func (s *Store) Get(name string, limit int64, resetDay int) *Quota {
+	q := New(limit, resetDay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if live, ok := s.quotas[name]; ok {
+		if q != nil && live.limit == q.limit && live.resetDay == q.resetDay {
+			return live
+		}
+		start, used := live.snapshot()
+		s.saved[name] = record{PeriodStart: start, Used: used}
+		delete(s.quotas, name)
+	}
+	if q == nil {
+		return nil
+	}
+	if rec, ok := s.saved[name]; ok {
+		q.restore(rec.PeriodStart, rec.Used)
+	}
+	s.quotas[name] = q
+	return q
+}
+
+// Save 将所有配额的当前用量写入文件，尚未被规则认领的记录原样保留，
+// 暂时停用或加载失败的规则重新启用后仍能延续用量
+func (s *Store) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	records := make(map[string]record, len(s.saved)+len(s.quotas))
+	for name, rec := range s.saved {
+		records[name] = rec
+	}
+	for name, q := range s.quotas {
+		start, used := q.snapshot()
+		records[name] = record{PeriodStart: start, Used: used}
+	}
+	s.mu.Unlock()
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// 先写临时文件再重命名，避免写入中途退出导致文件损坏
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Run 定期保存用量，直到上下文取消；退出前的最终保存由调用方在连接全部结束后进行
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultSaveInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.Printf("保存流量配额失败: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 录制文件格式：
+//
+//	头部: "NFRC" | 版本(1字节) | 协议名长度(1字节) | 协议名 | 开始时间(int64纳秒)
+//	每块数据: 相对开始时间的偏移(int64纳秒) | 长度(uint32) | 数据
+//
+// TCP按每次读取到的数据块记录，UDP每个数据包一块。
+const (
+	magic   = "NFRC"
+	version = 1
+)
+
+// FileExt 录制文件的扩展名
+const FileExt = ".nfr"
+
+// Recorder 将连接的入站数据录制到目录中，每个连接或会话一个文件
+type Recorder struct {
+	dir      string
+	maxBytes int64
+}
+
+// NewRecorder 创建录制器，dir为空时返回nil表示不录制；maxBytes>0时单个文件超过该大小后停止录制
+func NewRecorder(dir string, maxBytes int64) (*Recorder, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("无法创建录制目录: %w", err)
+	}
+	return &Recorder{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// Open 为一个连接创建录制文件，r为nil或创建失败时返回nil
+func (r *Recorder) Open(proxyID, protocol string, client net.Addr) *File {
+	if r == nil {
+		return nil
+	}
+
+	start := time.Now()
+	name := fmt.Sprintf("%s-%s-%s%s", proxyID, start.Format("20060102-150405.000"),
+		strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(client.String()), FileExt)
+	path := filepath.Join(r.dir, name)
+
+	// 录制内容可能包含敏感数据，只允许当前用户读取；不覆盖已有文件，也不跟随预先放置的符号链接
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("[%s] 创建录制文件失败: %v", proxyID, err)
+		return nil
+	}
+
+	file := &File{f: f, w: bufio.NewWriter(f), start: start, maxBytes: r.maxBytes}
+	header := []byte(magic)
+	header = append(header, version, byte(len(protocol)))
+	header = append(header, protocol...)
+	header = binary.BigEndian.AppendUint64(header, uint64(start.UnixNano()))
+	file.write(header)
+	return file
+}
+
+// File 单个连接的录制文件，可并发写入
+type File struct {
+	mu       sync.Mutex
+	f        *os.File
+	w        *bufio.Writer
+	start    time.Time
+	size     int64
+	maxBytes int64
+	stopped  bool
+}
+
+// Write 记录一块数据及其时间
+func (f *File) Write(data []byte) {
+	if f == nil || len(data) == 0 {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped {
+		return
+	}
+	if f.maxBytes > 0 && f.size+int64(len(data)) > f.maxBytes {
+		f.stopped = true
+		return
+	}
+
+	chunk := make([]byte, 0, 12+len(data))
+	chunk = binary.BigEndian.AppendUint64(chunk, uint64(time.Since(f.start)))
+	chunk = binary.BigEndian.AppendUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, data...)
+	f.write(chunk)
+}
+
+func (f *File) write(b []byte) {
+	n, err := f.w.Write(b)
+	f.size += int64(n)
+	if err != nil {
+		log.Printf("写入录制文件失败: %v", err)
+		f.stopped = true
+	}
+}
+
+// Close 写入剩余数据并关闭文件
+func (f *File) Close() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.w.Flush()
+	f.f.Close()
+}
+
+// Reader 包装r，读到的数据同时写入录制文件；f为nil时直接返回r
+func (f *File) Reader(r io.Reader) io.Reader {
+	if f == nil {
+		return r
+	}
+	return &teeReader{r: r, f: f}
+}
+
+type teeReader struct {
+	r io.Reader
+	f *File
+}
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.f.Write(p[:n])
+	return n, err
+}
+
+// Chunk 录制文件中的一块数据
+type Chunk struct {
+	Offset time.Duration // 相对录制开始的时间
+	Data   []byte
+}
+
+// Recording 已读取的录制文件
+type Recording struct {
+	Protocol string
+	Start    time.Time
+	Chunks   []Chunk
+}
+
+// Load 读取录制文件
+func Load(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(magic)]) != magic {
+		return nil, errors.New("不是有效的录制文件")
+	}
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("不支持的录制文件版本: %d", header[len(magic)])
+	}
+
+	proto := make([]byte, header[len(magic)+1])
+	if _, err := io.ReadFull(r, proto); err != nil {
+		return nil, fmt.Errorf("录制文件头部不完整: %w", err)
+	}
+	var startNano uint64
+	if err := binary.Read(r, binary.BigEndian, &startNano); err != nil {
+		return nil, fmt.Errorf("录制文件头部不完整: %w", err)
+	}
+
+	rec := &Recording{Protocol: string(proto), Start: time.Unix(0, int64(startNano))}
+	for {
+		var meta struct {
+			Offset uint64
+			Length uint32
+		}
+		if err := binary.Read(r, binary.BigEndian, &meta); err != nil {
+			if err == io.EOF {
+				return rec, nil
+			}
+			// 进程异常退出时最后一块可能不完整，保留已读取的部分
+			log.Printf("录制文件末尾不完整，已忽略: %v", err)
+			return rec, nil
+		}
+		// 长度来自文件内容，超过文件大小的一定不完整，不按它分配内存
+		if int64(meta.Length) > fi.Size() {
+			log.Printf("录制文件末尾不完整，已忽略: 数据块长度%d超过文件大小", meta.Length)
+			return rec, nil
+		}
+		data := make([]byte, meta.Length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			log.Printf("录制文件末尾不完整，已忽略: %v", err)
+			return rec, nil
+		}
+		rec.Chunks = append(rec.Chunks, Chunk{Offset: time.Duration(meta.Offset), Data: data})
+	}
+}
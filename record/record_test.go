@@ -0,0 +1,58 @@
+package record
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 录制文件只允许当前用户读取
+func TestOpenCreatesPrivateFile(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRecorder(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	f := r.Open("web", "tcp", client)
+	if f == nil {
+		t.Fatal("创建录制文件失败")
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+
+	fi, err := os.Stat(f.f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("录制文件权限为%o，应为600", perm)
+	}
+}
+
+// 数据块长度超过文件大小时按文件末尾不完整处理，不按该长度分配内存
+func TestLoadRejectsOversizedChunk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad"+FileExt)
+	b := []byte(magic)
+	b = append(b, version, 3)
+	b = append(b, "tcp"...)
+	b = binary.BigEndian.AppendUint64(b, 0)
+	b = binary.BigEndian.AppendUint64(b, 0)
+	b = binary.BigEndian.AppendUint32(b, 2)
+	b = append(b, "ok"...)
+	b = binary.BigEndian.AppendUint64(b, 1)
+	b = binary.BigEndian.AppendUint32(b, 0xffffffff)
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Chunks) != 1 || string(rec.Chunks[0].Data) != "ok" {
+		t.Errorf("读取到%d块数据，应只保留长度正常的第一块", len(rec.Chunks))
+	}
+}
@@ -0,0 +1,66 @@
+package record
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Replay 按录制时的时间间隔将数据发送到target，speed为回放速度倍数(<=0时不等待，尽快发送)
+// 目标返回的数据会被读取并统计，回放结束后等待wait时间以接收剩余响应
+func Replay(ctx context.Context, rec *Recording, target string, speed float64, wait time.Duration) error {
+	network := "tcp"
+	if rec.Protocol == "udp" {
+		network = "udp"
+	}
+
+	conn, err := net.Dial(network, target)
+	if err != nil {
+		return fmt.Errorf("无法连接到目标: %w", err)
+	}
+	defer conn.Close()
+
+	// 读取目标的响应
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+
+	start := time.Now()
+	var sent int64
+	for _, chunk := range rec.Chunks {
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(chunk.Offset) / speed))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		}
+		n, err := conn.Write(chunk.Data)
+		sent += int64(n)
+		if err != nil {
+			return fmt.Errorf("发送失败: %w", err)
+		}
+	}
+	log.Printf("已回放%d块数据共%d字节，用时%s", len(rec.Chunks), sent, time.Since(start).Round(time.Millisecond))
+
+	// TCP半关闭写方向，通知目标数据已发送完毕
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+
+	select {
+	case n := <-received:
+		log.Printf("目标已关闭连接，共收到%d字节", n)
+	case <-time.After(wait):
+		conn.Close()
+		log.Printf("共收到%d字节", <-received)
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package reverse
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/link"
+)
+
+// 重连间隔的上限
+const maxRetryInterval = 30 * time.Second
+
+// Agent 主动连接服务端并注册本地服务，服务端收到公网连接时由代理端连接本地服务并转发
+type Agent struct {
+	serverAddr string
+	token      string
+	name       string
+	services   []Service
+	locals     map[string]string // 服务名 -> 本地地址
+	status     func() link.Status
+
+	health   *health.Tracker // 控制连接建立后标记为就绪，断开时标记为未就绪
+	healthID string
+
+	active atomic.Int64 // 活动的转发连接数
+
+	mu  sync.Mutex
+	ctl *link.Control // 当前的控制连接
+}
+
+// NewAgent 创建反向转发代理端，name为本节点名，status为nil时不向服务端发送健康信息
+func NewAgent(serverAddr, token, name string, services []Service, status func() link.Status, tracker *health.Tracker) *Agent {
+	locals := make(map[string]string, len(services))
+	for _, svc := range services {
+		locals[svc.Name] = svc.LocalAddr
+	}
+	a := &Agent{
+		serverAddr: serverAddr,
+		token:      token,
+		name:       name,
+		services:   services,
+		locals:     locals,
+		status:     status,
+		health:     tracker,
+		healthID:   "reverse-agent:" + serverAddr,
+	}
+	tracker.Expect(a.healthID)
+	return a
+}
+
+// Peer 返回服务端的状态，未连接时返回nil
+func (a *Agent) Peer() *PeerInfo {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ctl == nil {
+		return nil
+	}
+	info := peerInfo(a.ctl, nil)
+	return &info
+}
+
+// Run 保持与服务端的控制连接，断开后按指数退避重连，直到上下文取消
+func (a *Agent) Run(ctx context.Context) {
+	retry := time.Second
+	for {
+		connected, err := a.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			retry = time.Second
+		}
+		log.Printf("反向转发代理端与服务端 %s 的连接断开: %v, %s后重连", a.serverAddr, err, retry)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, maxRetryInterval)
+	}
+}
+
+func (a *Agent) nodeStatus() link.Status {
+	var st link.Status
+	if a.status != nil {
+		st = a.status()
+	}
+	st.ActiveConns = a.active.Load()
+	return st
+}
+
+// 建立一次控制连接、协商服务并处理消息，返回是否曾连接成功
+func (a *Agent) session(ctx context.Context) (bool, error) {
+	c, peer, err := link.Dial(ctx, a.serverAddr, a.token, a.name, link.RoleControl, nil)
+	if err != nil {
+		return false, err
+	}
+	ctl := link.NewControl(c, peer, a.nodeStatus)
+	defer ctl.Close()
+
+	services := make([]link.Service, len(a.services))
+	for i, svc := range a.services {
+		services[i] = link.Service{Name: svc.Name, RemotePort: svc.RemotePort}
+	}
+	if err := ctl.Send(link.Message{Type: msgRegister, Services: services}); err != nil {
+		return false, err
+	}
+	m, err := ctl.Recv(link.HandshakeTimeout)
+	if err != nil {
+		return false, err
+	}
+	if m.Type != msgRegisterAck {
+		return false, fmt.Errorf("注册失败: %s", m.Error)
+	}
+
+	accepted := 0
+	for _, r := range m.Results {
+		if r.Accepted {
+			accepted++
+		} else {
+			log.Printf("反向转发服务[%s]被服务端拒绝: %s", r.Name, r.Error)
+		}
+	}
+	log.Printf("反向转发代理端已连接到服务端 %s(%s), 接受%d/%d个服务", peer, a.serverAddr, accepted, len(services))
+
+	a.mu.Lock()
+	a.ctl = ctl
+	a.mu.Unlock()
+	a.health.SetReady(a.healthID, true)
+	defer func() {
+		a.mu.Lock()
+		a.ctl = nil
+		a.mu.Unlock()
+		a.health.SetReady(a.healthID, false)
+	}()
+
+	err = ctl.Run(ctx, func(m link.Message) {
+		if m.Type == msgNewConn {
+			go a.work(ctx, m.ID, m.Service)
+		}
+	})
+	return true, err
+}
+
+// 为一个公网连接建立工作连接，并与本地服务之间转发数据
+func (a *Agent) work(ctx context.Context, id []byte, service string) {
+	localAddr, ok := a.locals[service]
+	if !ok {
+		log.Printf("反向转发代理端收到未知服务的连接请求: %s", service)
+		return
+	}
+
+	dialer := net.Dialer{Timeout: link.HandshakeTimeout}
+	local, err := dialer.DialContext(ctx, "tcp", localAddr)
+	if err != nil {
+		log.Printf("反向转发服务[%s]无法连接本地地址 %s: %v", service, localAddr, err)
+		return
+	}
+	defer local.Close()
+
+	conn, _, err := link.Dial(ctx, a.serverAddr, a.token, a.name, link.RoleWork, id)
+	if err != nil {
+		log.Printf("反向转发服务[%s]无法建立工作连接: %v", service, err)
+		return
+	}
+	defer conn.Close()
+
+	a.active.Add(1)
+	defer a.active.Add(-1)
+	pipe(conn, local)
+}
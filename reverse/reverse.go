@@ -0,0 +1,69 @@
+package reverse
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/link"
+)
+
+// 反向转发在链路控制连接上使用的消息：
+//
+//	代理端登录后发送register(服务列表)，服务端逐条协商后回复register_ack，
+//	之后服务端在有公网连接时发送new_conn，代理端以该连接ID建立工作连接
+const (
+	msgRegister    = "register"
+	msgRegisterAck = "register_ack"
+	msgNewConn     = "new_conn"
+)
+
+// 等待工作连接的超时时间
+const workTimeout = 10 * time.Second
+
+// Service 代理端注册的服务，服务端在RemotePort上监听并把连接转发给代理端
+type Service struct {
+	Name       string
+	RemotePort int
+	LocalAddr  string // 代理端本地服务地址，不发送给服务端
+}
+
+// PeerInfo 链路对端的状态，用于expvar输出
+type PeerInfo struct {
+	Name     string       `json:"name"`
+	Addr     string       `json:"addr"`
+	RTT      string       `json:"rtt"`
+	LastSeen time.Time    `json:"last_seen"`
+	Services []string     `json:"services,omitempty"`
+	Status   *link.Status `json:"status,omitempty"`
+}
+
+func peerInfo(ctl *link.Control, services []string) PeerInfo {
+	return PeerInfo{
+		Name:     ctl.Peer(),
+		Addr:     ctl.RemoteAddr().String(),
+		RTT:      ctl.RTT().String(),
+		LastSeen: ctl.LastSeen(),
+		Services: services,
+		Status:   ctl.PeerStatus(),
+	}
+}
+
+// 双向复制数据直到任一方向结束，返回a->b和b->a的字节数
+func pipe(a, b net.Conn) (int64, int64) {
+	var up, down int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		down, _ = io.Copy(a, b)
+		a.Close()
+		b.Close()
+	}()
+	up, _ = io.Copy(b, a)
+	a.Close()
+	b.Close()
+	wg.Wait()
+	return up, down
+}
@@ -0,0 +1,322 @@
+package reverse
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/link"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+)
+
+// Server 接受代理端连接，在公网端口上监听并把连接经由代理端转发到其本地服务
+type Server struct {
+	listenAddr string
+	token      string
+	name       string
+	allowPorts map[int]bool       // 允许代理端注册的公网端口，为空时拒绝所有注册
+	status     func() link.Status // 本节点的健康信息
+
+	active atomic.Int64 // 活动的转发连接数
+
+	mu      sync.Mutex
+	ports   map[int]string             // 已被注册的公网端口 -> 服务名
+	pending map[string]pendingConn     // 工作连接ID -> 等待该工作连接的公网连接
+	agents  map[*link.Control][]string // 已连接的代理端及其服务
+}
+
+// 等待工作连接的公网连接，只接受向其发出请求的代理端建立的工作连接
+type pendingConn struct {
+	ch    chan<- net.Conn
+	agent *link.Control
+}
+
+// NewServer 创建反向转发服务端，name为本节点名，allowPorts为空时不允许注册任何端口，status为nil时不向代理端发送健康信息
+func NewServer(listenAddr, token, name string, allowPorts []int, status func() link.Status) *Server {
+	s := &Server{
+		listenAddr: listenAddr,
+		token:      token,
+		name:       name,
+		status:     status,
+		ports:      make(map[int]string),
+		pending:    make(map[string]pendingConn),
+		agents:     make(map[*link.Control][]string),
+	}
+	s.allowPorts = make(map[int]bool, len(allowPorts))
+	for _, p := range allowPorts {
+		s.allowPorts[p] = true
+	}
+	return s
+}
+
+// Run 监听代理端连接直到上下文取消
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return fmt.Errorf("无法监听: %w", err)
+	}
+	context.AfterFunc(ctx, func() { listener.Close() })
+	log.Printf("反向转发服务端已启动: %s", s.listenAddr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("反向转发服务端接受连接错误: %v", err)
+			continue
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+// Peers 返回已连接的代理端，按名称排序
+func (s *Server) Peers() []PeerInfo {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]PeerInfo, 0, len(s.agents))
+	for ctl, services := range s.agents {
+		peers = append(peers, peerInfo(ctl, services))
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	return peers
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	c, auth, err := link.Accept(conn, s.token, s.name)
+	if err != nil {
+		if errors.Is(err, link.ErrAuthFailed) {
+			log.Printf("反向转发代理端认证失败: %s", conn.RemoteAddr())
+		}
+		conn.Close()
+		return
+	}
+
+	switch auth.Role {
+	case link.RoleControl:
+		s.serveAgent(ctx, link.NewControl(c, auth.Name, s.nodeStatus))
+	case link.RoleWork:
+		s.deliver(auth, c)
+	default:
+		conn.Close()
+	}
+}
+
+func (s *Server) nodeStatus() link.Status {
+	var st link.Status
+	if s.status != nil {
+		st = s.status()
+	}
+	st.ActiveConns = s.active.Load()
+	return st
+}
+
+// 与代理端协商服务并为接受的服务监听公网端口，然后保持控制连接直到断开
+func (s *Server) serveAgent(ctx context.Context, ctl *link.Control) {
+	defer ctl.Close()
+	agent := fmt.Sprintf("%s(%s)", ctl.Peer(), ctl.RemoteAddr())
+
+	m, err := ctl.Recv(link.HandshakeTimeout)
+	if err != nil || m.Type != msgRegister {
+		log.Printf("反向转发代理端 %s 未注册服务", agent)
+		return
+	}
+
+	var accepted []link.Service
+	var listeners []net.Listener
+	results := make([]link.RuleResult, 0, len(m.Services))
+	for _, svc := range m.Services {
+		l, err := s.register(svc)
+		if err != nil {
+			log.Printf("反向转发代理端 %s 的服务[%s]被拒绝: %v", agent, svc.Name, err)
+			results = append(results, link.RuleResult{Name: svc.Name, Error: err.Error()})
+			continue
+		}
+		accepted = append(accepted, svc)
+		listeners = append(listeners, l)
+		results = append(results, link.RuleResult{Name: svc.Name, Accepted: true})
+	}
+	defer s.unregister(accepted, listeners)
+
+	if err := ctl.Send(link.Message{Type: msgRegisterAck, Results: results}); err != nil {
+		return
+	}
+	log.Printf("反向转发代理端已连接: %s, 接受%d/%d个服务", agent, len(accepted), len(m.Services))
+
+	names := make([]string, len(accepted))
+	for i, svc := range accepted {
+		names[i] = svc.Name
+	}
+	s.mu.Lock()
+	s.agents[ctl] = names
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.agents, ctl)
+		s.mu.Unlock()
+	}()
+
+	agentCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for i, l := range listeners {
+		go s.acceptPublic(agentCtx, ctl, accepted[i], l)
+	}
+
+	err = ctl.Run(agentCtx, func(link.Message) {})
+	if ctx.Err() == nil {
+		log.Printf("反向转发代理端 %s 已断开: %v", agent, err)
+	}
+}
+
+// 检查并占用公网端口
+func (s *Server) register(svc link.Service) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.allowPorts[svc.RemotePort] {
+		return nil, fmt.Errorf("公网端口%d不在允许范围内", svc.RemotePort)
+	}
+	if owner, ok := s.ports[svc.RemotePort]; ok {
+		return nil, fmt.Errorf("公网端口%d已被服务[%s]占用", svc.RemotePort, owner)
+	}
+	l, err := net.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", svc.RemotePort))
+	if err != nil {
+		return nil, fmt.Errorf("无法监听公网端口%d: %w", svc.RemotePort, err)
+	}
+	s.ports[svc.RemotePort] = svc.Name
+	return l, nil
+}
+
+func (s *Server) unregister(services []link.Service, listeners []net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, l := range listeners {
+		l.Close()
+		delete(s.ports, services[i].RemotePort)
+	}
+}
+
+func (s *Server) acceptPublic(ctx context.Context, agent *link.Control, svc link.Service, l net.Listener) {
+	log.Printf("反向转发服务[%s]已在公网端口%d上监听", svc.Name, svc.RemotePort)
+	ruleStats := stats.Get("reverse-"+svc.Name, "tcp")
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("反向转发服务[%s]接受连接错误: %v", svc.Name, err)
+			}
+			return
+		}
+		ruleStats.Go(func() { s.forward(ctx, agent, svc, conn, ruleStats) })
+	}
+}
+
+// 请求代理端建立工作连接，并在两者之间转发数据
+func (s *Server) forward(ctx context.Context, agent *link.Control, svc link.Service, conn net.Conn, ruleStats *stats.Rule) {
+	defer conn.Close()
+
+	// 工作连接ID只经该代理端的控制连接发送，随机生成使其他持有令牌的代理端无法猜中并截取连接
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		ruleStats.AddError()
+		return
+	}
+	ch := make(chan net.Conn, 1)
+	s.mu.Lock()
+	s.pending[string(id)] = pendingConn{ch: ch, agent: agent}
+	s.mu.Unlock()
+	// 放弃等待：移除后deliver不会再发送，已送达但未取走的工作连接在此关闭
+	abandon := func() {
+		s.mu.Lock()
+		delete(s.pending, string(id))
+		s.mu.Unlock()
+		select {
+		case work := <-ch:
+			work.Close()
+		default:
+		}
+	}
+
+	if err := agent.Send(link.Message{Type: msgNewConn, ID: id, Service: svc.Name}); err != nil {
+		abandon()
+		ruleStats.AddError()
+		return
+	}
+
+	var work net.Conn
+	select {
+	case work = <-ch:
+	case <-time.After(workTimeout):
+		abandon()
+		log.Printf("反向转发服务[%s]等待代理端工作连接超时: %s", svc.Name, conn.RemoteAddr())
+		ruleStats.AddError()
+		return
+	case <-ctx.Done():
+		abandon()
+		return
+	}
+	defer work.Close()
+
+	start := time.Now()
+	s.active.Add(1)
+	defer s.active.Add(-1)
+	ruleStats.ConnOpened()
+	defer ruleStats.ConnClosed()
+	log.Printf("反向转发服务[%s]: %s -> %s", svc.Name, conn.RemoteAddr(), agent.Peer())
+
+	up, down := pipe(conn, work)
+	ruleStats.AddUp(up)
+	ruleStats.AddDown(down)
+	ruleStats.ConnFinished(time.Since(start), uint64(up+down))
+	log.Printf("反向转发服务[%s]连接关闭: %s, 上行%d字节, 下行%d字节, 持续%s",
+		svc.Name, conn.RemoteAddr(), up, down, time.Since(start).Round(time.Millisecond))
+}
+
+// 把工作连接交给等待中的公网连接，在持有锁时发送，避免与forward放弃等待交错而泄漏连接；
+// 工作连接须来自收到请求的代理端：节点名和地址与其控制连接一致，否则关闭且不影响等待中的公网连接
+func (s *Server) deliver(auth link.Message, work net.Conn) {
+	s.mu.Lock()
+	p, ok := s.pending[string(auth.ID)]
+	if ok && !sameAgent(p.agent, auth.Name, work.RemoteAddr()) {
+		s.mu.Unlock()
+		log.Printf("反向转发服务端拒绝不属于代理端 %s 的工作连接: %s(%s)", p.agent.Peer(), auth.Name, work.RemoteAddr())
+		work.Close()
+		return
+	}
+	delete(s.pending, string(auth.ID))
+	if ok {
+		select {
+		case p.ch <- work:
+		default:
+			ok = false
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		work.Close()
+	}
+}
+
+// 判断工作连接的节点名和来源IP是否与代理端的控制连接一致
+func sameAgent(agent *link.Control, name string, addr net.Addr) bool {
+	if name != agent.Peer() {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	agentHost, _, err := net.SplitHostPort(agent.RemoteAddr().String())
+	return err == nil && host == agentHost
+}
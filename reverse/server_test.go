@@ -0,0 +1,134 @@
+package reverse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/link"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+)
+
+// 建立一对本机TCP连接，返回拨号端和接受端
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err = net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server, err = ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// 对端已关闭时读取返回EOF，对端保持连接时读取超时
+func closedByServer(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	return errors.Is(err, io.EOF)
+}
+
+// 未配置allow_ports时拒绝所有注册，配置后只接受其中的端口
+func TestRegisterAllowPorts(t *testing.T) {
+	ln, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	svc := link.Service{Name: "web", RemotePort: port}
+
+	if l, err := NewServer("", "t", "srv", nil, nil).register(svc); err == nil {
+		l.Close()
+		t.Fatal("未配置allow_ports时接受了注册")
+	}
+	if l, err := NewServer("", "t", "srv", []int{port + 1}, nil).register(svc); err == nil {
+		l.Close()
+		t.Fatal("接受了不在allow_ports中的端口")
+	}
+	l, err := NewServer("", "t", "srv", []int{port}, nil).register(svc)
+	if err != nil {
+		t.Fatalf("allow_ports中的端口被拒绝: %v", err)
+	}
+	l.Close()
+}
+
+// 每个公网连接使用不同的16字节随机ID请求工作连接
+func TestForwardRandomIDs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	agentSide, serverSide := tcpPair(t)
+	agent := link.NewControl(link.NewConn(serverSide), "agent", nil)
+	s := NewServer("", "t", "srv", nil, nil)
+	ruleStats := stats.Get("reverse-test-ids", "tcp")
+
+	recv := link.NewConn(agentSide)
+	var ids [][]byte
+	for range 2 {
+		_, public := tcpPair(t)
+		go s.forward(ctx, agent, link.Service{Name: "web"}, public, ruleStats)
+		m, err := recv.Recv(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.ID) != 16 {
+			t.Fatalf("工作连接ID为%d字节: %x", len(m.ID), m.ID)
+		}
+		ids = append(ids, m.ID)
+	}
+	if bytes.Equal(ids[0], ids[1]) {
+		t.Errorf("两个公网连接使用了相同的ID %x", ids[0])
+	}
+}
+
+// 工作连接只交给向其代理端发出请求的公网连接，其他代理端猜中ID也不能截取
+func TestDeliverChecksAgent(t *testing.T) {
+	_, ctlConn := tcpPair(t)
+	agent := link.NewControl(link.NewConn(ctlConn), "agent-a", nil)
+	s := NewServer("", "t", "srv", nil, nil)
+	ch := make(chan net.Conn, 1)
+	s.pending["id"] = pendingConn{ch: ch, agent: agent}
+
+	otherClient, otherWork := tcpPair(t)
+	s.deliver(link.Message{ID: []byte("id"), Name: "agent-b"}, otherWork)
+	if !closedByServer(otherClient) {
+		t.Error("其他代理端的工作连接没有被关闭")
+	}
+	if _, ok := s.pending["id"]; !ok {
+		t.Fatal("其他代理端的工作连接取消了等待中的公网连接")
+	}
+
+	unknownClient, unknownWork := tcpPair(t)
+	s.deliver(link.Message{ID: []byte("other"), Name: "agent-a"}, unknownWork)
+	if !closedByServer(unknownClient) {
+		t.Error("未知ID的工作连接没有被关闭")
+	}
+
+	_, work := tcpPair(t)
+	s.deliver(link.Message{ID: []byte("id"), Name: "agent-a"}, work)
+	select {
+	case got := <-ch:
+		if got != work {
+			t.Error("公网连接收到了其他工作连接")
+		}
+	default:
+		t.Fatal("代理端自己的工作连接没有交给公网连接")
+	}
+	if _, ok := s.pending["id"]; ok {
+		t.Error("工作连接送达后仍在等待")
+	}
+}
@@ -0,0 +1,102 @@
+package rewrite
+
+import (
+	"bytes"
+	"io"
+)
+
+// Replacement 一条查找替换规则
+type Replacement struct {
+	Find    []byte
+	Replace []byte
+}
+
+// Reader 对底层数据流做查找替换，匹配可以跨越多次读取
+//
+// 读到的数据末尾若恰好是某个查找串的前缀，这部分会暂存到下次读取再输出；
+// 对服务端先发言的协议，若首个数据块恰好以查找串的前缀结尾，对端会等到下一块数据才收到这几个字节。
+type Reader struct {
+	r            io.Reader
+	replacements []Replacement
+	buf          []byte // 已读取但尚未处理的数据
+	out          []byte // 已处理待输出的数据
+	err          error
+}
+
+// NewReader 创建替换读取器，没有规则时直接返回r
+func NewReader(r io.Reader, replacements []Replacement) io.Reader {
+	if len(replacements) == 0 {
+		return r
+	}
+	return &Reader{r: r, replacements: replacements}
+}
+
+func (rw *Reader) Read(p []byte) (int, error) {
+	for len(rw.out) == 0 {
+		if rw.err != nil {
+			// 底层已结束，剩余的部分匹配原样输出
+			if len(rw.buf) > 0 {
+				rw.out, rw.buf = rw.buf, nil
+				break
+			}
+			return 0, rw.err
+		}
+
+		chunk := make([]byte, max(len(p), 512))
+		n, err := rw.r.Read(chunk)
+		rw.buf = append(rw.buf, chunk[:n]...)
+		rw.err = err
+		rw.process()
+	}
+
+	n := copy(p, rw.out)
+	rw.out = rw.out[n:]
+	return n, nil
+}
+
+// 替换buf中所有完整匹配，末尾可能是匹配前缀的部分留在buf中
+func (rw *Reader) process() {
+	data := rw.buf
+	var out []byte
+	for {
+		idx, rep := rw.earliest(data)
+		if idx < 0 {
+			break
+		}
+		out = append(out, data[:idx]...)
+		out = append(out, rep.Replace...)
+		data = data[idx+len(rep.Find):]
+	}
+
+	keep := rw.partialSuffix(data)
+	out = append(out, data[:len(data)-keep]...)
+	rw.out = append(rw.out, out...)
+	rw.buf = append([]byte(nil), data[len(data)-keep:]...)
+}
+
+// 返回最靠前的完整匹配位置，位置相同时取先配置的规则
+func (rw *Reader) earliest(data []byte) (int, *Replacement) {
+	best := -1
+	var bestRep *Replacement
+	for i := range rw.replacements {
+		rep := &rw.replacements[i]
+		if idx := bytes.Index(data, rep.Find); idx >= 0 && (best < 0 || idx < best) {
+			best, bestRep = idx, rep
+		}
+	}
+	return best, bestRep
+}
+
+// 返回data末尾是某个查找串真前缀的最长长度
+func (rw *Reader) partialSuffix(data []byte) int {
+	longest := 0
+	for _, rep := range rw.replacements {
+		for n := min(len(rep.Find)-1, len(data)); n > longest; n-- {
+			if bytes.HasSuffix(data, rep.Find[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
@@ -0,0 +1,196 @@
+// Package rtprelay 为RTP/RTCP媒体流分配成对的中转端口并双向转发，供SIP和RTSP等在信令中协商媒体地址的协议使用。
+//
+// 每个媒体流占用连续的4个端口：客户端侧的RTP和RTCP，以及目标侧的RTP和RTCP，RTP端口为偶数。
+// 客户端发往客户端侧端口的数据经目标侧端口发往目标，反之亦然；对端地址先取自信令，收到对端的
+// 数据后改为数据的来源地址，以适应NAT后的客户端和目标。只接受来自信令中的地址或信令对端IP的数据，
+// 其他来源的数据被丢弃，不能借此劫持媒体流
+package rtprelay
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+)
+
+// 端口范围未配置时使用的端口
+const (
+	defaultPortMin = 10000
+	defaultPortMax = 19999
+)
+
+// UDP数据包的最大长度
+const maxPacketSize = 65535
+
+// ErrNoPorts 端口范围中的端口已全部占用
+var ErrNoPorts = errors.New("媒体端口已全部占用")
+
+// Ports 一侧的中转端口
+type Ports struct {
+	RTP, RTCP int
+}
+
+// Allocator 从端口范围中分配中转端口，可在同一规则的多个代理间共享
+type Allocator struct {
+	bases []int // 可用作第一个端口的偶数端口
+	next  atomic.Uint32
+}
+
+// NewAllocator 创建端口分配器，ports为空时使用10000-19999
+func NewAllocator(ports []int) *Allocator {
+	if len(ports) == 0 {
+		for port := defaultPortMin; port <= defaultPortMax; port++ {
+			ports = append(ports, port)
+		}
+	}
+	set := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		set[port] = true
+	}
+	a := &Allocator{}
+	for _, port := range ports {
+		if port%2 == 0 && set[port+1] && set[port+2] && set[port+3] {
+			a.bases = append(a.bases, port)
+		}
+	}
+	slices.Sort(a.bases)
+	a.bases = slices.Compact(a.bases)
+	return a
+}
+
+// Usable 判断端口范围中是否有连续的4个端口
+func (a *Allocator) Usable() bool {
+	return len(a.bases) > 0
+}
+
+// Allocate 在clientIP和targetIP上分别绑定客户端侧和目标侧的中转端口。依次尝试各组端口直到全部绑定成功，
+// 从上次分配的位置继续，避免立即重用刚释放的端口
+func (a *Allocator) Allocate(clientIP, targetIP net.IP) (*Stream, error) {
+	for range a.bases {
+		base := a.bases[int(a.next.Add(1)-1)%len(a.bases)]
+		var conns [4]*net.UDPConn
+		var err error
+		for i := range conns {
+			ip := clientIP
+			if i >= 2 {
+				ip = targetIP
+			}
+			if conns[i], err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: base + i}); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			for _, c := range conns {
+				if c != nil {
+					c.Close()
+				}
+			}
+			continue
+		}
+		return &Stream{
+			Base: base,
+			rtp:  relay{client: conns[0], target: conns[2]},
+			rtcp: relay{client: conns[1], target: conns[3]},
+		}, nil
+	}
+	return nil, ErrNoPorts
+}
+
+// RTP或RTCP的中转
+type relay struct {
+	client, target *net.UDPConn
+	toClient       atomic.Pointer[net.UDPAddr]
+	toTarget       atomic.Pointer[net.UDPAddr]
+}
+
+// Stream 一个媒体流的中转
+type Stream struct {
+	Base int // 客户端侧RTP端口，依次为客户端侧RTCP、目标侧RTP和目标侧RTCP端口
+
+	rtp, rtcp relay
+	closeOnce sync.Once
+
+	// 各侧允许发来数据的IP，未设置前丢弃该侧的数据
+	clientIPs, targetIPs atomic.Pointer[[]net.IP]
+}
+
+// ClientPorts 返回客户端侧的中转端口，应在发给客户端的信令中公布
+func (s *Stream) ClientPorts() Ports {
+	return Ports{RTP: s.Base, RTCP: s.Base + 1}
+}
+
+// TargetPorts 返回目标侧的中转端口，应在发给目标的信令中公布
+func (s *Stream) TargetPorts() Ports {
+	return Ports{RTP: s.Base + 2, RTCP: s.Base + 3}
+}
+
+// SetClient 设置客户端接收RTP和RTCP的地址，signaling为客户端发送信令的IP(NAT后为其公网地址)
+func (s *Stream) SetClient(rtp, rtcp *net.UDPAddr, signaling net.IP) {
+	s.clientIPs.Store(&[]net.IP{rtp.IP, rtcp.IP, signaling})
+	s.rtp.toClient.Store(rtp)
+	s.rtcp.toClient.Store(rtcp)
+}
+
+// SetTarget 设置目标接收RTP和RTCP的地址，signaling为目标发送信令的IP
+func (s *Stream) SetTarget(rtp, rtcp *net.UDPAddr, signaling net.IP) {
+	s.targetIPs.Store(&[]net.IP{rtp.IP, rtcp.IP, signaling})
+	s.rtp.toTarget.Store(rtp)
+	s.rtcp.toTarget.Store(rtcp)
+}
+
+// Start 开始转发，直到调用Close；转发的流量计入st和q，每转发一个数据包调用一次touch(可以为nil)
+func (s *Stream) Start(st *stats.Rule, q *quota.Quota, touch func()) {
+	for _, r := range []*relay{&s.rtp, &s.rtcp} {
+		st.Go(func() { pump(r.client, r.target, &s.clientIPs, &r.toClient, &r.toTarget, st, st.AddUp, q, touch) })
+		st.Go(func() { pump(r.target, r.client, &s.targetIPs, &r.toTarget, &r.toClient, st, st.AddDown, q, touch) })
+	}
+}
+
+// Close 关闭所有中转端口
+func (s *Stream) Close() {
+	s.closeOnce.Do(func() {
+		for _, c := range []*net.UDPConn{s.rtp.client, s.rtp.target, s.rtcp.client, s.rtcp.target} {
+			c.Close()
+		}
+	})
+}
+
+// 从in读取来自allowed中IP的数据并经out发往dst，数据的来源地址记入src，转发的字节数计入add
+func pump(in, out *net.UDPConn, allowed *atomic.Pointer[[]net.IP], src, dst *atomic.Pointer[net.UDPAddr], st *stats.Rule, add func(int64), q *quota.Quota, touch func()) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := in.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if ips := allowed.Load(); ips == nil || !slices.ContainsFunc(*ips, addr.IP.Equal) {
+			st.AddDropped()
+			continue
+		}
+		src.Store(addr)
+		if touch != nil {
+			touch()
+		}
+		to := dst.Load()
+		if to == nil {
+			st.AddDropped()
+			continue
+		}
+		if exceeded, _ := q.Exceeded(); exceeded {
+			st.AddDropped()
+			continue
+		}
+		if _, err := out.WriteToUDP(buf[:n], to); err != nil {
+			continue
+		}
+		add(int64(n))
+		q.Add(int64(n))
+	}
+}
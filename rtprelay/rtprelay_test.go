@@ -0,0 +1,80 @@
+package rtprelay
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/stats"
+)
+
+func listenUDP(t *testing.T, ip string) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(ip)})
+	if err != nil {
+		t.Skipf("无法在%s上监听: %v", ip, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// 读取一个数据包，超时返回空字符串
+func readPacket(conn *net.UDPConn, wait time.Duration) string {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, 64)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+// 信令两端以外的地址发来的数据被丢弃，也不能把发往客户端的数据引向自己
+func TestStreamIgnoresUnsignaledSources(t *testing.T) {
+	client, target := listenUDP(t, "127.0.0.1"), listenUDP(t, "127.0.0.1")
+	attacker := listenUDP(t, "127.0.0.2")
+
+	st, err := NewAllocator([]int{24000, 24001, 24002, 24003}).Allocate(net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer st.Close()
+	local := net.ParseIP("127.0.0.1")
+	clientAddr, targetAddr := client.LocalAddr().(*net.UDPAddr), target.LocalAddr().(*net.UDPAddr)
+	st.SetClient(clientAddr, clientAddr, local)
+	st.SetTarget(targetAddr, targetAddr, local)
+	rule := stats.Get("rtprelay-test", "udp")
+	st.Start(rule, nil, nil)
+
+	clientSide := &net.UDPAddr{IP: local, Port: st.ClientPorts().RTP}
+	targetSide := &net.UDPAddr{IP: local, Port: st.TargetPorts().RTP}
+	if _, err := attacker.WriteToUDP([]byte("spoof"), clientSide); err != nil {
+		t.Fatal(err)
+	}
+	if got := readPacket(target, 200*time.Millisecond); got != "" {
+		t.Errorf("未在信令中出现的地址发来的数据被转发给目标: %q", got)
+	}
+
+	// 目标的回复仍发往信令中的客户端
+	target.WriteToUDP([]byte("media"), targetSide)
+	if got := readPacket(client, time.Second); got != "media" {
+		t.Errorf("客户端收到%q，目标的数据被其他来源劫持", got)
+	}
+	if got := readPacket(attacker, 100*time.Millisecond); got != "" {
+		t.Errorf("伪造来源收到了目标的数据: %q", got)
+	}
+	if rule.Dropped.Load() == 0 {
+		t.Error("丢弃的数据包没有计入统计")
+	}
+
+	// 信令中的客户端换了端口(例如NAT重新映射)后，回复发往新的端口
+	moved := listenUDP(t, "127.0.0.1")
+	moved.WriteToUDP([]byte("hello"), clientSide)
+	if got := readPacket(target, time.Second); got != "hello" {
+		t.Fatalf("目标收到%q", got)
+	}
+	target.WriteToUDP([]byte("again"), targetSide)
+	if got := readPacket(moved, time.Second); got != "again" {
+		t.Errorf("客户端的新端口收到%q", got)
+	}
+}
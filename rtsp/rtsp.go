@@ -0,0 +1,391 @@
+// Package rtsp 解析经TCP转发的RTSP控制连接，按SETUP请求和响应的Transport头部中协商的RTP/RTCP端口
+// 自动建立成对的UDP中转，使IP摄像头等RTSP服务器的UDP媒体流可以穿过转发。
+//
+// 客户端SETUP请求中的client_port改写为本机目标侧的中转端口，服务器响应中的client_port改回客户端
+// 的端口，server_port改写为本机客户端侧的中转端口。控制连接中的RTP over RTSP(interleaved)数据帧
+// 和消息体按长度原样转发，不会被当作RTSP消息解析。组播传输和RTSP over HTTP不做处理；控制连接
+// 关闭时关闭其所有中转端口
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/rtprelay"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+)
+
+// 消息头部的最大长度，超过时认为不是RTSP，此后原样转发
+const maxHeaderSize = 16 * 1024
+
+// 每个控制连接最多同时中转的媒体流数量
+const maxStreams = 32
+
+var errTooManyStreams = errors.New("控制连接的媒体流过多")
+
+// Options RTSP媒体转发的可选配置
+type Options struct {
+	// 媒体中转使用的端口，每个媒体流占用连续的4个端口，为空时使用10000-19999
+	MediaPorts []int
+
+	Stats *stats.Rule  // 媒体流量计入规则的统计
+	Quota *quota.Quota // 媒体流量计入配额，用尽后丢弃媒体数据
+}
+
+// Helper 为一个规则的RTSP控制连接建立媒体中转，可在同一规则的多个代理间共享
+type Helper struct {
+	opts  Options
+	ports *rtprelay.Allocator
+}
+
+// NewHelper 创建RTSP媒体转发，端口范围中没有连续的4个端口时返回错误
+func NewHelper(opts Options) (*Helper, error) {
+	ports := rtprelay.NewAllocator(opts.MediaPorts)
+	if !ports.Usable() {
+		return nil, errors.New("媒体端口范围中没有连续的4个可用端口")
+	}
+	return &Helper{opts: opts, ports: ports}, nil
+}
+
+// 一个经中转的媒体流
+type media struct {
+	stream *rtprelay.Stream
+	client rtprelay.Ports // 客户端在SETUP请求中给出的端口
+}
+
+// Control 一个RTSP控制连接的状态
+type Control struct {
+	h        *Helper
+	tag      string
+	log      *logging.Logger
+	clientIP net.IP // 客户端地址，媒体数据先发往该地址
+	local    net.IP // 客户端连接的本机地址，客户端侧中转端口绑定在该地址上
+	targetIP net.IP // 目标地址，媒体数据先发往该地址
+	source   net.IP // 本机连接目标使用的地址，目标侧中转端口绑定在该地址上
+	touch    func() // 媒体流有数据时调用，避免控制连接被当作空闲连接回收
+
+	mu      sync.Mutex
+	streams map[int]*media // 目标侧RTP中转端口 -> 媒体流
+	closed  bool
+}
+
+// Control 为一个控制连接创建状态，h为nil或连接不是TCP连接时返回nil；调用Close时关闭所有中转端口
+func (h *Helper) Control(tag string, log *logging.Logger, clientConn, targetConn net.Conn, touch func()) *Control {
+	if h == nil {
+		return nil
+	}
+	client, ok1 := clientConn.RemoteAddr().(*net.TCPAddr)
+	local, ok2 := clientConn.LocalAddr().(*net.TCPAddr)
+	target, ok3 := targetConn.RemoteAddr().(*net.TCPAddr)
+	source, ok4 := targetConn.LocalAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil
+	}
+	return &Control{
+		h:        h,
+		tag:      tag,
+		log:      log,
+		clientIP: client.IP,
+		local:    local.IP,
+		targetIP: target.IP,
+		source:   source.IP,
+		touch:    touch,
+		streams:  make(map[int]*media),
+	}
+}
+
+// RequestReader 返回改写客户端发来的SETUP请求的Reader，c为nil时直接返回r
+func (c *Control) RequestReader(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return &messageReader{r: r, rewrite: c.rewriteRequest}
+}
+
+// ResponseReader 返回改写目标发来的SETUP响应的Reader，c为nil时直接返回r
+func (c *Control) ResponseReader(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return &messageReader{r: r, rewrite: c.rewriteResponse}
+}
+
+// Close 关闭所有媒体流的中转端口
+func (c *Control) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, m := range c.streams {
+		m.stream.Close()
+	}
+	if len(c.streams) > 0 {
+		c.log.Debugf("[%s] 已关闭%d个RTSP媒体转发", c.tag, len(c.streams))
+	}
+	c.streams = nil
+}
+
+// 按RTSP消息的边界读取数据，改写消息头部；消息体和interleaved数据帧原样转发
+type messageReader struct {
+	r       io.Reader
+	rewrite func(head string) string
+	chunk   [4096]byte
+	buf     []byte // 尚未处理的数据
+	out     []byte
+	skip    int  // 需要原样转发的剩余字节数
+	raw     bool // 不是RTSP，此后原样转发
+	err     error
+}
+
+func (mr *messageReader) Read(p []byte) (int, error) {
+	for {
+		mr.process()
+		if len(mr.out) > 0 {
+			break
+		}
+		if mr.err != nil {
+			if len(mr.buf) > 0 {
+				mr.out, mr.buf = mr.buf, nil
+				break
+			}
+			return 0, mr.err
+		}
+		n, err := mr.r.Read(mr.chunk[:])
+		mr.buf = append(mr.buf, mr.chunk[:n]...)
+		mr.err = err
+	}
+	n := copy(p, mr.out)
+	mr.out = mr.out[n:]
+	return n, nil
+}
+
+// 把buf中可以转发的部分移入out，不完整的消息头部留在buf中
+func (mr *messageReader) process() {
+	for len(mr.buf) > 0 {
+		switch {
+		case mr.raw:
+			mr.forward(len(mr.buf))
+		case mr.skip > 0:
+			n := min(mr.skip, len(mr.buf))
+			mr.forward(n)
+			mr.skip -= n
+		case mr.buf[0] == '$':
+			// interleaved数据帧：'$'、通道号、2字节长度和数据
+			if len(mr.buf) < 4 {
+				return
+			}
+			mr.skip = 4 + int(binary.BigEndian.Uint16(mr.buf[2:4]))
+		case mr.buf[0] == '\r' || mr.buf[0] == '\n':
+			// 消息之间多余的空行
+			mr.forward(1)
+		default:
+			end := headerEnd(mr.buf)
+			if end < 0 {
+				if len(mr.buf) > maxHeaderSize {
+					mr.raw = true
+				}
+				return
+			}
+			head := string(mr.buf[:end])
+			mr.buf = mr.buf[end:]
+			line, _, _ := strings.Cut(head, "\n")
+			if !strings.Contains(line, "RTSP/") {
+				mr.raw = true
+				mr.out = append(mr.out, head...)
+				continue
+			}
+			mr.out = append(mr.out, mr.rewrite(head)...)
+			if v := header(head, "Content-Length"); v != "" {
+				if n, err := strconv.Atoi(v); err == nil && n > 0 {
+					mr.skip = n
+				}
+			}
+		}
+	}
+}
+
+func (mr *messageReader) forward(n int) {
+	mr.out = append(mr.out, mr.buf[:n]...)
+	mr.buf = mr.buf[n:]
+}
+
+// 返回消息头部结束(空行之后)的位置，头部不完整时返回-1
+func headerEnd(b []byte) int {
+	for i := 0; i < len(b); i++ {
+		if b[i] != '\n' {
+			continue
+		}
+		if bytes.HasPrefix(b[i+1:], []byte("\r\n")) {
+			return i + 3
+		}
+		if bytes.HasPrefix(b[i+1:], []byte("\n")) {
+			return i + 2
+		}
+	}
+	return -1
+}
+
+// 返回头部中name字段的值，不区分大小写
+func header(head, name string) string {
+	for _, line := range strings.Split(head, "\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(k), name) {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// 改写头部中的Transport字段，fn改写其中的每个传输参数集，没有该字段时原样返回
+func rewriteTransport(head string, fn func(spec []string) []string) string {
+	lines := strings.SplitAfter(head, "\n")
+	for i, line := range lines {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "Transport") {
+			continue
+		}
+		eol := v[len(strings.TrimRight(v, "\r\n")):]
+		specs := strings.Split(strings.TrimSpace(v), ",")
+		for j, spec := range specs {
+			specs[j] = strings.Join(fn(strings.Split(strings.TrimSpace(spec), ";")), ";")
+		}
+		lines[i] = k + ": " + strings.Join(specs, ",") + eol
+	}
+	return strings.Join(lines, "")
+}
+
+// 判断传输参数集是否为UDP单播
+func udpUnicast(spec []string) bool {
+	proto := strings.ToUpper(spec[0])
+	if strings.HasSuffix(proto, "/TCP") {
+		return false
+	}
+	for _, param := range spec[1:] {
+		if strings.EqualFold(param, "multicast") {
+			return false
+		}
+	}
+	return true
+}
+
+// 返回参数集中name参数的值和序号，不存在时序号为-1
+func param(spec []string, name string) (string, int) {
+	for i, p := range spec[1:] {
+		k, v, _ := strings.Cut(p, "=")
+		if strings.EqualFold(k, name) {
+			return v, i + 1
+		}
+	}
+	return "", -1
+}
+
+// 解析 "a" 或 "a-b" 形式的端口对，只有一个端口时RTCP端口为RTP端口+1
+func parsePorts(v string) (rtprelay.Ports, bool) {
+	a, b, ok := strings.Cut(v, "-")
+	rtp, err := strconv.Atoi(a)
+	if err != nil || rtp <= 0 || rtp > 65535 {
+		return rtprelay.Ports{}, false
+	}
+	rtcp := rtp + 1
+	if ok {
+		if rtcp, err = strconv.Atoi(b); err != nil || rtcp <= 0 || rtcp > 65535 {
+			return rtprelay.Ports{}, false
+		}
+	}
+	return rtprelay.Ports{RTP: rtp, RTCP: rtcp}, true
+}
+
+func formatPorts(p rtprelay.Ports) string {
+	return strconv.Itoa(p.RTP) + "-" + strconv.Itoa(p.RTCP)
+}
+
+// 为SETUP请求中的每个UDP单播传输分配中转端口，client_port改写为目标侧中转端口，并去掉destination参数
+func (c *Control) rewriteRequest(head string) string {
+	method, _, _ := strings.Cut(head, " ")
+	if !strings.EqualFold(method, "SETUP") {
+		return head
+	}
+	return rewriteTransport(head, func(spec []string) []string {
+		if !udpUnicast(spec) {
+			return spec
+		}
+		v, i := param(spec, "client_port")
+		ports, ok := parsePorts(v)
+		if !ok {
+			return spec
+		}
+		m, err := c.open(ports)
+		if err != nil {
+			c.log.Warnf("[%s] 无法为RTSP媒体流分配中转端口，原样转发SETUP请求: %v", c.tag, err)
+			return spec
+		}
+		spec[i] = "client_port=" + formatPorts(m.stream.TargetPorts())
+		if _, j := param(spec, "destination"); j >= 0 {
+			spec = append(spec[:j], spec[j+1:]...)
+		}
+		return spec
+	})
+}
+
+// 把响应中的client_port改回客户端的端口，server_port改写为客户端侧中转端口，source改写为本机地址
+func (c *Control) rewriteResponse(head string) string {
+	return rewriteTransport(head, func(spec []string) []string {
+		if !udpUnicast(spec) {
+			return spec
+		}
+		v, i := param(spec, "client_port")
+		ports, ok := parsePorts(v)
+		if !ok {
+			return spec
+		}
+		c.mu.Lock()
+		m := c.streams[ports.RTP]
+		c.mu.Unlock()
+		if m == nil {
+			return spec
+		}
+		spec[i] = "client_port=" + formatPorts(m.client)
+		if v, j := param(spec, "server_port"); j >= 0 {
+			if server, ok := parsePorts(v); ok {
+				m.stream.SetTarget(&net.UDPAddr{IP: c.targetIP, Port: server.RTP}, &net.UDPAddr{IP: c.targetIP, Port: server.RTCP}, c.targetIP)
+				spec[j] = "server_port=" + formatPorts(m.stream.ClientPorts())
+			}
+		}
+		if _, j := param(spec, "source"); j >= 0 {
+			spec[j] = "source=" + c.local.String()
+		}
+		return spec
+	})
+}
+
+// 分配中转端口并开始转发，媒体数据先发往客户端给出的端口
+func (c *Control) open(client rtprelay.Ports) (*media, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, net.ErrClosed
+	}
+	if len(c.streams) >= maxStreams {
+		return nil, errTooManyStreams
+	}
+	st, err := c.h.ports.Allocate(c.local, c.source)
+	if err != nil {
+		return nil, err
+	}
+	st.SetClient(&net.UDPAddr{IP: c.clientIP, Port: client.RTP}, &net.UDPAddr{IP: c.clientIP, Port: client.RTCP}, c.clientIP)
+	st.Start(c.h.opts.Stats, c.h.opts.Quota, c.touch)
+	m := &media{stream: st, client: client}
+	c.streams[st.TargetPorts().RTP] = m
+	c.log.Infof("[%s] RTSP媒体流使用中转端口%d-%d，客户端端口%s", c.tag, st.Base, st.Base+3, formatPorts(client))
+	return m, nil
+}
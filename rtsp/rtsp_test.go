@@ -0,0 +1,250 @@
+package rtsp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/Mxmilu666/nia-forwarding/rtprelay"
+)
+
+func TestParsePorts(t *testing.T) {
+	for in, want := range map[string]rtprelay.Ports{
+		"5000-5001":   {RTP: 5000, RTCP: 5001},
+		"5000":        {RTP: 5000, RTCP: 5001}, // 只有RTP端口时RTCP为下一个端口
+		"5000-6000":   {RTP: 5000, RTCP: 6000},
+		"65535-65535": {RTP: 65535, RTCP: 65535},
+	} {
+		if got, ok := parsePorts(in); !ok || got != want {
+			t.Errorf("端口对%q解析为%+v (%v)，应为%+v", in, got, ok, want)
+		}
+	}
+	for _, in := range []string{"", "-", "5000-", "-5001", "0-1", "5000-0", "65536", "5000-65536", "abc", "5000-5001-5002", "99999999999999999999"} {
+		if got, ok := parsePorts(in); ok {
+			t.Errorf("无效的端口对%q被解析为%+v", in, got)
+		}
+	}
+}
+
+// 头部以空行结束，空行只有空白字符时不算结束
+func TestHeaderEnd(t *testing.T) {
+	tests := []struct {
+		in  string
+		end int
+	}{
+		{"OPTIONS * RTSP/1.0\r\n\r\n", 22},
+		{"OPTIONS * RTSP/1.0\n\n", 20},
+		{"OPTIONS * RTSP/1.0\r\n\r\nbody", 22},
+		{"\n\n", 2},
+		{"OPTIONS * RTSP/1.0", -1},
+		{"OPTIONS * RTSP/1.0\r\n", -1},
+		{"OPTIONS * RTSP/1.0\r\n\r", -1},
+		{"OPTIONS * RTSP/1.0\r\n \r\n", -1},
+	}
+	for _, tt := range tests {
+		if end := headerEnd([]byte(tt.in)); end != tt.end {
+			t.Errorf("%q的头部结束位置为%d，应为%d", tt.in, end, tt.end)
+		}
+	}
+}
+
+// 依次返回各数据块，之后返回err
+type chunkReader struct {
+	chunks []string
+	err    error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.chunks[0])
+	if r.chunks[0] = r.chunks[0][n:]; r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+// 消息头部的边界：改写函数给每个头部加上尖括号，原样转发的部分不带尖括号
+func TestMessageReader(t *testing.T) {
+	options := "OPTIONS rtsp://cam/ RTSP/1.0\r\nCSeq: 1\r\n\r\n"
+	describe := "DESCRIBE rtsp://cam/ RTSP/1.0\nCSeq: 2\n\n"
+	body := "v=0\r\ns=RTSP/1.0\r\n\r\n" // 看起来像消息头部的消息体
+	withBody := "RTSP/1.0 200 OK\r\nCSeq: 2\r\ncontent-length: 19\r\n\r\n"
+	frame := "$\x01\x00\x0c" + "RTSP/1.0\r\n\r\n" // interleaved数据帧，数据像消息头部
+	oversize := "OPTIONS rtsp://cam/ RTSP/1.0\r\nX-Pad: " + strings.Repeat("a", maxHeaderSize+2*4096) + "\r\n\r\n"
+	reset := errors.New("连接被重置")
+
+	tests := []struct {
+		name   string
+		chunks []string
+		err    error // 数据读完后返回的错误，nil为io.EOF
+		want   string
+	}{
+		{"一条消息", []string{options}, nil, "<" + options + ">"},
+		{"LF换行", []string{describe}, nil, "<" + describe + ">"},
+		{"连续的消息", []string{options + describe}, nil, "<" + options + "><" + describe + ">"},
+		{"跨块的头部", []string{options[:10], options[10:30], options[30:] + describe[:5], describe[5:]}, nil,
+			"<" + options + "><" + describe + ">"},
+		{"消息体原样转发", []string{withBody + body + options}, nil, "<" + withBody + ">" + body + "<" + options + ">"},
+		{"跨块的消息体", []string{withBody + body[:3], body[3:] + options}, nil, "<" + withBody + ">" + body + "<" + options + ">"},
+		{"interleaved数据帧原样转发", []string{frame + options + frame}, nil, frame + "<" + options + ">" + frame},
+		{"跨块的数据帧头", []string{"$\x01", "\x00\x0c" + frame[4:] + options}, nil, frame + "<" + options + ">"},
+		{"消息之间的空行", []string{"\r\n\r\n" + options + "\n"}, nil, "\r\n\r\n<" + options + ">\n"},
+		{"无效的Content-Length", []string{"RTSP/1.0 200 OK\r\nContent-Length: abc\r\n\r\n" + options}, nil,
+			"<RTSP/1.0 200 OK\r\nContent-Length: abc\r\n\r\n><" + options + ">"},
+		{"负数的Content-Length", []string{"RTSP/1.0 200 OK\r\nContent-Length: -5\r\n\r\n" + options}, nil,
+			"<RTSP/1.0 200 OK\r\nContent-Length: -5\r\n\r\n><" + options + ">"},
+		{"头部截断", []string{options + "SETUP rtsp://cam/ RTSP/1.0\r\nCSeq: 3\r\n"}, nil,
+			"<" + options + ">SETUP rtsp://cam/ RTSP/1.0\r\nCSeq: 3\r\n"},
+		{"消息体截断", []string{withBody + body[:5]}, nil, "<" + withBody + ">" + body[:5]},
+		{"数据帧头截断", []string{options + "$\x01"}, nil, "<" + options + ">$\x01"},
+		{"数据帧截断", []string{"$\x01\x00\xffabc"}, nil, "$\x01\x00\xffabc"},
+		{"不是RTSP", []string{"GET / HTTP/1.1\r\n\r\n" + options}, nil, "GET / HTTP/1.1\r\n\r\n" + options},
+		{"二进制数据", []string{"\x00\x01\x02\n\n" + options}, nil, "\x00\x01\x02\n\n" + options},
+		{"头部超长", []string{oversize + options}, nil, oversize + options},
+		{"读取错误前的数据先交付", []string{options, "PLAY rtsp://cam/ RTSP/1.0\r\n"}, reset,
+			"<" + options + ">PLAY rtsp://cam/ RTSP/1.0\r\n"},
+	}
+	for _, tt := range tests {
+		wantErr := tt.err
+		if wantErr == nil {
+			wantErr = io.EOF
+		}
+		whole := strings.Join(tt.chunks, "")
+		readers := []struct {
+			mode string
+			r    io.Reader
+		}{
+			{"按块", &chunkReader{chunks: slices.Clone(tt.chunks), err: wantErr}},
+			{"整体", &chunkReader{chunks: []string{whole}, err: wantErr}},
+			{"逐字节", iotest.OneByteReader(&chunkReader{chunks: []string{whole}, err: wantErr})},
+			{"错误与数据同时返回", iotest.DataErrReader(&chunkReader{chunks: []string{whole}, err: wantErr})},
+		}
+		for _, rd := range readers {
+			t.Run(tt.name+"/"+rd.mode, func(t *testing.T) {
+				mr := &messageReader{r: rd.r, rewrite: func(head string) string { return "<" + head + ">" }}
+				var out []byte
+				p := make([]byte, 7)
+				var err error
+				for err == nil {
+					var n int
+					n, err = mr.Read(p)
+					out = append(out, p[:n]...)
+				}
+				if err != wantErr {
+					t.Errorf("读完后返回%v，应返回底层连接的%v", err, wantErr)
+				}
+				if string(out) != tt.want {
+					t.Errorf("转发%q，应为%q", shorten(string(out)), shorten(tt.want))
+				}
+			})
+		}
+	}
+}
+
+// 缩短超长的输出以便阅读
+func shorten(s string) string {
+	if len(s) > 200 {
+		return s[:100] + "..." + s[len(s)-100:]
+	}
+	return s
+}
+
+func newTestControl(t *testing.T) *Control {
+	h, err := NewHelper(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lo := net.IPv4(127, 0, 0, 1)
+	c := &Control{h: h, clientIP: lo, local: lo, targetIP: lo, source: lo, streams: make(map[int]*media)}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// 不是有效UDP单播传输的SETUP请求原样转发，不分配中转端口
+func TestRewriteRequestUnchanged(t *testing.T) {
+	c := newTestControl(t)
+	tests := []struct {
+		name string
+		head string
+	}{
+		{"不是SETUP", "PLAY rtsp://cam/ RTSP/1.0\r\nTransport: RTP/AVP;unicast;client_port=5000-5001\r\n\r\n"},
+		{"没有Transport", "SETUP rtsp://cam/ RTSP/1.0\r\nCSeq: 3\r\n\r\n"},
+		{"没有client_port", "SETUP rtsp://cam/ RTSP/1.0\r\nTransport: RTP/AVP;unicast\r\n\r\n"},
+		{"TCP传输", "SETUP rtsp://cam/ RTSP/1.0\r\nTransport: RTP/AVP/TCP;interleaved=0-1\r\n\r\n"},
+		{"组播", "SETUP rtsp://cam/ RTSP/1.0\r\nTransport: RTP/AVP;multicast;client_port=5000-5001\r\n\r\n"},
+		{"端口为0", "SETUP rtsp://cam/ RTSP/1.0\r\nTransport: RTP/AVP;unicast;client_port=0-1\r\n\r\n"},
+		{"端口越界", "SETUP rtsp://cam/ RTSP/1.0\r\nTransport: RTP/AVP;unicast;client_port=70000\r\n\r\n"},
+		{"端口不是数字", "SETUP rtsp://cam/ RTSP/1.0\r\nTransport: RTP/AVP;unicast;client_port=abc-def\r\n\r\n"},
+		{"端口对截断", "SETUP rtsp://cam/ RTSP/1.0\r\nTransport: RTP/AVP;unicast;client_port=5000-\r\n\r\n"},
+		{"Transport为空", "SETUP rtsp://cam/ RTSP/1.0\r\nTransport: \r\n\r\n"},
+	}
+	for _, tt := range tests {
+		if out := c.rewriteRequest(tt.head); out != tt.head {
+			t.Errorf("%s: 请求被改写为%q", tt.name, out)
+		}
+	}
+	if len(c.streams) != 0 {
+		t.Errorf("原样转发的请求分配了%d个媒体流的中转端口", len(c.streams))
+	}
+
+	// 没有对应媒体流的响应也原样转发
+	resp := "RTSP/1.0 200 OK\r\nTransport: RTP/AVP;unicast;client_port=5000-5001;server_port=6000-6001\r\n\r\n"
+	if out := c.rewriteResponse(resp); out != resp {
+		t.Errorf("没有对应媒体流的响应被改写为%q", out)
+	}
+}
+
+// SETUP请求中的client_port改为目标侧中转端口，响应中的端口改回客户端端口和客户端侧中转端口
+func TestRewriteSETUP(t *testing.T) {
+	c := newTestControl(t)
+	req := "SETUP rtsp://cam/track1 RTSP/1.0\r\nCSeq: 3\r\n" +
+		"Transport: RTP/AVP;unicast;client_port=5000-5001;destination=10.1.1.1, RTP/AVP/TCP;interleaved=0-1\r\n\r\n"
+	out := c.rewriteRequest(req)
+	if len(c.streams) != 1 {
+		t.Fatalf("一个SETUP请求分配了%d个媒体流", len(c.streams))
+	}
+	var m *media
+	for _, v := range c.streams {
+		m = v
+	}
+	if m.client != (rtprelay.Ports{RTP: 5000, RTCP: 5001}) {
+		t.Errorf("记录的客户端端口为%+v，应为请求中的5000-5001", m.client)
+	}
+	target := formatPorts(m.stream.TargetPorts())
+	want := "SETUP rtsp://cam/track1 RTSP/1.0\r\nCSeq: 3\r\n" +
+		"Transport: RTP/AVP;unicast;client_port=" + target + ",RTP/AVP/TCP;interleaved=0-1\r\n\r\n"
+	if out != want {
+		t.Errorf("client_port没有改为目标侧中转端口，或没有去掉destination:\n得到 %q\n应为 %q", out, want)
+	}
+
+	resp := "RTSP/1.0 200 OK\r\nCSeq: 3\r\n" +
+		"Transport: RTP/AVP;unicast;client_port=" + target + ";server_port=6000-6001;source=10.9.9.9\r\n\r\n"
+	want = "RTSP/1.0 200 OK\r\nCSeq: 3\r\n" +
+		"Transport: RTP/AVP;unicast;client_port=5000-5001;server_port=" + formatPorts(m.stream.ClientPorts()) + ";source=127.0.0.1\r\n\r\n"
+	if out := c.rewriteResponse(resp); out != want {
+		t.Errorf("响应中的端口和source没有改回客户端一侧:\n得到 %q\n应为 %q", out, want)
+	}
+}
+
+// 媒体流达到maxStreams后的SETUP请求原样转发
+func TestRewriteRequestStreamLimit(t *testing.T) {
+	c := newTestControl(t)
+	req := "SETUP rtsp://cam/ RTSP/1.0\r\nTransport: RTP/AVP;unicast;client_port=5000-5001\r\n\r\n"
+	for i := 0; i < maxStreams; i++ {
+		if out := c.rewriteRequest(req); out == req {
+			t.Fatalf("第%d个媒体流没有改写", i+1)
+		}
+	}
+	if out := c.rewriteRequest(req); out != req {
+		t.Errorf("超过上限的SETUP请求被改写为%q", out)
+	}
+	if len(c.streams) != maxStreams {
+		t.Errorf("达到上限后共有%d个媒体流，上限为%d", len(c.streams), maxStreams)
+	}
+}
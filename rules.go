@@ -0,0 +1,1161 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/audit"
+	"github.com/Mxmilu666/nia-forwarding/config"
+	"github.com/Mxmilu666/nia-forwarding/dnscache"
+	"github.com/Mxmilu666/nia-forwarding/dnsfwd"
+	"github.com/Mxmilu666/nia-forwarding/dscp"
+	"github.com/Mxmilu666/nia-forwarding/events"
+	"github.com/Mxmilu666/nia-forwarding/flow"
+	"github.com/Mxmilu666/nia-forwarding/ftp"
+	"github.com/Mxmilu666/nia-forwarding/fwmark"
+	"github.com/Mxmilu666/nia-forwarding/handoff"
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/inherit"
+	"github.com/Mxmilu666/nia-forwarding/inspect"
+	"github.com/Mxmilu666/nia-forwarding/iprelay"
+	"github.com/Mxmilu666/nia-forwarding/limit"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/middleware/command"
+	"github.com/Mxmilu666/nia-forwarding/netwatch"
+	"github.com/Mxmilu666/nia-forwarding/obfs"
+	"github.com/Mxmilu666/nia-forwarding/packetfwd"
+	"github.com/Mxmilu666/nia-forwarding/proxyproto"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/record"
+	"github.com/Mxmilu666/nia-forwarding/rtsp"
+	"github.com/Mxmilu666/nia-forwarding/serialport"
+	"github.com/Mxmilu666/nia-forwarding/shadowsocks"
+	"github.com/Mxmilu666/nia-forwarding/sip"
+	"github.com/Mxmilu666/nia-forwarding/sockmap"
+	"github.com/Mxmilu666/nia-forwarding/srcaddr"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+	"github.com/Mxmilu666/nia-forwarding/targetgroup"
+	"github.com/Mxmilu666/nia-forwarding/tcp"
+	"github.com/Mxmilu666/nia-forwarding/udp"
+	"github.com/Mxmilu666/nia-forwarding/upstream"
+	"github.com/Mxmilu666/nia-forwarding/vhost"
+	"github.com/Mxmilu666/nia-forwarding/wgnet"
+	"github.com/Mxmilu666/nia-forwarding/wol"
+	"github.com/Mxmilu666/nia-forwarding/xdp"
+)
+
+// 所有规则共享的组件
+type ruleShared struct {
+	tracker        *health.Tracker
+	quotas         *quota.Store
+	globalHandlers *limit.Semaphore
+	bandwidth      *limit.Bandwidth
+	memory         *limit.Memory
+	netWatch       *netwatch.Watcher
+	resolver       *dnscache.Cache
+	accel          *sockmap.Accelerator
+	xdp            *xdp.Forwarder
+	handoffs       *handoff.Registry
+	flows          *flow.Exporter
+	events         *events.Bus
+
+	adopted map[string][]handoff.Conn // 从旧进程接管的TCP连接，只在启动时交给对应的代理
+}
+
+// ruleManager 启动和停止转发规则，重新加载配置时只停止或重启有变化的规则
+type ruleManager struct {
+	ruleShared
+
+	ctx     context.Context
+	wg      *sync.WaitGroup   // 所有规则的代理，退出时等待
+	sockets *inherit.Registry // 重新加载时停止的代理交回的监听套接字
+
+	op sync.Mutex // 串行执行启动、重新加载和API对规则的修改，保护以下字段
+
+	started    *config.Config // 启动时的配置，其中规则和目标组之外的配置不随重新加载改变
+	defaults   *config.DefaultsConfig
+	groupCfg   map[string][]string
+	groups     map[string]*targetgroup.Group
+	wireGuard  map[string]config.WireGuardConfig
+	tunnels    map[string]*upstream.Dialer
+	tunnelErrs map[string]error
+	tunnelNets []*wgnet.Net
+
+	mu    sync.Mutex // 保护rules，供expvar读取
+	rules map[string]*runningRule
+}
+
+// runningRule 一条已启动的规则
+type runningRule struct {
+	cfg    config.ForwardConfig
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	all    *sync.WaitGroup
+
+	handlers *limit.Semaphore
+	tcp      []*tcp.Proxy
+	udp      []*udp.Proxy
+
+	cleanups []func() // 所有代理退出后释放规则在共享资源中的份额
+
+	// 规则包含串口、IP协议、DNS、SIP或数据包级转发，这些代理不能交回监听套接字，重新加载时须先停止
+	exclusive bool
+	api       bool // 通过API创建，重新加载配置时保留
+}
+
+// 通过API修改规则时的错误
+var (
+	errRuleExists   = errors.New("规则已存在")
+	errRuleNotFound = errors.New("规则不存在")
+	errRuleNotAPI   = errors.New("只能删除通过API创建的规则，配置文件中的规则须修改配置后重新加载")
+)
+
+func newRuleManager(ctx context.Context, wg *sync.WaitGroup, cfg *config.Config, shared ruleShared) *ruleManager {
+	m := &ruleManager{
+		ruleShared: shared,
+		ctx:        ctx,
+		wg:         wg,
+		sockets:    inherit.New(),
+		started:    cfg,
+		defaults:   cfg.Defaults,
+		groupCfg:   cfg.Groups,
+		groups:     make(map[string]*targetgroup.Group, len(cfg.Groups)),
+		wireGuard:  cfg.WireGuard,
+		tunnels:    make(map[string]*upstream.Dialer),
+		tunnelErrs: make(map[string]error),
+		rules:      make(map[string]*runningRule),
+	}
+	// 目标组在引用它的所有规则间共享轮询位置
+	for name, addrs := range cfg.Groups {
+		m.groups[name] = targetgroup.New(name, addrs)
+	}
+	return m
+}
+
+// 返回启用的规则及其名称，未命名的规则按在配置中的位置命名
+func enabledRules(forwards []config.ForwardConfig) (names []string, rules map[string]config.ForwardConfig) {
+	rules = make(map[string]config.ForwardConfig, len(forwards))
+	for i, fc := range forwards {
+		if !fc.Enabled {
+			continue
+		}
+		name := fc.Name
+		if name == "" {
+			name = fmt.Sprintf("forward-%d", i+1)
+		}
+		names = append(names, name)
+		rules[name] = fc
+	}
+	return names, rules
+}
+
+// startAll 启动配置中所有启用的规则
+func (m *ruleManager) startAll(forwards []config.ForwardConfig) {
+	m.op.Lock()
+	defer m.op.Unlock()
+
+	names, rules := enabledRules(forwards)
+	for _, name := range names {
+		r := m.start(name, rules[name])
+		m.mu.Lock()
+		m.rules[name] = r
+		m.mu.Unlock()
+	}
+}
+
+// reload 按新配置停止删除的规则、重启变更的规则并启动新增的规则，未变更的规则不受影响；
+// 变更的规则仍监听相同地址时新代理接手原来的监听套接字，端口一直可以连接，已建立的连接按原配置继续转发直到结束
+func (m *ruleManager) reload(cfg *config.Config) {
+	m.op.Lock()
+	defer m.op.Unlock()
+
+	if needsRestart(m.started, cfg) {
+		log.Printf("只有转发规则和目标组的变更在重新加载后生效，其他配置项的变更需要重启程序")
+	}
+
+	// 内容改变的目标组重新创建，引用它们的规则随之重启
+	changedGroups := make(map[string]bool)
+	for name := range maps.Keys(m.groupCfg) {
+		if _, ok := cfg.Groups[name]; !ok {
+			changedGroups[name] = true
+			delete(m.groups, name)
+		}
+	}
+	for name, addrs := range cfg.Groups {
+		if !slices.Equal(m.groupCfg[name], addrs) {
+			changedGroups[name] = true
+			m.groups[name] = targetgroup.New(name, addrs)
+		}
+	}
+	m.groupCfg = cfg.Groups
+	// 已启动的隧道保持原配置，尚未启动的隧道在第一次被引用时按新配置启动
+	m.wireGuard = cfg.WireGuard
+	m.defaults = cfg.Defaults
+
+	names, rules := enabledRules(cfg.Forwards)
+
+	m.sockets.Hold()
+	defer func() {
+		if n := m.sockets.Release(); n > 0 {
+			log.Printf("关闭了%d个没有被新规则接手的监听套接字", n)
+		}
+	}()
+
+	var stopped, restarted []string
+	var draining []*runningRule
+	m.mu.Lock()
+	old := maps.Clone(m.rules)
+	m.mu.Unlock()
+	for _, name := range slices.Sorted(maps.Keys(old)) {
+		r := old[name]
+		fc, keep := rules[name]
+		if r.api && !keep {
+			continue
+		}
+		// 配置文件中定义了与API规则同名的规则时改用配置文件中的规则
+		if keep && !r.api && reflect.DeepEqual(fc, r.cfg) && !changedGroups[fc.TargetGroup] {
+			continue
+		}
+
+		m.mu.Lock()
+		delete(m.rules, name)
+		m.mu.Unlock()
+		switch {
+		case r.exclusive:
+			r.stop()
+		case keep:
+			r.retire(m.sockets)
+			draining = append(draining, r)
+		default:
+			r.retire(m.sockets)
+			r.stop()
+		}
+		m.tracker.RemoveRule(name)
+
+		if keep {
+			restarted = append(restarted, name)
+		} else {
+			stopped = append(stopped, name)
+		}
+	}
+
+	var added []string
+	for _, name := range names {
+		m.mu.Lock()
+		_, running := m.rules[name]
+		m.mu.Unlock()
+		if running {
+			continue
+		}
+		if _, ok := old[name]; !ok {
+			added = append(added, name)
+		}
+		r := m.start(name, rules[name])
+		m.mu.Lock()
+		m.rules[name] = r
+		m.mu.Unlock()
+	}
+
+	// 重启的规则的旧代理处理完已建立的连接后再释放规则的资源
+	for _, r := range draining {
+		go r.drain()
+	}
+
+	log.Printf("配置已重新加载: 新增%d条规则, 重启%d条规则, 停止%d条规则", len(added), len(restarted), len(stopped))
+	for _, name := range added {
+		log.Printf("  新增规则[%s]", name)
+	}
+	for _, name := range restarted {
+		log.Printf("  重启规则[%s]", name)
+	}
+	for _, name := range stopped {
+		log.Printf("  停止规则[%s]", name)
+	}
+}
+
+// 收到SIGHUP时重新读取配置文件并应用规则的变更，读取失败时保持当前配置
+func reloadConfig(m *ruleManager, auditLog *audit.Log) {
+	log.Printf("收到SIGHUP，重新加载配置")
+	cfg, err := config.ReloadConfig(configPaths...)
+	if err != nil {
+		log.Printf("重新加载配置失败，保持当前配置: %v", err)
+		return
+	}
+	m.reload(cfg)
+
+	if auditLog != nil {
+		snapshot, err := cfg.Snapshot()
+		if err == nil {
+			err = auditLog.Record(audit.ActorSignal, audit.ActionConfigReload, "", snapshot)
+		}
+		if err != nil {
+			log.Printf("记录审计日志失败: %v", err)
+		}
+	}
+}
+
+// add 解析并启动通过API提交的规则，规则按当前的默认值、目标组和WireGuard隧道检查
+func (m *ruleManager) add(data []byte) (config.ForwardConfig, error) {
+	m.op.Lock()
+	defer m.op.Unlock()
+
+	fc, err := config.ParseRule(data, &config.Config{Defaults: m.defaults, Groups: m.groupCfg, WireGuard: m.wireGuard})
+	if err != nil {
+		return fc, err
+	}
+	m.mu.Lock()
+	_, exists := m.rules[fc.Name]
+	m.mu.Unlock()
+	if exists {
+		return fc, errRuleExists
+	}
+
+	r := m.start(fc.Name, fc)
+	r.api = true
+	m.mu.Lock()
+	m.rules[fc.Name] = r
+	m.mu.Unlock()
+	log.Printf("已通过API创建规则[%s]", fc.Name)
+	return fc, nil
+}
+
+// remove 停止并删除通过API创建的规则
+func (m *ruleManager) remove(name string) error {
+	m.op.Lock()
+	defer m.op.Unlock()
+
+	m.mu.Lock()
+	r, ok := m.rules[name]
+	switch {
+	case !ok:
+		m.mu.Unlock()
+		return errRuleNotFound
+	case !r.api:
+		m.mu.Unlock()
+		return errRuleNotAPI
+	}
+	delete(m.rules, name)
+	m.mu.Unlock()
+
+	r.stop()
+	m.tracker.RemoveRule(name)
+	log.Printf("已通过API删除规则[%s]", name)
+	return nil
+}
+
+// waitRule 等待规则的所有监听器绑定成功或失败，最多等待timeout，返回规则的监听器和启动失败记录
+func (m *ruleManager) waitRule(ctx context.Context, name string, timeout time.Duration) []health.Status {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var statuses []health.Status
+		for _, s := range m.tracker.Statuses() {
+			if s.Rule == name {
+				statuses = append(statuses, s)
+			}
+		}
+		if !slices.ContainsFunc(statuses, func(s health.Status) bool { return s.State == health.StatePending }) {
+			return statuses
+		}
+		select {
+		case <-ctx.Done():
+			return statuses
+		case <-deadline.C:
+			return statuses
+		case <-ticker.C:
+		}
+	}
+}
+
+// 返回规则和目标组之外的配置是否改变，这些配置只在启动时读取
+func needsRestart(old, cfg *config.Config) bool {
+	a, b := *old, *cfg
+	a.Forwards, b.Forwards = nil, nil
+	a.Groups, b.Groups = nil, nil
+	a.Defaults, b.Defaults = nil, nil // 已合并到各条规则中
+	a.LogLanguage, b.LogLanguage = "", ""
+	return !reflect.DeepEqual(a, b)
+}
+
+// handlerUsage 返回各规则已占用的连接处理名额，用于expvar输出
+func (m *ruleManager) handlerUsage() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := make(map[string]int, len(m.rules))
+	for name, r := range m.rules {
+		if r.handlers != nil {
+			usage[name] = r.handlers.InUse()
+		}
+	}
+	return usage
+}
+
+// 返回WireGuard隧道的拨号器，隧道在第一次被规则引用时启动；启动失败的隧道不再重试，由引用它的规则报告
+func (m *ruleManager) tunnel(name string) (*upstream.Dialer, error) {
+	if d, ok := m.tunnels[name]; ok {
+		return d, nil
+	}
+	if err, ok := m.tunnelErrs[name]; ok {
+		return nil, err
+	}
+	n, err := startWireGuard(name, m.wireGuard[name])
+	if err != nil {
+		log.Printf("WireGuard隧道[%s]启动失败: %v", name, err)
+		m.tunnelErrs[name] = err
+		return nil, err
+	}
+	m.tunnelNets = append(m.tunnelNets, n)
+	d := upstream.NewWireGuard(name, n)
+	m.tunnels[name] = d
+	return d, nil
+}
+
+// Close 关闭所有WireGuard隧道，须在所有规则退出后调用
+func (m *ruleManager) Close() {
+	for _, n := range m.tunnelNets {
+		n.Close()
+	}
+}
+
+// 在规则的上下文中运行代理
+func (r *runningRule) goRun(f func()) {
+	r.wg.Add(1)
+	r.all.Add(1)
+	go func() {
+		defer r.all.Done()
+		defer r.wg.Done()
+		f()
+	}()
+}
+
+// 停止接受新连接并把监听套接字交回sockets，已建立的连接继续转发
+func (r *runningRule) retire(sockets *inherit.Registry) {
+	for _, p := range r.tcp {
+		p.Retire(sockets)
+	}
+	for _, p := range r.udp {
+		p.Retire(sockets)
+	}
+}
+
+// 停止规则，等待其所有代理退出后释放资源
+func (r *runningRule) stop() {
+	r.cancel()
+	r.drain()
+}
+
+// 等待规则的所有代理退出，然后取消规则的上下文并释放资源；调用retire后代理在已建立的连接结束时退出
+func (r *runningRule) drain() {
+	r.wg.Wait()
+	r.cancel()
+	for _, f := range r.cleanups {
+		f()
+	}
+}
+
+// 启动一条规则的所有代理，配置有误时记录失败并返回没有代理的规则
+func (m *ruleManager) start(ruleName string, forwardCfg config.ForwardConfig) *runningRule {
+	ctx, cancel := context.WithCancel(m.ctx)
+	r := &runningRule{cfg: forwardCfg, ctx: ctx, cancel: cancel, all: m.wg}
+
+	// 规则或其中一个协议无法启动时记录日志，并在启动汇总中列出
+	ruleFailed := func(protocol, format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Print(msg)
+		m.tracker.RuleFailed(ruleName, protocol, errors.New(msg))
+	}
+
+	listenPorts, err := config.ParseListenPorts(forwardCfg.ListenPorts)
+	if err != nil {
+		ruleFailed("", "配置[%s]监听端口解析错误: %v", ruleName, err)
+		return r
+	}
+
+	targetPorts, err := config.ParsePorts(forwardCfg.TargetPorts)
+	if err != nil {
+		ruleFailed("", "配置[%s]目标端口解析错误: %v", ruleName, err)
+		return r
+	}
+
+	fallbackPorts, err := config.ParsePorts(forwardCfg.FallbackPorts)
+	if err != nil {
+		ruleFailed("", "配置[%s]备用端口解析错误: %v", ruleName, err)
+		return r
+	}
+
+	ruleQuota := m.quotas.Get(ruleName, int64(forwardCfg.TrafficQuota), forwardCfg.QuotaResetDay)
+	if used, total := ruleQuota.Used(); total > 0 {
+		log.Printf("配置[%s]流量配额: 本周期已使用%d/%d字节", ruleName, used, total)
+	}
+
+	middlewares, err := buildMiddlewares(forwardCfg.Middlewares)
+	if err != nil {
+		ruleFailed("", "配置[%s]中间件错误: %v", ruleName, err)
+		return r
+	}
+	if hooks := command.New(ruleName, forwardCfg.OnConnect, forwardCfg.OnDisconnect); hooks != nil {
+		middlewares = append(middlewares, hooks)
+	}
+	r.cleanups = append(r.cleanups, func() { middlewares.Close() })
+
+	var patterns []inspect.Pattern
+	for _, bp := range forwardCfg.BlockPatterns {
+		patterns = append(patterns, inspect.Pattern{Regex: bp.Regex, Hex: bp.Hex})
+	}
+	blocker, err := inspect.NewMatcher(patterns, forwardCfg.BlockInspectBytes)
+	if err != nil {
+		ruleFailed("", "配置[%s]禁止模式错误: %v", ruleName, err)
+		return r
+	}
+
+	logLevel, err := logging.ParseLevel(forwardCfg.LogLevel)
+	if err != nil {
+		ruleFailed("", "配置[%s]错误: %v", ruleName, err)
+		return r
+	}
+	ruleLog := logging.New(logLevel).Sample(forwardCfg.LogSample).Throttle(forwardCfg.LogThrottle)
+
+	injector := buildChaos(ruleName, forwardCfg.Chaos, forwardCfg.Delay)
+
+	recorder, err := record.NewRecorder(forwardCfg.RecordDir, int64(forwardCfg.RecordMaxBytes))
+	if err != nil {
+		ruleFailed("", "配置[%s]录制错误: %v", ruleName, err)
+		return r
+	}
+
+	upstreamDialer, err := upstream.Parse(forwardCfg.UpstreamProxy)
+	if err != nil {
+		ruleFailed("", "配置[%s]上游代理错误: %v", ruleName, err)
+		return r
+	}
+	if name := forwardCfg.WireGuard; name != "" {
+		if upstreamDialer, err = m.tunnel(name); err != nil {
+			ruleFailed("", "配置[%s]WireGuard隧道[%s]不可用: %v", ruleName, name, err)
+			return r
+		}
+	}
+	if j := forwardCfg.SSHJump; j != nil {
+		upstreamDialer, err = upstream.NewSSH(upstream.SSHConfig{
+			Host:                  j.Host,
+			User:                  j.User,
+			KeyFile:               j.Key,
+			Password:              j.Password,
+			KnownHostsFile:        j.KnownHosts,
+			InsecureIgnoreHostKey: j.InsecureIgnoreHostKey,
+		}, upstreamDialer)
+		if err != nil {
+			ruleFailed("", "配置[%s]SSH跳板机错误: %v", ruleName, err)
+			return r
+		}
+	}
+
+	source, err := srcaddr.Parse(forwardCfg.SourceIPv6)
+	if err != nil {
+		ruleFailed("", "配置[%s]错误: %v", ruleName, err)
+		return r
+	}
+
+	if err := fwmark.Check(forwardCfg.FwMark); err != nil {
+		ruleFailed("", "配置[%s]错误: %v", ruleName, err)
+		return r
+	}
+
+	priority, err := limit.ParsePriority(forwardCfg.Priority)
+	if err != nil {
+		ruleFailed("", "配置[%s]错误: %v", ruleName, err)
+		return r
+	}
+
+	overload, err := limit.ParseOverload(forwardCfg.Overload)
+	if err != nil {
+		ruleFailed("", "配置[%s]错误: %v", ruleName, err)
+		return r
+	}
+
+	// 全局的连接处理名额和带宽按规则优先级和权重分配，规则的所有端口共用一个份额
+	fairHandlers := m.globalHandlers.ForRule(forwardCfg.Weight, priority)
+	fairBandwidth := m.bandwidth.ForRule(forwardCfg.Weight)
+	r.cleanups = append(r.cleanups, fairHandlers.Close, fairBandwidth.Close)
+
+	// 规则的TCP连接和UDP会话共享的带宽上限
+	ruleBandwidth := limit.NewBandwidth(int64(forwardCfg.BandwidthLimit))
+	if ruleBandwidth != nil {
+		go ruleBandwidth.Run(r.ctx, limit.DefaultBandwidthInterval)
+		log.Printf("配置[%s]带宽上限: %s/s", ruleName, forwardCfg.BandwidthLimit)
+	}
+
+	dscpValue, err := dscp.Parse(forwardCfg.DSCP)
+	if err != nil {
+		ruleFailed("", "配置[%s]错误: %v", ruleName, err)
+		return r
+	}
+
+	proxyProtocol, err := proxyproto.ParseVersion(forwardCfg.ProxyProtocol)
+	if err != nil {
+		ruleFailed("", "配置[%s]错误: %v", ruleName, err)
+		return r
+	}
+
+	var ssRelay *shadowsocks.Relay
+	if ss := forwardCfg.Shadowsocks; ss != nil {
+		ssRelay, err = shadowsocks.NewRelay(ss.Role, ss.Method, ss.Password, ss.Destination)
+		if err != nil {
+			ruleFailed("", "配置[%s]Shadowsocks错误: %v", ruleName, err)
+			return r
+		}
+	}
+
+	var udpObfs *obfs.Obfuscator
+	if o := forwardCfg.UDPObfs; o != nil {
+		udpObfs, err = obfs.New(o.Role, o.Mode, o.Key)
+		if err != nil {
+			ruleFailed("", "配置[%s]UDP混淆错误: %v", ruleName, err)
+			return r
+		}
+	}
+
+	// 如果协议列表为空，默认使用TCP
+	if len(forwardCfg.Protocol) == 0 {
+		forwardCfg.Protocol = []string{"tcp"}
+	}
+	if upstreamDialer != nil && slices.Contains(forwardCfg.Protocol, "udp") {
+		log.Printf("配置[%s]的上游代理、SSH跳板机和WireGuard隧道仅对TCP生效，UDP仍直接连接目标", ruleName)
+	}
+	if ssRelay != nil && slices.Contains(forwardCfg.Protocol, "udp") {
+		log.Printf("配置[%s]的Shadowsocks加密仅对TCP生效，UDP仍明文转发", ruleName)
+	}
+
+	// 数据包级转发在一个代理中处理规则的所有协议和端口
+	if forwardCfg.PacketMode {
+		if len(forwardCfg.PacketInterfaces) == 0 {
+			ruleFailed("", "配置[%s]错误: packet_mode需要配置packet_interfaces", ruleName)
+			return r
+		}
+		if len(targetPorts) == 1 && len(listenPorts) > 1 {
+			targetPorts = slices.Repeat(targetPorts, len(listenPorts))
+		}
+		if len(listenPorts) != len(targetPorts) {
+			ruleFailed("", "配置[%s]错误: 监听端口数量(%d)与目标端口数量(%d)不匹配", ruleName, len(listenPorts), len(targetPorts))
+			return r
+		}
+		opts := packetfwd.Options{
+			Interfaces: forwardCfg.PacketInterfaces,
+			Timeout:    forwardCfg.Timeout,
+			Stats:      stats.Get(ruleName, "packet"),
+			Quota:      ruleQuota,
+			Health:     m.tracker,
+		}
+		for _, protocol := range forwardCfg.Protocol {
+			switch strings.ToLower(strings.TrimSpace(protocol)) {
+			case "tcp":
+				opts.TCP = true
+			case "udp":
+				opts.UDP = true
+			default:
+				ruleFailed(protocol, "配置[%s]错误: packet_mode只支持tcp和udp协议", ruleName)
+			}
+		}
+		listenIP, targetIP := strings.Trim(forwardCfg.ListenIP, "[]"), strings.Trim(forwardCfg.TargetIP, "[]")
+
+		proxyID := ruleName + "-packet"
+		m.tracker.Register(health.Listener{ID: proxyID, Rule: ruleName, Protocol: "packet",
+			Listen: endpointDesc(forwardCfg.ListenIP, forwardCfg.ListenPorts), Target: endpointDesc(forwardCfg.TargetIP, forwardCfg.TargetPorts)})
+		r.exclusive = true
+		packetProxy := packetfwd.NewProxy(proxyID, listenIP, targetIP, listenPorts, targetPorts, opts)
+		r.goRun(func() {
+			if err := packetProxy.Start(r.ctx); err != nil {
+				m.tracker.Fail(proxyID, err)
+				log.Printf("数据包级转发[%s]错误: %v", proxyID, err)
+			}
+		})
+		return r
+	}
+
+	// 循环处理每个协议
+	for _, protocol := range forwardCfg.Protocol {
+		protocol = strings.ToLower(strings.TrimSpace(protocol))
+
+		// 根据协议类型创建对应的转发代理
+		switch protocol {
+		case "tcp":
+			listenAddrs, targetAddrs, err := addrPairs(&forwardCfg, protocol, listenPorts, targetPorts)
+			if err != nil {
+				ruleFailed(protocol, "配置[%s]错误: %v", ruleName, err)
+				continue
+			}
+
+			// 串口监听没有连接可接受，由桥接保持串口打开并连接目标
+			if sc := serialConfig(forwardCfg.ListenSerial); sc != nil {
+				if forwardCfg.TargetUnix != "" || forwardCfg.TargetPipe != "" || forwardCfg.TargetSerial != nil || forwardCfg.TargetGroup != "" {
+					ruleFailed(protocol, "配置[%s]错误: listen_serial只能转发到TCP地址", ruleName)
+					continue
+				}
+				proxyID := fmt.Sprintf("%s-serial", ruleName)
+				m.tracker.Register(health.Listener{ID: proxyID, Rule: ruleName, Protocol: protocol, Listen: tcp.SerialPrefix + sc.Device, Target: targetAddrs[0]})
+				r.exclusive = true
+				bridge := serialport.NewBridge(proxyID, *sc, targetAddrs[0], serialport.Options{
+					Upstream: upstreamDialer,
+					Stats:    stats.Get(ruleName, "tcp"),
+					Quota:    ruleQuota,
+					Health:   m.tracker,
+				})
+				r.goRun(func() {
+					if err := bridge.Start(r.ctx); err != nil {
+						m.tracker.Fail(proxyID, err)
+						log.Printf("串口转发[%s]错误: %v", proxyID, err)
+					}
+				})
+				continue
+			}
+
+			var tlsConfig *tls.Config
+			if forwardCfg.TLS != nil {
+				tlsConfig, err = buildTLSConfig(r.ctx, forwardCfg.TLS)
+				if err != nil {
+					ruleFailed(protocol, "配置[%s]TLS错误: %v", ruleName, err)
+					continue
+				}
+			}
+
+			rewriteUp, rewriteDown, err := buildRewrites(forwardCfg.Rewrites)
+			if err != nil {
+				ruleFailed(protocol, "配置[%s]替换规则错误: %v", ruleName, err)
+				continue
+			}
+
+			hostRoutes, err := vhost.NewRouter(forwardCfg.HostRoutes)
+			if err != nil {
+				ruleFailed(protocol, "配置[%s]主机路由错误: %v", ruleName, err)
+				continue
+			}
+
+			var ftpHelper *ftp.Helper
+			if forwardCfg.FTPPassive {
+				var advertise net.IP
+				if forwardCfg.FTPAdvertiseIP != "" {
+					if advertise = net.ParseIP(forwardCfg.FTPAdvertiseIP).To4(); advertise == nil {
+						ruleFailed(protocol, "配置[%s]错误: 无效的ftp_advertise_ip '%s'", ruleName, forwardCfg.FTPAdvertiseIP)
+						continue
+					}
+				}
+				passivePorts, err := config.ParsePorts(forwardCfg.FTPPassivePorts)
+				if err != nil {
+					ruleFailed(protocol, "配置[%s]被动模式端口解析错误: %v", ruleName, err)
+					continue
+				}
+				ftpHelper = ftp.NewHelper(ftp.Options{
+					AdvertiseIP:  advertise,
+					PassivePorts: passivePorts,
+					Stats:        stats.Get(ruleName, "tcp"),
+					Quota:        ruleQuota,
+
+					Blocker:       blocker,
+					Bandwidth:     fairBandwidth,
+					RuleBandwidth: ruleBandwidth,
+					Priority:      priority,
+					Chaos:         injector,
+				})
+			}
+
+			var rtspHelper *rtsp.Helper
+			if forwardCfg.RTSP {
+				mediaPorts, err := config.ParsePorts(forwardCfg.RTSPMediaPorts)
+				if err != nil {
+					ruleFailed(protocol, "配置[%s]媒体端口解析错误: %v", ruleName, err)
+					continue
+				}
+				rtspHelper, err = rtsp.NewHelper(rtsp.Options{
+					MediaPorts: mediaPorts,
+					Stats:      stats.Get(ruleName, "tcp"),
+					Quota:      ruleQuota,
+				})
+				if err != nil {
+					ruleFailed(protocol, "配置[%s]错误: %v", ruleName, err)
+					continue
+				}
+			}
+
+			var waker *wol.Waker
+			if forwardCfg.WakeMAC != "" {
+				if forwardCfg.TargetGroup != "" {
+					ruleFailed(protocol, "配置[%s]错误: 网络唤醒不能与目标组同时使用", ruleName)
+					continue
+				}
+				if waker, err = wol.New(wol.Options{
+					MAC:       forwardCfg.WakeMAC,
+					Broadcast: forwardCfg.WakeBroadcast,
+					Wait:      forwardCfg.WakeWait,
+					Log:       ruleLog,
+				}); err != nil {
+					ruleFailed(protocol, "配置[%s]错误: %v", ruleName, err)
+					continue
+				}
+			}
+
+			handlers := limit.NewSemaphore(forwardCfg.MaxHandlers)
+			r.handlers = handlers
+
+			tcpOpts := tcp.Options{
+				Log: ruleLog,
+
+				TLSConfig: tlsConfig,
+				PerIP:     limit.NewPerIP(forwardCfg.MaxConnsPerIP),
+				Backlog:   forwardCfg.AcceptBacklog,
+				BindRetry: forwardCfg.BindRetry,
+				NetWatch:  m.netWatch,
+				Pacer:     limit.NewPacer(forwardCfg.MaxAcceptsPerSec),
+
+				FallbackPorts: fallbackPorts,
+
+				ListenNetwork: networkName("tcp", forwardCfg.ListenNetwork),
+				DialNetwork:   networkName("tcp", forwardCfg.TargetNetwork),
+				DialTimeout:   forwardCfg.DialTimeout,
+				PoolSize:      forwardCfg.TargetPool,
+				PoolMaxIdle:   forwardCfg.TargetPoolMaxIdle,
+				PoolReuse:     forwardCfg.TargetReuse,
+				Source:        source,
+				Mark:          forwardCfg.FwMark,
+				Resolver:      m.resolver,
+				TargetGroup:   m.groups[forwardCfg.TargetGroup],
+				HostRoutes:    hostRoutes,
+
+				MaxConnBytes:    int64(forwardCfg.MaxConnBytes),
+				MaxConnLifetime: forwardCfg.MaxConnLifetime,
+				IdleTimeout:     forwardCfg.TCPIdleTimeout,
+
+				Handlers:       handlers,
+				GlobalHandlers: fairHandlers,
+				Overload:       overload,
+				Memory:         m.memory,
+
+				Bandwidth:     fairBandwidth,
+				RuleBandwidth: ruleBandwidth,
+				Priority:      priority,
+
+				SocketReadBuffer:  forwardCfg.SocketReadBuffer,
+				SocketWriteBuffer: forwardCfg.SocketWriteBuffer,
+				Congestion:        forwardCfg.TCPCongestion,
+				DSCP:              dscpValue,
+				Sockmap:           sockmapFor(m.accel, forwardCfg.TCPSockmap),
+				Handoff:           m.handoffs,
+
+				Stats:  stats.Get(ruleName, "tcp"),
+				Quota:  ruleQuota,
+				Flows:  m.flows,
+				Events: m.events,
+
+				Health: m.tracker,
+
+				Middlewares: middlewares,
+
+				RewriteUp:   rewriteUp,
+				RewriteDown: rewriteDown,
+
+				Blocker: blocker,
+
+				Chaos: injector,
+
+				Recorder: recorder,
+				Upstream: upstreamDialer,
+
+				Shadowsocks: ssRelay,
+
+				ProxyProtocol: proxyProtocol,
+
+				TargetSerial: serialConfig(forwardCfg.TargetSerial),
+
+				FTP:  ftpHelper,
+				RTSP: rtspHelper,
+
+				Wake: waker,
+			}
+
+			// 为每对端口创建一个TCP代理
+			for j := range listenAddrs {
+				listenAddr, targetAddr := listenAddrs[j], targetAddrs[j]
+				proxyID := fmt.Sprintf("%s-tcp-p%d", ruleName, j+1)
+				m.tracker.Register(health.Listener{ID: proxyID, Rule: ruleName, Protocol: protocol, Listen: listenAddr, Target: targetAddr})
+
+				tcpProxy := tcp.NewProxy(proxyID, listenAddr, targetAddr, tcpOpts)
+				for _, c := range m.adopted[proxyID] {
+					tcpProxy.Adopt(c)
+				}
+				delete(m.adopted, proxyID)
+				tcpProxy.Inherit(m.sockets)
+				r.tcp = append(r.tcp, tcpProxy)
+
+				r.goRun(func() {
+					if err := tcpProxy.Start(r.ctx); err != nil {
+						m.tracker.Fail(proxyID, err)
+						log.Printf("TCP代理[%s]错误: %v", proxyID, err)
+					}
+				})
+			}
+
+			log.Printf("已启动TCP端口组[%s]: %s -> %s, 共%d个端口对",
+				ruleName, endpointDesc(forwardCfg.ListenIP, forwardCfg.ListenPorts, forwardCfg.ListenUnix, forwardCfg.ListenPipe),
+				endpointDesc(forwardCfg.TargetIP, forwardCfg.TargetPorts, forwardCfg.TargetUnix, forwardCfg.TargetPipe, serialDevice(forwardCfg.TargetSerial), groupDesc(forwardCfg.TargetGroup)), len(listenAddrs))
+
+		case "udp":
+			listenAddrs, targetAddrs, err := addrPairs(&forwardCfg, protocol, listenPorts, targetPorts)
+			if err != nil {
+				ruleFailed(protocol, "配置[%s]错误: %v", ruleName, err)
+				continue
+			}
+
+			if !udp.ValidReplies(forwardCfg.FanOutReplies) {
+				ruleFailed(protocol, "配置[%s]错误: 无效的fanout_replies '%s'", ruleName, forwardCfg.FanOutReplies)
+				continue
+			}
+			if !udp.ValidSessionMode(forwardCfg.SessionMode) {
+				ruleFailed(protocol, "配置[%s]错误: 无效的session_mode '%s'", ruleName, forwardCfg.SessionMode)
+				continue
+			}
+
+			group, iface, err := parseMulticast(forwardCfg.MulticastGroup, forwardCfg.MulticastInterface)
+			if err != nil {
+				ruleFailed(protocol, "配置[%s]组播错误: %v", ruleName, err)
+				continue
+			}
+
+			udpOpts := udp.Options{
+				Log: ruleLog,
+
+				BufferSize:    forwardCfg.BufferSize,
+				Timeout:       forwardCfg.Timeout,
+				SessionMode:   forwardCfg.SessionMode,
+				QUICAffinity:  forwardCfg.QUICAffinity,
+				TFTP:          forwardCfg.TFTP,
+				PerIP:         limit.NewPerIP(forwardCfg.MaxConnsPerIP),
+				ReadLoops:     forwardCfg.ReadLoops,
+				BindRetry:     forwardCfg.BindRetry,
+				FallbackPorts: fallbackPorts,
+				Memory:        m.memory,
+				Bandwidth:     fairBandwidth,
+				RuleBandwidth: ruleBandwidth,
+				Priority:      priority,
+				NetWatch:      m.netWatch,
+
+				MaxConnBytes:    int64(forwardCfg.MaxConnBytes),
+				MaxConnLifetime: forwardCfg.MaxConnLifetime,
+
+				ListenNetwork: networkName("udp", forwardCfg.ListenNetwork),
+				TargetNetwork: networkName("udp", forwardCfg.TargetNetwork),
+				Source:        source,
+				Mark:          forwardCfg.FwMark,
+				Resolver:      m.resolver,
+				TargetGroup:   m.groups[forwardCfg.TargetGroup],
+				XDP:           xdpFor(m.xdp, forwardCfg.UDPXDP),
+
+				SocketReadBuffer:  forwardCfg.SocketReadBuffer,
+				SocketWriteBuffer: forwardCfg.SocketWriteBuffer,
+				DSCP:              dscpValue,
+
+				Stats:  stats.Get(ruleName, "udp"),
+				Quota:  ruleQuota,
+				Flows:  m.flows,
+				Events: m.events,
+
+				Health: m.tracker,
+
+				Middlewares: middlewares,
+
+				Blocker: blocker,
+
+				Chaos: injector,
+
+				Recorder: recorder,
+
+				Obfs: udpObfs,
+
+				FanOutTargets: forwardCfg.FanOutTargets,
+				FanOutReplies: forwardCfg.FanOutReplies,
+
+				MulticastGroup:     group,
+				MulticastInterface: iface,
+			}
+
+			// 为每对端口创建一个UDP代理
+			for j := range listenAddrs {
+				listenAddr, targetAddr := listenAddrs[j], targetAddrs[j]
+				proxyID := fmt.Sprintf("%s-udp-p%d", ruleName, j+1)
+				m.tracker.Register(health.Listener{ID: proxyID, Rule: ruleName, Protocol: protocol, Listen: listenAddr, Target: targetAddr})
+
+				udpProxy := udp.NewProxy(proxyID, listenAddr, targetAddr, udpOpts)
+				udpProxy.Inherit(m.sockets)
+				r.udp = append(r.udp, udpProxy)
+				r.goRun(func() {
+					if err := udpProxy.Start(r.ctx); err != nil {
+						m.tracker.Fail(proxyID, err)
+						log.Printf("UDP代理[%s]错误: %v", proxyID, err)
+					}
+				})
+			}
+
+			log.Printf("已启动UDP端口组[%s]: %s -> %s, 共%d个端口对",
+				ruleName, endpointDesc(forwardCfg.ListenIP, forwardCfg.ListenPorts, forwardCfg.ListenUnix, forwardCfg.ListenPipe),
+				endpointDesc(forwardCfg.TargetIP, forwardCfg.TargetPorts, forwardCfg.TargetUnix, forwardCfg.TargetPipe, groupDesc(forwardCfg.TargetGroup)), len(listenAddrs))
+
+		case "ip":
+			if forwardCfg.IPProtocol < 1 || forwardCfg.IPProtocol > 255 {
+				ruleFailed(protocol, "配置[%s]错误: 无效的ip_protocol %d", ruleName, forwardCfg.IPProtocol)
+				continue
+			}
+			var peer net.IP
+			if forwardCfg.IPPeer != "" {
+				if peer = net.ParseIP(forwardCfg.IPPeer).To4(); peer == nil {
+					ruleFailed(protocol, "配置[%s]错误: 无效的ip_peer '%s'", ruleName, forwardCfg.IPPeer)
+					continue
+				}
+			}
+
+			proxyID := fmt.Sprintf("%s-ip%d", ruleName, forwardCfg.IPProtocol)
+			m.tracker.Register(health.Listener{ID: proxyID, Rule: ruleName, Protocol: protocol, Listen: forwardCfg.ListenIP, Target: forwardCfg.TargetIP})
+			r.exclusive = true
+			ipProxy := iprelay.NewProxy(proxyID, forwardCfg.ListenIP, strings.Trim(forwardCfg.TargetIP, "[]"), forwardCfg.IPProtocol, iprelay.Options{
+				Peer:   peer,
+				Stats:  stats.Get(ruleName, "ip"),
+				Quota:  ruleQuota,
+				Health: m.tracker,
+			})
+			r.goRun(func() {
+				if err := ipProxy.Start(r.ctx); err != nil {
+					m.tracker.Fail(proxyID, err)
+					log.Printf("IP协议转发[%s]错误: %v", proxyID, err)
+				}
+			})
+
+		case "dns":
+			if forwardCfg.ListenUnix != "" || forwardCfg.ListenPipe != "" || forwardCfg.ListenSerial != nil ||
+				forwardCfg.TargetUnix != "" || forwardCfg.TargetPipe != "" || forwardCfg.TargetSerial != nil || forwardCfg.TargetGroup != "" {
+				ruleFailed(protocol, "配置[%s]错误: DNS转发只支持IP地址和端口，不支持unix套接字、命名管道、串口和目标组", ruleName)
+				continue
+			}
+			listenAddrs, targetAddrs, err := addrPairs(&forwardCfg, "udp", listenPorts, targetPorts)
+			if err != nil {
+				ruleFailed(protocol, "配置[%s]错误: %v", ruleName, err)
+				continue
+			}
+			dnsRoutes, err := dnsfwd.NewRoutes(forwardCfg.DNSRoutes)
+			if err != nil {
+				ruleFailed(protocol, "配置[%s]DNS路由错误: %v", ruleName, err)
+				continue
+			}
+			if !dnsfwd.ValidListenMode(forwardCfg.DNSListen) {
+				ruleFailed(protocol, "配置[%s]错误: 无效的dns_listen '%s'", ruleName, forwardCfg.DNSListen)
+				continue
+			}
+			var dnsTLS *tls.Config
+			if forwardCfg.DNSListen == dnsfwd.ListenTLS || forwardCfg.DNSListen == dnsfwd.ListenHTTPS {
+				if forwardCfg.TLS == nil {
+					ruleFailed(protocol, "配置[%s]错误: dns_listen为%s时需要配置tls", ruleName, forwardCfg.DNSListen)
+					continue
+				}
+				if dnsTLS, err = buildTLSConfig(r.ctx, forwardCfg.TLS); err != nil {
+					ruleFailed(protocol, "配置[%s]TLS错误: %v", ruleName, err)
+					continue
+				}
+			}
+			dnsOpts := dnsfwd.Options{
+				Log:           ruleLog,
+				Routes:        dnsRoutes,
+				ListenMode:    forwardCfg.DNSListen,
+				TLSConfig:     dnsTLS,
+				ListenNetwork: forwardCfg.ListenNetwork,
+				BindRetry:     forwardCfg.BindRetry,
+				Stats:         stats.Get(ruleName, "dns"),
+				Quota:         ruleQuota,
+				Health:        m.tracker,
+			}
+
+			// 为每对端口创建一个DNS转发
+			for j := range listenAddrs {
+				listenAddr, targetAddr := listenAddrs[j], targetAddrs[j]
+				proxyID := fmt.Sprintf("%s-dns-p%d", ruleName, j+1)
+				m.tracker.Register(health.Listener{ID: proxyID, Rule: ruleName, Protocol: protocol, Listen: listenAddr, Target: targetAddr})
+
+				r.exclusive = true
+				dnsProxy := dnsfwd.NewProxy(proxyID, listenAddr, targetAddr, dnsOpts)
+				r.goRun(func() {
+					if err := dnsProxy.Start(r.ctx); err != nil {
+						m.tracker.Fail(proxyID, err)
+						log.Printf("DNS转发[%s]错误: %v", proxyID, err)
+					}
+				})
+			}
+
+			log.Printf("已启动DNS端口组[%s]: %s -> %s, 共%d个端口对",
+				ruleName, endpointDesc(forwardCfg.ListenIP, forwardCfg.ListenPorts), endpointDesc(forwardCfg.TargetIP, forwardCfg.TargetPorts), len(listenAddrs))
+
+		case "sip":
+			if forwardCfg.ListenUnix != "" || forwardCfg.ListenPipe != "" || forwardCfg.ListenSerial != nil ||
+				forwardCfg.TargetUnix != "" || forwardCfg.TargetPipe != "" || forwardCfg.TargetSerial != nil || forwardCfg.TargetGroup != "" {
+				ruleFailed(protocol, "配置[%s]错误: SIP转发只支持IP地址和端口，不支持unix套接字、命名管道、串口和目标组", ruleName)
+				continue
+			}
+			listenAddrs, targetAddrs, err := addrPairs(&forwardCfg, "udp", listenPorts, targetPorts)
+			if err != nil {
+				ruleFailed(protocol, "配置[%s]错误: %v", ruleName, err)
+				continue
+			}
+			var advertise net.IP
+			if forwardCfg.SIPAdvertiseIP != "" {
+				if advertise = net.ParseIP(forwardCfg.SIPAdvertiseIP); advertise == nil {
+					ruleFailed(protocol, "配置[%s]错误: 无效的sip_advertise_ip '%s'", ruleName, forwardCfg.SIPAdvertiseIP)
+					continue
+				}
+			}
+			mediaPorts, err := config.ParsePorts(forwardCfg.SIPMediaPorts)
+			if err != nil {
+				ruleFailed(protocol, "配置[%s]媒体端口解析错误: %v", ruleName, err)
+				continue
+			}
+			sipOpts := sip.Options{
+				Log:            ruleLog,
+				AdvertiseIP:    advertise,
+				MediaPorts:     mediaPorts,
+				SessionTimeout: forwardCfg.Timeout,
+				BindRetry:      forwardCfg.BindRetry,
+				Stats:          stats.Get(ruleName, "sip"),
+				Quota:          ruleQuota,
+				Health:         m.tracker,
+			}
+
+			// 为每对端口创建一个SIP转发
+			for j := range listenAddrs {
+				listenAddr, targetAddr := listenAddrs[j], targetAddrs[j]
+				proxyID := fmt.Sprintf("%s-sip-p%d", ruleName, j+1)
+				m.tracker.Register(health.Listener{ID: proxyID, Rule: ruleName, Protocol: protocol, Listen: listenAddr, Target: targetAddr})
+
+				r.exclusive = true
+				sipProxy := sip.NewProxy(proxyID, listenAddr, targetAddr, sipOpts)
+				r.goRun(func() {
+					if err := sipProxy.Start(r.ctx); err != nil {
+						m.tracker.Fail(proxyID, err)
+						log.Printf("SIP转发[%s]错误: %v", proxyID, err)
+					}
+				})
+			}
+
+			log.Printf("已启动SIP端口组[%s]: %s -> %s, 共%d个端口对",
+				ruleName, endpointDesc(forwardCfg.ListenIP, forwardCfg.ListenPorts), endpointDesc(forwardCfg.TargetIP, forwardCfg.TargetPorts), len(listenAddrs))
+
+		default:
+			ruleFailed(protocol, "配置[%s]错误: 不支持的协议类型 '%s'", ruleName, protocol)
+		}
+	}
+	return r
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/config"
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+)
+
+func TestEnabledRules(t *testing.T) {
+	names, rules := enabledRules([]config.ForwardConfig{
+		{Name: "web", Enabled: true},
+		{Enabled: false},
+		{Enabled: true, ListenIP: "127.0.0.1"},
+	})
+	if len(names) != 2 || names[0] != "web" || names[1] != "forward-3" {
+		t.Fatalf("规则名称 = %v", names)
+	}
+	if rules["forward-3"].ListenIP != "127.0.0.1" {
+		t.Error("未命名的规则没有按配置中的位置命名")
+	}
+}
+
+func TestNeedsRestart(t *testing.T) {
+	old := &config.Config{MaxHandlers: 10, Forwards: []config.ForwardConfig{{Name: "a"}}}
+
+	cfg := *old
+	cfg.Forwards = []config.ForwardConfig{{Name: "b"}}
+	cfg.Groups = map[string][]string{"g": {"127.0.0.1:80"}}
+	cfg.LogLanguage = "en"
+	if needsRestart(old, &cfg) {
+		t.Error("只改变规则、目标组和日志语言时要求重启")
+	}
+
+	cfg.MaxHandlers = 20
+	if !needsRestart(old, &cfg) {
+		t.Error("改变max_handlers时没有要求重启")
+	}
+}
+
+// 回显服务器，返回地址
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// 返回一个当前空闲的本地端口
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func tcpRule(name string, listenPort int, target string) config.ForwardConfig {
+	host, port, _ := net.SplitHostPort(target)
+	return config.ForwardConfig{
+		Name:          name,
+		Enabled:       true,
+		Protocol:      []string{"tcp"},
+		ListenIP:      "127.0.0.1",
+		ListenPorts:   []string{strconv.Itoa(listenPort)},
+		TargetIP:      host,
+		TargetPorts:   []string{port},
+		TargetNetwork: "ipv4",
+		LogLevel:      "error",
+	}
+}
+
+func newTestManager(t *testing.T, cfg *config.Config) *ruleManager {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	quotas, err := quota.NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newRuleManager(ctx, &wg, cfg, ruleShared{tracker: health.NewTracker(), quotas: quotas})
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+		m.Close()
+	})
+	return m
+}
+
+// 经转发往返一行数据
+func roundTrip(conn net.Conn, msg string) error {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := fmt.Fprintln(conn, msg); err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg)+1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != msg+"\n" {
+		return fmt.Errorf("收到 %q", buf)
+	}
+	return nil
+}
+
+// 等待代理开始监听后连接
+func dialRule(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("无法连接%s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 重新加载时只重启变更的规则；重启的规则接手原监听套接字，已建立的连接继续转发；删除的规则停止监听
+func TestReload(t *testing.T) {
+	target := echoServer(t)
+	changedPort, keptPort := freePort(t), freePort(t)
+	changedAddr := fmt.Sprintf("127.0.0.1:%d", changedPort)
+	cfg := &config.Config{Forwards: []config.ForwardConfig{
+		tcpRule("changed", changedPort, target),
+		tcpRule("kept", keptPort, target),
+	}}
+	m := newTestManager(t, cfg)
+	m.startAll(cfg.Forwards)
+
+	established := dialRule(t, changedAddr)
+	defer established.Close()
+	if err := roundTrip(established, "before"); err != nil {
+		t.Fatal(err)
+	}
+	kept := m.rules["kept"]
+
+	next := &config.Config{Forwards: []config.ForwardConfig{
+		tcpRule("changed", changedPort, target),
+		tcpRule("kept", keptPort, target),
+	}}
+	next.Forwards[0].MaxConnsPerIP = 100
+	m.reload(next)
+
+	if m.rules["kept"] != kept {
+		t.Error("未变更的规则被重启")
+	}
+	if err := roundTrip(established, "during"); err != nil {
+		t.Errorf("重启规则后已建立的连接中断: %v", err)
+	}
+	// 新代理接手了监听套接字，不需要等待重新绑定
+	conn, err := net.Dial("tcp", changedAddr)
+	if err != nil {
+		t.Fatalf("重启的规则没有接手监听套接字: %v", err)
+	}
+	defer conn.Close()
+	if err := roundTrip(conn, "after"); err != nil {
+		t.Error(err)
+	}
+
+	m.reload(&config.Config{Forwards: next.Forwards[1:]})
+	if _, ok := m.rules["changed"]; ok {
+		t.Fatal("删除的规则仍在运行")
+	}
+	if conn, err := net.Dial("tcp", changedAddr); err == nil {
+		conn.Close()
+		t.Error("删除的规则仍在监听")
+	}
+}
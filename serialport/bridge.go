@@ -0,0 +1,178 @@
+package serialport
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+	"github.com/Mxmilu666/nia-forwarding/upstream"
+)
+
+// 目标连接失败或断开后重新连接的间隔
+const reconnectDelay = 5 * time.Second
+
+// Options 串口桥接的可选配置
+type Options struct {
+	Upstream *upstream.Dialer // 经由上游代理连接目标，nil表示直接连接
+
+	Stats *stats.Rule  // 流量统计，串口发往目标计为上行
+	Quota *quota.Quota // 流量配额，用尽后不再连接目标
+
+	Health *health.Tracker // 串口打开后标记为就绪，退出时标记为未就绪
+}
+
+// Bridge 保持串口打开，把串口数据转发到TCP目标，并把目标的回复写回串口；目标断开后自动重连
+type Bridge struct {
+	proxyID string
+	cfg     Config
+	target  string
+	opts    Options
+}
+
+// NewBridge 创建串口到TCP目标的桥接
+func NewBridge(proxyID string, cfg Config, target string, opts Options) *Bridge {
+	return &Bridge{proxyID: proxyID, cfg: cfg, target: target, opts: opts}
+}
+
+// Start 打开串口并转发数据，直到上下文取消
+func (b *Bridge) Start(ctx context.Context) error {
+	port, err := Open(b.cfg)
+	if err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, func() { port.Close() })
+
+	log.Printf("[%s] 串口转发已启动: %s -> %s", b.proxyID, b.cfg.Device, b.target)
+	b.opts.Health.SetReady(b.proxyID, true)
+	defer b.opts.Health.SetReady(b.proxyID, false)
+
+	// 串口只能在关闭时中断读取，因此由单独的goroutine持续读取，目标断开期间的数据被丢弃
+	chunks := make(chan []byte, 64)
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, 4096)
+		for {
+			n, err := port.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("[%s] 串口读取错误: %v", b.proxyID, err)
+				}
+				return
+			}
+			if n > 0 {
+				chunks <- append([]byte(nil), buf[:n]...)
+			}
+		}
+	}()
+
+	for {
+		if exceeded, first := b.opts.Quota.Exceeded(); exceeded {
+			if first {
+				log.Printf("[%s] 流量配额已用尽，本周期内不再连接目标", b.proxyID)
+			}
+		} else if target, err := b.opts.Upstream.Dial("tcp6", b.target); err != nil {
+			log.Printf("[%s] 无法连接到TCP目标 %s: %v", b.proxyID, b.target, err)
+			b.opts.Stats.AddTargetError(b.target, err, true)
+		} else if !b.serve(ctx, port, target, chunks) {
+			return b.stopped(ctx)
+		}
+
+		if !b.discard(ctx, chunks, reconnectDelay) {
+			return b.stopped(ctx)
+		}
+	}
+}
+
+// 上下文取消属于正常退出，否则为串口被意外关闭(例如设备被拔出)
+func (b *Bridge) stopped(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errors.New("串口已关闭")
+}
+
+// 在串口和一个目标连接之间转发，返回false表示串口已关闭或上下文已取消
+func (b *Bridge) serve(ctx context.Context, port, target net.Conn, chunks <-chan []byte) bool {
+	defer target.Close()
+
+	start := time.Now()
+	b.opts.Stats.ConnOpened()
+	defer b.opts.Stats.ConnClosed()
+	log.Printf("[%s] 串口转发: %s -> %s", b.proxyID, b.cfg.Device, b.target)
+
+	var up, down int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := target.Read(buf)
+			if n > 0 {
+				if _, werr := port.Write(buf[:n]); werr != nil {
+					return
+				}
+				down += int64(n)
+				b.opts.Stats.AddDown(int64(n))
+				b.opts.Quota.Add(int64(n))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	alive := true
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			alive = false
+			break loop
+		case <-done:
+			break loop
+		case data, ok := <-chunks:
+			if !ok {
+				alive = false
+				break loop
+			}
+			if _, err := target.Write(data); err != nil {
+				break loop
+			}
+			up += int64(len(data))
+			b.opts.Stats.AddUp(int64(len(data)))
+			b.opts.Quota.Add(int64(len(data)))
+		}
+	}
+	target.Close()
+	<-done
+
+	d := time.Since(start)
+	b.opts.Stats.ConnFinished(d, uint64(up+down))
+	log.Printf("[%s] 串口转发连接关闭: %s, 上行%d字节, 下行%d字节, 持续%s",
+		b.proxyID, b.target, up, down, d.Round(time.Millisecond))
+	return alive
+}
+
+// 在d时间内丢弃串口数据，返回false表示串口已关闭或上下文已取消
+func (b *Bridge) discard(ctx context.Context, chunks <-chan []byte, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case _, ok := <-chunks:
+			if !ok {
+				return false
+			}
+			b.opts.Stats.AddDropped()
+		}
+	}
+}
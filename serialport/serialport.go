@@ -0,0 +1,140 @@
+// Package serialport 把串口包装为网络连接，用于串口和TCP之间的转发
+package serialport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// 默认串口参数
+const (
+	DefaultBaud   = 9600
+	DefaultFormat = "8N1"
+)
+
+// Config 串口参数
+type Config struct {
+	Device string // 例如 "/dev/ttyUSB0" 或 "COM3"
+	Baud   int    // 波特率，0为DefaultBaud
+	Format string // 数据位、校验位(N/O/E/M/S)和停止位，例如 "8N1"、"7E1"，为空时为DefaultFormat
+}
+
+// Validate 检查串口参数
+func (c Config) Validate() error {
+	_, err := c.mode()
+	return err
+}
+
+func (c Config) mode() (*serial.Mode, error) {
+	if c.Device == "" {
+		return nil, fmt.Errorf("未配置串口设备")
+	}
+	mode := &serial.Mode{BaudRate: c.Baud}
+	if mode.BaudRate == 0 {
+		mode.BaudRate = DefaultBaud
+	}
+
+	format := c.Format
+	if format == "" {
+		format = DefaultFormat
+	}
+	if len(format) != 3 || format[0] < '5' || format[0] > '8' {
+		return nil, fmt.Errorf("无效的串口格式: %q", c.Format)
+	}
+	mode.DataBits = int(format[0] - '0')
+	switch format[1] {
+	case 'N', 'n':
+		mode.Parity = serial.NoParity
+	case 'O', 'o':
+		mode.Parity = serial.OddParity
+	case 'E', 'e':
+		mode.Parity = serial.EvenParity
+	case 'M', 'm':
+		mode.Parity = serial.MarkParity
+	case 'S', 's':
+		mode.Parity = serial.SpaceParity
+	default:
+		return nil, fmt.Errorf("无效的串口校验位: %q", c.Format)
+	}
+	switch format[2] {
+	case '1':
+		mode.StopBits = serial.OneStopBit
+	case '2':
+		mode.StopBits = serial.TwoStopBits
+	default:
+		return nil, fmt.Errorf("无效的串口停止位: %q", c.Format)
+	}
+	return mode, nil
+}
+
+// 本进程已打开的串口，系统的独占标志对root无效，因此在进程内再检查一次
+var (
+	openMu sync.Mutex
+	opened = make(map[string]bool)
+)
+
+// Open 以独占方式打开串口，返回的连接关闭时释放串口
+func Open(c Config) (net.Conn, error) {
+	mode, err := c.mode()
+	if err != nil {
+		return nil, err
+	}
+
+	openMu.Lock()
+	defer openMu.Unlock()
+	if opened[c.Device] {
+		return nil, fmt.Errorf("串口 %s 正在被使用", c.Device)
+	}
+	port, err := serial.Open(c.Device, mode)
+	if err != nil {
+		return nil, fmt.Errorf("无法打开串口 %s: %w", c.Device, err)
+	}
+	opened[c.Device] = true
+	return &conn{Port: port, addr: Addr(c.Device)}, nil
+}
+
+// Addr 串口设备地址
+type Addr string
+
+func (a Addr) Network() string { return "serial" }
+func (a Addr) String() string  { return string(a) }
+
+// conn 把串口适配为net.Conn，串口没有截止时间，相关方法不做任何事
+type conn struct {
+	serial.Port
+	addr      Addr
+	closeOnce sync.Once
+}
+
+// Read 串口关闭后返回net.ErrClosed，与网络连接一致
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Port.Read(b)
+	var pe *serial.PortError
+	if errors.As(err, &pe) && pe.Code() == serial.PortClosed {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+// Close 关闭串口，可重复调用
+func (c *conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.Port.Close()
+		openMu.Lock()
+		delete(opened, string(c.addr))
+		openMu.Unlock()
+	})
+	return err
+}
+
+func (c *conn) LocalAddr() net.Addr                { return c.addr }
+func (c *conn) RemoteAddr() net.Addr               { return c.addr }
+func (c *conn) SetDeadline(t time.Time) error      { return nil }
+func (c *conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *conn) SetWriteDeadline(t time.Time) error { return nil }
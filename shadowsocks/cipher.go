@@ -0,0 +1,92 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Cipher Shadowsocks AEAD加密方式和主密钥
+type Cipher struct {
+	method  string
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// NewCipher 创建加密方式，支持 aes-128-gcm、aes-256-gcm 和 chacha20-ietf-poly1305
+func NewCipher(method, password string) (*Cipher, error) {
+	method = strings.ToLower(method)
+	var keyLen int
+	var newAEAD func(key []byte) (cipher.AEAD, error)
+	switch method {
+	case "aes-128-gcm":
+		keyLen, newAEAD = 16, newGCM
+	case "aes-256-gcm":
+		keyLen, newAEAD = 32, newGCM
+	case "chacha20-ietf-poly1305":
+		keyLen, newAEAD = chacha20poly1305.KeySize, chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("不支持的加密方式: %q", method)
+	}
+	if password == "" {
+		return nil, fmt.Errorf("未配置密码")
+	}
+	return &Cipher{method: method, key: evpBytesToKey(password, keyLen), newAEAD: newAEAD}, nil
+}
+
+// Method 返回加密方式名称
+func (c *Cipher) Method() string {
+	return c.method
+}
+
+// 盐的长度与密钥长度相同
+func (c *Cipher) saltSize() int {
+	return len(c.key)
+}
+
+// 用盐派生会话子密钥并创建AEAD
+func (c *Cipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 与OpenSSL EVP_BytesToKey(MD5, 无盐, 1轮)相同的密码到密钥转换，与其他Shadowsocks实现兼容
+func evpBytesToKey(password string, keyLen int) []byte {
+	var key, prev []byte
+	for len(key) < keyLen {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keyLen]
+}
+
+// 小端序递增nonce
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
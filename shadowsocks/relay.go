@@ -0,0 +1,82 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// 转发模式
+const (
+	RoleClient = "client" // 加密发往目标的数据，目标为Shadowsocks服务端
+	RoleServer = "server" // 解密客户端发来的数据，客户端为Shadowsocks客户端
+)
+
+// Relay 在转发的一端加解密Shadowsocks流
+type Relay struct {
+	cipher      *Cipher
+	role        string
+	destination string
+	salts       *saltFilter // server模式下最近见过的盐，拒绝重放的连接
+}
+
+// NewRelay 创建加密转发；client模式下destination为写入地址头、由服务端连接的最终地址
+func NewRelay(role, method, password, destination string) (*Relay, error) {
+	c, err := NewCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	switch role {
+	case RoleClient:
+		if destination == "" {
+			return nil, fmt.Errorf("client模式须配置destination")
+		}
+		if _, err := AppendAddr(nil, destination); err != nil {
+			return nil, fmt.Errorf("无效的destination: %w", err)
+		}
+	case RoleServer:
+		return &Relay{cipher: c, role: role, salts: newSaltFilter()}, nil
+	default:
+		return nil, fmt.Errorf("无效的模式: %q，应为client或server", role)
+	}
+	return &Relay{cipher: c, role: role, destination: destination}, nil
+}
+
+// WrapClient server模式下解密客户端连接，并在首次读取时跳过地址头；使用最近见过的盐的连接读取时返回ErrReplay。
+// r为nil或client模式时原样返回
+func (r *Relay) WrapClient(conn net.Conn) net.Conn {
+	if r == nil || r.role != RoleServer {
+		return conn
+	}
+	sc := r.cipher.NewConn(conn)
+	sc.salts = r.salts
+	return &serverConn{Conn: sc}
+}
+
+// WrapTarget client模式下加密目标连接并立即发送地址头；r为nil或server模式时原样返回
+func (r *Relay) WrapTarget(conn net.Conn) (net.Conn, error) {
+	if r == nil || r.role != RoleClient {
+		return conn, nil
+	}
+	sc := r.cipher.NewConn(conn)
+	header, _ := AppendAddr(nil, r.destination)
+	if _, err := sc.Write(header); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// serverConn 读取数据前先读出地址头，转发目标由规则决定，地址头中的目标不被使用
+type serverConn struct {
+	*Conn
+	once sync.Once
+	err  error
+}
+
+func (c *serverConn) Read(p []byte) (int, error) {
+	c.once.Do(func() { _, c.err = ReadAddr(c.Conn) })
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,44 @@
+package shadowsocks
+
+import (
+	"errors"
+	"sync"
+)
+
+// 每一代最多记录的盐数量，保留当前和上一代，共约占用 2*maxSalts*(盐长度+map开销) 的内存
+const maxSalts = 1 << 15
+
+// ErrReplay 客户端使用了最近见过的盐，可能是截获后重放的连接
+var ErrReplay = errors.New("shadowsocks: 盐重复，拒绝可能被重放的连接")
+
+// saltFilter 记录最近见过的盐。当前一代记满后成为上一代，更早的盐被丢弃，
+// 因此只能识别最近 maxSalts 到 2*maxSalts 个连接中的重复
+type saltFilter struct {
+	mu   sync.Mutex
+	cur  map[string]struct{}
+	prev map[string]struct{}
+}
+
+func newSaltFilter() *saltFilter {
+	return &saltFilter{cur: make(map[string]struct{})}
+}
+
+// 记录盐，已见过时返回false；f为nil时总是返回true
+func (f *saltFilter) add(salt []byte) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.cur[string(salt)]; ok {
+		return false
+	}
+	if _, ok := f.prev[string(salt)]; ok {
+		return false
+	}
+	if len(f.cur) >= maxSalts {
+		f.prev, f.cur = f.cur, make(map[string]struct{}, maxSalts)
+	}
+	f.cur[string(salt)] = struct{}{}
+	return true
+}
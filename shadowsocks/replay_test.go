@@ -0,0 +1,134 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// 从r读取、写入w的连接
+type bufConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *bufConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *bufConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// 返回client模式发往服务端的加密数据：盐、地址头和payload
+func clientStream(t *testing.T, password string, payload []byte) []byte {
+	t.Helper()
+	client, err := NewRelay(RoleClient, "aes-256-gcm", password, "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufConn{r: bytes.NewReader(nil)}
+	sc, err := client.WrapTarget(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	return conn.w.Bytes()
+}
+
+func TestServerRejectsReplay(t *testing.T) {
+	server, err := NewRelay(RoleServer, "aes-256-gcm", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := clientStream(t, "secret", []byte("hello"))
+	second := clientStream(t, "secret", []byte("hello"))
+	wrongKey := clientStream(t, "other", []byte("hello"))
+
+	tests := []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"新连接", first, nil},
+		{"重放的连接", first, ErrReplay},
+		{"再次重放", first, ErrReplay},
+		{"使用新盐的连接", second, nil},
+		{"密码错误", wrongKey, ErrAuthFailed},
+		{"截断的盐", second[:8], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := server.WrapClient(&bufConn{r: bytes.NewReader(tt.stream)})
+			got, err := io.ReadAll(conn)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("读取错误 = %v, 期望 %v", err, tt.err)
+			}
+			if err == nil && string(got) != "hello" {
+				t.Errorf("读取 = %q", got)
+			}
+		})
+	}
+
+	// 认证失败的连接不记录盐：先发送带有相同盐的伪造数据，不影响之后真正的连接
+	third := clientStream(t, "secret", []byte("hello"))
+	forged := append(bytes.Clone(third[:32]), bytes.Repeat([]byte{0xaa}, len(third)-32)...)
+	if _, err := io.ReadAll(server.WrapClient(&bufConn{r: bytes.NewReader(forged)})); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("伪造连接的读取错误 = %v, 期望 %v", err, ErrAuthFailed)
+	}
+	if _, err := io.ReadAll(server.WrapClient(&bufConn{r: bytes.NewReader(third)})); err != nil {
+		t.Errorf("伪造连接之后的真实连接读取失败: %v", err)
+	}
+}
+
+// 服务端发出的数据被反射回服务端时拒绝
+func TestServerRejectsReflection(t *testing.T) {
+	server, err := NewRelay(RoleServer, "chacha20-ietf-poly1305", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bufConn{r: bytes.NewReader(clientStream(t, "secret", nil))}
+	conn := server.WrapClient(out)
+	header, _ := AppendAddr(nil, "example.com:80")
+	if _, err := conn.Write(append(header, "reply"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	reflected := server.WrapClient(&bufConn{r: bytes.NewReader(out.w.Bytes())})
+	if _, err := io.ReadAll(reflected); !errors.Is(err, ErrReplay) {
+		t.Errorf("读取错误 = %v, 期望 %v", err, ErrReplay)
+	}
+}
+
+// 当前一代记满后成为上一代，仍能识别；再过一代后被丢弃
+func TestSaltFilterGenerations(t *testing.T) {
+	f := newSaltFilter()
+	salt := func(i int) []byte { return []byte(fmt.Sprintf("salt-%d", i)) }
+	for i := 0; i < maxSalts; i++ {
+		if !f.add(salt(i)) {
+			t.Fatalf("新的盐%d被当作重复", i)
+		}
+	}
+	if f.add(salt(0)) {
+		t.Fatal("当前一代中的盐没有被识别")
+	}
+	f.add(salt(maxSalts))
+	if f.add(salt(0)) || f.add(salt(maxSalts)) {
+		t.Fatal("轮换后没有识别上一代和当前一代中的盐")
+	}
+	for i := maxSalts + 1; i <= 2*maxSalts; i++ {
+		f.add(salt(i))
+	}
+	if !f.add(salt(0)) {
+		t.Error("两代之前的盐仍被记录")
+	}
+	if len(f.cur)+len(f.prev) > 2*maxSalts {
+		t.Errorf("记录了%d个盐，超过上限%d", len(f.cur)+len(f.prev), 2*maxSalts)
+	}
+
+	var none *saltFilter
+	if !none.add(salt(0)) || !none.add(salt(0)) {
+		t.Error("nil过滤器拒绝了盐")
+	}
+}
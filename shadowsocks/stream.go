@@ -0,0 +1,150 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// 每块数据的最大长度，长度字段只使用低14位
+const maxPayload = 0x3fff
+
+// ErrAuthFailed 数据解密失败，通常是密码或加密方式不一致
+var ErrAuthFailed = errors.New("shadowsocks: 解密失败，请检查密码和加密方式")
+
+// Conn 加密的TCP流：写入的数据按块加密发送，读取时解密
+type Conn struct {
+	net.Conn
+	c *Cipher
+
+	wmu    sync.Mutex
+	enc    cipher.AEAD
+	wnonce []byte
+	wbuf   []byte
+
+	dec    cipher.AEAD
+	rnonce []byte
+	rbuf   []byte // 已解密但尚未被读取的数据
+	rchunk []byte
+
+	salts *saltFilter // 服务端拒绝重复的盐，nil为不检查
+	rsalt []byte      // 对端的盐，第一块数据通过认证后记录到salts
+}
+
+// NewConn 包装conn，首次写入时发送随机盐，首次读取时读取对端的盐
+func (c *Cipher) NewConn(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, c: c}
+}
+
+func (sc *Conn) Write(p []byte) (int, error) {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+
+	buf := sc.wbuf[:0]
+	if sc.enc == nil {
+		salt := make([]byte, sc.c.saltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := sc.c.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		sc.enc, sc.wnonce = aead, make([]byte, aead.NonceSize())
+		buf = append(buf, salt...)
+		// 记录自己发出的盐，拒绝把服务端发出的数据反射回来的连接
+		sc.salts.add(salt)
+	}
+
+	n := 0
+	for n < len(p) {
+		chunk := p[n:min(len(p), n+maxPayload)]
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(len(chunk)))
+		buf = sc.seal(buf, size[:])
+		buf = sc.seal(buf, chunk)
+		n += len(chunk)
+	}
+	sc.wbuf = buf
+
+	if _, err := sc.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (sc *Conn) seal(dst, plain []byte) []byte {
+	dst = sc.enc.Seal(dst, sc.wnonce, plain, nil)
+	increment(sc.wnonce)
+	return dst
+}
+
+func (sc *Conn) Read(p []byte) (int, error) {
+	if len(sc.rbuf) == 0 {
+		if err := sc.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, sc.rbuf)
+	sc.rbuf = sc.rbuf[n:]
+	return n, nil
+}
+
+// 读取并解密下一块数据到rbuf
+func (sc *Conn) readChunk() error {
+	if sc.dec == nil {
+		salt := make([]byte, sc.c.saltSize())
+		if _, err := io.ReadFull(sc.Conn, salt); err != nil {
+			return err
+		}
+		aead, err := sc.c.aead(salt)
+		if err != nil {
+			return err
+		}
+		sc.dec, sc.rnonce = aead, make([]byte, aead.NonceSize())
+		sc.rchunk = make([]byte, maxPayload+aead.Overhead())
+		sc.rsalt = salt
+	}
+
+	overhead := sc.dec.Overhead()
+	sizeBuf := sc.rchunk[:2+overhead]
+	if _, err := io.ReadFull(sc.Conn, sizeBuf); err != nil {
+		return err
+	}
+	size, err := sc.open(sizeBuf)
+	if err != nil {
+		return err
+	}
+	// 通过认证后才记录盐，不知道密码的一方无法用随机的盐挤掉记录
+	if sc.rsalt != nil {
+		salt := sc.rsalt
+		sc.rsalt = nil
+		if !sc.salts.add(salt) {
+			return ErrReplay
+		}
+	}
+	n := int(binary.BigEndian.Uint16(size)) & maxPayload
+
+	payload := sc.rchunk[:n+overhead]
+	if _, err := io.ReadFull(sc.Conn, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	sc.rbuf, err = sc.open(payload)
+	return err
+}
+
+func (sc *Conn) open(b []byte) ([]byte, error) {
+	plain, err := sc.dec.Open(b[:0], sc.rnonce, b, nil)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	increment(sc.rnonce)
+	return plain, nil
+}
@@ -0,0 +1,43 @@
+package sip
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/rtprelay"
+)
+
+// DefaultMediaTimeout 通话的媒体流没有数据的最长时间，超过后关闭中转端口
+const DefaultMediaTimeout = 2 * time.Minute
+
+// 一个通话的媒体转发，以Call-ID区分
+type call struct {
+	id         string
+	mu         sync.Mutex
+	streams    map[int]*rtprelay.Stream // SDP中m行的序号 -> 媒体流
+	lastActive atomic.Int64
+	closed     bool
+}
+
+func (c *call) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *call) idle() time.Duration {
+	return time.Since(time.Unix(0, c.lastActive.Load()))
+}
+
+// 关闭所有媒体流的中转端口，返回关闭的媒体流数量
+func (c *call) close() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0
+	}
+	c.closed = true
+	for _, s := range c.streams {
+		s.Close()
+	}
+	return len(c.streams)
+}
@@ -0,0 +1,84 @@
+package sip
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// 一条SIP请求或响应，只解析转发需要的头部
+type message struct {
+	method      string // 请求的方法，例如 "INVITE"，响应为空
+	callID      string
+	contentType string
+	header      []byte // 起始行和头部，不含分隔头部和消息体的空行
+	body        []byte
+}
+
+// 解析SIP消息，不是SIP消息(例如保活用的空行)时返回false
+func parseMessage(b []byte) (*message, bool) {
+	sep := []byte("\r\n\r\n")
+	end := bytes.Index(b, sep)
+	if end < 0 {
+		sep = []byte("\n\n")
+		if end = bytes.Index(b, sep); end < 0 {
+			return nil, false
+		}
+	}
+	m := &message{header: b[:end], body: b[end+len(sep):]}
+
+	lines := strings.Split(string(m.header), "\n")
+	start := strings.TrimSpace(lines[0])
+	if !strings.HasPrefix(start, "SIP/2.0 ") {
+		method, _, ok := strings.Cut(start, " ")
+		if !ok || !strings.HasSuffix(start, "SIP/2.0") {
+			return nil, false
+		}
+		m.method = strings.ToUpper(method)
+	}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "call-id", "i":
+			m.callID = value
+		case "content-type", "c":
+			m.contentType = strings.ToLower(value)
+		}
+	}
+	return m, true
+}
+
+// 判断消息体是否为SDP
+func (m *message) hasSDP() bool {
+	return len(m.body) > 0 && strings.HasPrefix(m.contentType, "application/sdp")
+}
+
+// 以新的消息体重新组装消息并更新Content-Length
+func (m *message) withBody(body []byte) []byte {
+	lines := strings.Split(string(m.header), "\n")
+	for i, line := range lines {
+		name, _, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if n := strings.ToLower(strings.TrimSpace(name)); n == "content-length" || n == "l" {
+			lines[i] = name + ": " + strconv.Itoa(len(body))
+			if strings.HasSuffix(line, "\r") {
+				lines[i] += "\r"
+			}
+		}
+	}
+	var b bytes.Buffer
+	b.WriteString(strings.Join(lines, "\n"))
+	if bytes.Contains(m.header, []byte("\r\n")) {
+		b.WriteString("\r\n\r\n")
+	} else {
+		b.WriteString("\n\n")
+	}
+	b.Write(body)
+	return b.Bytes()
+}
@@ -0,0 +1,156 @@
+package sip
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Mxmilu666/nia-forwarding/rtprelay"
+)
+
+func TestParseMessage(t *testing.T) {
+	invite := "INVITE sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.1:5060\r\n" +
+		"Call-ID: a84b4c76e66710@pc33\r\n" +
+		"Content-Type: Application/SDP\r\n" +
+		"Content-Length: 4\r\n\r\n" +
+		"v=0\n"
+
+	tests := []struct {
+		name        string
+		in          string
+		method      string
+		callID      string
+		contentType string
+		body        string
+	}{
+		{"请求", invite, "INVITE", "a84b4c76e66710@pc33", "application/sdp", "v=0\n"},
+		{"小写方法", "bye sip:bob@example.com SIP/2.0\r\ni: x\r\n\r\n", "BYE", "x", "", ""},
+		{"响应没有方法", "SIP/2.0 200 OK\r\nCall-ID: y\r\n\r\n", "", "y", "", ""},
+		{"紧凑头部和LF换行", "ACK sip:a SIP/2.0\ni:  z \nc: application/sdp\n\nbody", "ACK", "z", "application/sdp", "body"},
+		{"没有冒号的头部行被忽略", "OPTIONS sip:a SIP/2.0\r\nbroken\r\nCall-ID: w\r\n\r\n", "OPTIONS", "w", "", ""},
+		{"消息体中的空行不影响头部", "MESSAGE sip:a SIP/2.0\r\n\r\nCall-ID: no\r\n\r\n", "MESSAGE", "", "", "Call-ID: no\r\n\r\n"},
+		{"超长头部", "NOTIFY sip:a SIP/2.0\r\nCall-ID: " + strings.Repeat("c", maxPacketSize) + "\r\n\r\n",
+			"NOTIFY", strings.Repeat("c", maxPacketSize), "", ""},
+	}
+	for _, tt := range tests {
+		m, ok := parseMessage([]byte(tt.in))
+		if !ok {
+			t.Errorf("%s: 没有被识别为SIP消息", tt.name)
+			continue
+		}
+		if m.method != tt.method {
+			t.Errorf("%s: 方法为%q，应为%q", tt.name, m.method, tt.method)
+		}
+		if m.callID != tt.callID {
+			t.Errorf("%s: Call-ID为%.20q，应为%.20q", tt.name, m.callID, tt.callID)
+		}
+		if m.contentType != tt.contentType {
+			t.Errorf("%s: Content-Type为%q，应转为小写的%q", tt.name, m.contentType, tt.contentType)
+		}
+		if string(m.body) != tt.body {
+			t.Errorf("%s: 消息体为%q，应为%q", tt.name, m.body, tt.body)
+		}
+	}
+}
+
+// 保活数据包和其他协议的数据原样转发，不能被当作SIP消息改写
+func TestParseMessageRejects(t *testing.T) {
+	invite := "INVITE sip:bob@example.com SIP/2.0\r\nCall-ID: a84b4c76e66710@pc33\r\n\r\nv=0\n"
+	for name, in := range map[string]string{
+		"保活空行":        "\r\n\r\n",
+		"头部截断":        invite[:40],
+		"缺少空行":        strings.TrimSuffix(invite, "\r\n\r\nv=0\n"),
+		"起始行没有版本":     "INVITE sip:bob@example.com\r\n\r\n",
+		"起始行只有一个词":    "SIP/2.0\r\n\r\n",
+		"版本不是SIP/2.0": "INVITE sip:bob@example.com HTTP/1.1\r\n\r\n",
+		"二进制数据":       "\x00\x01\x02\xff\r\n\r\n",
+		"超长数据包没有空行":   strings.Repeat("x", maxPacketSize),
+	} {
+		if m, ok := parseMessage([]byte(in)); ok {
+			t.Errorf("%s被解析为方法为%q的SIP消息", name, m.method)
+		}
+	}
+}
+
+func TestParseSDP(t *testing.T) {
+	relayed := func(ip string, port, rtcp int) media {
+		return media{rtp: &net.UDPAddr{IP: net.ParseIP(ip), Port: port}, rtcp: rtcp}
+	}
+
+	tests := []struct {
+		name  string
+		in    string
+		media []media
+	}{
+		{"会话级地址", "v=0\r\nc=IN IP4 10.0.0.1\r\nm=audio 4000 RTP/AVP 0\r\n",
+			[]media{relayed("10.0.0.1", 4000, 4001)}},
+		{"媒体级地址覆盖会话级地址", "c=IN IP4 10.0.0.1\nm=audio 4000 RTP/AVP 0\nm=video 5000 RTP/AVP 96\nc=IN IP6 fd00::2\n",
+			[]media{relayed("10.0.0.1", 4000, 4001), relayed("fd00::2", 5000, 5001)}},
+		{"a=rtcp指定端口", "c=IN IP4 10.0.0.1\nm=audio 4000 RTP/AVP 0\na=rtcp:4100 IN IP4 10.0.0.1\n",
+			[]media{relayed("10.0.0.1", 4000, 4100)}},
+		{"带端口数量的m行", "c=IN IP4 10.0.0.1\nm=audio 4000/2 RTP/AVP 0\n",
+			[]media{relayed("10.0.0.1", 4000, 4001)}},
+		{"a=rtcp超出范围时使用RTP端口+1", "c=IN IP4 10.0.0.1\nm=audio 4000 RTP/AVP 0\na=rtcp:99999\n",
+			[]media{relayed("10.0.0.1", 4000, 4001)}},
+		{"a=rtcp为空时使用RTP端口+1", "c=IN IP4 10.0.0.1\nm=audio 4000 RTP/AVP 0\na=rtcp:\n",
+			[]media{relayed("10.0.0.1", 4000, 4001)}},
+		{"超长行", "c=IN IP4 10.0.0.1\nm=audio 4000 RTP/AVP" + strings.Repeat(" 0", maxPacketSize/2) + "\n",
+			[]media{relayed("10.0.0.1", 4000, 4001)}},
+		{"没有媒体流", "v=0\r\nc=IN IP4 10.0.0.1\r\n", nil},
+		{"端口为0", "c=IN IP4 10.0.0.1\nm=audio 0 RTP/AVP 0\n", []media{{}}},
+		{"端口超出范围", "c=IN IP4 10.0.0.1\nm=audio 70000 RTP/AVP 0\n", []media{{}}},
+		{"端口不是数字", "c=IN IP4 10.0.0.1\nm=audio abc RTP/AVP 0\n", []media{{}}},
+		{"m行截断", "c=IN IP4 10.0.0.1\nm=audio\n", []media{{}}},
+		{"保持通话", "c=IN IP4 0.0.0.0\nm=audio 4000 RTP/AVP 0\n", []media{{}}},
+		{"组播地址", "m=audio 4000 RTP/AVP 0\nc=IN IP4 224.2.1.1/127\n", []media{{}}},
+		{"c行截断", "c=IN IP4\nm=audio 4000 RTP/AVP 0\n", []media{{}}},
+		{"c行地址无效", "c=IN IP4 not-an-ip\nm=audio 4000 RTP/AVP 0\n", []media{{}}},
+		{"没有c行", "m=audio 4000 RTP/AVP 0\n", []media{{}}},
+	}
+	for _, tt := range tests {
+		s := parseSDP([]byte(tt.in))
+		if len(s.media) != len(tt.media) {
+			t.Errorf("%s: 解析出%d个媒体流，应为%d个", tt.name, len(s.media), len(tt.media))
+			continue
+		}
+		for i, m := range s.media {
+			want := tt.media[i]
+			switch {
+			case want.rtp == nil && m.rtp != nil:
+				t.Errorf("%s: 不应转发的第%d个媒体流被转发到%v", tt.name, i+1, m.rtp)
+			case want.rtp != nil && m.rtp == nil:
+				t.Errorf("%s: 第%d个媒体流没有被转发", tt.name, i+1)
+			case want.rtp != nil && (!m.rtp.IP.Equal(want.rtp.IP) || m.rtp.Port != want.rtp.Port || m.rtcp != want.rtcp):
+				t.Errorf("%s: 第%d个媒体流为%v，RTCP端口%d，应为%v，RTCP端口%d", tt.name, i+1, m.rtp, m.rtcp, want.rtp, want.rtcp)
+			}
+		}
+	}
+}
+
+// 改写时保持原来的换行风格
+func TestParseSDPLineEndings(t *testing.T) {
+	if s := parseSDP([]byte("v=0\r\nm=audio 4000 RTP/AVP 0\r\n")); !s.crlf {
+		t.Error("CRLF换行的SDP没有记录为CRLF")
+	}
+	if s := parseSDP([]byte("v=0\nm=audio 4000 RTP/AVP 0\n")); s.crlf {
+		t.Error("LF换行的SDP被记录为CRLF")
+	}
+}
+
+// 改写后的SDP再次解析应指向中转地址，未转发的媒体流保持原样
+func TestSDPRewrite(t *testing.T) {
+	in := "v=0\r\nc=IN IP4 10.0.0.1\r\nm=audio 4000 RTP/AVP 0\r\na=rtcp:4100 IN IP4 10.0.0.1\r\nm=video 0 RTP/AVP 96\r\n"
+	out := parseSDP([]byte(in)).rewrite(net.ParseIP("192.0.2.9"), map[int]rtprelay.Ports{0: {RTP: 30000, RTCP: 30001}})
+	if !bytes.HasSuffix(out, []byte("\r\n")) || bytes.Contains(bytes.ReplaceAll(out, []byte("\r\n"), nil), []byte("\n")) {
+		t.Fatalf("改写后混用了换行: %q", out)
+	}
+	s := parseSDP(out)
+	if len(s.media) != 2 || s.media[1].rtp != nil {
+		t.Fatalf("改写改变了未转发的媒体流: %q", out)
+	}
+	if m := s.media[0]; !m.rtp.IP.Equal(net.ParseIP("192.0.2.9")) || m.rtp.Port != 30000 || m.rtcp != 30001 {
+		t.Errorf("改写后媒体流指向%v，RTCP端口%d，应指向中转地址192.0.2.9:30000/30001", m.rtp, m.rtcp)
+	}
+}
@@ -0,0 +1,405 @@
+// Package sip 转发UDP上的SIP信令，并按信令中SDP协商的RTP/RTCP地址自动建立临时的媒体转发，
+// 使VoIP通话无需映射大段静态端口即可穿过转发。
+//
+// 客户端发出的SDP中的媒体地址改写为本机目标侧的中转端口，目标发出的SDP中的媒体地址改写为
+// 公布给客户端的地址上的中转端口，中转端口收到的媒体数据发往对端在SDP中给出的地址；收到对端
+// 的数据后改为发往数据的来源地址，以适应NAT后的话机。Via、Contact等信令头部不改写，目标需要
+// 按数据包来源回复(rport)。通话以BYE或CANCEL结束，或媒体流空闲超时后关闭中转端口
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/bindretry"
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/rtprelay"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+)
+
+// DefaultSessionTimeout 信令会话的默认空闲超时
+const DefaultSessionTimeout = 3 * time.Minute
+
+// UDP数据包的最大长度
+const maxPacketSize = 65535
+
+var errCallEnded = errors.New("通话已结束")
+
+// Options SIP转发的可选配置
+type Options struct {
+	Log *logging.Logger // 规则的日志级别，nil为info
+
+	// 在SDP中公布给客户端的本机地址，nil时使用监听地址；监听地址为通配地址时必须设置
+	AdvertiseIP net.IP
+	// 媒体中转使用的端口，每个媒体流占用连续的4个端口，为空时使用10000-19999
+	MediaPorts []int
+
+	SessionTimeout time.Duration // 信令会话的空闲超时，0为DefaultSessionTimeout
+	MediaTimeout   time.Duration // 通话的媒体流空闲超时，0为DefaultMediaTimeout
+
+	BindRetry time.Duration // 监听地址被占用时重试绑定的时长，0为不重试
+
+	Stats *stats.Rule  // 流量统计，信令会话计为连接，信令和媒体的流量都计入
+	Quota *quota.Quota // 流量配额，用尽后丢弃信令和媒体数据
+
+	Health *health.Tracker // 监听成功后标记为就绪，退出时标记为未就绪
+}
+
+// Proxy 转发一个端口上的SIP信令和对应的媒体流
+type Proxy struct {
+	proxyID    string
+	listenAddr string
+	targetAddr string
+	opts       Options
+
+	ports     *rtprelay.Allocator
+	listenIP  net.IP // 客户端侧中转端口绑定的地址
+	advertise net.IP
+
+	mu       sync.Mutex
+	sessions map[string]*session // 客户端地址 -> 信令会话
+	calls    map[string]*call    // Call-ID -> 通话
+}
+
+// 一个客户端的信令会话
+type session struct {
+	key        string
+	tag        string
+	log        *logging.Logger
+	client     net.Addr
+	conn       *net.UDPConn // 连接目标的套接字
+	localIP    net.IP       // 本机连接目标使用的地址，目标侧中转端口绑定并公布该地址
+	started    time.Time
+	lastActive atomic.Int64
+}
+
+func (s *session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// NewProxy 创建SIP转发，targetAddr为SIP服务器 "host:port"
+func NewProxy(proxyID, listenAddr, targetAddr string, opts Options) *Proxy {
+	if opts.SessionTimeout <= 0 {
+		opts.SessionTimeout = DefaultSessionTimeout
+	}
+	if opts.MediaTimeout <= 0 {
+		opts.MediaTimeout = DefaultMediaTimeout
+	}
+	return &Proxy{
+		proxyID:    proxyID,
+		listenAddr: listenAddr,
+		targetAddr: targetAddr,
+		opts:       opts,
+		ports:      rtprelay.NewAllocator(opts.MediaPorts),
+		sessions:   make(map[string]*session),
+		calls:      make(map[string]*call),
+	}
+}
+
+// Start 监听SIP信令并转发，直到上下文取消
+func (p *Proxy) Start(ctx context.Context) error {
+	laddr, err := net.ResolveUDPAddr("udp", p.listenAddr)
+	if err != nil {
+		return fmt.Errorf("无法解析UDP监听地址: %w", err)
+	}
+	target, err := net.ResolveUDPAddr("udp", p.targetAddr)
+	if err != nil {
+		return fmt.Errorf("无法解析目标地址: %w", err)
+	}
+	p.listenIP = laddr.IP
+	p.advertise = p.opts.AdvertiseIP
+	if p.advertise == nil {
+		if laddr.IP == nil || laddr.IP.IsUnspecified() {
+			return errors.New("监听地址为通配地址时需要指定在SDP中公布的地址")
+		}
+		p.advertise = laddr.IP
+	}
+	if !p.ports.Usable() {
+		return errors.New("媒体端口范围中没有连续的4个可用端口")
+	}
+
+	conn, err := bindretry.Listen(ctx, p.opts.BindRetry, func(err error, wait time.Duration) {
+		p.opts.Log.Warnf("[%s] 监听地址被占用，%v后重试: %v", p.proxyID, wait, err)
+	}, func() (*net.UDPConn, error) {
+		return net.ListenUDP("udp", laddr)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("无法监听UDP: %w", err)
+	}
+	defer conn.Close()
+
+	p.opts.Log.Infof("[%s] SIP转发已启动: %s -> %s", p.proxyID, p.listenAddr, p.targetAddr)
+	p.opts.Health.SetReady(p.proxyID, true)
+	defer p.opts.Health.SetReady(p.proxyID, false)
+
+	context.AfterFunc(ctx, func() {
+		conn.Close()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, s := range p.sessions {
+			s.conn.Close()
+		}
+		for _, c := range p.calls {
+			c.close()
+		}
+	})
+	go p.reap(ctx)
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			p.opts.Log.Warnf("[%s] UDP读取错误: %v", p.proxyID, err)
+			p.opts.Stats.AddError()
+			continue
+		}
+		if exceeded, first := p.opts.Quota.Exceeded(); exceeded {
+			if first {
+				p.opts.Log.Warnf("[%s] 流量配额已用尽，本周期内丢弃所有数据包", p.proxyID)
+			}
+			p.opts.Stats.AddDropped()
+			continue
+		}
+
+		s, err := p.session(conn, client, target)
+		if err != nil {
+			p.opts.Log.Warnf("[%s] 无法连接目标 %s: %v", p.proxyID, target, err)
+			p.opts.Stats.AddTargetError(p.targetAddr, err, true)
+			p.opts.Stats.AddDropped()
+			continue
+		}
+		s.touch()
+		out := p.process(s, buf[:n], true)
+		if _, err := s.conn.Write(out); err != nil {
+			s.log.Debugf("[%s] 发送到目标失败: %v", s.tag, err)
+			p.opts.Stats.AddError()
+			continue
+		}
+		p.opts.Stats.AddUp(int64(len(out)))
+		p.opts.Quota.Add(int64(len(out)))
+	}
+}
+
+// 返回客户端的信令会话，不存在时连接目标并创建
+func (p *Proxy) session(listener net.PacketConn, client net.Addr, target *net.UDPAddr) (*session, error) {
+	key := client.String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.sessions[key]; ok {
+		return s, nil
+	}
+
+	conn, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		key:     key,
+		tag:     logging.Tag(p.proxyID, logging.NewConnID()),
+		log:     p.opts.Log.Conn(),
+		client:  client,
+		conn:    conn,
+		localIP: conn.LocalAddr().(*net.UDPAddr).IP,
+		started: time.Now(),
+	}
+	p.sessions[key] = s
+	p.opts.Stats.ConnOpened()
+	s.log.Infof("[%s] SIP会话创建: %s -> %s", s.tag, client, target)
+	p.opts.Stats.Go(func() { p.serveSession(listener, s) })
+	return s, nil
+}
+
+// 把目标发来的信令转发给客户端，直到会话被关闭
+func (p *Proxy) serveSession(listener net.PacketConn, s *session) {
+	defer func() {
+		p.mu.Lock()
+		if p.sessions[s.key] == s {
+			delete(p.sessions, s.key)
+		}
+		p.mu.Unlock()
+		s.conn.Close()
+		p.opts.Stats.ConnClosed()
+		p.opts.Stats.ConnFinished(time.Since(s.started), 0)
+		s.log.Infof("[%s] SIP会话关闭: %s, 持续%s", s.tag, s.key, time.Since(s.started).Round(time.Second))
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// 目标暂时不可达(ICMP端口不可达)时保留会话，由空闲超时关闭
+			continue
+		}
+		if exceeded, _ := p.opts.Quota.Exceeded(); exceeded {
+			p.opts.Stats.AddDropped()
+			continue
+		}
+		s.touch()
+		out := p.process(s, buf[:n], false)
+		if _, err := listener.WriteTo(out, s.client); err != nil {
+			s.log.Debugf("[%s] 发送到客户端失败: %v", s.tag, err)
+			p.opts.Stats.AddError()
+			continue
+		}
+		p.opts.Stats.AddDown(int64(len(out)))
+		p.opts.Quota.Add(int64(len(out)))
+	}
+}
+
+// 处理一条信令：BYE和CANCEL结束通话，带SDP的消息为其中的媒体流分配中转端口并改写地址；
+// fromClient表示信令由客户端发往目标。无法分配端口时原样转发
+func (p *Proxy) process(s *session, b []byte, fromClient bool) []byte {
+	m, ok := parseMessage(b)
+	if !ok || m.callID == "" {
+		return b
+	}
+	if m.method == "BYE" || m.method == "CANCEL" {
+		p.endCall(s, m.callID)
+		return b
+	}
+	if !m.hasSDP() {
+		return b
+	}
+
+	desc := parseSDP(m.body)
+	c := p.call(m.callID)
+	relayed := make(map[int]rtprelay.Ports)
+	for i, md := range desc.media {
+		if md.rtp == nil {
+			continue
+		}
+		st, err := p.stream(s, c, i)
+		if err != nil {
+			p.opts.Log.Warnf("[%s] 无法为通话%s分配媒体中转端口，原样转发SDP: %v", s.tag, c.id, err)
+			return b
+		}
+		rtcp := &net.UDPAddr{IP: md.rtp.IP, Port: md.rtcp}
+		if fromClient {
+			st.SetClient(md.rtp, rtcp, addrIP(s.client))
+			relayed[i] = st.TargetPorts()
+		} else {
+			st.SetTarget(md.rtp, rtcp, addrIP(s.conn.RemoteAddr()))
+			relayed[i] = st.ClientPorts()
+		}
+	}
+	if len(relayed) == 0 {
+		return b
+	}
+	c.touch()
+
+	ip := p.advertise
+	if fromClient {
+		ip = s.localIP
+	}
+	return m.withBody(desc.rewrite(ip, relayed))
+}
+
+// 返回UDP地址的IP，媒体流只接受来自信令两端和SDP中地址的数据
+func addrIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a.IP
+	}
+	return nil
+}
+
+// 返回Call-ID对应的通话，不存在或已结束时创建
+func (p *Proxy) call(id string) *call {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.calls[id]; ok {
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if !closed {
+			return c
+		}
+	}
+	c := &call{id: id, streams: make(map[int]*rtprelay.Stream)}
+	c.touch()
+	p.calls[id] = c
+	return c
+}
+
+// 返回通话中第index个媒体流，不存在时分配中转端口并开始转发
+func (p *Proxy) stream(s *session, c *call, index int) (*rtprelay.Stream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errCallEnded
+	}
+	if st, ok := c.streams[index]; ok {
+		return st, nil
+	}
+	st, err := p.ports.Allocate(p.listenIP, s.localIP)
+	if err != nil {
+		return nil, err
+	}
+	c.streams[index] = st
+	s.log.Infof("[%s] 通话%s的媒体流%d使用中转端口%d-%d", s.tag, c.id, index, st.Base, st.Base+3)
+	st.Start(p.opts.Stats, p.opts.Quota, c.touch)
+	return st, nil
+}
+
+// 结束通话并关闭其媒体转发
+func (p *Proxy) endCall(s *session, id string) {
+	p.mu.Lock()
+	c, ok := p.calls[id]
+	delete(p.calls, id)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	if n := c.close(); n > 0 {
+		s.log.Infof("[%s] 通话%s结束，已关闭%d个媒体转发", s.tag, id, n)
+	}
+}
+
+// 定期关闭空闲的信令会话和通话
+func (p *Proxy) reap(ctx context.Context) {
+	ticker := time.NewTicker(min(max(min(p.opts.SessionTimeout, p.opts.MediaTimeout)/2, time.Second), 30*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var idleCalls []*call
+		p.mu.Lock()
+		for _, s := range p.sessions {
+			if time.Since(time.Unix(0, s.lastActive.Load())) > p.opts.SessionTimeout {
+				s.conn.Close()
+			}
+		}
+		for id, c := range p.calls {
+			if c.idle() > p.opts.MediaTimeout {
+				delete(p.calls, id)
+				idleCalls = append(idleCalls, c)
+			}
+		}
+		p.mu.Unlock()
+
+		for _, c := range idleCalls {
+			if n := c.close(); n > 0 {
+				p.opts.Log.Infof("[%s] 通话%s的媒体流空闲超过%s，已关闭%d个媒体转发", p.proxyID, c.id, p.opts.MediaTimeout, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package sip
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Mxmilu666/nia-forwarding/rtprelay"
+)
+
+// SDP中一个媒体流(m行)的地址
+type media struct {
+	rtp  *net.UDPAddr // nil表示不转发：端口为0、地址未指定(保持通话)或为组播地址
+	rtcp int          // RTCP端口，没有a=rtcp属性时为RTP端口+1
+}
+
+// 解析后的SDP，按行保存以便改写
+type sdp struct {
+	lines []string // 不含行尾
+	crlf  bool
+	media []media
+}
+
+func parseSDP(body []byte) *sdp {
+	text := string(body)
+	s := &sdp{crlf: strings.Contains(text, "\r\n")}
+	s.lines = strings.Split(strings.TrimRight(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), "\n")
+
+	var session net.IP
+	type section struct {
+		ip         net.IP
+		ipSet      bool
+		port, rtcp int
+	}
+	var sections []section
+	for _, line := range s.lines {
+		switch {
+		case strings.HasPrefix(line, "m="):
+			fields := strings.Fields(line[2:])
+			port := 0
+			if len(fields) >= 2 {
+				p, _, _ := strings.Cut(fields[1], "/")
+				port, _ = strconv.Atoi(p)
+			}
+			sections = append(sections, section{port: port})
+		case strings.HasPrefix(line, "c="):
+			ip := connectionIP(line)
+			if len(sections) == 0 {
+				session = ip
+			} else {
+				sections[len(sections)-1].ip = ip
+				sections[len(sections)-1].ipSet = true
+			}
+		case strings.HasPrefix(line, "a=rtcp:") && len(sections) > 0:
+			fields := strings.Fields(line[len("a=rtcp:"):])
+			if len(fields) > 0 {
+				sections[len(sections)-1].rtcp, _ = strconv.Atoi(fields[0])
+			}
+		}
+	}
+
+	for _, sec := range sections {
+		ip := session
+		if sec.ipSet {
+			ip = sec.ip
+		}
+		if ip == nil || sec.port <= 0 || sec.port > 65535 {
+			s.media = append(s.media, media{})
+			continue
+		}
+		rtcp := sec.rtcp
+		if rtcp <= 0 || rtcp > 65535 {
+			rtcp = sec.port + 1
+		}
+		s.media = append(s.media, media{rtp: &net.UDPAddr{IP: ip, Port: sec.port}, rtcp: rtcp})
+	}
+	return s
+}
+
+// 取c=行中的单播地址，地址未指定或为组播时返回nil
+func connectionIP(line string) net.IP {
+	fields := strings.Fields(line[2:])
+	if len(fields) < 3 {
+		return nil
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || ip.IsUnspecified() || ip.IsMulticast() {
+		return nil
+	}
+	return ip
+}
+
+// 把relayed中的媒体流改为经ip上的中转端口收发，返回新的SDP
+func (s *sdp) rewrite(ip net.IP, relayed map[int]rtprelay.Ports) []byte {
+	addrType := "IP4"
+	if ip.To4() == nil {
+		addrType = "IP6"
+	}
+	conn := "IN " + addrType + " " + ip.String()
+
+	lines := make([]string, len(s.lines))
+	index := -1
+	for i, line := range s.lines {
+		lines[i] = line
+		p, ok := relayed[index]
+		switch {
+		case strings.HasPrefix(line, "m="):
+			index++
+			p, ok = relayed[index]
+			fields := strings.Fields(line[2:])
+			if ok && len(fields) >= 2 {
+				fields[1] = strconv.Itoa(p.RTP)
+				lines[i] = "m=" + strings.Join(fields, " ")
+			}
+		case strings.HasPrefix(line, "c="):
+			// 会话级的c=行由各媒体流共用，不转发的媒体流端口为0或有自己的c=行
+			if connectionIP(line) != nil && (index < 0 || ok) {
+				lines[i] = "c=" + conn
+			}
+		case strings.HasPrefix(line, "a=rtcp:") && ok:
+			fields := strings.Fields(line[len("a=rtcp:"):])
+			lines[i] = "a=rtcp:" + strconv.Itoa(p.RTCP)
+			if len(fields) > 1 {
+				lines[i] += " " + conn
+			}
+		}
+	}
+
+	eol := "\n"
+	if s.crlf {
+		eol = "\r\n"
+	}
+	return []byte(strings.Join(lines, eol) + eol)
+}
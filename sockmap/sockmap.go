@@ -0,0 +1,8 @@
+// Package sockmap 借助eBPF sockmap把已建立的客户端连接与目标连接在内核中对接，
+// 数据由内核直接从一端的接收方向转发到另一端的发送方向，不再复制到用户态，仅Linux支持
+package sockmap
+
+import "time"
+
+// DefaultDrainTimeout 一个方向结束后等待内核把已收到的数据转发到对端的最长时间
+const DefaultDrainTimeout = time.Second
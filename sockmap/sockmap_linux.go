@@ -0,0 +1,254 @@
+//go:build linux
+
+package sockmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Mxmilu666/nia-forwarding/ebpf"
+)
+
+// 每个表最多容纳的套接字数量，每对连接在两个表中各占两项
+const maxEntries = 1 << 16
+
+// verdictProgram 返回SK_SKB流判决程序：以收到数据的套接字的cookie为键，在peers中查找对端套接字，
+// 把数据重定向到对端的发送方向
+//
+//	r6 = r1
+//	r0 = bpf_get_socket_cookie(r1)
+//	*(u64 *)(r10 - 8) = r0
+//	return bpf_sk_redirect_hash(r6, peers, r10 - 8, 0)
+func verdictProgram(peers int) []ebpf.Insn {
+	var a ebpf.Asm
+	a.Emit(
+		ebpf.MovReg(ebpf.R6, ebpf.R1),
+		ebpf.Call(ebpf.FuncGetSocketCookie),
+		ebpf.Store(unix.BPF_DW, ebpf.R10, -8, ebpf.R0),
+		ebpf.MovReg(ebpf.R1, ebpf.R6),
+	)
+	a.Emit(ebpf.LoadMap(ebpf.R2, peers)...)
+	a.Emit(
+		ebpf.MovReg(ebpf.R3, ebpf.R10),
+		ebpf.ALU(unix.BPF_ADD, ebpf.R3, -8),
+		ebpf.Mov(ebpf.R4, 0),
+		ebpf.Call(ebpf.FuncSkRedirectHash),
+		ebpf.Exit(),
+	)
+	insns, _ := a.Program()
+	return insns
+}
+
+// 创建以u64 cookie为键的sockhash
+func createSockhash() (int, error) {
+	return ebpf.CreateMap(unix.BPF_MAP_TYPE_SOCKHASH, 8, 4, maxEntries)
+}
+
+func cookieKey(cookie uint64) []byte {
+	return binary.NativeEndian.AppendUint64(nil, cookie)
+}
+
+func sockValue(fd int) []byte {
+	return binary.NativeEndian.AppendUint32(nil, uint32(fd))
+}
+
+// Accelerator 所有规则共享的sockhash和判决程序
+type Accelerator struct {
+	peers  int // 键为套接字cookie，值为对端套接字，判决程序在其中查找重定向目标
+	splice int // 挂有判决程序的表，套接字加入后收到的数据交给判决程序
+	prog   int
+
+	mu sync.Mutex // 保证一对连接的四个表项按顺序写入
+}
+
+// New 创建表并加载判决程序，内核不支持(低于5.10)或没有CAP_BPF/CAP_NET_ADMIN权限时返回错误
+func New() (*Accelerator, error) {
+	peers, err := createSockhash()
+	if err != nil {
+		return nil, fmt.Errorf("无法创建sockhash: %w", err)
+	}
+	a := &Accelerator{peers: peers, splice: -1, prog: -1}
+	if a.splice, err = createSockhash(); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("无法创建sockhash: %w", err)
+	}
+	if a.prog, err = ebpf.LoadProgram(unix.BPF_PROG_TYPE_SK_SKB, verdictProgram(peers)); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("无法加载判决程序: %w", err)
+	}
+	if err := ebpf.AttachProgram(a.splice, a.prog, unix.BPF_SK_SKB_STREAM_VERDICT); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("无法挂载判决程序: %w", err)
+	}
+	return a, nil
+}
+
+// Close 释放表和程序，已对接的连接在关闭前保持对接
+func (a *Accelerator) Close() {
+	if a == nil {
+		return
+	}
+	for _, fd := range []int{a.prog, a.splice, a.peers} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
+
+// 对接时的一端
+type end struct {
+	conn   *net.TCPConn
+	fd     int
+	cookie uint64
+	recv0  uint64 // 对接时已收到且已被读取的字节数
+	sent0  uint64 // 对接时已写入套接字的字节数
+}
+
+// Pair 一对已对接的连接
+type Pair struct {
+	a              *Accelerator
+	client, target end
+}
+
+// Splice 把一对连接加入sockmap，此后双方收到的数据在内核中转发到对端。
+// 对接前已在接收队列中的数据仍由调用者读取和转发，调用者应继续读取两个连接以发现对端关闭
+func (a *Accelerator) Splice(client, target *net.TCPConn) (*Pair, error) {
+	if a == nil {
+		return nil, errors.New("sockmap加速不可用")
+	}
+	p := &Pair{a: a, client: end{conn: client}, target: end{conn: target}}
+	for _, e := range []*end{&p.client, &p.target} {
+		if err := e.init(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 先写入peers再加入splice，判决程序开始处理某个套接字时其对端一定已在peers中
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	steps := []struct {
+		m   int
+		key uint64
+		fd  int
+	}{
+		{a.peers, p.client.cookie, p.target.fd},
+		{a.peers, p.target.cookie, p.client.fd},
+		{a.splice, p.client.cookie, p.client.fd},
+		{a.splice, p.target.cookie, p.target.fd},
+	}
+	for i, step := range steps {
+		if err := ebpf.UpdateElem(step.m, cookieKey(step.key), sockValue(step.fd)); err != nil {
+			for _, done := range steps[:i] {
+				ebpf.DeleteElem(done.m, cookieKey(done.key))
+			}
+			return nil, fmt.Errorf("无法加入sockmap: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// 读取套接字的cookie和对接时的字节计数；fd在连接关闭前保持有效
+func (e *end) init() error {
+	rawConn, err := e.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		e.fd = int(fd)
+		if e.cookie, sockErr = unix.GetsockoptUint64(e.fd, unix.SOL_SOCKET, unix.SO_COOKIE); sockErr != nil {
+			return
+		}
+		var info *unix.TCPInfo
+		if info, sockErr = unix.GetsockoptTCPInfo(e.fd, unix.IPPROTO_TCP, unix.TCP_INFO); sockErr != nil {
+			return
+		}
+		var inq int
+		if inq, sockErr = unix.IoctlGetInt(e.fd, unix.SIOCINQ); sockErr != nil {
+			return
+		}
+		e.recv0 = received(info) - uint64(inq)
+		e.sent0 = written(info)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// 已收到的数据字节数，收到对端的FIN后序号多占一位
+func received(info *unix.TCPInfo) uint64 {
+	switch info.State {
+	case unix.BPF_TCP_CLOSE_WAIT, unix.BPF_TCP_LAST_ACK, unix.BPF_TCP_CLOSING, unix.BPF_TCP_TIME_WAIT:
+		return info.Bytes_received - 1
+	}
+	return info.Bytes_received
+}
+
+// 已写入套接字的字节数：已发出的不重复字节加上尚未发出的字节
+func written(info *unix.TCPInfo) uint64 {
+	return info.Bytes_sent - info.Bytes_retrans + uint64(info.Notsent_bytes)
+}
+
+func (e *end) info() (*unix.TCPInfo, error) {
+	return unix.GetsockoptTCPInfo(e.fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+}
+
+// Forwarded 返回对接后由内核转发的字节数，goUp和goDown为对接后由调用者读取并转发的字节数，须在连接关闭前调用
+func (p *Pair) Forwarded(goUp, goDown int64) (up, down int64) {
+	if p == nil {
+		return 0, 0
+	}
+	if c, err := p.client.info(); err == nil {
+		up = max(int64(received(c)-p.client.recv0)-goUp, 0)
+	}
+	if t, err := p.target.info(); err == nil {
+		down = max(int64(received(t)-p.target.recv0)-goDown, 0)
+	}
+	return up, down
+}
+
+// Drain 等待一个方向上对接后收到的数据全部写入对端套接字，up为客户端->目标方向，
+// 超过timeout时放弃；用于一端关闭后、关闭两个连接之前，避免丢弃内核中尚未转发的数据
+func (p *Pair) Drain(up bool, timeout time.Duration) {
+	if p == nil {
+		return
+	}
+	src, dst := &p.client, &p.target
+	if !up {
+		src, dst = dst, src
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		srcInfo, err1 := src.info()
+		dstInfo, err2 := dst.info()
+		if err1 != nil || err2 != nil {
+			return
+		}
+		// 对端套接字在对接前可能已写入额外的数据(例如PROXY协议头)，已计入sent0
+		if written(dstInfo)-dst.sent0 >= received(srcInfo)-src.recv0 || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Close 从sockmap中移除这对连接，连接关闭时内核也会自动移除
+func (p *Pair) Close() {
+	if p == nil {
+		return
+	}
+	p.a.mu.Lock()
+	defer p.a.mu.Unlock()
+	ebpf.DeleteElem(p.a.splice, cookieKey(p.client.cookie))
+	ebpf.DeleteElem(p.a.splice, cookieKey(p.target.cookie))
+	ebpf.DeleteElem(p.a.peers, cookieKey(p.client.cookie))
+	ebpf.DeleteElem(p.a.peers, cookieKey(p.target.cookie))
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+
+package sockmap
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errUnsupported = errors.New("仅Linux支持sockmap加速")
+
+// Accelerator 在该平台上不可用
+type Accelerator struct{}
+
+// New 在该平台上返回错误
+func New() (*Accelerator, error) {
+	return nil, errUnsupported
+}
+
+// Close 无操作
+func (a *Accelerator) Close() {}
+
+// Pair 在该平台上不可用
+type Pair struct{}
+
+// Splice 在该平台上返回错误
+func (a *Accelerator) Splice(client, target *net.TCPConn) (*Pair, error) {
+	return nil, errUnsupported
+}
+
+// Forwarded 始终返回0
+func (p *Pair) Forwarded(goUp, goDown int64) (up, down int64) {
+	return 0, 0
+}
+
+// Drain 无操作
+func (p *Pair) Drain(up bool, timeout time.Duration) {}
+
+// Close 无操作
+func (p *Pair) Close() {}
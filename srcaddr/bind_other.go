@@ -0,0 +1,15 @@
+//go:build !windows
+
+package srcaddr
+
+import (
+	"net"
+	"syscall"
+)
+
+// 把套接字绑定到ip，端口由系统分配
+func bindIP(fd uintptr, ip net.IP) error {
+	sa := &syscall.SockaddrInet6{}
+	copy(sa.Addr[:], ip.To16())
+	return syscall.Bind(int(fd), sa)
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package srcaddr
+
+import "golang.org/x/sys/unix"
+
+// linux/in6.h中的源地址偏好标志，x/sys/unix未定义
+const (
+	preferSrcTmp    = 0x0001
+	preferSrcPublic = 0x0002
+)
+
+func checkPreferences() error {
+	return nil
+}
+
+// 设置RFC 5014的源地址偏好(IPV6_ADDR_PREFERENCES)，由内核在连接时选择稳定地址或临时地址
+func setPreferences(fd uintptr, temporary bool) error {
+	flags := preferSrcPublic
+	if temporary {
+		flags = preferSrcTmp
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_ADDR_PREFERENCES, flags)
+}
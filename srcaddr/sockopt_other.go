@@ -0,0 +1,15 @@
+//go:build !linux
+
+package srcaddr
+
+import "errors"
+
+var errPreferences = errors.New("仅Linux支持按稳定地址或临时地址选择源地址")
+
+func checkPreferences() error {
+	return errPreferences
+}
+
+func setPreferences(fd uintptr, temporary bool) error {
+	return errPreferences
+}
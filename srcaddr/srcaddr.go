@@ -0,0 +1,149 @@
+// Package srcaddr 选择直接连接目标时使用的本机IPv6源地址，
+// 用于按来源地址设置白名单的目标
+package srcaddr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 源地址策略
+const (
+	Stable    = "stable"    // 优先使用稳定地址，不使用隐私扩展生成的临时地址
+	Temporary = "temporary" // 优先使用隐私扩展生成的临时地址
+)
+
+// 前缀内本机地址的缓存时间，地址变化后最迟在该时间后生效
+const cacheTTL = 10 * time.Second
+
+// Policy IPv6源地址选择策略，nil表示由系统选择；只作用于IPv6连接
+type Policy struct {
+	spec   string
+	prefer string     // Stable或Temporary
+	prefix *net.IPNet // 不为nil时绑定该前缀内的本机地址
+
+	mu      sync.Mutex
+	cached  net.IP
+	expires time.Time
+}
+
+// Parse 解析源地址策略："stable"、"temporary"或IPv6前缀(例如 "2001:db8:1::/48")，s为空时返回nil
+func Parse(s string) (*Policy, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case Stable, Temporary:
+		if err := checkPreferences(); err != nil {
+			return nil, err
+		}
+		return &Policy{spec: s, prefer: s}, nil
+	}
+
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil || prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("无效的源地址策略 %q，应为stable、temporary或IPv6前缀", s)
+	}
+	return &Policy{spec: s, prefix: prefix}, nil
+}
+
+// String 返回配置中的策略
+func (p *Policy) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.spec
+}
+
+// Dialer 返回按策略选择源地址的Dialer，p为nil时返回普通的Dialer
+func (p *Policy) Dialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if p != nil {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			return p.control(network, c, p.prefix != nil)
+		}
+	}
+	return d
+}
+
+// ListenUDP 创建发往多个地址的未连接UDP套接字，network为udp6时按策略选择源地址
+func (p *Policy) ListenUDP(network string) (*net.UDPConn, error) {
+	if p == nil {
+		return net.ListenUDP(network, nil)
+	}
+
+	var laddr string
+	if p.prefix != nil && network == "udp6" {
+		ip, err := p.localIP()
+		if err != nil {
+			return nil, err
+		}
+		laddr = net.JoinHostPort(ip.String(), "0")
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return p.control(network, c, false)
+	}}
+	conn, err := lc.ListenPacket(context.Background(), network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// 在IPv6套接字连接前设置源地址偏好，或绑定前缀内的本机地址
+func (p *Policy) control(network string, c syscall.RawConn, bind bool) error {
+	if !strings.HasSuffix(network, "6") {
+		return nil
+	}
+
+	var ip net.IP
+	if bind && p.prefix != nil {
+		var err error
+		if ip, err = p.localIP(); err != nil {
+			return err
+		}
+	}
+
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		switch {
+		case p.prefer != "":
+			sockErr = setPreferences(fd, p.prefer == Temporary)
+		case ip != nil:
+			sockErr = bindIP(fd, ip)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// 返回前缀内的一个本机全局IPv6地址，结果缓存cacheTTL
+func (p *Policy) localIP() (net.IP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cached != nil && time.Now().Before(p.expires) {
+		return p.cached, nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if p.prefix.Contains(ipNet.IP) {
+			p.cached, p.expires = ipNet.IP, time.Now().Add(cacheTTL)
+			return p.cached, nil
+		}
+	}
+	return nil, fmt.Errorf("本机没有位于%s内的IPv6地址", p.prefix)
+}
@@ -0,0 +1,140 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ActiveConn 一个正在转发的TCP连接，用于空闲回收和在状态报告中列出最早的连接
+type ActiveConn struct {
+	ID      string
+	Client  string
+	Target  string
+	Started time.Time
+
+	lastActive atomic.Int64 // 最近一次转发数据的时间(UnixNano)
+	reaped     atomic.Bool
+	close      func()
+}
+
+// ConnInfo 状态报告中的一个活动连接
+type ConnInfo struct {
+	Rule     string `json:"rule"`
+	Protocol string `json:"protocol"`
+	ID       string `json:"id"`
+	Client   string `json:"client"`
+	Target   string `json:"target"`
+	Age      int64  `json:"age_seconds"`  // 已持续的秒数
+	Idle     int64  `json:"idle_seconds"` // 距最近一次转发数据的秒数
+
+	started time.Time
+}
+
+type activeConns struct {
+	mu    sync.Mutex
+	conns map[*ActiveConn]struct{}
+}
+
+// Track 登记一个开始转发的连接，close在空闲回收时调用以关闭连接；连接结束时须调用Untrack
+func (r *Rule) Track(id, client, target string, started time.Time, close func()) *ActiveConn {
+	c := &ActiveConn{ID: id, Client: client, Target: target, Started: started, close: close}
+	c.Touch()
+	if r == nil {
+		return c
+	}
+	r.active.mu.Lock()
+	if r.active.conns == nil {
+		r.active.conns = make(map[*ActiveConn]struct{})
+	}
+	r.active.conns[c] = struct{}{}
+	r.active.mu.Unlock()
+	return c
+}
+
+// Untrack 取消登记已结束的连接
+func (r *Rule) Untrack(c *ActiveConn) {
+	if r == nil {
+		return
+	}
+	r.active.mu.Lock()
+	delete(r.active.conns, c)
+	r.active.mu.Unlock()
+}
+
+// Touch 记录连接上有数据转发
+func (c *ActiveConn) Touch() {
+	if c != nil {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+}
+
+// Idle 返回连接距最近一次转发数据的时长
+func (c *ActiveConn) Idle() time.Duration {
+	return time.Since(time.Unix(0, c.lastActive.Load()))
+}
+
+// Reap 关闭空闲超过idle的连接，返回本次回收的数量；同一连接只回收一次
+func (r *Rule) Reap(idle time.Duration) int {
+	if r == nil || idle <= 0 {
+		return 0
+	}
+	var expired []*ActiveConn
+	r.active.mu.Lock()
+	for c := range r.active.conns {
+		if c.Idle() > idle && c.reaped.CompareAndSwap(false, true) {
+			expired = append(expired, c)
+		}
+	}
+	r.active.mu.Unlock()
+
+	for _, c := range expired {
+		c.close()
+	}
+	r.Reaped.Add(uint64(len(expired)))
+	return len(expired)
+}
+
+// 返回最早开始的活动连接已持续的秒数，没有活动连接时返回0
+func (r *Rule) oldestAge() uint64 {
+	var oldest time.Time
+	r.active.mu.Lock()
+	for c := range r.active.conns {
+		if oldest.IsZero() || c.Started.Before(oldest) {
+			oldest = c.Started
+		}
+	}
+	r.active.mu.Unlock()
+	if oldest.IsZero() {
+		return 0
+	}
+	return uint64(time.Since(oldest).Seconds())
+}
+
+// OldestConns 返回所有规则中最早开始的n个活动连接，按开始时间排列
+func OldestConns(n int) []ConnInfo {
+	now := time.Now()
+	var list []ConnInfo
+	for _, r := range All() {
+		r.active.mu.Lock()
+		for c := range r.active.conns {
+			list = append(list, ConnInfo{
+				Rule:     r.Name,
+				Protocol: r.Protocol,
+				ID:       c.ID,
+				Client:   c.Client,
+				Target:   c.Target,
+				Age:      int64(now.Sub(c.Started).Seconds()),
+				Idle:     int64(c.Idle().Seconds()),
+				started:  c.Started,
+			})
+		}
+		r.active.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].started.Before(list[j].started) })
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
@@ -0,0 +1,112 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrorClass 转发错误的类别，用于区分目标不可用和客户端异常断开
+type ErrorClass string
+
+const (
+	ErrDialTimeout  ErrorClass = "dial_timeout"  // 连接目标超时
+	ErrRefused      ErrorClass = "refused"       // 目标拒绝连接
+	ErrUnreachable  ErrorClass = "unreachable"   // 目标网络或主机不可达
+	ErrReset        ErrorClass = "reset"         // 连接被对端重置或管道已断开
+	ErrReadTimeout  ErrorClass = "read_timeout"  // 转发过程中读取超时
+	ErrWriteTimeout ErrorClass = "write_timeout" // 转发过程中写入超时
+	ErrOther        ErrorClass = "other"
+)
+
+// PeerClient 作为AddTargetError的目标，表示错误发生在客户端一端，例如客户端重置连接
+const PeerClient = "client"
+
+// Classify 判断错误的类别，dialing表示错误发生在连接目标时
+func Classify(err error, dialing bool) ErrorClass {
+	switch {
+	case isRefused(err):
+		return ErrRefused
+	case isUnreachable(err):
+		return ErrUnreachable
+	case isReset(err):
+		return ErrReset
+	}
+
+	var netErr net.Error
+	timeout := errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+	if !timeout {
+		return ErrOther
+	}
+	if dialing {
+		return ErrDialTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "write" {
+		return ErrWriteTimeout
+	}
+	return ErrReadTimeout
+}
+
+// 按目标和类别的错误计数
+type errorKey struct {
+	target string
+	class  ErrorClass
+}
+
+type errorCounts struct {
+	mu     sync.Mutex
+	counts map[errorKey]*atomic.Uint64
+}
+
+// ClassifiedError 按目标和类别统计的错误次数
+type ClassifiedError struct {
+	Target string
+	Class  ErrorClass
+	Count  uint64
+}
+
+// AddTargetError 记录一次与目标相关的错误，同时计入Errors和按目标、类别的计数
+func (r *Rule) AddTargetError(target string, err error, dialing bool) {
+	if r == nil {
+		return
+	}
+	r.Errors.Add(1)
+
+	key := errorKey{target: target, class: Classify(err, dialing)}
+	r.errors.mu.Lock()
+	if r.errors.counts == nil {
+		r.errors.counts = make(map[errorKey]*atomic.Uint64)
+	}
+	n, ok := r.errors.counts[key]
+	if !ok {
+		n = new(atomic.Uint64)
+		r.errors.counts[key] = n
+	}
+	r.errors.mu.Unlock()
+	n.Add(1)
+}
+
+// ClassifiedErrors 返回按目标和类别统计的错误次数，按目标和类别排序
+func (r *Rule) ClassifiedErrors() []ClassifiedError {
+	if r == nil {
+		return nil
+	}
+	r.errors.mu.Lock()
+	list := make([]ClassifiedError, 0, len(r.errors.counts))
+	for key, n := range r.errors.counts {
+		list = append(list, ClassifiedError{Target: key.target, Class: key.class, Count: n.Load()})
+	}
+	r.errors.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Target != list[j].Target {
+			return list[i].Target < list[j].Target
+		}
+		return list[i].Class < list[j].Class
+	})
+	return list
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package stats
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+func isRefused(err error) bool {
+	return errors.Is(err, windows.WSAECONNREFUSED)
+}
+
+func isUnreachable(err error) bool {
+	return errors.Is(err, windows.WSAEHOSTUNREACH) || errors.Is(err, windows.WSAENETUNREACH)
+}
+
+func isReset(err error) bool {
+	return errors.Is(err, windows.WSAECONNRESET) || errors.Is(err, windows.WSAECONNABORTED) || errors.Is(err, windows.ERROR_BROKEN_PIPE)
+}
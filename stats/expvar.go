@@ -0,0 +1,45 @@
+package stats
+
+import (
+	"expvar"
+
+	"github.com/Mxmilu666/nia-forwarding/fdlimit"
+)
+
+// PublishExpvar 将各规则的统计以"rules"为名、文件描述符用量以"fds"为名发布到expvar
+func PublishExpvar() {
+	expvar.Publish("rules", expvar.Func(func() interface{} {
+		vars := make(map[string]map[string]interface{})
+		for _, r := range All() {
+			classified := make(map[string]map[ErrorClass]uint64)
+			for _, e := range r.ClassifiedErrors() {
+				if classified[e.Target] == nil {
+					classified[e.Target] = make(map[ErrorClass]uint64)
+				}
+				classified[e.Target][e.Class] = e.Count
+			}
+			vars[r.Name+"/"+r.Protocol] = map[string]interface{}{
+				"bytes_up":      r.BytesUp.Load(),
+				"bytes_down":    r.BytesDown.Load(),
+				"active_conns":  r.ActiveConns.Load(),
+				"total_conns":   r.TotalConns.Load(),
+				"errors":        r.Errors.Load(),
+				"error_classes": classified,
+				"dropped":       r.Dropped.Load(),
+				"cap_closed":    r.CapClosed.Load(),
+				"idle_reaped":   r.Reaped.Load(),
+				"oldest_age":    r.oldestAge(),
+				"goroutines":    r.Goroutines.Load(),
+			}
+		}
+		return vars
+	}))
+	expvar.Publish("fds", expvar.Func(func() interface{} {
+		soft, hard := fdlimit.Limit()
+		return map[string]interface{}{
+			"open":       fdlimit.Open(),
+			"soft_limit": soft,
+			"hard_limit": hard,
+		}
+	}))
+}
@@ -0,0 +1,65 @@
+package stats
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// 连接持续时间的桶上限(秒)
+var DurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800, 3600}
+
+// 单个连接传输字节数(双向合计)的桶上限
+var SizeBuckets = []float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30}
+
+// Histogram 固定桶的累积直方图，可并发更新
+type Histogram struct {
+	Bounds []float64
+	counts []atomic.Uint64 // 每个桶的非累积计数，最后一个为+Inf
+	sum    atomic.Uint64   // 以math.Float64bits存储
+	count  atomic.Uint64
+}
+
+// NewHistogram 使用给定的桶上限创建直方图，bounds须递增
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		Bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+// Observe 记录一个观测值
+func (h *Histogram) Observe(v float64) {
+	i := 0
+	for i < len(h.Bounds) && v > h.Bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Snapshot 返回每个桶的累积计数(与Bounds对应，最后一个为+Inf)、观测值总和和观测次数
+func (h *Histogram) Snapshot() (cumulative []uint64, sum float64, count uint64) {
+	cumulative = make([]uint64, len(h.counts))
+	var total uint64
+	for i := range h.counts {
+		total += h.counts[i].Load()
+		cumulative[i] = total
+	}
+	return cumulative, math.Float64frombits(h.sum.Load()), h.count.Load()
+}
+
+// ConnFinished 记录一个已结束连接或会话的持续时间和传输字节数
+func (r *Rule) ConnFinished(d time.Duration, bytes uint64) {
+	if r == nil {
+		return
+	}
+	r.Duration.Observe(d.Seconds())
+	r.Size.Observe(float64(bytes))
+}
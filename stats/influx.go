@@ -0,0 +1,73 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// InfluxDB 以行协议通过HTTP写入InfluxDB
+type InfluxDB struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewInfluxDB 创建写入url的推送器，url为完整的写入地址，
+// 例如v2的 "http://host:8086/api/v2/write?org=home&bucket=net" 或v1的 "http://host:8086/write?db=net"
+func NewInfluxDB(url, token string) *InfluxDB {
+	return &InfluxDB{
+		url:    url,
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Run 定期推送，直到上下文取消
+func (i *InfluxDB) Run(ctx context.Context, interval time.Duration) {
+	runPusher(ctx, i, interval)
+}
+
+func (i *InfluxDB) name() string { return "InfluxDB" }
+
+func (i *InfluxDB) push(samples []sample, now time.Time) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	for _, s := range samples {
+		fmt.Fprintf(&body, "nia_forwarding,rule=%s,protocol=%s bytes_up=%di,bytes_down=%di,connections=%di,errors=%di,dropped=%di,active_connections=%di %d\n",
+			influxTag(s.name), influxTag(s.protocol), s.bytesUp, s.bytesDown, s.totalConns, s.errors, s.dropped, s.activeConns, now.UnixNano())
+	}
+
+	req, err := http.NewRequest(http.MethodPost, i.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.token != "" {
+		req.Header.Set("Authorization", "Token "+i.token)
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// 转义行协议标签值中的逗号、等号和空格
+func influxTag(s string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
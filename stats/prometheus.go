@@ -0,0 +1,103 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Mxmilu666/nia-forwarding/fdlimit"
+	"github.com/Mxmilu666/nia-forwarding/limit"
+)
+
+// WritePrometheus 以Prometheus文本格式输出所有规则的统计
+func WritePrometheus(w io.Writer) {
+	rules := All()
+
+	writeCounter := func(name, help, typ string, value func(r *Rule) uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, r := range rules {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, r.labels(), value(r))
+		}
+	}
+
+	writeCounter("nia_forwarding_bytes_up_total", "Bytes forwarded from clients to targets.", "counter",
+		func(r *Rule) uint64 { return r.BytesUp.Load() })
+	writeCounter("nia_forwarding_bytes_down_total", "Bytes forwarded from targets to clients.", "counter",
+		func(r *Rule) uint64 { return r.BytesDown.Load() })
+	writeCounter("nia_forwarding_connections_total", "TCP connections or UDP sessions accepted.", "counter",
+		func(r *Rule) uint64 { return r.TotalConns.Load() })
+	writeCounter("nia_forwarding_errors_total", "Errors while accepting, dialing targets or forwarding data.", "counter",
+		func(r *Rule) uint64 { return r.Errors.Load() })
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", "nia_forwarding_classified_errors_total",
+		"Errors by peer (target address, or client) and class (dial_timeout, refused, unreachable, reset, read_timeout, write_timeout, other).", "nia_forwarding_classified_errors_total")
+	for _, r := range rules {
+		for _, e := range r.ClassifiedErrors() {
+			fmt.Fprintf(w, "nia_forwarding_classified_errors_total{%s,target=\"%s\",class=\"%s\"} %d\n",
+				r.labels(), escapeLabel(e.Target), e.Class, e.Count)
+		}
+	}
+	writeCounter("nia_forwarding_dropped_total", "Rejected TCP connections and dropped UDP packets.", "counter",
+		func(r *Rule) uint64 { return r.Dropped.Load() })
+	writeCounter("nia_forwarding_transfer_cap_closed_total", "TCP connections or UDP sessions closed after reaching the per-connection transfer cap.", "counter",
+		func(r *Rule) uint64 { return r.CapClosed.Load() })
+	writeCounter("nia_forwarding_idle_reaped_total", "TCP connections closed by the idle reaper after tcp_idle_timeout.", "counter",
+		func(r *Rule) uint64 { return r.Reaped.Load() })
+	writeCounter("nia_forwarding_active_connections", "TCP connections or UDP sessions currently open.", "gauge",
+		func(r *Rule) uint64 { return uint64(max(r.ActiveConns.Load(), 0)) })
+	writeCounter("nia_forwarding_oldest_connection_age_seconds", "Age of the oldest TCP connection currently being forwarded, 0 if none.", "gauge",
+		func(r *Rule) uint64 { return r.oldestAge() })
+
+	writeHistogram := func(name, help string, hist func(r *Rule) *Histogram) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		for _, r := range rules {
+			h := hist(r)
+			cumulative, sum, count := h.Snapshot()
+			for i, bound := range h.Bounds {
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, r.labels(),
+					strconv.FormatFloat(bound, 'f', -1, 64), cumulative[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, r.labels(), cumulative[len(h.Bounds)])
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", name, r.labels(), strconv.FormatFloat(sum, 'g', -1, 64))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", name, r.labels(), count)
+		}
+	}
+
+	writeHistogram("nia_forwarding_connection_duration_seconds", "Lifetime of closed TCP connections or UDP sessions.",
+		func(r *Rule) *Histogram { return r.Duration })
+	writeHistogram("nia_forwarding_connection_bytes", "Bytes transferred in both directions by closed TCP connections or UDP sessions.",
+		func(r *Rule) *Histogram { return r.Size })
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", "nia_forwarding_memory_bytes",
+		"Live heap memory after the last garbage collection, compared against memory_budget.", "nia_forwarding_memory_bytes", "nia_forwarding_memory_bytes", limit.MemoryUsage())
+
+	// 进程的文件描述符用量，当前系统没有上限时不输出
+	if soft, _ := fdlimit.Limit(); soft > 0 {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", "nia_forwarding_fd_limit",
+			"Soft limit on open file descriptors.", "nia_forwarding_fd_limit", "nia_forwarding_fd_limit", soft)
+		if open := fdlimit.Open(); open >= 0 {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", "nia_forwarding_open_fds",
+				"Open file descriptors.", "nia_forwarding_open_fds", "nia_forwarding_open_fds", open)
+		}
+	}
+}
+
+// Handler 返回输出Prometheus指标的HTTP处理器
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w)
+	})
+}
+
+func (r *Rule) labels() string {
+	return fmt.Sprintf("rule=\"%s\",protocol=\"%s\"", escapeLabel(r.Name), escapeLabel(r.Protocol))
+}
+
+// Prometheus文本格式的标签值只转义反斜杠、双引号和换行，其余字符(包括非ASCII字符)原样输出
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
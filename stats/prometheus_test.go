@@ -0,0 +1,22 @@
+package stats
+
+import "testing"
+
+// 标签值按Prometheus文本格式转义，非ASCII字符原样输出而不是Go的\u转义
+func TestLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"web", `rule="web",protocol="tcp"`},
+		{"网站", `rule="网站",protocol="tcp"`},
+		{`a"b\c`, `rule="a\"b\\c",protocol="tcp"`},
+		{"a\nb\tc", `rule="a\nb` + "\t" + `c",protocol="tcp"`},
+	}
+	for _, tt := range tests {
+		r := &Rule{Name: tt.name, Protocol: "tcp"}
+		if got := r.labels(); got != tt.want {
+			t.Errorf("规则名%q的标签为%s，应为%s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package stats
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// 默认推送间隔
+const DefaultPushInterval = 10 * time.Second
+
+// 某一时刻单条规则的计数快照
+type sample struct {
+	name        string
+	protocol    string
+	bytesUp     uint64
+	bytesDown   uint64
+	totalConns  uint64
+	errors      uint64
+	dropped     uint64
+	activeConns int64
+}
+
+func takeSamples() []sample {
+	rules := All()
+	samples := make([]sample, 0, len(rules))
+	for _, r := range rules {
+		samples = append(samples, sample{
+			name:        r.Name,
+			protocol:    r.Protocol,
+			bytesUp:     r.BytesUp.Load(),
+			bytesDown:   r.BytesDown.Load(),
+			totalConns:  r.TotalConns.Load(),
+			errors:      r.Errors.Load(),
+			dropped:     r.Dropped.Load(),
+			activeConns: r.ActiveConns.Load(),
+		})
+	}
+	return samples
+}
+
+// pusher 将统计快照发送到外部系统
+type pusher interface {
+	push(samples []sample, now time.Time) error
+	name() string
+}
+
+// 定期推送统计，直到上下文取消
+func runPusher(ctx context.Context, p pusher, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultPushInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := p.push(takeSamples(), now); err != nil {
+				log.Printf("推送%s指标失败: %v", p.name(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Rule 单条转发规则在某个协议上的流量统计
+type Rule struct {
+	Name     string
+	Protocol string
+
+	BytesUp     atomic.Uint64 // 客户端 -> 目标
+	BytesDown   atomic.Uint64 // 目标 -> 客户端
+	ActiveConns atomic.Int64  // 当前TCP连接数或UDP会话数
+	TotalConns  atomic.Uint64 // 累计TCP连接数或UDP会话数
+	Errors      atomic.Uint64 // 接受、连接目标和转发过程中的错误次数
+	Dropped     atomic.Uint64 // 被拒绝的TCP连接和被丢弃的UDP数据包
+	CapClosed   atomic.Uint64 // 达到单连接传输上限后被关闭的TCP连接和UDP会话
+	Reaped      atomic.Uint64 // 空闲超时后被回收的TCP连接
+	Goroutines  atomic.Int64  // 当前用于处理连接和会话的goroutine数量
+
+	Duration *Histogram // 连接或会话的持续时间(秒)
+	Size     *Histogram // 连接或会话双向传输的总字节数
+
+	errors errorCounts // 按目标和类别的错误次数，见AddTargetError
+	active activeConns // 正在转发的TCP连接，见Track
+}
+
+var (
+	mu    sync.Mutex
+	rules = make(map[string]*Rule)
+)
+
+// Get 返回指定规则和协议的统计，不存在时创建
+func Get(name, protocol string) *Rule {
+	key := name + "/" + protocol
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	r, ok := rules[key]
+	if !ok {
+		r = &Rule{
+			Name:     name,
+			Protocol: protocol,
+			Duration: NewHistogram(DurationBuckets),
+			Size:     NewHistogram(SizeBuckets),
+		}
+		rules[key] = r
+	}
+	return r
+}
+
+// All 返回所有规则的统计，按规则名和协议排序
+func All() []*Rule {
+	mu.Lock()
+	list := make([]*Rule, 0, len(rules))
+	for _, r := range rules {
+		list = append(list, r)
+	}
+	mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Protocol < list[j].Protocol
+	})
+	return list
+}
+
+// ConnOpened 记录一个新连接或会话
+func (r *Rule) ConnOpened() {
+	if r == nil {
+		return
+	}
+	r.ActiveConns.Add(1)
+	r.TotalConns.Add(1)
+}
+
+// ConnClosed 记录连接或会话关闭
+func (r *Rule) ConnClosed() {
+	if r == nil {
+		return
+	}
+	r.ActiveConns.Add(-1)
+}
+
+// AddUp 累加客户端到目标方向的字节数
+func (r *Rule) AddUp(n int64) {
+	if r == nil || n <= 0 {
+		return
+	}
+	r.BytesUp.Add(uint64(n))
+}
+
+// AddDown 累加目标到客户端方向的字节数
+func (r *Rule) AddDown(n int64) {
+	if r == nil || n <= 0 {
+		return
+	}
+	r.BytesDown.Add(uint64(n))
+}
+
+// AddError 记录一次转发错误
+func (r *Rule) AddError() {
+	if r == nil {
+		return
+	}
+	r.Errors.Add(1)
+}
+
+// AddDropped 记录一个被拒绝的连接或被丢弃的数据包
+func (r *Rule) AddDropped() {
+	if r == nil {
+		return
+	}
+	r.Dropped.Add(1)
+}
+
+// AddCapClosed 记录一个因达到传输上限被关闭的连接或会话
+func (r *Rule) AddCapClosed() {
+	if r == nil {
+		return
+	}
+	r.CapClosed.Add(1)
+}
+
+// Go 在新的goroutine中运行f，并在运行期间计入该规则的goroutine数量
+func (r *Rule) Go(f func()) {
+	if r == nil {
+		go f()
+		return
+	}
+	r.Goroutines.Add(1)
+	go func() {
+		defer r.Goroutines.Add(-1)
+		f()
+	}()
+}
@@ -0,0 +1,85 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// StatsD单个UDP包的最大长度
+const statsdMaxPacket = 1400
+
+// StatsD 以StatsD协议推送指标，计数器发送两次推送之间的增量，连接数作为gauge发送
+type StatsD struct {
+	conn   net.Conn
+	prefix string
+	last   map[string]sample
+}
+
+// NewStatsD 创建发送到address的StatsD推送器
+func NewStatsD(address, prefix string) (*StatsD, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		prefix = "nia_forwarding"
+	}
+	return &StatsD{conn: conn, prefix: prefix, last: make(map[string]sample)}, nil
+}
+
+// Run 定期推送，直到上下文取消
+func (s *StatsD) Run(ctx context.Context, interval time.Duration) {
+	defer s.conn.Close()
+	runPusher(ctx, s, interval)
+}
+
+func (s *StatsD) name() string { return "StatsD" }
+
+func (s *StatsD) push(samples []sample, now time.Time) error {
+	var lines []string
+	for _, cur := range samples {
+		key := cur.name + "/" + cur.protocol
+		prev := s.last[key]
+		s.last[key] = cur
+
+		base := s.prefix + "." + statsdName(cur.name) + "." + cur.protocol
+		lines = append(lines,
+			fmt.Sprintf("%s.bytes_up:%d|c", base, cur.bytesUp-prev.bytesUp),
+			fmt.Sprintf("%s.bytes_down:%d|c", base, cur.bytesDown-prev.bytesDown),
+			fmt.Sprintf("%s.connections:%d|c", base, cur.totalConns-prev.totalConns),
+			fmt.Sprintf("%s.errors:%d|c", base, cur.errors-prev.errors),
+			fmt.Sprintf("%s.dropped:%d|c", base, cur.dropped-prev.dropped),
+			fmt.Sprintf("%s.active_connections:%d|g", base, max(cur.activeConns, 0)),
+		)
+	}
+
+	// 多个指标以换行拼接，单包不超过MTU
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+			if _, err := s.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		if _, err := s.conn.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 替换StatsD指标名中有特殊含义的字符
+func statsdName(s string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", " ", "_").Replace(s)
+}
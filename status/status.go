@@ -0,0 +1,244 @@
+// Package status 提供运行中实例的状态报告，由指标HTTP服务的/status输出，status子命令读取后以表格显示
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/dnscache"
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/i18n"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+	"github.com/Mxmilu666/nia-forwarding/table"
+)
+
+// UnixPrefix 表示指标HTTP服务监听或连接unix套接字，例如 "unix:/run/nia-forwarding.sock"
+const UnixPrefix = "unix:"
+
+// Report 运行中实例的状态
+type Report struct {
+	Started   time.Time        `json:"started"`
+	Uptime    int64            `json:"uptime_seconds"`
+	Rules     []Rule           `json:"rules"`
+	Listeners []health.Status  `json:"listeners"`           // 所有监听器和启动失败的规则
+	DNSCache  []dnscache.Entry `json:"dns_cache,omitempty"` // 未过期的目标主机名解析缓存
+
+	OldestConns []stats.ConnInfo `json:"oldest_connections,omitempty"` // 最早开始的若干个TCP活动连接
+}
+
+// Rule 单条规则在某个协议上的状态
+type Rule struct {
+	Name        string `json:"name"`
+	Protocol    string `json:"protocol"`
+	Listeners   int    `json:"listeners"`       // 登记的监听器数量
+	Ready       int    `json:"ready_listeners"` // 已绑定的监听器数量
+	ActiveConns int64  `json:"active_conns"`    // 当前TCP连接数或UDP会话数
+	TotalConns  uint64 `json:"total_conns"`
+	BytesUp     uint64 `json:"bytes_up"`
+	BytesDown   uint64 `json:"bytes_down"`
+	Errors      uint64 `json:"errors"`
+	Reaped      uint64 `json:"idle_reaped"` // 空闲超时后被回收的TCP连接数
+}
+
+// 状态报告中列出的最早活动连接数量
+const oldestConns = 10
+
+// Collect 汇总当前的规则统计、最早的活动连接、监听器状态和解析缓存，dns为nil时不包含解析缓存
+func Collect(started time.Time, tracker *health.Tracker, dns *dnscache.Cache) *Report {
+	r := &Report{
+		Started:   started,
+		Uptime:    int64(time.Since(started).Seconds()),
+		Listeners: tracker.Statuses(),
+		DNSCache:  dns.Entries(),
+
+		OldestConns: stats.OldestConns(oldestConns),
+	}
+
+	index := make(map[string]int)
+	for _, s := range stats.All() {
+		index[s.Name+"/"+s.Protocol] = len(r.Rules)
+		r.Rules = append(r.Rules, Rule{
+			Name:        s.Name,
+			Protocol:    s.Protocol,
+			ActiveConns: s.ActiveConns.Load(),
+			TotalConns:  s.TotalConns.Load(),
+			BytesUp:     s.BytesUp.Load(),
+			BytesDown:   s.BytesDown.Load(),
+			Errors:      s.Errors.Load(),
+			Reaped:      s.Reaped.Load(),
+		})
+	}
+	for _, l := range r.Listeners {
+		i, ok := index[l.Rule+"/"+l.Protocol]
+		if !ok || l.Listen == "" {
+			continue
+		}
+		r.Rules[i].Listeners++
+		if l.State == health.StateReady {
+			r.Rules[i].Ready++
+		}
+	}
+	return r
+}
+
+// Handler 以JSON返回状态报告
+func Handler(started time.Time, tracker *health.Tracker, dns *dnscache.Cache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Collect(started, tracker, dns))
+	})
+}
+
+// Client 返回访问运行中实例指标HTTP服务的客户端和URL前缀，addr为 "host:port" 或 "unix:路径"；timeout为0表示不限时
+func Client(addr string, timeout time.Duration) (*http.Client, string) {
+	client := &http.Client{Timeout: timeout}
+	if path, ok := strings.CutPrefix(addr, UnixPrefix); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		return client, "http://unix"
+	}
+	return client, "http://" + addr
+}
+
+// Fetch 从运行中实例的指标HTTP服务读取状态报告，addr为 "host:port" 或 "unix:路径"
+func Fetch(addr string, timeout time.Duration) (*Report, error) {
+	client, base := Client(addr, timeout)
+	resp, err := client.Get(base + "/status")
+	if err != nil {
+		return nil, fmt.Errorf("无法连接运行中的实例: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("读取状态失败: %s", resp.Status)
+	}
+
+	var r Report
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("无法解析状态: %w", err)
+	}
+	return &r, nil
+}
+
+// Print 以表格输出状态报告，未就绪的监听器和解析缓存单独列出
+func Print(w io.Writer, r *Report) error {
+	ready, total := 0, 0
+	var pending, fallback [][]string
+	for _, l := range r.Listeners {
+		total++
+		if l.Preferred != "" {
+			fallback = append(fallback, []string{l.ID, l.Protocol, l.Preferred, l.Listen})
+		}
+		if l.State == health.StateReady {
+			ready++
+			continue
+		}
+		pending = append(pending, []string{l.ID, l.Protocol, l.Listen, i18n.Translate(stateText(l))})
+	}
+
+	uptime := (time.Duration(r.Uptime) * time.Second).String()
+	fmt.Fprintln(w, i18n.Translate(fmt.Sprintf("运行时间: %s，启动于%s，监听器: %d/%d已就绪",
+		uptime, r.Started.Local().Format(time.DateTime), ready, total)))
+	fmt.Fprintln(w)
+
+	var rows [][]string
+	for _, rule := range r.Rules {
+		rows = append(rows, []string{
+			rule.Name,
+			rule.Protocol,
+			fmt.Sprintf("%d/%d", rule.Ready, rule.Listeners),
+			strconv.FormatInt(rule.ActiveConns, 10),
+			strconv.FormatUint(rule.TotalConns, 10),
+			formatBytes(rule.BytesUp),
+			formatBytes(rule.BytesDown),
+			strconv.FormatUint(rule.Errors, 10),
+			strconv.FormatUint(rule.Reaped, 10),
+		})
+	}
+	if err := table.Write(w, translate("规则", "协议", "监听器", "活动连接", "累计连接", "上行", "下行", "错误", "空闲回收"), rows); err != nil {
+		return err
+	}
+
+	if len(r.OldestConns) > 0 {
+		var conns [][]string
+		for _, c := range r.OldestConns {
+			conns = append(conns, []string{c.Rule, c.ID, c.Client, c.Target,
+				(time.Duration(c.Age) * time.Second).String(), (time.Duration(c.Idle) * time.Second).String()})
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, i18n.Translate("最早的活动连接:"))
+		if err := table.Write(w, translate("规则", "连接", "客户端", "目标", "持续时间", "空闲"), conns); err != nil {
+			return err
+		}
+	}
+
+	if len(pending) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, i18n.Translate("未就绪的监听器:"))
+		if err := table.Write(w, translate("监听器", "协议", "监听地址", "状态"), pending); err != nil {
+			return err
+		}
+	}
+
+	if len(fallback) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, i18n.Translate("改用备用端口的监听器:"))
+		if err := table.Write(w, translate("监听器", "协议", "配置的地址", "实际地址"), fallback); err != nil {
+			return err
+		}
+	}
+
+	if len(r.DNSCache) > 0 {
+		var dns [][]string
+		for _, e := range r.DNSCache {
+			result := strings.Join(e.Addrs, ", ")
+			if e.Error != "" {
+				result = e.Error
+			}
+			ttl := time.Until(e.Expires).Truncate(time.Second)
+			dns = append(dns, []string{e.Host, result, max(ttl, 0).String(), strconv.FormatUint(e.Hits, 10)})
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, i18n.Translate("解析缓存:"))
+		return table.Write(w, translate("主机名", "地址", "剩余时间", "命中"), dns)
+	}
+	return nil
+}
+
+func stateText(l health.Status) string {
+	if l.State == health.StateFailed {
+		return fmt.Sprintf("失败: %s", l.Error)
+	}
+	return "等待中"
+}
+
+func translate(texts ...string) []string {
+	for i, text := range texts {
+		texts[i] = i18n.Translate(text)
+	}
+	return texts
+}
+
+// 以1024进位格式化字节数，保留一位小数
+func formatBytes(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, i := float64(n)/1024, 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%ciB", value, units[i])
+}
@@ -0,0 +1,62 @@
+// Package table 以对齐的纯文本表格输出，按显示宽度对齐，中文等宽字符计为两列
+package table
+
+import (
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Write 输出表头和各行，列之间以两个空格分隔，最后一列不补齐
+func Write(w io.Writer, header []string, rows [][]string) error {
+	widths := make([]int, len(header))
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			if i < len(widths) {
+				widths[i] = max(widths[i], Width(cell))
+			}
+		}
+	}
+
+	var b strings.Builder
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			if i >= len(widths) {
+				break
+			}
+			b.WriteString(cell)
+			if i < len(row)-1 && i < len(widths)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-Width(cell)+2))
+			}
+		}
+		b.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Width 返回字符串在终端中的显示宽度
+func Width(s string) int {
+	n := 0
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case wide(r):
+			n += 2
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// 东亚宽字符和全角字符
+func wide(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r) ||
+		(r >= 0x3000 && r <= 0x303f) || // 中文标点
+		(r >= 0xff01 && r <= 0xff60) || (r >= 0xffe0 && r <= 0xffe6) // 全角字符
+}
@@ -0,0 +1,35 @@
+// Package targetgroup 提供可被多条规则共享的命名目标组，按轮询顺序选择目标
+package targetgroup
+
+import "sync/atomic"
+
+// Prefix 表示目标为目标组，例如 "group:mc-servers"，仅用于日志，目标组由Options提供
+const Prefix = "group:"
+
+// Group 一组可相互替代的目标地址，同一个Group在引用它的所有规则间共享轮询位置
+type Group struct {
+	name  string
+	addrs []string
+	next  atomic.Uint64
+}
+
+// New 创建目标组，addrs为 "host:port" 格式的地址
+func New(name string, addrs []string) *Group {
+	return &Group{name: name, addrs: addrs}
+}
+
+// Name 返回目标组名称
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Order 返回本次连接依次尝试的目标，从轮询位置开始，第一个为首选目标
+func (g *Group) Order() []string {
+	if len(g.addrs) == 0 {
+		return nil
+	}
+	start := int((g.next.Add(1) - 1) % uint64(len(g.addrs)))
+	order := make([]string, 0, len(g.addrs))
+	order = append(order, g.addrs[start:]...)
+	return append(order, g.addrs[:start]...)
+}
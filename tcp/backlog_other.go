@@ -0,0 +1,12 @@
+//go:build !unix
+
+package tcp
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setBacklog(listener syscall.Conn, backlog int) error {
+	return errors.New("当前系统不支持设置监听队列长度")
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package tcp
+
+import "syscall"
+
+// 在已监听的套接字上再次调用listen以调整等待队列长度
+func setBacklog(listener syscall.Conn, backlog int) error {
+	rawConn, err := listener.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return listenErr
+}
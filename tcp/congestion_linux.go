@@ -0,0 +1,43 @@
+//go:build linux
+
+package tcp
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// 检查内核是否提供该拥塞控制算法
+func checkCongestion(name string) error {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/tcp_available_congestion_control")
+	if err != nil {
+		return nil // 无法读取时交给setsockopt报告错误
+	}
+	available := strings.Fields(string(data))
+	for _, a := range available {
+		if a == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("内核未提供该算法(可用: %s)，可能需要先加载tcp_%s模块", strings.Join(available, " "), name)
+}
+
+// 设置连接的拥塞控制算法(TCP_CONGESTION)
+func setCongestion(conn syscall.Conn, name string) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, name)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package tcp
+
+import (
+	"errors"
+	"syscall"
+)
+
+func checkCongestion(name string) error {
+	return errors.New("仅Linux支持设置拥塞控制算法")
+}
+
+func setCongestion(conn syscall.Conn, name string) error {
+	return errors.New("仅Linux支持设置拥塞控制算法")
+}
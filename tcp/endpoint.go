@@ -0,0 +1,82 @@
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Mxmilu666/nia-forwarding/fwmark"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+	"github.com/Mxmilu666/nia-forwarding/serialport"
+	"github.com/Mxmilu666/nia-forwarding/unixsock"
+)
+
+// 监听或目标地址的前缀，没有前缀的地址为TCP地址
+const (
+	// UnixPrefix 表示unix流套接字路径，例如 "unix:/run/docker.sock"，Linux上 "unix:@name" 表示抽象命名空间中的名称
+	UnixPrefix = "unix:"
+	// PipePrefix 表示Windows命名管道，例如 `pipe:\\.\pipe\docker_engine`
+	PipePrefix = "pipe:"
+	// SerialPrefix 表示串口设备，仅用于日志和中间件，串口参数由Options.TargetSerial提供
+	SerialPrefix = "serial:"
+)
+
+// 监听TCP地址(默认只监听IPv4)、unix套接字路径或命名管道，同名的旧套接字文件会被删除
+func listen(network, addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, UnixPrefix); ok {
+		unixsock.RemoveStale(path)
+		return net.Listen("unix", path)
+	}
+	if name, ok := strings.CutPrefix(addr, PipePrefix); ok {
+		return listenPipe(name)
+	}
+	if network == "" {
+		network = "tcp4"
+	}
+	return net.Listen(network, addr)
+}
+
+// 连接目标，串口、unix套接字和命名管道目标不经过上游代理
+func (p *Proxy) dialTarget(addr string) (net.Conn, error) {
+	if p.opts.TargetSerial != nil {
+		return serialport.Open(*p.opts.TargetSerial)
+	}
+	if path, ok := strings.CutPrefix(addr, UnixPrefix); ok {
+		return net.DialTimeout("unix", path, p.opts.DialTimeout)
+	}
+	if name, ok := strings.CutPrefix(addr, PipePrefix); ok {
+		return dialPipe(name)
+	}
+	network := p.opts.DialNetwork
+	if network == "" {
+		network = "tcp6"
+	}
+	if p.opts.Upstream == nil {
+		return p.opts.Resolver.Dial(fwmark.Dialer(p.opts.Source.Dialer(p.opts.DialTimeout), p.opts.Mark), network, addr)
+	}
+	return p.opts.Upstream.DialTimeout(network, addr, p.opts.DialTimeout)
+}
+
+// 依次连接目标组中的目标直到成功，连接成功的目标写入info；中间件修改了目标时只连接该目标。每次连接失败都计入错误统计
+func (p *Proxy) dialCandidates(info *middleware.Info, candidates []string) (net.Conn, error) {
+	if len(candidates) == 0 || info.TargetAddr != candidates[0] {
+		conn, err := p.dialTarget(info.TargetAddr)
+		if err != nil {
+			p.opts.Stats.AddTargetError(info.TargetAddr, err, true)
+		}
+		return conn, err
+	}
+
+	var err error
+	for _, addr := range candidates {
+		var conn net.Conn
+		if conn, err = p.dialTarget(addr); err == nil {
+			info.TargetAddr = addr
+			return conn, nil
+		}
+		p.opts.Stats.AddTargetError(addr, err, true)
+		p.opts.Log.Warnf("[%s] 无法连接目标组[%s]中的 %s: %v", logging.Tag(p.proxyID, info.ConnID), p.opts.TargetGroup.Name(), addr, err)
+	}
+	return nil, fmt.Errorf("目标组[%s]中的目标均无法连接: %w", p.opts.TargetGroup.Name(), err)
+}
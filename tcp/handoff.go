@@ -0,0 +1,47 @@
+package tcp
+
+import (
+	"context"
+
+	"github.com/Mxmilu666/nia-forwarding/events"
+	"github.com/Mxmilu666/nia-forwarding/handoff"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+)
+
+// Adopt 接管旧进程交出的连接，须在Start之前调用；Start开始后继续转发，不受连接数上限限制，
+// 连接再次登记，下次升级时可以继续交接
+func (p *Proxy) Adopt(c handoff.Conn) {
+	p.adopted = append(p.adopted, c)
+}
+
+func (p *Proxy) adopt(ctx context.Context, c handoff.Conn) {
+	acquired := p.opts.PerIP.Acquire(c.ClientConn.RemoteAddr())
+	p.conns.Add(1)
+	p.opts.Stats.Go(func() {
+		defer p.conns.Done()
+		defer c.Close()
+		if acquired {
+			defer p.opts.PerIP.Release(c.ClientConn.RemoteAddr())
+		}
+
+		p.opts.Stats.ConnOpened()
+		defer p.opts.Stats.ConnClosed()
+
+		info := &middleware.Info{
+			ProxyID:    p.proxyID,
+			ConnID:     c.ConnID,
+			Protocol:   "tcp",
+			ClientAddr: c.ClientConn.RemoteAddr(),
+			ListenAddr: c.ClientConn.LocalAddr(),
+			TargetAddr: c.State.Target,
+		}
+		p.opts.Log.Conn().Infof("[%s] 已接管旧进程的TCP连接: %s -> %s -> %s, 已转发上行%d字节, 下行%d字节",
+			logging.Tag(p.proxyID, c.ConnID), info.ClientAddr, info.ListenAddr, info.TargetAddr, c.BytesUp, c.BytesDown)
+
+		p.opts.Events.PublishConn(events.TypeOpen, info, nil)
+
+		relay := p.opts.Handoff.Register(c.State, c.ClientConn, c.TargetConn)
+		p.relay(ctx, info, c.ClientConn, c.TargetConn, nil, nil, relay, c.Started, c.BytesUp, c.BytesDown)
+	})
+}
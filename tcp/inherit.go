@@ -0,0 +1,53 @@
+package tcp
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/inherit"
+)
+
+// 监听套接字在暂存区中的标识
+func (p *Proxy) socketKey() string {
+	return inherit.Key("tcp", p.opts.ListenNetwork, p.listenAddr)
+}
+
+// Inherit 接手重新加载配置前监听同一地址的代理留在r中的监听套接字，须在Start之前调用；没有时Start照常绑定
+func (p *Proxy) Inherit(r *inherit.Registry) {
+	for _, s := range r.Take(p.socketKey()) {
+		if l, ok := s.(net.Listener); ok && p.inherited == nil {
+			p.inherited = l
+			continue
+		}
+		s.Close()
+	}
+}
+
+// Retire 停止接受新连接，把监听套接字留在r中供重新加载后监听同一地址的代理接手，套接字交回后返回；
+// 已建立的连接继续按原配置转发，全部结束后Start返回
+func (p *Proxy) Retire(r *inherit.Registry) {
+	p.retireOnce.Do(func() {
+		p.sockets = r
+		close(p.retire)
+	})
+	<-p.stopped
+}
+
+// 交回或关闭监听套接字；退出时(ctx已取消)总是关闭
+func (p *Proxy) release(ctx context.Context, l net.Listener) {
+	defer p.stop()
+	if ctx.Err() == nil {
+		if d, ok := l.(interface{ SetDeadline(time.Time) error }); ok {
+			d.SetDeadline(time.Time{})
+		}
+		if p.sockets.Park(p.socketKey(), l) {
+			return
+		}
+	}
+	l.Close()
+}
+
+func (p *Proxy) stop() {
+	p.stopOnce.Do(func() { close(p.stopped) })
+}
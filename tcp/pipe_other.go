@@ -0,0 +1,18 @@
+//go:build !windows
+
+package tcp
+
+import (
+	"errors"
+	"net"
+)
+
+var errPipeUnsupported = errors.New("命名管道仅支持Windows")
+
+func listenPipe(name string) (net.Listener, error) {
+	return nil, errPipeUnsupported
+}
+
+func dialPipe(name string) (net.Conn, error) {
+	return nil, errPipeUnsupported
+}
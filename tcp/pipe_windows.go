@@ -0,0 +1,21 @@
+package tcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// 连接命名管道的超时时间，管道的所有实例都忙时会在此期间等待
+const pipeDialTimeout = 10 * time.Second
+
+// 创建命名管道监听，使用默认安全描述符
+func listenPipe(name string) (net.Listener, error) {
+	return winio.ListenPipe(name, nil)
+}
+
+func dialPipe(name string) (net.Conn, error) {
+	timeout := pipeDialTimeout
+	return winio.DialPipe(name, &timeout)
+}
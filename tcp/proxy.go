@@ -2,110 +2,1019 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/bindretry"
+	"github.com/Mxmilu666/nia-forwarding/chaos"
+	"github.com/Mxmilu666/nia-forwarding/connpool"
+	"github.com/Mxmilu666/nia-forwarding/dnscache"
+	"github.com/Mxmilu666/nia-forwarding/dscp"
+	"github.com/Mxmilu666/nia-forwarding/events"
+	"github.com/Mxmilu666/nia-forwarding/flow"
+	"github.com/Mxmilu666/nia-forwarding/ftp"
+	"github.com/Mxmilu666/nia-forwarding/handoff"
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/inherit"
+	"github.com/Mxmilu666/nia-forwarding/inspect"
+	"github.com/Mxmilu666/nia-forwarding/limit"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+	"github.com/Mxmilu666/nia-forwarding/netwatch"
+	"github.com/Mxmilu666/nia-forwarding/proxyproto"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/record"
+	"github.com/Mxmilu666/nia-forwarding/rewrite"
+	"github.com/Mxmilu666/nia-forwarding/rtsp"
+	"github.com/Mxmilu666/nia-forwarding/serialport"
+	"github.com/Mxmilu666/nia-forwarding/shadowsocks"
+	"github.com/Mxmilu666/nia-forwarding/sockmap"
+	"github.com/Mxmilu666/nia-forwarding/srcaddr"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+	"github.com/Mxmilu666/nia-forwarding/targetgroup"
+	"github.com/Mxmilu666/nia-forwarding/upstream"
+	"github.com/Mxmilu666/nia-forwarding/vhost"
+	"github.com/Mxmilu666/nia-forwarding/wol"
 )
 
+// 终止TLS时等待客户端完成握手的最长时间
+const tlsHandshakeTimeout = 10 * time.Second
+
+// Options TCP代理的可选配置
+type Options struct {
+	Log *logging.Logger // 规则的日志级别，nil为info
+
+	TLSConfig *tls.Config   // 不为nil时在监听端终止TLS
+	PerIP     *limit.PerIP  // 每IP并发连接限制，可在同一规则的多个代理间共享
+	Backlog   int           // 监听队列长度，0为使用系统默认值
+	BindRetry time.Duration // 监听地址被占用时重试绑定的时长，0为不重试
+
+	// 监听端口在BindRetry重试后仍被占用时依次尝试的备用端口，实际端口记录在日志和监听器状态中；unix套接字和命名管道不使用
+	FallbackPorts []int
+
+	NetWatch *netwatch.Watcher // 监听地址在本机不存在时等待网卡地址变化后重新绑定，nil为直接失败
+
+	// 监听和连接目标使用的网络，例如 "tcp4"、"tcp6" 或双栈的 "tcp"，默认分别为tcp4和tcp6
+	ListenNetwork string
+	DialNetwork   string
+	DialTimeout   time.Duration   // 连接目标的超时时间，0为不限制
+	Source        *srcaddr.Policy // 直接连接目标时的IPv6源地址策略，nil为由系统选择
+	Mark          uint32          // 直接连接目标的套接字的fwmark，0为不设置，仅Linux支持
+	Pacer         *limit.Pacer    // 接受连接的速率限制
+	Resolver      *dnscache.Cache // 直接连接目标时缓存目标主机名的解析结果，nil为每次都查询系统解析器
+
+	// 预先建立并保持的目标空闲连接数，新连接直接取用以隐藏连接目标的延迟，0为不使用；
+	// PoolMaxIdle为空闲连接的最长保留时间，0为connpool.DefaultMaxIdle。目标组和串口目标不使用
+	PoolSize    int
+	PoolMaxIdle time.Duration
+
+	// 客户端正常断开且目标连接仍然可用时把目标连接放回连接池，供下一个客户端使用；
+	// 只适用于不依赖连接边界的协议，目标在客户端断开后发出的数据会交给下一个客户端
+	PoolReuse bool
+
+	// 单个连接双向合计的最大传输字节数，达到后关闭连接并计入transfer_cap_closed，0为不限制
+	MaxConnBytes int64
+	// 连接的最长持续时间，不论是否空闲，到达后关闭连接，迫使客户端经上游重新认证或重新连接；0为不限制
+	MaxConnLifetime time.Duration
+	// 连接双向都没有转发数据超过该时长时由定期运行的回收器关闭，计入idle_reaped；0为不回收
+	IdleTimeout time.Duration
+
+	// 同时处理的连接数上限，分别为规则级和全局，名额耗尽时暂停接受新连接
+	Handlers       *limit.Semaphore
+	GlobalHandlers *limit.Semaphore
+	Memory         *limit.Memory // 所有规则共享的内存预算，超过时暂停接受新连接
+	Overload       int           // 全局名额用尽或内存超过预算时对新连接的处理方式，见limit.OverloadQueue等
+
+	Bandwidth     *limit.Bandwidth // 所有规则共享的总带宽上限，nil为不限制
+	RuleBandwidth *limit.Bandwidth // 本规则所有连接和UDP会话共享的带宽上限，nil为不限制
+	Priority      int              // 总带宽或内存不足时本规则的优先级，见limit.PriorityHigh等
+
+	// 客户端和目标连接的内核收发缓冲区大小(SO_RCVBUF/SO_SNDBUF)，0为系统默认值
+	SocketReadBuffer  int
+	SocketWriteBuffer int
+
+	// 客户端和目标连接使用的拥塞控制算法(TCP_CONGESTION)，例如 "bbr"，为空时使用系统默认算法，仅Linux支持
+	Congestion string
+
+	DSCP int // 客户端和目标连接发出的数据包的DSCP标记(0-63)，0为不设置
+
+	// 不为nil时把客户端和目标连接在内核中对接转发(eBPF sockmap)；与需要在用户态处理数据的功能不兼容，
+	// 启动时检查，不兼容时不使用。对接后的流量在连接关闭时才计入统计和配额
+	Sockmap *sockmap.Accelerator
+
+	// 不为nil时把连接登记在此，升级时交给新进程继续转发；与需要在用户态保存状态的功能不兼容，启动时检查，不兼容时不交接
+	Handoff *handoff.Registry
+
+	Stats  *stats.Rule    // 流量统计
+	Quota  *quota.Quota   // 流量配额，用尽后拒绝新连接
+	Flows  *flow.Exporter // 连接关闭时导出流记录
+	Events *events.Bus    // 实时推送连接的建立、关闭和错误事件
+
+	Health *health.Tracker // 监听成功后标记为就绪，退出时标记为未就绪
+
+	Middlewares middleware.Chain // 连接中间件
+
+	// 数据流查找替换规则，分别作用于客户端->目标和目标->客户端方向
+	RewriteUp   []rewrite.Replacement
+	RewriteDown []rewrite.Replacement
+
+	Blocker *inspect.Matcher // 客户端数据开头命中禁止模式时断开连接
+
+	Chaos *chaos.Injector // 故障注入，为两个方向的数据附加延迟、带宽限制和随机重置
+
+	Recorder *record.Recorder // 录制客户端发出的数据
+
+	Upstream *upstream.Dialer // 经由上游代理连接目标
+
+	Shadowsocks *shadowsocks.Relay // Shadowsocks加密转发
+
+	ProxyProtocol int // 连接目标后发送的PROXY协议头版本(1或2)，0为不发送
+
+	TargetSerial *serialport.Config // 不为nil时每个连接独占打开该串口作为目标，代替targetAddr
+
+	TargetGroup *targetgroup.Group // 不为nil时按轮询顺序连接目标组中的目标，代替targetAddr
+
+	HostRoutes *vhost.Router // 不为nil时按客户端第一个HTTP请求的Host头选择目标，未匹配时使用targetAddr或目标组
+
+	FTP *ftp.Helper // 不为nil时改写目标发来的FTP被动模式响应，并为其中的数据端口打开临时转发
+
+	RTSP *rtsp.Helper // 不为nil时改写RTSP的SETUP请求和响应，并为其中协商的RTP/RTCP端口建立UDP中转
+
+	Wake *wol.Waker // 不为nil时连接目标超时或主机不可达后发送网络唤醒数据包，并等待目标启动后再连接
+}
+
 // Proxy 表示TCP代理
 type Proxy struct {
 	listenAddr string
 	targetAddr string
 	proxyID    string
+	opts       Options
+	pool       *connpool.Pool // 到targetAddr的空闲连接，未启用时为nil
+	adopted    []handoff.Conn // Start之前交给本代理的旧进程连接
+
+	inherited net.Listener      // Start之前从重新加载前的代理接手的监听套接字
+	sockets   *inherit.Registry // Retire时交回监听套接字的暂存区
+	retire    chan struct{}     // Retire时关闭，停止接受新连接
+	stopped   chan struct{}     // 停止接受连接并交回或关闭监听套接字后关闭
+	conns     sync.WaitGroup    // 正在处理的连接，Retire后Start等待它们结束
+
+	retireOnce, stopOnce sync.Once
 }
 
 // NewProxy 创建一个新的TCP代理
-func NewProxy(proxyID, listenAddr, targetAddr string) *Proxy {
+func NewProxy(proxyID, listenAddr, targetAddr string, opts Options) *Proxy {
 	return &Proxy{
 		proxyID:    proxyID,
 		listenAddr: listenAddr,
 		targetAddr: targetAddr,
+		opts:       opts,
+		retire:     make(chan struct{}),
+		stopped:    make(chan struct{}),
 	}
 }
 
 // Start 启动TCP代理服务
 func (p *Proxy) Start(ctx context.Context) error {
-	listener, err := net.Listen("tcp4", p.listenAddr)
+	if p.opts.Congestion != "" {
+		if err := checkCongestion(p.opts.Congestion); err != nil {
+			p.opts.Log.Warnf("[%s] 无法使用拥塞控制算法%s，使用系统默认算法: %v", p.proxyID, p.opts.Congestion, err)
+			p.opts.Congestion = ""
+		}
+	}
+
+	if p.opts.Sockmap != nil {
+		if reason := p.sockmapConflict(); reason != "" {
+			p.opts.Log.Warnf("[%s] 规则使用了%s，不使用sockmap加速", p.proxyID, reason)
+			p.opts.Sockmap = nil
+		}
+	}
+
+	if p.opts.Handoff != nil {
+		if reason := p.handoffConflict(); reason != "" {
+			p.opts.Log.Warnf("[%s] 规则使用了%s，升级时连接不交给新进程", p.proxyID, reason)
+			p.opts.Handoff = nil
+		}
+	}
+
+	if p.opts.PoolReuse {
+		if reason := p.reuseConflict(); reason != "" {
+			p.opts.Log.Warnf("[%s] 规则使用了%s，不复用目标连接", p.proxyID, reason)
+			p.opts.PoolReuse = false
+		}
+	}
+
+	if p.opts.IdleTimeout > 0 {
+		go p.reapIdle(ctx)
+	}
+
+	// Retire后停止接受新连接，已建立的连接使用ctx继续转发
+	acceptCtx, stopAccept := context.WithCancel(ctx)
+	defer stopAccept()
+	go func() {
+		select {
+		case <-p.retire:
+		case <-acceptCtx.Done():
+		}
+		stopAccept()
+	}()
+	defer p.stop()
+
+	// 接管的连接不需要等待监听
+	for _, c := range p.adopted {
+		p.adopt(ctx, c)
+	}
+	p.adopted = nil
+
+	listenAddr := p.listenAddr
+	host, _, splitErr := net.SplitHostPort(p.listenAddr)
+	fallbackPorts := p.opts.FallbackPorts
+	if splitErr != nil {
+		fallbackPorts = nil // unix套接字和命名管道
+	}
+	listener := p.inherited
+	var err error
+	if listener == nil {
+		listener, err = bindretry.WaitAddress(acceptCtx, p.opts.NetWatch.Changed, func(err error) {
+			p.opts.Log.Warnf("[%s] 监听地址在本机不存在，等待网卡地址变化后重试: %v", p.proxyID, err)
+		}, func() (net.Listener, error) {
+			l, port, err := bindretry.Fallback(fallbackPorts, func() (net.Listener, error) {
+				return bindretry.Listen(acceptCtx, p.opts.BindRetry, func(err error, wait time.Duration) {
+					p.opts.Log.Warnf("[%s] 监听地址被占用，%v后重试: %v", p.proxyID, wait, err)
+				}, func() (net.Listener, error) {
+					return listen(p.opts.ListenNetwork, p.listenAddr)
+				})
+			}, func(port int) (net.Listener, error) {
+				return listen(p.opts.ListenNetwork, net.JoinHostPort(host, strconv.Itoa(port)))
+			})
+			if port > 0 {
+				listenAddr = net.JoinHostPort(host, strconv.Itoa(port))
+				p.opts.Log.Warnf("[%s] 监听地址%s被占用，改用备用端口: %s", p.proxyID, p.listenAddr, listenAddr)
+			}
+			return l, err
+		})
+	}
+	// 接手的套接字可能绑定在备用端口上，端口为0时由系统分配
+	if listener != nil && splitErr == nil {
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+			listenAddr = net.JoinHostPort(host, strconv.Itoa(addr.Port))
+		}
+	}
+	if acceptCtx.Err() != nil {
+		if listener != nil {
+			p.release(ctx, listener)
+		}
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("无法监听TCP: %w", err)
 	}
-	defer listener.Close()
+	if listenAddr != p.listenAddr {
+		p.opts.Health.SetListen(p.proxyID, listenAddr)
+	}
+	raw := listener
+
+	if sc, ok := listener.(syscall.Conn); ok && p.opts.Backlog > 0 {
+		if err := setBacklog(sc, p.opts.Backlog); err != nil {
+			p.opts.Log.Warnf("[%s] 设置监听队列长度失败: %v", p.proxyID, err)
+		}
+	}
+
+	if p.opts.PoolSize > 0 || p.opts.PoolReuse {
+		if p.opts.TargetGroup != nil || p.opts.TargetSerial != nil {
+			p.opts.Log.Warnf("[%s] 目标组和串口目标不使用连接池", p.proxyID)
+		} else {
+			poolOpts := connpool.Options{
+				Size:    p.opts.PoolSize,
+				MaxIdle: p.opts.PoolMaxIdle,
+				OnError: func(err error) {
+					p.opts.Log.Warnf("[%s] 预建立目标连接失败: %v", p.proxyID, err)
+					p.opts.Stats.AddTargetError(p.targetAddr, err, true)
+				},
+			}
+			if p.opts.PoolSize > 0 {
+				poolOpts.Dial = func() (net.Conn, error) { return p.dialTarget(p.targetAddr) }
+			} else {
+				poolOpts.Size = connpool.DefaultSize
+			}
+			p.pool = connpool.New(poolOpts)
+			go p.pool.Run(acceptCtx)
+		}
+	}
+
+	if p.opts.TLSConfig != nil {
+		listener = tls.NewListener(listener, p.opts.TLSConfig)
+	}
 
-	log.Printf("[%s] TCP转发已启动: %s -> %s\n", p.proxyID, p.listenAddr, p.targetAddr)
+	p.opts.Log.Infof("[%s] TCP转发已启动: %s -> %s\n", p.proxyID, listenAddr, p.targetAddr)
 
+	p.opts.Health.SetReady(p.proxyID, true)
+
+	// 交回套接字时只中断Accept，不关闭套接字；不支持截止时间的监听器(命名管道)直接关闭
+	interrupted := make(chan struct{})
 	go func() {
-		<-ctx.Done()
-		listener.Close()
+		defer close(interrupted)
+		<-acceptCtx.Done()
+		if ctx.Err() == nil {
+			if d, ok := raw.(interface{ SetDeadline(time.Time) error }); ok && d.SetDeadline(time.Now()) == nil {
+				return
+			}
+		}
+		raw.Close()
 	}()
 
+	p.serve(ctx, acceptCtx, listener)
+	<-interrupted
+
+	// 新代理接手监听套接字后由它标记就绪，这里不再改为未就绪
+	if ctx.Err() != nil {
+		p.opts.Health.SetReady(p.proxyID, false)
+	}
+	p.release(ctx, raw)
+	p.conns.Wait()
+	return nil
+}
+
+// 接受连接直到acceptCtx取消，连接在ctx下转发
+func (p *Proxy) serve(ctx, acceptCtx context.Context, listener net.Listener) {
 	for {
+		// 限制接受速率，未处理的连接留在内核队列中
+		if err := p.opts.Pacer.Wait(acceptCtx); err != nil {
+			return
+		}
+		// 内存超过预算时暂停接受；过载时丢弃新连接的规则改为在admit中拒绝
+		if p.opts.Overload == limit.OverloadQueue {
+			if err := p.opts.Memory.Wait(acceptCtx, p.opts.Priority); err != nil {
+				return
+			}
+		}
+
 		conn, err := listener.Accept()
 		if err != nil {
 			select {
-			case <-ctx.Done():
-				return nil
+			case <-acceptCtx.Done():
+				return
 			default:
-				log.Printf("[%s] TCP接受连接错误: %v", p.proxyID, err)
+				p.opts.Log.Errorf("[%s] TCP接受连接错误: %v", p.proxyID, err)
+				p.opts.Stats.AddError()
 				continue
 			}
 		}
 
-		go p.handleConnection(ctx, conn)
+		// 接受连接后才获取名额，空闲的监听不占用名额；名额用尽时在此阻塞，后续连接留在内核队列中
+		if err := p.acquireHandler(acceptCtx); err != nil {
+			conn.Close()
+			return
+		}
+
+		if !p.admit(conn) {
+			p.opts.Stats.AddDropped()
+			conn.Close()
+			p.opts.Handlers.Release()
+			continue
+		}
+
+		if exceeded, first := p.opts.Quota.Exceeded(); exceeded {
+			if first {
+				p.opts.Log.Warnf("[%s] 流量配额已用尽，本周期内拒绝新的TCP连接", p.proxyID)
+			}
+			p.opts.Stats.AddDropped()
+			conn.Close()
+			p.releaseHandler()
+			continue
+		}
+
+		connID := logging.NewConnID()
+		if !p.opts.PerIP.Acquire(conn.RemoteAddr()) {
+			p.opts.Log.Warnf("[%s] TCP连接被拒绝: %s 并发连接数已达上限", logging.Tag(p.proxyID, connID), conn.RemoteAddr())
+			p.opts.Stats.AddDropped()
+			conn.Close()
+			p.releaseHandler()
+			continue
+		}
+
+		p.conns.Add(1)
+		p.opts.Stats.Go(func() {
+			defer p.conns.Done()
+			defer p.releaseHandler()
+			defer p.opts.PerIP.Release(conn.RemoteAddr())
+			p.handleConnection(ctx, conn, connID)
+		})
+	}
+}
+
+// 依次获取规则级和全局的处理名额；过载时丢弃新连接的规则不在此等待全局名额，而由admit获取
+func (p *Proxy) acquireHandler(ctx context.Context) error {
+	if err := p.opts.Handlers.Acquire(ctx); err != nil {
+		return err
+	}
+	if p.opts.Overload == limit.OverloadDrop {
+		return nil
+	}
+	if err := p.opts.GlobalHandlers.Acquire(ctx); err != nil {
+		p.opts.Handlers.Release()
+		return err
+	}
+	return nil
+}
+
+func (p *Proxy) releaseHandler() {
+	p.opts.GlobalHandlers.Release()
+	p.opts.Handlers.Release()
+}
+
+// 过载时丢弃新连接的规则检查内存预算并获取全局名额，不能接纳时返回false
+func (p *Proxy) admit(conn net.Conn) bool {
+	if p.opts.Overload != limit.OverloadDrop {
+		return true
+	}
+	if p.opts.Memory.Exceeded(p.opts.Priority) {
+		p.opts.Log.Warnf("[%s] TCP连接被拒绝: %s 内存用量超过预算", p.proxyID, conn.RemoteAddr())
+		return false
+	}
+	if !p.opts.GlobalHandlers.TryAcquire() {
+		p.opts.Log.Warnf("[%s] TCP连接被拒绝: %s 全局连接数已达上限", p.proxyID, conn.RemoteAddr())
+		return false
 	}
+	return true
 }
 
-func (p *Proxy) handleConnection(ctx context.Context, clientConn net.Conn) {
+// 处理一个TCP连接，connID为连接的唯一ID，该连接的所有日志都带有该ID
+func (p *Proxy) handleConnection(ctx context.Context, clientConn net.Conn, connID string) {
 	defer clientConn.Close()
+	tag := logging.Tag(p.proxyID, connID)
+	connLog := p.opts.Log.Conn() // 抽样未选中的连接只记录警告和错误
 
-	targetConn, err := net.Dial("tcp6", p.targetAddr)
-	if err != nil {
-		log.Printf("[%s]无法连接到TCP目标 %s: %v", p.proxyID, p.targetAddr, err)
+	// 终止TLS时先完成握手，以便中间件获得SNI
+	var sni string
+	if tlsConn, ok := clientConn.(*tls.Conn); ok {
+		hsCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+		err := tlsConn.HandshakeContext(hsCtx)
+		cancel()
+		if err != nil {
+			connLog.Warnf("[%s] TLS握手失败: %s: %v", tag, clientConn.RemoteAddr(), err)
+			p.opts.Stats.AddError()
+			return
+		}
+		sni = tlsConn.ConnectionState().ServerName
+	}
+
+	// 按Host头选择目标时先读取请求头，已读取的数据随后照常转发给目标
+	var host string
+	if p.opts.HostRoutes != nil {
+		conn, h, err := vhost.ReadHost(clientConn, vhost.DefaultReadTimeout)
+		if err != nil {
+			connLog.Warnf("[%s] 无法读取HTTP请求头: %s: %v", tag, clientConn.RemoteAddr(), err)
+			p.opts.Stats.AddError()
+			return
+		}
+		clientConn, host = conn, h
+	}
+
+	info := &middleware.Info{
+		ProxyID:    p.proxyID,
+		ConnID:     connID,
+		Protocol:   "tcp",
+		ClientAddr: clientConn.RemoteAddr(),
+		ListenAddr: clientConn.LocalAddr(),
+		TargetAddr: p.targetAddr,
+		SNI:        sni,
+	}
+	var candidates []string
+	if target, ok := p.opts.HostRoutes.Target(host); ok {
+		info.TargetAddr = target
+		connLog.Debugf("[%s] 按Host %s 选择目标 %s", tag, host, target)
+	} else if p.opts.TargetGroup != nil {
+		candidates = p.opts.TargetGroup.Order()
+		info.TargetAddr = candidates[0]
+	}
+	if err := p.opts.Middlewares.OnAccept(info); err != nil {
+		connLog.Warnf("[%s] TCP连接被中间件拒绝: %s: %v", tag, clientConn.RemoteAddr(), err)
+		p.opts.Stats.AddDropped()
+		return
+	}
+
+	startTime := time.Now()
+	p.opts.Stats.ConnOpened()
+	defer p.opts.Stats.ConnClosed()
+
+	if err := p.opts.Middlewares.OnDial(info); err != nil {
+		connLog.Warnf("[%s] TCP连接目标前被中间件中止: %s: %v", tag, clientConn.RemoteAddr(), err)
+		p.opts.Stats.AddDropped()
 		return
 	}
-	defer targetConn.Close()
 
-	log.Printf("[%s] TCP转发: %s -> %s", p.proxyID, clientConn.RemoteAddr(), p.targetAddr)
+	// 中间件没有改变目标时优先使用连接池中的连接
+	var targetConn net.Conn
+	reused := false // 目标连接已放回连接池
+	if info.TargetAddr == p.targetAddr {
+		if targetConn = p.pool.Get(); targetConn != nil {
+			connLog.Debugf("[%s] 使用连接池中的TCP目标连接 %s", tag, info.TargetAddr)
+		}
+	}
+	var err error
+	if targetConn == nil {
+		dialStart := time.Now()
+		targetConn, err = p.dialCandidates(info, candidates)
+		// 只唤醒规则的目标，中间件或主机路由改变了目标时不唤醒；连接池预先建立连接时也不唤醒
+		if p.opts.Wake.Asleep(err) && info.TargetAddr == p.targetAddr {
+			targetConn, clientConn, err = p.wakeTarget(ctx, info, clientConn, tag)
+			if errors.Is(err, errWakeAborted) {
+				connLog.Infof("[%s] 等待目标唤醒时客户端断开或转发已停止: %s", tag, clientConn.RemoteAddr())
+				return
+			}
+		}
+		if err != nil {
+			connLog.Errorf("[%s]无法连接到TCP目标 %s: %v", tag, info.TargetAddr, err)
+			p.opts.Events.PublishConn(events.TypeError, info, err)
+			return
+		}
+		connLog.Debugf("[%s] 已连接TCP目标 %s, 耗时%s", tag, info.TargetAddr, time.Since(dialStart).Round(time.Microsecond))
+	}
+	defer func(conn net.Conn) {
+		if !reused {
+			conn.Close()
+		}
+	}(targetConn)
+
+	p.setSocketOptions(tag, clientConn)
+	p.setSocketOptions(tag, targetConn)
+
+	clientConn = p.opts.Shadowsocks.WrapClient(clientConn)
+	if targetConn, err = p.opts.Shadowsocks.WrapTarget(targetConn); err != nil {
+		connLog.Errorf("[%s] 发送Shadowsocks地址头失败: %v", tag, err)
+		p.opts.Stats.AddTargetError(info.TargetAddr, err, false)
+		p.opts.Events.PublishConn(events.TypeError, info, err)
+		return
+	}
+	if err := proxyproto.WriteHeader(targetConn, p.opts.ProxyProtocol, info.ClientAddr, info.ListenAddr); err != nil {
+		connLog.Errorf("[%s] 发送PROXY协议头失败: %v", tag, err)
+		p.opts.Stats.AddTargetError(info.TargetAddr, err, false)
+		p.opts.Events.PublishConn(events.TypeError, info, err)
+		return
+	}
+
+	rec := p.opts.Recorder.Open(p.proxyID, "tcp", clientConn.RemoteAddr())
+	defer rec.Close()
+
+	// 包装后的连接关闭时须关闭底层连接，上面的defer仍会关闭原始连接作为兜底
+	rawTarget, _ := targetConn.(*net.TCPConn)
+	clientConn = p.opts.Middlewares.WrapConn(info, clientConn, middleware.SideClient)
+	targetConn = p.opts.Middlewares.WrapConn(info, targetConn, middleware.SideTarget)
+
+	// 只复用连接到规则目标且未被中间件包装的连接
+	var reuse *reuseState
+	if wrapped, _ := targetConn.(*net.TCPConn); p.opts.PoolReuse && p.pool != nil && rawTarget != nil &&
+		wrapped == rawTarget && info.TargetAddr == p.targetAddr {
+		reuse = &reuseState{}
+	}
+
+	// 升级时只交接两端都是未经包装的TCP连接的转发
+	var relay *handoff.Relay
+	clientTCP, _ := clientConn.(*net.TCPConn)
+	targetTCP, _ := targetConn.(*net.TCPConn)
+	if clientTCP != nil && targetTCP != nil {
+		relay = p.opts.Handoff.Register(handoff.State{ProxyID: p.proxyID, ConnID: connID, Target: info.TargetAddr, Started: startTime}, clientTCP, targetTCP)
+	}
+
+	connLog.Infof("[%s] TCP转发: %s -> %s -> %s", tag, clientConn.RemoteAddr(), info.ListenAddr, info.TargetAddr)
+	p.opts.Middlewares.OnConnect(info)
+	p.opts.Events.PublishConn(events.TypeOpen, info, nil)
+	reused = p.relay(ctx, info, clientConn, targetConn, rec, reuse, relay, startTime, 0, 0)
+}
+
+// 在客户端和目标连接之间双向转发直到任一方向结束，返回目标连接是否已放回连接池；
+// bytesUp和bytesDown为接管的连接此前已转发的字节数，连接交给新进程时不记录连接结束
+func (p *Proxy) relay(ctx context.Context, info *middleware.Info, clientConn, targetConn net.Conn, rec *record.File,
+	reuse *reuseState, relay *handoff.Relay, startTime time.Time, bytesUp, bytesDown int64) (reused bool) {
+	tag := logging.Tag(p.proxyID, info.ConnID)
+	connLog := p.opts.Log.Conn()
 
 	// 创建一个新的上下文，在连接关闭时取消
 	connCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// 到达最长持续时间时取消连接，接管的连接从最初建立时计算
+	if lifetime := p.opts.MaxConnLifetime; lifetime > 0 {
+		timer := time.AfterFunc(lifetime-time.Since(startTime), func() {
+			connLog.Infof("[%s] TCP连接达到最长持续时间%s，已关闭: %s", tag, lifetime, clientConn.RemoteAddr())
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	// 登记为活动连接，供空闲回收和状态报告列出最早的连接
+	active := p.opts.Stats.Track(info.ConnID, clientConn.RemoteAddr().String(), info.TargetAddr, startTime, func() {
+		connLog.Infof("[%s] TCP连接空闲超过%s，已关闭: %s", tag, p.opts.IdleTimeout, clientConn.RemoteAddr())
+		cancel()
+	})
+	defer p.opts.Stats.Untrack(active)
+
+	// 被动模式尚未被连接的数据端口在控制连接关闭时一并关闭，已建立的数据连接传输完才结束；
+	// 数据连接的流量使控制连接不被当作空闲连接
+	ftpControl := p.opts.FTP.Control(ctx, tag, connLog, clientConn, targetConn, active.Touch)
+	defer ftpControl.Close()
+	// RTSP的媒体中转端口同样随控制连接关闭，媒体流量使控制连接保持活动
+	rtspControl := p.opts.RTSP.Control(tag, connLog, clientConn, targetConn, active.Touch)
+	defer rtspControl.Close()
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	// 对接前已收到的数据和连接关闭仍由下面的转发循环处理
+	var pair *sockmap.Pair
+	if p.opts.Sockmap != nil {
+		clientTCP, ok1 := clientConn.(*net.TCPConn)
+		targetTCP, ok2 := targetConn.(*net.TCPConn)
+		if ok1 && ok2 {
+			var err error
+			if pair, err = p.opts.Sockmap.Splice(clientTCP, targetTCP); err != nil {
+				connLog.Warnf("[%s] sockmap对接失败，使用普通转发: %v", tag, err)
+			}
+			defer pair.Close()
+		}
+	}
+
+	// 接管的连接此前转发的字节数同样计入传输上限
+	transferCap := newTransferCap(p.opts.MaxConnBytes, bytesUp+bytesDown)
+	up := &countingWriter{w: transferCap.writer(p.limitWriter(connCtx, p.opts.Chaos.Writer(targetConn))), add: p.addUp, active: active}
+	down := &countingWriter{w: transferCap.writer(p.limitWriter(connCtx, p.opts.Chaos.Writer(clientConn))), add: p.addDown, active: active}
+	up.n.Store(bytesUp)
+	down.n.Store(bytesDown)
+
 	// 客户端 -> 目标
-	go func() {
+	p.opts.Stats.Go(func() {
 		defer wg.Done()
 		defer cancel() // 任一方向出错都会取消整个连接
-		if _, err := io.Copy(targetConn, clientConn); err != nil {
-			if !isClosedConnError(err) {
-				log.Printf("[%s] TCP客户端->目标错误: %v", p.proxyID, err)
+		_, err := io.Copy(up, rtspControl.RequestReader(p.clientReader(clientConn, rec)))
+		if err == nil {
+			pair.Drain(true, sockmap.DefaultDrainTimeout)
+			reuse.clientDone()
+		} else if relay.Interrupted(err) {
+			// 暂停转发以交给新进程
+		} else if pair == nil || !errors.Is(err, syscall.EPIPE) {
+			if errors.Is(err, inspect.ErrBlocked) {
+				connLog.Warnf("[%s] TCP连接被断开: %s 数据命中禁止模式", tag, clientConn.RemoteAddr())
+				p.opts.Stats.AddDropped()
+			} else if errors.Is(err, errTransferCap) {
+				p.capClosed(tag, clientConn.RemoteAddr())
+			} else if errors.Is(err, chaos.ErrInjectedReset) {
+				connLog.Infof("[%s] TCP连接被故障注入重置: %s", tag, clientConn.RemoteAddr())
+			} else if !isClosedConnError(err) {
+				connLog.Errorf("[%s] TCP客户端->目标错误: %v", tag, err)
+				p.addRelayError(info, err, true)
 			}
 		}
-	}()
+	})
 
 	// 目标 -> 客户端
-	go func() {
+	p.opts.Stats.Go(func() {
 		defer wg.Done()
 		defer cancel() // 任一方向出错都会取消整个连接
-		if _, err := io.Copy(clientConn, targetConn); err != nil {
-			if !isClosedConnError(err) {
-				log.Printf("[%s] TCP目标->客户端错误: %v", p.proxyID, err)
+		_, err := io.Copy(down, rewrite.NewReader(rtspControl.ResponseReader(ftpControl.Reader(targetConn)), p.opts.RewriteDown))
+		if err == nil {
+			pair.Drain(false, sockmap.DefaultDrainTimeout)
+		} else if reuse.interrupted(err) {
+			// 客户端断开后停止读取目标，目标连接可以复用
+		} else if relay.Interrupted(err) {
+			// 暂停转发以交给新进程
+		} else if pair == nil || !errors.Is(err, syscall.EPIPE) {
+			if errors.Is(err, chaos.ErrInjectedReset) {
+				connLog.Infof("[%s] TCP连接被故障注入重置: %s", tag, clientConn.RemoteAddr())
+			} else if errors.Is(err, errTransferCap) {
+				p.capClosed(tag, clientConn.RemoteAddr())
+			} else if !isClosedConnError(err) {
+				connLog.Errorf("[%s] TCP目标->客户端错误: %v", tag, err)
+				p.addRelayError(info, err, false)
 			}
 		}
-	}()
+	})
 
 	// 等待连接结束或上下文被取消
 	select {
 	case <-connCtx.Done():
-		// 连接已取消，关闭连接并等待goroutine完成
-		clientConn.Close()
-		targetConn.Close()
+		// 连接已取消，关闭连接并等待goroutine完成；对接的连接先计入内核转发的流量
+		if pair != nil {
+			kernelUp, kernelDown := pair.Forwarded(up.n.Load(), down.n.Load())
+			up.n.Add(kernelUp)
+			p.addUp(kernelUp)
+			down.n.Add(kernelDown)
+			p.addDown(kernelDown)
+		}
+		// 暂停交接时等另一方向写完已读到的数据后因读取超时退出，不关闭连接
+		if !relay.Paused() {
+			clientConn.Close()
+			if !reuse.stop(targetConn) {
+				targetConn.Close()
+			}
+		}
 	}
 
 	wg.Wait()
+	if relay.Finish(up.n.Load(), down.n.Load()) {
+		connLog.Infof("[%s] TCP连接已交给新进程: %s, 已转发上行%d字节, 下行%d字节",
+			tag, clientConn.RemoteAddr(), up.n.Load(), down.n.Load())
+		return false
+	}
+	if reuse.ok() {
+		targetConn.SetReadDeadline(time.Time{})
+		p.pool.Put(targetConn)
+		reused = true
+		connLog.Debugf("[%s] TCP目标连接已放回连接池", tag)
+	}
+
+	endTime := time.Now()
+	info.BytesUp, info.BytesDown, info.Duration = up.n.Load(), down.n.Load(), endTime.Sub(startTime)
+	p.opts.Middlewares.OnClose(info)
+
+	p.opts.Stats.ConnFinished(endTime.Sub(startTime), uint64(up.n.Load()+down.n.Load()))
+	p.opts.Flows.ExportConn(flow.ProtoTCP, clientConn.RemoteAddr(), targetConn.RemoteAddr(), startTime, endTime,
+		uint64(up.n.Load()), uint64(up.writes.Load()), uint64(down.n.Load()), uint64(down.writes.Load()))
+
+	connLog.Infof("[%s] TCP连接关闭: %s, 上行%d字节, 下行%d字节, 持续%s",
+		tag, clientConn.RemoteAddr(), up.n.Load(), down.n.Load(), endTime.Sub(startTime).Round(time.Millisecond))
+	p.opts.Events.PublishConn(events.TypeClose, info, nil)
+	return reused
+}
+
+// 返回规则中与sockmap加速冲突的功能，没有冲突时返回空字符串
+func (p *Proxy) sockmapConflict() string {
+	switch {
+	case p.opts.TLSConfig != nil:
+		return "TLS"
+	case p.opts.Shadowsocks != nil:
+		return "Shadowsocks"
+	case len(p.opts.RewriteUp) > 0 || len(p.opts.RewriteDown) > 0:
+		return "数据替换"
+	case p.opts.Blocker != nil:
+		return "禁止模式"
+	case p.opts.Recorder != nil:
+		return "录制"
+	case p.opts.Chaos != nil:
+		return "故障注入"
+	case p.opts.Bandwidth != nil:
+		return "全局带宽限制"
+	case p.opts.RuleBandwidth != nil:
+		return "规则带宽限制"
+	case p.opts.MaxConnBytes > 0:
+		return "单连接传输上限"
+	case p.opts.HostRoutes != nil:
+		return "HTTP主机路由"
+	case p.opts.FTP != nil:
+		return "FTP被动模式"
+	case p.opts.RTSP != nil:
+		return "RTSP媒体转发"
+	case p.opts.IdleTimeout > 0:
+		// 内核转发的数据不经过用户态，无法判断连接是否空闲
+		return "TCP空闲超时"
+	}
+	return ""
+}
+
+// 定期关闭空闲超过IdleTimeout的连接，同一规则的多个代理共享统计，任一代理都可以回收
+func (p *Proxy) reapIdle(ctx context.Context) {
+	ticker := time.NewTicker(min(max(p.opts.IdleTimeout/2, time.Second), 30*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.opts.Stats.Reap(p.opts.IdleTimeout)
+		}
+	}
+}
+
+// 返回先申请规则带宽、再申请全局带宽后写入w的Writer
+func (p *Proxy) limitWriter(ctx context.Context, w io.Writer) io.Writer {
+	return p.opts.RuleBandwidth.Writer(ctx, p.opts.Priority, p.opts.Bandwidth.Writer(ctx, p.opts.Priority, w))
+}
+
+// 返回规则中与连接交接冲突的功能，这些功能的状态无法交给新进程，没有冲突时返回空字符串
+func (p *Proxy) handoffConflict() string {
+	switch {
+	case p.opts.TLSConfig != nil:
+		return "TLS"
+	case p.opts.Shadowsocks != nil:
+		return "Shadowsocks"
+	case len(p.opts.RewriteUp) > 0 || len(p.opts.RewriteDown) > 0:
+		return "数据替换"
+	case p.opts.Blocker != nil:
+		return "禁止模式"
+	case p.opts.Recorder != nil:
+		return "录制"
+	case p.opts.Chaos != nil:
+		return "故障注入"
+	case p.opts.Sockmap != nil:
+		return "sockmap加速"
+	case p.opts.FTP != nil:
+		return "FTP被动模式"
+	case p.opts.RTSP != nil:
+		return "RTSP媒体转发"
+	case p.opts.Bandwidth != nil:
+		return "全局带宽限制"
+	case p.opts.RuleBandwidth != nil:
+		return "规则带宽限制"
+	}
+	return ""
+}
+
+// 返回规则中与复用目标连接冲突的功能，没有冲突时返回空字符串
+func (p *Proxy) reuseConflict() string {
+	switch {
+	case p.opts.ProxyProtocol > 0:
+		return "PROXY协议"
+	case p.opts.Shadowsocks != nil:
+		return "Shadowsocks"
+	case p.opts.Sockmap != nil:
+		return "sockmap加速"
+	case p.opts.FTP != nil:
+		return "FTP被动模式"
+	case p.opts.RTSP != nil:
+		return "RTSP媒体转发"
+	}
+	return ""
+}
+
+// 一个连接中复用目标连接的状态，nil表示不复用
+type reuseState struct {
+	done    atomic.Bool // 客户端已正常断开
+	stopped atomic.Bool // 已通过读取超时停止读取目标
+	idle    atomic.Bool // 目标方向因读取超时结束，期间没有出错
+}
+
+// 客户端正常断开时调用
+func (r *reuseState) clientDone() {
+	if r != nil {
+		r.done.Store(true)
+	}
+}
+
+// 客户端正常断开时以读取超时停止读取目标而不关闭目标连接，返回是否已停止
+func (r *reuseState) stop(conn net.Conn) bool {
+	if r == nil || !r.done.Load() {
+		return false
+	}
+	r.stopped.Store(true)
+	return conn.SetReadDeadline(time.Now()) == nil
+}
+
+// 判断目标方向的错误是否由stop引起
+func (r *reuseState) interrupted(err error) bool {
+	if r == nil || !r.stopped.Load() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	r.idle.Store(true)
+	return true
+}
+
+// 目标连接是否可以放回连接池
+func (r *reuseState) ok() bool {
+	return r != nil && r.idle.Load()
+}
+
+// 客户端数据依次经过录制、禁止模式检查和查找替换
+func (p *Proxy) clientReader(clientConn net.Conn, rec *record.File) io.Reader {
+	return rewrite.NewReader(inspect.NewReader(rec.Reader(clientConn), p.opts.Blocker), p.opts.RewriteUp)
+}
+
+// 按出错的一端记录转发错误：上行方向读取出错、下行方向写入出错时为客户端一端，其余为目标
+func (p *Proxy) addRelayError(info *middleware.Info, err error, up bool) {
+	var opErr *net.OpError
+	read := errors.As(err, &opErr) && opErr.Op == "read"
+	if read == up {
+		p.opts.Stats.AddTargetError(stats.PeerClient, err, false)
+	} else {
+		p.opts.Stats.AddTargetError(info.TargetAddr, err, false)
+	}
+	p.opts.Events.PublishConn(events.TypeError, info, err)
+}
+
+// 记录客户端到目标方向的流量
+func (p *Proxy) addUp(n int64) {
+	p.opts.Stats.AddUp(n)
+	p.opts.Quota.Add(n)
+}
+
+// 记录目标到客户端方向的流量
+func (p *Proxy) addDown(n int64) {
+	p.opts.Stats.AddDown(n)
+	p.opts.Quota.Add(n)
+}
+
+// errTransferCap 连接达到单连接传输上限
+var errTransferCap = errors.New("达到单连接传输上限")
+
+// 一个连接两个方向共享的传输上限，nil表示不限制
+type transferCap struct {
+	remaining atomic.Int64
+	reached   atomic.Bool // 已有一个方向返回errTransferCap
+}
+
+// 创建上限为max字节、已传输used字节的传输上限，max<=0时返回nil
+func newTransferCap(max, used int64) *transferCap {
+	if max <= 0 {
+		return nil
+	}
+	c := &transferCap{}
+	c.remaining.Store(max - used)
+	return c
+}
+
+// 返回超过上限时只写入剩余部分并返回errTransferCap的Writer，c为nil时返回w
+func (c *transferCap) writer(w io.Writer) io.Writer {
+	if c == nil {
+		return w
+	}
+	return &capWriter{c: c, w: w}
+}
+
+type capWriter struct {
+	c *transferCap
+	w io.Writer
+}
+
+func (cw *capWriter) Write(b []byte) (int, error) {
+	remaining := cw.c.remaining.Add(-int64(len(b)))
+	if remaining >= 0 {
+		return cw.w.Write(b)
+	}
+	n, err := 0, error(nil)
+	if allowed := int64(len(b)) + remaining; allowed > 0 {
+		n, err = cw.w.Write(b[:allowed])
+	}
+	if err != nil {
+		return n, err
+	}
+	// 两个方向都达到上限时只报告一次，另一方向按连接已关闭处理
+	if cw.c.reached.CompareAndSwap(false, true) {
+		return n, errTransferCap
+	}
+	return n, net.ErrClosed
+}
+
+// 记录达到传输上限被关闭的连接
+func (p *Proxy) capClosed(tag string, client net.Addr) {
+	p.opts.Log.Conn().Warnf("[%s] TCP连接达到传输上限%d字节，已关闭: %s", tag, p.opts.MaxConnBytes, client)
+	p.opts.Stats.AddCapClosed()
+}
+
+// countingWriter 在写入时累加字节数，使统计在长连接存续期间也能实时更新
+type countingWriter struct {
+	w      io.Writer
+	n      atomic.Int64
+	writes atomic.Int64 // 写入次数，作为流记录中的近似包数
+	add    func(int64)
+	active *stats.ActiveConn // 写入时记录连接有数据转发
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n.Add(int64(n))
+	c.writes.Add(1)
+	c.add(int64(n))
+	c.active.Touch()
+	return n, err
+}
+
+// 设置连接的内核收发缓冲区大小、拥塞控制算法和DSCP，TLS连接作用于其底层TCP连接
+func (p *Proxy) setSocketOptions(tag string, conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if p.opts.SocketReadBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(p.opts.SocketReadBuffer); err != nil {
+			p.opts.Log.Warnf("[%s] 设置TCP接收缓冲区失败: %v", tag, err)
+		}
+	}
+	if p.opts.SocketWriteBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(p.opts.SocketWriteBuffer); err != nil {
+			p.opts.Log.Warnf("[%s] 设置TCP发送缓冲区失败: %v", tag, err)
+		}
+	}
+	if p.opts.Congestion != "" {
+		if err := setCongestion(tcpConn, p.opts.Congestion); err != nil {
+			p.opts.Log.Warnf("[%s] 设置TCP拥塞控制算法失败: %v", tag, err)
+		}
+	}
+	if p.opts.DSCP > 0 {
+		if err := dscp.Set(tcpConn, p.opts.DSCP); err != nil {
+			p.opts.Log.Warnf("[%s] 设置TCP连接的DSCP失败: %v", tag, err)
+		}
+	}
 }
 
 // 判断是否为连接关闭错误
@@ -116,8 +1025,10 @@ func isClosedConnError(err error) bool {
 	if err == io.EOF {
 		return true
 	}
-	if opErr, ok := err.(*net.OpError); ok {
-		return opErr.Err.Error() == "use of closed network connection"
+	// 另一方向结束后等待带宽的写入被取消
+	if errors.Is(err, context.Canceled) {
+		return true
 	}
-	return false
+	// 客户端连接实现了WriterTo，错误可能被多层OpError包装
+	return errors.Is(err, net.ErrClosed)
 }
@@ -0,0 +1,283 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/ftp"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+)
+
+// 回显目标，返回地址
+func tcpEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// 启动代理并等待其开始监听，返回监听地址和Start的返回值
+func runProxy(t *testing.T, ctx context.Context, target string, opts Options) (*Proxy, string, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	opts.Log = logging.New(logging.LevelError)
+	opts.DialNetwork = "tcp4"
+	p := NewProxy("test", addr, target, opts)
+	done := make(chan error, 1)
+	go func() { done <- p.Start(ctx) }()
+
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if conn, err := net.Dial("tcp4", addr); err == nil {
+			conn.Close()
+			return p, addr, done
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("代理没有开始监听")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func echoOnce(conn net.Conn, msg string) (string, error) {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(conn, buf)
+	return string(buf), err
+}
+
+func TestProxyForwards(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	_, addr, done := runProxy(t, ctx, tcpEcho(t), Options{})
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, err := echoOnce(conn, "hello"); err != nil || got != "hello" {
+		t.Fatalf("经代理收到 %q, %v", got, err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Start返回 %v", err)
+	}
+}
+
+// Retire后不再接受新连接，已建立的连接继续转发，全部结束后Start返回
+func TestProxyRetireDrainsConnections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, addr, done := runProxy(t, ctx, tcpEcho(t), Options{})
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echoOnce(conn, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Retire(nil)
+	if c, err := net.Dial("tcp4", addr); err == nil {
+		c.Close()
+		t.Error("Retire后仍接受新连接")
+	}
+	if got, err := echoOnce(conn, "b"); err != nil || got != "b" {
+		t.Errorf("Retire后已建立的连接收到 %q, %v", got, err)
+	}
+	select {
+	case <-done:
+		t.Fatal("连接结束前Start已返回")
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("连接结束后Start没有返回")
+	}
+}
+
+// 流量配额用尽后拒绝新连接
+func TestProxyQuotaExceeded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := quota.New(1, 1)
+	_, addr, _ := runProxy(t, ctx, tcpEcho(t), Options{Quota: q})
+	q.Add(1)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := echoOnce(conn, "x"); err == nil {
+		t.Error("配额用尽后连接仍被转发")
+	}
+}
+
+// 记录连接事件的中间件
+type hookCounter struct {
+	middleware.Base
+	mu               sync.Mutex
+	connects, closes int
+}
+
+func (h *hookCounter) OnConnect(*middleware.Info) {
+	h.mu.Lock()
+	h.connects++
+	h.mu.Unlock()
+}
+
+func (h *hookCounter) OnClose(*middleware.Info) {
+	h.mu.Lock()
+	h.closes++
+	h.mu.Unlock()
+}
+
+func (h *hookCounter) counts() (connects, closes int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.connects, h.closes
+}
+
+// 连接目标失败时不触发OnConnect；触发了OnConnect的连接结束时一定触发OnClose
+func TestProxyConnectHooksPaired(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := ln.Addr().String()
+	ln.Close()
+	failed := &hookCounter{}
+	_, addr, _ := runProxy(t, ctx, unreachable, Options{Middlewares: middleware.Chain{failed}})
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("目标不可达时连接收到了数据")
+	}
+	conn.Close()
+	if connects, closes := failed.counts(); connects != 0 || closes != 0 {
+		t.Errorf("目标不可达时触发了%d次OnConnect和%d次OnClose", connects, closes)
+	}
+
+	ok := &hookCounter{}
+	_, addr, _ = runProxy(t, ctx, tcpEcho(t), Options{Middlewares: middleware.Chain{ok}})
+	conn, err = net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echoOnce(conn, "x"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		connects, closes := ok.counts()
+		if connects > 0 && connects == closes {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("连接结束后OnConnect触发%d次，OnClose触发%d次", connects, closes)
+		}
+	}
+}
+
+// FTP控制连接关闭后，已建立的被动模式数据连接继续传输
+func TestProxyFTPDataOutlivesControl(t *testing.T) {
+	p := int(netip.MustParseAddrPort(tcpEcho(t)).Port())
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "227 Entering Passive Mode (127,0,0,1,%d,%d).\r\n", p>>8, p&0xff)
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, addr, _ := runProxy(t, ctx, ln.Addr().String(), Options{FTP: ftp.NewHelper(ftp.Options{})})
+
+	control, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(control).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h1, h2, h3, h4, p1, p2 int
+	if _, err := fmt.Sscanf(line, "227 Entering Passive Mode (%d,%d,%d,%d,%d,%d).", &h1, &h2, &h3, &h4, &p1, &p2); err != nil {
+		t.Fatalf("PASV响应%q: %v", line, err)
+	}
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", p1<<8|p2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, err := echoOnce(conn, "before"); err != nil || got != "before" {
+		t.Fatalf("数据连接收到%q: %v", got, err)
+	}
+
+	control.Close()
+	time.Sleep(100 * time.Millisecond)
+	if got, err := echoOnce(conn, "after"); err != nil || got != "after" {
+		t.Errorf("控制连接关闭后数据连接收到%q: %v", got, err)
+	}
+}
@@ -0,0 +1,93 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+)
+
+// 等待唤醒目标期间最多缓存的客户端数据，超过后不再读取客户端
+const maxWakeBuffer = 64 * 1024
+
+// errWakeAborted 等待目标唤醒期间客户端断开或转发停止
+var errWakeAborted = errors.New("等待目标唤醒时客户端断开或转发已停止")
+
+// 目标无响应时发送网络唤醒数据包，等待目标启动后连接。等待期间读取客户端以便发现客户端断开，
+// 已读取的数据随后照常转发给目标；返回目标连接和之后应使用的客户端连接
+func (p *Proxy) wakeTarget(ctx context.Context, info *middleware.Info, clientConn net.Conn, tag string) (net.Conn, net.Conn, error) {
+	ctx, watch := watchClient(ctx, clientConn)
+	targetConn, err := p.opts.Wake.Dial(ctx, tag, info.TargetAddr, func() (net.Conn, error) {
+		return p.dialTarget(info.TargetAddr)
+	})
+	aborted := ctx.Err() != nil
+	clientConn = watch.stop()
+	if err != nil {
+		if aborted {
+			return nil, clientConn, errWakeAborted
+		}
+		p.opts.Stats.AddTargetError(info.TargetAddr, err, true)
+	}
+	return targetConn, clientConn, err
+}
+
+// 在后台读取客户端的数据，客户端断开时取消ctx
+type clientWatch struct {
+	conn   net.Conn
+	buf    bytes.Buffer
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+func watchClient(ctx context.Context, conn net.Conn) (context.Context, *clientWatch) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &clientWatch{conn: conn, done: make(chan struct{}), cancel: cancel}
+	go func() {
+		defer close(w.done)
+		chunk := make([]byte, 4096)
+		for w.buf.Len() < maxWakeBuffer {
+			n, err := conn.Read(chunk)
+			w.buf.Write(chunk[:n])
+			if err != nil {
+				var netErr net.Error
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					cancel()
+				}
+				return
+			}
+		}
+	}()
+	return ctx, w
+}
+
+// 停止读取客户端，返回先读出已缓存数据的客户端连接
+func (w *clientWatch) stop() net.Conn {
+	w.conn.SetReadDeadline(time.Unix(1, 0))
+	<-w.done
+	w.conn.SetReadDeadline(time.Time{})
+	w.cancel()
+	if w.buf.Len() == 0 {
+		return w.conn
+	}
+	return &bufferedConn{Conn: w.conn, buf: &w.buf}
+}
+
+// 先读出缓存的数据，再从原连接读取
+type bufferedConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if c.buf != nil {
+		n, _ := c.buf.Read(b)
+		if c.buf.Len() == 0 {
+			c.buf = nil
+		}
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
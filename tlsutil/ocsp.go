@@ -0,0 +1,145 @@
+package tlsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// 默认OCSP响应刷新间隔
+const DefaultOCSPRefreshInterval = 12 * time.Hour
+
+var ocspClient = &http.Client{Timeout: 10 * time.Second}
+
+// StapleOCSP 立即为所有证书获取OCSP响应，之后定期刷新，直到上下文取消
+func (r *CertReloader) StapleOCSP(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultOCSPRefreshInterval
+	}
+
+	r.mu.Lock()
+	r.stapling = true
+	r.mu.Unlock()
+
+	r.refreshStaples(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.refreshStaples(ctx)
+		}
+	}
+}
+
+// 刷新所有证书的OCSP响应
+func (r *CertReloader) refreshStaples(ctx context.Context) {
+	r.mu.RLock()
+	certs := make([]*loadedCert, len(r.certs))
+	copy(certs, r.certs)
+	r.mu.RUnlock()
+
+	for _, lc := range certs {
+		r.staple(ctx, lc)
+	}
+}
+
+// 为单个证书获取OCSP响应并装订，失败时保留仍在有效期内的旧响应
+func (r *CertReloader) staple(ctx context.Context, lc *loadedCert) {
+	raw, resp, err := fetchOCSP(ctx, lc.cert)
+	if err != nil {
+		if lc.cert.OCSPStaple != nil && time.Now().After(lc.ocspNextUpdate) {
+			r.replaceStaple(lc, nil, time.Time{})
+		}
+		log.Printf("获取OCSP响应失败 %s: %v", lc.pair.CertFile, err)
+		return
+	}
+
+	r.replaceStaple(lc, raw, resp.NextUpdate)
+}
+
+// 以新证书副本替换装订内容，避免与正在进行的握手产生数据竞争
+func (r *CertReloader) replaceStaple(lc *loadedCert, raw []byte, nextUpdate time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, cur := range r.certs {
+		if cur != lc {
+			continue
+		}
+		cert := *lc.cert
+		cert.OCSPStaple = raw
+		r.certs[i] = &loadedCert{
+			pair:           lc.pair,
+			cert:           &cert,
+			modTime:        lc.modTime,
+			ocspNextUpdate: nextUpdate,
+		}
+		return
+	}
+}
+
+// 向证书中的OCSP服务器查询证书状态
+func fetchOCSP(ctx context.Context, cert *tls.Certificate) ([]byte, *ocsp.Response, error) {
+	leaf := cert.Leaf
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("证书未包含OCSP服务器地址")
+	}
+	if len(cert.Certificate) < 2 {
+		return nil, nil, errors.New("证书链中缺少签发者证书")
+	}
+
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("无法解析签发者证书: %w", err)
+	}
+
+	reqBytes, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("无法创建OCSP请求: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
+	httpResp, err := ocspClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP服务器返回状态码 %d", httpResp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("无法解析OCSP响应: %w", err)
+	}
+	if resp.Status != ocsp.Good {
+		return nil, nil, fmt.Errorf("OCSP证书状态异常: %d", resp.Status)
+	}
+
+	return raw, resp, nil
+}
@@ -0,0 +1,51 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// ParseVersion 解析TLS版本字符串 (例如 "1.2"、"1.3")，空字符串返回0表示使用默认值
+func ParseVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "tls") {
+	case "":
+		return 0, nil
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("无效的TLS版本: %s", s)
+	}
+}
+
+// ParseCipherSuites 按名称解析密码套件列表 (例如 "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+// 注意: Go不支持配置TLS 1.3的密码套件，该列表仅对TLS 1.2及以下版本生效
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("不支持的密码套件: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
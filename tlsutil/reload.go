@@ -0,0 +1,169 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// 默认证书文件检查间隔
+const DefaultReloadInterval = 30 * time.Second
+
+// CertPair 证书和私钥文件路径
+type CertPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// 已加载的证书
+type loadedCert struct {
+	pair    CertPair
+	cert    *tls.Certificate
+	modTime time.Time
+
+	ocspNextUpdate time.Time // 已装订OCSP响应的下次更新时间
+}
+
+// CertReloader 管理可热重载的证书，通过GetCertificate提供给tls.Config
+type CertReloader struct {
+	mu       sync.RWMutex
+	certs    []*loadedCert
+	stapling bool // 是否启用OCSP装订
+}
+
+// NewCertReloader 加载所有证书并创建热重载器，第一个证书作为SNI不匹配时的默认证书
+func NewCertReloader(pairs []CertPair) (*CertReloader, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("未配置证书")
+	}
+
+	r := &CertReloader{}
+	for _, pair := range pairs {
+		lc, err := loadCert(pair)
+		if err != nil {
+			return nil, err
+		}
+		r.certs = append(r.certs, lc)
+	}
+	return r, nil
+}
+
+// GetCertificate 根据客户端SNI选择证书，用于tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.certs) > 1 && hello.ServerName != "" {
+		for _, lc := range r.certs {
+			if hello.SupportsCertificate(lc.cert) == nil {
+				return lc.cert, nil
+			}
+		}
+	}
+	return r.certs[0].cert, nil
+}
+
+// Watch 定期检查证书文件变化并重新加载，直到上下文取消
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reloadChanged(ctx)
+		}
+	}
+}
+
+// 重新加载文件有变化的证书
+func (r *CertReloader) reloadChanged(ctx context.Context) {
+	r.mu.RLock()
+	certs := make([]*loadedCert, len(r.certs))
+	copy(certs, r.certs)
+	r.mu.RUnlock()
+
+	for i, lc := range certs {
+		modTime, err := latestModTime(lc.pair)
+		if err != nil {
+			log.Printf("检查证书文件失败: %v", err)
+			continue
+		}
+		if !modTime.After(lc.modTime) {
+			continue
+		}
+
+		// 加载失败时保留旧证书，避免续期过程中文件写了一半导致服务中断
+		newCert, err := loadCert(lc.pair)
+		if err != nil {
+			log.Printf("重新加载证书失败，继续使用旧证书: %v", err)
+			continue
+		}
+
+		r.mu.Lock()
+		r.certs[i] = newCert
+		stapling := r.stapling
+		r.mu.Unlock()
+		log.Printf("已重新加载证书: %s", lc.pair.CertFile)
+
+		if stapling {
+			r.staple(ctx, newCert)
+		}
+	}
+}
+
+func loadCert(pair CertPair) (*loadedCert, error) {
+	modTime, err := latestModTime(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("无法加载证书 %s: %w", pair.CertFile, err)
+	}
+
+	// 预先解析叶子证书，供SNI匹配使用
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("无法解析证书 %s: %w", pair.CertFile, err)
+		}
+		cert.Leaf = leaf
+	}
+
+	return &loadedCert{
+		pair:    pair,
+		cert:    &cert,
+		modTime: modTime,
+	}, nil
+}
+
+// 返回证书和私钥文件中较新的修改时间
+func latestModTime(pair CertPair) (time.Time, error) {
+	certInfo, err := os.Stat(pair.CertFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(pair.KeyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
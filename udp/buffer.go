@@ -0,0 +1,33 @@
+package udp
+
+import "sync"
+
+// 按长度分组的数据包缓冲区池，buffer_size相同的规则共享同一个池
+var bufferPools sync.Map // int -> *sync.Pool
+
+// 从池中取出长度为size的缓冲区，用完后须以putBuffer归还
+func getBuffer(size int) *[]byte {
+	pool, ok := bufferPools.Load(size)
+	if !ok {
+		pool, _ = bufferPools.LoadOrStore(size, &sync.Pool{New: func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}})
+	}
+	return pool.(*sync.Pool).Get().(*[]byte)
+}
+
+// 归还getBuffer取出的缓冲区，归还后不能再使用
+func putBuffer(b *[]byte) {
+	if pool, ok := bufferPools.Load(len(*b)); ok {
+		pool.(*sync.Pool).Put(b)
+	}
+}
+
+// 取出混淆数据包使用的缓冲区，比数据包缓冲区长出混淆头；未配置混淆时返回nil，否则用完后须以putBuffer归还
+func (s *Session) obfsBuffer() *[]byte {
+	if s.opts.Obfs == nil {
+		return nil
+	}
+	return getBuffer(s.opts.BufferSize + s.opts.Obfs.Overhead())
+}
@@ -0,0 +1,80 @@
+package udp
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/inherit"
+)
+
+// 监听套接字在暂存区中的标识
+func (p *Proxy) socketKey() string {
+	return inherit.Key("udp", p.opts.ListenNetwork, p.listenAddr)
+}
+
+// 组播和unixgram套接字不交回，重新加载后由新代理重新绑定
+func (p *Proxy) inheritable() bool {
+	return p.opts.MulticastGroup == nil && !strings.HasPrefix(p.listenAddr, UnixgramPrefix)
+}
+
+// Inherit 接手重新加载配置前监听同一地址的代理留在r中的监听套接字，须在Start之前调用；没有时Start照常绑定
+func (p *Proxy) Inherit(r *inherit.Registry) {
+	sockets := r.Take(p.socketKey())
+	if !p.inheritable() {
+		for _, s := range sockets {
+			s.Close()
+		}
+		return
+	}
+	p.inherited = append(p.inherited, sockets...)
+}
+
+// 取出接手的套接字；数量与需要的不同(read_loops改变)时全部关闭并返回nil，由Start重新绑定
+func (p *Proxy) takeInherited(n int) []net.PacketConn {
+	inherited := p.inherited
+	p.inherited = nil
+	conns := make([]net.PacketConn, 0, len(inherited))
+	for _, s := range inherited {
+		if conn, ok := s.(*net.UDPConn); ok {
+			conns = append(conns, conn)
+		}
+	}
+	if len(conns) == n && len(conns) == len(inherited) {
+		return conns
+	}
+	for _, s := range inherited {
+		s.Close()
+	}
+	return nil
+}
+
+// Retire 停止读取数据包并关闭所有会话，把监听套接字留在r中供重新加载后监听同一地址的代理接手，
+// 套接字交回后返回；客户端的下一个数据包由新代理按新配置创建会话
+func (p *Proxy) Retire(r *inherit.Registry) {
+	p.retireOnce.Do(func() {
+		p.sockets = r
+		close(p.retire)
+	})
+	<-p.stopped
+}
+
+// 交回监听套接字并返回true；退出时(ctx已取消)或无法交回时返回false，由调用者关闭
+func (p *Proxy) release(ctx context.Context, conns []net.PacketConn) bool {
+	defer p.stop()
+	if ctx.Err() != nil || !p.inheritable() {
+		return false
+	}
+	sockets := make([]io.Closer, 0, len(conns))
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Time{})
+		sockets = append(sockets, conn)
+	}
+	return p.sockets.Park(p.socketKey(), sockets...)
+}
+
+func (p *Proxy) stop() {
+	p.stopOnce.Do(func() { close(p.stopped) })
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package udp
+
+import "net"
+
+// 当前系统不支持指定组播发送网卡，使用系统默认
+func setMulticastInterface(conn *net.UDPConn, iface *net.Interface) error {
+	return nil
+}
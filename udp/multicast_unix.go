@@ -0,0 +1,40 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package udp
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// 指定发送IPv4组播数据包使用的网卡
+func setMulticastInterface(conn *net.UDPConn, iface *net.Interface) error {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	var ip4 net.IP
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			ip4 = ipNet.IP.To4()
+			break
+		}
+	}
+	if ip4 == nil {
+		return fmt.Errorf("网卡 %s 没有IPv4地址", iface.Name)
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInet4Addr(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_IF, [4]byte(ip4))
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
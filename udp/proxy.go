@@ -3,100 +3,537 @@ package udp
 import (
 	"context"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"net/netip"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/bindretry"
+	"github.com/Mxmilu666/nia-forwarding/chaos"
+	"github.com/Mxmilu666/nia-forwarding/dnscache"
+	"github.com/Mxmilu666/nia-forwarding/dscp"
+	"github.com/Mxmilu666/nia-forwarding/events"
+	"github.com/Mxmilu666/nia-forwarding/flow"
+	"github.com/Mxmilu666/nia-forwarding/health"
+	"github.com/Mxmilu666/nia-forwarding/inherit"
+	"github.com/Mxmilu666/nia-forwarding/inspect"
+	"github.com/Mxmilu666/nia-forwarding/limit"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+	"github.com/Mxmilu666/nia-forwarding/netwatch"
+	"github.com/Mxmilu666/nia-forwarding/obfs"
+	"github.com/Mxmilu666/nia-forwarding/quota"
+	"github.com/Mxmilu666/nia-forwarding/record"
+	"github.com/Mxmilu666/nia-forwarding/srcaddr"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+	"github.com/Mxmilu666/nia-forwarding/targetgroup"
+	"github.com/Mxmilu666/nia-forwarding/xdp"
 )
 
+// Options UDP代理的可选配置
+type Options struct {
+	Log *logging.Logger // 规则的日志级别，nil为info
+
+	BufferSize  int
+	Timeout     time.Duration // 会话空闲超时，0为使用SessionMode预设的超时
+	SessionMode string        // 会话模式预设，见ModeDNS和ModeGame
+
+	// 除客户端地址外还按QUIC连接ID查找会话，客户端地址变化后仍使用原会话和原目标连接，见quic.go
+	QUICAffinity bool
+
+	// 按TFTP转发：接受目标从新端口发来的回复，之后发往目标的数据包改发到该端口，见tftp.go
+	TFTP bool
+
+	// 单个会话双向合计的最大传输字节数，达到后关闭会话并计入transfer_cap_closed，0为不限制
+	MaxConnBytes int64
+	// 会话的最长持续时间，不论是否空闲，到达后关闭会话，客户端的下一个数据包会创建新会话；0为不限制
+	MaxConnLifetime time.Duration
+
+	// 监听和连接目标使用的网络，例如 "udp4"、"udp6" 或双栈的 "udp"，默认分别为udp4和udp6
+	ListenNetwork string
+	TargetNetwork string
+	Source        *srcaddr.Policy  // 会话套接字的IPv6源地址策略，nil为由系统选择
+	Mark          uint32           // 会话套接字的fwmark，0为不设置，仅Linux支持
+	Resolver      *dnscache.Cache  // 新会话解析目标主机名时使用的缓存，nil为每次都查询系统解析器
+	PerIP         *limit.PerIP     // 每IP并发会话限制，可在同一规则的多个代理间共享
+	ReadLoops     int              // 并行读取循环数量，0或1为单循环
+	BindRetry     time.Duration    // 监听地址被占用时重试绑定的时长，0为不重试
+	Memory        *limit.Memory    // 所有规则共享的内存预算，超过时丢弃需要新会话的数据包
+	Bandwidth     *limit.Bandwidth // 所有规则共享的总带宽上限，带宽不足时数据包等待发送，nil为不限制
+	RuleBandwidth *limit.Bandwidth // 本规则所有会话和TCP连接共享的带宽上限，nil为不限制
+	Priority      int              // 总带宽或内存不足时本规则的优先级，见limit.PriorityHigh等
+
+	NetWatch *netwatch.Watcher // 监听地址在本机不存在时等待网卡地址变化后重新绑定，nil为直接失败
+
+	// 监听端口在BindRetry重试后仍被占用时依次尝试的备用端口，实际端口记录在日志和监听器状态中；组播和unixgram监听不使用
+	FallbackPorts []int
+
+	// 套接字内核缓冲区大小，同时作用于监听套接字和会话的目标套接字，0为系统默认值
+	SocketReadBuffer  int
+	SocketWriteBuffer int
+
+	DSCP int // 发往客户端和目标的数据包的DSCP标记(0-63)，0为不设置
+
+	Stats  *stats.Rule    // 流量统计
+	Quota  *quota.Quota   // 流量配额，用尽后不再创建新会话
+	Flows  *flow.Exporter // 会话关闭时导出流记录
+	Events *events.Bus    // 实时推送会话的建立、关闭和错误事件
+
+	Health *health.Tracker // 所有套接字绑定后标记为就绪，退出时标记为未就绪
+
+	Middlewares middleware.Chain // 会话中间件，UDP会话不调用WrapConn
+
+	Blocker *inspect.Matcher // 数据包开头命中禁止模式时丢弃
+
+	Chaos *chaos.Injector // 故障注入，为数据包附加延迟、抖动和带宽限制
+
+	Recorder *record.Recorder // 录制客户端发出的数据包
+
+	Obfs *obfs.Obfuscator // 与另一个转发节点之间的数据包混淆
+
+	// 每个数据包额外复制一份发往这些地址；FanOutReplies决定返回哪些目标的回复
+	FanOutTargets []string
+	FanOutReplies string
+
+	// 不为nil时在监听端口上加入该IPv4组播组，接收组播数据包并转发给目标
+	MulticastGroup     net.IP
+	MulticastInterface *net.Interface // 加入组播组和向组播目标发送数据包的网卡，nil为系统默认
+
+	TargetGroup *targetgroup.Group // 不为nil时每个新会话按轮询顺序选择目标组中的一个目标，代替targetAddr
+
+	// 不为nil时IPv4会话的后续数据包由网卡上的XDP程序在内核中转发，规则使用了需要逐包处理的功能时不启用
+	XDP *xdp.Forwarder
+}
+
+// 扇出时接受回复的来源
+const (
+	RepliesPrimary = "primary" // 只返回主目标的回复(默认)
+	RepliesAll     = "all"     // 返回所有目标的回复
+	RepliesNone    = "none"    // 丢弃所有回复
+)
+
+// ValidReplies 检查FanOutReplies的取值
+func ValidReplies(s string) bool {
+	return s == "" || s == RepliesPrimary || s == RepliesAll || s == RepliesNone
+}
+
+// 会话模式预设，决定未配置超时时的空闲超时，以及会话是否在应答后立即结束
+const (
+	ModeDNS  = "dns"  // 请求应答：每个请求都收到回复后立即关闭会话，空闲超时5秒
+	ModeGame = "game" // 持续交互：空闲超时10分钟，适合游戏和语音等长时间保持的会话
+)
+
+// ValidSessionMode 检查SessionMode的取值
+func ValidSessionMode(s string) bool {
+	return s == "" || s == ModeDNS || s == ModeGame
+}
+
+// ModeTimeout 返回会话模式预设的空闲超时，未设置模式时返回0
+func ModeTimeout(mode string) time.Duration {
+	switch mode {
+	case ModeDNS:
+		return 5 * time.Second
+	case ModeGame:
+		return 10 * time.Minute
+	}
+	return 0
+}
+
 // Proxy 表示UDP代理
 type Proxy struct {
 	proxyID    string
 	listenAddr string
 	targetAddr string
-	bufferSize int
-	timeout    time.Duration
+	opts       Options
+
+	inherited []io.Closer       // Start之前从重新加载前的代理接手的监听套接字
+	sockets   *inherit.Registry // Retire时交回监听套接字的暂存区
+	retire    chan struct{}     // Retire时关闭，停止读取数据包
+	stopped   chan struct{}     // 停止读取并交回或关闭监听套接字后关闭
+
+	retireOnce, stopOnce sync.Once
 }
 
 // NewProxy 创建一个新的UDP代理
-func NewProxy(proxyID, listenAddr, targetAddr string, bufferSize int, timeout time.Duration) *Proxy {
+func NewProxy(proxyID, listenAddr, targetAddr string, opts Options) *Proxy {
+	if opts.Timeout == 0 {
+		opts.Timeout = ModeTimeout(opts.SessionMode)
+	}
 	return &Proxy{
 		proxyID:    proxyID,
 		listenAddr: listenAddr,
 		targetAddr: targetAddr,
-		bufferSize: bufferSize,
-		timeout:    timeout,
+		opts:       opts,
+		retire:     make(chan struct{}),
+		stopped:    make(chan struct{}),
 	}
 }
 
 // Start 启动UDP代理服务
 func (p *Proxy) Start(ctx context.Context) error {
-	// 监听IPv4 UDP
-	addr, err := net.ResolveUDPAddr("udp4", p.listenAddr)
-	if err != nil {
-		return fmt.Errorf("无法解析UDP监听地址: %w", err)
+	defer p.stop()
+
+	unixPath, isUnix := strings.CutPrefix(p.listenAddr, UnixgramPrefix)
+
+	if p.opts.XDP != nil {
+		reason := p.xdpConflict()
+		if isUnix {
+			reason = "unixgram监听"
+		}
+		if reason != "" {
+			p.opts.Log.Warnf("[%s] 规则使用了%s，不使用XDP转发", p.proxyID, reason)
+			p.opts.XDP = nil
+		}
 	}
 
-	conn, err := net.ListenUDP("udp4", addr)
-	if err != nil {
-		return fmt.Errorf("无法监听UDP: %w", err)
+	// 默认监听IPv4 UDP，组播只支持IPv4
+	network := p.opts.ListenNetwork
+	if network == "" || p.opts.MulticastGroup != nil {
+		network = "udp4"
+	}
+	var addr *net.UDPAddr
+	if !isUnix {
+		var err error
+		addr, err = net.ResolveUDPAddr(network, p.listenAddr)
+		if err != nil {
+			return fmt.Errorf("无法解析UDP监听地址: %w", err)
+		}
 	}
-	defer conn.Close()
 
-	log.Printf("[%s] UDP转发已启动: %s -> %s\n", p.proxyID, p.listenAddr, p.targetAddr)
+	loops := p.opts.ReadLoops
+	if loops < 1 {
+		loops = 1
+	}
 
-	// 使用map存储UDP会话
-	sessions := &sync.Map{}
+	// 多个读取循环时在Linux上使用SO_REUSEPORT为每个循环创建独立套接字，
+	// 内核按四元组分流，同一客户端始终落在同一个套接字上；其他系统共享一个套接字
+	sockets := 1
+	if loops > 1 && p.opts.MulticastGroup != nil {
+		p.opts.Log.Warnf("[%s] 组播监听只使用一个套接字，%d个读取循环将共享该套接字", p.proxyID, loops)
+	} else if loops > 1 && isUnix {
+		p.opts.Log.Warnf("[%s] unixgram监听只使用一个套接字，%d个读取循环将共享该套接字", p.proxyID, loops)
+	} else if loops > 1 {
+		if reusePortSupported {
+			sockets = loops
+		} else {
+			p.opts.Log.Warnf("[%s] 只有Linux支持按SO_REUSEPORT分流，%d个读取循环将共享同一套接字", p.proxyID, loops)
+		}
+	}
 
-	// 监听上下文取消
+	// Retire后停止读取，监听套接字交给新代理
+	readCtx, stopRead := context.WithCancel(ctx)
+	defer stopRead()
 	go func() {
-		<-ctx.Done()
-		conn.Close()
-		// 关闭所有会话
-		sessions.Range(func(key, value interface{}) bool {
-			if s, ok := value.(*Session); ok {
-				s.Close()
-			}
-			return true
+		select {
+		case <-p.retire:
+		case <-readCtx.Done():
+		}
+		stopRead()
+	}()
+
+	conns := make([]net.PacketConn, 0, sockets)
+	kept := false
+	defer func() {
+		if !kept {
+			for _, conn := range conns {
+				closePacketConn(conn)
+			}
+		}
+	}()
+	// 只有第一个套接字可以改用备用端口，其余套接字绑定同一端口
+	listenAddr := p.listenAddr
+	fallbackPorts := p.opts.FallbackPorts
+	if isUnix || p.opts.MulticastGroup != nil {
+		fallbackPorts = nil
+	}
+	// 接手的套接字数量与读取循环需要的不同时(read_loops改变)重新绑定
+	if inherited := p.takeInherited(sockets); inherited != nil {
+		conns = inherited
+	}
+	// 接手的套接字可能绑定在备用端口上，端口为0时由系统分配；其余套接字绑定同一端口
+	boundPort := func() {
+		if local, ok := conns[0].LocalAddr().(*net.UDPAddr); ok && !isUnix && local.Port != addr.Port {
+			addr = &net.UDPAddr{IP: addr.IP, Port: local.Port, Zone: addr.Zone}
+			host, _, _ := net.SplitHostPort(p.listenAddr)
+			listenAddr = net.JoinHostPort(host, strconv.Itoa(local.Port))
+		}
+	}
+	if len(conns) > 0 {
+		boundPort()
+	}
+	for i := len(conns); i < sockets; i++ {
+		conn, err := bindretry.WaitAddress(readCtx, p.opts.NetWatch.Changed, func(err error) {
+			p.opts.Log.Warnf("[%s] 监听地址在本机不存在，等待网卡地址变化后重试: %v", p.proxyID, err)
+		}, func() (socketConn, error) {
+			l, port, err := bindretry.Fallback(fallbackPorts, func() (socketConn, error) {
+				return bindretry.Listen(readCtx, p.opts.BindRetry, func(err error, wait time.Duration) {
+					p.opts.Log.Warnf("[%s] 监听地址被占用，%v后重试: %v", p.proxyID, wait, err)
+				}, func() (socketConn, error) {
+					switch {
+					case isUnix:
+						return listenUnixgram(unixPath)
+					case p.opts.MulticastGroup != nil:
+						return net.ListenMulticastUDP("udp4", p.opts.MulticastInterface, &net.UDPAddr{IP: p.opts.MulticastGroup, Port: addr.Port})
+					default:
+						return listenUDP(ctx, network, addr, sockets > 1)
+					}
+				})
+			}, func(port int) (socketConn, error) {
+				return listenUDP(ctx, network, &net.UDPAddr{IP: addr.IP, Port: port, Zone: addr.Zone}, sockets > 1)
+			})
+			if port > 0 {
+				host, _, _ := net.SplitHostPort(p.listenAddr)
+				p.opts.Log.Warnf("[%s] 监听地址%s被占用，改用备用端口: %s", p.proxyID, p.listenAddr, net.JoinHostPort(host, strconv.Itoa(port)))
+			}
+			return l, err
 		})
+		fallbackPorts = nil
+		if err == nil {
+			conns = append(conns, conn)
+			boundPort()
+		}
+		if readCtx.Err() != nil {
+			kept = p.release(ctx, conns)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("无法监听UDP: %w", err)
+		}
+	}
+	if listenAddr != p.listenAddr {
+		p.opts.Health.SetListen(p.proxyID, listenAddr)
+	}
+	for _, conn := range conns {
+		sc, ok := conn.(socketConn)
+		if !ok {
+			continue
+		}
+		if err := setSocketBuffers(sc, p.opts.SocketReadBuffer, p.opts.SocketWriteBuffer); err != nil {
+			p.opts.Log.Warnf("[%s] 设置UDP套接字缓冲区失败: %v", p.proxyID, err)
+		}
+		if p.opts.DSCP > 0 && !isUnix {
+			if err := dscp.Set(sc, p.opts.DSCP); err != nil {
+				p.opts.Log.Warnf("[%s] 设置UDP套接字的DSCP失败: %v", p.proxyID, err)
+			}
+		}
+	}
+
+	// 每个套接字的读取循环使用独立的会话表：SO_REUSEPORT按四元组把同一客户端固定到一个套接字，
+	// 各套接字之间没有共享的会话。QUIC连接迁移后客户端的四元组改变，可能落到其他套接字，
+	// 因此启用QUIC亲和时所有套接字共用一个会话表，以便按连接ID找回原会话
+	sessions := make([]*SessionMap, sockets)
+	for i := range sessions {
+		if i > 0 && p.opts.QUICAffinity {
+			sessions[i] = sessions[0]
+			continue
+		}
+		sessions[i] = NewSessionMap()
+	}
+
+	if p.opts.MulticastGroup != nil {
+		p.opts.Log.Infof("[%s] UDP转发已启动: 组播%s:%d -> %s\n", p.proxyID, p.opts.MulticastGroup, addr.Port, p.targetAddr)
+	} else {
+		p.opts.Log.Infof("[%s] UDP转发已启动: %s -> %s\n", p.proxyID, listenAddr, p.targetAddr)
+	}
+
+	p.opts.Health.SetReady(p.proxyID, true)
+
+	// 交回套接字时只中断读取，不关闭套接字
+	interrupted := make(chan struct{})
+	go func() {
+		defer close(interrupted)
+		<-readCtx.Done()
+		for _, conn := range conns {
+			if ctx.Err() != nil || conn.SetReadDeadline(time.Now()) != nil {
+				conn.Close()
+			}
+		}
 	}()
 
-	buffer := make([]byte, p.bufferSize)
+	var wg sync.WaitGroup
+	for i := 0; i < loops; i++ {
+		conn, m := conns[i%sockets], sessions[i%sockets]
+		wg.Add(1)
+		p.opts.Stats.Go(func() {
+			defer wg.Done()
+			p.serve(ctx, readCtx, conn, m)
+		})
+	}
+	wg.Wait()
+	<-interrupted
+
+	// 关闭所有会话，共用的会话表重复关闭时已为空；交回套接字后客户端的下一个数据包在新代理中创建会话
+	for _, m := range sessions {
+		m.CloseAll()
+	}
+	// 新代理接手监听套接字后由它标记就绪，这里不再改为未就绪
+	if ctx.Err() != nil {
+		p.opts.Health.SetReady(p.proxyID, false)
+	}
+	kept = p.release(ctx, conns)
+	return nil
+}
+
+// 从监听套接字读取数据并转发到对应会话，直到readCtx取消；会话在ctx下转发
+func (p *Proxy) serve(ctx, readCtx context.Context, conn net.PacketConn, sessions *SessionMap) {
+	buffer := make([]byte, p.opts.BufferSize)
+	// UDP套接字按netip.AddrPort读取来源地址，已有会话的数据包不再分配net.UDPAddr和字符串
+	udpConn, _ := conn.(*net.UDPConn)
 	for {
-		n, clientAddr, err := conn.ReadFromUDP(buffer)
+		var n int
+		var key SessionKey
+		var clientAddr net.Addr
+		var err error
+		if udpConn != nil {
+			var addr netip.AddrPort
+			n, addr, err = udpConn.ReadFromUDPAddrPort(buffer)
+			// 双栈套接字上的IPv4客户端以IPv4映射地址返回，还原为IPv4地址以便与日志和中间件中的地址一致
+			key.addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		} else {
+			n, clientAddr, err = conn.ReadFrom(buffer)
+		}
 		if err != nil {
 			select {
-			case <-ctx.Done():
-				return nil
+			case <-readCtx.Done():
+				return
 			default:
-				log.Printf("[%s] UDP读取错误: %v", p.proxyID, err)
+				p.opts.Log.Errorf("[%s] UDP读取错误: %v", p.proxyID, err)
+				p.opts.Stats.AddError()
 				continue
 			}
 		}
 
-		data := make([]byte, n)
-		copy(data, buffer[:n])
+		if udpConn == nil {
+			// 未绑定路径的unixgram客户端共用一个会话，无法收到回复
+			if clientAddr == nil {
+				clientAddr = unnamedClient
+			}
+			key.name = clientAddr.String()
+		}
+
+		data, err := p.opts.Obfs.FromClient(buffer[:n])
+		if err != nil {
+			p.opts.Stats.AddDropped()
+			continue
+		}
+
+		// 命中禁止模式的数据包只在debug级别记录日志，避免被大量数据包刷屏
+		if p.opts.Blocker.Match(data) {
+			if p.opts.Log.Enabled(logging.LevelDebug) {
+				p.opts.Log.Debugf("[%s] UDP数据包命中禁止模式被丢弃: %s", p.proxyID, key)
+			}
+			p.opts.Stats.AddDropped()
+			continue
+		}
 
-		clientAddrStr := clientAddr.String()
-		var session *Session
+		// data指向读取缓冲区，Send需要延迟发送时自行复制，因此这里不再逐包复制
 
-		// 查找或创建会话
-		v, ok := sessions.Load(clientAddrStr)
+		// 查找或创建会话，QUIC客户端地址变化时按连接ID找回原会话
+		session, ok := sessions.Load(key)
+		if !ok && clientAddr == nil {
+			// 只有未找到会话时才需要net.Addr形式的客户端地址
+			clientAddr = net.UDPAddrFromAddrPort(key.addr)
+		}
+		if !ok && p.opts.QUICAffinity {
+			if session, ok = sessions.loadQUIC(data); ok {
+				session.migrate(clientAddr, key)
+			}
+		}
 		if !ok {
+			if exceeded, first := p.opts.Quota.Exceeded(); exceeded {
+				if first {
+					p.opts.Log.Warnf("[%s] 流量配额已用尽，本周期内不再创建新的UDP会话", p.proxyID)
+				}
+				p.opts.Stats.AddDropped()
+				continue
+			}
+			if p.opts.Memory.Exceeded(p.opts.Priority) {
+				p.opts.Stats.AddDropped()
+				continue
+			}
+
+			info := &middleware.Info{
+				ProxyID:    p.proxyID,
+				ConnID:     logging.NewConnID(),
+				Protocol:   "udp",
+				ClientAddr: clientAddr,
+				ListenAddr: conn.LocalAddr(),
+				TargetAddr: p.targetAddr,
+			}
+			if p.opts.TargetGroup != nil {
+				info.TargetAddr = p.opts.TargetGroup.Order()[0]
+			}
+			if err := p.opts.Middlewares.OnAccept(info); err != nil {
+				p.opts.Log.Warnf("[%s] UDP数据包被中间件丢弃: %s: %v", logging.Tag(p.proxyID, info.ConnID), key, err)
+				p.opts.Stats.AddDropped()
+				continue
+			}
+
+			if !p.opts.PerIP.Acquire(clientAddr) {
+				p.opts.Log.Warnf("[%s] UDP数据包被丢弃: %s 并发会话数已达上限", logging.Tag(p.proxyID, info.ConnID), key)
+				p.opts.Stats.AddDropped()
+				continue
+			}
+
+			if err := p.opts.Middlewares.OnDial(info); err != nil {
+				p.opts.PerIP.Release(clientAddr)
+				p.opts.Log.Warnf("[%s] UDP会话创建前被中间件中止: %s: %v", logging.Tag(p.proxyID, info.ConnID), key, err)
+				p.opts.Stats.AddDropped()
+				continue
+			}
+
 			// 使用客户端地址作为会话 ID
-			newSession, err := NewSession(ctx, conn, clientAddr, p.targetAddr, sessions, clientAddrStr, p.bufferSize, p.timeout)
+			newSession, err := NewSession(ctx, conn, clientAddr, sessions, key, info, p.opts)
 			if err != nil {
-				log.Printf("[%s] 创建UDP会话失败: %v", p.proxyID, err)
+				p.opts.PerIP.Release(clientAddr)
+				p.opts.Log.Errorf("[%s] 创建UDP会话失败: %v", logging.Tag(p.proxyID, info.ConnID), err)
+				p.opts.Stats.AddTargetError(info.TargetAddr, err, true)
+				p.opts.Events.PublishConn(events.TypeError, info, err)
+				p.opts.Stats.AddDropped()
 				continue
 			}
-			sessions.Store(clientAddrStr, newSession)
-			session = newSession
+			p.opts.Middlewares.OnConnect(info)
+
+			// 多个读取循环共享一个套接字时，其他循环可能已为同一客户端创建了会话
+			var loaded bool
+			if session, loaded = sessions.LoadOrStore(key, newSession); loaded {
+				newSession.Close()
+			}
 		} else {
-			session = v.(*Session)
 			session.Refresh() // 刷新超时
 		}
+		if p.opts.QUICAffinity {
+			session.noteClientQUIC(data)
+		}
 
 		// 发送数据到目标
 		session.Send(data)
 	}
 }
+
+// 可设置内核缓冲区和套接字选项的监听或会话套接字
+type socketConn interface {
+	net.PacketConn
+	syscall.Conn
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// 设置套接字的内核读写缓冲区大小，0表示保持系统默认值
+func setSocketBuffers(conn socketConn, readBuffer, writeBuffer int) error {
+	if readBuffer > 0 {
+		if err := conn.SetReadBuffer(readBuffer); err != nil {
+			return err
+		}
+	}
+	if writeBuffer > 0 {
+		if err := conn.SetWriteBuffer(writeBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package udp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/inherit"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+)
+
+// 回显目标，返回地址
+func udpEcho(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// 返回一个当前空闲的本地UDP地址
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func startProxy(t *testing.T, ctx context.Context, p *Proxy) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- p.Start(ctx) }()
+	return done
+}
+
+// 发送一个数据包并等待回复，代理尚未绑定时重试
+func exchange(t *testing.T, client net.PacketConn, proxyAddr, msg string) {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp4", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	for range 20 {
+		client.WriteTo([]byte(msg), addr)
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := client.ReadFrom(buf)
+		if err == nil {
+			if got := string(buf[:n]); got != msg {
+				t.Fatalf("收到 %q, 期望 %q", got, msg)
+			}
+			return
+		}
+	}
+	t.Fatalf("没有收到%q的回复", msg)
+}
+
+func testOptions() Options {
+	return Options{Log: logging.New(logging.LevelError), BufferSize: 2048, TargetNetwork: "udp4"}
+}
+
+// Retire把监听套接字交给监听同一地址的新代理，客户端不需要重新绑定即可继续收到回复
+func TestProxyRetireHandsOverSocket(t *testing.T) {
+	target := udpEcho(t)
+	listen := freeUDPAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	old := NewProxy("old", listen, target, testOptions())
+	oldDone := startProxy(t, ctx, old)
+	exchange(t, client, listen, "first")
+
+	sockets := inherit.New()
+	sockets.Hold()
+	old.Retire(sockets)
+	if err := <-oldDone; err != nil {
+		t.Fatalf("Retire后Start返回错误: %v", err)
+	}
+
+	next := NewProxy("next", listen, target, testOptions())
+	next.Inherit(sockets)
+	if len(next.inherited) != 1 {
+		t.Fatalf("新代理接手了%d个套接字, 期望 1", len(next.inherited))
+	}
+	if n := sockets.Release(); n != 0 {
+		t.Errorf("Release关闭了%d个已被接手的套接字", n)
+	}
+	nextDone := startProxy(t, ctx, next)
+	exchange(t, client, listen, "second")
+
+	cancel()
+	if err := <-nextDone; err != nil {
+		t.Error(err)
+	}
+}
+
+// 不在暂存期间Retire时套接字被关闭，地址可以重新绑定
+func TestProxyRetireWithoutHoldCloses(t *testing.T) {
+	listen := freeUDPAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := NewProxy("p", listen, udpEcho(t), testOptions())
+	done := startProxy(t, ctx, p)
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	exchange(t, client, listen, "ping")
+
+	p.Retire(inherit.New())
+	<-done
+	conn, err := net.ListenPacket("udp4", listen)
+	if err != nil {
+		t.Fatalf("代理退出后监听地址仍被占用: %v", err)
+	}
+	conn.Close()
+}
+
+// 接手的套接字数量与读取循环需要的不同时全部关闭，由Start重新绑定
+func TestTakeInheritedCountMismatch(t *testing.T) {
+	p := NewProxy("p", "127.0.0.1:0", "127.0.0.1:1", testOptions())
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.inherited = append(p.inherited, conn)
+	if got := p.takeInherited(2); got != nil {
+		t.Fatalf("需要2个套接字时返回了%d个", len(got))
+	}
+	if _, err := conn.WriteTo([]byte("x"), conn.LocalAddr()); err == nil {
+		t.Error("数量不符的套接字没有被关闭")
+	}
+}
@@ -0,0 +1,132 @@
+package udp
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// QUIC会话亲和：除客户端地址外还以QUIC连接ID为键查找会话，客户端地址变化(例如NAT重新绑定)后
+// 数据包仍交给原会话，新地址再次出现后回复发往新地址。只能看到明文包头中的连接ID：长包头带有双方的连接ID，
+// 短包头只带目标连接ID且不含长度，长度从服务器长包头中的源连接ID得知。客户端迁移时改用
+// 经加密帧下发的新连接ID的情况无法识别，会建立新会话
+
+const (
+	quicKeyPrefix  = "quic:"
+	maxQUICIDLen   = 20 // RFC 9000中连接ID的最大长度
+	maxQUICAliases = 8  // 每个会话最多登记的连接ID和迁移地址数量
+)
+
+// 解析长包头中的目标和源连接ID，不是QUIC长包头时返回false；版本协商包不含可用的连接ID
+func quicLongHeaderIDs(b []byte) (dcid, scid []byte, ok bool) {
+	if len(b) < 7 || b[0]&0xc0 != 0xc0 || binary.BigEndian.Uint32(b[1:5]) == 0 {
+		return nil, nil, false
+	}
+	b = b[5:]
+	n := int(b[0])
+	if n > maxQUICIDLen || len(b) < 1+n+1 {
+		return nil, nil, false
+	}
+	dcid, b = b[1:1+n], b[1+n:]
+	n = int(b[0])
+	if n > maxQUICIDLen || len(b) < 1+n {
+		return nil, nil, false
+	}
+	return dcid, b[1 : 1+n], true
+}
+
+// 取短包头中长度为n的目标连接ID，不是QUIC短包头时返回false
+func quicShortHeaderID(b []byte, n int) ([]byte, bool) {
+	if len(b) < 1+n || b[0]&0xc0 != 0x40 {
+		return nil, false
+	}
+	return b[1 : 1+n], true
+}
+
+func quicKey(id []byte) SessionKey {
+	return SessionKey{name: quicKeyPrefix + string(id)}
+}
+
+// 按数据包中的QUIC连接ID查找会话
+func (m *SessionMap) loadQUIC(data []byte) (*Session, bool) {
+	if dcid, _, ok := quicLongHeaderIDs(data); ok {
+		if len(dcid) == 0 {
+			return nil, false
+		}
+		return m.Load(quicKey(dcid))
+	}
+	lens := m.quicIDLens.Load()
+	for n := 1; n <= maxQUICIDLen; n++ {
+		if lens&(1<<n) == 0 {
+			continue
+		}
+		if id, ok := quicShortHeaderID(data, n); ok {
+			if s, ok := m.Load(quicKey(id)); ok {
+				return s, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// 登记客户端长包头中的目标连接ID，即客户端在服务器回复前选择的初始连接ID
+func (s *Session) noteClientQUIC(data []byte) {
+	if dcid, _, ok := quicLongHeaderIDs(data); ok && len(dcid) > 0 {
+		s.addAlias(quicKey(dcid))
+	}
+}
+
+// 登记服务器长包头中的源连接ID，客户端此后以它作为目标连接ID，短包头按它的长度解析
+func (s *Session) noteTargetQUIC(data []byte) {
+	if _, scid, ok := quicLongHeaderIDs(data); ok && len(scid) > 0 {
+		s.sessions.addQUICIDLen(len(scid))
+		s.addAlias(quicKey(scid))
+	}
+}
+
+// 客户端地址变化后改为向新地址回复，并以新地址登记会话。同一新地址第二次出现时才迁移，
+// 避免一个伪造来源的数据包就把回复引走；别名数量已达上限时不再迁移
+func (s *Session) migrate(addr net.Addr, key SessionKey) {
+	s.mu.Lock()
+	seen := s.migrating == key
+	s.migrating = key
+	s.mu.Unlock()
+	if !seen || !s.addAlias(key) {
+		return
+	}
+	old := s.replyTo()
+	s.migrated.Store(&addr)
+	s.opts.Log.Infof("[%s] QUIC连接迁移: %s -> %s", s.tag, old, addr)
+}
+
+// 返回回复客户端的地址，QUIC连接迁移后为客户端的新地址
+func (s *Session) replyTo() net.Addr {
+	if addr := s.migrated.Load(); addr != nil {
+		return *addr
+	}
+	return s.clientAddr
+}
+
+// 以key为别名登记会话，已指向其他会话或别名数量已达上限时不登记并返回false；会话关闭时删除所有别名
+func (s *Session) addAlias(key SessionKey) bool {
+	s.mu.Lock()
+	full := len(s.aliases) >= maxQUICAliases
+	s.mu.Unlock()
+	if full {
+		return false
+	}
+	if actual, loaded := s.sessions.LoadOrStore(key, s); loaded {
+		return actual == s
+	}
+	s.mu.Lock()
+	s.aliases = append(s.aliases, key)
+	s.mu.Unlock()
+
+	// 与Close并发时Close可能已删除了别名
+	select {
+	case <-s.done:
+		s.sessions.CompareAndDelete(key, s)
+		return false
+	default:
+		return true
+	}
+}
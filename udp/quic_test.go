@@ -0,0 +1,237 @@
+package udp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+// 构造QUIC长包头：首字节、版本、目标连接ID长度和内容、源连接ID长度和内容，之后为载荷
+func longHeader(version uint32, dcid, scid []byte, payload ...byte) []byte {
+	b := []byte{0xc3, byte(version >> 24), byte(version >> 16), byte(version >> 8), byte(version)}
+	b = append(b, byte(len(dcid)))
+	b = append(b, dcid...)
+	b = append(b, byte(len(scid)))
+	b = append(b, scid...)
+	return append(b, payload...)
+}
+
+// 返回表中指向s的所有键
+func keysOf(m *SessionMap, s *Session) []SessionKey {
+	var keys []SessionKey
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		for k, v := range sh.sessions {
+			if v == s {
+				keys = append(keys, k)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return keys
+}
+
+func TestQUICLongHeaderIDs(t *testing.T) {
+	dcid, scid := []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{9, 10, 11, 12}
+	full := longHeader(1, dcid, scid, 0xaa, 0xbb)
+	maxID := bytes.Repeat([]byte{0x55}, maxQUICIDLen)
+
+	t.Run("解析连接ID", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			in         []byte
+			dcid, scid []byte
+		}{
+			{"带载荷", full, dcid, scid},
+			{"不带载荷", longHeader(1, dcid, scid), dcid, scid},
+			{"连接ID为空", longHeader(1, nil, nil), []byte{}, []byte{}},
+			{"连接ID为最大长度", longHeader(0xff000020, maxID, maxID), maxID, maxID},
+		}
+		for _, tt := range tests {
+			gotD, gotS, ok := quicLongHeaderIDs(tt.in)
+			if !ok {
+				t.Errorf("%s: 有效的长包头没有解析出连接ID", tt.name)
+				continue
+			}
+			if !bytes.Equal(gotD, tt.dcid) || !bytes.Equal(gotS, tt.scid) {
+				t.Errorf("%s: 目标/源连接ID为%x/%x，应为%x/%x", tt.name, gotD, gotS, tt.dcid, tt.scid)
+			}
+		}
+	})
+
+	// 截断和超长的包头不能越界读取，也不能把载荷当作连接ID
+	t.Run("拒绝无效包头", func(t *testing.T) {
+		for name, in := range map[string][]byte{
+			"短于最小长包头":   full[:6],
+			"短包头":       append([]byte{0x43}, full[1:]...),
+			"固定位为0":     append([]byte{0x83}, full[1:]...),
+			"版本协商包":     longHeader(0, dcid, scid),
+			"目标连接ID截断":  full[:5+1+4],
+			"缺少源连接ID长度": full[:5+1+len(dcid)],
+			"源连接ID截断":   full[:5+1+len(dcid)+1+2],
+			"目标连接ID超长":  longHeader(1, append(maxID, 0), scid),
+			"源连接ID超长":   longHeader(1, dcid, append(maxID, 0)),
+			"长度字节为0xff": append(full[:5:5], 0xff, 1, 2, 3),
+		} {
+			if d, s, ok := quicLongHeaderIDs(in); ok {
+				t.Errorf("%s: % x被解析为长包头，连接ID为%x/%x", name, in, d, s)
+			}
+		}
+	})
+}
+
+func TestQUICShortHeaderID(t *testing.T) {
+	if id, ok := quicShortHeaderID([]byte{0x5f, 1, 2, 3, 4, 5, 6}, 4); !ok || !bytes.Equal(id, []byte{1, 2, 3, 4}) {
+		t.Errorf("带载荷的短包头取出连接ID %x (%v)，应只取首字节后的4个字节", id, ok)
+	}
+	if id, ok := quicShortHeaderID([]byte{0x40, 1, 2, 3, 4}, 4); !ok || len(id) != 4 {
+		t.Errorf("恰好容纳连接ID的短包头取出%x (%v)", id, ok)
+	}
+	for name, in := range map[string][]byte{
+		"连接ID截断": {0x40, 1, 2, 3},
+		"长包头":    {0xc0, 1, 2, 3, 4},
+		"固定位为0":  {0x00, 1, 2, 3, 4},
+	} {
+		if id, ok := quicShortHeaderID(in, 4); ok {
+			t.Errorf("%s的数据包被当作短包头，连接ID为%x", name, id)
+		}
+	}
+}
+
+// 长包头按目标连接ID查找会话，短包头按已登记过的源连接ID长度截取连接ID
+func TestLoadQUIC(t *testing.T) {
+	m := NewSessionMap()
+	client, server := &Session{}, &Session{}
+	m.LoadOrStore(quicKey([]byte{1, 2, 3, 4, 5, 6, 7, 8}), client)
+	m.LoadOrStore(quicKey([]byte{9, 10, 11, 12}), server)
+	m.addQUICIDLen(4)
+
+	tests := []struct {
+		name string
+		in   []byte
+		want *Session
+	}{
+		{"长包头按目标连接ID查找", longHeader(1, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil), client},
+		{"短包头按已知长度查找", []byte{0x41, 9, 10, 11, 12, 0xee}, server},
+		{"长包头目标连接ID为空", longHeader(1, nil, []byte{9, 10, 11, 12}), nil},
+		{"长包头目标连接ID未知", longHeader(1, []byte{7, 7, 7, 7}, nil), nil},
+		{"截断的长包头不按短包头解析", []byte{0xc0, 0, 0, 0, 1, 4, 9, 10}, nil},
+		{"短包头连接ID截断", []byte{0x41, 9, 10, 11}, nil},
+		{"短包头连接ID未知", []byte{0x41, 1, 2, 3, 4}, nil},
+	}
+	for _, tt := range tests {
+		s, ok := m.loadQUIC(tt.in)
+		switch {
+		case tt.want == nil && ok:
+			t.Errorf("%s: 找到了会话%p", tt.name, s)
+		case tt.want != nil && s != tt.want:
+			t.Errorf("%s: 找到会话%p，应为%p", tt.name, s, tt.want)
+		}
+	}
+}
+
+// 登记别名与Close同时进行，Close结束后表中不留下指向已关闭会话的别名
+func TestSessionAliasCloseRace(t *testing.T) {
+	m := NewSessionMap()
+	for i := 0; i < 200; i++ {
+		key := addrKey(i)
+		s := newTestSession(t, m, key)
+		m.LoadOrStore(key, s)
+
+		var wg sync.WaitGroup
+		for a := 0; a < maxQUICAliases; a++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.addAlias(quicKey([]byte(fmt.Sprintf("%d/%d", i, a))))
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Close()
+		}()
+		wg.Wait()
+
+		if keys := keysOf(m, s); len(keys) > 0 {
+			t.Fatalf("第%d次: 关闭的会话仍有键 %v", i, keys)
+		}
+	}
+}
+
+// 别名已指向其他会话或数量达到上限时不登记；会话关闭时只删除仍指向自身的别名
+func TestSessionAliases(t *testing.T) {
+	m := NewSessionMap()
+	a, b := newTestSession(t, m, addrKey(1)), newTestSession(t, m, addrKey(2))
+	m.LoadOrStore(a.sessionKey, a)
+	m.LoadOrStore(b.sessionKey, b)
+
+	shared := quicKey([]byte("shared"))
+	a.addAlias(shared)
+	b.addAlias(shared)
+	if s, _ := m.Load(shared); s != a {
+		t.Fatal("已登记的别名被其他会话覆盖")
+	}
+	for i := 0; i < maxQUICAliases+4; i++ {
+		b.addAlias(quicKey([]byte(fmt.Sprint("b", i))))
+	}
+	if n := len(keysOf(m, b)); n != 1+maxQUICAliases {
+		t.Errorf("登记%d个别名后会话b有%d个键，别名应以%d个为上限", maxQUICAliases+4, n, maxQUICAliases)
+	}
+
+	a.Close()
+	if keys := keysOf(m, a); len(keys) > 0 {
+		t.Errorf("关闭的会话a仍有键 %v", keys)
+	}
+	if n := len(keysOf(m, b)); n != 1+maxQUICAliases {
+		t.Errorf("关闭a删除了会话b的键，剩下%d个", n)
+	}
+	b.Close()
+	if keys := keysOf(m, b); len(keys) > 0 {
+		t.Errorf("关闭的会话b仍有键 %v", keys)
+	}
+}
+
+// 新地址第二次出现时才迁移回复地址；别名数量达到上限后不再迁移
+func TestSessionMigrate(t *testing.T) {
+	m := NewSessionMap()
+	s := newTestSession(t, m, addrKey(1))
+	m.LoadOrStore(s.sessionKey, s)
+	defer s.Close()
+
+	moved := addrKey(2)
+	movedAddr := net.UDPAddrFromAddrPort(moved.addr)
+	s.migrate(movedAddr, moved)
+	if got := s.replyTo(); got != s.clientAddr {
+		t.Fatalf("新地址只出现一次就把回复改发往%s", got)
+	}
+	if _, ok := m.Load(moved); ok {
+		t.Fatal("新地址只出现一次就登记为别名")
+	}
+	s.migrate(movedAddr, moved)
+	if got := s.replyTo(); got != net.Addr(movedAddr) {
+		t.Fatalf("新地址第二次出现后回复仍发往%s", got)
+	}
+
+	// 另一个地址与迁移地址交替出现时都只算出现一次
+	spoof, other := addrKey(3), addrKey(4)
+	s.migrate(net.UDPAddrFromAddrPort(spoof.addr), spoof)
+	s.migrate(net.UDPAddrFromAddrPort(other.addr), other)
+	s.migrate(net.UDPAddrFromAddrPort(spoof.addr), spoof)
+	if got := s.replyTo(); got != net.Addr(movedAddr) {
+		t.Fatalf("交替出现的地址改变了回复地址: %s", got)
+	}
+
+	for i := 0; i < maxQUICAliases; i++ {
+		s.addAlias(quicKey([]byte(fmt.Sprint("id", i))))
+	}
+	last := addrKey(5)
+	s.migrate(net.UDPAddrFromAddrPort(last.addr), last)
+	s.migrate(net.UDPAddrFromAddrPort(last.addr), last)
+	if got := s.replyTo(); got != net.Addr(movedAddr) {
+		t.Errorf("别名已满时仍迁移到%s", got)
+	}
+}
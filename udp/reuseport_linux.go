@@ -0,0 +1,37 @@
+//go:build linux
+
+package udp
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// 只有Linux的SO_REUSEPORT按四元组哈希把数据包分给绑定同一端口的各个套接字，
+// 其他系统上后绑定的套接字独占数据包，无法用于并行读取
+const reusePortSupported = true
+
+// 监听UDP地址，reusePort为true时设置SO_REUSEPORT以便多个套接字绑定同一端口
+func listenUDP(ctx context.Context, network string, addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	pc, err := lc.ListenPacket(ctx, network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package udp
+
+import (
+	"context"
+	"net"
+)
+
+const reusePortSupported = false
+
+func listenUDP(ctx context.Context, network string, addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	return net.ListenUDP(network, addr)
+}
@@ -2,63 +2,173 @@ package udp
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/chaos"
+	"github.com/Mxmilu666/nia-forwarding/dscp"
+	"github.com/Mxmilu666/nia-forwarding/events"
+	"github.com/Mxmilu666/nia-forwarding/flow"
+	"github.com/Mxmilu666/nia-forwarding/fwmark"
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+	"github.com/Mxmilu666/nia-forwarding/record"
+	"github.com/Mxmilu666/nia-forwarding/stats"
+	"github.com/Mxmilu666/nia-forwarding/xdp"
 )
 
 // Session 表示UDP会话
 type Session struct {
-	clientAddr     *net.UDPAddr
-	targetConn     *net.UDPConn
-	targetAddr     *net.UDPAddr
-	sourceConn     *net.UDPConn
-	sessions       *sync.Map
-	sessionKey     string
+	clientAddr     net.Addr
+	targetConn     net.PacketConn
+	connected      *net.UDPConn // 已连接到targetAddr的套接字，与targetConn相同；无法使用已连接套接字时为nil
+	targetAddr     net.Addr
+	fanOut         []net.Addr // 额外接收数据包副本的目标
+	sourceConn     net.PacketConn
+	sessions       *SessionMap
+	sessionKey     SessionKey
+	aliases        []SessionKey             // 会话在会话表中的其他键(QUIC连接ID和迁移后的客户端地址)，由mu保护
+	migrated       atomic.Pointer[net.Addr] // QUIC连接迁移后客户端的新地址
+	migrating      SessionKey               // 最近一次按连接ID找到会话的新客户端地址，由mu保护
+	delayed        map[*time.Timer]*[]byte  // 故障注入延迟发送中尚未到期的定时器及其缓冲区，由mu保护
+	tftpPeer       atomic.Pointer[net.Addr] // TFTP服务器回复使用的地址，见tftp.go
 	lastActiveTime time.Time
 	done           chan struct{}
+	ctx            context.Context // 会话关闭时取消，用于等待带宽
+	cancel         context.CancelFunc
+	closeOnce      sync.Once
 	mu             sync.Mutex
-	bufferSize     int
-	timeout        time.Duration
+	opts           Options
+	info           *middleware.Info
+	tag            string // 日志中的代理ID和会话ID
+	createdAt      time.Time
+	bytesUp        atomic.Int64 // 客户端 -> 目标
+	bytesDown      atomic.Int64 // 目标 -> 客户端
+	packetsUp      atomic.Int64
+	packetsDown    atomic.Int64
+	pending        atomic.Int64 // dns模式下尚未收到回复的请求数
+	capped         atomic.Bool  // 已达到传输上限
+	rec            *record.File
+	upShaper       *chaos.Shaper // 故障注入的延迟和带宽整形
+	downShaper     *chaos.Shaper
+	xdp            *xdp.Session // 内核中转发的会话，未使用XDP时为nil
+	xdpUp, xdpDown xdp.Counter  // 已计入统计的内核转发流量
 }
 
 // NewSession 创建一个新的UDP会话
-func NewSession(ctx context.Context, sourceConn *net.UDPConn, clientAddr *net.UDPAddr,
-	targetAddrStr string, sessions *sync.Map, sessionKey string,
-	bufferSize int, timeout time.Duration) (*Session, error) {
+// info.TargetAddr为会话的目标地址，会话关闭时info会传给中间件的OnClose
+func NewSession(ctx context.Context, sourceConn net.PacketConn, clientAddr net.Addr,
+	sessions *SessionMap, sessionKey SessionKey, info *middleware.Info, opts Options) (*Session, error) {
 
-	targetAddr, err := net.ResolveUDPAddr("udp6", targetAddrStr)
+	// 默认使用IPv6套接字，目标为IPv4组播组时使用IPv4套接字发送
+	network := opts.TargetNetwork
+	if network == "" {
+		network = "udp6"
+	}
+	if host, _, err := net.SplitHostPort(info.TargetAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.IsMulticast() && ip.To4() != nil {
+			network = "udp4"
+		}
+	}
+
+	tag := logging.Tag(info.ProxyID, info.ConnID)
+	opts.Log = opts.Log.Conn() // 抽样未选中的会话只记录警告和错误
+	targetAddr, err := resolveTarget(opts.Resolver, network, info.TargetAddr)
 	if err != nil {
 		return nil, fmt.Errorf("无法解析目标UDP地址: %w", err)
 	}
 
-	targetConn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6zero, Port: 0})
+	// 扇出目标与目标共用一个套接字，必须是同一类型的地址
+	var fanOut []net.Addr
+	for _, t := range opts.FanOutTargets {
+		addr, err := resolveTarget(opts.Resolver, network, t)
+		if err != nil {
+			return nil, fmt.Errorf("无法解析扇出目标地址: %w", err)
+		}
+		if addr.Network() != targetAddr.Network() {
+			return nil, fmt.Errorf("扇出目标 %s 与目标 %s 的地址类型不同", t, info.TargetAddr)
+		}
+		fanOut = append(fanOut, addr)
+	}
+
+	var targetConn socketConn
+	var connected *net.UDPConn
+	udpTarget, _ := targetAddr.(*net.UDPAddr)
+	switch {
+	case udpTarget == nil:
+		targetConn, err = listenUnixgramTemp()
+	case len(fanOut) == 0 && !udpTarget.IP.IsMulticast() && !opts.TFTP:
+		// 只发往一个单播目标时使用已连接的套接字：内核只接收该目标的数据包，
+		// 目标返回的ICMP端口不可达作为错误返回，会话可以立即关闭
+		var conn net.Conn
+		if conn, err = fwmark.Dialer(opts.Source.Dialer(0), opts.Mark).Dial(network, udpTarget.String()); err == nil {
+			connected = conn.(*net.UDPConn)
+			targetConn = connected
+		}
+	default:
+		var conn *net.UDPConn
+		if conn, err = opts.Source.ListenUDP(network); err == nil {
+			targetConn = conn
+			if err = fwmark.Set(conn, opts.Mark); err != nil {
+				conn.Close()
+			}
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("无法创建UDP会话: %w", err)
 	}
 
+	if err := setSocketBuffers(targetConn, opts.SocketReadBuffer, opts.SocketWriteBuffer); err != nil {
+		opts.Log.Warnf("[%s] 设置UDP会话套接字缓冲区失败: %v", tag, err)
+	}
+	if opts.DSCP > 0 && udpTarget != nil {
+		if err := dscp.Set(targetConn, opts.DSCP); err != nil {
+			opts.Log.Warnf("[%s] 设置UDP会话套接字的DSCP失败: %v", tag, err)
+		}
+	}
+	if udpAddr, ok := targetAddr.(*net.UDPAddr); ok && udpAddr.IP.IsMulticast() && opts.MulticastInterface != nil {
+		if err := setMulticastInterface(targetConn.(*net.UDPConn), opts.MulticastInterface); err != nil {
+			opts.Log.Warnf("[%s] 设置UDP组播发送网卡失败: %v", tag, err)
+		}
+	}
+
+	sessionCtx, cancel := context.WithCancel(ctx)
 	session := &Session{
 		clientAddr:     clientAddr,
 		targetConn:     targetConn,
+		connected:      connected,
 		targetAddr:     targetAddr,
+		fanOut:         fanOut,
 		sourceConn:     sourceConn,
 		sessions:       sessions,
 		sessionKey:     sessionKey,
 		lastActiveTime: time.Now(),
 		done:           make(chan struct{}),
-		bufferSize:     bufferSize,
-		timeout:        timeout,
+		ctx:            sessionCtx,
+		cancel:         cancel,
+		opts:           opts,
+		info:           info,
+		tag:            tag,
+		rec:            opts.Recorder.Open(info.ProxyID, "udp", clientAddr),
+		upShaper:       opts.Chaos.NewShaper(),
+		downShaper:     opts.Chaos.NewShaper(),
+		createdAt:      time.Now(),
 	}
+	opts.Stats.ConnOpened()
+	session.startXDP()
 
-	log.Printf("UDP会话创建: %s -> %s", clientAddr.String(), targetAddrStr)
+	opts.Log.Infof("[%s] UDP会话创建: %s -> %s -> %s", tag, clientAddr.String(), info.ListenAddr, info.TargetAddr)
+	opts.Events.PublishConn(events.TypeOpen, info, nil)
 
 	// 处理从目标返回的数据
-	go session.handleTargetData(ctx)
+	opts.Stats.Go(func() { session.handleTargetData(ctx) })
 
 	// 启动超时检查
-	go session.checkTimeout(ctx)
+	opts.Stats.Go(func() { session.checkTimeout(ctx) })
 
 	return session, nil
 }
@@ -70,17 +180,146 @@ func (s *Session) Refresh() {
 	s.lastActiveTime = time.Now()
 }
 
-// Send 发送数据到目标
+// Send 发送数据到目标，data只在调用期间使用，需要延迟发送时复制到缓冲区池中的缓冲区
 func (s *Session) Send(data []byte) {
 	s.Refresh()
-	if _, err := s.targetConn.WriteToUDP(data, s.targetAddr); err != nil {
-		log.Printf("UDP发送到目标错误: %v", err)
+	s.rec.Write(data)
+	if s.opts.SessionMode == ModeDNS {
+		s.pending.Add(1)
+	}
+	d, drop := s.upShaper.Schedule(len(data))
+	switch {
+	case drop:
+		s.opts.Stats.AddDropped()
+		s.settle()
+	case d > 0:
+		buf := getBuffer(s.opts.BufferSize)
+		n := copy(*buf, data)
+		s.after(d, buf, func() { s.sendToTarget((*buf)[:n]) })
+	default:
+		s.sendToTarget(data)
 	}
 }
 
+func (s *Session) sendToTarget(data []byte) {
+	var dst []byte
+	if buf := s.obfsBuffer(); buf != nil {
+		defer putBuffer(buf)
+		dst = *buf
+	}
+	data, err := s.opts.Obfs.ToTarget(dst, data)
+	if err != nil {
+		s.opts.Log.Errorf("[%s] UDP数据包混淆错误: %v", s.tag, err)
+		s.opts.Stats.AddDropped()
+		s.settle()
+		return
+	}
+	if !s.writeTo(data, s.sendAddr()) {
+		s.settle()
+	}
+	for _, addr := range s.fanOut {
+		s.writeTo(data, addr)
+	}
+}
+
+// dns模式下一个请求已应答或没有发出，所有请求都已结束时关闭会话，不必等待空闲超时；
+// 没有发出的请求也须在此撤销Send中的计数，否则不会到来的回复让会话一直等到空闲超时
+func (s *Session) settle() {
+	if s.opts.SessionMode == ModeDNS && s.pending.Add(-1) <= 0 {
+		s.Close()
+	}
+}
+
+// 发送一个数据包，没有发出时返回false
+func (s *Session) writeTo(data []byte, addr net.Addr) bool {
+	if s.capReached(len(data)) || s.waitBandwidth(len(data)) != nil {
+		return false
+	}
+
+	var n int
+	var err error
+	if s.connected != nil {
+		n, err = s.connected.Write(data)
+	} else {
+		n, err = s.targetConn.WriteTo(data, addr)
+	}
+	if err != nil {
+		s.opts.Log.Errorf("[%s] UDP发送到目标 %s 错误: %v", s.tag, addr, err)
+		s.opts.Stats.AddTargetError(addr.String(), err, false)
+		s.opts.Events.PublishConn(events.TypeError, s.info, err)
+		if s.connected != nil && targetDead(err) {
+			s.Close()
+		}
+		return false
+	}
+	s.bytesUp.Add(int64(n))
+	s.packetsUp.Add(1)
+	s.opts.Stats.AddUp(int64(n))
+	s.opts.Quota.Add(int64(n))
+	// 先判断级别，避免未开启debug时每个数据包都为可变参数分配内存
+	if s.opts.Log.Enabled(logging.LevelDebug) {
+		s.opts.Log.Debugf("[%s] UDP数据包: %s -> %s, %d字节", s.tag, s.clientAddr, addr, n)
+	}
+	return true
+}
+
+// errSessionCapped 会话达到传输上限，已关闭
+var errSessionCapped = errors.New("达到单连接传输上限")
+
+// 判断再转发n字节是否超过会话的传输上限，超过时关闭会话
+func (s *Session) capReached(n int) bool {
+	limit := s.opts.MaxConnBytes
+	if limit <= 0 || s.bytesUp.Load()+s.bytesDown.Load()+int64(n) <= limit {
+		return false
+	}
+	if s.capped.CompareAndSwap(false, true) {
+		s.opts.Log.Warnf("[%s] UDP会话达到传输上限%d字节，已关闭: %s", s.tag, limit, s.sessionKey)
+		s.opts.Stats.AddCapClosed()
+	}
+	s.Close()
+	return true
+}
+
+// 先申请规则带宽、再申请全局带宽，会话关闭时返回错误
+func (s *Session) waitBandwidth(n int) error {
+	if err := s.opts.RuleBandwidth.Wait(s.ctx, s.opts.Priority, n); err != nil {
+		return err
+	}
+	return s.opts.Bandwidth.Wait(s.ctx, s.opts.Priority, n)
+}
+
+// 判断已连接套接字上的错误是否表示目标不可达，例如目标端口未监听时收到ICMP端口不可达，
+// Windows上表现为连接被重置
+func targetDead(err error) bool {
+	switch stats.Classify(err, false) {
+	case stats.ErrRefused, stats.ErrUnreachable, stats.ErrReset:
+		return true
+	}
+	return false
+}
+
+// 判断是否应把来自from的数据包返回给客户端
+func (s *Session) acceptReply(from net.Addr) bool {
+	if s.opts.TFTP {
+		return s.acceptTFTP(from)
+	}
+	if len(s.fanOut) == 0 {
+		return true
+	}
+	switch s.opts.FanOutReplies {
+	case RepliesAll:
+		return true
+	case RepliesNone:
+		return false
+	}
+	return sameAddr(from, s.targetAddr)
+}
+
 // 处理从目标返回的数据
 func (s *Session) handleTargetData(ctx context.Context) {
-	buffer := make([]byte, s.bufferSize)
+	buf := getBuffer(s.opts.BufferSize)
+	defer putBuffer(buf)
+	buffer := *buf
 	for {
 		select {
 		case <-ctx.Done():
@@ -90,7 +329,7 @@ func (s *Session) handleTargetData(ctx context.Context) {
 		default:
 			// 设置超时以便能检查上下文取消
 			s.targetConn.SetReadDeadline(time.Now().Add(time.Second))
-			n, _, err := s.targetConn.ReadFromUDP(buffer)
+			n, from, err := s.targetConn.ReadFrom(buffer)
 
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
@@ -98,16 +337,47 @@ func (s *Session) handleTargetData(ctx context.Context) {
 					continue
 				}
 
-				// 其他网络错误，关闭会话
+				// 其他网络错误，关闭会话；已连接的套接字在目标端口不可达时也会返回错误
+				if s.connected != nil && targetDead(err) {
+					s.opts.Log.Warnf("[%s] UDP目标 %s 不可达，关闭会话: %v", s.tag, s.targetAddr, err)
+					s.opts.Stats.AddTargetError(s.targetAddr.String(), err, false)
+					s.opts.Events.PublishConn(events.TypeError, s.info, err)
+				}
 				s.Close()
 				return
 			}
 
+			if from == nil || !s.acceptReply(from) {
+				continue
+			}
 			s.Refresh()
 
+			data, err := s.opts.Obfs.FromTarget(buffer[:n])
+			if err != nil {
+				s.opts.Stats.AddDropped()
+				continue
+			}
+			if s.opts.QUICAffinity {
+				s.noteTargetQUIC(data)
+			}
+
 			// 将数据返回给客户端
-			if _, err := s.sourceConn.WriteToUDP(buffer[:n], s.clientAddr); err != nil {
-				log.Printf("UDP返回到客户端错误: %v", err)
+			d, drop := s.downShaper.Schedule(len(data))
+			if drop {
+				s.opts.Stats.AddDropped()
+				continue
+			}
+			if d > 0 {
+				delayed := getBuffer(s.opts.BufferSize)
+				n := copy(*delayed, data)
+				s.after(d, delayed, func() {
+					if err := s.sendToClient((*delayed)[:n]); err != nil {
+						s.Close()
+					}
+				})
+				continue
+			}
+			if err := s.sendToClient(data); err != nil {
 				s.Close()
 				return
 			}
@@ -115,11 +385,92 @@ func (s *Session) handleTargetData(ctx context.Context) {
 	}
 }
 
+func (s *Session) sendToClient(data []byte) error {
+	if s.clientAddr == unnamedClient {
+		s.opts.Stats.AddDropped()
+		return nil
+	}
+	if s.capReached(len(data)) {
+		return errSessionCapped
+	}
+	if s.waitBandwidth(len(data)) != nil {
+		return nil
+	}
+	var dst []byte
+	if buf := s.obfsBuffer(); buf != nil {
+		defer putBuffer(buf)
+		dst = *buf
+	}
+	data, err := s.opts.Obfs.ToClient(dst, data)
+	if err != nil {
+		s.opts.Log.Errorf("[%s] UDP数据包混淆错误: %v", s.tag, err)
+		s.opts.Stats.AddDropped()
+		return nil
+	}
+	written, err := s.sourceConn.WriteTo(data, s.replyTo())
+	if err != nil {
+		s.opts.Log.Errorf("[%s] UDP返回到客户端错误: %v", s.tag, err)
+		s.opts.Stats.AddTargetError(stats.PeerClient, err, false)
+		s.opts.Events.PublishConn(events.TypeError, s.info, err)
+		return err
+	}
+	s.bytesDown.Add(int64(written))
+	s.packetsDown.Add(1)
+	s.opts.Stats.AddDown(int64(written))
+	s.opts.Quota.Add(int64(written))
+	if s.opts.Log.Enabled(logging.LevelDebug) {
+		s.opts.Log.Debugf("[%s] UDP数据包: %s -> %s, %d字节", s.tag, s.targetAddr, s.replyTo(), written)
+	}
+
+	s.settle()
+	return nil
+}
+
+// 延迟d后执行f，之后把buf放回缓冲区池；会话关闭时停止尚未到期的定时器并放回其缓冲区
+func (s *Session) after(d time.Duration, buf *[]byte, f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		putBuffer(buf)
+		return
+	default:
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		s.mu.Lock()
+		_, ok := s.delayed[timer]
+		delete(s.delayed, timer)
+		s.mu.Unlock()
+		// 不在表中时已由Close放回缓冲区
+		if ok {
+			f()
+			putBuffer(buf)
+		}
+	})
+	if s.delayed == nil {
+		s.delayed = make(map[*time.Timer]*[]byte)
+	}
+	s.delayed[timer] = buf
+}
+
 // 检查会话是否超时
 func (s *Session) checkTimeout(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second)
+	// 超时较短时相应缩短检查间隔，使会话在超时后及时关闭
+	interval := 30 * time.Second
+	if s.opts.Timeout > 0 {
+		interval = min(interval, max(s.opts.Timeout/2, time.Second))
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	var expired <-chan time.Time
+	if s.opts.MaxConnLifetime > 0 {
+		timer := time.NewTimer(s.opts.MaxConnLifetime - time.Since(s.createdAt))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -127,13 +478,18 @@ func (s *Session) checkTimeout(ctx context.Context) {
 			return
 		case <-s.done:
 			return
+		case <-expired:
+			s.opts.Log.Infof("[%s] UDP会话达到最长持续时间%s，已关闭: %s", s.tag, s.opts.MaxConnLifetime, s.sessionKey)
+			s.Close()
+			return
 		case <-ticker.C:
+			s.syncXDP()
 			s.mu.Lock()
-			inactive := time.Since(s.lastActiveTime) > s.timeout
+			inactive := time.Since(s.lastActiveTime) > s.opts.Timeout
 			s.mu.Unlock()
 
 			if inactive {
-				log.Printf("UDP会话超时: %s", s.sessionKey)
+				s.opts.Log.Infof("[%s] UDP会话超时: %s", s.tag, s.sessionKey)
 				s.Close()
 				return
 			}
@@ -141,16 +497,39 @@ func (s *Session) checkTimeout(ctx context.Context) {
 	}
 }
 
-// Close 关闭会话
+// Close 关闭会话，可被多个goroutine重复调用
 func (s *Session) Close() {
-	select {
-	case <-s.done:
-		// 已经关闭
-		return
-	default:
+	s.closeOnce.Do(func() {
 		close(s.done)
-		s.targetConn.Close()
-		s.sessions.Delete(s.sessionKey)
-		log.Printf("UDP会话关闭: %s", s.sessionKey)
-	}
+		s.cancel()
+		s.syncXDP()
+		s.xdp.Delete()
+		closePacketConn(s.targetConn)
+		s.rec.Close()
+		s.sessions.CompareAndDelete(s.sessionKey, s)
+		s.mu.Lock()
+		for _, key := range s.aliases {
+			s.sessions.CompareAndDelete(key, s)
+		}
+		for timer, buf := range s.delayed {
+			timer.Stop()
+			putBuffer(buf)
+		}
+		s.delayed = nil
+		s.mu.Unlock()
+		s.opts.PerIP.Release(s.clientAddr)
+		s.opts.Stats.ConnClosed()
+
+		closedAt := time.Now()
+		s.info.BytesUp, s.info.BytesDown, s.info.Duration = s.bytesUp.Load(), s.bytesDown.Load(), closedAt.Sub(s.createdAt)
+		s.opts.Middlewares.OnClose(s.info)
+
+		s.opts.Stats.ConnFinished(closedAt.Sub(s.createdAt), uint64(s.bytesUp.Load()+s.bytesDown.Load()))
+		s.opts.Flows.ExportConn(flow.ProtoUDP, s.clientAddr, s.targetAddr, s.createdAt, closedAt,
+			uint64(s.bytesUp.Load()), uint64(s.packetsUp.Load()), uint64(s.bytesDown.Load()), uint64(s.packetsDown.Load()))
+
+		s.opts.Log.Infof("[%s] UDP会话关闭: %s, 上行%d字节, 下行%d字节, 持续%s",
+			s.tag, s.sessionKey, s.bytesUp.Load(), s.bytesDown.Load(), closedAt.Sub(s.createdAt).Round(time.Millisecond))
+		s.opts.Events.PublishConn(events.TypeClose, s.info, nil)
+	})
 }
@@ -0,0 +1,36 @@
+package udp
+
+import (
+	"testing"
+	"time"
+)
+
+// 延迟发送到期后执行，会话关闭时停止尚未到期的延迟发送并放回缓冲区
+func TestSessionAfter(t *testing.T) {
+	m := NewSessionMap()
+	s := newTestSession(t, m, addrKey(1))
+
+	fired := make(chan struct{})
+	s.after(time.Millisecond, getBuffer(64), func() { close(fired) })
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("延迟发送到期后没有执行")
+	}
+
+	s.after(time.Hour, getBuffer(64), func() { t.Error("会话关闭后仍执行了延迟发送") })
+	s.after(20*time.Millisecond, getBuffer(64), func() { t.Error("会话关闭后仍执行了延迟发送") })
+	s.mu.Lock()
+	pending := len(s.delayed)
+	s.mu.Unlock()
+	if pending != 2 {
+		t.Fatalf("登记了%d个延迟发送，应为2个", pending)
+	}
+	s.Close()
+	if s.delayed != nil {
+		t.Errorf("会话关闭后仍有%d个延迟发送", len(s.delayed))
+	}
+
+	s.after(time.Millisecond, getBuffer(64), func() { t.Error("会话关闭后登记的延迟发送被执行") })
+	time.Sleep(50 * time.Millisecond)
+}
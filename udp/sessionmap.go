@@ -0,0 +1,127 @@
+package udp
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// 会话表的分片数量，按客户端地址的哈希选择分片
+const sessionShards = 64
+
+// SessionKey 会话表的键。UDP客户端以地址和端口为键，查找时不分配内存；
+// unixgram客户端和QUIC连接ID别名以字符串为键
+type SessionKey struct {
+	addr netip.AddrPort
+	name string
+}
+
+func (k SessionKey) String() string {
+	if k.name != "" {
+		return k.name
+	}
+	return k.addr.String()
+}
+
+// SessionMap 以客户端地址为键的会话表，分片加锁，
+// 降低大量客户端同时创建、查找和关闭会话时的锁竞争
+type SessionMap struct {
+	shards [sessionShards]sessionShard
+
+	quicIDLens atomic.Uint32 // 已见过的服务器QUIC连接ID长度，第n位表示长度n
+}
+
+type sessionShard struct {
+	mu       sync.RWMutex
+	sessions map[SessionKey]*Session
+}
+
+// NewSessionMap 创建空的会话表
+func NewSessionMap() *SessionMap {
+	m := &SessionMap{}
+	for i := range m.shards {
+		m.shards[i].sessions = make(map[SessionKey]*Session)
+	}
+	return m
+}
+
+// 按FNV-1a哈希选择分片
+func (m *SessionMap) shard(key SessionKey) *sessionShard {
+	h := uint32(2166136261)
+	if key.name != "" {
+		for i := 0; i < len(key.name); i++ {
+			h ^= uint32(key.name[i])
+			h *= 16777619
+		}
+	} else {
+		ip := key.addr.Addr().As16()
+		for _, b := range ip {
+			h ^= uint32(b)
+			h *= 16777619
+		}
+		port := key.addr.Port()
+		for _, b := range [2]byte{byte(port >> 8), byte(port)} {
+			h ^= uint32(b)
+			h *= 16777619
+		}
+	}
+	return &m.shards[h%sessionShards]
+}
+
+// Load 查找会话
+func (m *SessionMap) Load(key SessionKey) (*Session, bool) {
+	sh := m.shard(key)
+	sh.mu.RLock()
+	s, ok := sh.sessions[key]
+	sh.mu.RUnlock()
+	return s, ok
+}
+
+// LoadOrStore 已有会话时返回该会话和true，否则保存s并返回s和false
+func (m *SessionMap) LoadOrStore(key SessionKey, s *Session) (*Session, bool) {
+	sh := m.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if existing, ok := sh.sessions[key]; ok {
+		return existing, true
+	}
+	sh.sessions[key] = s
+	return s, false
+}
+
+// CompareAndDelete 键对应的会话为s时删除
+func (m *SessionMap) CompareAndDelete(key SessionKey, s *Session) {
+	sh := m.shard(key)
+	sh.mu.Lock()
+	if sh.sessions[key] == s {
+		delete(sh.sessions, key)
+	}
+	sh.mu.Unlock()
+}
+
+// 记录服务器使用的QUIC连接ID长度
+func (m *SessionMap) addQUICIDLen(n int) {
+	for {
+		old := m.quicIDLens.Load()
+		if old&(1<<n) != 0 || m.quicIDLens.CompareAndSwap(old, old|1<<n) {
+			return
+		}
+	}
+}
+
+// CloseAll 关闭所有会话，会话关闭时会从表中删除自身，因此先复制再逐个关闭
+func (m *SessionMap) CloseAll() {
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		sessions := make([]*Session, 0, len(sh.sessions))
+		for _, s := range sh.sessions {
+			sessions = append(sessions, s)
+		}
+		sh.mu.RUnlock()
+
+		for _, s := range sessions {
+			s.Close()
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package udp
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/Mxmilu666/nia-forwarding/logging"
+	"github.com/Mxmilu666/nia-forwarding/middleware"
+)
+
+func addrKey(i int) SessionKey {
+	return SessionKey{addr: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), uint16(40000+i))}
+}
+
+// 创建只用于会话表的会话，不启动转发goroutine
+func newTestSession(t *testing.T, m *SessionMap, key SessionKey) *Session {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{
+		clientAddr: net.UDPAddrFromAddrPort(key.addr),
+		targetConn: conn,
+		sessions:   m,
+		sessionKey: key,
+		done:       make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+		opts:       Options{Log: logging.New(logging.LevelError)},
+		info:       &middleware.Info{},
+	}
+}
+
+// 返回表中的会话数量
+func sessionCount(m *SessionMap) int {
+	n := 0
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		n += len(sh.sessions)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+func TestSessionMapShards(t *testing.T) {
+	m := NewSessionMap()
+	used := make(map[*sessionShard]bool)
+	for i := 0; i < 1000; i++ {
+		used[m.shard(addrKey(i))] = true
+	}
+	if len(used) < sessionShards/2 {
+		t.Errorf("1000个客户端地址只分布在%d个分片中", len(used))
+	}
+
+	// 地址相同、端口不同的客户端是不同的会话
+	s := &Session{}
+	m.LoadOrStore(SessionKey{addr: netip.MustParseAddrPort("192.0.2.1:1000")}, s)
+	if _, ok := m.Load(SessionKey{addr: netip.MustParseAddrPort("192.0.2.1:1001")}); ok {
+		t.Error("端口不同的客户端找到了同一会话")
+	}
+}
+
+// 多个goroutine同时为同一批客户端创建会话，每个客户端只保存一个会话，其余调用取得该会话
+func TestSessionMapLoadOrStoreConcurrent(t *testing.T) {
+	const keys, workers = 256, 8
+	m := NewSessionMap()
+	got := make([][]*Session, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got[w] = make([]*Session, keys)
+			for i := 0; i < keys; i++ {
+				got[w][i], _ = m.LoadOrStore(addrKey(i), &Session{})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := sessionCount(m); n != keys {
+		t.Fatalf("表中有%d个会话, 期望 %d", n, keys)
+	}
+	for i := 0; i < keys; i++ {
+		stored, _ := m.Load(addrKey(i))
+		for w := 0; w < workers; w++ {
+			if got[w][i] != stored {
+				t.Fatalf("%s: goroutine %d取得的会话不是表中保存的会话", addrKey(i), w)
+			}
+		}
+	}
+}
+
+// CompareAndDelete只删除仍指向该会话的键，客户端已有新会话时保留
+func TestSessionMapCompareAndDelete(t *testing.T) {
+	m := NewSessionMap()
+	key := addrKey(1)
+	old, cur := &Session{}, &Session{}
+	m.LoadOrStore(key, old)
+	m.CompareAndDelete(key, old)
+	if _, ok := m.Load(key); ok {
+		t.Fatal("CompareAndDelete没有删除会话")
+	}
+	m.LoadOrStore(key, cur)
+	m.CompareAndDelete(key, old)
+	if s, ok := m.Load(key); !ok || s != cur {
+		t.Fatal("旧会话的CompareAndDelete删除了客户端的新会话")
+	}
+}
+
+// CloseAll关闭所有会话，会话关闭时从表中删除自身
+func TestSessionMapCloseAll(t *testing.T) {
+	m := NewSessionMap()
+	var sessions []*Session
+	for i := 0; i < 100; i++ {
+		s := newTestSession(t, m, addrKey(i))
+		m.LoadOrStore(s.sessionKey, s)
+		sessions = append(sessions, s)
+	}
+
+	m.CloseAll()
+	if n := sessionCount(m); n != 0 {
+		t.Errorf("CloseAll后表中还有%d个会话", n)
+	}
+	for _, s := range sessions {
+		select {
+		case <-s.done:
+		default:
+			t.Fatalf("会话%s没有关闭", s.sessionKey)
+		}
+	}
+}
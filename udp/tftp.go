@@ -0,0 +1,36 @@
+package udp
+
+import "net"
+
+// TFTP：服务器从新的临时端口(传输ID)回复客户端的读写请求，此后的传输都使用该端口(RFC 1350)。
+// 已连接的套接字只接收发往端口的回复，因此TFTP会话使用未连接的套接字，接受目标IP从任意端口
+// 发来的第一个回复，并把之后发往目标的数据包改发到该端口；其他端口发来的数据包被丢弃
+
+// 判断是否接受来自from的TFTP回复，第一个回复的端口记为服务器的传输端口，之后只接受该端口
+func (s *Session) acceptTFTP(from net.Addr) bool {
+	target, ok := s.targetAddr.(*net.UDPAddr)
+	if !ok {
+		return true
+	}
+	addr, ok := from.(*net.UDPAddr)
+	if !ok || !addr.IP.Equal(target.IP) {
+		return false
+	}
+	// 只在读取目标数据的goroutine中调用，不会并发记录
+	if peer := s.tftpPeer.Load(); peer != nil {
+		return sameAddr(*peer, from)
+	}
+	s.tftpPeer.Store(&from)
+	if addr.Port != target.Port {
+		s.opts.Log.Infof("[%s] TFTP服务器改用端口%d回复，后续数据包发往该端口", s.tag, addr.Port)
+	}
+	return true
+}
+
+// 返回发往目标的地址，TFTP服务器改用新端口回复后为该端口
+func (s *Session) sendAddr() net.Addr {
+	if peer := s.tftpPeer.Load(); peer != nil {
+		return *peer
+	}
+	return s.targetAddr
+}
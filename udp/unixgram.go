@@ -0,0 +1,71 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Mxmilu666/nia-forwarding/dnscache"
+	"github.com/Mxmilu666/nia-forwarding/unixsock"
+)
+
+// UnixgramPrefix 监听或目标地址以该前缀开头时表示unixgram套接字路径，例如 "unixgram:/dev/log"，
+// Linux上 "unixgram:@name" 表示抽象命名空间中的名称
+const UnixgramPrefix = "unixgram:"
+
+// 会话临时套接字文件的序号
+var unixgramSeq atomic.Uint64
+
+// 解析目标地址，unixgram路径以外的地址按network解析为UDP地址，主机名经resolver缓存
+func resolveTarget(resolver *dnscache.Cache, network, addr string) (net.Addr, error) {
+	if path, ok := strings.CutPrefix(addr, UnixgramPrefix); ok {
+		return &net.UnixAddr{Name: path, Net: "unixgram"}, nil
+	}
+	return resolver.ResolveUDPAddr(network, addr)
+}
+
+// 监听unixgram路径，同名的旧套接字文件会被删除
+func listenUnixgram(path string) (*net.UnixConn, error) {
+	unixsock.RemoveStale(path)
+	return net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+}
+
+// 为发往unixgram目标的会话绑定临时路径，目标才能回复；Linux上使用抽象名称，不产生文件
+func listenUnixgramTemp() (*net.UnixConn, error) {
+	name := fmt.Sprintf("nia-forwarding-%d-%d.sock", os.Getpid(), unixgramSeq.Add(1))
+	if runtime.GOOS == "linux" {
+		return listenUnixgram("@" + name)
+	}
+	return listenUnixgram(filepath.Join(os.TempDir(), name))
+}
+
+// 关闭套接字，unixgram套接字同时删除其文件
+func closePacketConn(conn net.PacketConn) error {
+	if uc, ok := conn.(*net.UnixConn); ok {
+		if addr, ok := uc.LocalAddr().(*net.UnixAddr); ok && addr != nil {
+			defer unixsock.Remove(addr.Name)
+		}
+	}
+	return conn.Close()
+}
+
+// 判断两个地址是否相同
+func sameAddr(a, b net.Addr) bool {
+	if ua, ok := a.(*net.UDPAddr); ok {
+		ub, ok := b.(*net.UDPAddr)
+		return ok && ua.IP.Equal(ub.IP) && ua.Port == ub.Port
+	}
+	return a.Network() == b.Network() && a.String() == b.String()
+}
+
+// 未绑定路径的unixgram客户端的地址，这类客户端共用一个会话且无法收到回复
+type unnamedAddr struct{}
+
+func (unnamedAddr) Network() string { return "unixgram" }
+func (unnamedAddr) String() string  { return "(unnamed)" }
+
+var unnamedClient net.Addr = unnamedAddr{}
@@ -0,0 +1,106 @@
+package udp
+
+import (
+	"net"
+
+	"github.com/Mxmilu666/nia-forwarding/xdp"
+)
+
+// 返回规则中与XDP转发冲突的功能，这些功能需要每个数据包经过Go处理；没有冲突时返回空字符串
+func (p *Proxy) xdpConflict() string {
+	switch {
+	case p.opts.Obfs != nil:
+		return "数据包混淆"
+	case p.opts.Chaos != nil:
+		return "故障注入"
+	case p.opts.Recorder != nil:
+		return "录制"
+	case p.opts.Blocker != nil:
+		return "禁止模式"
+	case p.opts.Bandwidth != nil:
+		return "全局带宽限制"
+	case p.opts.RuleBandwidth != nil:
+		return "规则带宽限制"
+	case p.opts.MaxConnBytes > 0:
+		return "单连接传输上限"
+	case len(p.opts.FanOutTargets) > 0:
+		return "扇出"
+	case p.opts.SessionMode == ModeDNS:
+		return "dns会话模式"
+	case p.opts.QUICAffinity:
+		return "QUIC会话亲和"
+	case p.opts.TFTP:
+		return "TFTP"
+	case p.opts.MulticastGroup != nil:
+		return "组播"
+	case p.opts.DSCP > 0:
+		return "DSCP标记"
+	case p.opts.Mark != 0:
+		return "fwmark"
+	}
+	return ""
+}
+
+// 会话使用已连接的IPv4套接字时把两个方向加入XDP会话表，此后的数据包由内核直接转发；
+// 无法加入时继续由Go转发
+func (s *Session) startXDP() {
+	if s.opts.XDP == nil || s.connected == nil {
+		return
+	}
+	client, ok1 := s.clientAddr.(*net.UDPAddr)
+	listen, ok2 := s.sourceConn.LocalAddr().(*net.UDPAddr)
+	local, ok3 := s.connected.LocalAddr().(*net.UDPAddr)
+	target, ok4 := s.targetAddr.(*net.UDPAddr)
+	if !ok1 || !ok2 || !ok3 || !ok4 || client.IP.To4() == nil || target.IP.To4() == nil {
+		return
+	}
+
+	// 监听通配地址时，客户端发往的地址按路由取本机到客户端的源地址
+	proxy := &net.UDPAddr{IP: listen.IP, Port: listen.Port}
+	if proxy.IP.IsUnspecified() {
+		conn, err := net.DialUDP("udp4", nil, client)
+		if err != nil {
+			return
+		}
+		proxy.IP = conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+	}
+
+	session, err := s.opts.XDP.Add(
+		xdp.Flow{Src: client, Dst: proxy, NewSrc: local, NewDst: target},
+		xdp.Flow{Src: target, Dst: local, NewSrc: proxy, NewDst: client},
+	)
+	if err != nil {
+		s.opts.Log.Debugf("[%s] UDP会话未使用XDP转发: %v", s.tag, err)
+		return
+	}
+	s.xdp = session
+	s.opts.Log.Debugf("[%s] UDP会话使用XDP转发", s.tag)
+}
+
+// 把内核转发的流量计入会话统计和配额，并按最后一个数据包的时间刷新活动时间
+func (s *Session) syncXDP() {
+	if s.xdp == nil {
+		return
+	}
+	up, down := s.xdp.Counters()
+
+	s.mu.Lock()
+	upBytes, downBytes := int64(up.Bytes-s.xdpUp.Bytes), int64(down.Bytes-s.xdpDown.Bytes)
+	upPackets, downPackets := int64(up.Packets-s.xdpUp.Packets), int64(down.Packets-s.xdpDown.Packets)
+	s.xdpUp, s.xdpDown = up, down
+	for _, last := range []xdp.Counter{up, down} {
+		if last.Last.After(s.lastActiveTime) {
+			s.lastActiveTime = last.Last
+		}
+	}
+	s.mu.Unlock()
+
+	s.bytesUp.Add(upBytes)
+	s.packetsUp.Add(upPackets)
+	s.bytesDown.Add(downBytes)
+	s.packetsDown.Add(downPackets)
+	s.opts.Stats.AddUp(upBytes)
+	s.opts.Stats.AddDown(downBytes)
+	s.opts.Quota.Add(upBytes + downBytes)
+}
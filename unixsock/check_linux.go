@@ -0,0 +1,11 @@
+package unixsock
+
+import "fmt"
+
+// Check 检查路径在当前系统上是否可用
+func Check(path string) error {
+	if path == "" {
+		return fmt.Errorf("unix套接字路径为空")
+	}
+	return nil
+}
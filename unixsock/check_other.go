@@ -0,0 +1,16 @@
+//go:build !linux
+
+package unixsock
+
+import "fmt"
+
+// Check 检查路径在当前系统上是否可用，抽象命名空间仅Linux支持
+func Check(path string) error {
+	if path == "" {
+		return fmt.Errorf("unix套接字路径为空")
+	}
+	if IsAbstract(path) {
+		return fmt.Errorf("抽象命名空间套接字 %q 仅支持Linux", path)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+// Package unixsock 处理unix套接字路径，路径以@开头时表示Linux抽象命名空间中的名称
+package unixsock
+
+import (
+	"os"
+	"strings"
+)
+
+// IsAbstract 判断路径是否为抽象命名空间名称，这类套接字没有对应的文件
+func IsAbstract(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// RemoveStale 删除同名的旧套接字文件以便重新监听，抽象名称和非套接字文件不受影响
+func RemoveStale(path string) {
+	if IsAbstract(path) {
+		return
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+// Remove 删除监听结束后遗留的套接字文件
+func Remove(path string) {
+	if path != "" && !IsAbstract(path) {
+		os.Remove(path)
+	}
+}
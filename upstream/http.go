@@ -0,0 +1,44 @@
+package upstream
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// 通过HTTP CONNECT请求建立到addr的隧道
+func (d *Dialer) httpConnect(conn net.Conn, addr string) error {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if d.username != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(d.username + ":" + d.password))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	// 逐字节读取响应头，避免把隧道中的后续数据读进缓冲区
+	resp, err := http.ReadResponse(bufio.NewReaderSize(byteReader{conn}, 1), nil)
+	if err != nil {
+		return fmt.Errorf("读取CONNECT响应失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("连接 %s 失败: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// byteReader 每次最多读取一个字节
+type byteReader struct {
+	conn net.Conn
+}
+
+func (r byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.conn.Read(p)
+}
@@ -0,0 +1,151 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5协议常量 (RFC 1928, RFC 1929)
+const (
+	socks5Version = 0x05
+
+	authNone     = 0x00
+	authPassword = 0x02
+	authNoAccept = 0xff
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "服务器故障",
+	0x02: "规则不允许连接",
+	0x03: "网络不可达",
+	0x04: "主机不可达",
+	0x05: "连接被拒绝",
+	0x06: "TTL过期",
+	0x07: "不支持的命令",
+	0x08: "不支持的地址类型",
+}
+
+// 在已建立的连接上完成SOCKS5认证并请求连接addr
+func (d *Dialer) socks5Connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("无效的端口: %q", portStr)
+	}
+
+	// 协商认证方式
+	method := byte(authNone)
+	if d.username != "" {
+		method = authPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("不是SOCKS5服务器 (版本 %d)", resp[0])
+	}
+	switch resp[1] {
+	case authNone:
+	case authPassword:
+		if err := d.socks5Auth(conn); err != nil {
+			return err
+		}
+	case authNoAccept:
+		return errors.New("没有可接受的认证方式")
+	default:
+		return fmt.Errorf("不支持的认证方式 %d", resp[1])
+	}
+
+	// 发送CONNECT请求
+	req := []byte{socks5Version, cmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, atypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, atypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("域名过长: %q", host)
+		}
+		req = append(req, atypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// 读取响应，绑定地址不使用但必须读完
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		if msg, ok := socks5Replies[head[1]]; ok {
+			return fmt.Errorf("连接 %s 失败: %s", addr, msg)
+		}
+		return fmt.Errorf("连接 %s 失败: 错误码 %d", addr, head[1])
+	}
+
+	var skip int
+	switch head[3] {
+	case atypIPv4:
+		skip = net.IPv4len
+	case atypIPv6:
+		skip = net.IPv6len
+	case atypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return fmt.Errorf("无效的地址类型 %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// 用户名密码认证 (RFC 1929)
+func (d *Dialer) socks5Auth(conn net.Conn) error {
+	if len(d.username) > 255 || len(d.password) > 255 {
+		return errors.New("用户名或密码过长")
+	}
+
+	req := []byte{0x01, byte(len(d.username))}
+	req = append(req, d.username...)
+	req = append(req, byte(len(d.password)))
+	req = append(req, d.password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != 0 {
+		return errors.New("用户名或密码错误")
+	}
+	return nil
+}
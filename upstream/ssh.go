@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHConfig SSH跳板机配置
+type SSHConfig struct {
+	Host           string // 跳板机地址，默认端口22
+	User           string
+	KeyFile        string // 私钥文件路径
+	Password       string // 未配置私钥或私钥认证失败时使用
+	KnownHostsFile string // known_hosts文件路径，为空时使用 ~/.ssh/known_hosts
+
+	// 不校验跳板机的主机密钥，路径上的任何人都可以冒充跳板机获取密码和转发的数据，仅用于测试
+	InsecureIgnoreHostKey bool
+}
+
+// sshJump 维护到跳板机的SSH连接，断开后在下次连接时重新建立
+type sshJump struct {
+	addr   string
+	config *ssh.ClientConfig
+	via    *Dialer // 连接跳板机所用的上游代理
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// NewSSH 创建经由SSH跳板机连接目标的Dialer，via不为nil时通过该上游代理连接跳板机
+func NewSSH(cfg SSHConfig, via *Dialer) (*Dialer, error) {
+	if cfg.Host == "" || cfg.User == "" {
+		return nil, errors.New("SSH跳板机须配置host和user")
+	}
+
+	var auths []ssh.AuthMethod
+	if cfg.KeyFile != "" {
+		key, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("无法读取私钥: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("无法解析私钥: %w", err)
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auths = append(auths, ssh.Password(cfg.Password))
+	}
+	if len(auths) == 0 {
+		return nil, errors.New("SSH跳板机须配置key或password")
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if cfg.InsecureIgnoreHostKey {
+		log.Printf("SSH跳板机 %s 配置了insecure_ignore_host_key，将不校验主机密钥", cfg.Host)
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		file := cfg.KnownHostsFile
+		if file == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("未配置known_hosts且无法确定用户主目录: %w", err)
+			}
+			file = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		cb, err := knownhosts.New(file)
+		if err != nil {
+			return nil, fmt.Errorf("无法读取known_hosts: %w", err)
+		}
+		hostKeyCallback = cb
+	}
+
+	addr := cfg.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	jump := &sshJump{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            auths,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         handshakeTimeout,
+		},
+		via: via,
+	}
+	return &Dialer{scheme: "ssh", addr: addr, ssh: jump}, nil
+}
+
+// 返回当前的SSH连接，没有可用连接时建立新连接。建立连接时持有锁，
+// 连接跳板机和SSH握手都有超时，跳板机无响应时不会无限期阻塞其他连接
+func (j *sshJump) getClient() (*ssh.Client, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.client != nil {
+		return j.client, nil
+	}
+
+	conn, err := j.via.DialTimeout("tcp", j.addr, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// ClientConfig.Timeout只用于ssh.Dial，在已建立的连接上握手需要自行设置期限
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, j.addr, j.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+	j.client = client
+
+	// 连接断开后清除，下次使用时重连
+	go func() {
+		err := client.Wait()
+		log.Printf("与SSH跳板机 %s 的连接已断开: %v", j.addr, err)
+		j.mu.Lock()
+		if j.client == client {
+			j.client = nil
+		}
+		j.mu.Unlock()
+	}()
+	return client, nil
+}
+
+// 通过跳板机连接addr，timeout为等待跳板机打开通道的超时时间，0为默认值；
+// 连接失败时关闭可能已失效的SSH连接并重试一次
+func (j *sshJump) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = handshakeTimeout
+	}
+	for attempt := 0; ; attempt++ {
+		client, err := j.getClient()
+		if err != nil {
+			return nil, fmt.Errorf("无法连接SSH跳板机 %s: %w", j.addr, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		conn, err := client.DialContext(ctx, "tcp", addr)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		// 目标拒绝连接或连接目标超时时SSH连接本身仍然可用，不重试；
+		// 跳板机失去响应时底层TCP连接的keepalive会使连接断开，随后重新建立
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) || errors.Is(err, context.DeadlineExceeded) || attempt > 0 {
+			return nil, fmt.Errorf("SSH跳板机 %s: %w", j.addr, err)
+		}
+		client.Close()
+		j.mu.Lock()
+		if j.client == client {
+			j.client = nil
+		}
+		j.mu.Unlock()
+	}
+}
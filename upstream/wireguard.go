@@ -0,0 +1,21 @@
+package upstream
+
+import (
+	"net"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/wgnet"
+)
+
+// NewWireGuard 创建经由进程内WireGuard隧道连接目标的Dialer，多条规则可以共用同一个隧道
+func NewWireGuard(name string, n *wgnet.Net) *Dialer {
+	return &Dialer{scheme: "wireguard", addr: name, wg: n}
+}
+
+// 经隧道连接addr，timeout为0时使用默认值，避免隧道对端不可达时一直重传SYN
+func dialWireGuard(n *wgnet.Net, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = handshakeTimeout
+	}
+	return n.DialTimeout(addr, timeout)
+}
@@ -0,0 +1,149 @@
+// Package vhost 按HTTP请求的Host头选择目标，使多个Web后端共享一个转发端口；
+// 只读取连接上第一个请求的请求头，同一连接的后续请求转发到同一目标
+package vhost
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 请求头的最大长度，超过时放弃读取
+const maxHeaderBytes = 16 << 10
+
+// DefaultReadTimeout 等待客户端发完请求头的默认时长
+const DefaultReadTimeout = 10 * time.Second
+
+// ErrHeaderTooLarge 请求头超过maxHeaderBytes仍未结束
+var ErrHeaderTooLarge = fmt.Errorf("请求头超过%d字节", maxHeaderBytes)
+
+// Router 主机名到目标地址的映射
+type Router struct {
+	exact     map[string]string
+	wildcards []wildcard // 按后缀长度从长到短排列
+}
+
+type wildcard struct {
+	suffix string // 例如 ".example.com"
+	target string
+}
+
+// NewRouter 创建路由表，键为主机名或 "*.example.com" 形式的通配符(匹配所有子域名)，值为 "host:port"；routes为空时返回nil
+func NewRouter(routes map[string]string) (*Router, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	r := &Router{exact: make(map[string]string)}
+	for host, target := range routes {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("主机%s的目标地址无效: %w", host, err)
+		}
+		host = normalize(host)
+		if suffix, ok := strings.CutPrefix(host, "*"); ok {
+			if !strings.HasPrefix(suffix, ".") || len(suffix) < 2 {
+				return nil, fmt.Errorf("无效的通配符主机名: %s", host)
+			}
+			r.wildcards = append(r.wildcards, wildcard{suffix: suffix, target: target})
+			continue
+		}
+		if host == "" {
+			return nil, errors.New("主机名不能为空")
+		}
+		r.exact[host] = target
+	}
+	sort.Slice(r.wildcards, func(i, j int) bool { return len(r.wildcards[i].suffix) > len(r.wildcards[j].suffix) })
+	return r, nil
+}
+
+// Target 返回主机名对应的目标，精确匹配优先于通配符，没有匹配时返回false
+func (r *Router) Target(host string) (string, bool) {
+	if r == nil || host == "" {
+		return "", false
+	}
+	host = normalize(host)
+	if target, ok := r.exact[host]; ok {
+		return target, true
+	}
+	for _, w := range r.wildcards {
+		if strings.HasSuffix(host, w.suffix) {
+			return w.target, true
+		}
+	}
+	return "", false
+}
+
+// ReadHost 读取客户端第一个请求的请求头并返回其中的Host，没有Host头时返回空字符串；
+// 返回的连接会先读出已读取的数据，转发时须使用它代替conn
+func ReadHost(conn net.Conn, timeout time.Duration) (net.Conn, string, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	buf := make([]byte, maxHeaderBytes)
+	n := 0
+	for {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if end := headerEnd(buf[:n]); end >= 0 {
+			return &prefixConn{Conn: conn, prefix: buf[:n]}, findHost(buf[:end]), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if n == len(buf) {
+			return nil, "", ErrHeaderTooLarge
+		}
+	}
+}
+
+// 返回请求头结束(空行)的位置，尚未结束时返回-1
+func headerEnd(buf []byte) int {
+	if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+		return i
+	}
+	return bytes.Index(buf, []byte("\n\n"))
+}
+
+// 从请求头中找出Host头的值，跳过第一行的请求行
+func findHost(header []byte) string {
+	lines := strings.Split(string(header), "\n")
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "host") {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// 去掉端口和末尾的点并转为小写
+func normalize(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// 先读出已读取的请求头，再从原连接读取
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		if len(c.prefix) == 0 {
+			c.prefix = nil // 释放读取请求头的缓冲区
+		}
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
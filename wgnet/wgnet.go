@@ -0,0 +1,190 @@
+// Package wgnet 在进程内运行WireGuard隧道，经隧道与对端网络中的地址建立TCP连接，不需要创建系统网卡和root权限。
+// 隧道内的TCP/IP由wireguard-go的netstack(gVisor用户态协议栈)处理
+package wgnet
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// Config 隧道配置，与wg-quick配置文件中的同名项对应
+type Config struct {
+	PrivateKey string       // base64编码的本端私钥
+	Addresses  []netip.Addr // 本端在隧道内的地址
+	ListenPort int          // 0为随机端口
+	MTU        int          // 0为默认的1420
+	Peers      []Peer
+}
+
+// Peer 隧道对端
+type Peer struct {
+	PublicKey           string // base64编码
+	PresharedKey        string // base64编码，可为空
+	Endpoint            string // 对端的 "host:port"，可为空(等待对端连接)
+	AllowedIPs          []netip.Prefix
+	PersistentKeepalive time.Duration
+}
+
+// Net 运行中的隧道
+type Net struct {
+	name string
+	dev  *device.Device
+	tnet *netstack.Net
+}
+
+// New 创建并启动隧道，name用于日志
+func New(name string, cfg Config) (*Net, error) {
+	if len(cfg.Addresses) == 0 {
+		return nil, errors.New("未配置隧道内地址")
+	}
+	mtu := cfg.MTU
+	if mtu == 0 {
+		mtu = device.DefaultMTU
+	}
+	if mtu < 1280 || mtu > 65535 {
+		return nil, fmt.Errorf("无效的MTU %d", mtu)
+	}
+	uapi, err := uapiConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]netip.Addr, len(cfg.Addresses))
+	for i, a := range cfg.Addresses {
+		addrs[i] = a.Unmap()
+	}
+	tunDev, tnet, err := netstack.CreateNetTUN(addrs, nil, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("创建隧道失败: %w", err)
+	}
+
+	logger := &device.Logger{
+		Verbosef: device.DiscardLogf,
+		Errorf: func(format string, args ...any) {
+			log.Printf("WireGuard隧道[%s]: %s", name, fmt.Sprintf(format, args...))
+		},
+	}
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), logger)
+	if err := dev.IpcSet(uapi); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("配置隧道失败: %w", err)
+	}
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("启动隧道失败: %w", err)
+	}
+	return &Net{name: name, dev: dev, tnet: tnet}, nil
+}
+
+// uapiConfig 把配置转换为wireguard-go的配置协议格式
+func uapiConfig(cfg Config) (string, error) {
+	var b strings.Builder
+	key, err := hexKey(cfg.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("无效的private_key: %w", err)
+	}
+	fmt.Fprintf(&b, "private_key=%s\n", key)
+	if cfg.ListenPort != 0 {
+		fmt.Fprintf(&b, "listen_port=%d\n", cfg.ListenPort)
+	}
+	b.WriteString("replace_peers=true\n")
+	if len(cfg.Peers) == 0 {
+		return "", errors.New("未配置对端")
+	}
+	for i, p := range cfg.Peers {
+		key, err := hexKey(p.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("第%d个对端的public_key无效: %w", i+1, err)
+		}
+		fmt.Fprintf(&b, "public_key=%s\n", key)
+		if p.PresharedKey != "" {
+			key, err := hexKey(p.PresharedKey)
+			if err != nil {
+				return "", fmt.Errorf("第%d个对端的preshared_key无效: %w", i+1, err)
+			}
+			fmt.Fprintf(&b, "preshared_key=%s\n", key)
+		}
+		if p.Endpoint != "" {
+			// wireguard-go只接受IP地址，主机名在启动时解析一次
+			addr, err := net.ResolveUDPAddr("udp", p.Endpoint)
+			if err != nil {
+				return "", fmt.Errorf("第%d个对端的endpoint无效: %w", i+1, err)
+			}
+			ep := addr.AddrPort()
+			// IPv4地址须去掉映射前缀，否则wireguard-go会经IPv6套接字发送
+			fmt.Fprintf(&b, "endpoint=%s\n", netip.AddrPortFrom(ep.Addr().Unmap(), ep.Port()))
+		}
+		if p.PersistentKeepalive > 0 {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", int(p.PersistentKeepalive.Seconds()))
+		}
+		b.WriteString("replace_allowed_ips=true\n")
+		for _, prefix := range p.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", prefix.Masked())
+		}
+	}
+	return b.String(), nil
+}
+
+func hexKey(s string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	if len(key) != 32 {
+		return "", fmt.Errorf("密钥应为32字节，实际为%d字节", len(key))
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// DialTimeout 经隧道连接addr ("host:port")，主机名由系统解析器解析，timeout为0时不限制
+func (n *Net) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("无效的端口 %q", portStr)
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		c, err := n.tnet.DialContextTCPAddrPort(ctx, netip.AddrPortFrom(ip.Unmap(), uint16(port)))
+		if err == nil {
+			return c, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("经WireGuard隧道[%s]连接 %s 失败: %w", n.name, addr, lastErr)
+}
+
+// Close 关闭隧道，已建立的连接随之失效
+func (n *Net) Close() {
+	n.dev.Close()
+}
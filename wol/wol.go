@@ -0,0 +1,123 @@
+// Package wol 在目标无响应时发送网络唤醒(Wake-on-LAN)魔术包，并在主机启动期间重试连接，
+// 使平时休眠的服务器在有连接时自动唤醒
+package wol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Mxmilu666/nia-forwarding/logging"
+)
+
+// DefaultBroadcast 魔术包默认发往的地址
+const DefaultBroadcast = "255.255.255.255:9"
+
+// DefaultWait 发送魔术包后等待目标启动的默认时长
+const DefaultWait = 2 * time.Minute
+
+const (
+	retryInterval  = 2 * time.Second  // 等待目标启动期间重试连接的间隔
+	resendInterval = 10 * time.Second // 同一规则重新发送魔术包的最短间隔，等待中的多个连接共用
+)
+
+// Options 网络唤醒的配置
+type Options struct {
+	MAC       string        // 目标的MAC地址
+	Broadcast string        // 魔术包发往的地址 "host:port"，空为DefaultBroadcast
+	Wait      time.Duration // 发送魔术包后等待目标启动的时长，0为DefaultWait
+
+	Log *logging.Logger
+}
+
+// Waker 唤醒一个规则的目标，可在同一规则的多个代理间共享
+type Waker struct {
+	opts   Options
+	packet []byte
+
+	mu       sync.Mutex
+	lastSent time.Time
+}
+
+// New 创建网络唤醒，MAC地址无效时返回错误
+func New(opts Options) (*Waker, error) {
+	mac, err := net.ParseMAC(opts.MAC)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("无效的MAC地址: %q", opts.MAC)
+	}
+	if opts.Broadcast == "" {
+		opts.Broadcast = DefaultBroadcast
+	}
+	if opts.Wait <= 0 {
+		opts.Wait = DefaultWait
+	}
+	// 魔术包为6个0xff后接16次MAC地址
+	packet := append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(mac, 16)...)
+	return &Waker{opts: opts, packet: packet}, nil
+}
+
+// Asleep 判断连接错误是否表示目标可能在休眠：连接超时或主机不可达；w为nil时返回false
+func (w *Waker) Asleep(err error) bool {
+	if w == nil || err == nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.EHOSTDOWN)
+}
+
+// Dial 发送魔术包，并在等待时长内每隔2秒调用dial重试，直到连接成功或ctx取消；tag和target用于日志
+func (w *Waker) Dial(ctx context.Context, tag, target string, dial func() (net.Conn, error)) (net.Conn, error) {
+	start := time.Now()
+	timer := time.NewTimer(retryInterval)
+	defer timer.Stop()
+	var err error
+	for {
+		if sent, sendErr := w.send(); sendErr != nil {
+			w.opts.Log.Warnf("[%s] 无法发送网络唤醒数据包到 %s: %v", tag, w.opts.Broadcast, sendErr)
+		} else if sent {
+			w.opts.Log.Infof("[%s] 目标 %s 无响应，已向 %s 发送网络唤醒数据包", tag, target, w.opts.Broadcast)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		var conn net.Conn
+		if conn, err = dial(); err == nil {
+			w.opts.Log.Infof("[%s] 目标 %s 已唤醒，等待%s", tag, target, time.Since(start).Round(time.Second))
+			return conn, nil
+		}
+		if time.Since(start) >= w.opts.Wait {
+			return nil, fmt.Errorf("网络唤醒后%s内仍无法连接: %w", w.opts.Wait, err)
+		}
+		timer.Reset(retryInterval)
+	}
+}
+
+// 发送魔术包，距上次发送不足resendInterval时不发送；返回是否已发送
+func (w *Waker) send() (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if time.Since(w.lastSent) < resendInterval {
+		return false, nil
+	}
+	conn, err := net.Dial("udp", w.opts.Broadcast)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(w.packet); err != nil {
+		return false, err
+	}
+	w.lastSent = time.Now()
+	return true, nil
+}
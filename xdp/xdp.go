@@ -0,0 +1,22 @@
+// Package xdp 在网卡上挂载XDP程序，对已建立的UDP会话在内核中直接改写地址并转发数据包，
+// 只有会话的第一个数据包和会话管理经过Go，仅Linux支持且只处理IPv4。
+// 程序按增量更新UDP校验和，发送方使用校验和卸载的数据包(例如同一主机上经veth发来的)不能在内核中转发
+package xdp
+
+import (
+	"net"
+	"time"
+)
+
+// Flow 一个方向的地址改写：从Src发往Dst的数据包改写为从NewSrc发往NewDst
+type Flow struct {
+	Src, Dst       *net.UDPAddr
+	NewSrc, NewDst *net.UDPAddr
+}
+
+// Counter 一个方向经内核转发的数据包统计
+type Counter struct {
+	Packets uint64
+	Bytes   uint64    // UDP载荷字节数
+	Last    time.Time // 最后一个数据包的时间，没有数据包时为零值
+}
@@ -0,0 +1,386 @@
+//go:build linux
+
+package xdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Mxmilu666/nia-forwarding/ebpf"
+)
+
+// 会话表的大小，每个会话占两项
+const maxEntries = 1 << 17
+
+// 会话表的键和值，地址和端口均为网络字节序
+//
+//	键: saddr(4) daddr(4) sport(2) dport(2)
+//	值: 同样布局的改写后地址(12) 填充(4) packets(8) bytes(8) last_ns(8)
+const (
+	keySize      = 12
+	valueSize    = 40
+	offPackets   = 16
+	offBytes     = 24
+	offLastNanos = 32
+)
+
+// 以太网头、不带选项的IPv4头和UDP头的长度，以及各字段在数据包中的偏移
+const (
+	ethLen      = 14
+	ipLen       = 20
+	udpLen      = 8
+	offEthProto = 12
+	offIP       = ethLen
+	offTOS      = offIP + 1
+	offTotLen   = offIP + 2
+	offFrag     = offIP + 6
+	offTTL      = offIP + 8
+	offProto    = offIP + 9
+	offIPCheck  = offIP + 10
+	offAddrs    = offIP + 12 // saddr和daddr
+	offPorts    = offIP + ipLen
+	offUDPLen   = offPorts + 4
+	offUDPCheck = offPorts + 6
+)
+
+// bpf_fib_lookup参数在栈上的位置和字段偏移，共64字节，见 include/uapi/linux/bpf.h
+const (
+	fibBase    = -80
+	fibSize    = 64
+	fibIfindex = fibBase + 8
+	fibTOS     = fibBase + 12
+	fibSrc     = fibBase + 16
+	fibDst     = fibBase + 32
+	fibSMAC    = fibBase + 52
+	fibDMAC    = fibBase + 58
+	keyBase    = -16 // 查找会话表的键
+)
+
+// XDP程序的返回值
+const (
+	xdpPass = 2
+	xdpTX   = 3
+)
+
+// program 返回XDP程序：匹配会话表中的IPv4 UDP数据包，按表项改写地址和端口、更新校验和，
+// 经路由查找得到出口网卡和MAC地址后转发；不匹配或无法在内核中转发的数据包交给协议栈
+func program(sessions int) ([]ebpf.Insn, error) {
+	var a ebpf.Asm
+	R0, R1, R2, R3, R4, R5, R6, R7, R8, R9, R10 := ebpf.R0, ebpf.R1, ebpf.R2, ebpf.R3, ebpf.R4, ebpf.R5, ebpf.R6, ebpf.R7, ebpf.R8, ebpf.R9, ebpf.R10
+	fold := func(r uint8) {
+		for i := 0; i < 3; i++ {
+			a.Emit(
+				ebpf.MovReg(R1, r),
+				ebpf.ALU(unix.BPF_AND, R1, 0xffff),
+				ebpf.ALU(unix.BPF_RSH, r, 16),
+				ebpf.ALUReg(unix.BPF_ADD, r, R1),
+			)
+		}
+	}
+
+	// r6 = ctx, r7 = data, r8 = data_end，确认包含完整的以太网、IPv4和UDP头
+	a.Emit(
+		ebpf.MovReg(R6, R1),
+		ebpf.Load(unix.BPF_W, R7, R6, 0),
+		ebpf.Load(unix.BPF_W, R8, R6, 4),
+		ebpf.MovReg(R1, R7),
+		ebpf.ALU(unix.BPF_ADD, R1, ethLen+ipLen+udpLen),
+	)
+	a.JumpReg(unix.BPF_JGT, R1, R8, "pass")
+
+	// IPv4、无选项、UDP、非分片；以小端读取网络字节序的字段
+	a.Emit(ebpf.Load(unix.BPF_H, R1, R7, offEthProto))
+	a.Jump(unix.BPF_JNE, R1, 0x0008, "pass")
+	a.Emit(ebpf.Load(unix.BPF_B, R1, R7, offIP))
+	a.Jump(unix.BPF_JNE, R1, 0x45, "pass")
+	a.Emit(ebpf.Load(unix.BPF_B, R1, R7, offProto))
+	a.Jump(unix.BPF_JNE, R1, unix.IPPROTO_UDP, "pass")
+	a.Emit(
+		ebpf.Load(unix.BPF_H, R1, R7, offFrag),
+		ebpf.ALU(unix.BPF_AND, R1, 0xff3f), // MF标志和片偏移
+	)
+	a.Jump(unix.BPF_JNE, R1, 0, "pass")
+
+	// 以地址和端口查找会话，r9 = 表项
+	a.Emit(
+		ebpf.Load(unix.BPF_W, R1, R7, offAddrs),
+		ebpf.Store(unix.BPF_W, R10, keyBase, R1),
+		ebpf.Load(unix.BPF_W, R1, R7, offAddrs+4),
+		ebpf.Store(unix.BPF_W, R10, keyBase+4, R1),
+		ebpf.Load(unix.BPF_W, R1, R7, offPorts),
+		ebpf.Store(unix.BPF_W, R10, keyBase+8, R1),
+	)
+	a.Emit(ebpf.LoadMap(R1, sessions)...)
+	a.Emit(
+		ebpf.MovReg(R2, R10),
+		ebpf.ALU(unix.BPF_ADD, R2, keyBase),
+		ebpf.Call(ebpf.FuncMapLookupElem),
+	)
+	a.Jump(unix.BPF_JEQ, R0, 0, "pass")
+	a.Emit(ebpf.MovReg(R9, R0))
+
+	// 按改写后的地址查找路由和下一跳MAC，邻居未解析等情况交给协议栈处理
+	for off := int16(fibBase); off < fibBase+fibSize; off += 8 {
+		a.Emit(ebpf.StoreImm(unix.BPF_DW, R10, off, 0))
+	}
+	a.Emit(
+		ebpf.StoreImm(unix.BPF_B, R10, fibBase, unix.AF_INET),
+		ebpf.StoreImm(unix.BPF_B, R10, fibBase+1, unix.IPPROTO_UDP),
+		ebpf.Load(unix.BPF_H, R1, R9, 8),
+		ebpf.Store(unix.BPF_H, R10, fibBase+2, R1),
+		ebpf.Load(unix.BPF_H, R1, R9, 10),
+		ebpf.Store(unix.BPF_H, R10, fibBase+4, R1),
+		ebpf.Load(unix.BPF_W, R1, R6, 12), // ingress_ifindex
+		ebpf.Store(unix.BPF_W, R10, fibIfindex, R1),
+		ebpf.Load(unix.BPF_B, R1, R7, offTOS),
+		ebpf.Store(unix.BPF_B, R10, fibTOS, R1),
+		ebpf.Load(unix.BPF_W, R1, R9, 0),
+		ebpf.Store(unix.BPF_W, R10, fibSrc, R1),
+		ebpf.Load(unix.BPF_W, R1, R9, 4),
+		ebpf.Store(unix.BPF_W, R10, fibDst, R1),
+		ebpf.MovReg(R1, R6),
+		ebpf.MovReg(R2, R10),
+		ebpf.ALU(unix.BPF_ADD, R2, fibBase),
+		ebpf.Mov(R3, fibSize),
+		ebpf.Mov(R4, 0),
+		ebpf.Call(ebpf.FuncFibLookup),
+	)
+	a.Jump(unix.BPF_JNE, R0, 0, "pass")
+
+	// UDP校验和按改写前后的地址和端口增量更新，为0表示未使用校验和
+	a.Emit(ebpf.Load(unix.BPF_H, R1, R7, offUDPCheck))
+	a.Jump(unix.BPF_JEQ, R1, 0, "rewrite")
+	a.Emit(
+		ebpf.ALU(unix.BPF_XOR, R1, 0xffff),
+		ebpf.MovReg(R5, R1),
+		ebpf.MovReg(R1, R10),
+		ebpf.ALU(unix.BPF_ADD, R1, keyBase),
+		ebpf.Mov(R2, keySize),
+		ebpf.MovReg(R3, R9),
+		ebpf.Mov(R4, keySize),
+		ebpf.Call(ebpf.FuncCsumDiff),
+	)
+	fold(R0)
+	a.Emit(
+		ebpf.ALU(unix.BPF_XOR, R0, 0xffff),
+		ebpf.ALU(unix.BPF_AND, R0, 0xffff),
+	)
+	a.Jump(unix.BPF_JNE, R0, 0, "udpcheck")
+	a.Emit(ebpf.Mov(R0, 0xffff))
+	a.Label("udpcheck")
+	a.Emit(ebpf.Store(unix.BPF_H, R7, offUDPCheck, R0))
+
+	// 改写地址和端口，TTL重置为系统默认的64，重新计算IPv4头校验和
+	a.Label("rewrite")
+	a.Emit(
+		ebpf.Load(unix.BPF_W, R1, R9, 0),
+		ebpf.Store(unix.BPF_W, R7, offAddrs, R1),
+		ebpf.Load(unix.BPF_W, R1, R9, 4),
+		ebpf.Store(unix.BPF_W, R7, offAddrs+4, R1),
+		ebpf.Load(unix.BPF_W, R1, R9, 8),
+		ebpf.Store(unix.BPF_W, R7, offPorts, R1),
+		ebpf.StoreImm(unix.BPF_B, R7, offTTL, 64),
+		ebpf.StoreImm(unix.BPF_H, R7, offIPCheck, 0),
+		ebpf.Mov(R1, 0),
+		ebpf.Mov(R2, 0),
+		ebpf.MovReg(R3, R7),
+		ebpf.ALU(unix.BPF_ADD, R3, offIP),
+		ebpf.Mov(R4, ipLen),
+		ebpf.Mov(R5, 0),
+		ebpf.Call(ebpf.FuncCsumDiff),
+	)
+	fold(R0)
+	a.Emit(
+		ebpf.ALU(unix.BPF_XOR, R0, 0xffff),
+		ebpf.Store(unix.BPF_H, R7, offIPCheck, R0),
+	)
+
+	// 目的MAC和源MAC，栈上的MAC只按2字节对齐
+	for i := int16(0); i < 6; i += 2 {
+		a.Emit(
+			ebpf.Load(unix.BPF_H, R1, R10, fibDMAC+i),
+			ebpf.Store(unix.BPF_H, R7, i, R1),
+			ebpf.Load(unix.BPF_H, R1, R10, fibSMAC+i),
+			ebpf.Store(unix.BPF_H, R7, 6+i, R1),
+		)
+	}
+
+	// 统计包数、载荷字节数和最后一个数据包的时间
+	a.Emit(
+		ebpf.Mov(R1, 1),
+		ebpf.AtomicAdd(unix.BPF_DW, R9, offPackets, R1),
+		ebpf.Load(unix.BPF_H, R1, R7, offUDPLen),
+		ebpf.ToBE(R1, 16),
+		ebpf.ALU(unix.BPF_SUB, R1, udpLen),
+		ebpf.AtomicAdd(unix.BPF_DW, R9, offBytes, R1),
+		ebpf.Call(ebpf.FuncKtimeGetNs),
+		ebpf.Store(unix.BPF_DW, R9, offLastNanos, R0),
+	)
+
+	// 出口与入口为同一网卡时原路发回，否则重定向到出口网卡
+	a.Emit(
+		ebpf.Load(unix.BPF_W, R1, R10, fibIfindex),
+		ebpf.Load(unix.BPF_W, R2, R6, 12),
+	)
+	a.JumpReg(unix.BPF_JEQ, R1, R2, "tx")
+	a.Emit(
+		ebpf.Mov(R2, 0),
+		ebpf.Call(ebpf.FuncRedirect),
+		ebpf.Exit(),
+	)
+	a.Label("tx")
+	a.Emit(ebpf.Mov(R0, xdpTX), ebpf.Exit())
+	a.Label("pass")
+	a.Emit(ebpf.Mov(R0, xdpPass), ebpf.Exit())
+	return a.Program()
+}
+
+// Forwarder 挂在网卡上的XDP程序和所有规则共享的会话表
+type Forwarder struct {
+	sessions int
+	prog     int
+	links    []int
+}
+
+// New 加载XDP程序并挂到ifaces中的每个网卡，内核不支持或没有CAP_BPF/CAP_NET_ADMIN权限时返回错误；
+// 进程退出时程序自动卸载
+func New(ifaces []string) (*Forwarder, error) {
+	if len(ifaces) == 0 {
+		return nil, errors.New("没有配置挂载XDP程序的网卡")
+	}
+	sessions, err := ebpf.CreateMap(unix.BPF_MAP_TYPE_HASH, keySize, valueSize, maxEntries)
+	if err != nil {
+		return nil, fmt.Errorf("无法创建XDP会话表: %w", err)
+	}
+	f := &Forwarder{sessions: sessions, prog: -1}
+	insns, err := program(sessions)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if f.prog, err = ebpf.LoadProgram(unix.BPF_PROG_TYPE_XDP, insns); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("无法加载XDP程序: %w", err)
+	}
+	for _, name := range ifaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		link, err := ebpf.CreateLink(f.prog, iface.Index, unix.BPF_XDP, 0)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("无法把XDP程序挂到网卡%s: %w", name, err)
+		}
+		f.links = append(f.links, link)
+	}
+	return f, nil
+}
+
+// Close 从网卡卸载程序并释放会话表
+func (f *Forwarder) Close() {
+	if f == nil {
+		return
+	}
+	for _, link := range f.links {
+		unix.Close(link)
+	}
+	if f.prog >= 0 {
+		unix.Close(f.prog)
+	}
+	unix.Close(f.sessions)
+}
+
+// Session 在内核中转发的一个UDP会话
+type Session struct {
+	f        *Forwarder
+	up, down []byte // 两个方向的键
+}
+
+// Add 添加会话的两个方向，所有地址须为IPv4
+func (f *Forwarder) Add(up, down Flow) (*Session, error) {
+	if f == nil {
+		return nil, errors.New("XDP转发不可用")
+	}
+	upKey, upValue, err := up.encode()
+	if err != nil {
+		return nil, err
+	}
+	downKey, downValue, err := down.encode()
+	if err != nil {
+		return nil, err
+	}
+	if err := ebpf.UpdateElem(f.sessions, upKey, upValue); err != nil {
+		return nil, fmt.Errorf("无法写入XDP会话表: %w", err)
+	}
+	if err := ebpf.UpdateElem(f.sessions, downKey, downValue); err != nil {
+		ebpf.DeleteElem(f.sessions, upKey)
+		return nil, fmt.Errorf("无法写入XDP会话表: %w", err)
+	}
+	return &Session{f: f, up: upKey, down: downKey}, nil
+}
+
+// 返回表项的键和值
+func (fl Flow) encode() (key, value []byte, err error) {
+	key, err = appendAddrs(nil, fl.Src, fl.Dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err = appendAddrs(make([]byte, 0, valueSize), fl.NewSrc, fl.NewDst)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, value[:valueSize], nil
+}
+
+func appendAddrs(b []byte, src, dst *net.UDPAddr) ([]byte, error) {
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		return nil, fmt.Errorf("XDP转发只支持IPv4地址: %s -> %s", src, dst)
+	}
+	b = append(append(b, srcIP...), dstIP...)
+	b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+	return binary.BigEndian.AppendUint16(b, uint16(dst.Port)), nil
+}
+
+// Counters 返回两个方向经内核转发的累计统计
+func (s *Session) Counters() (up, down Counter) {
+	if s == nil {
+		return Counter{}, Counter{}
+	}
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	now, mono := time.Now(), ts.Nano()
+	return s.counter(s.up, now, mono), s.counter(s.down, now, mono)
+}
+
+func (s *Session) counter(key []byte, now time.Time, mono int64) Counter {
+	value := make([]byte, valueSize)
+	if ebpf.LookupElem(s.f.sessions, key, value) != nil {
+		return Counter{}
+	}
+	c := Counter{
+		Packets: binary.NativeEndian.Uint64(value[offPackets:]),
+		Bytes:   binary.NativeEndian.Uint64(value[offBytes:]),
+	}
+	// 程序记录的是单调时钟
+	if last := int64(binary.NativeEndian.Uint64(value[offLastNanos:])); last > 0 {
+		c.Last = now.Add(-time.Duration(mono - last))
+	}
+	return c
+}
+
+// Delete 删除会话，此后的数据包交给协议栈
+func (s *Session) Delete() {
+	if s == nil {
+		return
+	}
+	ebpf.DeleteElem(s.f.sessions, s.up)
+	ebpf.DeleteElem(s.f.sessions, s.down)
+}
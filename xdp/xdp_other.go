@@ -0,0 +1,34 @@
+//go:build !linux
+
+package xdp
+
+import "errors"
+
+var errUnsupported = errors.New("仅Linux支持XDP转发")
+
+// Forwarder 在该平台上不可用
+type Forwarder struct{}
+
+// New 在该平台上返回错误
+func New(ifaces []string) (*Forwarder, error) {
+	return nil, errUnsupported
+}
+
+// Close 无操作
+func (f *Forwarder) Close() {}
+
+// Session 在该平台上不可用
+type Session struct{}
+
+// Add 在该平台上返回错误
+func (f *Forwarder) Add(up, down Flow) (*Session, error) {
+	return nil, errUnsupported
+}
+
+// Counters 始终返回零值
+func (s *Session) Counters() (up, down Counter) {
+	return Counter{}, Counter{}
+}
+
+// Delete 无操作
+func (s *Session) Delete() {}